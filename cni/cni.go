@@ -4,6 +4,8 @@
 package cni
 
 import (
+	"github.com/Azure/azure-container-networking/common"
+
 	cniSkel "github.com/containernetworking/cni/pkg/skel"
 )
 
@@ -16,12 +18,24 @@ const (
 	CmdUpdate = "UPDATE"
 
 	// CNI errors.
-	ErrRuntime = 100
+	ErrUnknownContainer     = 3
+	ErrInvalidNetworkConfig = 7
+	ErrTryAgainLater        = 11
+	ErrRuntime              = 100
 
 	// DefaultVersion is the CNI version used when no version is specified in a network config file.
 	defaultVersion = "0.2.0"
 )
 
+// CNI error codes of failures with error codes, for those not reported as ErrRuntime.
+var cniErrorCodes = map[common.ErrorCode]uint{
+	common.ErrCodeInvalidConfig:        ErrInvalidNetworkConfig,
+	common.ErrCodeEndpointNotFound:     ErrUnknownContainer,
+	common.ErrCodeHNSTimeout:           ErrTryAgainLater,
+	common.ErrCodeHostUnreachable:      ErrTryAgainLater,
+	common.ErrCodeAddressPoolExhausted: ErrTryAgainLater,
+}
+
 // Supported CNI versions.
 var supportedVersions = []string{"0.1.0", "0.2.0", "0.3.0", "0.3.1", "0.4.0"}
 
@@ -26,6 +26,7 @@ const (
 
 var (
 	ipv4DefaultRouteDstPrefix = net.IPNet{net.IPv4zero, net.IPv4Mask(0, 0, 0, 0)}
+	ipv6DefaultRouteDstPrefix = net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
 )
 
 // IpamPlugin represents the CNI IPAM plugin.
@@ -150,46 +151,129 @@ func (plugin *ipamPlugin) Add(args *cniSkel.CmdArgs) error {
 		return err
 	}
 
+	if err = nwCfg.Validate(); err != nil {
+		err = plugin.Errorf("Invalid network configuration: %v", err)
+		return err
+	}
+
+	// Record the container as the owner of the addresses, unless another owner is specified.
+	options := make(map[string]string)
+	options[ipam.OptAddressOwner] = nwCfg.Ipam.Owner
+	if nwCfg.Ipam.Owner == "" {
+		options[ipam.OptAddressOwner] = args.ContainerID
+	}
+
+	// Restrict address requests to the requested address family.
+	if nwCfg.Ipam.AddressFamily != "" {
+		options[ipam.OptAddressFamily] = nwCfg.Ipam.AddressFamily
+	}
+
 	// Check if an address pool is specified.
+	subnets := []string{nwCfg.Ipam.Subnet}
 	if nwCfg.Ipam.Subnet == "" {
-		var poolID string
-		var subnet string
+		subnets = nil
 
-		// Select the requested interface.
-		options := make(map[string]string)
-		options[ipam.OptInterfaceName] = nwCfg.Master
+		// Allocate an address pool of each requested address family.
+		for _, v6 := range addressFamilies(nwCfg.Ipam.AddressFamily) {
+			var poolID string
+			var subnet string
 
-		// Allocate an address pool.
-		poolID, subnet, err = plugin.am.RequestPool(nwCfg.Ipam.AddrSpace, "", "", options, false)
+			// Select the requested interface.
+			poolOptions := make(map[string]string)
+			poolOptions[ipam.OptInterfaceName] = nwCfg.Master
+
+			poolID, subnet, err = plugin.am.RequestPool(nwCfg.Ipam.AddrSpace, "", "", poolOptions, v6)
+			if err != nil {
+				err = plugin.Errorf("Failed to allocate pool: %v", err)
+				return err
+			}
+
+			// On failure, release the address pool.
+			defer func() {
+				if err != nil && poolID != "" {
+					log.Printf("[cni-ipam] Releasing pool %v.", poolID)
+					plugin.am.ReleasePool(nwCfg.Ipam.AddrSpace, poolID)
+				}
+			}()
+
+			subnets = append(subnets, subnet)
+			log.Printf("[cni-ipam] Allocated address poolID %v with subnet %v.", poolID, subnet)
+		}
+	}
+
+	result = &cniTypesCurr.Result{}
+
+	// Allocate an address for the endpoint from each pool.
+	for _, subnet := range subnets {
+		var ipConfig *cniTypesCurr.IPConfig
+		var apInfo *ipam.AddressPoolInfo
+
+		ipConfig, apInfo, err = plugin.requestAddress(nwCfg, subnet, options)
 		if err != nil {
-			err = plugin.Errorf("Failed to allocate pool: %v", err)
 			return err
 		}
 
-		// On failure, release the address pool.
-		defer func() {
-			if err != nil && poolID != "" {
-				log.Printf("[cni-ipam] Releasing pool %v.", poolID)
-				plugin.am.ReleasePool(nwCfg.Ipam.AddrSpace, poolID)
+		// On failure, release the address.
+		defer func(subnet string, address net.IP) {
+			if err != nil {
+				log.Printf("[cni-ipam] Releasing address %v.", address)
+				plugin.am.ReleaseAddress(nwCfg.Ipam.AddrSpace, subnet, address.String(), nil)
 			}
-		}()
+		}(subnet, ipConfig.Address.IP)
 
-		nwCfg.Ipam.Subnet = subnet
-		log.Printf("[cni-ipam] Allocated address poolID %v with subnet %v.", poolID, subnet)
+		// Populate result.
+		defaultRouteDstPrefix := ipv4DefaultRouteDstPrefix
+		if apInfo.IsIPv6 {
+			defaultRouteDstPrefix = ipv6DefaultRouteDstPrefix
+		}
+
+		result.IPs = append(result.IPs, ipConfig)
+		result.Routes = append(result.Routes, &cniTypes.Route{
+			Dst: defaultRouteDstPrefix,
+			GW:  apInfo.Gateway,
+		})
+
+		// Populate DNS servers.
+		for _, dnsServer := range apInfo.DnsServers {
+			if !containsString(result.DNS.Nameservers, dnsServer.String()) {
+				result.DNS.Nameservers = append(result.DNS.Nameservers, dnsServer.String())
+			}
+		}
 	}
 
-	// Allocate an address for the endpoint.
-	address, err := plugin.am.RequestAddress(nwCfg.Ipam.AddrSpace, nwCfg.Ipam.Subnet, nwCfg.Ipam.Address, nil)
+	// Convert result to the requested CNI version.
+	res, err := result.GetAsVersion(nwCfg.CNIVersion)
 	if err != nil {
-		err = plugin.Errorf("Failed to allocate address: %v", err)
+		err = plugin.Errorf("Failed to convert result: %v", err)
 		return err
 	}
 
+	// Output the result.
+	if nwCfg.Ipam.Type == cni.Internal {
+		// Called via the internal interface. Pass output back in args.
+		args.StdinData, _ = json.Marshal(res)
+	} else {
+		// Called via the executable interface. Print output to stdout.
+		res.Print()
+	}
+
+	return nil
+}
+
+// requestAddress allocates an address from the given pool and returns its IP configuration
+// along with the pool information.
+func (plugin *ipamPlugin) requestAddress(nwCfg *cni.NetworkConfig, subnet string, options map[string]string) (*cniTypesCurr.IPConfig, *ipam.AddressPoolInfo, error) {
+	address, err := plugin.am.RequestAddress(nwCfg.Ipam.AddrSpace, subnet, nwCfg.Ipam.Address, options)
+	if err != nil {
+		err = plugin.Errorf("Failed to allocate address: %v", err)
+		return nil, nil, err
+	}
+
 	// On failure, release the address.
 	defer func() {
-		if err != nil && address != "" {
+		if err != nil {
 			log.Printf("[cni-ipam] Releasing address %v.", address)
-			plugin.am.ReleaseAddress(nwCfg.Ipam.AddrSpace, nwCfg.Ipam.Subnet, address, nil)
+			plugin.am.ReleaseAddress(nwCfg.Ipam.AddrSpace, subnet, address, nil)
 		}
 	}()
 
@@ -199,55 +283,51 @@ func (plugin *ipamPlugin) Add(args *cniSkel.CmdArgs) error {
 	ipAddress, err := platform.ConvertStringToIPNet(address)
 	if err != nil {
 		err = plugin.Errorf("Failed to parse address: %v", err)
-		return err
+		return nil, nil, err
 	}
 
 	// Query pool information for gateways and DNS servers.
-	apInfo, err := plugin.am.GetPoolInfo(nwCfg.Ipam.AddrSpace, nwCfg.Ipam.Subnet)
+	apInfo, err := plugin.am.GetPoolInfo(nwCfg.Ipam.AddrSpace, subnet)
 	if err != nil {
 		err = plugin.Errorf("Failed to get pool information: %v", err)
-		return err
+		return nil, nil, err
 	}
 
-	// Populate result.
-	result = &cniTypesCurr.Result{
-		IPs: []*cniTypesCurr.IPConfig{
-			{
-				Version: "4",
-				Address: *ipAddress,
-				Gateway: apInfo.Gateway,
-			},
-		},
-		Routes: []*cniTypes.Route{
-			{
-				Dst: ipv4DefaultRouteDstPrefix,
-				GW:  apInfo.Gateway,
-			},
-		},
+	version := "4"
+	if apInfo.IsIPv6 {
+		version = "6"
 	}
 
-	// Populate DNS servers.
-	for _, dnsServer := range apInfo.DnsServers {
-		result.DNS.Nameservers = append(result.DNS.Nameservers, dnsServer.String())
+	ipConfig := &cniTypesCurr.IPConfig{
+		Version: version,
+		Address: *ipAddress,
+		Gateway: apInfo.Gateway,
 	}
 
-	// Convert result to the requested CNI version.
-	res, err := result.GetAsVersion(nwCfg.CNIVersion)
-	if err != nil {
-		err = plugin.Errorf("Failed to convert result: %v", err)
-		return err
+	return ipConfig, apInfo, nil
+}
+
+// addressFamilies returns whether to allocate an IPv6 pool for each of the given address families.
+func addressFamilies(family string) []bool {
+	switch family {
+	case cni.IpamAddressFamilyIPv6:
+		return []bool{true}
+	case cni.IpamAddressFamilyBoth:
+		return []bool{false, true}
+	default:
+		return []bool{false}
 	}
+}
 
-	// Output the result.
-	if nwCfg.Ipam.Type == cni.Internal {
-		// Called via the internal interface. Pass output back in args.
-		args.StdinData, _ = json.Marshal(res)
-	} else {
-		// Called via the executable interface. Print output to stdout.
-		res.Print()
+// containsString returns whether the list contains the given string.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
 	}
 
-	return nil
+	return false
 }
 
 // Get handles CNI Get commands.
@@ -271,7 +351,8 @@ func (plugin *ipamPlugin) Delete(args *cniSkel.CmdArgs) error {
 		return err
 	}
 
-	// If an address is specified, release that address. Otherwise, release the pool.
+	// If an address is specified, release that address. If an owner is specified, release the
+	// addresses of that owner. Otherwise, release the pool.
 	if nwCfg.Ipam.Address != "" {
 		// Release the address.
 		err := plugin.am.ReleaseAddress(nwCfg.Ipam.AddrSpace, nwCfg.Ipam.Subnet, nwCfg.Ipam.Address, nil)
@@ -279,6 +360,15 @@ func (plugin *ipamPlugin) Delete(args *cniSkel.CmdArgs) error {
 			err = plugin.Errorf("Failed to release address: %v", err)
 			return err
 		}
+	} else if nwCfg.Ipam.Owner != "" {
+		// Release the addresses of the owner.
+		addresses, err := plugin.am.ReleaseAddressesByOwner(nwCfg.Ipam.AddrSpace, nwCfg.Ipam.Subnet, nwCfg.Ipam.Owner)
+		if err != nil {
+			err = plugin.Errorf("Failed to release addresses: %v", err)
+			return err
+		}
+
+		log.Printf("[cni-ipam] Released addresses %v of owner %v.", addresses, nwCfg.Ipam.Owner)
 	} else {
 		// Release the pool.
 		err := plugin.am.ReleasePool(nwCfg.Ipam.AddrSpace, nwCfg.Ipam.Subnet)
@@ -5,8 +5,10 @@ package cni
 
 import (
 	"encoding/json"
+	"fmt"
 	"strings"
 
+	"github.com/Azure/azure-container-networking/common"
 	"github.com/Azure/azure-container-networking/network/policy"
 
 	cniTypes "github.com/containernetworking/cni/pkg/types"
@@ -14,6 +16,18 @@ import (
 
 const (
 	PolicyStr string = "Policy"
+
+	// Ranges of network config values.
+	minMTU     = 68
+	maxMTU     = 65535
+	maxVlanID  = 4094
+	maxVxlanID = 1<<24 - 1
+	maxPortNum = 65535
+
+	// Address families of the IPAM config.
+	IpamAddressFamilyIPv4 = "ipv4"
+	IpamAddressFamilyIPv6 = "ipv6"
+	IpamAddressFamilyBoth = "both"
 )
 
 // KVPair represents a K-V pair of a json object.
@@ -29,35 +43,74 @@ type PortMapping struct {
 	HostIp        string `json:"hostIP,omitempty"`
 }
 
+// RouteEntry represents a custom route to program in the container network namespace.
+type RouteEntry struct {
+	Dst    string `json:"dst"`
+	Gw     string `json:"gw,omitempty"`
+	Src    string `json:"src,omitempty"`
+	Dev    string `json:"dev,omitempty"`
+	Metric int    `json:"metric,omitempty"`
+	Scope  string `json:"scope,omitempty"`
+}
+
+// BandwidthEntry represents the bandwidth capability of the runtime config, in bits per second.
+type BandwidthEntry struct {
+	IngressRate  int `json:"ingressRate,omitempty"`
+	IngressBurst int `json:"ingressBurst,omitempty"`
+	EgressRate   int `json:"egressRate,omitempty"`
+	EgressBurst  int `json:"egressBurst,omitempty"`
+}
+
 type RuntimeConfig struct {
-	PortMappings []PortMapping `json:"portMappings,omitempty"`
+	PortMappings []PortMapping   `json:"portMappings,omitempty"`
+	Bandwidth    *BandwidthEntry `json:"bandwidth,omitempty"`
 }
 
 // NetworkConfig represents Azure CNI plugin network configuration.
 type NetworkConfig struct {
-	CNIVersion                 string   `json:"cniVersion"`
-	Name                       string   `json:"name"`
-	Type                       string   `json:"type"`
-	Mode                       string   `json:"mode"`
-	Master                     string   `json:"master"`
-	Bridge                     string   `json:"bridge,omitempty"`
-	LogLevel                   string   `json:"logLevel,omitempty"`
-	LogTarget                  string   `json:"logTarget,omitempty"`
-	InfraVnetAddressSpace      string   `json:"infraVnetAddressSpace,omitempty"`
-	PodNamespaceForDualNetwork []string `json:"podNamespaceForDualNetwork,omitempty"`
-	MultiTenancy               bool     `json:"multiTenancy,omitempty"`
-	EnableSnatOnHost           bool     `json:"enableSnatOnHost,omitempty"`
-	EnableExactMatchForPodName bool     `json:"enableExactMatchForPodName,omitempty"`
-	CNSUrl                     string   `json:"cnsurl,omitempty"`
+	CNIVersion                 string                       `json:"cniVersion"`
+	Name                       string                       `json:"name"`
+	Type                       string                       `json:"type"`
+	Mode                       string                       `json:"mode"`
+	Master                     string                       `json:"master"`
+	Bridge                     string                       `json:"bridge,omitempty"`
+	LogLevel                   string                       `json:"logLevel,omitempty"`
+	LogTarget                  string                       `json:"logTarget,omitempty"`
+	InfraVnetAddressSpace      string                       `json:"infraVnetAddressSpace,omitempty"`
+	PodNamespaceForDualNetwork []string                     `json:"podNamespaceForDualNetwork,omitempty"`
+	MultiTenancy               bool                         `json:"multiTenancy,omitempty"`
+	EnableSnatOnHost           bool                         `json:"enableSnatOnHost,omitempty"`
+	EnableExactMatchForPodName bool                         `json:"enableExactMatchForPodName,omitempty"`
+	HashedEndpointID           bool                         `json:"hashedEndpointID,omitempty"`
+	HNSTimeoutSeconds          int                          `json:"hnsTimeoutSeconds,omitempty"`
+	HNSRetryAttempts           int                          `json:"hnsRetryAttempts,omitempty"`
+	HNSRetryInitialBackoffMs   int                          `json:"hnsRetryInitialBackoffMs,omitempty"`
+	HNSRetryMaxBackoffMs       int                          `json:"hnsRetryMaxBackoffMs,omitempty"`
+	EnableLoopbackDSR          bool                         `json:"enableLoopbackDSR,omitempty"`
+	MTU                        int                          `json:"mtu,omitempty"`
+	IpvlanMode                 string                       `json:"ipvlanMode,omitempty"`
+	VlanId                     int                          `json:"vlanId,omitempty"`
+	VxlanId                    int                          `json:"vxlanId,omitempty"`
+	VxlanPort                  int                          `json:"vxlanPort,omitempty"`
+	AllowOverlappingSubnets    bool                         `json:"allowOverlappingSubnets,omitempty"`
+	DisableTxChecksumOffload   bool                         `json:"disableTxChecksumOffload,omitempty"`
+	Routes                     []RouteEntry                 `json:"routes,omitempty"`
+	Sysctls                    map[string]string            `json:"sysctls,omitempty"`
+	NetworkPolicies            []policy.NetworkScopedPolicy `json:"networkPolicies,omitempty"`
+	CNSUrl                     string                       `json:"cnsurl,omitempty"`
+	EnableHNSV2                bool                         `json:"enableHnsV2,omitempty"`
 	Ipam                       struct {
 		Type          string `json:"type"`
 		Environment   string `json:"environment,omitempty"`
 		AddrSpace     string `json:"addressSpace,omitempty"`
 		Subnet        string `json:"subnet,omitempty"`
 		Address       string `json:"ipAddress,omitempty"`
+		AddressFamily string `json:"addressFamily,omitempty"`
+		Owner         string `json:"owner,omitempty"`
 		QueryInterval string `json:"queryInterval,omitempty"`
 	}
 	DNS            cniTypes.DNS  `json:"dns"`
+	NetworkDNS     *cniTypes.DNS `json:"networkDns,omitempty"`
 	RuntimeConfig  RuntimeConfig `json:"runtimeConfig"`
 	AdditionalArgs []KVPair
 }
@@ -67,6 +120,7 @@ type K8SPodEnvArgs struct {
 	K8S_POD_NAMESPACE          cniTypes.UnmarshallableString `json:"K8S_POD_NAMESPACE,omitempty"`
 	K8S_POD_NAME               cniTypes.UnmarshallableString `json:"K8S_POD_NAME,omitempty"`
 	K8S_POD_INFRA_CONTAINER_ID cniTypes.UnmarshallableString `json:"K8S_POD_INFRA_CONTAINER_ID,omitempty"`
+	MAC                        cniTypes.UnmarshallableString `json:"MAC,omitempty"`
 }
 
 // ParseCniArgs unmarshals cni arguments.
@@ -96,6 +150,78 @@ func ParseNetworkConfig(b []byte) (*NetworkConfig, error) {
 	return &nwCfg, nil
 }
 
+// Validate checks the ranges of the network config values and that they are consistent. The
+// returned error lists every invalid field by its JSON name. It is not called by ParseNetworkConfig,
+// so that commands cleaning up after a config can still parse it.
+func (nwcfg *NetworkConfig) Validate() error {
+	var configErr common.ConfigError
+
+	if nwcfg.MTU != 0 && (nwcfg.MTU < minMTU || nwcfg.MTU > maxMTU) {
+		configErr.Add("mtu", "Value %v is not between %v and %v", nwcfg.MTU, minMTU, maxMTU)
+	}
+
+	if nwcfg.VlanId < 0 || nwcfg.VlanId > maxVlanID {
+		configErr.Add("vlanId", "Value %v is not between 0 and %v", nwcfg.VlanId, maxVlanID)
+	}
+
+	if nwcfg.VxlanId < 0 || nwcfg.VxlanId > maxVxlanID {
+		configErr.Add("vxlanId", "Value %v is not between 0 and %v", nwcfg.VxlanId, maxVxlanID)
+	}
+
+	if nwcfg.VxlanPort < 0 || nwcfg.VxlanPort > maxPortNum {
+		configErr.Add("vxlanPort", "Value %v is not between 0 and %v", nwcfg.VxlanPort, maxPortNum)
+	}
+
+	if nwcfg.VlanId != 0 && nwcfg.VxlanId != 0 {
+		configErr.Add("vxlanId", "Cannot be set with vlanId")
+	}
+
+	if nwcfg.VxlanPort != 0 && nwcfg.VxlanId == 0 {
+		configErr.Add("vxlanPort", "Requires vxlanId")
+	}
+
+	switch nwcfg.IpvlanMode {
+	case "", "l2", "l3":
+	default:
+		configErr.Add("ipvlanMode", "Value %v is not one of l2, l3", nwcfg.IpvlanMode)
+	}
+
+	if nwcfg.HNSTimeoutSeconds < 0 {
+		configErr.Add("hnsTimeoutSeconds", "Value %v is negative", nwcfg.HNSTimeoutSeconds)
+	}
+
+	if nwcfg.HNSRetryAttempts < 0 {
+		configErr.Add("hnsRetryAttempts", "Value %v is negative", nwcfg.HNSRetryAttempts)
+	}
+
+	if nwcfg.HNSRetryInitialBackoffMs < 0 {
+		configErr.Add("hnsRetryInitialBackoffMs", "Value %v is negative", nwcfg.HNSRetryInitialBackoffMs)
+	}
+
+	if nwcfg.HNSRetryMaxBackoffMs < 0 {
+		configErr.Add("hnsRetryMaxBackoffMs", "Value %v is negative", nwcfg.HNSRetryMaxBackoffMs)
+	}
+
+	switch nwcfg.Ipam.AddressFamily {
+	case "", IpamAddressFamilyIPv4, IpamAddressFamilyIPv6:
+	case IpamAddressFamilyBoth:
+		if nwcfg.Ipam.Address != "" {
+			configErr.Add("ipam.ipAddress", "Cannot be set with addressFamily %v", nwcfg.Ipam.AddressFamily)
+		}
+	default:
+		configErr.Add("ipam.addressFamily", "Value %v is not one of %v, %v, %v",
+			nwcfg.Ipam.AddressFamily, IpamAddressFamilyIPv4, IpamAddressFamilyIPv6, IpamAddressFamilyBoth)
+	}
+
+	for i, route := range nwcfg.Routes {
+		if route.Dst == "" {
+			configErr.Add(fmt.Sprintf("routes[%v].dst", i), "Value is empty")
+		}
+	}
+
+	return configErr.Err()
+}
+
 // GetPoliciesFromNwCfg returns network policies from network config.
 func GetPoliciesFromNwCfg(kvp []KVPair) []policy.Policy {
 	var policies []policy.Policy
@@ -0,0 +1,16 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"github.com/Azure/azure-container-networking/common"
+)
+
+var (
+	// Metrics of the CNI network plugin, reported in the telemetry report of each invocation.
+	addDuration = common.NewHistogram(
+		"cni_add_duration_seconds", "Duration of ADD commands.", common.DefaultDurationBuckets)
+	addFailures = common.NewCounter(
+		"cni_add_failures_total", "Number of ADD commands that failed.")
+)
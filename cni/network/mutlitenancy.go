@@ -159,7 +159,7 @@ func getInfraVnetIP(
 		nwCfg.Ipam.Subnet = ipNet.String()
 
 		log.Printf("call ipam to allocate ip from subnet %v", nwCfg.Ipam.Subnet)
-		azIpamResult, err := plugin.DelegateAdd(nwCfg.Ipam.Type, nwCfg)
+		azIpamResult, err := plugin.ipam.DelegateAdd(nwCfg.Ipam.Type, nwCfg)
 		if err != nil {
 			err = plugin.Errorf("Failed to allocate address: %v", err)
 			return nil, err
@@ -183,7 +183,7 @@ func cleanupInfraVnetIP(
 		_, ipNet, _ := net.ParseCIDR(infraIPNet.String())
 		nwCfg.Ipam.Subnet = ipNet.String()
 		nwCfg.Ipam.Address = infraIPNet.IP.String()
-		plugin.DelegateDel(nwCfg.Ipam.Type, nwCfg)
+		plugin.ipam.DelegateDel(nwCfg.Ipam.Type, nwCfg)
 	}
 }
 
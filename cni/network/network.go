@@ -5,8 +5,12 @@ package network
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Azure/azure-container-networking/cni"
 	"github.com/Azure/azure-container-networking/cns"
@@ -28,15 +32,31 @@ const (
 
 	// Supported IP version. Currently support only IPv4
 	ipVersion = "4"
+
+	// IP version of the IPv6 addresses of dual-stack endpoints.
+	ipv6Version = "6"
+
+	// Mode of networks that only record their endpoints, whose results have no interfaces.
+	networkModeNone = "none"
+
+	// Maximum length of interface names, excluding the terminating null of IFNAMSIZ.
+	maxInterfaceNameLength = 15
 )
 
 // NetPlugin represents the CNI network plugin.
 type netPlugin struct {
 	*cni.Plugin
 	nm            network.NetworkManager
+	ipam          ipamDelegate
 	reportManager *telemetry.ReportManager
 }
 
+// ipamDelegate calls into the IPAM plugin. It is implemented by the base plugin, and replaced by tests.
+type ipamDelegate interface {
+	DelegateAdd(pluginName string, nwCfg *cni.NetworkConfig) (*cniTypesCurr.Result, error)
+	DelegateDel(pluginName string, nwCfg *cni.NetworkConfig) error
+}
+
 // NewPlugin creates a new netPlugin object.
 func NewPlugin(config *common.PluginConfig) (*netPlugin, error) {
 	// Setup base plugin.
@@ -56,6 +76,7 @@ func NewPlugin(config *common.PluginConfig) (*netPlugin, error) {
 	return &netPlugin{
 		Plugin: plugin,
 		nm:     nm,
+		ipam:   plugin,
 	}, nil
 }
 
@@ -125,12 +146,43 @@ func (plugin *netPlugin) findMasterInterface(nwCfg *cni.NetworkConfig, subnetPre
 	return ""
 }
 
-// GetEndpointID returns a unique endpoint ID based on the CNI args.
-func GetEndpointID(args *cniSkel.CmdArgs) string {
-	infraEpId, _ := network.ConstructEndpointID(args.ContainerID, args.Netns, args.IfName)
+// GetEndpointID returns a unique endpoint ID based on the CNI args and network namespace.
+func GetEndpointID(args *cniSkel.CmdArgs, netNs *common.Namespace, nwCfg *cni.NetworkConfig) string {
+	infraEpId, workloadEpId := constructEndpointID(args, netNs, nwCfg)
+
+	// Workload containers get their own endpoint sharing the infrastructure container's endpoint.
+	if workloadEpId != "" {
+		return workloadEpId
+	}
+
 	return infraEpId
 }
 
+// constructEndpointID returns the infrastructure and workload endpoint IDs based on the CNI args.
+func constructEndpointID(args *cniSkel.CmdArgs, netNs *common.Namespace, nwCfg *cni.NetworkConfig) (string, string) {
+	if nwCfg.HashedEndpointID {
+		return network.ConstructHashedEndpointID(args.ContainerID, netNs, args.IfName)
+	}
+
+	return network.ConstructEndpointID(args.ContainerID, netNs, args.IfName)
+}
+
+// parseNetNs returns the network namespace of the CNI args, or nil if none is specified.
+func parseNetNs(args *cniSkel.CmdArgs) (*common.Namespace, error) {
+	if args.Netns == "" {
+		return nil, nil
+	}
+
+	return common.NamespaceFromPath(args.Netns)
+}
+
+// isWorkloadContainer returns true if the CNI args refer to a workload container sharing
+// the network of an infrastructure container.
+func isWorkloadContainer(args *cniSkel.CmdArgs, netNs *common.Namespace, nwCfg *cni.NetworkConfig) bool {
+	_, workloadEpId := constructEndpointID(args, netNs, nwCfg)
+	return workloadEpId != ""
+}
+
 // getPodInfo returns POD info by parsing the CNI args.
 func (plugin *netPlugin) getPodInfo(args string) (string, string, error) {
 	podCfg, err := cni.ParseCniArgs(args)
@@ -156,6 +208,26 @@ func (plugin *netPlugin) getPodInfo(args string) (string, string, error) {
 	return k8sPodName, k8sNamespace, nil
 }
 
+// getMacAddress returns the MAC address requested in the CNI args, if any.
+func (plugin *netPlugin) getMacAddress(args string) (net.HardwareAddr, error) {
+	podCfg, err := cni.ParseCniArgs(args)
+	if err != nil {
+		log.Printf("Error while parsing CNI Args %v", err)
+		return nil, err
+	}
+
+	if len(podCfg.MAC) == 0 {
+		return nil, nil
+	}
+
+	macAddress, err := net.ParseMAC(string(podCfg.MAC))
+	if err != nil {
+		return nil, plugin.Errorf("Invalid MAC address %v in CNI Args: %v", podCfg.MAC, err)
+	}
+
+	return macAddress, nil
+}
+
 //
 // CNI implementation
 // https://github.com/containernetworking/cni/blob/master/SPEC.md
@@ -178,6 +250,14 @@ func (plugin *netPlugin) Add(args *cniSkel.CmdArgs) error {
 	log.Printf("[cni-net] Processing ADD command with args {ContainerID:%v Netns:%v IfName:%v Args:%v Path:%v}.",
 		args.ContainerID, args.Netns, args.IfName, args.Args, args.Path)
 
+	start := time.Now()
+	defer func() {
+		addDuration.ObserveDuration(start)
+		if err != nil {
+			addFailures.Inc()
+		}
+	}()
+
 	// Parse network configuration from stdin.
 	nwCfg, err = cni.ParseNetworkConfig(args.StdinData)
 	if err != nil {
@@ -185,21 +265,36 @@ func (plugin *netPlugin) Add(args *cniSkel.CmdArgs) error {
 		return err
 	}
 
+	if err = nwCfg.Validate(); err != nil {
+		err = plugin.Errorf("Invalid network configuration: %v.", err)
+		return err
+	}
+
 	log.Printf("[cni-net] Read network configuration %+v.", nwCfg)
 
+	netNs, err := parseNetNs(args)
+	if err != nil {
+		err = plugin.Errorf("Invalid network namespace: %v.", err)
+		return err
+	}
+
 	defer func() {
 		// Add Interfaces to result.
 		if result == nil {
 			result = &cniTypesCurr.Result{}
 		}
 
-		iface = &cniTypesCurr.Interface{
-			Name: args.IfName,
-		}
+		if nwCfg.Mode == networkModeNone {
+			removeResultInterfaces(result)
+		} else {
+			iface = &cniTypesCurr.Interface{
+				Name: args.IfName,
+			}
 
-		result.Interfaces = append(result.Interfaces, iface)
+			result.Interfaces = append(result.Interfaces, iface)
 
-		addSnatInterface(nwCfg, result)
+			addSnatInterface(nwCfg, result)
+		}
 
 		// Convert result to the requested CNI version.
 		res, vererr := result.GetAsVersion(nwCfg.CNIVersion)
@@ -265,13 +360,19 @@ func (plugin *netPlugin) Add(args *cniSkel.CmdArgs) error {
 		return err
 	}
 
-	endpointId := GetEndpointID(args)
+	endpointId := GetEndpointID(args, netNs, nwCfg)
 
 	policies := cni.GetPoliciesFromNwCfg(nwCfg.AdditionalArgs)
 
 	// Check whether the network already exists.
 	nwInfo, nwInfoErr := plugin.nm.GetNetworkInfo(networkId)
 
+	// Workload containers share the endpoint of their infrastructure container.
+	if nwInfoErr == nil && isWorkloadContainer(args, netNs, nwCfg) {
+		result, err = plugin.addWorkloadEndpoint(networkId, endpointId, args, netNs, nwCfg)
+		return err
+	}
+
 	if nwInfoErr == nil {
 		/* Handle consecutive ADD calls for infrastructure containers.
 		* This is a temporary work around for issue #57253 of Kubernetes.
@@ -301,7 +402,7 @@ func (plugin *netPlugin) Add(args *cniSkel.CmdArgs) error {
 
 		if !nwCfg.MultiTenancy {
 			// Call into IPAM plugin to allocate an address pool for the network.
-			result, err = plugin.DelegateAdd(nwCfg.Ipam.Type, nwCfg)
+			result, err = plugin.ipam.DelegateAdd(nwCfg.Ipam.Type, nwCfg)
 			if err != nil {
 				err = plugin.Errorf("Failed to allocate pool: %v", err)
 				return err
@@ -317,17 +418,23 @@ func (plugin *netPlugin) Add(args *cniSkel.CmdArgs) error {
 		ipconfig := result.IPs[0]
 		gateway := ipconfig.Gateway
 
-		// On failure, call into IPAM plugin to release the address and address pool.
-		defer func() {
-			if err != nil {
-				nwCfg.Ipam.Subnet = subnetPrefix.String()
-				nwCfg.Ipam.Address = ipconfig.Address.IP.String()
-				plugin.DelegateDel(nwCfg.Ipam.Type, nwCfg)
-
-				nwCfg.Ipam.Address = ""
-				plugin.DelegateDel(nwCfg.Ipam.Type, nwCfg)
-			}
-		}()
+		// On failure, call into IPAM plugin to release the addresses and the address pools they
+		// were allocated from.
+		if !nwCfg.MultiTenancy {
+			defer func(ipconfigs []*cniTypesCurr.IPConfig) {
+				if err != nil {
+					for _, ipconfig := range ipconfigs {
+						subnetPrefix := subnetOfAddress(ipconfig.Address)
+						nwCfg.Ipam.Subnet = subnetPrefix.String()
+						nwCfg.Ipam.Address = ipconfig.Address.IP.String()
+						plugin.ipam.DelegateDel(nwCfg.Ipam.Type, nwCfg)
+
+						nwCfg.Ipam.Address = ""
+						plugin.ipam.DelegateDel(nwCfg.Ipam.Type, nwCfg)
+					}
+				}
+			}(result.IPs)
+		}
 
 		subnetPrefix.IP = subnetPrefix.IP.Mask(subnetPrefix.Mask)
 		// Find the master interface.
@@ -369,13 +476,57 @@ func (plugin *netPlugin) Add(args *cniSkel.CmdArgs) error {
 			},
 			BridgeName:       nwCfg.Bridge,
 			EnableSnatOnHost: nwCfg.EnableSnatOnHost,
+			MTU:              nwCfg.MTU,
+			HNSTimeout:       time.Duration(nwCfg.HNSTimeoutSeconds) * time.Second,
 			DNS:              nwDNSInfo,
+			SearchDomains:    getNetworkSearchDomains(nwCfg),
 			Policies:         policies,
+			EnableHNSV2:      nwCfg.EnableHNSV2,
+			RetryPolicy:      getRetryPolicy(nwCfg),
+			NetworkPolicies:  nwCfg.NetworkPolicies,
+			VlanID:           nwCfg.VlanId,
+		}
+
+		// Record the subnets of the other address families allocated by IPAM.
+		if !nwCfg.MultiTenancy {
+			for _, ipconfig := range result.IPs[1:] {
+				nwInfo.Subnets = append(nwInfo.Subnets, network.SubnetInfo{
+					Family:  platform.GetAddressFamily(&ipconfig.Address.IP),
+					Prefix:  subnetOfAddress(ipconfig.Address),
+					Gateway: ipconfig.Gateway,
+				})
+			}
 		}
 
+		// Overlapping subnets are rejected unless the configuration explicitly allows them.
+		nwInfo.AllowOverlappingSubnets = nwCfg.AllowOverlappingSubnets
+
 		nwInfo.Options = make(map[string]interface{})
 		setNetworkOptions(cnsNetworkConfig, &nwInfo)
 
+		if nwCfg.IpvlanMode != "" {
+			opt, _ := nwInfo.Options[dockerNetworkOption].(map[string]interface{})
+			if opt == nil {
+				opt = make(map[string]interface{})
+				nwInfo.Options[dockerNetworkOption] = opt
+			}
+
+			opt[network.IpvlanModeKey] = nwCfg.IpvlanMode
+		}
+
+		if nwCfg.VxlanId != 0 {
+			opt, _ := nwInfo.Options[dockerNetworkOption].(map[string]interface{})
+			if opt == nil {
+				opt = make(map[string]interface{})
+				nwInfo.Options[dockerNetworkOption] = opt
+			}
+
+			opt[network.VxlanIdKey] = strconv.Itoa(nwCfg.VxlanId)
+			if nwCfg.VxlanPort != 0 {
+				opt[network.VxlanPortKey] = strconv.Itoa(nwCfg.VxlanPort)
+			}
+		}
+
 		err = plugin.nm.CreateNetwork(&nwInfo)
 		if err != nil {
 			err = plugin.Errorf("Failed to create network: %v", err)
@@ -386,29 +537,38 @@ func (plugin *netPlugin) Add(args *cniSkel.CmdArgs) error {
 	} else {
 		if !nwCfg.MultiTenancy {
 			// Network already exists.
-			subnetPrefix := nwInfo.Subnets[0].Prefix.String()
-			log.Printf("[cni-net] Found network %v with subnet %v.", networkId, subnetPrefix)
+			result = &cniTypesCurr.Result{}
 
-			// Call into IPAM plugin to allocate an address for the endpoint.
-			nwCfg.Ipam.Subnet = subnetPrefix
-			result, err = plugin.DelegateAdd(nwCfg.Ipam.Type, nwCfg)
-			if err != nil {
-				err = plugin.Errorf("Failed to allocate address: %v", err)
-				return err
-			}
+			for _, subnet := range getIpamSubnets(nwCfg, nwInfo) {
+				var ipamResult *cniTypesCurr.Result
 
-			ipconfig := result.IPs[0]
+				subnetPrefix := subnet.Prefix.String()
+				log.Printf("[cni-net] Found network %v with subnet %v.", networkId, subnetPrefix)
 
-			iface := &cniTypesCurr.Interface{Name: args.IfName}
-			result.Interfaces = append(result.Interfaces, iface)
-
-			// On failure, call into IPAM plugin to release the address.
-			defer func() {
+				// Call into IPAM plugin to allocate an address for the endpoint.
+				nwCfg.Ipam.Subnet = subnetPrefix
+				ipamResult, err = plugin.ipam.DelegateAdd(nwCfg.Ipam.Type, nwCfg)
 				if err != nil {
-					nwCfg.Ipam.Address = ipconfig.Address.IP.String()
-					plugin.DelegateDel(nwCfg.Ipam.Type, nwCfg)
+					err = plugin.Errorf("Failed to allocate address: %v", err)
+					return err
 				}
-			}()
+
+				// On failure, call into IPAM plugin to release the addresses.
+				defer func(subnetPrefix string, ipconfigs []*cniTypesCurr.IPConfig) {
+					if err != nil {
+						nwCfg.Ipam.Subnet = subnetPrefix
+						for _, ipconfig := range ipconfigs {
+							nwCfg.Ipam.Address = ipconfig.Address.IP.String()
+							plugin.ipam.DelegateDel(nwCfg.Ipam.Type, nwCfg)
+						}
+					}
+				}(subnetPrefix, ipamResult.IPs)
+
+				mergeResult(result, ipamResult)
+			}
+
+			iface := &cniTypesCurr.Interface{Name: args.IfName}
+			result.Interfaces = append(result.Interfaces, iface)
 		}
 	}
 
@@ -419,18 +579,31 @@ func (plugin *netPlugin) Add(args *cniSkel.CmdArgs) error {
 	}
 
 	epInfo = &network.EndpointInfo{
-		Id:                 endpointId,
-		ContainerID:        args.ContainerID,
-		NetNsPath:          args.Netns,
-		IfName:             args.IfName,
-		Data:               make(map[string]interface{}),
-		DNS:                epDNSInfo,
-		Policies:           policies,
-		EnableSnatOnHost:   nwCfg.EnableSnatOnHost,
-		EnableMultiTenancy: nwCfg.MultiTenancy,
-		EnableInfraVnet:    enableInfraVnet,
-		PODName:            k8sPodName,
-		PODNameSpace:       k8sNamespace,
+		Id:                       endpointId,
+		ContainerID:              args.ContainerID,
+		NetNs:                    netNs,
+		IfName:                   args.IfName,
+		Data:                     make(map[string]interface{}),
+		DNS:                      epDNSInfo,
+		Policies:                 policies,
+		EnableSnatOnHost:         nwCfg.EnableSnatOnHost,
+		EnableMultiTenancy:       nwCfg.MultiTenancy,
+		EnableInfraVnet:          enableInfraVnet,
+		PODName:                  k8sPodName,
+		PODNameSpace:             k8sNamespace,
+		HashedEndpointID:         nwCfg.HashedEndpointID,
+		HNSTimeout:               time.Duration(nwCfg.HNSTimeoutSeconds) * time.Second,
+		RetryPolicy:              getRetryPolicy(nwCfg),
+		EnableLoopbackDSR:        nwCfg.EnableLoopbackDSR,
+		MTU:                      nwCfg.MTU,
+		DisableTxChecksumOffload: nwCfg.DisableTxChecksumOffload,
+		Sysctls:                  nwCfg.Sysctls,
+	}
+
+	// Honor a static MAC address requested through the CNI args.
+	epInfo.MacAddress, err = plugin.getMacAddress(args.Args)
+	if err != nil {
+		return err
 	}
 
 	epPolicies := getPoliciesFromRuntimeCfg(nwCfg)
@@ -438,6 +611,18 @@ func (plugin *netPlugin) Add(args *cniSkel.CmdArgs) error {
 		epInfo.Policies = append(epInfo.Policies, epPolicy)
 	}
 
+	epInfo.PortMappings = getPortMappingsFromRuntimeCfg(nwCfg)
+
+	if bandwidth := nwCfg.RuntimeConfig.Bandwidth; bandwidth != nil {
+		if bandwidth.IngressRate > 0 {
+			epInfo.IngressRate = uint64(bandwidth.IngressRate)
+		}
+
+		if bandwidth.EgressRate > 0 {
+			epInfo.EgressRate = uint64(bandwidth.EgressRate)
+		}
+	}
+
 	// Populate addresses.
 	for _, ipconfig := range result.IPs {
 		epInfo.IPAddresses = append(epInfo.IPAddresses, ipconfig.Address)
@@ -448,6 +633,13 @@ func (plugin *netPlugin) Add(args *cniSkel.CmdArgs) error {
 		epInfo.Routes = append(epInfo.Routes, network.RouteInfo{Dst: route.Dst, Gw: route.GW})
 	}
 
+	customRoutes, err := getRoutesFromNetConf(nwCfg)
+	if err != nil {
+		err = plugin.Errorf("Failed to parse routes: %v", err)
+		return err
+	}
+	epInfo.Routes = append(epInfo.Routes, customRoutes...)
+
 	if azIpamResult != nil && azIpamResult.IPs != nil {
 		epInfo.InfraVnetIP = azIpamResult.IPs[0].Address
 	}
@@ -467,9 +659,53 @@ func (plugin *netPlugin) Add(args *cniSkel.CmdArgs) error {
 		return err
 	}
 
+	// Containers attached to multiple networks get their default routes and DNS settings
+	// from the endpoint of their primary network only.
+	if epInfo.Secondary {
+		log.Printf("[cni-net] Endpoint %v is a secondary endpoint of container %v.", epInfo.Id, args.ContainerID)
+		removeDefaultRoutes(result)
+		result.DNS = cniTypes.DNS{}
+	} else if searchDomains := epInfo.GetSearchDomains(); len(searchDomains) > 0 {
+		// Report the search domains of the network along with those of the endpoint.
+		result.DNS.Search = searchDomains
+	}
+
 	return nil
 }
 
+// addWorkloadEndpoint attaches the endpoint of the infrastructure container to a workload container.
+func (plugin *netPlugin) addWorkloadEndpoint(networkId string, endpointId string, args *cniSkel.CmdArgs, netNs *common.Namespace, nwCfg *cni.NetworkConfig) (*cniTypesCurr.Result, error) {
+	epInfo := &network.EndpointInfo{
+		Id:               endpointId,
+		ContainerID:      args.ContainerID,
+		NetNs:            netNs,
+		IfName:           args.IfName,
+		HashedEndpointID: nwCfg.HashedEndpointID,
+		HNSTimeout:       time.Duration(nwCfg.HNSTimeoutSeconds) * time.Second,
+		RetryPolicy:      getRetryPolicy(nwCfg),
+	}
+
+	log.Printf("[cni-net] Creating workload endpoint %v.", epInfo.Id)
+	err := plugin.nm.CreateEndpoint(networkId, epInfo)
+	if err != nil {
+		err = plugin.Errorf("Failed to create endpoint: %v", err)
+		return nil, err
+	}
+
+	epInfo, err = plugin.nm.GetEndpointInfo(networkId, endpointId)
+	if err != nil {
+		err = plugin.Errorf("Failed to query endpoint: %v", err)
+		return nil, err
+	}
+
+	// Populate result from the shared endpoint.
+	result := &cniTypesCurr.Result{}
+	populateResult(result, epInfo)
+	result.DNS.Nameservers = nwCfg.DNS.Nameservers
+
+	return result, nil
+}
+
 // Get handles CNI Get commands.
 func (plugin *netPlugin) Get(args *cniSkel.CmdArgs) error {
 	var (
@@ -485,10 +721,14 @@ func (plugin *netPlugin) Get(args *cniSkel.CmdArgs) error {
 
 	defer func() {
 		// Add Interfaces to result.
-		iface = &cniTypesCurr.Interface{
-			Name: args.IfName,
+		if nwCfg != nil && nwCfg.Mode == networkModeNone {
+			removeResultInterfaces(&result)
+		} else {
+			iface = &cniTypesCurr.Interface{
+				Name: args.IfName,
+			}
+			result.Interfaces = append(result.Interfaces, iface)
 		}
-		result.Interfaces = append(result.Interfaces, iface)
 
 		if err == nil {
 			// Convert result to the requested CNI version.
@@ -512,6 +752,12 @@ func (plugin *netPlugin) Get(args *cniSkel.CmdArgs) error {
 
 	log.Printf("[cni-net] Read network configuration %+v.", nwCfg)
 
+	netNs, err := parseNetNs(args)
+	if err != nil {
+		err = plugin.Errorf("Invalid network namespace: %v.", err)
+		return err
+	}
+
 	// Parse Pod arguments.
 	k8sPodName, k8sNamespace, err := plugin.getPodInfo(args.Args)
 	if err != nil {
@@ -524,7 +770,7 @@ func (plugin *netPlugin) Get(args *cniSkel.CmdArgs) error {
 		log.Printf("[cni-net] Failed to extract network name from network config. error: %v", err)
 	}
 
-	endpointId := GetEndpointID(args)
+	endpointId := GetEndpointID(args, netNs, nwCfg)
 
 	// Query the network.
 	_, err = plugin.nm.GetNetworkInfo(networkId)
@@ -540,15 +786,34 @@ func (plugin *netPlugin) Get(args *cniSkel.CmdArgs) error {
 		return err
 	}
 
-	for _, ipAddresses := range epInfo.IPAddresses {
+	populateResult(&result, epInfo)
+
+	return nil
+}
+
+// removeResultInterfaces removes the interfaces from the result of an endpoint of a network in none
+// mode, which is allocated addresses without any interface being created for them.
+func removeResultInterfaces(result *cniTypesCurr.Result) {
+	result.Interfaces = nil
+	for _, ipConfig := range result.IPs {
+		ipConfig.Interface = nil
+	}
+}
+
+// populateResult populates the CNI result with the addresses, routes and DNS settings of an endpoint.
+func populateResult(result *cniTypesCurr.Result, epInfo *network.EndpointInfo) {
+	for _, ipAddress := range epInfo.IPAddresses {
+		isIPv4 := ipAddress.IP.To4() != nil
+
 		ipConfig := &cniTypesCurr.IPConfig{
 			Version:   ipVersion,
 			Interface: &epInfo.IfIndex,
-			Address:   ipAddresses,
+			Address:   ipAddress,
+			Gateway:   getGateway(epInfo.Gateways, isIPv4),
 		}
 
-		if epInfo.Gateways != nil {
-			ipConfig.Gateway = epInfo.Gateways[0]
+		if !isIPv4 {
+			ipConfig.Version = ipv6Version
 		}
 
 		result.IPs = append(result.IPs, ipConfig)
@@ -558,12 +823,156 @@ func (plugin *netPlugin) Get(args *cniSkel.CmdArgs) error {
 		result.Routes = append(result.Routes, &cniTypes.Route{Dst: route.Dst, GW: route.Gw})
 	}
 
+	if !epInfo.Secondary {
+		addDefaultRoutes(result, epInfo.Gateways)
+	}
+
 	result.DNS.Nameservers = epInfo.DNS.Servers
 	result.DNS.Domain = epInfo.DNS.Suffix
+	result.DNS.Search = epInfo.GetSearchDomains()
+}
+
+// getNetworkSearchDomains returns the DNS search domains that the network configuration applies to
+// all endpoints of the network, ahead of their own search domains.
+func getNetworkSearchDomains(nwCfg *cni.NetworkConfig) []string {
+	if nwCfg.NetworkDNS == nil {
+		return nil
+	}
+
+	var searchDomains []string
+	if nwCfg.NetworkDNS.Domain != "" {
+		searchDomains = append(searchDomains, nwCfg.NetworkDNS.Domain)
+	}
+
+	return append(searchDomains, nwCfg.NetworkDNS.Search...)
+}
+
+// getRetryPolicy returns the policy that HNS operations are retried with. Returns nil to select
+// the default policy if the network configuration does not set the number of attempts.
+func getRetryPolicy(nwCfg *cni.NetworkConfig) *network.RetryPolicy {
+	if nwCfg.HNSRetryAttempts == 0 {
+		return nil
+	}
+
+	return &network.RetryPolicy{
+		MaxAttempts:    nwCfg.HNSRetryAttempts,
+		InitialBackoff: time.Duration(nwCfg.HNSRetryInitialBackoffMs) * time.Millisecond,
+		MaxBackoff:     time.Duration(nwCfg.HNSRetryMaxBackoffMs) * time.Millisecond,
+	}
+}
+
+// getGateway returns the first gateway of the given address family.
+func getGateway(gateways []net.IP, isIPv4 bool) net.IP {
+	for _, gateway := range gateways {
+		if (gateway.To4() != nil) == isIPv4 {
+			return gateway
+		}
+	}
 
 	return nil
 }
 
+// getRoutesFromNetConf converts the custom routes in the network configuration to endpoint routes.
+func getRoutesFromNetConf(nwCfg *cni.NetworkConfig) ([]network.RouteInfo, error) {
+	var routes []network.RouteInfo
+
+	for _, entry := range nwCfg.Routes {
+		_, dst, err := net.ParseCIDR(entry.Dst)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid route destination %v", entry.Dst)
+		}
+
+		if entry.Dev != "" && !isValidInterfaceName(entry.Dev) {
+			return nil, fmt.Errorf("Invalid route device %q", entry.Dev)
+		}
+
+		route := network.RouteInfo{
+			Dst:     *dst,
+			DevName: entry.Dev,
+			Metric:  entry.Metric,
+		}
+
+		if entry.Gw != "" {
+			if route.Gw = net.ParseIP(entry.Gw); route.Gw == nil {
+				return nil, fmt.Errorf("Invalid route gateway %v", entry.Gw)
+			}
+		}
+
+		if entry.Src != "" {
+			if route.Src = net.ParseIP(entry.Src); route.Src == nil {
+				return nil, fmt.Errorf("Invalid route source %v", entry.Src)
+			}
+		}
+
+		switch entry.Scope {
+		case "", "global", "universe":
+			route.Scope = network.RouteScopeUniverse
+		case "link":
+			route.Scope = network.RouteScopeLink
+		case "host":
+			route.Scope = network.RouteScopeHost
+		default:
+			return nil, fmt.Errorf("Invalid route scope %v", entry.Scope)
+		}
+
+		routes = append(routes, route)
+	}
+
+	return routes, nil
+}
+
+// isValidInterfaceName returns whether the name is a valid Linux interface name. The interface
+// itself is in the container network namespace, so its existence is checked when routes are added.
+func isValidInterfaceName(name string) bool {
+	if len(name) > maxInterfaceNameLength || name == "." || name == ".." {
+		return false
+	}
+
+	return !strings.ContainsAny(name, "/: \t\n")
+}
+
+// addDefaultRoutes adds a default route through the gateway of each address family
+// that does not already have a default route in the CNI result.
+func addDefaultRoutes(result *cniTypesCurr.Result, gateways []net.IP) {
+	for _, gateway := range gateways {
+		isIPv4 := gateway.To4() != nil
+
+		hasDefaultRoute := false
+		for _, route := range result.Routes {
+			ones, _ := route.Dst.Mask.Size()
+			if ones == 0 && (route.Dst.IP.To4() != nil) == isIPv4 {
+				hasDefaultRoute = true
+				break
+			}
+		}
+
+		if hasDefaultRoute {
+			continue
+		}
+
+		dst := net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+		if !isIPv4 {
+			dst = net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+		}
+
+		result.Routes = append(result.Routes, &cniTypes.Route{Dst: dst, GW: gateway})
+	}
+}
+
+// removeDefaultRoutes removes the default routes of both address families from the CNI result.
+func removeDefaultRoutes(result *cniTypesCurr.Result) {
+	var routes []*cniTypes.Route
+	for _, route := range result.Routes {
+		if ones, _ := route.Dst.Mask.Size(); ones == 0 && route.Dst.IP.IsUnspecified() {
+			continue
+		}
+
+		routes = append(routes, route)
+	}
+
+	result.Routes = routes
+}
+
 // Delete handles CNI delete commands.
 func (plugin *netPlugin) Delete(args *cniSkel.CmdArgs) error {
 	var err error
@@ -582,6 +991,13 @@ func (plugin *netPlugin) Delete(args *cniSkel.CmdArgs) error {
 
 	log.Printf("[cni-net] Read network configuration %+v.", nwCfg)
 
+	// Endpoints are not created for malformed namespaces, so there is nothing to delete.
+	netNs, err := parseNetNs(args)
+	if err != nil {
+		log.Printf("[cni-net] Ignoring invalid network namespace: %v.", err)
+		return nil
+	}
+
 	// Parse Pod arguments.
 	k8sPodName, k8sNamespace, err := plugin.getPodInfo(args.Args)
 	if err != nil {
@@ -594,39 +1010,73 @@ func (plugin *netPlugin) Delete(args *cniSkel.CmdArgs) error {
 		log.Printf("[cni-net] Failed to extract network name from network config. error: %v", err)
 	}
 
-	endpointId := GetEndpointID(args)
+	endpointId := GetEndpointID(args, netNs, nwCfg)
 
 	// Query the network.
 	nwInfo, err := plugin.nm.GetNetworkInfo(networkId)
 	if err != nil {
-		// Log the error but return success if the endpoint being deleted is not found.
-		plugin.Errorf("Failed to query network: %v", err)
-		err = nil
+		if errors.Is(err, network.ErrNetworkNotFound) {
+			// Log the error but return success if the endpoint being deleted is not found.
+			plugin.Errorf("Failed to query network: %v", err)
+			err = nil
+			return err
+		}
+
+		err = plugin.Errorf("Failed to query network: %v", err)
 		return err
 	}
 
 	// Query the endpoint.
 	epInfo, err := plugin.nm.GetEndpointInfo(networkId, endpointId)
 	if err != nil {
-		// Log the error but return success if the endpoint being deleted is not found.
-		plugin.Errorf("Failed to query endpoint: %v", err)
-		err = nil
+		if errors.Is(err, network.ErrEndpointNotFound) {
+			// Log the error but return success if the endpoint being deleted is not found.
+			plugin.Errorf("Failed to query endpoint: %v", err)
+			err = nil
+			return err
+		}
+
+		err = plugin.Errorf("Failed to query endpoint: %v", err)
 		return err
 	}
 
-	// Delete the endpoint.
+	// Delete the endpoint. An endpoint deleted concurrently is already gone.
 	err = plugin.nm.DeleteEndpoint(networkId, endpointId)
-	if err != nil {
+	if err != nil && !errors.Is(err, network.ErrEndpointNotFound) {
 		err = plugin.Errorf("Failed to delete endpoint: %v", err)
 		return err
 	}
 
-	if !nwCfg.MultiTenancy {
-		// Call into IPAM plugin to release the endpoint's addresses.
-		nwCfg.Ipam.Subnet = nwInfo.Subnets[0].Prefix.String()
+	// Workload containers do not own the addresses of the shared endpoint.
+	if isWorkloadContainer(args, netNs, nwCfg) {
+		return nil
+	}
+
+	if !nwCfg.MultiTenancy && len(epInfo.IPAddresses) == 0 {
+		// The addresses of the endpoint were not recorded, so call into IPAM plugin to release
+		// the addresses owned by the container instead.
+		nwCfg.Ipam.Address = ""
+		nwCfg.Ipam.Owner = args.ContainerID
+		for _, subnet := range nwInfo.Subnets {
+			nwCfg.Ipam.Subnet = subnet.Prefix.String()
+			err = plugin.ipam.DelegateDel(nwCfg.Ipam.Type, nwCfg)
+			if err != nil {
+				err = plugin.Errorf("Failed to release addresses: %v", err)
+				return err
+			}
+		}
+	} else if !nwCfg.MultiTenancy {
+		// Call into IPAM plugin to release each address of the endpoint from the subnet containing it.
 		for _, address := range epInfo.IPAddresses {
+			subnet := findSubnet(nwInfo, address.IP)
+			if subnet == nil {
+				log.Printf("[cni-net] Ignoring address %v outside of the subnets of network %v.", address.IP, networkId)
+				continue
+			}
+
+			nwCfg.Ipam.Subnet = subnet.Prefix.String()
 			nwCfg.Ipam.Address = address.IP.String()
-			err = plugin.DelegateDel(nwCfg.Ipam.Type, nwCfg)
+			err = plugin.ipam.DelegateDel(nwCfg.Ipam.Type, nwCfg)
 			if err != nil {
 				err = plugin.Errorf("Failed to release address: %v", err)
 				return err
@@ -635,7 +1085,7 @@ func (plugin *netPlugin) Delete(args *cniSkel.CmdArgs) error {
 	} else if epInfo.EnableInfraVnet {
 		nwCfg.Ipam.Subnet = nwInfo.Subnets[0].Prefix.String()
 		nwCfg.Ipam.Address = epInfo.InfraVnetIP.IP.String()
-		err = plugin.DelegateDel(nwCfg.Ipam.Type, nwCfg)
+		err = plugin.ipam.DelegateDel(nwCfg.Ipam.Type, nwCfg)
 		if err != nil {
 			err = plugin.Errorf("Failed to release address: %v", err)
 			return err
@@ -645,6 +1095,65 @@ func (plugin *netPlugin) Delete(args *cniSkel.CmdArgs) error {
 	return nil
 }
 
+// getIpamSubnets returns the subnets of an existing network to allocate the addresses of an endpoint
+// from, which are the first subnet of each address family for dual-stack configurations, and the
+// first subnet otherwise.
+func getIpamSubnets(nwCfg *cni.NetworkConfig, nwInfo *network.NetworkInfo) []network.SubnetInfo {
+	if nwCfg.Ipam.AddressFamily != cni.IpamAddressFamilyBoth {
+		return nwInfo.Subnets[:1]
+	}
+
+	var subnets []network.SubnetInfo
+	for _, subnet := range nwInfo.Subnets {
+		v6 := subnet.Prefix.IP.To4() == nil
+		if len(subnets) == 0 || (subnets[0].Prefix.IP.To4() == nil) != v6 {
+			subnets = append(subnets, subnet)
+		}
+
+		if len(subnets) == 2 {
+			break
+		}
+	}
+
+	return subnets
+}
+
+// findSubnet returns the subnet of the network containing the given address, or nil if none does.
+func findSubnet(nwInfo *network.NetworkInfo, address net.IP) *network.SubnetInfo {
+	for i := range nwInfo.Subnets {
+		if nwInfo.Subnets[i].Prefix.Contains(address) {
+			return &nwInfo.Subnets[i]
+		}
+	}
+
+	return nil
+}
+
+// subnetOfAddress returns the subnet prefix of an address in CIDR notation.
+func subnetOfAddress(address net.IPNet) net.IPNet {
+	return net.IPNet{IP: address.IP.Mask(address.Mask), Mask: address.Mask}
+}
+
+// mergeResult adds the addresses, routes and DNS servers of an IPAM result to another result.
+func mergeResult(result *cniTypesCurr.Result, other *cniTypesCurr.Result) {
+	result.IPs = append(result.IPs, other.IPs...)
+	result.Routes = append(result.Routes, other.Routes...)
+
+	for _, nameserver := range other.DNS.Nameservers {
+		found := false
+		for _, existing := range result.DNS.Nameservers {
+			if existing == nameserver {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			result.DNS.Nameservers = append(result.DNS.Nameservers, nameserver)
+		}
+	}
+}
+
 // Update handles CNI update commands.
 // Update is only supported for multitenancy and to update routes.
 func (plugin *netPlugin) Update(args *cniSkel.CmdArgs) error {
@@ -667,6 +1176,12 @@ func (plugin *netPlugin) Update(args *cniSkel.CmdArgs) error {
 
 	log.Printf("[cni-net] Read network configuration %+v.", nwCfg)
 
+	netNs, err := parseNetNs(args)
+	if err != nil {
+		err = plugin.Errorf("Invalid network namespace: %v.", err)
+		return err
+	}
+
 	defer func() {
 		if result == nil {
 			result = &cniTypesCurr.Result{}
@@ -753,7 +1268,19 @@ func (plugin *netPlugin) Update(args *cniSkel.CmdArgs) error {
 	}
 
 	log.Printf("Network config received from cns for [name=%v, namespace=%v] is as follows -> %+v", k8sPodName, k8sNamespace, targetNetworkConfig)
-	targetEpInfo := &network.EndpointInfo{}
+	targetEpInfo := &network.EndpointInfo{
+		NetNs: netNs,
+	}
+
+	if bandwidth := nwCfg.RuntimeConfig.Bandwidth; bandwidth != nil {
+		if bandwidth.IngressRate > 0 {
+			targetEpInfo.IngressRate = uint64(bandwidth.IngressRate)
+		}
+
+		if bandwidth.EgressRate > 0 {
+			targetEpInfo.EgressRate = uint64(bandwidth.EgressRate)
+		}
+	}
 
 	// get the target routes that should replace existingEpInfo.Routes inside the network namespace
 	log.Printf("Going to collect target routes for [name=%v, namespace=%v] from targetNetworkConfig.", k8sPodName, k8sNamespace)
@@ -82,25 +82,36 @@ func setupInfraVnetRoutingForMultitenancy(
 }
 
 func getNetworkDNSSettings(nwCfg *cni.NetworkConfig, result *cniTypesCurr.Result, namespace string) (network.DNSInfo, error) {
-	var nwDNS network.DNSInfo
+	// Network-level DNS settings are inherited by the endpoints that do not set their own.
+	if nwCfg.NetworkDNS != nil {
+		return network.DNSInfo{
+			Servers:  nwCfg.NetworkDNS.Nameservers,
+			Suffix:   nwCfg.NetworkDNS.Domain,
+			Suffixes: nwCfg.NetworkDNS.Search,
+		}, nil
+	}
+
+	return getEndpointDNSSettings(nwCfg, result, namespace)
+}
+
+func getEndpointDNSSettings(nwCfg *cni.NetworkConfig, result *cniTypesCurr.Result, namespace string) (network.DNSInfo, error) {
+	var epDNS network.DNSInfo
 
 	if len(nwCfg.DNS.Nameservers) > 0 {
-		nwDNS = network.DNSInfo{
-			Servers: nwCfg.DNS.Nameservers,
-			Suffix:  nwCfg.DNS.Domain,
+		epDNS = network.DNSInfo{
+			Servers:  nwCfg.DNS.Nameservers,
+			Suffix:   nwCfg.DNS.Domain,
+			Suffixes: nwCfg.DNS.Search,
 		}
 	} else {
-		nwDNS = network.DNSInfo{
-			Suffix:  result.DNS.Domain,
-			Servers: result.DNS.Nameservers,
+		epDNS = network.DNSInfo{
+			Suffix:   result.DNS.Domain,
+			Suffixes: result.DNS.Search,
+			Servers:  result.DNS.Nameservers,
 		}
 	}
 
-	return nwDNS, nil
-}
-
-func getEndpointDNSSettings(nwCfg *cni.NetworkConfig, result *cniTypesCurr.Result, namespace string) (network.DNSInfo, error) {
-	return getNetworkDNSSettings(nwCfg, result, namespace)
+	return epDNS, nil
 }
 
 // getPoliciesFromRuntimeCfg returns network policies from network config.
@@ -109,6 +120,12 @@ func getPoliciesFromRuntimeCfg(nwCfg *cni.NetworkConfig) []policy.Policy {
 	return nil
 }
 
+// getPortMappingsFromRuntimeCfg returns port mappings from network config.
+// getPortMappingsFromRuntimeCfg is a dummy function for Linux platform.
+func getPortMappingsFromRuntimeCfg(nwCfg *cni.NetworkConfig) []network.PortMapping {
+	return nil
+}
+
 func updateSubnetPrefix(cnsNetworkConfig *cns.GetNetworkContainerResponse, subnetPrefix *net.IPNet) {
 }
 
@@ -0,0 +1,256 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-container-networking/cni"
+	"github.com/Azure/azure-container-networking/network"
+	"github.com/Azure/azure-container-networking/platform"
+
+	cniSkel "github.com/containernetworking/cni/pkg/skel"
+	cniTypesCurr "github.com/containernetworking/cni/pkg/types/current"
+)
+
+var (
+	dualStackSubnets = []network.SubnetInfo{
+		{Family: platform.AfINET, Prefix: mustParseCIDR("10.0.0.0/24"), Gateway: net.ParseIP("10.0.0.1")},
+		{Family: platform.AfINET6, Prefix: mustParseCIDR("fd00::/64"), Gateway: net.ParseIP("fd00::1")},
+	}
+
+	dualStackConfig = `{"cniVersion":"0.3.0","name":"azure","type":"azure-vnet","ipam":{"type":"azure-vnet-ipam","addressFamily":"both"}}`
+)
+
+// Returns the subnet prefix of a CIDR string.
+func mustParseCIDR(s string) net.IPNet {
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return *ipNet
+}
+
+// fakeIpam allocates addresses from fixed pools and, like the IPAM plugin, ignores releases of
+// addresses not in the given pool.
+type fakeIpam struct {
+	pools     map[string]string
+	allocated map[string]map[string]bool
+	released  []string
+}
+
+// Creates a fake IPAM with a pool per subnet, each allocating the given address.
+func newFakeIpam(addresses map[string]string) *fakeIpam {
+	ipam := &fakeIpam{
+		pools:     addresses,
+		allocated: make(map[string]map[string]bool),
+	}
+
+	for subnet := range addresses {
+		ipam.allocated[subnet] = make(map[string]bool)
+	}
+
+	return ipam
+}
+
+// Allocates an address from the requested pool, or from every pool if none is requested.
+func (ipam *fakeIpam) DelegateAdd(pluginName string, nwCfg *cni.NetworkConfig) (*cniTypesCurr.Result, error) {
+	subnets := []string{nwCfg.Ipam.Subnet}
+	if nwCfg.Ipam.Subnet == "" {
+		subnets = []string{dualStackSubnets[0].Prefix.String(), dualStackSubnets[1].Prefix.String()}
+	}
+
+	result := &cniTypesCurr.Result{}
+	for _, subnet := range subnets {
+		prefix := mustParseCIDR(subnet)
+		address := net.ParseIP(ipam.pools[subnet])
+		ipam.allocated[subnet][address.String()] = true
+
+		result.IPs = append(result.IPs, &cniTypesCurr.IPConfig{
+			Address: net.IPNet{IP: address, Mask: prefix.Mask},
+		})
+	}
+
+	return result, nil
+}
+
+// Releases an address of a pool, or the pool itself if no address is specified.
+func (ipam *fakeIpam) DelegateDel(pluginName string, nwCfg *cni.NetworkConfig) error {
+	if nwCfg.Ipam.Address == "" {
+		ipam.released = append(ipam.released, nwCfg.Ipam.Subnet)
+		return nil
+	}
+
+	delete(ipam.allocated[nwCfg.Ipam.Subnet], nwCfg.Ipam.Address)
+	return nil
+}
+
+// Returns whether no address is allocated from any pool.
+func (ipam *fakeIpam) isEmpty() bool {
+	for _, addresses := range ipam.allocated {
+		if len(addresses) != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// fakeNetworkManager serves a single dual-stack network.
+type fakeNetworkManager struct {
+	network.NetworkManager
+	nwInfo    *network.NetworkInfo
+	epInfo    *network.EndpointInfo
+	createErr error
+}
+
+func (nm *fakeNetworkManager) GetNetworkInfo(networkId string) (*network.NetworkInfo, error) {
+	if nm.nwInfo == nil {
+		return nil, network.ErrNetworkNotFound
+	}
+
+	return nm.nwInfo, nil
+}
+
+func (nm *fakeNetworkManager) GetEndpointInfo(networkId string, endpointId string) (*network.EndpointInfo, error) {
+	if nm.epInfo == nil {
+		return nil, network.ErrEndpointNotFound
+	}
+
+	return nm.epInfo, nil
+}
+
+func (nm *fakeNetworkManager) CreateEndpoint(networkId string, epInfo *network.EndpointInfo) error {
+	return nm.createErr
+}
+
+func (nm *fakeNetworkManager) DeleteEndpoint(networkId string, endpointId string) error {
+	return nil
+}
+
+// Creates a plugin with a fake network manager and a fake IPAM.
+func newTestPlugin(t *testing.T, nm network.NetworkManager, ipam ipamDelegate) *netPlugin {
+	base, err := cni.NewPlugin(name, "test")
+	if err != nil {
+		t.Fatalf("Failed to create plugin, err:%v.", err)
+	}
+
+	return &netPlugin{Plugin: base, nm: nm, ipam: ipam}
+}
+
+// Returns CNI args for a test container.
+func newTestArgs() *cniSkel.CmdArgs {
+	return &cniSkel.CmdArgs{
+		ContainerID: "0123456789abcdef",
+		IfName:      "eth0",
+		Args:        "K8S_POD_NAME=pod;K8S_POD_NAMESPACE=default",
+		StdinData:   []byte(dualStackConfig),
+	}
+}
+
+// Tests that DEL releases each address of a dual-stack endpoint from the pool it was allocated from.
+func TestDeleteReleasesDualStackAddresses(t *testing.T) {
+	ipam := newFakeIpam(map[string]string{"10.0.0.0/24": "10.0.0.4", "fd00::/64": "fd00::4"})
+	ipam.allocated["10.0.0.0/24"]["10.0.0.4"] = true
+	ipam.allocated["fd00::/64"]["fd00::4"] = true
+
+	nm := &fakeNetworkManager{
+		nwInfo: &network.NetworkInfo{Id: "azure", Subnets: dualStackSubnets},
+		epInfo: &network.EndpointInfo{
+			Id: "01234567-eth0",
+			IPAddresses: []net.IPNet{
+				{IP: net.ParseIP("10.0.0.4"), Mask: net.CIDRMask(24, 32)},
+				{IP: net.ParseIP("fd00::4"), Mask: net.CIDRMask(64, 128)},
+			},
+		},
+	}
+
+	plugin := newTestPlugin(t, nm, ipam)
+
+	if err := plugin.Delete(newTestArgs()); err != nil {
+		t.Fatalf("Delete failed, err:%v", err)
+	}
+
+	if !ipam.isEmpty() {
+		t.Errorf("Expected both pools to be empty, got %v", ipam.allocated)
+	}
+}
+
+// Tests that a failed dual-stack ADD releases each address, and each pool of a new network, from
+// the pool it was allocated from.
+func TestAddRollbackReleasesDualStackAddresses(t *testing.T) {
+	tests := []struct {
+		name   string
+		nwInfo *network.NetworkInfo
+		pools  []string
+	}{
+		// The network is not created since no interface is on the test subnets.
+		{"new network", nil, []string{"10.0.0.0/24", "fd00::/64"}},
+		{"existing network", &network.NetworkInfo{Id: "azure", Subnets: dualStackSubnets}, nil},
+	}
+
+	for _, test := range tests {
+		ipam := newFakeIpam(map[string]string{"10.0.0.0/24": "10.0.0.4", "fd00::/64": "fd00::4"})
+		nm := &fakeNetworkManager{nwInfo: test.nwInfo, createErr: errors.New("Create failed")}
+		plugin := newTestPlugin(t, nm, ipam)
+
+		if err := plugin.Add(newTestArgs()); err == nil {
+			t.Errorf("%v: Expected ADD to fail", test.name)
+		}
+
+		if !ipam.isEmpty() {
+			t.Errorf("%v: Expected both pools to be empty, got %v", test.name, ipam.allocated)
+		}
+
+		if len(ipam.released) != len(test.pools) {
+			t.Errorf("%v: Expected pools %v to be released, got %v", test.name, test.pools, ipam.released)
+		}
+
+		for i := range test.pools {
+			if i < len(ipam.released) && ipam.released[i] != test.pools[i] {
+				t.Errorf("%v: Expected pools %v to be released, got %v", test.name, test.pools, ipam.released)
+			}
+		}
+	}
+}
+
+// Tests that routes with invalid devices are rejected when the network configuration is parsed.
+func TestGetRoutesFromNetConfDevices(t *testing.T) {
+	tests := []struct {
+		dev   string
+		valid bool
+	}{
+		{"", true},
+		{"eth1", true},
+		{"averylonginterface", false},
+		{"eth/1", false},
+		{"eth 1", false},
+		{"..", false},
+	}
+
+	for _, test := range tests {
+		nwCfg := &cni.NetworkConfig{Routes: []cni.RouteEntry{{Dst: "10.1.0.0/16", Dev: test.dev}}}
+		_, err := getRoutesFromNetConf(nwCfg)
+		if (err == nil) != test.valid {
+			t.Errorf("Route through device %q returned err:%v", test.dev, err)
+		}
+	}
+}
+
+func TestGetRetryPolicy(t *testing.T) {
+	if retryPolicy := getRetryPolicy(&cni.NetworkConfig{HNSRetryMaxBackoffMs: 100}); retryPolicy != nil {
+		t.Errorf("Expected the default retry policy, got %+v", retryPolicy)
+	}
+
+	nwCfg := &cni.NetworkConfig{HNSRetryAttempts: 3, HNSRetryInitialBackoffMs: 10, HNSRetryMaxBackoffMs: 100}
+	retryPolicy := getRetryPolicy(nwCfg)
+	if retryPolicy == nil || retryPolicy.MaxAttempts != 3 ||
+		retryPolicy.InitialBackoff != 10*time.Millisecond || retryPolicy.MaxBackoff != 100*time.Millisecond {
+		t.Errorf("Unexpected retry policy %+v", retryPolicy)
+	}
+}
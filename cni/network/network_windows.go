@@ -1,11 +1,9 @@
 package network
 
 import (
-	"encoding/json"
 	"fmt"
 	"net"
 	"strconv"
-	"strings"
 
 	"github.com/Azure/azure-container-networking/cni"
 	"github.com/Azure/azure-container-networking/cns"
@@ -139,6 +137,17 @@ func getNetworkDNSSettings(nwCfg *cni.NetworkConfig, result *cniTypesCurr.Result
 		return nwDNS, err
 	}
 
+	// Network-level DNS settings are inherited by the endpoints that do not set their own.
+	if nwCfg.NetworkDNS != nil {
+		nwDNS = network.DNSInfo{
+			Servers:  nwCfg.NetworkDNS.Nameservers,
+			Suffix:   nwCfg.NetworkDNS.Domain,
+			Suffixes: nwCfg.NetworkDNS.Search,
+		}
+
+		return nwDNS, nil
+	}
+
 	nwDNS = network.DNSInfo{
 		Servers: nwCfg.DNS.Nameservers,
 	}
@@ -155,14 +164,18 @@ func getEndpointDNSSettings(nwCfg *cni.NetworkConfig, result *cniTypesCurr.Resul
 	}
 
 	if len(nwCfg.DNS.Search) > 0 {
+		// Search the pod's namespace first, followed by the configured search list.
+		suffixes := append([]string{namespace + "." + nwCfg.DNS.Search[0]}, nwCfg.DNS.Search...)
 		epDNS = network.DNSInfo{
-			Servers: nwCfg.DNS.Nameservers,
-			Suffix:  namespace + "." + strings.Join(nwCfg.DNS.Search, ","),
+			Servers:  nwCfg.DNS.Nameservers,
+			Suffix:   suffixes[0],
+			Suffixes: suffixes,
 		}
 	} else {
 		epDNS = network.DNSInfo{
-			Suffix:  result.DNS.Domain,
-			Servers: result.DNS.Nameservers,
+			Suffix:   result.DNS.Domain,
+			Suffixes: result.DNS.Search,
+			Servers:  result.DNS.Nameservers,
 		}
 	}
 
@@ -173,22 +186,32 @@ func getEndpointDNSSettings(nwCfg *cni.NetworkConfig, result *cniTypesCurr.Resul
 func getPoliciesFromRuntimeCfg(nwCfg *cni.NetworkConfig) []policy.Policy {
 	log.Printf("[net] RuntimeConfigs: %+v", nwCfg.RuntimeConfig)
 	var policies []policy.Policy
+
+	// Limit the egress bandwidth of the endpoint.
+	if bandwidth := nwCfg.RuntimeConfig.Bandwidth; bandwidth != nil && bandwidth.EgressRate > 0 {
+		qosPolicy := policy.GetQosPolicy(uint64(bandwidth.EgressRate / 8))
+		log.Printf("[net] Creating QoS policy: %+v", qosPolicy)
+
+		policies = append(policies, qosPolicy)
+	}
+
+	return policies
+}
+
+// getPortMappingsFromRuntimeCfg returns port mappings from network config.
+func getPortMappingsFromRuntimeCfg(nwCfg *cni.NetworkConfig) []network.PortMapping {
+	var portMappings []network.PortMapping
 	for _, mapping := range nwCfg.RuntimeConfig.PortMappings {
-		rawPolicy, _ := json.Marshal(&hcsshim.NatPolicy{
-			Type:         "NAT",
-			ExternalPort: uint16(mapping.HostPort),
-			InternalPort: uint16(mapping.ContainerPort),
-			Protocol:     mapping.Protocol,
-		})
-
-		policy := policy.Policy{
-			Type: policy.EndpointPolicy,
-			Data: rawPolicy,
+		portMapping := network.PortMapping{
+			Protocol:      mapping.Protocol,
+			HostPort:      mapping.HostPort,
+			ContainerPort: mapping.ContainerPort,
+			HostIP:        net.ParseIP(mapping.HostIp),
 		}
-		log.Printf("[net] Creating port mapping policy: %+v", policy)
+		log.Printf("[net] Creating port mapping: %+v", portMapping)
 
-		policies = append(policies, policy)
+		portMappings = append(portMappings, portMapping)
 	}
 
-	return policies
+	return portMappings
 }
@@ -4,6 +4,7 @@
 package cni
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"runtime"
@@ -106,7 +107,7 @@ func (plugin *Plugin) DelegateAdd(pluginName string, nwCfg *NetworkConfig) (*cni
 
 	res, err := cniInvoke.DelegateAdd(pluginName, nwCfg.Serialize(), nil)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to delegate: %v", err)
+		return nil, fmt.Errorf("Failed to delegate: %w", err)
 	}
 
 	result, err = cniTypesCurr.NewResultFromResult(res)
@@ -128,20 +129,18 @@ func (plugin *Plugin) DelegateDel(pluginName string, nwCfg *NetworkConfig) error
 
 	err = cniInvoke.DelegateDel(pluginName, nwCfg.Serialize(), nil)
 	if err != nil {
-		return fmt.Errorf("Failed to delegate: %v", err)
+		return fmt.Errorf("Failed to delegate: %w", err)
 	}
 
 	return nil
 }
 
-// Error creates and logs a structured CNI error.
+// Error creates and logs a structured CNI error. The CNI error code is derived from the code of
+// the error, which is reported in the details of the CNI error.
 func (plugin *Plugin) Error(err error) *cniTypes.Error {
-	var cniErr *cniTypes.Error
-	var ok bool
-
-	// Wrap error if necessary.
-	if cniErr, ok = err.(*cniTypes.Error); !ok {
-		cniErr = &cniTypes.Error{Code: 100, Msg: err.Error()}
+	cniErr, ok := err.(*cniTypes.Error)
+	if !ok {
+		cniErr = newError(err.Error(), err)
 	}
 
 	log.Printf("[%v] %+v.", plugin.Name, cniErr.Error())
@@ -149,9 +148,39 @@ func (plugin *Plugin) Error(err error) *cniTypes.Error {
 	return cniErr
 }
 
-// Errorf creates and logs a custom CNI error according to a format specifier.
+// Errorf creates and logs a custom CNI error according to a format specifier. The CNI error code
+// is derived from the first error in the arguments.
 func (plugin *Plugin) Errorf(format string, args ...interface{}) *cniTypes.Error {
-	return plugin.Error(fmt.Errorf(format, args...))
+	msg := fmt.Sprintf(format, args...)
+
+	for _, arg := range args {
+		if err, ok := arg.(error); ok {
+			return plugin.Error(newError(msg, err))
+		}
+	}
+
+	return plugin.Error(&cniTypes.Error{Code: ErrRuntime, Msg: msg})
+}
+
+// newError creates a CNI error with the given message for the given error. Errors of delegated
+// plugins keep their CNI error code and details.
+func newError(msg string, err error) *cniTypes.Error {
+	var cniErr *cniTypes.Error
+	if errors.As(err, &cniErr) {
+		return &cniTypes.Error{Code: cniErr.Code, Msg: msg, Details: cniErr.Details}
+	}
+
+	code := common.GetErrorCode(err)
+	if code == common.ErrCodeUnknown {
+		return &cniTypes.Error{Code: ErrRuntime, Msg: msg}
+	}
+
+	cniCode, ok := cniErrorCodes[code]
+	if !ok {
+		cniCode = ErrRuntime
+	}
+
+	return &cniTypes.Error{Code: cniCode, Msg: msg, Details: string(code)}
 }
 
 // Initialize key-value store
@@ -7,6 +7,9 @@ const (
 	// Libnetwork remote plugin paths
 	activatePath = "/Plugin.Activate"
 
+	// Version of the Docker plugin API implemented by the plugins.
+	remotePluginAPIVersion = "1.2"
+
 	// Libnetwork labels
 	genericData = "com.docker.network.generic"
 )
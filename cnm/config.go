@@ -0,0 +1,78 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package cnm
+
+import (
+	"net/url"
+
+	"github.com/Azure/azure-container-networking/common"
+)
+
+// Config is the configuration of the CNM plugin, decoded from its arguments.
+type Config struct {
+	Environment              string `arg:"environment"`
+	APIServerURL             string `arg:"api-url"`
+	LogLevel                 int    `arg:"log-level"`
+	LogTarget                int    `arg:"log-target"`
+	LogLocation              string `arg:"log-location"`
+	IpamQueryURL             string `arg:"ipam-query-url"`
+	IpamQueryInterval        int    `arg:"ipam-query-interval"`
+	EndpointGCInterval       int    `arg:"endpoint-gc-interval"`
+	EndpointGCGracePeriod    int    `arg:"endpoint-gc-grace-period"`
+	InterfaceRefreshInterval int    `arg:"interface-refresh-interval"`
+	Version                  bool   `arg:"version"`
+}
+
+// ParseConfig decodes and validates the configuration from the arguments parsed with ParseArgs.
+// The returned error lists every invalid argument.
+func ParseConfig() (*Config, error) {
+	var config Config
+	var configErr common.ConfigError
+
+	configErr.Merge(common.DecodeArgs(&config))
+	configErr.Merge(config.Validate())
+
+	return &config, configErr.Err()
+}
+
+// Validate checks the ranges of the options and that they are consistent.
+func (config *Config) Validate() error {
+	var configErr common.ConfigError
+
+	for _, option := range []struct {
+		name  string
+		value string
+	}{
+		{common.OptAPIServerURL, config.APIServerURL},
+		{common.OptIpamQueryUrl, config.IpamQueryURL},
+	} {
+		if option.value == "" {
+			continue
+		}
+
+		if u, err := url.Parse(option.value); err != nil || u.Scheme == "" {
+			configErr.Add(option.name, "Invalid URL %v", option.value)
+		}
+	}
+
+	for _, option := range []struct {
+		name  string
+		value int
+	}{
+		{common.OptIpamQueryInterval, config.IpamQueryInterval},
+		{common.OptEndpointGCInterval, config.EndpointGCInterval},
+		{common.OptEndpointGCGracePeriod, config.EndpointGCGracePeriod},
+		{common.OptInterfaceRefreshInterval, config.InterfaceRefreshInterval},
+	} {
+		if option.value < 0 {
+			configErr.Add(option.name, "Value %v is negative", option.value)
+		}
+	}
+
+	if config.EndpointGCGracePeriod > 0 && config.EndpointGCInterval == 0 {
+		configErr.Add(common.OptEndpointGCGracePeriod, "Requires %v", common.OptEndpointGCInterval)
+	}
+
+	return configErr.Err()
+}
@@ -13,6 +13,7 @@ const (
 	RequestPoolPath      = "/IpamDriver.RequestPool"
 	ReleasePoolPath      = "/IpamDriver.ReleasePool"
 	GetPoolInfoPath      = "/IpamDriver.GetPoolInfo"
+	GetPoolUsagePath     = "/IpamDriver.GetPoolUsage"
 	RequestAddressPath   = "/IpamDriver.RequestAddress"
 	ReleaseAddressPath   = "/IpamDriver.ReleaseAddress"
 
@@ -83,6 +84,28 @@ type GetPoolInfoResponse struct {
 	UnhealthyAddresses []string
 }
 
+// Request sent when querying address pool utilization.
+type GetPoolUsageRequest struct {
+	PoolID string
+}
+
+// Address allocated from a pool along with the ID of its owner.
+type AllocatedAddress struct {
+	Address string
+	OwnerID string
+}
+
+// Response sent by plugin when returning address pool utilization.
+type GetPoolUsageResponse struct {
+	Err       string
+	Total     int
+	Allocated int
+	Reserved  int
+	Unhealthy int
+	Available int
+	Addresses []AllocatedAddress
+}
+
 // Request sent by libnetwork when reserving an address from a pool.
 type RequestAddressRequest struct {
 	PoolID  string
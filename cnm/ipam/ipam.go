@@ -77,9 +77,15 @@ func (plugin *ipamPlugin) Start(config *common.PluginConfig) error {
 	listener.AddHandler(RequestPoolPath, plugin.requestPool)
 	listener.AddHandler(ReleasePoolPath, plugin.releasePool)
 	listener.AddHandler(GetPoolInfoPath, plugin.getPoolInfo)
+	listener.AddHandler(GetPoolUsagePath, plugin.getPoolUsage)
 	listener.AddHandler(RequestAddressPath, plugin.requestAddress)
 	listener.AddHandler(ReleaseAddressPath, plugin.releaseAddress)
 
+	// Report the state of the address source on /healthz.
+	if err = plugin.AddHealthCheck("ipam-source", plugin.am.CheckSource); err != nil {
+		log.Printf("[ipam] Failed to add health check, err:%v.", err)
+	}
+
 	// Plugin is ready to be discovered.
 	err = plugin.EnableDiscovery()
 	if err != nil {
@@ -237,6 +243,49 @@ func (plugin *ipamPlugin) getPoolInfo(w http.ResponseWriter, r *http.Request) {
 	log.Response(plugin.Name, &resp, err)
 }
 
+// Handles GetPoolUsage requests.
+func (plugin *ipamPlugin) getPoolUsage(w http.ResponseWriter, r *http.Request) {
+	var req GetPoolUsageRequest
+
+	// Decode request.
+	err := plugin.Listener.Decode(w, r, &req)
+	log.Request(plugin.Name, &req, err)
+	if err != nil {
+		return
+	}
+
+	// Process request.
+	poolId, err := ipam.NewAddressPoolIdFromString(req.PoolID)
+	if err != nil {
+		plugin.SendErrorResponse(w, err)
+		return
+	}
+
+	usage, err := plugin.am.GetPoolUsage(poolId.AsId, poolId.Subnet)
+	if err != nil {
+		plugin.SendErrorResponse(w, err)
+		return
+	}
+
+	// Encode response.
+	resp := GetPoolUsageResponse{
+		Total:     usage.Total,
+		Allocated: usage.Allocated,
+		Reserved:  usage.Reserved,
+		Unhealthy: usage.Unhealthy,
+		Available: usage.Total - usage.Allocated - usage.Reserved,
+		Addresses: []AllocatedAddress{},
+	}
+
+	for _, addr := range usage.Addresses {
+		resp.Addresses = append(resp.Addresses, AllocatedAddress{Address: addr.Address.String(), OwnerID: addr.OwnerID})
+	}
+
+	err = plugin.Listener.Encode(w, &resp)
+
+	log.Response(plugin.Name, &resp, err)
+}
+
 // Handles RequestAddress requests.
 func (plugin *ipamPlugin) requestAddress(w http.ResponseWriter, r *http.Request) {
 	var req RequestAddressRequest
@@ -262,6 +311,7 @@ func (plugin *ipamPlugin) requestAddress(w http.ResponseWriter, r *http.Request)
 	}
 
 	options[ipam.OptAddressID] = req.Options[ipam.OptAddressID]
+	options[ipam.OptStaticAddress] = req.Options[ipam.OptStaticAddress]
 
 	addr, err := plugin.am.RequestAddress(poolId.AsId, poolId.Subnet, req.Address, options)
 	if err != nil {
@@ -428,3 +428,51 @@ func TestReleaseAddressWithID(t *testing.T) {
 		t.Errorf("ReleaseAddress response is invalid %+v", err)
 	}
 }
+
+// Tests IpamDriver.GetPoolUsage functionality.
+func TestGetPoolUsage(t *testing.T) {
+	reqPayload := &RequestAddressRequest{
+		PoolID:  poolId1,
+		Options: map[string]string{ipam.OptAddressID: "usage"},
+	}
+
+	addr, err := reqAddrInternal(reqPayload)
+	if err != nil {
+		t.Fatalf("RequestAddress response is invalid %+v", err)
+	}
+
+	var body bytes.Buffer
+	var resp GetPoolUsageResponse
+
+	json.NewEncoder(&body).Encode(&GetPoolUsageRequest{PoolID: poolId1})
+
+	req, err := http.NewRequest(http.MethodGet, GetPoolUsagePath, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	err = decodeResponse(w, &resp)
+	if err != nil || resp.Err != "" || resp.Total != resp.Allocated+resp.Reserved+resp.Available {
+		t.Errorf("GetPoolUsage response is invalid %+v", resp)
+	}
+
+	address, _, _ := net.ParseCIDR(addr)
+	found := false
+	for _, allocated := range resp.Addresses {
+		if allocated.Address == address.String() && allocated.OwnerID == "usage" {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Errorf("GetPoolUsage response does not list address %v, got %+v", addr, resp)
+	}
+
+	err = releaseAddrInternal(&ReleaseAddressRequest{PoolID: poolId1, Address: address.String()})
+	if err != nil {
+		t.Errorf("ReleaseAddress response is invalid %+v", err)
+	}
+}
@@ -3,6 +3,10 @@
 
 package network
 
+import (
+	"github.com/Azure/azure-container-networking/network"
+)
+
 const (
 	// Libnetwork network plugin endpoint type
 	endpointType = "NetworkDriver"
@@ -17,8 +21,27 @@ const (
 	leavePath            = "/NetworkDriver.Leave"
 	endpointOperInfoPath = "/NetworkDriver.EndpointOperInfo"
 
+	// Read-only plugin state query path
+	statePath = "/state"
+	gcPath    = "/gc"
+
+	// Read-only diagnostic snapshot path
+	snapshotPath = "/debug/network-snapshot"
+
 	// Libnetwork network plugin options
-	modeOption = "com.microsoft.azure.network.mode"
+	modeOption                 = "com.microsoft.azure.network.mode"
+	mtuOption                  = "com.microsoft.azure.network.mtu"
+	dnsServersOption           = "com.microsoft.azure.network.dns.servers"
+	dnsSuffixOption            = "com.microsoft.azure.network.dns.suffix"
+	masterOption               = "com.microsoft.azure.network.master"
+	masterMacOption            = "com.microsoft.azure.network.master.mac"
+	masterPatternOption        = "com.microsoft.azure.network.master.pattern"
+	maxOutgoingBandwidthOption = "com.microsoft.azure.network.endpoint.maxoutgoingbandwidth"
+
+	// HNS retry policy of the endpoints of the network, with backoffs in milliseconds.
+	hnsRetryAttemptsOption       = "com.microsoft.azure.network.hns.retry.attempts"
+	hnsRetryInitialBackoffOption = "com.microsoft.azure.network.hns.retry.initialbackoff"
+	hnsRetryMaxBackoffOption     = "com.microsoft.azure.network.hns.retry.maxbackoff"
 )
 
 // Request sent by libnetwork when querying plugin capabilities.
@@ -147,3 +170,33 @@ type endpointOperInfoResponse struct {
 	Err   string
 	Value map[string]interface{}
 }
+
+// Response sent by plugin when queried for its state.
+type stateResponse struct {
+	Err      string
+	Networks []networkState
+	Orphans  []*network.OrphanInfo `json:",omitempty"`
+}
+
+// Represents a network and its endpoints in a state response.
+type networkState struct {
+	*network.NetworkInfo
+	Endpoints []*network.EndpointInfo
+}
+
+// Response sent by plugin when queried for a diagnostic snapshot.
+type snapshotResponse struct {
+	Err string
+	*network.Snapshot
+}
+
+// Request sent to the plugin to delete the endpoints of dead containers.
+type gcRequest struct {
+	GracePeriodSeconds int
+}
+
+// Response sent by plugin when the endpoints of dead containers are deleted.
+type gcResponse struct {
+	Err     string
+	Deleted []string
+}
@@ -4,13 +4,19 @@
 package network
 
 import (
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Azure/azure-container-networking/cnm"
 	"github.com/Azure/azure-container-networking/common"
 	"github.com/Azure/azure-container-networking/log"
 	"github.com/Azure/azure-container-networking/network"
+	"github.com/Azure/azure-container-networking/network/policy"
 	"github.com/Azure/azure-container-networking/platform"
 )
 
@@ -75,6 +81,12 @@ func (plugin *netPlugin) Start(config *common.PluginConfig) error {
 		return err
 	}
 
+	// Clean up endpoints leaked by a previous instance.
+	err = plugin.nm.ReconcileEndpoints(false)
+	if err != nil {
+		log.Printf("[net] Failed to reconcile endpoints, err:%v.", err)
+	}
+
 	// Add protocol handlers.
 	listener := plugin.Listener
 	listener.AddEndpoint(plugin.EndpointType)
@@ -86,6 +98,15 @@ func (plugin *netPlugin) Start(config *common.PluginConfig) error {
 	listener.AddHandler(joinPath, plugin.join)
 	listener.AddHandler(leavePath, plugin.leave)
 	listener.AddHandler(endpointOperInfoPath, plugin.endpointOperInfo)
+	listener.AddReadOnlyHandler(statePath, plugin.getState)
+	listener.AddHandler(gcPath, plugin.collectEndpoints)
+	listener.AddReadOnlyHandler(snapshotPath, plugin.getSnapshot)
+
+	// Periodically delete the endpoints of dead containers, if enabled.
+	if interval, _ := plugin.GetOption(common.OptEndpointGCInterval).(int); interval > 0 {
+		gracePeriod, _ := plugin.GetOption(common.OptEndpointGCGracePeriod).(int)
+		plugin.nm.StartEndpointGC(isSandboxAlive, time.Duration(gracePeriod)*time.Second, time.Duration(interval)*time.Second)
+	}
 
 	// Plugin is ready to be discovered.
 	err = plugin.EnableDiscovery()
@@ -145,6 +166,27 @@ func (plugin *netPlugin) createNetwork(w http.ResponseWriter, r *http.Request) {
 	options := plugin.ParseOptions(req.Options)
 	if options != nil {
 		nwInfo.Mode, _ = options[modeOption].(string)
+		if mtu, ok := options[mtuOption].(string); ok {
+			nwInfo.MTU, _ = strconv.Atoi(mtu)
+		}
+		nwInfo.RetryPolicy = getRetryPolicy(options)
+
+		// Network DNS settings are inherited by endpoints.
+		if servers, ok := options[dnsServersOption].(string); ok && servers != "" {
+			nwInfo.DNS.Servers = strings.Split(servers, ",")
+		}
+		nwInfo.DNS.Suffix, _ = options[dnsSuffixOption].(string)
+
+		// Pin the external interface.
+		nwInfo.MasterIfName, _ = options[masterOption].(string)
+		nwInfo.MasterIfNamePattern, _ = options[masterPatternOption].(string)
+		if mac, ok := options[masterMacOption].(string); ok && mac != "" {
+			nwInfo.MasterIfMacAddress, err = net.ParseMAC(mac)
+			if err != nil {
+				plugin.SendErrorResponse(w, fmt.Errorf("Invalid external interface MAC address %v: %v", mac, err))
+				return
+			}
+		}
 	}
 
 	// Populate subnets.
@@ -190,8 +232,9 @@ func (plugin *netPlugin) deleteNetwork(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Process request.
+	// Networks that do not exist are already deleted.
 	err = plugin.nm.DeleteNetwork(req.NetworkID)
-	if err != nil {
+	if err != nil && !errors.Is(err, network.ErrNetworkNotFound) {
 		plugin.SendErrorResponse(w, err)
 		return
 	}
@@ -233,6 +276,18 @@ func (plugin *netPlugin) createEndpoint(w http.ResponseWriter, r *http.Request)
 
 	epInfo.Data = make(map[string]interface{})
 
+	// Limit the egress bandwidth of the endpoint, in bytes per second.
+	if req.Options[maxOutgoingBandwidthOption] != nil {
+		var maxOutgoingBandwidth uint64
+		maxOutgoingBandwidth, err = strconv.ParseUint(fmt.Sprint(req.Options[maxOutgoingBandwidthOption]), 10, 64)
+		if err != nil {
+			plugin.SendErrorResponse(w, err)
+			return
+		}
+
+		epInfo.Policies = append(epInfo.Policies, policy.GetQosPolicy(maxOutgoingBandwidth))
+	}
+
 	err = plugin.nm.CreateEndpoint(req.NetworkID, &epInfo)
 	if err != nil {
 		plugin.SendErrorResponse(w, err)
@@ -259,8 +314,9 @@ func (plugin *netPlugin) deleteEndpoint(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Process request.
+	// Endpoints that do not exist, or whose network does not exist, are already deleted.
 	err = plugin.nm.DeleteEndpoint(req.NetworkID, req.EndpointID)
-	if err != nil {
+	if err != nil && !errors.Is(err, network.ErrEndpointNotFound) && !errors.Is(err, network.ErrNetworkNotFound) {
 		plugin.SendErrorResponse(w, err)
 		return
 	}
@@ -355,3 +411,120 @@ func (plugin *netPlugin) endpointOperInfo(w http.ResponseWriter, r *http.Request
 
 	log.Response(plugin.Name, &resp, err)
 }
+
+//
+// Plugin state API implementation
+//
+
+// Handles state queries. The networkid, containerid and ifname query parameters
+// restrict the response to matching networks and endpoints.
+func (plugin *netPlugin) getState(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	networkID := query.Get("networkid")
+	filter := &network.EndpointFilter{
+		ContainerID: query.Get("containerid"),
+		IfName:      query.Get("ifname"),
+	}
+
+	log.Printf("[net] Received state query %v.", r.URL.RawQuery)
+
+	// Process request.
+	nwInfos, err := plugin.nm.GetNetworkInfos()
+	if err != nil {
+		plugin.SendErrorResponse(w, err)
+		return
+	}
+
+	resp := stateResponse{Networks: []networkState{}}
+	for _, nwInfo := range nwInfos {
+		if networkID != "" && nwInfo.Id != networkID {
+			continue
+		}
+
+		epInfos, err := plugin.nm.GetEndpointInfos(nwInfo.Id, filter)
+		if err != nil {
+			// The network was deleted after it was listed.
+			continue
+		}
+
+		resp.Networks = append(resp.Networks, networkState{NetworkInfo: nwInfo, Endpoints: epInfos})
+	}
+
+	// Report the entries dropped from the persisted state as invalid.
+	resp.Orphans, err = plugin.nm.GetOrphanInfos()
+	if err != nil {
+		plugin.SendErrorResponse(w, err)
+		return
+	}
+
+	// Encode response.
+	err = plugin.Listener.Encode(w, &resp)
+
+	log.Response(plugin.Name, &resp, err)
+}
+
+// Handles diagnostic snapshot queries.
+func (plugin *netPlugin) getSnapshot(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[net] Received snapshot query.")
+
+	// Process request.
+	snapshot, err := plugin.nm.Snapshot()
+	if err != nil {
+		plugin.SendErrorResponse(w, err)
+		return
+	}
+
+	// Encode response. The snapshot is too large to be logged.
+	resp := snapshotResponse{Snapshot: snapshot}
+	err = plugin.Listener.Encode(w, &resp)
+
+	log.Printf("[net] Sent snapshot of %v networks, err:%v.", len(snapshot.Networks), err)
+}
+
+// Handles requests to delete the endpoints of dead containers.
+func (plugin *netPlugin) collectEndpoints(w http.ResponseWriter, r *http.Request) {
+	var req gcRequest
+
+	// Decode request.
+	err := plugin.Listener.Decode(w, r, &req)
+	log.Request(plugin.Name, &req, err)
+	if err != nil {
+		return
+	}
+
+	// Process request.
+	deleted, err := plugin.nm.CollectEndpoints(isSandboxAlive, time.Duration(req.GracePeriodSeconds)*time.Second)
+	if err != nil {
+		plugin.SendErrorResponse(w, err)
+		return
+	}
+
+	// Encode response.
+	resp := gcResponse{Deleted: deleted}
+	err = plugin.Listener.Encode(w, &resp)
+
+	log.Response(plugin.Name, &resp, err)
+}
+
+// getRetryPolicy returns the HNS retry policy set by the network options. Returns nil to select
+// the default policy if the options do not set the number of attempts.
+func getRetryPolicy(options map[string]interface{}) *network.RetryPolicy {
+	var retryPolicy network.RetryPolicy
+	if attempts, ok := options[hnsRetryAttemptsOption].(string); ok {
+		retryPolicy.MaxAttempts, _ = strconv.Atoi(attempts)
+	}
+	if retryPolicy.MaxAttempts <= 0 {
+		return nil
+	}
+
+	if backoff, ok := options[hnsRetryInitialBackoffOption].(string); ok {
+		ms, _ := strconv.Atoi(backoff)
+		retryPolicy.InitialBackoff = time.Duration(ms) * time.Millisecond
+	}
+	if backoff, ok := options[hnsRetryMaxBackoffOption].(string); ok {
+		ms, _ := strconv.Atoi(backoff)
+		retryPolicy.MaxBackoff = time.Duration(ms) * time.Millisecond
+	}
+
+	return &retryPolicy
+}
@@ -0,0 +1,30 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"os"
+
+	"github.com/Azure/azure-container-networking/network"
+)
+
+// isSandboxAlive returns whether the sandbox an endpoint is joined to still exists. Libnetwork
+// removes the network namespace of a sandbox along with it, so a missing namespace means the
+// container is gone. Endpoints that are not joined are still owned by libnetwork.
+func isSandboxAlive(epInfo *network.EndpointInfo) (bool, error) {
+	if epInfo.SandboxKey == "" {
+		return true, nil
+	}
+
+	_, err := os.Stat(epInfo.SandboxKey)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -66,18 +66,18 @@ func TestMain(m *testing.M) {
 		os.Exit(3)
 	}
 
-	err = plugin.(*netPlugin).nm.AddExternalInterface(anyInterface, anySubnet)
-	if err != nil {
-		fmt.Printf("Failed to add test network interface, err:%v.\n", err)
-		os.Exit(4)
-	}
-
 	err = netlink.AddIpAddress(anyInterface, net.ParseIP("192.168.1.4"), &ipnet)
 	if err != nil {
 		fmt.Printf("Failed to add test IP address, err:%v.\n", err)
 		os.Exit(5)
 	}
 
+	err = plugin.(*netPlugin).nm.AddExternalInterface(anyInterface, anySubnet)
+	if err != nil {
+		fmt.Printf("Failed to add test network interface, err:%v.\n", err)
+		os.Exit(4)
+	}
+
 	// Get the internal http mux as test hook.
 	mux = plugin.(*netPlugin).Listener.GetMux()
 
@@ -158,7 +158,8 @@ func TestCreateNetwork(t *testing.T) {
 		NetworkID: networkID,
 		IPv4Data: []driverApi.IPAMData{
 			{
-				Pool: pool,
+				Pool:    pool,
+				Gateway: &net.IPNet{IP: net.ParseIP("192.168.1.1"), Mask: pool.Mask},
 			},
 		},
 	}
@@ -234,6 +235,57 @@ func TestEndpointOperInfo(t *testing.T) {
 	}
 }
 
+// Tests plugin state queries.
+func TestGetState(t *testing.T) {
+	var resp stateResponse
+
+	req, err := http.NewRequest(http.MethodGet, statePath+"?networkid="+networkID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	err = decodeResponse(w, &resp)
+	if err != nil || resp.Err != "" || len(resp.Networks) != 1 || resp.Networks[0].Id != networkID ||
+		len(resp.Networks[0].Endpoints) != 1 || resp.Networks[0].Endpoints[0].Id != endpointID {
+		t.Errorf("State response is invalid %+v", resp)
+	}
+
+	// The state cannot be modified.
+	req, err = http.NewRequest(http.MethodPost, statePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected state update to be rejected, got HTTP status %d", w.Code)
+	}
+}
+
+// Tests diagnostic snapshot queries.
+func TestGetSnapshot(t *testing.T) {
+	var resp snapshotResponse
+
+	req, err := http.NewRequest(http.MethodGet, snapshotPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	err = decodeResponse(w, &resp)
+	if err != nil || resp.Err != "" || resp.Snapshot == nil || len(resp.Networks) != 1 ||
+		resp.Networks[0].Id != networkID || resp.Host == nil {
+		t.Errorf("Snapshot response is invalid %+v", resp)
+	}
+}
+
 // Tests NetworkDriver.DeleteNetwork functionality.
 func TestDeleteNetwork(t *testing.T) {
 	var body bytes.Buffer
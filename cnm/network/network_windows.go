@@ -0,0 +1,14 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"github.com/Azure/azure-container-networking/network"
+)
+
+// isSandboxAlive returns whether the sandbox an endpoint is joined to still exists. Sandbox keys
+// are not paths on Windows, so endpoints are always kept.
+func isSandboxAlive(epInfo *network.EndpointInfo) (bool, error) {
+	return true, nil
+}
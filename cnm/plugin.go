@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 
 	"github.com/Azure/azure-container-networking/common"
 	"github.com/Azure/azure-container-networking/log"
@@ -56,6 +57,16 @@ func (plugin *Plugin) Initialize(config *common.PluginConfig) error {
 		// Add generic protocol handlers.
 		listener.AddHandler(activatePath, plugin.activate)
 
+		// Serve the health checks of the subsystems and the build version.
+		err = listener.EnableServiceHandlers(common.VersionInfo{
+			Version:     config.Version,
+			GitCommit:   config.GitCommit,
+			APIVersions: []string{remotePluginAPIVersion},
+		})
+		if err != nil {
+			return err
+		}
+
 		// Start the listener.
 		err = listener.Start(config.ErrChan)
 		if err != nil {
@@ -89,11 +100,22 @@ func (plugin *Plugin) EnableDiscovery() error {
 
 	// Write the listener URL to the spec file.
 	fileName := path + plugin.Name + ".spec"
-	url := plugin.Listener.URL.String()
+	url := getSpecURL(plugin.Listener.URL)
 	err := ioutil.WriteFile(fileName, []byte(url), 0644)
 	return err
 }
 
+// getSpecURL returns the listener URL to write to the plugin spec file. Docker dials the path of
+// npipe URLs as is, so they are written with the full path of the pipe, for example npipe:////./pipe/azure-vnet.
+func getSpecURL(u *url.URL) string {
+	if u.Scheme != "npipe" {
+		return u.String()
+	}
+
+	path := strings.Replace(u.Host+u.Path, `\`, "/", -1)
+	return "npipe:////" + strings.TrimLeft(path, "/")
+}
+
 // DisableDiscovery disables discovery by deleting the plugin spec file.
 func (plugin *Plugin) DisableDiscovery() {
 	// Plugins using unix domain sockets do not need a spec file.
@@ -105,6 +127,11 @@ func (plugin *Plugin) DisableDiscovery() {
 	os.Remove(fileName)
 }
 
+// AddHealthCheck registers a health check of the named subsystem, reported on /healthz.
+func (plugin *Plugin) AddHealthCheck(name string, check func() error) error {
+	return plugin.Listener.AddHealthCheck(name, check)
+}
+
 // ParseOptions returns generic options from a libnetwork request.
 func (plugin *Plugin) ParseOptions(options OptionMap) OptionMap {
 	opt, _ := options[genericData].(map[string]interface{})
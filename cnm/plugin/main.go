@@ -8,7 +8,9 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/Azure/azure-container-networking/cnm"
 	"github.com/Azure/azure-container-networking/cnm/ipam"
 	"github.com/Azure/azure-container-networking/cnm/network"
 	"github.com/Azure/azure-container-networking/common"
@@ -25,6 +27,9 @@ const (
 // Version is populated by make during build.
 var version string
 
+// Git commit of the plugin, set at build time.
+var commit string
+
 // Command line arguments for CNM plugin.
 var args = common.ArgumentList{
 	{
@@ -89,6 +94,34 @@ var args = common.ArgumentList{
 		Type:         "int",
 		DefaultValue: "",
 	},
+	{
+		Name:         common.OptEndpointGCInterval,
+		Shorthand:    common.OptEndpointGCIntervalAlias,
+		Description:  "Set the interval in seconds between collections of endpoints of dead containers",
+		Type:         "int",
+		DefaultValue: "",
+	},
+	{
+		Name:         common.OptEndpointGCGracePeriod,
+		Shorthand:    common.OptEndpointGCGracePeriodAlias,
+		Description:  "Set the minimum age in seconds of collected endpoints",
+		Type:         "int",
+		DefaultValue: "",
+	},
+	{
+		Name:         common.OptInterfaceRefreshInterval,
+		Shorthand:    common.OptInterfaceRefreshIntervalAlias,
+		Description:  "Set the interval in seconds between refreshes of the cached host network interfaces",
+		Type:         "int",
+		DefaultValue: "60",
+	},
+	{
+		Name:         common.OptConfigFile,
+		Shorthand:    common.OptConfigFileAlias,
+		Description:  "Set the JSON file of options that are not set on the command line or in the environment",
+		Type:         "string",
+		DefaultValue: "",
+	},
 	{
 		Name:         common.OptVersion,
 		Shorthand:    common.OptVersionAlias,
@@ -106,16 +139,26 @@ func printVersion() {
 
 // Main is the entry point for CNM plugin.
 func main() {
-	// Initialize and parse command line arguments.
-	common.ParseArgs(&args, printVersion)
+	// Initialize and parse arguments from the command line, the environment and the config file.
+	common.ParseArgsWithEnv(&args, printVersion, "CNM")
 
-	environment := common.GetArg(common.OptEnvironment).(string)
-	url := common.GetArg(common.OptAPIServerURL).(string)
-	logLevel := common.GetArg(common.OptLogLevel).(int)
-	logTarget := common.GetArg(common.OptLogTarget).(int)
-	ipamQueryUrl, _ := common.GetArg(common.OptIpamQueryUrl).(string)
-	ipamQueryInterval, _ := common.GetArg(common.OptIpamQueryInterval).(int)
-	vers := common.GetArg(common.OptVersion).(bool)
+	// Decode and validate the arguments, reporting all invalid ones at once.
+	cfg, err := cnm.ParseConfig()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+
+	environment := cfg.Environment
+	url := cfg.APIServerURL
+	logLevel := cfg.LogLevel
+	logTarget := cfg.LogTarget
+	ipamQueryUrl := cfg.IpamQueryURL
+	ipamQueryInterval := cfg.IpamQueryInterval
+	endpointGCInterval := cfg.EndpointGCInterval
+	endpointGCGracePeriod := cfg.EndpointGCGracePeriod
+	interfaceRefreshInterval := cfg.InterfaceRefreshInterval
+	vers := cfg.Version
 
 	if vers {
 		printVersion()
@@ -125,6 +168,7 @@ func main() {
 	// Initialize plugin common configuration.
 	var config common.PluginConfig
 	config.Version = version
+	config.GitCommit = commit
 
 	// Create a channel to receive unhandled errors from the plugins.
 	config.ErrChan = make(chan error, 1)
@@ -167,10 +211,40 @@ func main() {
 
 	// Log platform information.
 	log.Printf("Running on %v", platform.GetOSInfo())
+	common.LogArgs()
 	common.LogNetworkInterfaces()
 
+	// Watch the config file and apply the options that can change without restarting.
+	configWatcher, err := common.NewArgConfigWatcher(map[string]func(interface{}){
+		common.OptLogLevel: func(value interface{}) { log.SetLevel(value.(int)) },
+	})
+	if err != nil {
+		fmt.Printf("Failed to watch config file, err:%v.\n", err)
+		return
+	}
+	if configWatcher != nil {
+		if err = configWatcher.Start(); err != nil {
+			fmt.Printf("Failed to start config watcher, err:%v.\n", err)
+			return
+		}
+		defer configWatcher.Stop()
+	}
+
+	// Cache the host network interfaces shared by the plugins and refresh them periodically.
+	config.Interfaces = common.NewInterfaceInventory()
+	if err = config.Interfaces.Refresh(); err != nil {
+		fmt.Printf("Failed to query network interfaces, err:%v.\n", err)
+		return
+	}
+
+	if interfaceRefreshInterval > 0 {
+		config.Interfaces.Start(time.Duration(interfaceRefreshInterval) * time.Second)
+	}
+
 	// Set plugin options.
 	netPlugin.SetOption(common.OptAPIServerURL, url)
+	netPlugin.SetOption(common.OptEndpointGCInterval, endpointGCInterval)
+	netPlugin.SetOption(common.OptEndpointGCGracePeriod, endpointGCGracePeriod)
 
 	ipamPlugin.SetOption(common.OptEnvironment, environment)
 	ipamPlugin.SetOption(common.OptAPIServerURL, url)
@@ -207,6 +281,8 @@ func main() {
 	}
 
 	// Cleanup.
+	config.Interfaces.Stop()
+
 	if netPlugin != nil {
 		netPlugin.Stop()
 	}
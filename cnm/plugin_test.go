@@ -0,0 +1,61 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package cnm
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/Azure/azure-container-networking/common"
+)
+
+// Tests that the spec file gets the listener URL in the form Docker dials.
+func TestGetSpecURL(t *testing.T) {
+	for address, expected := range map[string]string{
+		"tcp://localhost:48080":       "tcp://localhost:48080",
+		"npipe:////./pipe/azure-vnet": "npipe:////./pipe/azure-vnet",
+		"npipe://./pipe/azure-vnet":   "npipe:////./pipe/azure-vnet",
+	} {
+		u, err := url.Parse(address)
+		if err != nil {
+			t.Fatalf("Failed to parse %v: %v", address, err)
+		}
+
+		if specURL := getSpecURL(u); specURL != expected {
+			t.Errorf("Address %v: expected spec URL %v, got %v", address, expected, specURL)
+		}
+	}
+}
+
+// Tests that config validation reports every invalid option.
+func TestConfigValidate(t *testing.T) {
+	config := Config{
+		APIServerURL:          "tcp://localhost:48080",
+		IpamQueryURL:          "localhost",
+		IpamQueryInterval:     -1,
+		EndpointGCGracePeriod: 60,
+	}
+
+	err := config.Validate()
+	configErr, ok := err.(*common.ConfigError)
+	if !ok {
+		t.Fatalf("Expected a config error, got %v", err)
+	}
+
+	var fields []string
+	for _, field := range configErr.Fields {
+		fields = append(fields, field.Field)
+	}
+
+	expected := []string{common.OptIpamQueryUrl, common.OptIpamQueryInterval, common.OptEndpointGCGracePeriod}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Unexpected invalid fields %v, expected %v", fields, expected)
+	}
+
+	config = Config{EndpointGCInterval: 300, EndpointGCGracePeriod: 60}
+	if err = config.Validate(); err != nil {
+		t.Errorf("Unexpected error for a valid config: %v", err)
+	}
+}
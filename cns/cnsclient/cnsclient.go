@@ -3,10 +3,12 @@ package cnsclient
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 
 	"github.com/Azure/azure-container-networking/cns"
+	acn "github.com/Azure/azure-container-networking/common"
 	"github.com/Azure/azure-container-networking/log"
 )
 
@@ -57,6 +59,13 @@ func (cnsClient *CNSClient) GetNetworkConfiguration(orchestratorContext []byte)
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
+		var errResp acn.ErrorResponse
+		if err = json.NewDecoder(res.Body).Decode(&errResp); err == nil && errResp.Error.Code != "" {
+			log.Printf("[Azure CNSClient] GetNetworkConfiguration received error response %v: %v",
+				errResp.Error.Code, errResp.Error.Message)
+			return nil, errors.New(errResp.Error.Message)
+		}
+
 		errMsg := fmt.Sprintf("[Azure CNSClient] GetNetworkConfiguration invalid http status code: %v", res.StatusCode)
 		log.Printf(errMsg)
 		return nil, fmt.Errorf(errMsg)
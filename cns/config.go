@@ -0,0 +1,102 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package cns
+
+import (
+	"net/url"
+	"os"
+	"strings"
+
+	acn "github.com/Azure/azure-container-networking/common"
+)
+
+// Config is the configuration of CNS, decoded from its arguments.
+type Config struct {
+	Environment       string `arg:"environment"`
+	APIServerURL      string `arg:"api-url"`
+	CnsURL            string `arg:"cns-url"`
+	CnsTokenFile      string `arg:"cns-token-file"`
+	LogLevel          int    `arg:"log-level"`
+	LogTarget         int    `arg:"log-target"`
+	LogLocation       string `arg:"log-location"`
+	IpamQueryURL      string `arg:"ipam-query-url"`
+	IpamQueryInterval int    `arg:"ipam-query-interval"`
+	StopAzureVnet     bool   `arg:"stop-azure-cnm"`
+	Version           bool   `arg:"version"`
+}
+
+// ParseConfig decodes and validates the configuration from the arguments parsed with ParseArgs.
+// The returned error lists every invalid argument.
+func ParseConfig() (*Config, error) {
+	var config Config
+	var configErr acn.ConfigError
+
+	configErr.Merge(acn.DecodeArgs(&config))
+	configErr.Merge(config.Validate())
+
+	return &config, configErr.Err()
+}
+
+// Validate checks the ranges of the options and that they are consistent.
+func (config *Config) Validate() error {
+	var configErr acn.ConfigError
+
+	// CNS listens on each of the comma-separated URLs.
+	if config.CnsURL != "" {
+		seen := make(map[string]bool)
+		for _, rawURL := range strings.Split(config.CnsURL, ",") {
+			rawURL = strings.TrimSpace(rawURL)
+			if u, err := url.Parse(rawURL); err != nil || u.Scheme == "" {
+				configErr.Add(acn.OptCnsURL, "Invalid URL %v", rawURL)
+			} else if seen[rawURL] {
+				configErr.Add(acn.OptCnsURL, "Duplicate URL %v", rawURL)
+			}
+			seen[rawURL] = true
+		}
+	}
+
+	for _, option := range []struct {
+		name  string
+		value string
+	}{
+		{acn.OptAPIServerURL, config.APIServerURL},
+		{acn.OptIpamQueryUrl, config.IpamQueryURL},
+	} {
+		if option.value == "" {
+			continue
+		}
+
+		if u, err := url.Parse(option.value); err != nil || u.Scheme == "" {
+			configErr.Add(option.name, "Invalid URL %v", option.value)
+		}
+	}
+
+	if config.CnsTokenFile != "" {
+		if _, err := os.Stat(config.CnsTokenFile); err != nil {
+			configErr.Add(acn.OptCnsTokenFile, "%v", err)
+		}
+	}
+
+	if config.IpamQueryInterval < 0 {
+		configErr.Add(acn.OptIpamQueryInterval, "Value %v is negative", config.IpamQueryInterval)
+	}
+
+	// The API server and IPAM options configure the CNM plugin, which is not started.
+	if config.StopAzureVnet {
+		for _, option := range []struct {
+			name string
+			set  bool
+		}{
+			{acn.OptAPIServerURL, config.APIServerURL != ""},
+			{acn.OptIpamQueryUrl, config.IpamQueryURL != ""},
+			{acn.OptIpamQueryInterval, config.IpamQueryInterval != 0},
+		} {
+			if option.set {
+				configErr.Add(option.name, "Cannot be set with %v", acn.OptStopAzureVnet)
+			}
+		}
+	}
+
+	return configErr.Err()
+}
@@ -21,6 +21,9 @@ const (
 	bridgeMode                 = "bridge"
 )
 
+// ErrNetworkNotFound is returned when docker does not know the network.
+var ErrNetworkNotFound = fmt.Errorf("Network not found")
+
 // DockerClient specifies a client to connect to docker.
 type DockerClient struct {
 	connectionURL string
@@ -66,7 +69,7 @@ func (dockerClient *DockerClient) NetworkExists(networkName string) error {
 	// network not found
 	if res.StatusCode == 404 {
 		log.Debugf("[Azure CNS] Network with name %v does not exist. Docker return code: %v", networkName, res.StatusCode)
-		return fmt.Errorf("Network not found")
+		return ErrNetworkNotFound
 	}
 
 	return fmt.Errorf("Unknown return code from docker inspect %d", res.StatusCode)
@@ -189,7 +192,7 @@ func (dockerClient *DockerClient) DeleteNetwork(networkName string) error {
 
 	// network not found.
 	if res.StatusCode == 404 {
-		return fmt.Errorf("[Azure CNS] Network not found %v", networkName)
+		return fmt.Errorf("[Azure CNS] %w %v", ErrNetworkNotFound, networkName)
 	}
 
 	return fmt.Errorf("[Azure CNS] Unknown return code from docker delete network %v: ret = %d",
@@ -4,15 +4,19 @@
 package imdsclient
 
 import (
+	"context"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
-	"net/http"
 	"strings"
 
+	acn "github.com/Azure/azure-container-networking/common"
 	"github.com/Azure/azure-container-networking/log"
 )
 
+// Client of the host agent.
+var hostClient = acn.NewHostClient(acn.HostClientConfig{Name: "CNS host query"})
+
 // GetNetworkContainerInfoFromHost retrieves the programmed version of network container from Host.
 func (imdsClient *ImdsClient) GetNetworkContainerInfoFromHost(networkContainerID string, primaryAddress string, authToken string, apiVersion string) (*ContainerVersion, error) {
 	log.Printf("[Azure CNS] GetNetworkContainerInfoFromHost")
@@ -20,17 +24,15 @@ func (imdsClient *ImdsClient) GetNetworkContainerInfoFromHost(networkContainerID
 		primaryAddress, networkContainerID, authToken, apiVersion)
 
 	log.Printf("[Azure CNS] Going to query Azure Host for container version @\n %v\n", queryURL)
-	jsonResponse, err := http.Get(queryURL)
+	jsonResponse, err := hostClient.Get(context.Background(), queryURL)
 	if err != nil {
 		return nil, err
 	}
 
-	defer jsonResponse.Body.Close()
-
-	log.Printf("[Azure CNS] Response received from Azure Host for NetworkManagement/interfaces: %v", jsonResponse.Body)
+	log.Printf("[Azure CNS] Response received from Azure Host for NetworkManagement/interfaces: %s", jsonResponse)
 
 	var response containerVersionJsonResponse
-	err = json.NewDecoder(jsonResponse.Body).Decode(&response)
+	err = json.Unmarshal(jsonResponse, &response)
 	if err != nil {
 		return nil, err
 	}
@@ -48,18 +50,15 @@ func (imdsClient *ImdsClient) GetPrimaryInterfaceInfoFromHost() (*InterfaceInfo,
 	log.Printf("[Azure CNS] GetPrimaryInterfaceInfoFromHost")
 
 	interfaceInfo := &InterfaceInfo{}
-	resp, err := http.Get(hostQueryURL)
+	resp, err := hostClient.Get(context.Background(), hostQueryURL)
 	if err != nil {
 		return nil, err
 	}
 
-	defer resp.Body.Close()
-
-	log.Printf("[Azure CNS] Response received from NMAgent for get interface details: %v", resp.Body)
+	log.Printf("[Azure CNS] Response received from NMAgent for get interface details: %s", resp)
 
 	var doc xmlDocument
-	decoder := xml.NewDecoder(resp.Body)
-	err = decoder.Decode(&doc)
+	err = xml.Unmarshal(resp, &doc)
 	if err != nil {
 		return nil, err
 	}
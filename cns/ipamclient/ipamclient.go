@@ -9,6 +9,7 @@ import (
 	"fmt"
 
 	cnmIpam "github.com/Azure/azure-container-networking/cnm/ipam"
+	acn "github.com/Azure/azure-container-networking/common"
 	ipam "github.com/Azure/azure-container-networking/ipam"
 	"github.com/Azure/azure-container-networking/log"
 )
@@ -42,7 +43,7 @@ func (ic *IpamClient) GetAddressSpace() (string, error) {
 	res, err := client.Post(url, "application/json", nil)
 	if err != nil {
 		log.Printf("[Azure CNS] HTTP Post returned error %v", err.Error())
-		return "", err
+		return "", acn.WrapError(acn.ErrCodeHostUnreachable, err, "Failed to reach IPAM plugin")
 	}
 
 	defer res.Body.Close()
@@ -88,7 +89,7 @@ func (ic *IpamClient) GetPoolID(asID, subnet string) (string, error) {
 	res, err := client.Post(url, "application/json", &body)
 	if err != nil {
 		log.Printf("[Azure CNS] HTTP Post returned error %v", err.Error())
-		return "", err
+		return "", acn.WrapError(acn.ErrCodeHostUnreachable, err, "Failed to reach IPAM plugin")
 	}
 
 	defer res.Body.Close()
@@ -136,7 +137,7 @@ func (ic *IpamClient) ReserveIPAddress(poolID string, reservationID string) (str
 	res, err := client.Post(url, "application/json", &body)
 	if err != nil {
 		log.Printf("[Azure CNS] HTTP Post returned error %v", err.Error())
-		return "", err
+		return "", acn.WrapError(acn.ErrCodeHostUnreachable, err, "Failed to reach IPAM plugin")
 	}
 
 	defer res.Body.Close()
@@ -187,7 +188,7 @@ func (ic *IpamClient) ReleaseIPAddress(poolID string, reservationID string) erro
 	res, err := client.Post(url, "application/json", &body)
 	if err != nil {
 		log.Printf("[Azure CNS] HTTP Post returned error %v", err.Error())
-		return err
+		return acn.WrapError(acn.ErrCodeHostUnreachable, err, "Failed to reach IPAM plugin")
 	}
 
 	defer res.Body.Close()
@@ -232,7 +233,7 @@ func (ic *IpamClient) GetIPAddressUtilization(poolID string) (int, int, []string
 	res, err := client.Post(url, "application/json", &body)
 	if err != nil {
 		log.Printf("[Azure CNS] HTTP Post returned error %v", err.Error())
-		return 0, 0, nil, err
+		return 0, 0, nil, acn.WrapError(acn.ErrCodeHostUnreachable, err, "Failed to reach IPAM plugin")
 	}
 
 	defer res.Body.Close()
@@ -3,6 +3,12 @@
 
 package restserver
 
+import (
+	"net/http"
+
+	acn "github.com/Azure/azure-container-networking/common"
+)
+
 // Container Network Service remote API Contract.
 const (
 	Success                      = 0
@@ -22,3 +28,46 @@ const (
 	UnsupportedOrchestratorType  = 19
 	UnexpectedError              = 99
 )
+
+// Codes of the error responses sent for return codes other than Success.
+var returnCodeErrors = map[int]struct {
+	status int
+	code   string
+}{
+	UnsupportedNetworkType:       {http.StatusBadRequest, "UnsupportedNetworkType"},
+	InvalidParameter:             {http.StatusBadRequest, "InvalidParameter"},
+	UnsupportedEnvironment:       {http.StatusBadRequest, "UnsupportedEnvironment"},
+	UnreachableHost:              {http.StatusBadGateway, "UnreachableHost"},
+	ReservationNotFound:          {http.StatusNotFound, "ReservationNotFound"},
+	MalformedSubnet:              {http.StatusBadRequest, "MalformedSubnet"},
+	UnreachableDockerDaemon:      {http.StatusBadGateway, "UnreachableDockerDaemon"},
+	UnspecifiedNetworkName:       {http.StatusBadRequest, "UnspecifiedNetworkName"},
+	NotFound:                     {http.StatusNotFound, "NotFound"},
+	AddressUnavailable:           {http.StatusConflict, "AddressUnavailable"},
+	NetworkContainerNotSpecified: {http.StatusBadRequest, "NetworkContainerNotSpecified"},
+	CallToHostFailed:             {http.StatusBadGateway, "CallToHostFailed"},
+	UnknownContainerID:           {http.StatusNotFound, "UnknownContainerID"},
+	UnsupportedOrchestratorType:  {http.StatusBadRequest, "UnsupportedOrchestratorType"},
+	UnexpectedError:              {http.StatusInternalServerError, "UnexpectedError"},
+}
+
+// Return codes of failures with error codes.
+var errorCodeReturnCodes = map[acn.ErrorCode]int{
+	acn.ErrCodeInvalidArgument:      InvalidParameter,
+	acn.ErrCodeInvalidConfig:        InvalidParameter,
+	acn.ErrCodeHostUnreachable:      UnreachableHost,
+	acn.ErrCodeAddressPoolNotFound:  NotFound,
+	acn.ErrCodeAddressPoolExhausted: AddressUnavailable,
+	acn.ErrCodeAddressInUse:         AddressUnavailable,
+	acn.ErrCodeAddressNotFound:      ReservationNotFound,
+}
+
+// returnCodeForError returns the return code of an error with an error code, or the given default
+// return code if the error has no code with a return code.
+func returnCodeForError(err error, defaultReturnCode int) int {
+	if returnCode, ok := errorCodeReturnCodes[acn.GetErrorCode(err)]; ok {
+		return returnCode
+	}
+
+	return defaultReturnCode
+}
@@ -0,0 +1,24 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package restserver
+
+import (
+	acn "github.com/Azure/azure-container-networking/common"
+)
+
+var (
+	// Metrics of the CNS REST service.
+	networkContainers = acn.NewGauge(
+		"cns_network_containers", "Number of network containers.")
+	networks = acn.NewGauge(
+		"cns_networks", "Number of networks created by CNS.")
+	errorResponses = acn.NewCounter(
+		"cns_error_responses_total", "Number of requests that failed with a return code other than Success.")
+)
+
+// updateMetrics updates the metrics of the service state.
+func (service *httpRestService) updateMetrics() {
+	networkContainers.Set(float64(len(service.state.ContainerStatus)))
+	networks.Set(float64(len(service.state.Networks)))
+}
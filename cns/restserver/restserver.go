@@ -5,9 +5,11 @@ package restserver
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 
@@ -18,6 +20,7 @@ import (
 	"github.com/Azure/azure-container-networking/cns/ipamclient"
 	"github.com/Azure/azure-container-networking/cns/networkcontainers"
 	"github.com/Azure/azure-container-networking/cns/routes"
+	acn "github.com/Azure/azure-container-networking/common"
 	"github.com/Azure/azure-container-networking/log"
 	"github.com/Azure/azure-container-networking/platform"
 	"github.com/Azure/azure-container-networking/store"
@@ -133,37 +136,42 @@ func (service *httpRestService) Start(config *common.ServiceConfig) error {
 
 	// Add handlers.
 	listener := service.Listener
-	// default handlers
-	listener.AddHandler(cns.SetEnvironmentPath, service.setEnvironment)
-	listener.AddHandler(cns.CreateNetworkPath, service.createNetwork)
-	listener.AddHandler(cns.DeleteNetworkPath, service.deleteNetwork)
-	listener.AddHandler(cns.ReserveIPAddressPath, service.reserveIPAddress)
-	listener.AddHandler(cns.ReleaseIPAddressPath, service.releaseIPAddress)
-	listener.AddHandler(cns.GetHostLocalIPPath, service.getHostLocalIP)
-	listener.AddHandler(cns.GetIPAddressUtilizationPath, service.getIPAddressUtilization)
-	listener.AddHandler(cns.GetUnhealthyIPAddressesPath, service.getUnhealthyIPAddresses)
-	listener.AddHandler(cns.CreateOrUpdateNetworkContainer, service.createOrUpdateNetworkContainer)
-	listener.AddHandler(cns.DeleteNetworkContainer, service.deleteNetworkContainer)
-	listener.AddHandler(cns.GetNetworkContainerStatus, service.getNetworkContainerStatus)
-	listener.AddHandler(cns.GetInterfaceForContainer, service.getInterfaceForContainer)
-	listener.AddHandler(cns.SetOrchestratorType, service.setOrchestratorType)
-	listener.AddHandler(cns.GetNetworkContainerByOrchestratorContext, service.getNetworkContainerByOrchestratorContext)
-
-	// handlers for v0.2
-	listener.AddHandler(cns.V2Prefix+cns.SetEnvironmentPath, service.setEnvironment)
-	listener.AddHandler(cns.V2Prefix+cns.CreateNetworkPath, service.createNetwork)
-	listener.AddHandler(cns.V2Prefix+cns.DeleteNetworkPath, service.deleteNetwork)
-	listener.AddHandler(cns.V2Prefix+cns.ReserveIPAddressPath, service.reserveIPAddress)
-	listener.AddHandler(cns.V2Prefix+cns.ReleaseIPAddressPath, service.releaseIPAddress)
-	listener.AddHandler(cns.V2Prefix+cns.GetHostLocalIPPath, service.getHostLocalIP)
-	listener.AddHandler(cns.V2Prefix+cns.GetIPAddressUtilizationPath, service.getIPAddressUtilization)
-	listener.AddHandler(cns.V2Prefix+cns.GetUnhealthyIPAddressesPath, service.getUnhealthyIPAddresses)
-	listener.AddHandler(cns.V2Prefix+cns.CreateOrUpdateNetworkContainer, service.createOrUpdateNetworkContainer)
-	listener.AddHandler(cns.V2Prefix+cns.DeleteNetworkContainer, service.deleteNetworkContainer)
-	listener.AddHandler(cns.V2Prefix+cns.GetNetworkContainerStatus, service.getNetworkContainerStatus)
-	listener.AddHandler(cns.V2Prefix+cns.GetInterfaceForContainer, service.getInterfaceForContainer)
-	listener.AddHandler(cns.V2Prefix+cns.SetOrchestratorType, service.setOrchestratorType)
-	listener.AddHandler(cns.V2Prefix+cns.GetNetworkContainerByOrchestratorContext, service.getNetworkContainerByOrchestratorContext)
+	handlers := []struct {
+		method  string
+		path    string
+		handler func(http.ResponseWriter, *http.Request)
+	}{
+		{http.MethodPost, cns.SetEnvironmentPath, service.setEnvironment},
+		{http.MethodPost, cns.CreateNetworkPath, service.createNetwork},
+		{http.MethodPost, cns.DeleteNetworkPath, service.deleteNetwork},
+		{http.MethodPost, cns.ReserveIPAddressPath, service.reserveIPAddress},
+		{http.MethodPost, cns.ReleaseIPAddressPath, service.releaseIPAddress},
+		{http.MethodGet, cns.GetHostLocalIPPath, service.getHostLocalIP},
+		{http.MethodGet, cns.GetIPAddressUtilizationPath, service.getIPAddressUtilization},
+		{http.MethodGet, cns.GetUnhealthyIPAddressesPath, service.getUnhealthyIPAddresses},
+		{http.MethodPost, cns.CreateOrUpdateNetworkContainer, service.createOrUpdateNetworkContainer},
+		{http.MethodPost, cns.DeleteNetworkContainer, service.deleteNetworkContainer},
+		{http.MethodPost, cns.GetNetworkContainerStatus, service.getNetworkContainerStatus},
+		{http.MethodPost, cns.GetInterfaceForContainer, service.getInterfaceForContainer},
+		{http.MethodPost, cns.SetOrchestratorType, service.setOrchestratorType},
+		{http.MethodPost, cns.GetNetworkContainerByOrchestratorContext, service.getNetworkContainerByOrchestratorContext},
+	}
+
+	// Each route is served both by default and for v0.2.
+	for _, route := range handlers {
+		for _, path := range []string{route.path, cns.V2Prefix + route.path} {
+			err = listener.AddHandlerFor(route.method, path, route.handler)
+			if err != nil {
+				log.Printf("[Azure CNS]  Failed to add handler, err:%v.", err)
+				return err
+			}
+		}
+	}
+
+	// Report the state of the store on /healthz.
+	if err = service.AddHealthCheck("store", service.checkStore); err != nil {
+		log.Printf("[Azure CNS]  Failed to add health check, err:%v.", err)
+	}
 
 	log.Printf("[Azure CNS]  Listening.")
 	return nil
@@ -175,6 +183,32 @@ func (service *httpRestService) Stop() {
 	log.Printf("[Azure CNS]  Service stopped.")
 }
 
+// checkStore checks that the store of the service state can be accessed. A store that was not
+// written yet is healthy.
+func (service *httpRestService) checkStore() error {
+	if service.store == nil {
+		return fmt.Errorf("Store is not initialized")
+	}
+
+	if _, err := service.store.GetModificationTime(); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// sendErrorResponse sends an error response with the HTTP status and error code of a return code.
+func (service *httpRestService) sendErrorResponse(w http.ResponseWriter, returnCode int, returnMessage string) {
+	status, code := http.StatusInternalServerError, "UnexpectedError"
+	if e, ok := returnCodeErrors[returnCode]; ok {
+		status, code = e.status, e.code
+	}
+
+	errorResponses.Inc()
+
+	service.SendErrorWithCode(w, status, code, returnMessage)
+}
+
 // Handles requests to set the environment type.
 func (service *httpRestService) setEnvironment(w http.ResponseWriter, r *http.Request) {
 	log.Printf("[Azure CNS] setEnvironment")
@@ -217,8 +251,7 @@ func (service *httpRestService) createNetwork(w http.ResponseWriter, r *http.Req
 		log.Request(service.Name, &req, err)
 
 		if err != nil {
-			returnMessage = fmt.Sprintf("[Azure CNS] Error. Unable to decode input request.")
-			returnCode = InvalidParameter
+			return
 		} else {
 			switch r.Method {
 			case "POST":
@@ -246,7 +279,7 @@ func (service *httpRestService) createNetwork(w http.ResponseWriter, r *http.Req
 							nicInfo, err := service.imdsClient.GetPrimaryInterfaceInfoFromHost()
 							if err != nil {
 								returnMessage = fmt.Sprintf("[Azure CNS] Error. GetPrimaryInterfaceInfoFromHost failed %v.", err.Error())
-								returnCode = UnexpectedError
+								returnCode = returnCodeForError(err, UnexpectedError)
 								break
 							}
 
@@ -283,8 +316,8 @@ func (service *httpRestService) createNetwork(w http.ResponseWriter, r *http.Req
 				}
 
 			default:
-				returnMessage = "[Azure CNS] Error. CreateNetwork did not receive a POST."
-				returnCode = InvalidParameter
+				service.SendErrorWithCode(w, http.StatusMethodNotAllowed, acn.ErrorCodeMethodNotAllowed, "[Azure CNS] Error. CreateNetwork did not receive a POST.")
+				return
 			}
 		}
 
@@ -293,6 +326,11 @@ func (service *httpRestService) createNetwork(w http.ResponseWriter, r *http.Req
 		returnCode = UnsupportedEnvironment
 	}
 
+	if returnCode != Success {
+		service.sendErrorResponse(w, returnCode, returnMessage)
+		return
+	}
+
 	resp := &cns.Response{
 		ReturnCode: returnCode,
 		Message:    returnMessage,
@@ -335,7 +373,7 @@ func (service *httpRestService) deleteNetwork(w http.ResponseWriter, r *http.Req
 				returnCode = UnexpectedError
 			}
 		} else {
-			if err == fmt.Errorf("Network not found") {
+			if errors.Is(err, dockerclient.ErrNetworkNotFound) {
 				log.Printf("[Azure CNS] Received a request to delete network that does not exist: %v.", req.NetworkName)
 			} else {
 				returnCode = UnexpectedError
@@ -344,8 +382,13 @@ func (service *httpRestService) deleteNetwork(w http.ResponseWriter, r *http.Req
 		}
 
 	default:
-		returnMessage = "[Azure CNS] Error. DeleteNetwork did not receive a POST."
-		returnCode = InvalidParameter
+		service.SendErrorWithCode(w, http.StatusMethodNotAllowed, acn.ErrorCodeMethodNotAllowed, "[Azure CNS] Error. DeleteNetwork did not receive a POST.")
+		return
+	}
+
+	if returnCode != Success {
+		service.sendErrorResponse(w, returnCode, returnMessage)
+		return
 	}
 
 	resp := &cns.Response{
@@ -392,28 +435,28 @@ func (service *httpRestService) reserveIPAddress(w http.ResponseWriter, r *http.
 		ifInfo, err := service.imdsClient.GetPrimaryInterfaceInfoFromMemory()
 		if err != nil {
 			returnMessage = fmt.Sprintf("[Azure CNS] Error. GetPrimaryIfaceInfo failed %v", err.Error())
-			returnCode = UnexpectedError
+			returnCode = returnCodeForError(err, UnexpectedError)
 			break
 		}
 
 		asID, err := ic.GetAddressSpace()
 		if err != nil {
 			returnMessage = fmt.Sprintf("[Azure CNS] Error. GetAddressSpace failed %v", err.Error())
-			returnCode = UnexpectedError
+			returnCode = returnCodeForError(err, UnexpectedError)
 			break
 		}
 
 		poolID, err := ic.GetPoolID(asID, ifInfo.Subnet)
 		if err != nil {
 			returnMessage = fmt.Sprintf("[Azure CNS] Error. GetPoolID failed %v", err.Error())
-			returnCode = UnexpectedError
+			returnCode = returnCodeForError(err, UnexpectedError)
 			break
 		}
 
 		addr, err = ic.ReserveIPAddress(poolID, req.ReservationID)
 		if err != nil {
 			returnMessage = fmt.Sprintf("[Azure CNS] ReserveIpAddress failed with %+v", err.Error())
-			returnCode = AddressUnavailable
+			returnCode = returnCodeForError(err, AddressUnavailable)
 			break
 		}
 
@@ -426,11 +469,16 @@ func (service *httpRestService) reserveIPAddress(w http.ResponseWriter, r *http.
 		address = addressIP.String()
 
 	default:
-		returnMessage = "[Azure CNS] Error. ReserveIP did not receive a POST."
-		returnCode = InvalidParameter
+		service.SendErrorWithCode(w, http.StatusMethodNotAllowed, acn.ErrorCodeMethodNotAllowed, "[Azure CNS] Error. ReserveIP did not receive a POST.")
+		return
 
 	}
 
+	if returnCode != Success {
+		service.sendErrorResponse(w, returnCode, returnMessage)
+		return
+	}
+
 	resp := cns.Response{
 		ReturnCode: returnCode,
 		Message:    returnMessage,
@@ -468,33 +516,38 @@ func (service *httpRestService) releaseIPAddress(w http.ResponseWriter, r *http.
 		ifInfo, err := service.imdsClient.GetPrimaryInterfaceInfoFromMemory()
 		if err != nil {
 			returnMessage = fmt.Sprintf("[Azure CNS] Error. GetPrimaryIfaceInfo failed %v", err.Error())
-			returnCode = UnexpectedError
+			returnCode = returnCodeForError(err, UnexpectedError)
 			break
 		}
 
 		asID, err := ic.GetAddressSpace()
 		if err != nil {
 			returnMessage = fmt.Sprintf("[Azure CNS] Error. GetAddressSpace failed %v", err.Error())
-			returnCode = UnexpectedError
+			returnCode = returnCodeForError(err, UnexpectedError)
 			break
 		}
 
 		poolID, err := ic.GetPoolID(asID, ifInfo.Subnet)
 		if err != nil {
 			returnMessage = fmt.Sprintf("[Azure CNS] Error. GetPoolID failed %v", err.Error())
-			returnCode = UnexpectedError
+			returnCode = returnCodeForError(err, UnexpectedError)
 			break
 		}
 
 		err = ic.ReleaseIPAddress(poolID, req.ReservationID)
 		if err != nil {
 			returnMessage = fmt.Sprintf("[Azure CNS] ReleaseIpAddress failed with %+v", err.Error())
-			returnCode = ReservationNotFound
+			returnCode = returnCodeForError(err, ReservationNotFound)
 		}
 
 	default:
-		returnMessage = "[Azure CNS] Error. ReleaseIP did not receive a POST."
-		returnCode = InvalidParameter
+		service.SendErrorWithCode(w, http.StatusMethodNotAllowed, acn.ErrorCodeMethodNotAllowed, "[Azure CNS] Error. ReleaseIP did not receive a POST.")
+		return
+	}
+
+	if returnCode != Success {
+		service.sendErrorResponse(w, returnCode, returnMessage)
+		return
 	}
 
 	resp := cns.Response{
@@ -536,7 +589,8 @@ func (service *httpRestService) getHostLocalIP(w http.ResponseWriter, r *http.Re
 			}
 
 		default:
-			errmsg = "[Azure-CNS] GetHostLocalIP API expects a GET."
+			service.SendErrorWithCode(w, http.StatusMethodNotAllowed, acn.ErrorCodeMethodNotAllowed, "[Azure-CNS] GetHostLocalIP API expects a GET.")
+			return
 		}
 	}
 
@@ -548,6 +602,11 @@ func (service *httpRestService) getHostLocalIP(w http.ResponseWriter, r *http.Re
 		}
 	}
 
+	if returnCode != Success {
+		service.sendErrorResponse(w, returnCode, errmsg)
+		return
+	}
+
 	resp := cns.Response{ReturnCode: returnCode, Message: errmsg}
 	hostLocalIPResponse := &cns.HostLocalIPAddressResponse{
 		Response:  resp,
@@ -577,35 +636,40 @@ func (service *httpRestService) getIPAddressUtilization(w http.ResponseWriter, r
 		ifInfo, err := service.imdsClient.GetPrimaryInterfaceInfoFromMemory()
 		if err != nil {
 			returnMessage = fmt.Sprintf("[Azure CNS] Error. GetPrimaryIfaceInfo failed %v", err.Error())
-			returnCode = UnexpectedError
+			returnCode = returnCodeForError(err, UnexpectedError)
 			break
 		}
 
 		asID, err := ic.GetAddressSpace()
 		if err != nil {
 			returnMessage = fmt.Sprintf("[Azure CNS] Error. GetAddressSpace failed %v", err.Error())
-			returnCode = UnexpectedError
+			returnCode = returnCodeForError(err, UnexpectedError)
 			break
 		}
 
 		poolID, err := ic.GetPoolID(asID, ifInfo.Subnet)
 		if err != nil {
 			returnMessage = fmt.Sprintf("[Azure CNS] Error. GetPoolID failed %v", err.Error())
-			returnCode = UnexpectedError
+			returnCode = returnCodeForError(err, UnexpectedError)
 			break
 		}
 
 		capacity, available, unhealthyAddrs, err = ic.GetIPAddressUtilization(poolID)
 		if err != nil {
 			returnMessage = fmt.Sprintf("[Azure CNS] Error. GetIPUtilization failed %v", err.Error())
-			returnCode = UnexpectedError
+			returnCode = returnCodeForError(err, UnexpectedError)
 			break
 		}
 		log.Printf("[Azure CNS] Capacity %v Available %v UnhealthyAddrs %v", capacity, available, unhealthyAddrs)
 
 	default:
-		returnMessage = "[Azure CNS] Error. GetIPUtilization did not receive a GET."
-		returnCode = InvalidParameter
+		service.SendErrorWithCode(w, http.StatusMethodNotAllowed, acn.ErrorCodeMethodNotAllowed, "[Azure CNS] Error. GetIPUtilization did not receive a GET.")
+		return
+	}
+
+	if returnCode != Success {
+		service.sendErrorResponse(w, returnCode, returnMessage)
+		return
 	}
 
 	resp := cns.Response{
@@ -677,35 +741,40 @@ func (service *httpRestService) getUnhealthyIPAddresses(w http.ResponseWriter, r
 		ifInfo, err := service.imdsClient.GetPrimaryInterfaceInfoFromMemory()
 		if err != nil {
 			returnMessage = fmt.Sprintf("[Azure CNS] Error. GetPrimaryIfaceInfo failed %v", err.Error())
-			returnCode = UnexpectedError
+			returnCode = returnCodeForError(err, UnexpectedError)
 			break
 		}
 
 		asID, err := ic.GetAddressSpace()
 		if err != nil {
 			returnMessage = fmt.Sprintf("[Azure CNS] Error. GetAddressSpace failed %v", err.Error())
-			returnCode = UnexpectedError
+			returnCode = returnCodeForError(err, UnexpectedError)
 			break
 		}
 
 		poolID, err := ic.GetPoolID(asID, ifInfo.Subnet)
 		if err != nil {
 			returnMessage = fmt.Sprintf("[Azure CNS] Error. GetPoolID failed %v", err.Error())
-			returnCode = UnexpectedError
+			returnCode = returnCodeForError(err, UnexpectedError)
 			break
 		}
 
 		capacity, available, unhealthyAddrs, err = ic.GetIPAddressUtilization(poolID)
 		if err != nil {
 			returnMessage = fmt.Sprintf("[Azure CNS] Error. GetIPUtilization failed %v", err.Error())
-			returnCode = UnexpectedError
+			returnCode = returnCodeForError(err, UnexpectedError)
 			break
 		}
 		log.Printf("[Azure CNS] Capacity %v Available %v UnhealthyAddrs %v", capacity, available, unhealthyAddrs)
 
 	default:
-		returnMessage = "[Azure CNS] Error. GetUnhealthyIP did not receive a POST."
-		returnCode = InvalidParameter
+		service.SendErrorWithCode(w, http.StatusMethodNotAllowed, acn.ErrorCodeMethodNotAllowed, "[Azure CNS] Error. GetUnhealthyIP did not receive a POST.")
+		return
+	}
+
+	if returnCode != Success {
+		service.sendErrorResponse(w, returnCode, returnMessage)
+		return
 	}
 
 	resp := cns.Response{
@@ -760,6 +829,8 @@ func (service *httpRestService) getHealthReport(w http.ResponseWriter, r *http.R
 func (service *httpRestService) saveState() error {
 	log.Printf("[Azure CNS] saveState")
 
+	service.updateMetrics()
+
 	// Skip if a store is not provided.
 	if service.store == nil {
 		log.Printf("[Azure CNS]  store not initialized.")
@@ -801,6 +872,8 @@ func (service *httpRestService) restoreState() error {
 		return err
 	}
 
+	service.updateMetrics()
+
 	log.Printf("[Azure CNS]  Restored state, %+v\n", service.state)
 	return nil
 }
@@ -830,6 +903,11 @@ func (service *httpRestService) setOrchestratorType(w http.ResponseWriter, r *ht
 
 	service.lock.Unlock()
 
+	if returnCode != Success {
+		service.sendErrorResponse(w, returnCode, returnMessage)
+		return
+	}
+
 	resp := cns.Response{
 		ReturnCode: returnCode,
 		Message:    returnMessage,
@@ -930,8 +1008,13 @@ func (service *httpRestService) createOrUpdateNetworkContainer(w http.ResponseWr
 		returnCode, returnMessage = service.saveNetworkContainerGoalState(req)
 
 	default:
-		returnMessage = "[Azure CNS] Error. CreateOrUpdateNetworkContainer did not receive a POST."
-		returnCode = InvalidParameter
+		service.SendErrorWithCode(w, http.StatusMethodNotAllowed, acn.ErrorCodeMethodNotAllowed, "[Azure CNS] Error. CreateOrUpdateNetworkContainer did not receive a POST.")
+		return
+	}
+
+	if returnCode != Success {
+		service.sendErrorResponse(w, returnCode, returnMessage)
+		return
 	}
 
 	resp := cns.Response{
@@ -1029,6 +1112,10 @@ func (service *httpRestService) getNetworkContainerByOrchestratorContext(w http.
 	}
 
 	getNetworkContainerResponse := service.getNetworkContainerResponse(req)
+	if returnCode := getNetworkContainerResponse.Response.ReturnCode; returnCode != Success {
+		service.sendErrorResponse(w, returnCode, getNetworkContainerResponse.Response.Message)
+		return
+	}
 
 	err = service.Listener.Encode(w, &getNetworkContainerResponse)
 	log.Response(service.Name, getNetworkContainerResponse, err)
@@ -1094,8 +1181,13 @@ func (service *httpRestService) deleteNetworkContainer(w http.ResponseWriter, r
 		service.saveState()
 		break
 	default:
-		returnMessage = "[Azure CNS] Error. DeleteNetworkContainer did not receive a POST."
-		returnCode = InvalidParameter
+		service.SendErrorWithCode(w, http.StatusMethodNotAllowed, acn.ErrorCodeMethodNotAllowed, "[Azure CNS] Error. DeleteNetworkContainer did not receive a POST.")
+		return
+	}
+
+	if returnCode != Success {
+		service.sendErrorResponse(w, returnCode, returnMessage)
+		return
 	}
 
 	resp := cns.Response{
@@ -1155,6 +1247,11 @@ func (service *httpRestService) getNetworkContainerStatus(w http.ResponseWriter,
 		returnCode = UnknownContainerID
 	}
 
+	if returnCode != Success {
+		service.sendErrorResponse(w, returnCode, returnMessage)
+		return
+	}
+
 	resp := cns.Response{
 		ReturnCode: returnCode,
 		Message:    returnMessage,
@@ -1208,6 +1305,11 @@ func (service *httpRestService) getInterfaceForContainer(w http.ResponseWriter,
 		version = ""
 	}
 
+	if returnCode != Success {
+		service.sendErrorResponse(w, returnCode, returnMessage)
+		return
+	}
+
 	resp := cns.Response{
 		ReturnCode: returnCode,
 		Message:    returnMessage,
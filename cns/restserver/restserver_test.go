@@ -16,7 +16,6 @@ import (
 
 	"github.com/Azure/azure-container-networking/cns"
 	"github.com/Azure/azure-container-networking/cns/common"
-	"github.com/Azure/azure-container-networking/cns/imdsclient"
 	acncommon "github.com/Azure/azure-container-networking/common"
 )
 
@@ -93,11 +92,6 @@ func TestMain(m *testing.M) {
 
 	// Configure test mode.
 	service.(*httpRestService).Name = "cns-test-server"
-	service.(*httpRestService).imdsClient.HostQueryURL = imdsclient.HostQueryURL
-	service.(*httpRestService).imdsClient.HostQueryURLForProgrammedVersion = imdsclient.HostQueryURLForProgrammedVersion
-	// Following HostQueryURL and HostQueryURLForProgrammedVersion are only for mock environment.
-	// service.(*httpRestService).imdsClient.HostQueryURL = "http://localhost:9000/getInterface"
-	// service.(*httpRestService).imdsClient.HostQueryURLForProgrammedVersion = "http://localhost:9000/machine/plugins/?comp=nmagent&type=NetworkManagement/interfaces/%s/networkContainers/%s/authenticationToken/%s/api-version/%s"
 
 	// Start the service.
 	err = service.Start(&config)
@@ -481,7 +475,7 @@ func getNetworkCotnainerByContext(t *testing.T, name string) error {
 
 func getNonExistNetworkCotnainerByContext(t *testing.T, name string) error {
 	var body bytes.Buffer
-	var resp cns.GetNetworkContainerResponse
+	var resp acncommon.ErrorResponse
 
 	podInfo := cns.KubernetesPodInfo{PodName: "testpod", PodNamespace: "testpodnamespace"}
 	podInfoBytes, err := json.Marshal(podInfo)
@@ -496,9 +490,9 @@ func getNonExistNetworkCotnainerByContext(t *testing.T, name string) error {
 	w := httptest.NewRecorder()
 	mux.ServeHTTP(w, req)
 
-	err = decodeResponse(w, &resp)
-	if err != nil || resp.Response.ReturnCode != UnknownContainerID {
-		t.Errorf("GetNetworkContainerByContext unexpected response %+v Err:%+v", resp, err)
+	err = json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil || w.Code != http.StatusNotFound || resp.Error.Code != "UnknownContainerID" {
+		t.Errorf("GetNetworkContainerByContext unexpected response %d %+v Err:%+v", w.Code, resp, err)
 		t.Fatal(err)
 	}
 
@@ -6,6 +6,7 @@ package cns
 import (
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/Azure/azure-container-networking/cns/common"
 	acn "github.com/Azure/azure-container-networking/common"
@@ -17,6 +18,9 @@ const (
 	// Default CNS server URL.
 	defaultAPIServerURL = "tcp://localhost:10090"
 	genericData         = "com.microsoft.azure.network.generic"
+
+	// Maximum size of request bodies, larger than the listener default to fit batch requests.
+	maxRequestBodySize = 16 << 20
 )
 
 // Service defines Container Networking Service.
@@ -39,7 +43,7 @@ func NewService(name, version string, store store.KeyValueStore) (*Service, erro
 	}, nil
 }
 
-// GetAPIServerURL returns the API server URL.
+// GetAPIServerURL returns the API server URLs, separated by commas.
 func (service *Service) getAPIServerURL() string {
 	urls, _ := service.GetOption(acn.OptCnsURL).(string)
 	if urls == "" {
@@ -58,18 +62,52 @@ func (service *Service) Initialize(config *common.ServiceConfig) error {
 
 	// Initialize the listener.
 	if config.Listener == nil {
-		// Fetch and parse the API server URL.
-		u, err := url.Parse(service.getAPIServerURL())
+		// Fetch and parse the API server URLs. CNS listens on all of them, for example
+		// on a unix socket for the CNI plugin and on a TCP port for the orchestrator.
+		var urls []*url.URL
+		for _, rawURL := range strings.Split(service.getAPIServerURL(), ",") {
+			u, err := url.Parse(strings.TrimSpace(rawURL))
+			if err != nil {
+				return err
+			}
+			urls = append(urls, u)
+		}
+
+		// Create the listener.
+		listener, err := acn.NewListener(urls[0])
 		if err != nil {
 			return err
 		}
 
-		// Create the listener.
-		listener, err := acn.NewListener(u)
+		for _, u := range urls[1:] {
+			if err = listener.AddAddress(u); err != nil {
+				return err
+			}
+		}
+
+		listener.SetMaxRequestBodySize(maxRequestBodySize)
+		listener.EnableStrictDecoding()
+
+		// Serve the health checks of the subsystems and the build version.
+		err = listener.EnableServiceHandlers(acn.VersionInfo{
+			Version:     config.Version,
+			GitCommit:   config.GitCommit,
+			APIVersions: []string{strings.TrimPrefix(V1Prefix, "/"), strings.TrimPrefix(V2Prefix, "/")},
+		})
 		if err != nil {
 			return err
 		}
 
+		// Require clients to present the shared token if one is configured.
+		if tokenFile, _ := service.GetOption(acn.OptCnsTokenFile).(string); tokenFile != "" {
+			authenticator, err := acn.NewSharedSecretAuthenticator(tokenFile)
+			if err != nil {
+				return err
+			}
+
+			listener.SetAuthenticator(authenticator)
+		}
+
 		// Start the listener.
 		err = listener.Start(config.ErrChan)
 		if err != nil {
@@ -91,15 +129,27 @@ func (service *Service) Uninitialize() {
 	service.Service.Uninitialize()
 }
 
+// AddHealthCheck registers a health check of the named subsystem, reported on /healthz.
+func (service *Service) AddHealthCheck(name string, check func() error) error {
+	return service.Listener.AddHealthCheck(name, check)
+}
+
 // ParseOptions returns generic options from a libnetwork request.
 func (service *Service) ParseOptions(options OptionMap) OptionMap {
 	opt, _ := options[genericData].(OptionMap)
 	return opt
 }
 
-// SendErrorResponse sends and logs an error response.
+// SendErrorResponse sends and logs an error response with status 200, as expected by libnetwork.
+// Use SendErrorWithCode for the CNS API.
 func (service *Service) SendErrorResponse(w http.ResponseWriter, errMsg error) {
 	resp := errorResponse{errMsg.Error()}
 	err := service.Listener.Encode(w, &resp)
 	log.Response(service.Name, &resp, err)
 }
+
+// SendErrorWithCode sends and logs an error response with the given HTTP status and error code.
+func (service *Service) SendErrorWithCode(w http.ResponseWriter, status int, code string, msg string) {
+	acn.SendErrorWithCode(w, status, code, msg)
+	log.Response(service.Name, &acn.ErrorDetails{Code: code, Message: msg}, nil)
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/Azure/azure-container-networking/cnm/ipam"
 	"github.com/Azure/azure-container-networking/cnm/network"
+	"github.com/Azure/azure-container-networking/cns"
 	"github.com/Azure/azure-container-networking/cns/common"
 	"github.com/Azure/azure-container-networking/cns/restserver"
 	acn "github.com/Azure/azure-container-networking/common"
@@ -28,6 +29,9 @@ const (
 // Version is populated by make during build.
 var version string
 
+// Git commit of the service, set at build time.
+var commit string
+
 // Command line arguments for CNS.
 var args = acn.ArgumentList{
 	{
@@ -98,7 +102,14 @@ var args = acn.ArgumentList{
 	{
 		Name:         acn.OptCnsURL,
 		Shorthand:    acn.OptCnsURLAlias,
-		Description:  "Set the URL for CNS to listen on",
+		Description:  "Set the URLs, separated by commas, for CNS to listen on",
+		Type:         "string",
+		DefaultValue: "",
+	},
+	{
+		Name:         acn.OptCnsTokenFile,
+		Shorthand:    acn.OptCnsTokenFileAlias,
+		Description:  "Set the file of the token that CNS clients must present",
 		Type:         "string",
 		DefaultValue: "",
 	},
@@ -109,6 +120,13 @@ var args = acn.ArgumentList{
 		Type:         "bool",
 		DefaultValue: false,
 	},
+	{
+		Name:         acn.OptConfigFile,
+		Shorthand:    acn.OptConfigFileAlias,
+		Description:  "Set the JSON file of options that are not set on the command line or in the environment",
+		Type:         "string",
+		DefaultValue: "",
+	},
 	{
 		Name:         acn.OptVersion,
 		Shorthand:    acn.OptVersionAlias,
@@ -127,19 +145,27 @@ func printVersion() {
 // Main is the entry point for CNS.
 func main() {
 	var stopcnm = false
-	// Initialize and parse command line arguments.
-	acn.ParseArgs(&args, printVersion)
-
-	environment := acn.GetArg(acn.OptEnvironment).(string)
-	url := acn.GetArg(acn.OptAPIServerURL).(string)
-	cnsURL := acn.GetArg(acn.OptCnsURL).(string)
-	logLevel := acn.GetArg(acn.OptLogLevel).(int)
-	logTarget := acn.GetArg(acn.OptLogTarget).(int)
-	logDirectory := acn.GetArg(acn.OptLogLocation).(string)
-	ipamQueryUrl, _ := acn.GetArg(acn.OptIpamQueryUrl).(string)
-	ipamQueryInterval, _ := acn.GetArg(acn.OptIpamQueryInterval).(int)
-	stopcnm = acn.GetArg(acn.OptStopAzureVnet).(bool)
-	vers := acn.GetArg(acn.OptVersion).(bool)
+	// Initialize and parse arguments from the command line, the environment and the config file.
+	acn.ParseArgsWithEnv(&args, printVersion, "CNS")
+
+	// Decode and validate the arguments, reporting all invalid ones at once.
+	cfg, err := cns.ParseConfig()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+
+	environment := cfg.Environment
+	url := cfg.APIServerURL
+	cnsURL := cfg.CnsURL
+	cnsTokenFile := cfg.CnsTokenFile
+	logLevel := cfg.LogLevel
+	logTarget := cfg.LogTarget
+	logDirectory := cfg.LogLocation
+	ipamQueryUrl := cfg.IpamQueryURL
+	ipamQueryInterval := cfg.IpamQueryInterval
+	stopcnm = cfg.StopAzureVnet
+	vers := cfg.Version
 
 	if vers {
 		printVersion()
@@ -149,12 +175,12 @@ func main() {
 	// Initialize CNS.
 	var config common.ServiceConfig
 	config.Version = version
+	config.GitCommit = commit
 	config.Name = name
 
 	// Create a channel to receive unhandled errors from CNS.
 	config.ErrChan = make(chan error, 1)
 
-	var err error
 	// Create logging provider.
 	log.SetName(name)
 	log.SetLevel(logLevel)
@@ -170,6 +196,23 @@ func main() {
 
 	// Log platform information.
 	log.Printf("Running on %v", platform.GetOSInfo())
+	acn.LogArgs()
+
+	// Watch the config file and apply the options that can change without restarting.
+	configWatcher, err := acn.NewArgConfigWatcher(map[string]func(interface{}){
+		acn.OptLogLevel: func(value interface{}) { log.SetLevel(value.(int)) },
+	})
+	if err != nil {
+		log.Printf("Failed to watch config file, err:%v.\n", err)
+		return
+	}
+	if configWatcher != nil {
+		if err = configWatcher.Start(); err != nil {
+			log.Printf("Failed to start config watcher, err:%v.\n", err)
+			return
+		}
+		defer configWatcher.Stop()
+	}
 
 	err = acn.CreateDirectory(platform.CNMRuntimePath)
 	if err != nil {
@@ -193,6 +236,7 @@ func main() {
 
 	// Set CNS options.
 	httpRestService.SetOption(acn.OptCnsURL, cnsURL)
+	httpRestService.SetOption(acn.OptCnsTokenFile, cnsTokenFile)
 
 	// Start CNS.
 	if httpRestService != nil {
@@ -209,6 +253,8 @@ func main() {
 	if !stopcnm {
 		var pluginConfig acn.PluginConfig
 		pluginConfig.Version = version
+		pluginConfig.GitCommit = commit
+		pluginConfig.Interfaces = acn.NewInterfaceInventory()
 
 		// Create a channel to receive unhandled errors from the plugins.
 		pluginConfig.ErrChan = make(chan error, 1)
@@ -0,0 +1,84 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// AddressError is an error that stopped a listener from serving on one of its addresses.
+type AddressError struct {
+	Address string
+	Err     error
+}
+
+// Error returns the error message tagged with the address.
+func (e *AddressError) Error() string {
+	return fmt.Sprintf("Failed to serve on %v: %v", e.Address, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *AddressError) Unwrap() error {
+	return e.Err
+}
+
+// AddAddress makes the listener also listen on the given URL, for example a localhost TCP port
+// next to a unix socket. All addresses serve the same handlers with the same middlewares and
+// settings. Errors are reported on the error channel as AddressError and Stop stops listening
+// on all addresses. It must be called before Start.
+func (listener *Listener) AddAddress(u *url.URL) error {
+	if listener.active {
+		return fmt.Errorf("Addresses cannot be added to an active listener")
+	}
+
+	localAddress := u.Host + u.Path
+	if u.Scheme == "" || localAddress == "" || localAddress == "null" {
+		return fmt.Errorf("Invalid listener address %v", u)
+	}
+
+	for _, address := range listener.getAddresses() {
+		if address.protocol == u.Scheme && address.localAddress == localAddress {
+			return fmt.Errorf("Listener already listens on %v", u)
+		}
+	}
+
+	listener.addresses = append(listener.addresses, &Listener{
+		URL:          u,
+		protocol:     u.Scheme,
+		localAddress: localAddress,
+	})
+
+	return nil
+}
+
+// getAddresses returns the listener itself followed by its additional addresses.
+func (listener *Listener) getAddresses() []*Listener {
+	return append([]*Listener{listener}, listener.addresses...)
+}
+
+// createAddressListeners creates the sockets of the additional addresses, with the socket settings
+// of the listener. The sockets already created are closed if one fails.
+func (listener *Listener) createAddressListeners() error {
+	for i, address := range listener.addresses {
+		address.socket = listener.socket
+		address.maxConns = listener.maxConns
+		address.relisten = listener.relisten
+		address.metrics = listener.metrics
+		address.tlsConfig = listener.tlsConfig
+		address.pipeSecurityDescriptor = listener.pipeSecurityDescriptor
+
+		l, err := address.createListener()
+		if err != nil {
+			for _, created := range listener.addresses[:i] {
+				created.l.Close()
+			}
+			return err
+		}
+
+		address.l = l
+	}
+
+	return nil
+}
@@ -4,11 +4,27 @@
 package common
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+// ArgSource tells where the value of an argument came from.
+type ArgSource string
+
+// Sources of argument values, from the highest precedence to the lowest.
+const (
+	ArgSourceFlag        ArgSource = "flag"
+	ArgSourceEnvironment ArgSource = "environment"
+	ArgSourceConfigFile  ArgSource = "config file"
+	ArgSourceDefault     ArgSource = "default"
 )
 
 // Argument represents a command line argument.
@@ -22,6 +38,8 @@ type Argument struct {
 	ValueMap     map[string]interface{}
 	strVal       string
 	boolVal      bool
+	source       ArgSource
+	err          error
 }
 
 // ArgumentList represents a set of command line arguments.
@@ -29,11 +47,30 @@ type ArgumentList []*Argument
 
 var argList *ArgumentList
 var usageFunc func()
+var argWarnings []string
 
 // ParseArgs parses and validates command line arguments based on rules in the given ArgumentList.
 func ParseArgs(args *ArgumentList, usage func()) {
+	parseArgs(args, usage, "")
+}
+
+// ParseArgsWithEnv parses and validates arguments like ParseArgs, but also reads them from environment
+// variables and from the JSON config file given by the OptConfigFile argument, if the list has one.
+// A value set on the command line takes precedence over the environment, which takes precedence over
+// the config file, which takes precedence over the default value. The environment variable of an
+// argument is named after it with the given prefix, for example CNS_LOG_LEVEL for log-level and
+// prefix CNS, and the config file maps argument names to values. Environment variables with the
+// prefix that match no argument are reported as warnings by LogArgs.
+func ParseArgsWithEnv(args *ArgumentList, usage func(), envPrefix string) {
+	parseArgs(args, usage, envPrefix)
+}
+
+// parseArgs parses and validates arguments, reading them from the environment and the config file
+// if envPrefix is not empty.
+func parseArgs(args *ArgumentList, usage func(), envPrefix string) {
 	argList = args
 	usageFunc = usage
+	argWarnings = nil
 
 	// Setup all arguments.
 	for _, arg := range *args {
@@ -51,6 +88,21 @@ func ParseArgs(args *ArgumentList, usage func()) {
 	flag.Usage = printHelp
 	flag.Parse()
 
+	// Apply the values that were not set on the command line.
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+
+	for _, arg := range *args {
+		arg.source = ArgSourceDefault
+		if setFlags[arg.Name] || setFlags[arg.Shorthand] {
+			arg.source = ArgSourceFlag
+		}
+	}
+
+	if envPrefix != "" {
+		applyEnvArgs(args, envPrefix)
+	}
+
 	// Validate arguments and convert them to their mapped values.
 	for _, arg := range *args {
 		switch arg.Type {
@@ -70,8 +122,12 @@ func ParseArgs(args *ArgumentList, usage func()) {
 			}
 		case "int":
 			if arg.ValueMap == nil {
-				// Argument is a free-form integer.
-				arg.Value, _ = strconv.Atoi(arg.strVal)
+				// Argument is a free-form integer. Invalid values are reported by DecodeArgs.
+				value, err := strconv.Atoi(arg.strVal)
+				arg.Value = value
+				if err != nil && arg.strVal != "" {
+					arg.err = fmt.Errorf("Value %v is not an integer", arg.strVal)
+				}
 			} else {
 				// Argument must match one of the values in the map.
 				arg.strVal = strings.ToLower(arg.strVal)
@@ -84,6 +140,225 @@ func ParseArgs(args *ArgumentList, usage func()) {
 	}
 }
 
+// applyEnvArgs applies the values of the arguments that were not set on the command line from the
+// environment and then from the config file.
+func applyEnvArgs(args *ArgumentList, envPrefix string) {
+	knownVars := make(map[string]bool)
+	for _, arg := range *args {
+		name := getArgEnvName(envPrefix, arg.Name)
+		knownVars[name] = true
+
+		if value, ok := os.LookupEnv(name); ok && arg.source == ArgSourceDefault {
+			setArgValue(arg, value, ArgSourceEnvironment)
+		}
+	}
+
+	for _, env := range os.Environ() {
+		name := strings.SplitN(env, "=", 2)[0]
+		if strings.HasPrefix(name, envPrefix+"_") && !knownVars[name] {
+			argWarnings = append(argWarnings, fmt.Sprintf("Ignoring unknown environment variable %v.", name))
+		}
+	}
+
+	// The config file argument itself can be set on the command line or in the environment.
+	var configFile string
+	for _, arg := range *args {
+		if arg.Name == OptConfigFile {
+			configFile = arg.strVal
+		}
+	}
+
+	if configFile == "" {
+		return
+	}
+
+	values, err := readArgConfigFile(configFile)
+	if err != nil {
+		fmt.Printf("Failed to read config file %v: %v\n\n", configFile, err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	for _, arg := range *args {
+		if value, ok := values[arg.Name]; ok && arg.source == ArgSourceDefault {
+			setArgValue(arg, value, ArgSourceConfigFile)
+		}
+		delete(values, arg.Name)
+	}
+
+	for name := range values {
+		argWarnings = append(argWarnings, fmt.Sprintf("Ignoring unknown option %v in config file %v.", name, configFile))
+	}
+}
+
+// getArgEnvName returns the name of the environment variable of an argument.
+func getArgEnvName(envPrefix string, name string) string {
+	return envPrefix + "_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// readArgConfigFile reads the argument values of a JSON config file, converting them to strings.
+func readArgConfigFile(path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseArgConfig(b)
+}
+
+// parseArgConfig parses the argument values of a JSON config file, converting them to strings.
+func parseArgConfig(b []byte) (map[string]string, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	for name, value := range raw {
+		values[name] = fmt.Sprint(value)
+	}
+
+	return values, nil
+}
+
+// setArgValue sets the raw value of an argument from the given source.
+func setArgValue(arg *Argument, value string, source ArgSource) {
+	arg.source = source
+
+	if arg.Type == "bool" {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			arg.strVal = value
+			printErrorForArg(arg)
+		}
+		arg.boolVal = b
+		return
+	}
+
+	arg.strVal = value
+}
+
+// NewArgConfigWatcher creates a watcher for the config file given by the OptConfigFile argument, which
+// applies changes of the values of the arguments in live by calling their function with the new value,
+// converted like the value returned by GetArg. Changes of other arguments and of arguments set on the
+// command line or in the environment are logged and ignored. It returns nil if no config file is set.
+// The watcher must be started.
+func NewArgConfigWatcher(live map[string]func(value interface{})) (*ConfigWatcher, error) {
+	configFile, _ := GetArg(OptConfigFile).(string)
+	if configFile == "" {
+		return nil, nil
+	}
+
+	watcher, err := NewConfigWatcher(configFile, func(b []byte) (interface{}, error) {
+		return parseArgConfig(b)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	watcher.OnChange(func(oldConfig interface{}, newConfig interface{}) {
+		applyArgConfigChange(oldConfig.(map[string]string), newConfig.(map[string]string), live)
+	})
+
+	return watcher, nil
+}
+
+// applyArgConfigChange applies the changes of the argument values in a config file.
+func applyArgConfigChange(oldValues map[string]string, newValues map[string]string, live map[string]func(interface{})) {
+	var rejected []string
+
+	for _, arg := range *argList {
+		oldValue, oldOk := oldValues[arg.Name]
+		newValue, newOk := newValues[arg.Name]
+		if oldOk == newOk && oldValue == newValue {
+			continue
+		}
+
+		if arg.source == ArgSourceFlag || arg.source == ArgSourceEnvironment {
+			log.Printf("[Config] Ignoring change of option %v, which is overridden by its %v value.", arg.Name, arg.source)
+			continue
+		}
+
+		apply := live[arg.Name]
+		if apply == nil {
+			rejected = append(rejected, arg.Name)
+			continue
+		}
+
+		// An option removed from the file gets back its default value.
+		if !newOk {
+			newValue = fmt.Sprint(arg.DefaultValue)
+		}
+
+		value, err := convertArgValue(arg, newValue)
+		if err != nil {
+			log.Printf("[Config] Ignoring invalid value %v of option %v: %v", newValue, arg.Name, err)
+			continue
+		}
+
+		log.Printf("[Config] Applying new value %v of option %v.", newValue, arg.Name)
+		apply(value)
+	}
+
+	if len(rejected) > 0 {
+		log.Printf("[Config] Ignoring change of options %v, which require a restart.", strings.Join(rejected, ", "))
+	}
+}
+
+// convertArgValue converts a raw value of an argument like ParseArgs, returning an error for invalid values.
+func convertArgValue(arg *Argument, value string) (interface{}, error) {
+	switch arg.Type {
+	case "bool":
+		return strconv.ParseBool(value)
+	case "int":
+		if arg.ValueMap == nil {
+			return strconv.Atoi(value)
+		}
+	case "string":
+		if arg.ValueMap == nil {
+			return value, nil
+		}
+	}
+
+	value = strings.ToLower(value)
+	if arg.ValueMap[value] == nil {
+		return nil, fmt.Errorf("Value is not one of the allowed values")
+	}
+
+	if arg.Type == "int" {
+		return arg.ValueMap[value], nil
+	}
+
+	return value, nil
+}
+
+// GetArgSource returns where the value of the given argument came from.
+func GetArgSource(name string) ArgSource {
+	for _, arg := range *argList {
+		if arg.Name == name {
+			return arg.source
+		}
+	}
+	return ""
+}
+
+// LogArgs logs the effective value of each argument with where it came from, and the warnings
+// about unknown environment variables and config file options. It is meant to be called once
+// logging is set up.
+func LogArgs() {
+	for _, arg := range *argList {
+		value := arg.strVal
+		if arg.Type == "bool" {
+			value = strconv.FormatBool(arg.boolVal)
+		}
+		log.Printf("Argument %v=%v from %v.", arg.Name, value, arg.source)
+	}
+
+	for _, warning := range argWarnings {
+		log.Printf("Warning: %v", warning)
+	}
+}
+
 // GetArg returns the parsed value of the given argument.
 func GetArg(name string) interface{} {
 	for _, arg := range *argList {
@@ -94,6 +369,49 @@ func GetArg(name string) interface{} {
 	return nil
 }
 
+// DecodeArgs sets the fields of the struct pointed to by config from the parsed arguments named by
+// their arg tag, for example `arg:"log-level"`, with the values returned by GetArg. It returns a
+// ConfigError listing every argument with an invalid value or that does not fit its field.
+func DecodeArgs(config interface{}) error {
+	var configErr ConfigError
+
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("arg")
+		if name == "" {
+			continue
+		}
+
+		var arg *Argument
+		for _, a := range *argList {
+			if a.Name == name {
+				arg = a
+				break
+			}
+		}
+
+		if arg == nil {
+			configErr.Add(name, "Unknown argument")
+			continue
+		}
+
+		if arg.err != nil {
+			configErr.Add(name, "%v", arg.err)
+			continue
+		}
+
+		value := reflect.ValueOf(arg.Value)
+		if !value.IsValid() || !value.Type().AssignableTo(v.Field(i).Type()) {
+			configErr.Add(name, "Value %v cannot be decoded into %v", arg.Value, v.Field(i).Type())
+			continue
+		}
+
+		v.Field(i).Set(value)
+	}
+
+	return configErr.Err()
+}
+
 // printErrorForArg prints the error line for the given argument.
 func printErrorForArg(arg *Argument) {
 	fmt.Printf("Invalid value '%v' for argument '%v'.\n\n", arg.strVal, arg.Name)
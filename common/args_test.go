@@ -0,0 +1,115 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Tests that arguments not set on the command line are read from the environment and then from
+// the config file, and that unknown variables and options are reported.
+func TestApplyEnvArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "args")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile := path.Join(dir, "config.json")
+	ioutil.WriteFile(configFile, []byte(`{"log-level": "info", "ipam-query-interval": 10, "stop-azure-cnm": true, "typo": 1}`), 0600)
+
+	os.Setenv("ACNTEST_CONFIG_FILE", configFile)
+	os.Setenv("ACNTEST_LOG_LEVEL", "debug")
+	os.Setenv("ACNTEST_LOG_LOCATION", "/env")
+	os.Setenv("ACNTEST_UNKNOWN", "1")
+	defer func() {
+		for _, name := range []string{"ACNTEST_CONFIG_FILE", "ACNTEST_LOG_LEVEL", "ACNTEST_LOG_LOCATION", "ACNTEST_UNKNOWN"} {
+			os.Unsetenv(name)
+		}
+	}()
+
+	args := ArgumentList{
+		{Name: OptConfigFile, Type: "string", strVal: "", source: ArgSourceDefault},
+		{Name: OptLogLevel, Type: "string", strVal: "info", source: ArgSourceDefault},
+		{Name: OptLogLocation, Type: "string", strVal: "/flag", source: ArgSourceFlag},
+		{Name: OptIpamQueryInterval, Type: "int", strVal: "", source: ArgSourceDefault},
+		{Name: OptStopAzureVnet, Type: "bool", source: ArgSourceDefault},
+		{Name: OptLogTarget, Type: "string", strVal: "logfile", source: ArgSourceDefault},
+	}
+	argList = &args
+	argWarnings = nil
+
+	applyEnvArgs(&args, "ACNTEST")
+
+	for _, test := range []struct {
+		arg    *Argument
+		value  string
+		source ArgSource
+	}{
+		{args[0], configFile, ArgSourceEnvironment},
+		{args[1], "debug", ArgSourceEnvironment},
+		{args[2], "/flag", ArgSourceFlag},
+		{args[3], "10", ArgSourceConfigFile},
+		{args[5], "logfile", ArgSourceDefault},
+	} {
+		if test.arg.strVal != test.value || GetArgSource(test.arg.Name) != test.source {
+			t.Errorf("Unexpected value %v from %v for %v", test.arg.strVal, test.arg.source, test.arg.Name)
+		}
+	}
+
+	if !args[4].boolVal || args[4].source != ArgSourceConfigFile {
+		t.Errorf("Unexpected value %v from %v for %v", args[4].boolVal, args[4].source, args[4].Name)
+	}
+
+	warnings := strings.Join(argWarnings, "\n")
+	if !strings.Contains(warnings, "ACNTEST_UNKNOWN") || !strings.Contains(warnings, "typo") || len(argWarnings) != 2 {
+		t.Errorf("Unexpected warnings:\n%v", warnings)
+	}
+}
+
+// Tests that decoding arguments into a config reports every invalid argument at once.
+func TestDecodeArgs(t *testing.T) {
+	args := ArgumentList{
+		{Name: OptLogLevel, Type: "int", Value: 1},
+		{Name: OptLogLocation, Type: "string", Value: "/var/log"},
+		{Name: OptIpamQueryInterval, Type: "int", Value: 0, err: errors.New("Value ten is not an integer")},
+		{Name: OptStopAzureVnet, Type: "bool", Value: true},
+	}
+	argList = &args
+
+	var config struct {
+		LogLevel          int    `arg:"log-level"`
+		LogLocation       string `arg:"log-location"`
+		IpamQueryInterval int    `arg:"ipam-query-interval"`
+		StopAzureVnet     string `arg:"stop-azure-cnm"`
+		Unknown           string `arg:"unknown"`
+		Ignored           string
+	}
+
+	err := DecodeArgs(&config)
+	configErr, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("Expected a config error, got %v", err)
+	}
+
+	var fields []string
+	for _, field := range configErr.Fields {
+		fields = append(fields, field.Field)
+	}
+
+	expected := []string{OptIpamQueryInterval, OptStopAzureVnet, "unknown"}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Unexpected invalid fields %v, expected %v", fields, expected)
+	}
+
+	if config.LogLevel != 1 || config.LogLocation != "/var/log" {
+		t.Errorf("Unexpected decoded config %+v", config)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+// Scheme of the Authorization header checked by the shared secret authenticator.
+const bearerScheme = "Bearer"
+
+// SetAuthenticator makes the listener authenticate every request before passing it to its handler,
+// except for the handlers added with AddPublicHandler. Requests for which the authenticator returns
+// an error are rejected with status 401. It must be called before Start.
+func (listener *Listener) SetAuthenticator(authenticator func(*http.Request) error) error {
+	if listener.active {
+		return fmt.Errorf("Authentication cannot be configured on an active listener")
+	}
+
+	listener.authenticator = authenticator
+
+	return nil
+}
+
+// AddPublicHandler registers a protocol handler that is served without authentication, such as
+// a health check. It fails if the path already has a handler.
+func (listener *Listener) AddPublicHandler(path string, handler func(http.ResponseWriter, *http.Request)) error {
+	r := listener.newRoute(handler, nil)
+	r.public = true
+	if listener.active {
+		r.chain = listener.chain(r)
+	}
+
+	return listener.router.add(path, r)
+}
+
+// authenticate wraps a handler to reject the requests that fail authentication.
+func (listener *Listener) authenticate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := listener.authenticator(r); err != nil {
+			log.Printf("[Listener] %vRejected unauthenticated request %v %v from %v: %v",
+				getRequestLogPrefix(w), r.Method, r.URL.Path, r.RemoteAddr, err)
+
+			w.Header().Set("WWW-Authenticate", bearerScheme)
+			SendErrorWithCode(w, http.StatusUnauthorized, ErrorCodeUnauthorized, "Unauthorized")
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// sharedSecret is a token shared with the clients of a listener, loaded from a file. The file is
+// checked on each request and the token is reloaded when it changed, so that it can be rotated
+// without restarting the listener.
+type sharedSecret struct {
+	tokenFile string
+	token     []byte
+	modTime   time.Time
+	sync.Mutex
+}
+
+// NewSharedSecretAuthenticator returns an authenticator accepting the requests with an
+// "Authorization: Bearer <token>" header whose token matches the content of the given file.
+// Surrounding whitespace in the file is ignored. It fails if the file cannot be read or is empty.
+func NewSharedSecretAuthenticator(tokenFile string) (func(*http.Request) error, error) {
+	secret := &sharedSecret{tokenFile: tokenFile}
+	if err := secret.load(); err != nil {
+		return nil, err
+	}
+
+	return secret.authenticate, nil
+}
+
+// load loads the token if the file changed since it was last loaded.
+func (secret *sharedSecret) load() error {
+	secret.Lock()
+	defer secret.Unlock()
+
+	info, err := os.Stat(secret.tokenFile)
+	if err != nil {
+		return err
+	}
+
+	if secret.token != nil && info.ModTime().Equal(secret.modTime) {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(secret.tokenFile)
+	if err != nil {
+		return err
+	}
+
+	token := []byte(strings.TrimSpace(string(b)))
+	if len(token) == 0 {
+		return fmt.Errorf("Token file %v is empty", secret.tokenFile)
+	}
+
+	if secret.token != nil {
+		log.Printf("[Listener] Reloaded token %v.", secret.tokenFile)
+	}
+
+	secret.token = token
+	secret.modTime = info.ModTime()
+
+	return nil
+}
+
+// authenticate checks the bearer token of a request against the shared secret, reloading it first
+// if the file changed. A token that fails to reload is logged and the previous one is used, since
+// the file can be caught in the middle of being replaced.
+func (secret *sharedSecret) authenticate(r *http.Request) error {
+	if err := secret.load(); err != nil {
+		log.Printf("[Listener] Failed to reload token %v, err:%v.", secret.tokenFile, err)
+	}
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, bearerScheme+" ") {
+		return fmt.Errorf("Request has no bearer token")
+	}
+	token := []byte(strings.TrimSpace(header[len(bearerScheme)+1:]))
+
+	secret.Lock()
+	defer secret.Unlock()
+
+	if subtle.ConstantTimeCompare(token, secret.token) != 1 {
+		return fmt.Errorf("Request has an invalid bearer token")
+	}
+
+	return nil
+}
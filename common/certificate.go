@@ -0,0 +1,88 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+// certificateReloader serves a TLS certificate loaded from a certificate and a key file. The files are
+// checked on each handshake and the certificate is reloaded when either of them changed, so that renewed
+// certificates are picked up without restarting the listener.
+type certificateReloader struct {
+	certFile    string
+	keyFile     string
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	sync.Mutex
+}
+
+// newCertificateReloader creates a certificateReloader for the given files.
+func newCertificateReloader(certFile string, keyFile string) *certificateReloader {
+	return &certificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+}
+
+// load loads the certificate if the files changed since it was last loaded.
+func (reloader *certificateReloader) load() error {
+	reloader.Lock()
+	defer reloader.Unlock()
+
+	certInfo, err := os.Stat(reloader.certFile)
+	if err != nil {
+		return err
+	}
+
+	keyInfo, err := os.Stat(reloader.keyFile)
+	if err != nil {
+		return err
+	}
+
+	if reloader.certificate != nil &&
+		certInfo.ModTime().Equal(reloader.certModTime) && keyInfo.ModTime().Equal(reloader.keyModTime) {
+		return nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return err
+	}
+
+	if reloader.certificate != nil {
+		log.Printf("[Listener] Reloaded TLS certificate %v.", reloader.certFile)
+	}
+
+	reloader.certificate = &certificate
+	reloader.certModTime = certInfo.ModTime()
+	reloader.keyModTime = keyInfo.ModTime()
+
+	return nil
+}
+
+// getCertificate returns the current certificate, reloading it first if the files changed.
+// A certificate that fails to reload is logged and the previous one is served, since the files
+// can be caught in the middle of being replaced.
+func (reloader *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if err := reloader.load(); err != nil {
+		log.Printf("[Listener] Failed to reload TLS certificate %v, err:%v.", reloader.certFile, err)
+	}
+
+	reloader.Lock()
+	defer reloader.Unlock()
+
+	if reloader.certificate == nil {
+		return nil, fmt.Errorf("TLS certificate %v is not loaded", reloader.certFile)
+	}
+
+	return reloader.certificate, nil
+}
@@ -17,6 +17,10 @@ const (
 	OptCnsURL            = "cns-url"
 	OptCnsURLAlias       = "c"
 
+	// File of the token that clients of the CNS API must present.
+	OptCnsTokenFile      = "cns-token-file"
+	OptCnsTokenFileAlias = "ct"
+
 	// Logging level.
 	OptLogLevel      = "log-level"
 	OptLogLevelAlias = "l"
@@ -44,10 +48,26 @@ const (
 	OptIpamQueryInterval      = "ipam-query-interval"
 	OptIpamQueryIntervalAlias = "i"
 
+	// Interval in seconds between collections of endpoints of dead containers, zero disables it.
+	OptEndpointGCInterval      = "endpoint-gc-interval"
+	OptEndpointGCIntervalAlias = "g"
+
+	// Minimum age in seconds of the endpoints deleted by garbage collection.
+	OptEndpointGCGracePeriod      = "endpoint-gc-grace-period"
+	OptEndpointGCGracePeriodAlias = "gp"
+
+	// Interval in seconds between refreshes of the cached host network interfaces, zero disables them.
+	OptInterfaceRefreshInterval      = "interface-refresh-interval"
+	OptInterfaceRefreshIntervalAlias = "ir"
+
 	// Don't Start CNM
 	OptStopAzureVnet      = "stop-azure-cnm"
 	OptStopAzureVnetAlias = "stopcnm"
 
+	// Config file with the values of options that are not set on the command line or in the environment.
+	OptConfigFile      = "config-file"
+	OptConfigFileAlias = "f"
+
 	// Version.
 	OptVersion      = "version"
 	OptVersionAlias = "v"
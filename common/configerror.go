@@ -0,0 +1,64 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FieldError describes an invalid field of a config.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+// ConfigError lists every invalid field of a config, so that they can all be fixed at once.
+type ConfigError struct {
+	Fields []FieldError
+}
+
+// Error returns the invalid fields and the reason each is invalid.
+func (e *ConfigError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for _, field := range e.Fields {
+		fields = append(fields, fmt.Sprintf("%v: %v", field.Field, field.Message))
+	}
+
+	return fmt.Sprintf("Invalid config: %v", strings.Join(fields, "; "))
+}
+
+// Add records an invalid field.
+func (e *ConfigError) Add(field string, format string, args ...interface{}) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Merge records the invalid fields of another config error. Other errors are recorded as an
+// invalid config field.
+func (e *ConfigError) Merge(err error) {
+	if err == nil {
+		return
+	}
+
+	if other, ok := err.(*ConfigError); ok {
+		e.Fields = append(e.Fields, other.Fields...)
+		return
+	}
+
+	e.Add("config", "%v", err)
+}
+
+// Err returns the config error, or nil if no field is invalid.
+func (e *ConfigError) Err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+// ErrorCode returns ErrCodeInvalidConfig.
+func (e *ConfigError) ErrorCode() ErrorCode {
+	return ErrCodeInvalidConfig
+}
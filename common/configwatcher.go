@@ -0,0 +1,163 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+const (
+	// Interval between two checks of the config file when file system notifications are not available.
+	defaultConfigPollInterval = 5 * time.Second
+)
+
+// ConfigWatcher watches a config file and notifies its subscribers when the parsed config changes,
+// so that services can apply changes without restarting. It relies on file system notifications
+// where available and polls the file otherwise.
+type ConfigWatcher struct {
+	path         string
+	parse        func([]byte) (interface{}, error)
+	config       interface{}
+	callbacks    []func(oldConfig interface{}, newConfig interface{})
+	pollInterval time.Duration
+	stop         chan struct{}
+	done         chan struct{}
+	sync.Mutex
+}
+
+// NewConfigWatcher creates a watcher for the config file at the given path, parsed with the given
+// function. It fails if the file cannot be read or parsed.
+func NewConfigWatcher(path string, parse func([]byte) (interface{}, error)) (*ConfigWatcher, error) {
+	watcher := &ConfigWatcher{
+		path:         path,
+		parse:        parse,
+		pollInterval: defaultConfigPollInterval,
+	}
+
+	config, err := watcher.read()
+	if err != nil {
+		return nil, err
+	}
+	watcher.config = config
+
+	return watcher, nil
+}
+
+// OnChange registers a callback invoked with the old and the new config each time the config changes.
+// Callbacks are invoked in registration order from the goroutine of the watcher.
+func (watcher *ConfigWatcher) OnChange(callback func(oldConfig interface{}, newConfig interface{})) {
+	watcher.Lock()
+	watcher.callbacks = append(watcher.callbacks, callback)
+	watcher.Unlock()
+}
+
+// GetConfig returns the current config.
+func (watcher *ConfigWatcher) GetConfig() interface{} {
+	watcher.Lock()
+	defer watcher.Unlock()
+
+	return watcher.config
+}
+
+// Start starts watching the config file.
+func (watcher *ConfigWatcher) Start() error {
+	watcher.Lock()
+	defer watcher.Unlock()
+
+	if watcher.stop != nil {
+		return fmt.Errorf("Config watcher for %v is already started", watcher.path)
+	}
+
+	stop := make(chan struct{})
+	events, err := watcher.notify(stop)
+	if err != nil {
+		log.Printf("[Config] Failed to watch %v for changes, polling it instead: %v", watcher.path, err)
+		events = nil
+	}
+
+	watcher.stop = stop
+	watcher.done = make(chan struct{})
+	go watcher.run(events, stop, watcher.done)
+
+	return nil
+}
+
+// Stop stops watching the config file.
+func (watcher *ConfigWatcher) Stop() {
+	watcher.Lock()
+	stop, done := watcher.stop, watcher.done
+	watcher.stop = nil
+	watcher.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// run reloads the config file when notified of a change, or periodically if events is nil.
+func (watcher *ConfigWatcher) run(events chan struct{}, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	var poll <-chan time.Time
+	if events == nil {
+		ticker := time.NewTicker(watcher.pollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-events:
+		case <-poll:
+		}
+
+		watcher.reload()
+	}
+}
+
+// reload reads the config file and notifies the subscribers if the config changed. A config file
+// that fails to read or parse is logged and the previous config is kept, since the file can be
+// caught in the middle of being replaced.
+func (watcher *ConfigWatcher) reload() {
+	config, err := watcher.read()
+	if err != nil {
+		log.Printf("[Config] Failed to reload %v, keeping the previous config: %v", watcher.path, err)
+		return
+	}
+
+	watcher.Lock()
+	oldConfig := watcher.config
+	if reflect.DeepEqual(oldConfig, config) {
+		watcher.Unlock()
+		return
+	}
+	watcher.config = config
+	callbacks := watcher.callbacks
+	watcher.Unlock()
+
+	log.Printf("[Config] Reloaded %v.", watcher.path)
+
+	for _, callback := range callbacks {
+		callback(oldConfig, config)
+	}
+}
+
+// read reads and parses the config file.
+func (watcher *ConfigWatcher) read() (interface{}, error) {
+	b, err := ioutil.ReadFile(watcher.path)
+	if err != nil {
+		return nil, err
+	}
+
+	return watcher.parse(b)
+}
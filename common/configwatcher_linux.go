@@ -0,0 +1,72 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"path/filepath"
+
+	"github.com/Azure/azure-container-networking/log"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Time in milliseconds that the watcher waits for file system notifications before checking whether it is stopped.
+	configNotifyTimeout = 500
+)
+
+// notify returns a channel signaled when a file is written or moved into the directory of the config
+// file. The whole directory is watched so that replacing the file, as editors and Kubernetes config
+// maps do, is noticed as well.
+func (watcher *ConfigWatcher) notify(stop chan struct{}) (chan struct{}, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = unix.InotifyAddWatch(fd, filepath.Dir(watcher.path), unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	events := make(chan struct{}, 1)
+
+	go func() {
+		defer unix.Close(fd)
+
+		buf := make([]byte, 4096)
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			n, err := unix.Poll(fds, configNotifyTimeout)
+			if err == unix.EINTR || n == 0 {
+				continue
+			}
+			if err != nil {
+				log.Printf("[Config] Failed to wait for changes of %v: %v", watcher.path, err)
+				return
+			}
+
+			// Drain the pending events, which all trigger a single check of the file.
+			for {
+				if _, err := unix.Read(fd, buf); err != nil {
+					break
+				}
+			}
+
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return events, nil
+}
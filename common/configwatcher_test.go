@@ -0,0 +1,105 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// Tests that the config watcher notices changes of the config file and ignores rewrites with the
+// same content or invalid content.
+func TestConfigWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile := path.Join(dir, "config.json")
+	ioutil.WriteFile(configFile, []byte(`{"log-level": "info"}`), 0600)
+
+	watcher, err := NewConfigWatcher(configFile, func(b []byte) (interface{}, error) {
+		return parseArgConfig(b)
+	})
+	if err != nil {
+		t.Fatalf("Failed to create config watcher: %v", err)
+	}
+	watcher.pollInterval = 50 * time.Millisecond
+
+	changes := make(chan map[string]string, 10)
+	watcher.OnChange(func(oldConfig interface{}, newConfig interface{}) {
+		changes <- newConfig.(map[string]string)
+	})
+
+	if err = watcher.Start(); err != nil {
+		t.Fatalf("Failed to start config watcher: %v", err)
+	}
+	defer watcher.Stop()
+
+	ioutil.WriteFile(configFile, []byte(`{"log-level": "info"}`), 0600)
+	ioutil.WriteFile(configFile, []byte(`{"log-level": `), 0600)
+	ioutil.WriteFile(configFile, []byte(`{"log-level": "debug"}`), 0600)
+
+	select {
+	case config := <-changes:
+		if config["log-level"] != "debug" {
+			t.Errorf("Unexpected config %v", config)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Config change was not noticed")
+	}
+
+	select {
+	case config := <-changes:
+		t.Errorf("Unexpected change to %v", config)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if config := watcher.GetConfig().(map[string]string); config["log-level"] != "debug" {
+		t.Errorf("Unexpected current config %v", config)
+	}
+}
+
+// Tests that only the changes of live options not set on the command line are applied.
+func TestApplyArgConfigChange(t *testing.T) {
+	args := ArgumentList{
+		{Name: OptLogLevel, Type: "int", DefaultValue: "info", source: ArgSourceConfigFile,
+			ValueMap: map[string]interface{}{"info": 1, "debug": 2}},
+		{Name: OptLogLocation, Type: "string", source: ArgSourceFlag},
+		{Name: OptIpamQueryInterval, Type: "int", source: ArgSourceConfigFile},
+	}
+	argList = &args
+
+	applied := make(map[string]interface{})
+	live := map[string]func(interface{}){
+		OptLogLevel:    func(value interface{}) { applied[OptLogLevel] = value },
+		OptLogLocation: func(value interface{}) { applied[OptLogLocation] = value },
+	}
+
+	oldValues := map[string]string{OptLogLevel: "info", OptIpamQueryInterval: "10"}
+	applyArgConfigChange(oldValues, map[string]string{
+		OptLogLevel:          "Debug",
+		OptLogLocation:       "/config",
+		OptIpamQueryInterval: "20",
+	}, live)
+
+	if len(applied) != 1 || applied[OptLogLevel] != 2 {
+		t.Errorf("Unexpected applied options %v", applied)
+	}
+
+	// Removed options get back their default value, invalid values are ignored.
+	applyArgConfigChange(map[string]string{OptLogLevel: "debug"}, map[string]string{}, live)
+	if applied[OptLogLevel] != 1 {
+		t.Errorf("Removed option was not reset, got %v", applied[OptLogLevel])
+	}
+
+	applyArgConfigChange(map[string]string{}, map[string]string{OptLogLevel: "verbose"}, live)
+	if applied[OptLogLevel] != 1 {
+		t.Errorf("Invalid option was applied, got %v", applied[OptLogLevel])
+	}
+}
@@ -0,0 +1,10 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+// notify returns no channel since file system notifications are not used on Windows,
+// so that the watcher polls the config file instead.
+func (watcher *ConfigWatcher) notify(stop chan struct{}) (chan struct{}, error) {
+	return nil, nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+// Codes of error responses sent by the listener.
+const (
+	ErrorCodeInvalidRequest       = "InvalidRequest"
+	ErrorCodeUnauthorized         = "Unauthorized"
+	ErrorCodeRequestTooLarge      = "RequestTooLarge"
+	ErrorCodeUnsupportedMediaType = "UnsupportedMediaType"
+	ErrorCodeMethodNotAllowed     = "MethodNotAllowed"
+	ErrorCodeTooManyRequests      = "TooManyRequests"
+	ErrorCodeInternalError        = "InternalError"
+)
+
+// ErrorResponse is the envelope of error responses sent with SendErrorWithCode.
+type ErrorResponse struct {
+	Error ErrorDetails
+}
+
+// ErrorDetails describes the error of an ErrorResponse.
+type ErrorDetails struct {
+	Code      string
+	Message   string
+	RequestID string `json:",omitempty"`
+}
+
+// SendErrorWithCode sends an error response with the given HTTP status, an error code for programmatic
+// handling and a message. The response includes the ID of the request if request logging is enabled.
+func SendErrorWithCode(w http.ResponseWriter, status int, code string, msg string) {
+	resp := ErrorResponse{
+		Error: ErrorDetails{
+			Code:      code,
+			Message:   msg,
+			RequestID: getResponseRequestID(w),
+		},
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		log.Printf("[Listener] %vFailed to encode error response: %v\n", getRequestLogPrefix(w), err.Error())
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorCode identifies the cause of a failure. Codes are stable so that failures can be
+// aggregated by cause across releases.
+type ErrorCode string
+
+// Codes of errors returned by the network, IPAM and CNS packages.
+const (
+	ErrCodeUnknown              ErrorCode = "Unknown"
+	ErrCodeInvalidConfig        ErrorCode = "InvalidConfig"
+	ErrCodeInvalidArgument      ErrorCode = "InvalidArgument"
+	ErrCodeNotSupported         ErrorCode = "NotSupported"
+	ErrCodeNetworkNotFound      ErrorCode = "NetworkNotFound"
+	ErrCodeNetworkExists        ErrorCode = "NetworkExists"
+	ErrCodeEndpointNotFound     ErrorCode = "EndpointNotFound"
+	ErrCodeEndpointExists       ErrorCode = "EndpointExists"
+	ErrCodeSubnetInUse          ErrorCode = "SubnetInUse"
+	ErrCodeHNSFailure           ErrorCode = "HNSFailure"
+	ErrCodeHNSTimeout           ErrorCode = "HNSTimeout"
+	ErrCodeAddressPoolNotFound  ErrorCode = "AddressPoolNotFound"
+	ErrCodeAddressPoolExhausted ErrorCode = "AddressPoolExhausted"
+	ErrCodeAddressNotFound      ErrorCode = "AddressNotFound"
+	ErrCodeAddressInUse         ErrorCode = "AddressInUse"
+	ErrCodeHostUnreachable      ErrorCode = "HostUnreachable"
+)
+
+// CodedError is implemented by errors that carry an error code.
+type CodedError interface {
+	error
+	ErrorCode() ErrorCode
+}
+
+// Error is an error with a code, a message and an optional cause.
+type Error struct {
+	Code    ErrorCode
+	Message string
+	Err     error
+}
+
+// NewError creates an error with the given code and message.
+func NewError(code ErrorCode, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// WrapError creates an error with the given code wrapping a cause. The message is formatted
+// according to a format specifier.
+func WrapError(code ErrorCode, err error, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...), Err: err}
+}
+
+// Error returns the message followed by the cause, if any.
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+
+	return fmt.Sprintf("%v: %v", e.Message, e.Err)
+}
+
+// Unwrap returns the cause.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorCode returns the code.
+func (e *Error) ErrorCode() ErrorCode {
+	return e.Code
+}
+
+// GetErrorCode returns the code of the outermost coded error in the chain of the given error,
+// or ErrCodeUnknown if there is none.
+func GetErrorCode(err error) ErrorCode {
+	var codedErr CodedError
+	if errors.As(err, &codedErr) {
+		return codedErr.ErrorCode()
+	}
+
+	return ErrCodeUnknown
+}
@@ -0,0 +1,42 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Tests that error codes are extracted from wrapped errors.
+func TestGetErrorCode(t *testing.T) {
+	cause := errors.New("connection refused")
+	err := WrapError(ErrCodeHostUnreachable, cause, "Failed to query %v", "host")
+
+	if err.Error() != "Failed to query host: connection refused" {
+		t.Errorf("Unexpected message %q", err.Error())
+	}
+
+	if !errors.Is(err, cause) {
+		t.Errorf("Error does not wrap its cause")
+	}
+
+	tests := []struct {
+		err      error
+		expected ErrorCode
+	}{
+		{err, ErrCodeHostUnreachable},
+		{fmt.Errorf("Failed to refresh: %w", err), ErrCodeHostUnreachable},
+		{NewError(ErrCodeAddressPoolExhausted, "No available addresses"), ErrCodeAddressPoolExhausted},
+		{&ConfigError{Fields: []FieldError{{Field: "mtu", Message: "Invalid"}}}, ErrCodeInvalidConfig},
+		{cause, ErrCodeUnknown},
+		{nil, ErrCodeUnknown},
+	}
+
+	for _, test := range tests {
+		if code := GetErrorCode(test.err); code != test.expected {
+			t.Errorf("Unexpected code %v for %v, expected %v", code, test.err, test.expected)
+		}
+	}
+}
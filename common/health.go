@@ -0,0 +1,181 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+const (
+	// Paths of the service handlers.
+	healthPath  = "/healthz"
+	versionPath = "/version"
+
+	// Time that a health check can take before it is reported as failed.
+	healthCheckTimeout = 5 * time.Second
+
+	// Status of health checks that succeeded.
+	healthStatusOK = "ok"
+)
+
+// HealthChecker is implemented by services that report the health of their subsystems on /healthz.
+type HealthChecker interface {
+	// AddHealthCheck registers a check returning an error when the named subsystem is unhealthy.
+	AddHealthCheck(name string, check func() error) error
+}
+
+// VersionInfo describes the build of a service, as returned by /version.
+type VersionInfo struct {
+	Version     string
+	GitCommit   string
+	APIVersions []string
+}
+
+// HealthResponse is the response of /healthz, with the status of each check.
+type HealthResponse struct {
+	Status string
+	Checks map[string]string `json:",omitempty"`
+}
+
+// healthChecks holds the health checks of a service.
+type healthChecks struct {
+	checks map[string]func() error
+	sync.Mutex
+}
+
+// EnableServiceHandlers makes the listener serve the build version on GET /version and the result of
+// the health checks added with AddHealthCheck on GET /healthz, both without authentication. /healthz
+// responds with status 503 and the names of the failed checks if any check fails. It must be called
+// before Start.
+func (listener *Listener) EnableServiceHandlers(version VersionInfo) error {
+	if listener.active {
+		return fmt.Errorf("Service handlers cannot be enabled on an active listener")
+	}
+
+	if listener.health != nil {
+		return fmt.Errorf("Service handlers are already enabled")
+	}
+
+	health := &healthChecks{checks: make(map[string]func() error)}
+
+	if err := listener.AddPublicHandler(healthPath, readOnly(health.serve)); err != nil {
+		return err
+	}
+
+	if err := listener.AddPublicHandler(versionPath, readOnly(func(w http.ResponseWriter, r *http.Request) {
+		listener.Encode(w, &version)
+	})); err != nil {
+		return err
+	}
+
+	listener.health = health
+
+	return nil
+}
+
+// AddHealthCheck registers a health check of the named subsystem, reported on /healthz. It fails if
+// the service handlers are not enabled or the name already has a check.
+func (listener *Listener) AddHealthCheck(name string, check func() error) error {
+	if listener.health == nil {
+		return fmt.Errorf("Service handlers are not enabled")
+	}
+
+	return listener.health.add(name, check)
+}
+
+// add registers a health check, failing if the name already has one.
+func (health *healthChecks) add(name string, check func() error) error {
+	health.Lock()
+	defer health.Unlock()
+
+	if health.checks[name] != nil {
+		return fmt.Errorf("Health check %v is already registered", name)
+	}
+
+	health.checks[name] = check
+
+	return nil
+}
+
+// run runs the health checks concurrently and returns the status of each. Checks that do not
+// complete within healthCheckTimeout are reported as failed, so that a hung subsystem cannot
+// hang the probe.
+func (health *healthChecks) run() map[string]string {
+	health.Lock()
+	checks := make(map[string]func() error, len(health.checks))
+	for name, check := range health.checks {
+		checks[name] = check
+	}
+	health.Unlock()
+
+	type result struct {
+		name string
+		err  error
+	}
+
+	// Buffered so that checks completing after the timeout do not block.
+	results := make(chan result, len(checks))
+	for name, check := range checks {
+		go func(name string, check func() error) {
+			results <- result{name: name, err: check()}
+		}(name, check)
+	}
+
+	statuses := make(map[string]string, len(checks))
+	timeout := time.After(healthCheckTimeout)
+
+	for len(statuses) < len(checks) {
+		select {
+		case res := <-results:
+			statuses[res.name] = healthStatusOK
+			if res.err != nil {
+				statuses[res.name] = res.err.Error()
+			}
+		case <-timeout:
+			for name := range checks {
+				if _, ok := statuses[name]; !ok {
+					statuses[name] = fmt.Sprintf("Timed out after %v", healthCheckTimeout)
+				}
+			}
+		}
+	}
+
+	return statuses
+}
+
+// serve handles health requests.
+func (health *healthChecks) serve(w http.ResponseWriter, r *http.Request) {
+	resp := HealthResponse{Status: healthStatusOK, Checks: health.run()}
+
+	var failed []string
+	for name, status := range resp.Checks {
+		if status != healthStatusOK {
+			failed = append(failed, name)
+		}
+	}
+
+	status := http.StatusOK
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		log.Printf("[Listener] %vFailed health checks %v.", getRequestLogPrefix(w), strings.Join(failed, ", "))
+
+		resp.Status = fmt.Sprintf("Failed health checks: %v", strings.Join(failed, ", "))
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		log.Printf("[Listener] %vFailed to encode health response: %v\n", getRequestLogPrefix(w), err.Error())
+	}
+}
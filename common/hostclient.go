@@ -0,0 +1,262 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-container-networking/common/retry"
+)
+
+const (
+	// Defaults of host client configurations.
+	DefaultHostConnectTimeout  = 5 * time.Second
+	DefaultHostReadTimeout     = 10 * time.Second
+	DefaultHostMaxResponseSize = 4 << 20
+
+	// Default retry policy of host queries.
+	defaultHostRetryAttempts       = 3
+	defaultHostRetryInitialBackoff = 500 * time.Millisecond
+	defaultHostRetryMaxBackoff     = 2 * time.Second
+	defaultHostRetryJitter         = 0.2
+
+	// Header required by the instance metadata service.
+	imdsMetadataHeader = "Metadata"
+)
+
+var (
+	// ErrHostResponseTooLarge is returned when a response exceeds the size limit of the client.
+	ErrHostResponseTooLarge = errors.New("Host response exceeds the size limit")
+)
+
+// HostStatusError is returned when the host responds to a request with a status other than 2xx.
+type HostStatusError struct {
+	StatusCode int
+	Body       []byte
+}
+
+// Error returns the status of the response.
+func (e *HostStatusError) Error() string {
+	return fmt.Sprintf("Host responded with status %v", e.StatusCode)
+}
+
+// HostClientConfig configures a host client. Zero values are replaced by defaults.
+type HostClientConfig struct {
+	// Name of the client in the logs.
+	Name string
+
+	// Timeout of establishing a connection, and timeout of receiving the response once connected.
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+
+	// Maximum size of response bodies.
+	MaxResponseSize int64
+
+	// Headers added to each request.
+	Headers map[string]string
+
+	// Retry policy of requests failing with connection errors, 429 or 5xx responses.
+	// The retryable errors are fixed by the client, so IsRetryable is ignored.
+	Retry retry.Policy
+
+	// Sends the requests, instead of a transport built from the timeouts if set.
+	Transport http.RoundTripper
+}
+
+// HostClient queries the Azure host endpoints, such as wireserver and the instance metadata service.
+type HostClient struct {
+	config HostClientConfig
+	client *http.Client
+}
+
+var (
+	// Transport sending the requests of all host clients, set by tests via StubHostClients.
+	hostClientStub     http.RoundTripper
+	hostClientStubLock sync.RWMutex
+)
+
+// StubHostClients makes all host clients send their requests to the given transport instead of
+// the network, and returns a function restoring them. It is meant for unit tests.
+func StubHostClients(transport http.RoundTripper) func() {
+	hostClientStubLock.Lock()
+	saved := hostClientStub
+	hostClientStub = transport
+	hostClientStubLock.Unlock()
+
+	return func() {
+		hostClientStubLock.Lock()
+		hostClientStub = saved
+		hostClientStubLock.Unlock()
+	}
+}
+
+// hostTransport sends requests to the stub transport if set, or to the underlying transport otherwise.
+type hostTransport struct {
+	transport http.RoundTripper
+}
+
+// RoundTrip sends a request.
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	hostClientStubLock.RLock()
+	stub := hostClientStub
+	hostClientStubLock.RUnlock()
+
+	if stub != nil {
+		return stub.RoundTrip(req)
+	}
+
+	return t.transport.RoundTrip(req)
+}
+
+// RoundTripperFunc is a function sending requests, such as a stub of the host endpoints.
+type RoundTripperFunc func(*http.Request) (*http.Response, error)
+
+// RoundTrip calls the function.
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// NewHostClient creates a host client.
+func NewHostClient(config HostClientConfig) *HostClient {
+	if config.ConnectTimeout == 0 {
+		config.ConnectTimeout = DefaultHostConnectTimeout
+	}
+
+	if config.ReadTimeout == 0 {
+		config.ReadTimeout = DefaultHostReadTimeout
+	}
+
+	if config.MaxResponseSize == 0 {
+		config.MaxResponseSize = DefaultHostMaxResponseSize
+	}
+
+	if config.Retry.MaxAttempts == 0 && config.Retry.MaxElapsed == 0 {
+		config.Retry.MaxAttempts = defaultHostRetryAttempts
+		config.Retry.InitialBackoff = defaultHostRetryInitialBackoff
+		config.Retry.MaxBackoff = defaultHostRetryMaxBackoff
+		config.Retry.Jitter = defaultHostRetryJitter
+	}
+
+	config.Retry.Name = config.Name
+	config.Retry.IsRetryable = IsRetryableHostError
+
+	transport := config.Transport
+	if transport == nil {
+		// Host endpoints are link-local, so requests never go through a proxy.
+		transport = &http.Transport{
+			DialContext:           (&net.Dialer{Timeout: config.ConnectTimeout}).DialContext,
+			ResponseHeaderTimeout: config.ReadTimeout,
+		}
+	}
+
+	return &HostClient{
+		config: config,
+		client: &http.Client{
+			Transport: &hostTransport{transport: transport},
+			Timeout:   config.ConnectTimeout + config.ReadTimeout,
+		},
+	}
+}
+
+// NewIMDSClient creates a host client for the instance metadata service, which requires each
+// request to carry the Metadata header.
+func NewIMDSClient(config HostClientConfig) *HostClient {
+	headers := map[string]string{imdsMetadataHeader: "true"}
+	for name, value := range config.Headers {
+		headers[name] = value
+	}
+	config.Headers = headers
+
+	return NewHostClient(config)
+}
+
+// Get sends a GET request and returns the response body.
+func (c *HostClient) Get(ctx context.Context, url string) ([]byte, error) {
+	return c.Do(ctx, http.MethodGet, url, "", nil)
+}
+
+// Post sends a POST request with the given body and returns the response body.
+func (c *HostClient) Post(ctx context.Context, url string, contentType string, body []byte) ([]byte, error) {
+	return c.Do(ctx, http.MethodPost, url, contentType, body)
+}
+
+// Do sends a request, retrying transient failures, and returns the response body. Requests that
+// keep failing with transient errors return an error with code ErrCodeHostUnreachable.
+func (c *HostClient) Do(ctx context.Context, method string, url string, contentType string, body []byte) ([]byte, error) {
+	var resp []byte
+
+	err := retry.Do(ctx, c.config.Retry, func() error {
+		var err error
+		resp, err = c.send(ctx, method, url, contentType, body)
+		return err
+	})
+	if err != nil {
+		if IsRetryableHostError(err) {
+			err = WrapError(ErrCodeHostUnreachable, err, "%v failed", c.config.Name)
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// send sends a single request and reads the response body.
+func (c *HostClient) send(ctx context.Context, method string, url string, contentType string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	for name, value := range c.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, c.config.MaxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > c.config.MaxResponseSize {
+		return nil, fmt.Errorf("%w: %v bytes", ErrHostResponseTooLarge, c.config.MaxResponseSize)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &HostStatusError{StatusCode: resp.StatusCode, Body: data}
+	}
+
+	return data, nil
+}
+
+// IsRetryableHostError returns true if a request failed to reach the host or the host failed to
+// respond, and false if the host rejected the request.
+func IsRetryableHostError(err error) bool {
+	var statusErr *HostStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= http.StatusInternalServerError || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
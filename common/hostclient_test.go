@@ -0,0 +1,99 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-container-networking/common/retry"
+)
+
+// Returns a host client with a short retry policy.
+func newTestHostClient(imds bool) *HostClient {
+	config := HostClientConfig{
+		Name:            "Test query",
+		MaxResponseSize: 16,
+		Retry:           retry.Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+	}
+
+	if imds {
+		return NewIMDSClient(config)
+	}
+
+	return NewHostClient(config)
+}
+
+// Stubs host clients with a handler and returns a function restoring them.
+func stubHostHandler(handler http.HandlerFunc) func() {
+	return StubHostClients(RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Result(), nil
+	}))
+}
+
+// Tests that requests carry the required headers and server errors are retried.
+func TestHostClientRetriesServerErrors(t *testing.T) {
+	attempts := 0
+	restore := stubHostHandler(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if r.Header.Get("Metadata") != "true" {
+			t.Errorf("Missing Metadata header")
+		}
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	defer restore()
+
+	data, err := newTestHostClient(true).Get(context.Background(), "http://169.254.169.254/metadata")
+	if err != nil || string(data) != "ok" || attempts != 3 {
+		t.Errorf("Unexpected response %q after %v attempts, err:%v", data, attempts, err)
+	}
+
+	attempts = -10
+	_, err = newTestHostClient(true).Get(context.Background(), "http://169.254.169.254/metadata")
+	if GetErrorCode(err) != ErrCodeHostUnreachable {
+		t.Errorf("Expected the host to be unreachable, err:%v", err)
+	}
+}
+
+// Tests that client errors and oversized responses are not retried.
+func TestHostClientPermanentErrors(t *testing.T) {
+	attempts := 0
+	restore := stubHostHandler(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if r.Header.Get("Metadata") != "" {
+			t.Errorf("Unexpected Metadata header")
+		}
+		if r.Method == http.MethodPost {
+			w.Write([]byte(strings.Repeat("x", 17)))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	defer restore()
+
+	client := newTestHostClient(false)
+
+	_, err := client.Get(context.Background(), "http://169.254.169.254/machine")
+	var statusErr *HostStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadRequest || attempts != 1 {
+		t.Errorf("Expected a single rejected attempt, got %v, err:%v", attempts, err)
+	}
+
+	attempts = 0
+	_, err = client.Post(context.Background(), "http://169.254.169.254/machine", "application/json", []byte("{}"))
+	if !errors.Is(err, ErrHostResponseTooLarge) || attempts != 1 {
+		t.Errorf("Expected a single oversized attempt, got %v, err:%v", attempts, err)
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+const (
+	// Minimum time between two refreshes triggered by lookups that found no interface.
+	minInterfaceLookupRefreshInterval = time.Second
+)
+
+// InterfaceInfo is a snapshot of a host network interface and its addresses.
+type InterfaceInfo struct {
+	Name         string
+	Index        int
+	MTU          int
+	Flags        net.Flags
+	HardwareAddr net.HardwareAddr
+	Addresses    []*net.IPNet
+}
+
+// InterfaceInventory caches the host network interfaces, so that components resolving interfaces
+// do not enumerate them on every operation. The cache is refreshed on demand with Refresh, when a
+// lookup finds no interface, and periodically once started. The interfaces returned are shared
+// with the cache and must not be modified.
+type InterfaceInventory struct {
+	list        func() ([]InterfaceInfo, error)
+	interfaces  []InterfaceInfo
+	loaded      time.Time
+	generation  uint64
+	subscribers []func(oldInterfaces []InterfaceInfo, newInterfaces []InterfaceInfo)
+	stop        chan struct{}
+	done        chan struct{}
+	sync.Mutex
+}
+
+// NewInterfaceInventory creates an inventory of the host network interfaces. The interfaces are
+// enumerated on the first read unless Refresh is called first.
+func NewInterfaceInventory() *InterfaceInventory {
+	return &InterfaceInventory{list: listInterfaces}
+}
+
+// Subscribe registers a callback invoked with the old and the new interfaces each time a refresh
+// finds that they changed. Callbacks are invoked from the goroutine that refreshed the inventory,
+// without holding its lock, and must not refresh it.
+func (inv *InterfaceInventory) Subscribe(callback func(oldInterfaces []InterfaceInfo, newInterfaces []InterfaceInfo)) {
+	inv.Lock()
+	inv.subscribers = append(inv.subscribers, callback)
+	inv.Unlock()
+}
+
+// Refresh enumerates the host network interfaces and notifies the subscribers if they changed.
+func (inv *InterfaceInventory) Refresh() error {
+	interfaces, err := inv.list()
+	if err != nil {
+		return err
+	}
+
+	inv.Lock()
+	oldInterfaces := inv.interfaces
+	first := inv.loaded.IsZero()
+	inv.loaded = time.Now()
+	if reflect.DeepEqual(oldInterfaces, interfaces) {
+		inv.Unlock()
+		return nil
+	}
+	inv.interfaces = interfaces
+	inv.generation++
+	subscribers := inv.subscribers
+	inv.Unlock()
+
+	if !first {
+		logInterfaceChanges(oldInterfaces, interfaces)
+	}
+
+	for _, callback := range subscribers {
+		callback(oldInterfaces, interfaces)
+	}
+
+	return nil
+}
+
+// Interfaces returns the cached host network interfaces, ordered by index.
+func (inv *InterfaceInventory) Interfaces() ([]InterfaceInfo, error) {
+	inv.Lock()
+	loaded := !inv.loaded.IsZero()
+	interfaces := inv.interfaces
+	inv.Unlock()
+
+	if loaded {
+		return interfaces, nil
+	}
+
+	if err := inv.Refresh(); err != nil {
+		return nil, err
+	}
+
+	inv.Lock()
+	defer inv.Unlock()
+
+	return inv.interfaces, nil
+}
+
+// Generation returns a number that changes each time a refresh finds that the interfaces changed,
+// so that consumers can tell whether to recompute state derived from them.
+func (inv *InterfaceInventory) Generation() uint64 {
+	inv.Lock()
+	defer inv.Unlock()
+
+	return inv.generation
+}
+
+// FindInterface returns the first cached interface for which match returns true. If none does, the
+// inventory is refreshed, at most once every minInterfaceLookupRefreshInterval, and searched again,
+// since the interface may have been created since the last refresh.
+func (inv *InterfaceInventory) FindInterface(match func(*InterfaceInfo) bool) (*InterfaceInfo, error) {
+	interfaces, err := inv.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	if iface := findInterface(interfaces, match); iface != nil {
+		return iface, nil
+	}
+
+	inv.Lock()
+	stale := time.Since(inv.loaded) >= minInterfaceLookupRefreshInterval
+	inv.Unlock()
+
+	if !stale {
+		return nil, nil
+	}
+
+	if err = inv.Refresh(); err != nil {
+		return nil, err
+	}
+
+	interfaces, err = inv.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	return findInterface(interfaces, match), nil
+}
+
+// InterfaceByName returns the interface with the given name.
+func (inv *InterfaceInventory) InterfaceByName(name string) (*InterfaceInfo, error) {
+	iface, err := inv.FindInterface(func(iface *InterfaceInfo) bool { return iface.Name == name })
+	if err != nil {
+		return nil, err
+	}
+
+	if iface == nil {
+		return nil, fmt.Errorf("Interface %v not found", name)
+	}
+
+	return iface, nil
+}
+
+// Start refreshes the inventory at the given interval until Stop is called.
+func (inv *InterfaceInventory) Start(interval time.Duration) error {
+	inv.Lock()
+	defer inv.Unlock()
+
+	if inv.stop != nil {
+		return fmt.Errorf("Interface inventory is already started")
+	}
+
+	if interval <= 0 {
+		return fmt.Errorf("Invalid interface refresh interval %v", interval)
+	}
+
+	inv.stop = make(chan struct{})
+	inv.done = make(chan struct{})
+	go inv.run(interval, inv.stop, inv.done)
+
+	return nil
+}
+
+// Stop stops refreshing the inventory periodically.
+func (inv *InterfaceInventory) Stop() {
+	inv.Lock()
+	stop, done := inv.stop, inv.done
+	inv.stop = nil
+	inv.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// run refreshes the inventory periodically.
+func (inv *InterfaceInventory) run(interval time.Duration, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := inv.Refresh(); err != nil {
+			log.Printf("[net] Failed to refresh network interfaces, err:%v.", err)
+		}
+	}
+}
+
+// findInterface returns the first interface for which match returns true.
+func findInterface(interfaces []InterfaceInfo, match func(*InterfaceInfo) bool) *InterfaceInfo {
+	for i := range interfaces {
+		if match(&interfaces[i]) {
+			return &interfaces[i]
+		}
+	}
+
+	return nil
+}
+
+// listInterfaces enumerates the host network interfaces and their addresses, ordered by index.
+func listInterfaces() ([]InterfaceInfo, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	interfaces := make([]InterfaceInfo, 0, len(ifaces))
+	for _, iface := range ifaces {
+		info := InterfaceInfo{
+			Name:         iface.Name,
+			Index:        iface.Index,
+			MTU:          iface.MTU,
+			Flags:        iface.Flags,
+			HardwareAddr: iface.HardwareAddr,
+		}
+
+		// Interfaces can disappear while they are enumerated.
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if ipAddr, ipNet, err := net.ParseCIDR(addr.String()); err == nil {
+				ipNet.IP = ipAddr
+				info.Addresses = append(info.Addresses, ipNet)
+			}
+		}
+
+		interfaces = append(interfaces, info)
+	}
+
+	sort.Slice(interfaces, func(i, j int) bool { return interfaces[i].Index < interfaces[j].Index })
+
+	return interfaces, nil
+}
+
+// logInterfaceChanges logs the interfaces that were added, removed or changed.
+func logInterfaceChanges(oldInterfaces []InterfaceInfo, newInterfaces []InterfaceInfo) {
+	old := make(map[string]*InterfaceInfo, len(oldInterfaces))
+	for i := range oldInterfaces {
+		old[oldInterfaces[i].Name] = &oldInterfaces[i]
+	}
+
+	for i := range newInterfaces {
+		iface := &newInterfaces[i]
+		oldIface := old[iface.Name]
+		delete(old, iface.Name)
+
+		if oldIface == nil {
+			log.Printf("[net] Network interface %v was added with IP addresses: %v.", iface.Name, iface.Addresses)
+		} else if !reflect.DeepEqual(oldIface, iface) {
+			log.Printf("[net] Network interface %v changed to %+v.", iface.Name, *iface)
+		}
+	}
+
+	for name := range old {
+		log.Printf("[net] Network interface %v was removed.", name)
+	}
+}
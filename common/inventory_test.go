@@ -0,0 +1,80 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Tests that the interface inventory serves reads from its cache, refreshes when a lookup misses
+// and notifies subscribers only when the interfaces change.
+func TestInterfaceInventory(t *testing.T) {
+	var lock sync.Mutex
+	var lists int
+	interfaces := []InterfaceInfo{{Name: "eth0", Index: 2, HardwareAddr: net.HardwareAddr{0, 0x0d, 0x3a, 0, 0, 0}}}
+
+	inv := NewInterfaceInventory()
+	inv.list = func() ([]InterfaceInfo, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		lists++
+		return append([]InterfaceInfo{}, interfaces...), nil
+	}
+
+	var changes int
+	inv.Subscribe(func(oldInterfaces []InterfaceInfo, newInterfaces []InterfaceInfo) {
+		changes++
+	})
+
+	for i := 0; i < 3; i++ {
+		if iface, err := inv.InterfaceByName("eth0"); err != nil || iface.Index != 2 {
+			t.Fatalf("Unexpected interface %+v, err:%v", iface, err)
+		}
+	}
+
+	if lists != 1 || changes != 1 {
+		t.Errorf("Expected one enumeration and one change, got %v and %v", lists, changes)
+	}
+
+	// Refreshing without changes does not notify subscribers.
+	if err := inv.Refresh(); err != nil || changes != 1 || inv.Generation() != 1 {
+		t.Errorf("Unexpected change after refresh without changes, err:%v", err)
+	}
+
+	// A lookup of a new interface refreshes the stale cache.
+	lock.Lock()
+	interfaces = append(interfaces, InterfaceInfo{Name: "eth1", Index: 3})
+	lock.Unlock()
+	inv.loaded = inv.loaded.Add(-minInterfaceLookupRefreshInterval)
+
+	if iface, err := inv.InterfaceByName("eth1"); err != nil || iface.Index != 3 {
+		t.Errorf("Unexpected interface %+v, err:%v", iface, err)
+	}
+
+	if changes != 2 || inv.Generation() != 2 {
+		t.Errorf("Expected a second change, got %v", changes)
+	}
+
+	// Lookups of missing interfaces do not refresh a recent cache.
+	lists = 0
+	if _, err := inv.InterfaceByName("eth2"); err == nil || lists != 0 {
+		t.Errorf("Expected a failed lookup without refresh, got err:%v after %v enumerations", err, lists)
+	}
+
+	// The inventory is refreshed periodically once started.
+	if err := inv.Start(10 * time.Millisecond); err != nil {
+		t.Fatalf("Failed to start inventory: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	inv.Stop()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if lists == 0 {
+		t.Errorf("Expected periodic refreshes")
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errListenerClosed is returned by Accept on a closed limitListener.
+var errListenerClosed = errors.New("Listener is closed")
+
+// limitListener is a net.Listener that accepts at most a fixed number of simultaneous connections.
+// Further connections wait in the backlog of the socket until an accepted connection is closed.
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newLimitListener returns a listener accepting at most n simultaneous connections from l.
+func newLimitListener(l net.Listener, n int) net.Listener {
+	return &limitListener{
+		Listener: l,
+		sem:      make(chan struct{}, n),
+		done:     make(chan struct{}),
+	}
+}
+
+// Accept waits for a connection slot to be available and accepts the next connection.
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+
+	return &limitConn{Conn: conn, release: func() { <-l.sem }}, nil
+}
+
+// Close closes the listener, unblocking pending calls to Accept.
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+// limitConn is a connection accepted by a limitListener, releasing its slot when closed.
+type limitConn struct {
+	net.Conn
+	release     func()
+	releaseOnce sync.Once
+}
+
+// Close closes the connection and releases its slot.
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
+
+// AddHandlerWithLimits registers a protocol handler that serves at most maxConcurrent requests at
+// once and at most ratePerSec requests per second on average, with bursts of up to ratePerSec
+// requests. Requests over either limit are rejected with status 429 and a Retry-After header.
+// The limits only apply to this path, so that the load on it does not throttle other paths.
+// Zero disables a limit. It fails if the path already has a handler.
+func (listener *Listener) AddHandlerWithLimits(
+	path string, handler func(http.ResponseWriter, *http.Request), maxConcurrent int, ratePerSec float64) error {
+	if maxConcurrent < 0 || ratePerSec < 0 {
+		return fmt.Errorf("Invalid request limits %v concurrent and %v per second", maxConcurrent, ratePerSec)
+	}
+
+	limiter := newRequestLimiter(maxConcurrent, ratePerSec)
+
+	return listener.AddHandlerWithMiddleware(path, handler, limiter.limit)
+}
+
+// requestLimiter limits the number of concurrent requests with a semaphore and the request rate
+// with a token bucket.
+type requestLimiter struct {
+	sem    chan struct{}
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	sync.Mutex
+}
+
+// newRequestLimiter creates a requestLimiter. Zero disables a limit.
+func newRequestLimiter(maxConcurrent int, ratePerSec float64) *requestLimiter {
+	limiter := &requestLimiter{rate: ratePerSec}
+
+	if maxConcurrent > 0 {
+		limiter.sem = make(chan struct{}, maxConcurrent)
+	}
+
+	if ratePerSec > 0 {
+		limiter.burst = math.Max(ratePerSec, 1)
+		limiter.tokens = limiter.burst
+	}
+
+	return limiter
+}
+
+// limit wraps a handler to reject the requests over the limits.
+func (limiter *requestLimiter) limit(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limiter.sem != nil {
+			select {
+			case limiter.sem <- struct{}{}:
+				defer func() { <-limiter.sem }()
+			default:
+				sendTooManyRequests(w, time.Second)
+				return
+			}
+		}
+
+		if wait := limiter.take(); wait > 0 {
+			sendTooManyRequests(w, wait)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// take takes a token from the bucket. It returns zero if a token was available,
+// or how long to wait for the next one otherwise.
+func (limiter *requestLimiter) take() time.Duration {
+	if limiter.rate == 0 {
+		return 0
+	}
+
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	now := time.Now()
+	if !limiter.last.IsZero() {
+		limiter.tokens = math.Min(limiter.burst, limiter.tokens+now.Sub(limiter.last).Seconds()*limiter.rate)
+	}
+	limiter.last = now
+
+	if limiter.tokens >= 1 {
+		limiter.tokens--
+		return 0
+	}
+
+	return time.Duration((1 - limiter.tokens) / limiter.rate * float64(time.Second))
+}
+
+// sendTooManyRequests rejects a request over a limit, telling the client to retry after the given duration.
+func sendTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	SendErrorWithCode(w, http.StatusTooManyRequests, ErrorCodeTooManyRequests, "Too many requests")
+}
@@ -4,16 +4,52 @@
 package common
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/Azure/azure-container-networking/log"
 )
 
+const (
+	// Time that Stop waits for active requests to complete before closing their connections.
+	defaultShutdownTimeout = 10 * time.Second
+
+	// Default timeouts for reading requests, writing responses and keeping idle connections open.
+	DefaultReadTimeout  = 30 * time.Second
+	DefaultWriteTimeout = 2 * time.Minute
+	DefaultIdleTimeout  = 2 * time.Minute
+
+	// Default maximum size of request bodies decoded by the listener.
+	DefaultMaxRequestBodySize = 4 << 20
+
+	// Media type of request and response bodies.
+	jsonContentType = "application/json"
+
+	// Protocol of listeners on Windows named pipes.
+	npipeProtocol = "npipe"
+)
+
+// Middleware wraps an HTTP handler, for example to authenticate, log or recover from panics.
+type Middleware func(http.Handler) http.Handler
+
+// serverTimeouts are the timeouts of the HTTP server of a listener.
+type serverTimeouts struct {
+	read  time.Duration
+	write time.Duration
+	idle  time.Duration
+}
+
 // Listener represents an HTTP listener.
 type Listener struct {
 	URL          *url.URL
@@ -23,6 +59,27 @@ type Listener struct {
 	active       bool
 	l            net.Listener
 	mux          *http.ServeMux
+	router       *router
+	server       *http.Server
+	tlsConfig    *tls.Config
+	certificate  *certificateReloader
+	logRequests  bool
+	socket       socketOptions
+	middlewares  []Middleware
+	maxBodySize  int64
+	metrics      *listenerMetrics
+	health       *healthChecks
+	strict       bool
+	timeouts     serverTimeouts
+	maxConns     int
+	addresses    []*Listener
+	relisten     *relistenOptions
+	stop         chan struct{}
+	socketInfo   os.FileInfo
+	lock         sync.Mutex
+
+	pipeSecurityDescriptor string
+	authenticator          func(*http.Request) error
 }
 
 // NewListener creates a new Listener.
@@ -31,13 +88,110 @@ func NewListener(u *url.URL) (*Listener, error) {
 		URL:          u,
 		protocol:     u.Scheme,
 		localAddress: u.Host + u.Path,
+		socket:       socketOptions{uid: -1, gid: -1},
+		maxBodySize:  DefaultMaxRequestBodySize,
+		timeouts: serverTimeouts{
+			read:  DefaultReadTimeout,
+			write: DefaultWriteTimeout,
+			idle:  DefaultIdleTimeout,
+		},
 	}
 
+	listener.router = newRouter()
 	listener.mux = http.NewServeMux()
+	listener.mux.Handle("/", listener.router)
 
 	return &listener, nil
 }
 
+// SetTLSConfig makes the listener serve HTTPS. It must be called before Start. The certificate is
+// loaded from the given certificate and key files and reloaded when they change. The files can be
+// omitted if config provides the certificates itself. Config may be nil to use the defaults.
+func (listener *Listener) SetTLSConfig(certFile string, keyFile string, config *tls.Config) error {
+	if listener.active {
+		return fmt.Errorf("TLS cannot be configured on an active listener")
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("TLS certificate and key files must be specified together")
+	}
+
+	if config != nil {
+		config = config.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+
+	listener.certificate = nil
+	if certFile != "" {
+		listener.certificate = newCertificateReloader(certFile, keyFile)
+		config.GetCertificate = listener.certificate.getCertificate
+	} else if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		return fmt.Errorf("TLS requires a certificate")
+	}
+
+	listener.tlsConfig = config
+
+	return nil
+}
+
+// SetTimeouts sets the maximum durations for reading a request, writing its response and keeping an
+// idle connection open. A zero duration disables the timeout. It must be called before Start.
+func (listener *Listener) SetTimeouts(read time.Duration, write time.Duration, idle time.Duration) error {
+	if listener.active {
+		return fmt.Errorf("Timeouts cannot be configured on an active listener")
+	}
+
+	listener.timeouts = serverTimeouts{read: read, write: write, idle: idle}
+
+	return nil
+}
+
+// SetMaxConnections sets the maximum number of simultaneous connections served by the listener.
+// Further connections wait until a served connection is closed. Zero removes the limit.
+// It must be called before Start.
+func (listener *Listener) SetMaxConnections(n int) error {
+	if listener.active {
+		return fmt.Errorf("Connection limit cannot be configured on an active listener")
+	}
+
+	if n < 0 {
+		return fmt.Errorf("Invalid connection limit %v", n)
+	}
+
+	listener.maxConns = n
+
+	return nil
+}
+
+// SetPipeSecurityDescriptor sets the security descriptor in SDDL format of the named pipe of the
+// listener, which controls who can connect to it. It must be called before Start.
+func (listener *Listener) SetPipeSecurityDescriptor(sddl string) {
+	listener.pipeSecurityDescriptor = sddl
+}
+
+// SetMaxRequestBodySize sets the maximum size in bytes of the request bodies decoded by the listener.
+// Larger requests are rejected with status 413. A size of zero or less removes the limit.
+func (listener *Listener) SetMaxRequestBodySize(size int64) {
+	listener.maxBodySize = size
+}
+
+// EnableStrictDecoding makes Decode reject requests with unknown fields or with data after the JSON
+// value, like DecodeStrict. It must be called before Start.
+func (listener *Listener) EnableStrictDecoding() {
+	listener.strict = true
+}
+
+// EnableRequestLogging makes the listener assign an ID to each request and log each request once it
+// completes. Handlers get the ID with GetRequestID. It must be called before Start.
+func (listener *Listener) EnableRequestLogging() {
+	listener.logRequests = true
+}
+
 // Start creates the listener socket and starts the HTTP server.
 func (listener *Listener) Start(errChan chan error) error {
 	var err error
@@ -47,43 +201,144 @@ func (listener *Listener) Start(errChan chan error) error {
 		return nil
 	}
 
-	listener.l, err = net.Listen(listener.protocol, listener.localAddress)
+	// Fail before listening if the certificate cannot be served.
+	if listener.certificate != nil {
+		if err = listener.certificate.load(); err != nil {
+			log.Printf("[Listener] Failed to load TLS certificate: %+v", err)
+			return fmt.Errorf("Failed to load TLS certificate %v: %v", listener.certificate.certFile, err)
+		}
+	}
+
+	listener.l, err = listener.createListener()
 	if err != nil {
-		log.Printf("[Listener] Failed to listen: %+v", err)
 		return err
 	}
 
-	log.Printf("[Listener] Started listening on %s.", listener.localAddress)
+	if err = listener.createAddressListeners(); err != nil {
+		listener.l.Close()
+		return err
+	}
 
-	// Launch goroutine for servicing requests.
-	go func() {
-		errChan <- http.Serve(listener.l, listener.mux)
-	}()
+	listener.router.wrap(listener.chain)
+
+	handler := listener.recoverPanics(listener.mux)
+	if listener.logRequests {
+		handler = logRequests(handler)
+	}
+	if listener.metrics != nil {
+		handler = listener.metrics.instrument(handler)
+	}
+
+	server := &http.Server{
+		Handler:      handler,
+		TLSConfig:    listener.tlsConfig,
+		ReadTimeout:  listener.timeouts.read,
+		WriteTimeout: listener.timeouts.write,
+		IdleTimeout:  listener.timeouts.idle,
+	}
+	listener.server = server
+
+	// Launch goroutines for servicing requests on each address.
+	listener.stop = make(chan struct{})
+	for _, address := range listener.getAddresses() {
+		if listener.tlsConfig != nil {
+			log.Printf("[Listener] Started listening on %s with TLS.", address.localAddress)
+		} else {
+			log.Printf("[Listener] Started listening on %s.", address.localAddress)
+		}
+
+		go address.serve(server, address.l, errChan, listener.stop)
+	}
 
 	listener.active = true
 	return nil
 }
 
-// Stop stops listening for requests.
+// createListener creates the listener socket.
+func (listener *Listener) createListener() (net.Listener, error) {
+	var err error
+
+	if listener.protocol == "unix" {
+		if err = removeStaleSocket(listener.localAddress); err != nil {
+			log.Printf("[Listener] Failed to remove stale socket: %+v", err)
+			return nil, err
+		}
+	}
+
+	l, err := listener.listen()
+	if err != nil {
+		log.Printf("[Listener] Failed to listen: %+v", err)
+		return nil, err
+	}
+
+	if listener.protocol == "unix" {
+		if err = listener.applySocketOptions(); err != nil {
+			log.Printf("[Listener] Failed to set permissions of socket %v: %+v", listener.localAddress, err)
+			l.Close()
+			return nil, err
+		}
+
+		// Remember the socket so that it can be told apart from a replacement.
+		listener.socketInfo, _ = os.Stat(listener.localAddress)
+	}
+
+	if listener.maxConns > 0 {
+		l = newLimitListener(l, listener.maxConns)
+	}
+
+	return l, nil
+}
+
+// Stop stops listening for requests, after waiting a bounded time for active requests to complete.
 func (listener *Listener) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownTimeout)
+	defer cancel()
+
+	listener.Shutdown(ctx)
+}
+
+// Shutdown stops listening for requests and waits for active requests to complete. If the context
+// expires first, the remaining connections are closed and the context error is returned.
+func (listener *Listener) Shutdown(ctx context.Context) error {
 	// Ignore if not active.
 	if !listener.active {
-		return
+		return nil
 	}
 	listener.active = false
 
+	// Cancel any attempt to listen again.
+	addresses := listener.getAddresses()
+	for _, address := range addresses {
+		address.lock.Lock()
+	}
+	close(listener.stop)
+	for _, address := range addresses {
+		address.lock.Unlock()
+	}
+
 	// Stop servicing requests.
-	listener.l.Close()
+	err := listener.server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("[Listener] Failed to complete active requests on %s, closing connections: %v", listener.localAddress, err)
+		listener.server.Close()
+	}
 
-	// Delete the unix socket.
-	if listener.protocol == "unix" {
-		os.Remove(listener.localAddress)
+	for _, address := range addresses {
+		// Delete the unix socket.
+		if address.protocol == "unix" {
+			os.Remove(address.localAddress)
+		}
+
+		log.Printf("[Listener] Stopped listening on %s", address.localAddress)
 	}
 
-	log.Printf("[Listener] Stopped listening on %s", listener.localAddress)
+	return err
 }
 
-// GetMux returns the HTTP mux for the listener.
+// GetMux returns the HTTP mux for the listener, which routes requests to the handlers of the listener.
+//
+// Deprecated: Handlers registered directly on the mux cannot be removed and are not wrapped by middlewares.
+// Use the AddHandler methods instead.
 func (listener *Listener) GetMux() *http.ServeMux {
 	return listener.mux
 }
@@ -98,34 +353,183 @@ func (listener *Listener) AddEndpoint(endpoint string) {
 	listener.endpoints = append(listener.endpoints, endpoint)
 }
 
-// AddHandler registers a protocol handler.
-func (listener *Listener) AddHandler(path string, handler func(http.ResponseWriter, *http.Request)) {
-	listener.mux.HandleFunc(path, handler)
+// Use registers a middleware that wraps every handler added through the AddHandler methods, including
+// the handlers added before it. Middlewares are applied in registration order, the first one being the
+// outermost, and are applied when the listener starts. Middlewares cannot be added to an active listener
+// and Use returns an error if it is called after Start.
+func (listener *Listener) Use(middleware Middleware) error {
+	if listener.active {
+		return fmt.Errorf("Middlewares cannot be added to an active listener")
+	}
+
+	listener.middlewares = append(listener.middlewares, middleware)
+
+	return nil
+}
+
+// AddHandler registers a protocol handler. Paths ending in a slash match the whole subtree under them.
+// It fails if the path already has a handler.
+func (listener *Listener) AddHandler(path string, handler func(http.ResponseWriter, *http.Request)) error {
+	return listener.AddHandlerWithMiddleware(path, handler)
+}
+
+// AddHandlerWithMiddleware registers a protocol handler wrapped by the given middlewares, in order.
+// They are applied inside the middlewares registered with Use. It fails if the path already has a handler.
+func (listener *Listener) AddHandlerWithMiddleware(
+	path string, handler func(http.ResponseWriter, *http.Request), middlewares ...Middleware) error {
+	return listener.router.add(path, listener.newRoute(handler, middlewares))
+}
+
+// ReplaceHandler registers a protocol handler, replacing the existing handler of the path if any.
+// Requests are served by either handler while it is replaced.
+func (listener *Listener) ReplaceHandler(path string, handler func(http.ResponseWriter, *http.Request)) error {
+	return listener.router.replace(path, listener.newRoute(handler, nil))
+}
+
+// RemoveHandler removes the protocol handler of a path. It fails if the path has no handler.
+func (listener *Listener) RemoveHandler(path string) error {
+	return listener.router.remove(path)
+}
+
+// newRoute creates a route for a handler wrapped by the given middlewares.
+func (listener *Listener) newRoute(handler func(http.ResponseWriter, *http.Request), middlewares []Middleware) *route {
+	var h http.Handler = http.HandlerFunc(handler)
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+
+	r := &route{handler: h, chain: h}
+	if listener.active {
+		r.chain = listener.chain(r)
+	}
+
+	return r
+}
+
+// chain wraps the handler of a route with the middlewares registered with Use, after authenticating
+// requests if the listener has an authenticator and the route is not public.
+func (listener *Listener) chain(r *route) http.Handler {
+	h := listener.applyMiddlewares(r.handler)
+	if listener.authenticator != nil && !r.public {
+		h = listener.authenticate(h)
+	}
+
+	return h
+}
+
+// applyMiddlewares wraps a handler with the middlewares registered with Use.
+func (listener *Listener) applyMiddlewares(h http.Handler) http.Handler {
+	for i := len(listener.middlewares) - 1; i >= 0; i-- {
+		h = listener.middlewares[i](h)
+	}
+
+	return h
+}
+
+// AddReadOnlyHandler registers a handler that only serves GET and HEAD requests.
+func (listener *Listener) AddReadOnlyHandler(path string, handler func(http.ResponseWriter, *http.Request)) error {
+	return listener.AddHandler(path, readOnly(handler))
 }
 
-// Decode receives and decodes JSON payload to a request.
+// readOnly wraps a handler to only serve GET and HEAD requests.
+func readOnly(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// Decode receives and decodes JSON payload to a request. Requests without a Content-Type are accepted
+// for compatibility with libnetwork.
 func (listener *Listener) Decode(w http.ResponseWriter, r *http.Request, request interface{}) error {
+	return listener.decode(w, r, request, listener.strict)
+}
+
+// DecodeStrict receives and decodes JSON payload to a request like Decode, but rejects requests with
+// fields unknown to the request type or with data after the JSON value.
+func (listener *Listener) DecodeStrict(w http.ResponseWriter, r *http.Request, request interface{}) error {
+	return listener.decode(w, r, request, true)
+}
+
+// decode receives and decodes JSON payload to a request.
+func (listener *Listener) decode(w http.ResponseWriter, r *http.Request, request interface{}, strict bool) error {
 	var err error
 
+	if contentType := r.Header.Get("Content-Type"); contentType != "" && !isJSONContentType(contentType) {
+		err = fmt.Errorf("Unsupported content type %v", contentType)
+		SendErrorWithCode(w, http.StatusUnsupportedMediaType, ErrorCodeUnsupportedMediaType, err.Error())
+		log.Printf("[Listener] %vFailed to decode request: %v\n", getRequestLogPrefix(w), err.Error())
+		return err
+	}
+
 	if r.Body == nil {
 		err = fmt.Errorf("Request body is empty")
 	} else {
-		err = json.NewDecoder(r.Body).Decode(request)
+		body := r.Body
+		if listener.maxBodySize > 0 {
+			body = http.MaxBytesReader(w, r.Body, listener.maxBodySize)
+		}
+
+		decoder := json.NewDecoder(body)
+		if strict {
+			decoder.DisallowUnknownFields()
+		}
+
+		err = decoder.Decode(request)
+		if err == nil && strict {
+			if _, tokenErr := decoder.Token(); tokenErr != io.EOF {
+				err = fmt.Errorf("Request body has data after the JSON value")
+			}
+		}
 	}
 
-	if err != nil {
+	if isBodyTooLarge(err) {
+		err = fmt.Errorf("Request body exceeds the maximum size of %v bytes", listener.maxBodySize)
+		SendErrorWithCode(w, http.StatusRequestEntityTooLarge, ErrorCodeRequestTooLarge, err.Error())
+		log.Printf("[Listener] %vFailed to decode request: %v\n", getRequestLogPrefix(w), err.Error())
+	} else if err != nil && strict {
+		SendErrorWithCode(w, http.StatusBadRequest, ErrorCodeInvalidRequest, "Failed to decode request: "+err.Error())
+		log.Printf("[Listener] %vFailed to decode request: %v\n", getRequestLogPrefix(w), err.Error())
+	} else if err != nil {
 		http.Error(w, "Failed to decode request: "+err.Error(), http.StatusBadRequest)
-		log.Printf("[Listener] Failed to decode request: %v\n", err.Error())
+		log.Printf("[Listener] %vFailed to decode request: %v\n", getRequestLogPrefix(w), err.Error())
 	}
 	return err
 }
 
+// isBodyTooLarge returns whether reading a body wrapped by http.MaxBytesReader failed because the
+// body exceeds the limit. The reader reports it with an error that only has a fixed message.
+func isBodyTooLarge(err error) bool {
+	return err != nil && err.Error() == "http: request body too large"
+}
+
 // Encode encodes and sends a response as JSON payload.
 func (listener *Listener) Encode(w http.ResponseWriter, response interface{}) error {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", jsonContentType)
+	}
+
 	err := json.NewEncoder(w).Encode(response)
 	if err != nil {
 		http.Error(w, "Failed to encode response: "+err.Error(), http.StatusInternalServerError)
-		log.Printf("[Listener] Failed to encode response: %v\n", err.Error())
+		log.Printf("[Listener] %vFailed to encode response: %v\n", getRequestLogPrefix(w), err.Error())
 	}
 	return err
 }
+
+// isJSONContentType returns whether a Content-Type header denotes a JSON body. Structured suffixes
+// such as the application/vnd.docker.plugins.v1.2+json of Docker plugins are JSON as well.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == jsonContentType ||
+		(strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json"))
+}
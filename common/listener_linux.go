@@ -0,0 +1,18 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"fmt"
+	"net"
+)
+
+// listen creates the socket of the listener.
+func (listener *Listener) listen() (net.Listener, error) {
+	if listener.protocol == npipeProtocol {
+		return nil, fmt.Errorf("Named pipes are only supported on Windows")
+	}
+
+	return net.Listen(listener.protocol, listener.localAddress)
+}
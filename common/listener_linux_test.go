@@ -0,0 +1,251 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Tests that the unix socket of the listener gets the requested permissions and ownership.
+func TestListenerSocketPermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listener")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socketPath := path.Join(dir, "test.sock")
+	listener, _ := NewListener(&url.URL{Scheme: "unix", Path: socketPath})
+	listener.SetSocketMode(0660)
+	listener.SetSocketOwner(os.Getuid(), os.Getgid())
+
+	if err := listener.Start(make(chan error, 1)); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+	defer listener.Stop()
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("Failed to stat socket: %v", err)
+	}
+
+	if info.Mode().Perm() != 0660 {
+		t.Errorf("Expected socket mode 0660, got %v", info.Mode().Perm())
+	}
+
+	if stat := info.Sys().(*syscall.Stat_t); int(stat.Uid) != os.Getuid() || int(stat.Gid) != os.Getgid() {
+		t.Errorf("Unexpected socket owner %v:%v", stat.Uid, stat.Gid)
+	}
+
+	if err := listener.SetSocketGroup("no-such-group-for-listener-test"); err == nil {
+		t.Errorf("Expected an unknown group to be rejected")
+	}
+}
+
+// Tests that a socket left behind by a crashed listener is replaced, while a socket that is still
+// served and files that are not sockets are not.
+func TestListenerStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listener")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socketPath := path.Join(dir, "test.sock")
+
+	// Leave a socket file behind, as a crashed listener would.
+	stale, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to create socket: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, _ := NewListener(&url.URL{Scheme: "unix", Path: socketPath})
+	if err := listener.Start(make(chan error, 1)); err != nil {
+		t.Fatalf("Failed to start listener over stale socket: %v", err)
+	}
+	defer listener.Stop()
+
+	// A second listener must not take over the socket of the running one.
+	other, _ := NewListener(&url.URL{Scheme: "unix", Path: socketPath})
+	if err := other.Start(make(chan error, 1)); err == nil {
+		other.Stop()
+		t.Errorf("Expected the socket of a running listener to be left alone")
+	}
+
+	filePath := path.Join(dir, "file")
+	ioutil.WriteFile(filePath, []byte("data"), 0600)
+
+	other, _ = NewListener(&url.URL{Scheme: "unix", Path: filePath})
+	if err := other.Start(make(chan error, 1)); err == nil {
+		other.Stop()
+		t.Errorf("Expected listening over a regular file to fail")
+	}
+
+	if _, err := os.Stat(filePath); err != nil {
+		t.Errorf("Regular file was removed: %v", err)
+	}
+}
+
+// Tests that the listener listens again when its socket is deleted and stops trying once stopped.
+func TestListenerRelisten(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listener")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socketPath := path.Join(dir, "test.sock")
+	listener, _ := NewListener(&url.URL{Scheme: "unix", Path: socketPath})
+	listener.EnableMetrics("test")
+
+	if err := listener.EnableRelisten(0, time.Millisecond); err == nil {
+		t.Errorf("Expected an empty retry budget to be rejected")
+	}
+
+	listener.EnableRelisten(3, 10*time.Millisecond)
+	listener.relisten.checkInterval = 10 * time.Millisecond
+
+	errChan := make(chan error, 1)
+	if err := listener.Start(errChan); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", socketPath)
+			},
+			DisableKeepAlives: true,
+		},
+		Timeout: time.Second,
+	}
+
+	os.Remove(socketPath)
+
+	var body []byte
+	for i := 0; i < 100 && !strings.Contains(string(body), "test_listener_relisten_attempts_total 1\n"); i++ {
+		time.Sleep(10 * time.Millisecond)
+		if resp, err := client.Get("http://unix/metrics"); err == nil {
+			body, _ = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+	}
+
+	if !strings.Contains(string(body), "test_listener_relisten_attempts_total 1\n") {
+		t.Fatalf("Expected the listener to serve again after one attempt, got:\n%s", body)
+	}
+
+	listener.Stop()
+
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be removed once stopped, got %v", err)
+	}
+
+	select {
+	case err := <-errChan:
+		t.Errorf("Unexpected serve error: %v", err)
+	default:
+	}
+}
+
+// Tests that a listener serves the same handlers and middlewares on all of its addresses,
+// reports serve errors tagged with the address and stops listening on all of them.
+func TestListenerMultipleAddresses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listener")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socketPath := path.Join(dir, "test.sock")
+	listener, _ := NewListener(&url.URL{Scheme: "unix", Path: socketPath})
+	listener.AddHandler("/test", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	listener.Use(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Test", "wrapped")
+			h.ServeHTTP(w, r)
+		})
+	})
+
+	if err := listener.AddAddress(&url.URL{Scheme: "unix", Path: socketPath}); err == nil {
+		t.Errorf("Expected a duplicate address to be rejected")
+	}
+
+	tcpURL, _ := url.Parse("tcp://127.0.0.1:0")
+	if err := listener.AddAddress(tcpURL); err != nil {
+		t.Fatalf("Failed to add address: %v", err)
+	}
+
+	errChan := make(chan error, 2)
+	if err := listener.Start(errChan); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+
+	if err := listener.AddAddress(tcpURL); err == nil {
+		t.Errorf("Expected adding an address to an active listener to fail")
+	}
+
+	unixClient := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socketPath)
+		},
+		DisableKeepAlives: true,
+	}}
+	tcpAddress := listener.addresses[0].l.Addr().String()
+
+	for _, get := range []func() (*http.Response, error){
+		func() (*http.Response, error) { return unixClient.Get("http://unix/test") },
+		func() (*http.Response, error) { return http.Get("http://" + tcpAddress + "/test") },
+	} {
+		resp, err := get()
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Test") != "wrapped" {
+			t.Errorf("Unexpected response %v with headers %v", resp.StatusCode, resp.Header)
+		}
+	}
+
+	// Closing one socket under the server reports an error for its address only.
+	listener.addresses[0].l.Close()
+
+	select {
+	case err := <-errChan:
+		addressErr, ok := err.(*AddressError)
+		if !ok || addressErr.Address != "127.0.0.1:0" {
+			t.Errorf("Unexpected serve error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected a serve error for the closed address")
+	}
+
+	if resp, err := unixClient.Get("http://unix/test"); err != nil {
+		t.Errorf("Expected the unix socket to still be served: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+
+	listener.Stop()
+
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be removed once stopped, got %v", err)
+	}
+
+	if _, err := net.Dial("tcp", tcpAddress); err == nil {
+		t.Errorf("Expected the TCP address to be closed once stopped")
+	}
+}
@@ -0,0 +1,1021 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate with the given serial number and its key.
+func writeTestCertificate(t *testing.T, certFile string, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	// Make sure that the change is visible even on file systems with a coarse modification time.
+	modTime := time.Now().Add(time.Duration(serial) * time.Second)
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+}
+
+// getServedSerial returns the serial number of the certificate served by the listener.
+func getServedSerial(t *testing.T, listener *Listener) int64 {
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}}
+
+	resp, err := client.Get("https://" + listener.l.Addr().String() + "/test")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	return resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+}
+
+// Tests that the listener serves TLS, fails to start without a certificate and reloads a changed certificate.
+func TestListenerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listener")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := path.Join(dir, "cert.pem")
+	keyFile := path.Join(dir, "key.pem")
+
+	u, _ := url.Parse("tcp://127.0.0.1:0")
+	listener, _ := NewListener(u)
+	listener.AddHandler("/test", func(w http.ResponseWriter, r *http.Request) {})
+
+	if err := listener.SetTLSConfig(certFile, "", nil); err == nil {
+		t.Errorf("Expected a certificate without a key to be rejected")
+	}
+
+	if err := listener.SetTLSConfig(certFile, keyFile, nil); err != nil {
+		t.Fatalf("Failed to set TLS config: %v", err)
+	}
+
+	errChan := make(chan error, 1)
+	if err := listener.Start(errChan); err == nil || listener.active {
+		t.Fatalf("Expected start to fail without a certificate")
+	}
+
+	writeTestCertificate(t, certFile, keyFile, 1)
+	if err := listener.Start(errChan); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+	defer listener.Stop()
+
+	if serial := getServedSerial(t, listener); serial != 1 {
+		t.Errorf("Expected certificate 1, got %v", serial)
+	}
+
+	writeTestCertificate(t, certFile, keyFile, 2)
+	if serial := getServedSerial(t, listener); serial != 2 {
+		t.Errorf("Expected reloaded certificate 2, got %v", serial)
+	}
+
+	// A certificate that cannot be loaded keeps the previous one in service.
+	ioutil.WriteFile(keyFile, []byte("invalid"), 0600)
+	if serial := getServedSerial(t, listener); serial != 2 {
+		t.Errorf("Expected certificate 2 after a failed reload, got %v", serial)
+	}
+}
+
+// Tests that shutting down the listener completes active requests, closes the connections of the requests
+// still active once the deadline expires, and does not report the closed server as an error.
+func TestListenerShutdown(t *testing.T) {
+	u, _ := url.Parse("tcp://127.0.0.1:0")
+	listener, _ := NewListener(u)
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	listener.AddHandler("/test", func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("done"))
+	})
+
+	errChan := make(chan error, 1)
+	if err := listener.Start(errChan); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+
+	address := "http://" + listener.l.Addr().String() + "/test"
+	get := func(results chan string) {
+		resp, err := http.Get(address)
+		if err != nil {
+			results <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		results <- string(body)
+	}
+
+	results := make(chan string, 1)
+	go get(results)
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- listener.Shutdown(context.Background()) }()
+
+	// The request completes while the listener drains it.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	if result := <-results; result != "done" {
+		t.Errorf("Expected the active request to complete, got %v", result)
+	}
+
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("Unexpected shutdown error: %v", err)
+	}
+
+	// Requests still active when the deadline expires are aborted.
+	release = make(chan struct{})
+	defer close(release)
+
+	if err := listener.Start(errChan); err != nil {
+		t.Fatalf("Failed to restart listener: %v", err)
+	}
+
+	address = "http://" + listener.l.Addr().String() + "/test"
+	go get(results)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := listener.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline to be exceeded, got %v", err)
+	}
+
+	if result := <-results; result == "done" {
+		t.Errorf("Expected the active request to be aborted")
+	}
+
+	select {
+	case err := <-errChan:
+		t.Errorf("Unexpected serve error: %v", err)
+	default:
+	}
+}
+
+// Tests that request logging assigns request IDs, honoring the ones set by callers, and exposes them to handlers.
+func TestListenerRequestLogging(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		u, _ := url.Parse("tcp://127.0.0.1:0")
+		listener, _ := NewListener(u)
+		listener.AddHandler("/test", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(GetRequestID(r.Context())))
+		})
+
+		if enabled {
+			listener.EnableRequestLogging()
+		}
+
+		if err := listener.Start(make(chan error, 1)); err != nil {
+			t.Fatalf("Failed to start listener: %v", err)
+		}
+
+		for _, requestID := range []string{"", "caller-id"} {
+			req, _ := http.NewRequest(http.MethodGet, "http://"+listener.l.Addr().String()+"/test", nil)
+			if requestID != "" {
+				req.Header.Set(RequestIDHeader, requestID)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			served := resp.Header.Get(RequestIDHeader)
+
+			switch {
+			case resp.StatusCode != http.StatusCreated:
+				t.Errorf("Unexpected status %v", resp.StatusCode)
+			case !enabled && (served != "" || len(body) != 0):
+				t.Errorf("Unexpected request ID %q %q without request logging", served, body)
+			case enabled && (served != string(body) || served == ""):
+				t.Errorf("Request ID %q does not match the one seen by the handler %q", served, body)
+			case enabled && requestID != "" && served != requestID:
+				t.Errorf("Expected request ID %v, got %v", requestID, served)
+			}
+		}
+
+		listener.Stop()
+	}
+}
+
+// Tests that middlewares wrap handlers in registration order, inside out from the listener ones to the
+// route ones, and cannot be added once the listener is active.
+func TestListenerMiddleware(t *testing.T) {
+	mark := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(name))
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	u, _ := url.Parse("tcp://127.0.0.1:0")
+	listener, _ := NewListener(u)
+	listener.Use(mark("a"))
+	listener.AddHandler("/plain", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("h")) })
+	listener.AddHandlerWithMiddleware("/route", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("h"))
+	}, mark("c"), mark("d"))
+	listener.Use(mark("b"))
+
+	if err := listener.Start(make(chan error, 1)); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+	defer listener.Stop()
+
+	if err := listener.Use(mark("e")); err == nil {
+		t.Errorf("Expected adding a middleware to an active listener to fail")
+	}
+
+	listener.AddHandler("/late", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("h")) })
+
+	for path, expected := range map[string]string{"/plain": "abh", "/route": "abcdh", "/late": "abh"} {
+		resp, err := http.Get("http://" + listener.l.Addr().String() + path)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(body) != expected {
+			t.Errorf("Path %v: expected %v, got %v", path, expected, string(body))
+		}
+	}
+}
+
+// Tests that Decode rejects request bodies larger than the limit of the listener with a structured error.
+func TestListenerMaxRequestBodySize(t *testing.T) {
+	u, _ := url.Parse("tcp://127.0.0.1:0")
+	listener, _ := NewListener(u)
+	listener.SetMaxRequestBodySize(64)
+	listener.AddHandler("/test", func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]string
+		if listener.Decode(w, r, &request) == nil {
+			listener.Encode(w, request)
+		}
+	})
+
+	if err := listener.Start(make(chan error, 1)); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+	defer listener.Stop()
+
+	address := "http://" + listener.l.Addr().String() + "/test"
+	for size, status := range map[int]int{8: http.StatusOK, 128: http.StatusRequestEntityTooLarge} {
+		body := `{"data":"` + strings.Repeat("x", size) + `"}`
+		resp, err := http.Post(address, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+
+		var response ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&response)
+		resp.Body.Close()
+
+		if resp.StatusCode != status {
+			t.Errorf("Body of %v bytes: expected status %v, got %v", len(body), status, resp.StatusCode)
+		}
+
+		if status == http.StatusRequestEntityTooLarge && response.Error.Message == "" {
+			t.Errorf("Expected an error in the response")
+		}
+	}
+}
+
+// Tests that Decode only accepts JSON or unspecified content types and that Encode sets the content type.
+func TestListenerContentType(t *testing.T) {
+	u, _ := url.Parse("tcp://127.0.0.1:0")
+	listener, _ := NewListener(u)
+	listener.AddHandler("/test", func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]string
+		if listener.Decode(w, r, &request) == nil {
+			listener.Encode(w, request)
+		}
+	})
+
+	if err := listener.Start(make(chan error, 1)); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+	defer listener.Stop()
+
+	address := "http://" + listener.l.Addr().String() + "/test"
+	for contentType, status := range map[string]int{
+		"":                                       http.StatusOK,
+		"application/json":                       http.StatusOK,
+		"application/json; charset=utf-8":        http.StatusOK,
+		"application/vnd.docker.plugins.v1+json": http.StatusOK,
+		"text/plain":                             http.StatusUnsupportedMediaType,
+		"invalid;;":                              http.StatusUnsupportedMediaType,
+	} {
+		req, _ := http.NewRequest(http.MethodPost, address, strings.NewReader(`{"key":"value"}`))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != status {
+			t.Errorf("Content type %q: expected status %v, got %v", contentType, status, resp.StatusCode)
+		}
+
+		if served := resp.Header.Get("Content-Type"); served != "application/json" {
+			t.Errorf("Content type %q: expected a JSON response, got %q", contentType, served)
+		}
+	}
+}
+
+// Tests that the listener counts requests by handler pattern and status code and serves the metrics.
+func TestListenerMetrics(t *testing.T) {
+	u, _ := url.Parse("tcp://127.0.0.1:0")
+	listener, _ := NewListener(u)
+	listener.AddHandler("/test/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	if err := listener.EnableMetrics("azure-cnm"); err == nil {
+		t.Errorf("Expected an invalid prefix to be rejected")
+	}
+
+	if err := listener.EnableMetrics("azure_cnm"); err != nil {
+		t.Fatalf("Failed to enable metrics: %v", err)
+	}
+
+	if err := listener.Start(make(chan error, 1)); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+	defer listener.Stop()
+
+	address := "http://" + listener.l.Addr().String()
+	for _, path := range []string{"/test/a", "/test/b", "/missing"} {
+		resp, err := http.Get(address + path)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(address + "/metrics")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	for _, line := range []string{
+		`azure_cnm_http_requests_total{path="/test/",code="202"} 2`,
+		`azure_cnm_http_requests_total{path="unmatched",code="404"} 1`,
+		`azure_cnm_http_request_duration_seconds_bucket{path="/test/",le="+Inf"} 2`,
+		`azure_cnm_http_request_duration_seconds_count{path="/test/"} 2`,
+		`azure_cnm_http_requests_in_flight 1`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("Expected metrics to contain %v, got:\n%s", line, body)
+		}
+	}
+}
+
+// Tests that handlers can be added, replaced and removed, including while the listener is active.
+func TestListenerHandlers(t *testing.T) {
+	u, _ := url.Parse("tcp://127.0.0.1:0")
+	listener, _ := NewListener(u)
+	reply := func(body string) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(body)) }
+	}
+
+	listener.AddHandler("/test", reply("test"))
+	listener.AddHandler("/tree/", reply("tree"))
+	listener.AddHandler("/tree/leaf", reply("leaf"))
+
+	if err := listener.AddHandler("/test", reply("duplicate")); err == nil {
+		t.Errorf("Expected a duplicate handler to be rejected")
+	}
+
+	if err := listener.RemoveHandler("/missing"); err == nil {
+		t.Errorf("Expected removing a missing handler to fail")
+	}
+
+	if err := listener.Start(make(chan error, 1)); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+	defer listener.Stop()
+
+	get := func(path string) string {
+		resp, err := http.Get("http://" + listener.l.Addr().String() + path)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			return "not found"
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	for path, expected := range map[string]string{
+		"/test":        "test",
+		"/test/other":  "not found",
+		"/tree/":       "tree",
+		"/tree/branch": "tree",
+		"/tree/leaf":   "leaf",
+	} {
+		if body := get(path); body != expected {
+			t.Errorf("Path %v: expected %v, got %v", path, expected, body)
+		}
+	}
+
+	listener.ReplaceHandler("/test", reply("replaced"))
+	listener.RemoveHandler("/tree/leaf")
+
+	if body := get("/test"); body != "replaced" {
+		t.Errorf("Expected the replaced handler, got %v", body)
+	}
+
+	if body := get("/tree/leaf"); body != "tree" {
+		t.Errorf("Expected the subtree handler after removal, got %v", body)
+	}
+
+	// The deprecated mux keeps routing requests to the handlers of the listener.
+	w := httptest.NewRecorder()
+	listener.GetMux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/test", nil))
+	if w.Body.String() != "replaced" {
+		t.Errorf("Expected the mux to route to the listener handlers, got %v", w.Body.String())
+	}
+}
+
+// Tests that a panicking handler is answered with an internal server error, counted in the metrics,
+// and does not prevent the listener from serving subsequent requests.
+func TestListenerPanicRecovery(t *testing.T) {
+	u, _ := url.Parse("tcp://127.0.0.1:0")
+	listener, _ := NewListener(u)
+	listener.AddHandler("/panic", func(w http.ResponseWriter, r *http.Request) { panic("test panic") })
+	listener.AddHandler("/test", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	listener.EnableMetrics("test")
+
+	if err := listener.Start(make(chan error, 1)); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+	defer listener.Stop()
+
+	address := "http://" + listener.l.Addr().String()
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(address + "/panic")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+
+		var response ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&response)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusInternalServerError || response.Error.Message == "" {
+			t.Errorf("Expected an internal server error, got %v %q", resp.StatusCode, response.Error.Message)
+		}
+
+		resp, err = http.Get(address + "/test")
+		if err != nil {
+			t.Fatalf("Request after panic failed: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(body) != "ok" {
+			t.Errorf("Expected the listener to keep serving, got %v", string(body))
+		}
+	}
+
+	resp, err := http.Get(address + "/metrics")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	for _, line := range []string{
+		"test_http_handler_panics_total 2\n",
+		`test_http_requests_total{path="/panic",code="500"} 2` + "\n",
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("Expected metrics to contain %v, got:\n%s", line, body)
+		}
+	}
+}
+
+// Tests that strict decoding rejects unknown fields and trailing data while lenient decoding accepts them.
+func TestListenerStrictDecoding(t *testing.T) {
+	u, _ := url.Parse("tcp://127.0.0.1:0")
+	listener, _ := NewListener(u)
+	listener.AddHandler("/lenient", func(w http.ResponseWriter, r *http.Request) {
+		var request struct{ Name string }
+		listener.Decode(w, r, &request)
+	})
+	listener.AddHandler("/strict", func(w http.ResponseWriter, r *http.Request) {
+		var request struct{ Name string }
+		listener.DecodeStrict(w, r, &request)
+	})
+
+	if err := listener.Start(make(chan error, 1)); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+	defer listener.Stop()
+
+	address := "http://" + listener.l.Addr().String()
+	for _, test := range []struct {
+		body   string
+		status int
+		err    string
+	}{
+		{`{"Name":"a"}`, http.StatusOK, ""},
+		{`{"Name":"a"}` + "\n", http.StatusOK, ""},
+		{`{"Nmae":"a"}`, http.StatusBadRequest, "Nmae"},
+		{`{"Name":"a"} {}`, http.StatusBadRequest, "after the JSON value"},
+	} {
+		resp, err := http.Post(address+"/lenient", "application/json", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Body %q: expected lenient decoding to succeed, got %v", test.body, resp.StatusCode)
+		}
+
+		resp, err = http.Post(address+"/strict", "application/json", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+
+		var response ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&response)
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status || !strings.Contains(response.Error.Message, test.err) {
+			t.Errorf("Body %q: expected status %v with error %q, got %v %q",
+				test.body, test.status, test.err, resp.StatusCode, response.Error.Message)
+		}
+	}
+}
+
+// Tests that error responses carry the status, the code, the message and the ID of the request.
+func TestSendErrorWithCode(t *testing.T) {
+	u, _ := url.Parse("tcp://127.0.0.1:0")
+	listener, _ := NewListener(u)
+	listener.EnableRequestLogging()
+	listener.AddHandler("/test", func(w http.ResponseWriter, r *http.Request) {
+		SendErrorWithCode(w, http.StatusConflict, "Conflict", "test error")
+	})
+
+	if err := listener.Start(make(chan error, 1)); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+	defer listener.Stop()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+listener.l.Addr().String()+"/test", nil)
+	req.Header.Set(RequestIDHeader, "caller-id")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var response ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode error response: %v", err)
+	}
+
+	expected := ErrorDetails{Code: "Conflict", Message: "test error", RequestID: "caller-id"}
+	if resp.StatusCode != http.StatusConflict || response.Error != expected {
+		t.Errorf("Unexpected error response %v %+v", resp.StatusCode, response.Error)
+	}
+}
+
+// Tests that the listener closes connections that do not send a request in time and serves
+// at most the configured number of connections at once.
+func TestListenerConnectionLimits(t *testing.T) {
+	u, _ := url.Parse("tcp://127.0.0.1:0")
+	listener, _ := NewListener(u)
+	listener.AddHandler("/test", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	listener.SetTimeouts(200*time.Millisecond, time.Second, time.Second)
+
+	if err := listener.SetMaxConnections(-1); err == nil {
+		t.Errorf("Expected a negative connection limit to be rejected")
+	}
+	listener.SetMaxConnections(1)
+
+	if err := listener.Start(make(chan error, 1)); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+	defer listener.Stop()
+
+	if err := listener.SetTimeouts(0, 0, 0); err == nil {
+		t.Errorf("Expected configuring timeouts on an active listener to fail")
+	}
+
+	address := listener.l.Addr().String()
+
+	// An idle connection takes the only slot until the read timeout closes it.
+	idle, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer idle.Close()
+
+	start := time.Now()
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + address + "/test")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if time.Since(start) < 100*time.Millisecond {
+		t.Errorf("Expected the request to wait for the idle connection to be closed")
+	}
+
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Expected the idle connection to be closed")
+	}
+}
+
+// Tests that the listener rejects requests without the shared token, except for public handlers,
+// and accepts a rotated token without restarting.
+func TestListenerAuthentication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenFile := path.Join(dir, "token")
+	if _, err := NewSharedSecretAuthenticator(tokenFile); err == nil {
+		t.Errorf("Expected a missing token file to be rejected")
+	}
+
+	ioutil.WriteFile(tokenFile, []byte("secret-1\n"), 0600)
+	authenticator, err := NewSharedSecretAuthenticator(tokenFile)
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+
+	u, _ := url.Parse("tcp://127.0.0.1:0")
+	listener, _ := NewListener(u)
+	listener.SetAuthenticator(authenticator)
+	listener.EnableMetrics("azure_cns")
+	listener.AddHandler("/test", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	listener.AddPublicHandler("/health", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+
+	if err := listener.Start(make(chan error, 1)); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+	defer listener.Stop()
+
+	if err := listener.SetAuthenticator(nil); err == nil {
+		t.Errorf("Expected configuring authentication on an active listener to fail")
+	}
+
+	address := "http://" + listener.l.Addr().String()
+	get := func(path string, token string) (int, ErrorResponse) {
+		req, _ := http.NewRequest(http.MethodGet, address+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var response ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&response)
+		return resp.StatusCode, response
+	}
+
+	for _, test := range []struct {
+		path   string
+		token  string
+		status int
+	}{
+		{"/test", "", http.StatusUnauthorized},
+		{"/test", "secret-2", http.StatusUnauthorized},
+		{"/test", "secret-1", http.StatusOK},
+		{"/health", "", http.StatusOK},
+		{"/metrics", "", http.StatusOK},
+	} {
+		status, response := get(test.path, test.token)
+		if status != test.status {
+			t.Errorf("Unexpected status %v for %v with token %q", status, test.path, test.token)
+		}
+		if status == http.StatusUnauthorized && response.Error.Code != ErrorCodeUnauthorized {
+			t.Errorf("Unexpected error response %+v", response.Error)
+		}
+	}
+
+	// Handlers added while the listener is active are authenticated as well.
+	listener.AddHandler("/late", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	if status, _ := get("/late", ""); status != http.StatusUnauthorized {
+		t.Errorf("Unexpected status %v for a handler added after start", status)
+	}
+
+	// Rotate the token.
+	ioutil.WriteFile(tokenFile, []byte("secret-2"), 0600)
+	modTime := time.Now().Add(time.Second)
+	os.Chtimes(tokenFile, modTime, modTime)
+
+	if status, _ := get("/test", "secret-2"); status != http.StatusOK {
+		t.Errorf("Unexpected status %v with the rotated token", status)
+	}
+	if status, _ := get("/test", "secret-1"); status != http.StatusUnauthorized {
+		t.Errorf("Unexpected status %v with the previous token", status)
+	}
+}
+
+// Tests that per-path limits reject requests over the concurrency and rate limits with status 429,
+// without throttling other paths.
+func TestListenerHandlerLimits(t *testing.T) {
+	u, _ := url.Parse("tcp://127.0.0.1:0")
+	listener, _ := NewListener(u)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	listener.AddHandlerWithLimits("/slow", func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}, 1, 0)
+	listener.AddHandlerWithLimits("/rated", func(w http.ResponseWriter, r *http.Request) {}, 0, 1)
+	listener.AddHandler("/healthz", func(w http.ResponseWriter, r *http.Request) {})
+
+	if err := listener.AddHandlerWithLimits("/invalid", func(w http.ResponseWriter, r *http.Request) {}, -1, 0); err == nil {
+		t.Errorf("Expected negative limits to be rejected")
+	}
+
+	if err := listener.Start(make(chan error, 1)); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+	defer listener.Stop()
+
+	address := "http://" + listener.l.Addr().String()
+	get := func(path string) *http.Response {
+		resp, err := http.Get(address + path)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// The only concurrent request slot of /slow is taken.
+	done := make(chan *http.Response)
+	go func() {
+		resp, _ := http.Get(address + "/slow")
+		done <- resp
+	}()
+	<-started
+
+	resp := get("/slow")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("Unexpected response %v with Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	if resp := get("/healthz"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected other paths not to be throttled, got %v", resp.StatusCode)
+	}
+
+	close(release)
+	if resp := <-done; resp == nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected response to the first request %+v", resp)
+	}
+
+	// The rate of /rated allows a single request per second.
+	if resp := get("/rated"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected response %v within the rate", resp.StatusCode)
+	}
+
+	resp = get("/rated")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("Unexpected response %v with Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	if resp := get("/healthz"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected other paths not to be throttled, got %v", resp.StatusCode)
+	}
+}
+
+// Tests that handlers registered for methods are dispatched by method, and that other methods
+// are answered with status 405 and OPTIONS with the allowed methods.
+func TestListenerMethodHandlers(t *testing.T) {
+	u, _ := url.Parse("tcp://127.0.0.1:0")
+	listener, _ := NewListener(u)
+	if err := listener.AddHandlerFor(http.MethodGet, "/test", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("get")) }); err != nil {
+		t.Fatalf("Failed to add GET handler: %v", err)
+	}
+	if err := listener.AddHandlerFor("post", "/test", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("post")) }); err != nil {
+		t.Fatalf("Failed to add POST handler: %v", err)
+	}
+	listener.AddHandler("/legacy", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(r.Method)) })
+
+	if err := listener.AddHandlerFor(http.MethodGet, "/test", func(w http.ResponseWriter, r *http.Request) {}); err == nil {
+		t.Errorf("Expected a duplicate method handler to be rejected")
+	}
+	if err := listener.AddHandlerFor(http.MethodGet, "/legacy", func(w http.ResponseWriter, r *http.Request) {}); err == nil {
+		t.Errorf("Expected a method handler for a path with a handler for all methods to be rejected")
+	}
+	if err := listener.AddHandler("/test", func(w http.ResponseWriter, r *http.Request) {}); err == nil {
+		t.Errorf("Expected a handler for all methods for a path with method handlers to be rejected")
+	}
+
+	if err := listener.Start(make(chan error, 1)); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+	defer listener.Stop()
+
+	// Method handlers can be added while the listener is active.
+	if err := listener.AddHandlerFor(http.MethodDelete, "/test", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("delete")) }); err != nil {
+		t.Fatalf("Failed to add DELETE handler: %v", err)
+	}
+
+	address := "http://" + listener.l.Addr().String()
+	for _, test := range []struct {
+		method string
+		path   string
+		status int
+		body   string
+		allow  string
+	}{
+		{http.MethodGet, "/test", http.StatusOK, "get", ""},
+		{http.MethodPost, "/test", http.StatusOK, "post", ""},
+		{http.MethodDelete, "/test", http.StatusOK, "delete", ""},
+		{http.MethodHead, "/test", http.StatusOK, "", ""},
+		{http.MethodPut, "/test", http.StatusMethodNotAllowed, "", "DELETE, GET, HEAD, OPTIONS, POST"},
+		{http.MethodOptions, "/test", http.StatusNoContent, "", "DELETE, GET, HEAD, OPTIONS, POST"},
+		{http.MethodPut, "/legacy", http.StatusOK, http.MethodPut, ""},
+	} {
+		req, _ := http.NewRequest(test.method, address+test.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status || resp.Header.Get("Allow") != test.allow {
+			t.Errorf("Unexpected response %v with Allow %q to %v %v",
+				resp.StatusCode, resp.Header.Get("Allow"), test.method, test.path)
+		}
+
+		if test.status == http.StatusOK && string(body) != test.body {
+			t.Errorf("Unexpected body %q for %v %v", body, test.method, test.path)
+		}
+
+		if test.status == http.StatusMethodNotAllowed {
+			var response ErrorResponse
+			if err := json.Unmarshal(body, &response); err != nil || response.Error.Code != ErrorCodeMethodNotAllowed {
+				t.Errorf("Unexpected error response %s", body)
+			}
+		}
+	}
+}
+
+// Tests that the service handlers serve the build version and aggregate the health checks.
+func TestListenerServiceHandlers(t *testing.T) {
+	u, _ := url.Parse("tcp://127.0.0.1:0")
+	listener, _ := NewListener(u)
+
+	if err := listener.AddHealthCheck("store", func() error { return nil }); err == nil {
+		t.Errorf("Expected adding a health check without service handlers to fail")
+	}
+
+	version := VersionInfo{Version: "v1.0.0", GitCommit: "abc123", APIVersions: []string{"v0.1", "v0.2"}}
+	if err := listener.EnableServiceHandlers(version); err != nil {
+		t.Fatalf("Failed to enable service handlers: %v", err)
+	}
+
+	var sourceErr error
+	var lock sync.Mutex
+	listener.AddHealthCheck("store", func() error { return nil })
+	listener.AddHealthCheck("ipam-source", func() error {
+		lock.Lock()
+		defer lock.Unlock()
+		return sourceErr
+	})
+	if err := listener.AddHealthCheck("store", func() error { return nil }); err == nil {
+		t.Errorf("Expected adding a duplicate health check to fail")
+	}
+
+	if err := listener.Start(make(chan error, 1)); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+	defer listener.Stop()
+
+	address := "http://" + listener.l.Addr().String()
+	get := func(path string, response interface{}) int {
+		resp, err := http.Get(address + path)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		json.NewDecoder(resp.Body).Decode(response)
+		return resp.StatusCode
+	}
+
+	var versionResp VersionInfo
+	if status := get(versionPath, &versionResp); status != http.StatusOK || !reflect.DeepEqual(versionResp, version) {
+		t.Errorf("Unexpected version response %v %+v", status, versionResp)
+	}
+
+	var healthResp HealthResponse
+	if status := get(healthPath, &healthResp); status != http.StatusOK || healthResp.Status != healthStatusOK {
+		t.Errorf("Unexpected health response %v %+v", status, healthResp)
+	}
+
+	lock.Lock()
+	sourceErr = errors.New("refresh failed")
+	lock.Unlock()
+
+	healthResp = HealthResponse{}
+	status := get(healthPath, &healthResp)
+	if status != http.StatusServiceUnavailable || !strings.Contains(healthResp.Status, "ipam-source") ||
+		healthResp.Checks["ipam-source"] != "refresh failed" || healthResp.Checks["store"] != healthStatusOK {
+		t.Errorf("Unexpected health response %v %+v", status, healthResp)
+	}
+
+	resp, err := http.Post(address+healthPath, jsonContentType, nil)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Unexpected status %v for POST %v", resp.StatusCode, healthPath)
+	}
+}
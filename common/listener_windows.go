@@ -0,0 +1,28 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"net"
+	"strings"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// listen creates the socket or named pipe of the listener.
+func (listener *Listener) listen() (net.Listener, error) {
+	if listener.protocol == npipeProtocol {
+		config := &winio.PipeConfig{SecurityDescriptor: listener.pipeSecurityDescriptor}
+		return winio.ListenPipe(getPipePath(listener.localAddress), config)
+	}
+
+	return net.Listen(listener.protocol, listener.localAddress)
+}
+
+// getPipePath returns the path of a named pipe from the address of a npipe URL, which like in
+// Docker spells the path with forward slashes, for example npipe:////./pipe/azure-vnet.
+func getPipePath(address string) string {
+	path := strings.Replace(address, "/", `\`, -1)
+	return `\\` + strings.TrimLeft(path, `\`)
+}
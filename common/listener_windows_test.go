@@ -0,0 +1,58 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// Tests that named pipe paths are derived from npipe URLs written like the ones of Docker.
+func TestGetPipePath(t *testing.T) {
+	for address, expected := range map[string]string{
+		"npipe:////./pipe/azure-vnet": `\\.\pipe\azure-vnet`,
+		"npipe://./pipe/azure-vnet":   `\\.\pipe\azure-vnet`,
+	} {
+		u, _ := url.Parse(address)
+		listener, _ := NewListener(u)
+		if path := getPipePath(listener.localAddress); path != expected {
+			t.Errorf("Address %v: expected pipe %v, got %v", address, expected, path)
+		}
+	}
+}
+
+// Tests that the listener serves requests on a named pipe and closes it when stopped.
+func TestListenerNamedPipe(t *testing.T) {
+	u, _ := url.Parse("npipe:////./pipe/acn-listener-test")
+	listener, _ := NewListener(u)
+	listener.AddHandler("/test", func(w http.ResponseWriter, r *http.Request) {
+		listener.Encode(w, map[string]string{"result": "ok"})
+	})
+
+	if err := listener.Start(make(chan error, 1)); err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return winio.DialPipe(`\\.\pipe\acn-listener-test`, nil)
+		},
+	}}
+
+	resp, err := client.Get("http://pipe/test")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	listener.Stop()
+
+	if _, err := winio.DialPipe(`\\.\pipe\acn-listener-test`, nil); err == nil {
+		t.Errorf("Expected the named pipe to be closed")
+	}
+}
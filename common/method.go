@@ -0,0 +1,98 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// methodHandler dispatches the requests for a path to the handlers registered for their method.
+type methodHandler struct {
+	handlers map[string]http.Handler
+	sync.RWMutex
+}
+
+// newMethodHandler creates a methodHandler without handlers.
+func newMethodHandler() *methodHandler {
+	return &methodHandler{
+		handlers: make(map[string]http.Handler),
+	}
+}
+
+// AddHandlerFor registers a protocol handler for requests with the given method. Requests with a
+// method that has no handler for the path are answered with status 405, and OPTIONS requests with
+// status 204, both with an Allow header listing the methods of the path. HEAD requests are served
+// by the GET handler if the path has no HEAD handler. It fails if the path already has a handler
+// for the method or a handler for all methods added with AddHandler.
+func (listener *Listener) AddHandlerFor(method string, path string, handler func(http.ResponseWriter, *http.Request)) error {
+	if method == "" {
+		return fmt.Errorf("Handler method cannot be empty")
+	}
+
+	methods := newMethodHandler()
+	r := listener.newRoute(methods.ServeHTTP, nil)
+	r.methods = methods
+
+	return listener.router.addMethod(path, strings.ToUpper(method), http.HandlerFunc(handler), r)
+}
+
+// add registers the handler of a method, failing if the method already has one.
+func (methods *methodHandler) add(path string, method string, handler http.Handler) error {
+	methods.Lock()
+	defer methods.Unlock()
+
+	if methods.handlers[method] != nil {
+		return fmt.Errorf("Handler for %v %v is already registered", method, path)
+	}
+
+	methods.handlers[method] = handler
+
+	return nil
+}
+
+// allow returns the value of the Allow header listing the methods with a handler.
+func (methods *methodHandler) allow() string {
+	allowed := []string{http.MethodOptions}
+	for method := range methods.handlers {
+		allowed = append(allowed, method)
+	}
+
+	if methods.handlers[http.MethodGet] != nil && methods.handlers[http.MethodHead] == nil {
+		allowed = append(allowed, http.MethodHead)
+	}
+
+	sort.Strings(allowed)
+
+	return strings.Join(allowed, ", ")
+}
+
+// ServeHTTP dispatches a request to the handler of its method.
+func (methods *methodHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	methods.RLock()
+	handler := methods.handlers[r.Method]
+	if handler == nil && r.Method == http.MethodHead {
+		handler = methods.handlers[http.MethodGet]
+	}
+	allow := methods.allow()
+	methods.RUnlock()
+
+	if handler != nil {
+		handler.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set("Allow", allow)
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	SendErrorWithCode(w, http.StatusMethodNotAllowed, ErrorCodeMethodNotAllowed,
+		fmt.Sprintf("Method %v is not allowed for %v", r.Method, r.URL.Path))
+}
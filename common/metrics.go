@@ -0,0 +1,235 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Path of the metrics handler.
+	metricsPath = "/metrics"
+
+	// Label of requests that do not match any registered handler.
+	unmatchedPathLabel = "unmatched"
+)
+
+var (
+	// Upper bounds in seconds of the buckets of the request duration histogram.
+	requestDurationBuckets = DefaultDurationBuckets
+
+	// Valid metric names and name prefixes.
+	metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+	// Escapes label values.
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// requestKey identifies the requests counted together.
+type requestKey struct {
+	path   string
+	status int
+}
+
+// durationHistogram is a histogram of request durations.
+type durationHistogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// listenerMetrics holds the metrics of the requests served by a listener.
+type listenerMetrics struct {
+	prefix    string
+	router    *router
+	requests  map[requestKey]uint64
+	durations map[string]*durationHistogram
+	inFlight  int64
+	panics    uint64
+	relistens uint64
+	sync.Mutex
+}
+
+// EnableMetrics makes the listener collect metrics of the requests it serves and serve them on
+// /metrics in the Prometheus text format, without authentication, along with the metrics of the
+// default registry. Metric names start with the given prefix, which tells apart the services scraped
+// on the same node. It must be called before Start.
+func (listener *Listener) EnableMetrics(prefix string) error {
+	if listener.active {
+		return fmt.Errorf("Metrics cannot be enabled on an active listener")
+	}
+
+	if !metricNameRegexp.MatchString(prefix) {
+		return fmt.Errorf("Invalid metrics prefix %v", prefix)
+	}
+
+	if listener.metrics != nil {
+		return fmt.Errorf("Metrics are already enabled")
+	}
+
+	metrics := &listenerMetrics{
+		prefix:    prefix,
+		router:    listener.router,
+		requests:  make(map[requestKey]uint64),
+		durations: make(map[string]*durationHistogram),
+	}
+
+	if err := listener.AddPublicHandler(metricsPath, readOnly(metrics.serve)); err != nil {
+		return err
+	}
+
+	listener.metrics = metrics
+
+	return nil
+}
+
+// instrument wraps a handler to update the metrics with each request it serves.
+func (metrics *listenerMetrics) instrument(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		// Label requests with the pattern of their handler rather than their path, so that
+		// clients cannot create an unbounded number of series.
+		_, path := metrics.router.match(r.URL.Path)
+		if path == "" {
+			path = unmatchedPathLabel
+		}
+
+		metrics.Lock()
+		metrics.inFlight++
+		metrics.Unlock()
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		metrics.record(path, recorder.status, time.Since(start))
+	})
+}
+
+// record updates the metrics with a completed request.
+func (metrics *listenerMetrics) record(path string, status int, duration time.Duration) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	metrics.inFlight--
+	metrics.requests[requestKey{path: path, status: status}]++
+
+	histogram := metrics.durations[path]
+	if histogram == nil {
+		histogram = &durationHistogram{buckets: make([]uint64, len(requestDurationBuckets))}
+		metrics.durations[path] = histogram
+	}
+
+	seconds := duration.Seconds()
+	for i, bound := range requestDurationBuckets {
+		if seconds <= bound {
+			histogram.buckets[i]++
+		}
+	}
+	histogram.count++
+	histogram.sum += seconds
+}
+
+// recordPanic updates the metrics with a panic recovered from a handler.
+func (metrics *listenerMetrics) recordPanic() {
+	metrics.Lock()
+	metrics.panics++
+	metrics.Unlock()
+}
+
+// recordRelisten updates the metrics with an attempt to listen again.
+func (metrics *listenerMetrics) recordRelisten() {
+	metrics.Lock()
+	metrics.relistens++
+	metrics.Unlock()
+}
+
+// serve handles requests for the metrics.
+func (metrics *listenerMetrics) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.write(w)
+}
+
+// write writes the metrics in the Prometheus text format.
+func (metrics *listenerMetrics) write(w io.Writer) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	name := metrics.prefix + "_http_requests_total"
+	fmt.Fprintf(w, "# HELP %s Number of HTTP requests served, by path and status code.\n", name)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+
+	keys := make([]requestKey, 0, len(metrics.requests))
+	for key := range metrics.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].path != keys[j].path {
+			return keys[i].path < keys[j].path
+		}
+		return keys[i].status < keys[j].status
+	})
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{path=\"%s\",code=\"%d\"} %d\n",
+			name, escapeLabelValue(key.path), key.status, metrics.requests[key])
+	}
+
+	name = metrics.prefix + "_http_request_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Duration of HTTP requests, by path.\n", name)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+
+	paths := make([]string, 0, len(metrics.durations))
+	for path := range metrics.durations {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		histogram := metrics.durations[path]
+		label := escapeLabelValue(path)
+
+		for i, bound := range requestDurationBuckets {
+			fmt.Fprintf(w, "%s_bucket{path=\"%s\",le=\"%s\"} %d\n",
+				name, label, strconv.FormatFloat(bound, 'g', -1, 64), histogram.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{path=\"%s\",le=\"+Inf\"} %d\n", name, label, histogram.count)
+		fmt.Fprintf(w, "%s_sum{path=\"%s\"} %s\n", name, label, strconv.FormatFloat(histogram.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{path=\"%s\"} %d\n", name, label, histogram.count)
+	}
+
+	name = metrics.prefix + "_http_requests_in_flight"
+	fmt.Fprintf(w, "# HELP %s Number of HTTP requests being served.\n", name)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+	fmt.Fprintf(w, "%s %d\n", name, metrics.inFlight)
+
+	name = metrics.prefix + "_http_handler_panics_total"
+	fmt.Fprintf(w, "# HELP %s Number of panics recovered from HTTP handlers.\n", name)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	fmt.Fprintf(w, "%s %d\n", name, metrics.panics)
+
+	name = metrics.prefix + "_listener_relisten_attempts_total"
+	fmt.Fprintf(w, "# HELP %s Number of attempts to listen again after serving stopped unexpectedly.\n", name)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	fmt.Fprintf(w, "%s %d\n", name, metrics.relistens)
+
+	DefaultMetricsRegistry.WriteText(w, metrics.prefix)
+}
+
+// escapeLabelValue escapes a label value for the Prometheus text format.
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
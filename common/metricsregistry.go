@@ -0,0 +1,291 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// DefaultDurationBuckets are the upper bounds in seconds of the buckets of duration histograms.
+	DefaultDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	// DefaultMetricsRegistry holds the metrics of the process. Listeners with metrics enabled serve
+	// them along with their request metrics.
+	DefaultMetricsRegistry = NewMetricsRegistry()
+)
+
+// metric is implemented by the metric types held by a registry.
+type metric interface {
+	// Writes the samples of the metric in the Prometheus text format.
+	write(w io.Writer, name string)
+
+	// Adds the samples of the metric to a snapshot.
+	snapshot(values map[string]float64, name string)
+}
+
+// registeredMetric is a metric with its description.
+type registeredMetric struct {
+	help   string
+	kind   string
+	metric metric
+}
+
+// MetricsRegistry holds named metrics.
+type MetricsRegistry struct {
+	metrics map[string]*registeredMetric
+	sync.Mutex
+}
+
+// NewMetricsRegistry creates a new metrics registry.
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{metrics: make(map[string]*registeredMetric)}
+}
+
+// register returns the metric registered with the given name, or registers the one created by
+// newMetric. It panics if the name is invalid or registered with another type, since both are
+// programming errors.
+func (registry *MetricsRegistry) register(name string, help string, kind string, newMetric func() metric) metric {
+	if !metricNameRegexp.MatchString(name) {
+		panic(fmt.Sprintf("Invalid metric name %v", name))
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	if m, ok := registry.metrics[name]; ok {
+		if m.kind != kind {
+			panic(fmt.Sprintf("Metric %v is already registered as a %v", name, m.kind))
+		}
+		return m.metric
+	}
+
+	m := &registeredMetric{help: help, kind: kind, metric: newMetric()}
+	registry.metrics[name] = m
+
+	return m.metric
+}
+
+// Counter returns the counter registered with the given name, registering it if necessary.
+func (registry *MetricsRegistry) Counter(name string, help string) *Counter {
+	return registry.register(name, help, "counter", func() metric { return &Counter{} }).(*Counter)
+}
+
+// Gauge returns the gauge registered with the given name, registering it if necessary.
+func (registry *MetricsRegistry) Gauge(name string, help string) *Gauge {
+	return registry.register(name, help, "gauge", func() metric { return &Gauge{} }).(*Gauge)
+}
+
+// Histogram returns the histogram registered with the given name, registering it with the given
+// bucket upper bounds if necessary.
+func (registry *MetricsRegistry) Histogram(name string, help string, buckets []float64) *Histogram {
+	return registry.register(name, help, "histogram", func() metric { return newHistogram(buckets) }).(*Histogram)
+}
+
+// sortedNames returns the names of the registered metrics in order.
+func (registry *MetricsRegistry) sortedNames() []string {
+	names := make([]string, 0, len(registry.metrics))
+	for name := range registry.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// WriteText writes the metrics in the Prometheus text format. Metric names start with the given
+// prefix, if any.
+func (registry *MetricsRegistry) WriteText(w io.Writer, prefix string) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	for _, name := range registry.sortedNames() {
+		m := registry.metrics[name]
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+
+		fmt.Fprintf(w, "# HELP %s %s\n", name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, m.kind)
+		m.metric.write(w, name)
+	}
+}
+
+// Snapshot returns the current value of each counter and gauge, and the count and sum of each
+// histogram, by name.
+func (registry *MetricsRegistry) Snapshot() map[string]float64 {
+	registry.Lock()
+	defer registry.Unlock()
+
+	values := make(map[string]float64, len(registry.metrics))
+	for name, m := range registry.metrics {
+		m.metric.snapshot(values, name)
+	}
+
+	return values
+}
+
+// NewCounter returns the counter with the given name in the default registry.
+func NewCounter(name string, help string) *Counter {
+	return DefaultMetricsRegistry.Counter(name, help)
+}
+
+// NewGauge returns the gauge with the given name in the default registry.
+func NewGauge(name string, help string) *Gauge {
+	return DefaultMetricsRegistry.Gauge(name, help)
+}
+
+// NewHistogram returns the histogram with the given name in the default registry.
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	return DefaultMetricsRegistry.Histogram(name, help, buckets)
+}
+
+// Counter is a metric that only increases.
+type Counter struct {
+	value uint64
+}
+
+// Inc increments the counter.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Add adds the given value to the counter.
+func (c *Counter) Add(delta uint64) {
+	atomic.AddUint64(&c.value, delta)
+}
+
+// Value returns the value of the counter.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %d\n", name, c.Value())
+}
+
+func (c *Counter) snapshot(values map[string]float64, name string) {
+	values[name] = float64(c.Value())
+}
+
+// Gauge is a metric that can increase and decrease.
+type Gauge struct {
+	bits uint64
+}
+
+// Set sets the value of the gauge.
+func (g *Gauge) Set(value float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(value))
+}
+
+// Add adds the given value, which may be negative, to the gauge.
+func (g *Gauge) Add(delta float64) {
+	addFloat64(&g.bits, delta)
+}
+
+// Inc increments the gauge.
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+// Dec decrements the gauge.
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+// Value returns the value of the gauge.
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+func (g *Gauge) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(g.Value()))
+}
+
+func (g *Gauge) snapshot(values map[string]float64, name string) {
+	values[name] = g.Value()
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	// Updated atomically, so kept first for 64-bit alignment on 32-bit platforms.
+	count   uint64
+	sumBits uint64
+	bounds  []float64
+	buckets []uint64
+}
+
+// newHistogram creates a histogram with the given bucket upper bounds.
+func newHistogram(bounds []float64) *Histogram {
+	bounds = append([]float64(nil), bounds...)
+	sort.Float64s(bounds)
+
+	return &Histogram{bounds: bounds, buckets: make([]uint64, len(bounds))}
+}
+
+// Observe adds an observation to the histogram.
+func (h *Histogram) Observe(value float64) {
+	for i, bound := range h.bounds {
+		if value <= bound {
+			atomic.AddUint64(&h.buckets[i], 1)
+		}
+	}
+
+	atomic.AddUint64(&h.count, 1)
+	addFloat64(&h.sumBits, value)
+}
+
+// ObserveDuration adds the duration since the given time, in seconds, to the histogram.
+func (h *Histogram) ObserveDuration(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+// Sum returns the sum of the observations.
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.sumBits))
+}
+
+func (h *Histogram) write(w io.Writer, name string) {
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), atomic.LoadUint64(&h.buckets[i]))
+	}
+
+	count := h.Count()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.Sum()))
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
+
+func (h *Histogram) snapshot(values map[string]float64, name string) {
+	values[name+"_count"] = float64(h.Count())
+	values[name+"_sum"] = h.Sum()
+}
+
+// addFloat64 atomically adds a value to a float64 stored as its bits.
+func addFloat64(bits *uint64, delta float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		updated := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(bits, old, updated) {
+			return
+		}
+	}
+}
+
+// formatFloat formats a sample value for the Prometheus text format.
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,84 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Tests that the registry updates metrics concurrently and writes them in the Prometheus text format.
+func TestMetricsRegistry(t *testing.T) {
+	registry := NewMetricsRegistry()
+	counter := registry.Counter("requests_total", "Number of requests.")
+	gauge := registry.Gauge("addresses_in_use", "Number of addresses in use.")
+	histogram := registry.Histogram("duration_seconds", "Duration of requests.", []float64{1, 0.1})
+
+	if registry.Counter("requests_total", "Number of requests.") != counter {
+		t.Errorf("Registering a counter again returned a different counter")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			counter.Inc()
+			gauge.Inc()
+			histogram.Observe(0.5)
+		}()
+	}
+	wg.Wait()
+
+	gauge.Add(-2.5)
+	histogram.Observe(0.05)
+
+	var buf bytes.Buffer
+	registry.WriteText(&buf, "azure_cns")
+	text := buf.String()
+
+	for _, line := range []string{
+		"# TYPE azure_cns_requests_total counter",
+		"azure_cns_requests_total 10",
+		"# TYPE azure_cns_addresses_in_use gauge",
+		"azure_cns_addresses_in_use 7.5",
+		"# TYPE azure_cns_duration_seconds histogram",
+		`azure_cns_duration_seconds_bucket{le="0.1"} 1`,
+		`azure_cns_duration_seconds_bucket{le="1"} 11`,
+		`azure_cns_duration_seconds_bucket{le="+Inf"} 11`,
+		"azure_cns_duration_seconds_sum 5.05",
+		"azure_cns_duration_seconds_count 11",
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("Expected metrics to contain %v, got:\n%s", line, text)
+		}
+	}
+
+	snapshot := registry.Snapshot()
+	if snapshot["requests_total"] != 10 || snapshot["addresses_in_use"] != 7.5 || snapshot["duration_seconds_count"] != 11 {
+		t.Errorf("Unexpected snapshot %v", snapshot)
+	}
+}
+
+// Tests that registering a metric with an invalid name or another type panics.
+func TestMetricsRegistryConflicts(t *testing.T) {
+	registry := NewMetricsRegistry()
+	registry.Counter("requests_total", "Number of requests.")
+
+	for _, register := range []func(){
+		func() { registry.Gauge("requests_total", "Number of requests.") },
+		func() { registry.Counter("requests-total", "Number of requests.") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected registration to panic")
+				}
+			}()
+			register()
+		}()
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+var (
+	// Errors returned for malformed network namespaces.
+	ErrNamespacePathInvalid        = NewError(ErrCodeInvalidArgument, "Network namespace path is invalid")
+	ErrNamespaceContainerIDInvalid = NewError(ErrCodeInvalidArgument, "Network namespace container ID is invalid")
+	ErrNamespaceNotSupported       = NewError(ErrCodeNotSupported, "Network namespace is not supported on this platform")
+)
+
+// Namespace identifies the network namespace of a container. On Linux it is the path of a network
+// namespace file. On Windows it is either the ID of an HNS namespace, or the ID of the container
+// owning the network of a workload container in the form "container:<id>".
+type Namespace struct {
+	path string
+}
+
+// NamespaceFromPath returns the network namespace with the given path, as passed by container runtimes.
+func NamespaceFromPath(path string) (*Namespace, error) {
+	if err := validateNamespacePath(path); err != nil {
+		return nil, err
+	}
+
+	return &Namespace{path: path}, nil
+}
+
+// NamespaceFromContainerID returns the network namespace of the container with the given ID.
+func NamespaceFromContainerID(containerID string) (*Namespace, error) {
+	path, err := namespacePathForContainer(containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Namespace{path: path}, nil
+}
+
+// Path returns the path of the namespace, or an empty string for a nil namespace.
+func (ns *Namespace) Path() string {
+	if ns == nil {
+		return ""
+	}
+
+	return ns.path
+}
+
+// String returns the path of the namespace.
+func (ns *Namespace) String() string {
+	return ns.Path()
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/Azure/azure-container-networking/netlink"
+
+	"golang.org/x/sys/unix"
+)
+
+// validateNamespacePath returns an error if the path is not a clean absolute path.
+func validateNamespacePath(path string) error {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path || strings.ContainsRune(path, 0) {
+		return fmt.Errorf("%w: %q", ErrNamespacePathInvalid, path)
+	}
+
+	return nil
+}
+
+// namespacePathForContainer fails since the network namespace of a container cannot be derived
+// from its ID on Linux.
+func namespacePathForContainer(containerID string) (string, error) {
+	return "", ErrNamespaceNotSupported
+}
+
+// Do runs fn on the caller thread inside the namespace, and returns the caller thread to its
+// previous namespace once fn returns. If the thread cannot be returned to its previous namespace,
+// it stays locked to the goroutine so that it is terminated when the goroutine exits.
+func (ns *Namespace) Do(fn func() error) error {
+	target, err := os.Open(ns.path)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	// The namespace of a thread is changed, so keep the goroutine on it until it is restored.
+	runtime.LockOSThread()
+
+	current, err := os.Open(fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), unix.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer current.Close()
+
+	if err = unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("Failed to enter namespace %v, err:%v", ns.path, err)
+	}
+
+	// Recycle the netlink socket for the new network namespace.
+	netlink.ResetSocket()
+
+	fnErr := fn()
+
+	if err = unix.Setns(int(current.Fd()), unix.CLONE_NEWNET); err != nil {
+		// The thread cannot be returned to the goroutine pool in a foreign namespace.
+		return fmt.Errorf("Failed to exit namespace %v, err:%v", ns.path, err)
+	}
+
+	netlink.ResetSocket()
+	runtime.UnlockOSThread()
+
+	return fnErr
+}
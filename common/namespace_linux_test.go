@@ -0,0 +1,31 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"errors"
+	"testing"
+)
+
+// Tests that only clean absolute namespace paths are accepted.
+func TestNamespaceFromPath(t *testing.T) {
+	ns, err := NamespaceFromPath("/var/run/netns/test")
+	if err != nil || ns.Path() != "/var/run/netns/test" {
+		t.Errorf("Unexpected namespace %v, err:%v", ns, err)
+	}
+
+	for _, path := range []string{"", "netns/test", "/var/run/netns/../test", "/var/run/netns/"} {
+		if _, err := NamespaceFromPath(path); !errors.Is(err, ErrNamespacePathInvalid) {
+			t.Errorf("Expected path %q to be invalid, err:%v", path, err)
+		}
+	}
+
+	if _, err := NamespaceFromContainerID("0123456789abcdef"); !errors.Is(err, ErrNamespaceNotSupported) {
+		t.Errorf("Expected container namespaces to be unsupported, err:%v", err)
+	}
+
+	if (*Namespace)(nil).Path() != "" {
+		t.Errorf("Expected a nil namespace to have an empty path")
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// Prefix of the namespaces of workload containers sharing the network of another container.
+	containerNamespacePrefix = "container:"
+)
+
+// validateNamespacePath returns an error if the path is empty or names a container with a
+// malformed ID.
+func validateNamespacePath(path string) error {
+	if path == "" {
+		return fmt.Errorf("%w: %q", ErrNamespacePathInvalid, path)
+	}
+
+	if strings.HasPrefix(path, containerNamespacePrefix) {
+		return validateNamespaceContainerID(strings.TrimPrefix(path, containerNamespacePrefix))
+	}
+
+	if strings.Contains(path, ":") {
+		return fmt.Errorf("%w: %q", ErrNamespacePathInvalid, path)
+	}
+
+	return nil
+}
+
+// validateNamespaceContainerID returns an error if the container ID is empty or contains separators.
+func validateNamespaceContainerID(containerID string) error {
+	if containerID == "" || strings.ContainsAny(containerID, ":/\\") {
+		return fmt.Errorf("%w: %q", ErrNamespaceContainerIDInvalid, containerID)
+	}
+
+	return nil
+}
+
+// namespacePathForContainer returns the namespace path naming the container with the given ID.
+func namespacePathForContainer(containerID string) (string, error) {
+	if err := validateNamespaceContainerID(containerID); err != nil {
+		return "", err
+	}
+
+	return containerNamespacePrefix + containerID, nil
+}
+
+// ContainerID returns the ID of the container owning the network of the namespace, or an empty
+// string if the namespace is not owned by a container.
+func (ns *Namespace) ContainerID() string {
+	if ns == nil || !strings.HasPrefix(ns.path, containerNamespacePrefix) {
+		return ""
+	}
+
+	return strings.TrimPrefix(ns.path, containerNamespacePrefix)
+}
@@ -0,0 +1,37 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"errors"
+	"testing"
+)
+
+// Tests that container namespaces are parsed and malformed ones are rejected.
+func TestNamespaceFromPath(t *testing.T) {
+	ns, err := NamespaceFromPath("container:0123456789abcdef")
+	if err != nil || ns.ContainerID() != "0123456789abcdef" {
+		t.Errorf("Unexpected namespace %v, err:%v", ns, err)
+	}
+
+	ns, err = NamespaceFromPath("a1b2c3d4-0000-0000-0000-000000000000")
+	if err != nil || ns.ContainerID() != "" {
+		t.Errorf("Unexpected namespace %v, err:%v", ns, err)
+	}
+
+	if _, err := NamespaceFromPath(""); !errors.Is(err, ErrNamespacePathInvalid) {
+		t.Errorf("Expected an empty path to be invalid, err:%v", err)
+	}
+
+	for _, path := range []string{"container:", "container:a:b", "container:a/b"} {
+		if _, err := NamespaceFromPath(path); !errors.Is(err, ErrNamespaceContainerIDInvalid) {
+			t.Errorf("Expected path %q to be invalid, err:%v", path, err)
+		}
+	}
+
+	ns, err = NamespaceFromContainerID("0123456789abcdef")
+	if err != nil || ns.Path() != "container:0123456789abcdef" {
+		t.Errorf("Unexpected namespace %v, err:%v", ns, err)
+	}
+}
@@ -35,12 +35,14 @@ type IpamApi interface {
 
 // Plugin common configuration.
 type PluginConfig struct {
-	Version  string
-	NetApi   NetApi
-	IpamApi  IpamApi
-	Listener *Listener
-	ErrChan  chan error
-	Store    store.KeyValueStore
+	Version    string
+	GitCommit  string
+	NetApi     NetApi
+	IpamApi    IpamApi
+	Listener   *Listener
+	ErrChan    chan error
+	Store      store.KeyValueStore
+	Interfaces *InterfaceInventory
 }
 
 // NewPlugin creates a new Plugin object.
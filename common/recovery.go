@@ -0,0 +1,45 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"net/http"
+	"runtime/debug"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+// recoverPanics wraps a handler to recover from panics in it, so that a failing handler does not
+// take the connection down with it. Panics are logged with their stack trace and answered with an
+// internal server error if the handler did not send a response yet.
+func (listener *Listener) recoverPanics(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, requestID: GetRequestID(r.Context())}
+
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+
+			// Handlers abort responses on purpose with this panic.
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			log.Printf("[Listener] %vPanic while serving %v %v: %v\n%s",
+				getRequestLogPrefix(recorder), r.Method, r.URL.Path, err, debug.Stack())
+
+			if listener.metrics != nil {
+				listener.metrics.recordPanic()
+			}
+
+			if recorder.status == 0 {
+				SendErrorWithCode(recorder, http.StatusInternalServerError, ErrorCodeInternalError, "Internal server error")
+			}
+		}()
+
+		handler.ServeHTTP(recorder, r)
+	})
+}
@@ -0,0 +1,184 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+const (
+	// Maximum time to wait between two attempts to listen again.
+	maxRelistenBackoff = time.Minute
+
+	// Interval between two checks that the unix socket of the listener still exists.
+	defaultSocketCheckInterval = 5 * time.Second
+)
+
+// relistenOptions configure how a listener listens again after it stopped serving unexpectedly.
+type relistenOptions struct {
+	retries       int
+	backoff       time.Duration
+	checkInterval time.Duration
+}
+
+// EnableRelisten makes the listener listen again when it stops serving unexpectedly, for example
+// because its unix socket was deleted, instead of reporting the error. Each time, it makes up to
+// retries attempts, waiting backoff before the first one and twice as long before each next one.
+// The error is reported once all attempts failed. It must be called before Start.
+func (listener *Listener) EnableRelisten(retries int, backoff time.Duration) error {
+	if listener.active {
+		return fmt.Errorf("Relisten cannot be configured on an active listener")
+	}
+
+	if retries <= 0 || backoff <= 0 {
+		return fmt.Errorf("Invalid relisten retries %v or backoff %v", retries, backoff)
+	}
+
+	listener.relisten = &relistenOptions{
+		retries:       retries,
+		backoff:       backoff,
+		checkInterval: defaultSocketCheckInterval,
+	}
+
+	return nil
+}
+
+// serve services requests on l until the listener is stopped. When serving stops unexpectedly, it
+// listens again if enabled and reports the error otherwise.
+func (listener *Listener) serve(server *http.Server, l net.Listener, errChan chan error, stop chan struct{}) {
+	for {
+		done := make(chan struct{})
+		if listener.relisten != nil && listener.socketInfo != nil {
+			go listener.watchSocket(l, listener.socketInfo, done, stop)
+		}
+
+		// Serving sets up HTTP/2 in the TLS configuration of the server, so the configuration
+		// of the listener tells whether to serve TLS.
+		var err error
+		if listener.tlsConfig != nil {
+			err = server.ServeTLS(l, "", "")
+		} else {
+			err = server.Serve(l)
+		}
+		close(done)
+
+		// Serving can fail before taking ownership of the listener socket.
+		l.Close()
+
+		// The server is closed on purpose when the listener is stopped.
+		if err == http.ErrServerClosed {
+			return
+		}
+
+		if listener.relisten == nil {
+			errChan <- &AddressError{Address: listener.localAddress, Err: err}
+			return
+		}
+
+		log.Printf("[Listener] Stopped serving on %s unexpectedly: %v", listener.localAddress, err)
+
+		l, err = listener.listenAgain(stop)
+		if err != nil {
+			errChan <- &AddressError{Address: listener.localAddress, Err: err}
+			return
+		}
+
+		if l == nil {
+			return
+		}
+	}
+}
+
+// listenAgain creates the listener socket again with exponential backoff. It returns
+// a nil listener if the listener is stopped meanwhile.
+func (listener *Listener) listenAgain(stop chan struct{}) (net.Listener, error) {
+	var err error
+	backoff := listener.relisten.backoff
+
+	for attempt := 1; attempt <= listener.relisten.retries; attempt++ {
+		select {
+		case <-stop:
+			return nil, nil
+		case <-time.After(backoff):
+		}
+
+		log.Printf("[Listener] Listening again on %s, attempt %v of %v.",
+			listener.localAddress, attempt, listener.relisten.retries)
+
+		if listener.metrics != nil {
+			listener.metrics.recordRelisten()
+		}
+
+		// Hold the lock so that the listener is not stopped while its socket is being created.
+		listener.lock.Lock()
+		select {
+		case <-stop:
+			listener.lock.Unlock()
+			return nil, nil
+		default:
+		}
+
+		var l net.Listener
+		l, err = listener.createListener()
+		if err == nil {
+			listener.l = l
+		}
+		listener.lock.Unlock()
+
+		if err == nil {
+			log.Printf("[Listener] Started listening again on %s.", listener.localAddress)
+			return l, nil
+		}
+
+		backoff *= 2
+		if backoff > maxRelistenBackoff {
+			backoff = maxRelistenBackoff
+		}
+	}
+
+	log.Printf("[Listener] Failed to listen again on %s, giving up: %v", listener.localAddress, err)
+
+	return nil, fmt.Errorf("Failed to listen again on %v after %v attempts: %v",
+		listener.localAddress, listener.relisten.retries, err)
+}
+
+// watchSocket closes l if its unix socket is deleted or replaced, so that the listener listens again.
+func (listener *Listener) watchSocket(l net.Listener, socket os.FileInfo, done chan struct{}, stop chan struct{}) {
+	ticker := time.NewTicker(listener.relisten.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(listener.localAddress)
+		if err == nil && os.SameFile(socket, info) {
+			continue
+		}
+
+		log.Printf("[Listener] Socket %s was deleted or replaced.", listener.localAddress)
+
+		// Do not delete whatever is now at the path of the socket.
+		if limit, ok := l.(*limitListener); ok {
+			l = limit.Listener
+		}
+		if unixListener, ok := l.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+
+		l.Close()
+		return
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+const (
+	// Header carrying the ID of a request, set by the caller or assigned by the listener.
+	RequestIDHeader = "X-Request-ID"
+
+	// Incoming request IDs longer than this are replaced, so that they cannot flood the logs.
+	maxRequestIDLength = 128
+)
+
+// requestIDKey is the key of the request ID in the context of a request.
+type requestIDKey struct{}
+
+// GetRequestID returns the ID assigned to a request by the request logging of the listener,
+// or an empty string if request logging is not enabled.
+func GetRequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder records the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	requestID string
+	status    int
+}
+
+// WriteHeader records the status code and writes it to the response.
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes the body of the response, with an implicit OK status if none was written.
+func (recorder *statusRecorder) Write(b []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+
+	return recorder.ResponseWriter.Write(b)
+}
+
+// logRequests wraps a handler to assign an ID to each request, honoring the ID set by the caller,
+// and to log each request with its status code and duration once it completes.
+func logRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get(RequestIDHeader)
+		if requestID == "" || len(requestID) > maxRequestIDLength {
+			requestID = newRequestID()
+		}
+
+		w.Header().Set(RequestIDHeader, requestID)
+		recorder := &statusRecorder{ResponseWriter: w, requestID: requestID}
+
+		handler.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, requestID)))
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		log.Printf("[Listener] Request %v %v %v from %v completed with status %v in %v.",
+			requestID, r.Method, r.URL.Path, r.RemoteAddr, recorder.status, time.Since(start))
+	})
+}
+
+// getResponseRequestID returns the ID of the request of a response, or an empty string if the request has no ID.
+func getResponseRequestID(w http.ResponseWriter) string {
+	if recorder, ok := w.(*statusRecorder); ok {
+		return recorder.requestID
+	}
+
+	return ""
+}
+
+// getRequestLogPrefix returns the prefix identifying the request of a response in log lines,
+// or an empty string if the request has no ID.
+func getRequestLogPrefix(w http.ResponseWriter) string {
+	if requestID := getResponseRequestID(w); requestID != "" {
+		return "Request " + requestID + ": "
+	}
+
+	return ""
+}
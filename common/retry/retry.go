@@ -0,0 +1,118 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package retry
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+const (
+	// Default growth factor of the backoff between attempts.
+	defaultMultiplier = 2
+)
+
+// Policy controls how an operation is retried.
+type Policy struct {
+	// Name of the operation in the logs.
+	Name string
+
+	// Maximum number of attempts, zero for no limit other than MaxElapsed.
+	MaxAttempts int
+
+	// Backoff before the second attempt, which grows by Multiplier up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+
+	// Fraction of each backoff that is randomized, between 0 and 1, so that clients failing
+	// together do not retry together.
+	Jitter float64
+
+	// Time after the first attempt past which no attempt is started, zero for no limit.
+	MaxElapsed time.Duration
+
+	// Returns whether an error is transient and worth retrying. All errors are retried if nil.
+	IsRetryable func(error) bool
+}
+
+// Waits for the given duration or until the context is done. Replaced by tests.
+var sleep = func(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Do calls fn until it succeeds, fails with an error that is not retryable, or the policy runs out
+// of attempts or time, and returns the error of the last attempt. It stops waiting between attempts
+// when the context is done.
+func Do(ctx context.Context, policy Policy, fn func() error) error {
+	start := time.Now()
+	backoff := policy.InitialBackoff
+
+	multiplier := policy.Multiplier
+	if multiplier <= 0 {
+		multiplier = defaultMultiplier
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			if attempt > 1 {
+				log.Printf("[retry] %v succeeded after %v attempts.", policy.Name, attempt)
+			}
+			return nil
+		}
+
+		if policy.IsRetryable != nil && !policy.IsRetryable(err) {
+			if attempt > 1 {
+				log.Printf("[retry] %v failed with permanent error after %v attempts, err:%v.", policy.Name, attempt, err)
+			}
+			return err
+		}
+
+		delay := jitter(backoff, policy.Jitter)
+		elapsed := time.Since(start)
+
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts ||
+			policy.MaxElapsed > 0 && elapsed+delay > policy.MaxElapsed {
+			log.Printf("[retry] %v failed after %v attempts in %v, err:%v.", policy.Name, attempt, elapsed, err)
+			return err
+		}
+
+		log.Printf("[retry] %v failed, attempt:%v backoff:%v err:%v.", policy.Name, attempt, delay, err)
+
+		if sleepErr := sleep(ctx, delay); sleepErr != nil {
+			log.Printf("[retry] %v stopped after %v attempts, err:%v.", policy.Name, attempt, sleepErr)
+			return err
+		}
+
+		backoff = time.Duration(float64(backoff) * multiplier)
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// jitter randomizes the given fraction of a backoff, keeping it centered on the backoff.
+func jitter(backoff time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 || backoff <= 0 {
+		return backoff
+	}
+
+	if fraction > 1 {
+		fraction = 1
+	}
+
+	return time.Duration(float64(backoff) * (1 + fraction*(2*rand.Float64()-1)))
+}
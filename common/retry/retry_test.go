@@ -0,0 +1,130 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var (
+	errTransient = errors.New("transient")
+	errPermanent = errors.New("permanent")
+)
+
+// Replaces sleep with a recorder of the requested backoffs and returns a function restoring it.
+func recordSleeps() (*[]time.Duration, func()) {
+	var sleeps []time.Duration
+	saved := sleep
+	sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return ctx.Err()
+	}
+	return &sleeps, func() { sleep = saved }
+}
+
+// Tests that Do retries with exponential backoff until the operation succeeds.
+func TestDoRetriesUntilSuccess(t *testing.T) {
+	sleeps, restore := recordSleeps()
+	defer restore()
+	attempts := 0
+
+	err := Do(context.Background(), Policy{
+		MaxAttempts:    5,
+		InitialBackoff: time.Second,
+		MaxBackoff:     3 * time.Second,
+	}, func() error {
+		attempts++
+		if attempts < 4 {
+			return errTransient
+		}
+		return nil
+	})
+
+	if err != nil || attempts != 4 {
+		t.Fatalf("Unexpected result after %v attempts, err:%v", attempts, err)
+	}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}
+	if len(*sleeps) != len(expected) {
+		t.Fatalf("Unexpected backoffs %v", *sleeps)
+	}
+	for i := range expected {
+		if (*sleeps)[i] != expected[i] {
+			t.Errorf("Unexpected backoffs %v, expected %v", *sleeps, expected)
+		}
+	}
+}
+
+// Tests that Do stops at the attempt limit and on errors that are not retryable.
+func TestDoStopsOnLimitsAndPermanentErrors(t *testing.T) {
+	_, restore := recordSleeps()
+	defer restore()
+	attempts := 0
+
+	err := Do(context.Background(), Policy{MaxAttempts: 3}, func() error {
+		attempts++
+		return errTransient
+	})
+	if err != errTransient || attempts != 3 {
+		t.Errorf("Expected three attempts, got %v, err:%v", attempts, err)
+	}
+
+	attempts = 0
+	err = Do(context.Background(), Policy{
+		MaxAttempts: 3,
+		IsRetryable: func(err error) bool { return err == errTransient },
+	}, func() error {
+		attempts++
+		return errPermanent
+	})
+	if err != errPermanent || attempts != 1 {
+		t.Errorf("Expected a single attempt, got %v, err:%v", attempts, err)
+	}
+
+	attempts = 0
+	err = Do(context.Background(), Policy{
+		InitialBackoff: time.Second,
+		MaxElapsed:     500 * time.Millisecond,
+	}, func() error {
+		attempts++
+		return errTransient
+	})
+	if err != errTransient || attempts != 1 {
+		t.Errorf("Expected the elapsed budget to stop retries, got %v attempts, err:%v", attempts, err)
+	}
+}
+
+// Tests that Do stops waiting once the context is done.
+func TestDoStopsWhenContextIsDone(t *testing.T) {
+	_, restore := recordSleeps()
+	defer restore()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts := 0
+
+	err := Do(ctx, Policy{MaxAttempts: 5}, func() error {
+		attempts++
+		return errTransient
+	})
+	if err != errTransient || attempts != 1 {
+		t.Errorf("Expected a single attempt, got %v, err:%v", attempts, err)
+	}
+}
+
+// Tests that jitter keeps backoffs within the randomized fraction.
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Second, 0.2)
+		if d < 800*time.Millisecond || d > 1200*time.Millisecond {
+			t.Fatalf("Backoff %v out of range", d)
+		}
+	}
+
+	if d := jitter(time.Second, 0); d != time.Second {
+		t.Errorf("Unexpected backoff %v without jitter", d)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// route is a handler registered on the listener, wrapped by the middlewares of the listener once it starts.
+// Public routes are served without authentication. The handler of routes with methods dispatches
+// requests to the handlers of their method.
+type route struct {
+	handler http.Handler
+	chain   http.Handler
+	public  bool
+	methods *methodHandler
+}
+
+// router routes requests to the handlers registered on the listener. Like http.ServeMux, a path
+// ending in a slash matches the whole subtree under it and the longest matching path wins. Unlike
+// it, handlers can be removed and replaced while requests are served.
+type router struct {
+	routes map[string]*route
+	sync.RWMutex
+}
+
+// newRouter creates a new router.
+func newRouter() *router {
+	return &router{
+		routes: make(map[string]*route),
+	}
+}
+
+// add registers a route for a path, failing if the path already has one.
+func (router *router) add(path string, r *route) error {
+	if path == "" {
+		return fmt.Errorf("Handler path cannot be empty")
+	}
+
+	router.Lock()
+	defer router.Unlock()
+
+	if router.routes[path] != nil {
+		return fmt.Errorf("Handler for path %v is already registered", path)
+	}
+
+	router.routes[path] = r
+
+	return nil
+}
+
+// addMethod registers the handler of a method for a path, adding the given route with methods if
+// the path has no route. It fails if the path has a route for all methods or a handler for the method.
+func (router *router) addMethod(path string, method string, handler http.Handler, r *route) error {
+	if path == "" {
+		return fmt.Errorf("Handler path cannot be empty")
+	}
+
+	router.Lock()
+	defer router.Unlock()
+
+	existing := router.routes[path]
+	if existing == nil {
+		router.routes[path] = r
+		existing = r
+	} else if existing.methods == nil {
+		return fmt.Errorf("Handler for path %v is already registered for all methods", path)
+	}
+
+	return existing.methods.add(path, method, handler)
+}
+
+// replace registers a route for a path, replacing any existing one.
+func (router *router) replace(path string, r *route) error {
+	if path == "" {
+		return fmt.Errorf("Handler path cannot be empty")
+	}
+
+	router.Lock()
+	router.routes[path] = r
+	router.Unlock()
+
+	return nil
+}
+
+// remove removes the route of a path, failing if the path has none.
+func (router *router) remove(path string) error {
+	router.Lock()
+	defer router.Unlock()
+
+	if router.routes[path] == nil {
+		return fmt.Errorf("Handler for path %v is not registered", path)
+	}
+
+	delete(router.routes, path)
+
+	return nil
+}
+
+// wrap rebuilds the handler chains of all routes with the given function.
+func (router *router) wrap(apply func(*route) http.Handler) {
+	router.Lock()
+	defer router.Unlock()
+
+	for _, r := range router.routes {
+		r.chain = apply(r)
+	}
+}
+
+// match returns the handler chain and the registered path matching a request path,
+// or a nil handler if no route matches.
+func (router *router) match(path string) (http.Handler, string) {
+	router.RLock()
+	defer router.RUnlock()
+
+	if r := router.routes[path]; r != nil {
+		return r.chain, path
+	}
+
+	var pattern string
+	var chain http.Handler
+	for p, r := range router.routes {
+		if strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) && len(p) > len(pattern) {
+			pattern = p
+			chain = r.chain
+		}
+	}
+
+	return chain, pattern
+}
+
+// ServeHTTP routes a request to the handler of its path.
+func (router *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler, _ := router.match(r.URL.Path)
+	if handler == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	handler.ServeHTTP(w, r)
+}
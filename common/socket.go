@@ -0,0 +1,92 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package common
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+const (
+	// Time to wait for a connection when checking whether a unix socket is still served.
+	staleSocketDialTimeout = time.Second
+)
+
+// socketOptions are the permissions and ownership of the unix socket of a listener.
+// Negative IDs leave the owner or group unchanged and a zero mode leaves the permissions unchanged.
+type socketOptions struct {
+	mode os.FileMode
+	uid  int
+	gid  int
+}
+
+// SetSocketMode sets the permissions of the unix socket of the listener. It must be called before Start.
+func (listener *Listener) SetSocketMode(mode os.FileMode) {
+	listener.socket.mode = mode
+}
+
+// SetSocketOwner sets the owner and group of the unix socket of the listener. Negative IDs leave the
+// owner or group unchanged. It must be called before Start.
+func (listener *Listener) SetSocketOwner(uid int, gid int) {
+	listener.socket.uid = uid
+	listener.socket.gid = gid
+}
+
+// SetSocketGroup sets the group of the unix socket of the listener by name. It must be called before Start.
+func (listener *Listener) SetSocketGroup(name string) error {
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return err
+	}
+
+	gid, err := strconv.Atoi(group.Gid)
+	if err != nil {
+		return fmt.Errorf("Group %v has non-numeric ID %v", name, group.Gid)
+	}
+
+	listener.socket.gid = gid
+
+	return nil
+}
+
+// removeStaleSocket removes the unix socket left behind by a listener that did not stop cleanly,
+// so that listening on it does not fail. Sockets that are still served and files that are not
+// sockets are left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+
+	if conn, err := net.DialTimeout("unix", path, staleSocketDialTimeout); err == nil {
+		conn.Close()
+		return fmt.Errorf("Socket %v is in use by another process", path)
+	}
+
+	log.Printf("[Listener] Removing stale socket %v.", path)
+	return os.Remove(path)
+}
+
+// applySocketOptions sets the permissions and ownership of the unix socket of the listener.
+func (listener *Listener) applySocketOptions() error {
+	if listener.socket.mode != 0 {
+		if err := os.Chmod(listener.localAddress, listener.socket.mode); err != nil {
+			return err
+		}
+	}
+
+	if listener.socket.uid >= 0 || listener.socket.gid >= 0 {
+		if err := os.Chown(listener.localAddress, listener.socket.uid, listener.socket.gid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -82,9 +82,14 @@ func SetVepaMode(bridgeName string, downstreamIfNamePrefix string, upstreamMacAd
 
 // SetDnatForIPAddress sets a MAC DNAT rule for an IP address.
 func SetDnatForIPAddress(interfaceName string, ipAddress net.IP, macAddress net.HardwareAddr, action string) error {
+	protocol, dstOption := "IPv4", "--ip-dst"
+	if ipAddress.To4() == nil {
+		protocol, dstOption = "IPv6", "--ip6-dst"
+	}
+
 	command := fmt.Sprintf(
-		"ebtables -t nat %s PREROUTING -p IPv4 -i %s --ip-dst %s -j dnat --to-dst %s --dnat-target ACCEPT",
-		action, interfaceName, ipAddress.String(), macAddress.String())
+		"ebtables -t nat %s PREROUTING -p %s -i %s %s %s -j dnat --to-dst %s --dnat-target ACCEPT",
+		action, protocol, interfaceName, dstOption, ipAddress.String(), macAddress.String())
 
 	return executeShellCommand(command)
 }
@@ -0,0 +1,86 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ethtool
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Ethtool commands, see linux/ethtool.h.
+	ethtoolGetTxCsum = 0x00000016
+	ethtoolSetTxCsum = 0x00000017
+
+	// Maximum length of an interface name, including the terminating null.
+	ifNameSize = 16
+)
+
+var (
+	// ErrNotSupported is returned when the interface does not support the requested operation.
+	ErrNotSupported = fmt.Errorf("Operation not supported by interface")
+)
+
+// ethtoolValue is the generic ethtool_value structure.
+type ethtoolValue struct {
+	cmd  uint32
+	data uint32
+}
+
+// ifreq is the interface request structure passed to SIOCETHTOOL.
+type ifreq struct {
+	name [ifNameSize]byte
+	data unsafe.Pointer
+}
+
+// GetTxChecksumOffload returns whether TX checksum offload is enabled on an interface.
+func GetTxChecksumOffload(ifName string) (bool, error) {
+	value := ethtoolValue{cmd: ethtoolGetTxCsum}
+	if err := ioctl(ifName, &value); err != nil {
+		return false, err
+	}
+
+	return value.data != 0, nil
+}
+
+// SetTxChecksumOffload enables or disables TX checksum offload on an interface,
+// the equivalent of "ethtool -K <ifName> tx on|off".
+func SetTxChecksumOffload(ifName string, on bool) error {
+	value := ethtoolValue{cmd: ethtoolSetTxCsum}
+	if on {
+		value.data = 1
+	}
+
+	return ioctl(ifName, &value)
+}
+
+// ioctl sends an ethtool request for an interface.
+func ioctl(ifName string, value *ethtoolValue) error {
+	if len(ifName) >= ifNameSize {
+		return fmt.Errorf("Invalid interface name %v", ifName)
+	}
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	var req ifreq
+	copy(req.name[:], ifName)
+	req.data = unsafe.Pointer(value)
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(unix.SIOCETHTOOL), uintptr(unsafe.Pointer(&req)))
+	if errno == unix.EOPNOTSUPP {
+		return ErrNotSupported
+	}
+
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ethtool
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/Azure/azure-container-networking/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	vethName     = "ethtooltest"
+	vethPeerName = "ethtooltest2"
+)
+
+// withTestNamespace runs a test function inside a new, empty network namespace
+// and returns the calling thread to its original namespace afterwards.
+func withTestNamespace(t *testing.T, test func()) {
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origNs, err := os.Open(fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), unix.Gettid()))
+	if err != nil {
+		t.Fatalf("Failed to open current netns: %v", err)
+	}
+	defer origNs.Close()
+
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("Failed to create test netns: %v", err)
+	}
+	netlink.ResetSocket()
+
+	defer func() {
+		if err := unix.Setns(int(origNs.Fd()), unix.CLONE_NEWNET); err != nil {
+			t.Fatalf("Failed to restore netns: %v", err)
+		}
+		netlink.ResetSocket()
+	}()
+
+	test()
+}
+
+// TestSetTxChecksumOffload tests disabling and enabling TX checksum offload on a veth interface.
+func TestSetTxChecksumOffload(t *testing.T) {
+	withTestNamespace(t, func() {
+		link := netlink.VEthLink{
+			LinkInfo: netlink.LinkInfo{
+				Type: netlink.LINK_TYPE_VETH,
+				Name: vethName,
+			},
+			PeerName: vethPeerName,
+		}
+
+		if err := netlink.AddLink(&link); err != nil {
+			t.Fatalf("AddLink failed: %v", err)
+		}
+
+		if err := SetTxChecksumOffload(vethPeerName, false); err != nil {
+			t.Fatalf("SetTxChecksumOffload failed: %v", err)
+		}
+
+		on, err := GetTxChecksumOffload(vethPeerName)
+		if err != nil {
+			t.Fatalf("GetTxChecksumOffload failed: %v", err)
+		}
+
+		if on {
+			t.Errorf("TX checksum offload is still enabled")
+		}
+
+		if err := SetTxChecksumOffload(vethPeerName, true); err != nil {
+			t.Fatalf("SetTxChecksumOffload failed: %v", err)
+		}
+
+		on, err = GetTxChecksumOffload(vethPeerName)
+		if err != nil {
+			t.Fatalf("GetTxChecksumOffload failed: %v", err)
+		}
+
+		if !on {
+			t.Errorf("TX checksum offload is not enabled")
+		}
+	})
+}
+
+// TestSetTxChecksumOffloadInvalidInterface tests that requests for missing interfaces fail.
+func TestSetTxChecksumOffloadInvalidInterface(t *testing.T) {
+	withTestNamespace(t, func() {
+		if err := SetTxChecksumOffload("ethtoolmissing", false); err == nil {
+			t.Errorf("SetTxChecksumOffload succeeded for a missing interface")
+		}
+	})
+}
@@ -4,30 +4,44 @@
 package ipam
 
 import (
-	"fmt"
+	"github.com/Azure/azure-container-networking/common"
 )
 
 var (
 	// Error responses returned by AddressManager.
-	errInvalidAddressSpace     = fmt.Errorf("Invalid address space")
-	errInvalidPoolId           = fmt.Errorf("Invalid address pool")
-	errInvalidAddress          = fmt.Errorf("Invalid address")
-	errInvalidScope            = fmt.Errorf("Invalid scope")
-	errInvalidConfiguration    = fmt.Errorf("Invalid configuration")
-	errAddressPoolExists       = fmt.Errorf("Address pool already exists")
-	errAddressPoolNotFound     = fmt.Errorf("Address pool not found")
-	errAddressPoolInUse        = fmt.Errorf("Address pool already in use")
-	errAddressPoolNotInUse     = fmt.Errorf("Address pool not in use")
-	errNoAvailableAddressPools = fmt.Errorf("No available address pools")
-	errAddressExists           = fmt.Errorf("Address already exists")
-	errAddressNotFound         = fmt.Errorf("Address not found")
-	errAddressInUse            = fmt.Errorf("Address already in use")
-	errAddressNotInUse         = fmt.Errorf("Address not in use")
-	errNoAvailableAddresses    = fmt.Errorf("No available addresses")
+	errInvalidAddressSpace     = common.NewError(common.ErrCodeInvalidArgument, "Invalid address space")
+	errInvalidPoolId           = common.NewError(common.ErrCodeInvalidArgument, "Invalid address pool")
+	errInvalidAddress          = common.NewError(common.ErrCodeInvalidArgument, "Invalid address")
+	errInvalidScope            = common.NewError(common.ErrCodeInvalidArgument, "Invalid scope")
+	errInvalidConfiguration    = common.NewError(common.ErrCodeInvalidConfig, "Invalid configuration")
+	errAddressPoolExists       = common.NewError(common.ErrCodeInvalidArgument, "Address pool already exists")
+	errAddressPoolNotFound     = common.NewError(common.ErrCodeAddressPoolNotFound, "Address pool not found")
+	errAddressPoolInUse        = common.NewError(common.ErrCodeInvalidArgument, "Address pool already in use")
+	errAddressPoolNotInUse     = common.NewError(common.ErrCodeInvalidArgument, "Address pool not in use")
+	errNoAvailableAddressPools = common.NewError(common.ErrCodeAddressPoolExhausted, "No available address pools")
+	errAddressExists           = common.NewError(common.ErrCodeInvalidArgument, "Address already exists")
+	errAddressNotFound         = common.NewError(common.ErrCodeAddressNotFound, "Address not found")
+	errAddressInUse            = common.NewError(common.ErrCodeAddressInUse, "Address already in use")
+	errAddressIDInUse          = common.NewError(common.ErrCodeAddressInUse, "Address ID already holds another address")
+	errAddressOutOfRange       = common.NewError(common.ErrCodeInvalidArgument, "Address is outside of the pool subnet")
+	errAddressNotInUse         = common.NewError(common.ErrCodeInvalidArgument, "Address not in use")
+	errNoAvailableAddresses    = common.NewError(common.ErrCodeAddressPoolExhausted, "No available addresses")
+	errAddressFamilyMismatch   = common.NewError(common.ErrCodeInvalidArgument, "Address family does not match the pool")
+	errInvalidReservation      = common.NewError(common.ErrCodeInvalidArgument, "Invalid address reservation")
+	errReservationNotFound     = common.NewError(common.ErrCodeAddressNotFound, "Address reservation not found or expired")
+	errInvalidAddressOwner     = common.NewError(common.ErrCodeInvalidArgument, "Invalid address owner")
 
 	// Options used by AddressManager.
 	OptInterfaceName      = "azure.interface.name"
 	OptAddressID          = "azure.address.id"
 	OptAddressType        = "azure.address.type"
 	OptAddressTypeGateway = "gateway"
+	OptAddressFamily      = "azure.address.family"
+	OptStaticAddress      = "azure.address.static"
+	OptAddressOwner       = "azure.address.owner"
+
+	// Address families accepted by OptAddressFamily.
+	OptAddressFamilyIPv4 = "ipv4"
+	OptAddressFamilyIPv6 = "ipv6"
+	OptAddressFamilyBoth = "both"
 )
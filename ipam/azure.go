@@ -4,13 +4,14 @@
 package ipam
 
 import (
+	"context"
 	"encoding/xml"
 	"net"
-	"net/http"
 	"strings"
 	"time"
 
 	"github.com/Azure/azure-container-networking/common"
+	"github.com/Azure/azure-container-networking/common/retry"
 	"github.com/Azure/azure-container-networking/log"
 )
 
@@ -20,6 +21,14 @@ const (
 
 	// Minimum time interval between consecutive queries.
 	azureQueryInterval = 10 * time.Second
+
+	// Retry policy of queries that fail with transient errors. The budget is kept short since
+	// queries are made while requests wait for the address manager.
+	azureQueryRetryAttempts       = 3
+	azureQueryRetryInitialBackoff = 500 * time.Millisecond
+	azureQueryRetryMaxBackoff     = 2 * time.Second
+	azureQueryRetryMaxElapsed     = 5 * time.Second
+	azureQueryRetryJitter         = 0.2
 )
 
 // Microsoft Azure IPAM configuration source.
@@ -29,10 +38,13 @@ type azureSource struct {
 	queryUrl      string
 	queryInterval time.Duration
 	lastRefresh   time.Time
+	interfaces    *common.InterfaceInventory
+	generation    uint64
+	client        *common.HostClient
 }
 
 // Creates the Azure source.
-func newAzureSource(options map[string]interface{}) (*azureSource, error) {
+func newAzureSource(options map[string]interface{}, interfaces *common.InterfaceInventory) (*azureSource, error) {
 	queryUrl, _ := options[common.OptIpamQueryUrl].(string)
 	if queryUrl == "" {
 		queryUrl = azureQueryUrl
@@ -48,6 +60,17 @@ func newAzureSource(options map[string]interface{}) (*azureSource, error) {
 		name:          "Azure",
 		queryUrl:      queryUrl,
 		queryInterval: queryInterval,
+		interfaces:    interfaces,
+		client: common.NewHostClient(common.HostClientConfig{
+			Name: "Azure IPAM query",
+			Retry: retry.Policy{
+				MaxAttempts:    azureQueryRetryAttempts,
+				InitialBackoff: azureQueryRetryInitialBackoff,
+				MaxBackoff:     azureQueryRetryMaxBackoff,
+				MaxElapsed:     azureQueryRetryMaxElapsed,
+				Jitter:         azureQueryRetryJitter,
+			},
+		}),
 	}, nil
 }
 
@@ -63,20 +86,36 @@ func (s *azureSource) stop() {
 	return
 }
 
+// Queries the interface configuration from the host, retrying transient failures.
+func (s *azureSource) query() (*common.XmlDocument, error) {
+	data, err := s.client.Get(context.Background(), s.queryUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decode XML document.
+	var doc common.XmlDocument
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	return &doc, nil
+}
+
 // Refreshes configuration.
 func (s *azureSource) refresh() error {
+	// Load the list of local interfaces.
+	if _, err := s.interfaces.Interfaces(); err != nil {
+		return err
+	}
 
-	// Refresh only if enough time has passed since the last query.
-	if time.Since(s.lastRefresh) < s.queryInterval {
+	// Refresh only if enough time has passed since the last query, or if the local interfaces changed.
+	generation := s.interfaces.Generation()
+	if time.Since(s.lastRefresh) < s.queryInterval && generation == s.generation {
 		return nil
 	}
 	s.lastRefresh = time.Now()
-
-	// Query the list of local interfaces.
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		return err
-	}
+	s.generation = generation
 
 	// Configure the local default address space.
 	local, err := s.sink.newAddressSpace(LocalDefaultAddressSpaceId, LocalScope)
@@ -85,17 +124,7 @@ func (s *azureSource) refresh() error {
 	}
 
 	// Fetch configuration.
-	resp, err := http.Get(s.queryUrl)
-	if err != nil {
-		return err
-	}
-
-	defer resp.Body.Close()
-
-	// Decode XML document.
-	var doc common.XmlDocument
-	decoder := xml.NewDecoder(resp.Body)
-	err = decoder.Decode(&doc)
+	doc, err := s.query()
 	if err != nil {
 		return err
 	}
@@ -107,17 +136,21 @@ func (s *azureSource) refresh() error {
 		i.MacAddress = strings.ToLower(i.MacAddress)
 
 		// Find the interface with the matching MacAddress.
-		for _, iface := range interfaces {
+		iface, err := s.interfaces.FindInterface(func(iface *common.InterfaceInfo) bool {
 			macAddr := strings.Replace(iface.HardwareAddr.String(), ":", "", -1)
 			macAddr = strings.ToLower(macAddr)
-			if macAddr == i.MacAddress || i.MacAddress == "*" {
-				ifName = iface.Name
+			return macAddr == i.MacAddress || i.MacAddress == "*"
+		})
+		if err != nil {
+			return err
+		}
 
-				// Prioritize secondary interfaces.
-				if !i.IsPrimary {
-					priority = 1
-				}
-				break
+		if iface != nil {
+			ifName = iface.Name
+
+			// Prioritize secondary interfaces.
+			if !i.IsPrimary {
+				priority = 1
 			}
 		}
 
@@ -4,6 +4,7 @@
 package ipam
 
 import (
+	"fmt"
 	"sync"
 	"time"
 
@@ -25,7 +26,11 @@ type addressManager struct {
 	AddrSpaces map[string]*addressSpace `json:"AddressSpaces"`
 	store      store.KeyValueStore
 	source     addressConfigSource
+	sourceErr  error
+	interfaces *common.InterfaceInventory
 	netApi     common.NetApi
+	sweepStop  chan struct{}
+	sweepDone  chan struct{}
 	sync.Mutex
 }
 
@@ -36,15 +41,22 @@ type AddressManager interface {
 
 	StartSource(options map[string]interface{}) error
 	StopSource()
+	CheckSource() error
 
 	GetDefaultAddressSpaces() (string, string)
 
 	RequestPool(asId, poolId, subPoolId string, options map[string]string, v6 bool) (string, string, error)
 	ReleasePool(asId, poolId string) error
 	GetPoolInfo(asId, poolId string) (*AddressPoolInfo, error)
+	GetPoolUsage(asId, poolId string) (*AddressPoolUsage, error)
 
 	RequestAddress(asId, poolId, address string, options map[string]string) (string, error)
 	ReleaseAddress(asId, poolId, address string, options map[string]string) error
+	ReleaseAddressesByOwner(asId, poolId, ownerId string) ([]string, error)
+	ReconcileAddresses(asId string, inUse []string, options ReconcileOptions) (*ReconcileSummary, error)
+
+	ReserveAddress(asId, poolId, requestorId string, ttl time.Duration) (string, string, error)
+	CommitReservation(token string) (string, error)
 }
 
 // AddressConfigSource configures the address pools managed by AddressManager.
@@ -74,6 +86,10 @@ func (am *addressManager) Initialize(config *common.PluginConfig, options map[st
 	am.Version = config.Version
 	am.store = config.Store
 	am.netApi = config.NetApi
+	am.interfaces = config.Interfaces
+	if am.interfaces == nil {
+		am.interfaces = common.NewInterfaceInventory()
+	}
 
 	// Restore persisted state.
 	err := am.restore()
@@ -83,12 +99,19 @@ func (am *addressManager) Initialize(config *common.PluginConfig, options map[st
 
 	// Start source.
 	err = am.StartSource(options)
+	if err != nil {
+		return err
+	}
 
-	return err
+	// Expire uncommitted reservations in the background.
+	am.startSweeper(reservationSweepInterval)
+
+	return nil
 }
 
 // Uninitialize cleans up address manager.
 func (am *addressManager) Uninitialize() {
+	am.stopSweeper()
 	am.StopSource()
 }
 
@@ -131,11 +154,17 @@ func (am *addressManager) restore() error {
 		for _, ap := range as.Pools {
 			ap.as = as
 			ap.addrsByID = make(map[string]*addressRecord)
+			ap.IsIPv6 = (ap.Subnet.IP.To4() == nil)
 
 			for _, ar := range ap.Addresses {
 				if ar.ID != "" {
 					ap.addrsByID[ar.ID] = ar
 				}
+
+				// Addresses allocated before owners were recorded are owned by their ID.
+				if ar.InUse && ar.Owner == "" {
+					ar.Owner = ar.ID
+				}
 			}
 		}
 	}
@@ -149,11 +178,17 @@ func (am *addressManager) restore() error {
 
 				for _, ar := range ap.Addresses {
 					ar.InUse = false
+					ar.Reservation = nil
 				}
 			}
 		}
 	}
 
+	// Reservations that expired while stopped are not restored.
+	am.expireReservations(time.Now())
+
+	am.updateMetrics()
+
 	log.Printf("[ipam] Restored state, %+v\n", am)
 
 	return nil
@@ -186,7 +221,7 @@ func (am *addressManager) StartSource(options map[string]interface{}) error {
 
 	switch environment {
 	case common.OptEnvironmentAzure:
-		am.source, err = newAzureSource(options)
+		am.source, err = newAzureSource(options, am.interfaces)
 
 	case common.OptEnvironmentMAS:
 		am.source, err = newMasSource(options)
@@ -229,9 +264,23 @@ func (am *addressManager) refreshSource() {
 		if err != nil {
 			log.Printf("[ipam] Source refresh failed, err:%v.\n", err)
 		}
+		am.sourceErr = err
+		am.updateMetrics()
 	}
 }
 
+// CheckSource returns the error of the last refresh of the configuration source, if it failed.
+func (am *addressManager) CheckSource() error {
+	am.Lock()
+	defer am.Unlock()
+
+	if am.sourceErr != nil {
+		return fmt.Errorf("Last source refresh failed: %v", am.sourceErr)
+	}
+
+	return nil
+}
+
 //
 // AddressManager API
 //
@@ -328,6 +377,24 @@ func (am *addressManager) GetPoolInfo(asId string, poolId string) (*AddressPoolI
 	return ap.getInfo(), nil
 }
 
+// GetPoolUsage returns the utilization of the given address pool.
+func (am *addressManager) GetPoolUsage(asId string, poolId string) (*AddressPoolUsage, error) {
+	am.Lock()
+	defer am.Unlock()
+
+	as, err := am.getAddressSpace(asId)
+	if err != nil {
+		return nil, err
+	}
+
+	ap, err := as.getAddressPool(poolId)
+	if err != nil {
+		return nil, err
+	}
+
+	return ap.getUsage(), nil
+}
+
 // RequestAddress reserves a new address from the address pool.
 func (am *addressManager) RequestAddress(asId, poolId, address string, options map[string]string) (string, error) {
 	am.Lock()
@@ -345,11 +412,16 @@ func (am *addressManager) RequestAddress(asId, poolId, address string, options m
 		return "", err
 	}
 
+	addressRequests.Inc()
+
 	addr, err := ap.requestAddress(address, options)
 	if err != nil {
+		addressRequestFailures.Inc()
 		return "", err
 	}
 
+	am.updateMetrics()
+
 	err = am.save()
 	if err != nil {
 		return "", err
@@ -380,6 +452,9 @@ func (am *addressManager) ReleaseAddress(asId string, poolId string, address str
 		return err
 	}
 
+	addressReleases.Inc()
+	am.updateMetrics()
+
 	err = am.save()
 	if err != nil {
 		return err
@@ -387,3 +462,43 @@ func (am *addressManager) ReleaseAddress(asId string, poolId string, address str
 
 	return nil
 }
+
+// ReleaseAddressesByOwner releases all addresses of the address pool held by the given owner, and
+// returns the released addresses. Releasing the addresses of an owner holding none is not an error.
+func (am *addressManager) ReleaseAddressesByOwner(asId string, poolId string, ownerId string) ([]string, error) {
+	am.Lock()
+	defer am.Unlock()
+
+	if ownerId == "" {
+		return nil, errInvalidAddressOwner
+	}
+
+	am.refreshSource()
+
+	as, err := am.getAddressSpace(asId)
+	if err != nil {
+		return nil, err
+	}
+
+	ap, err := as.getAddressPool(poolId)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := ap.releaseAddressesByOwner(ownerId)
+	log.Printf("[ipam] Released addresses %v of owner %v.", addresses, ownerId)
+
+	if len(addresses) == 0 {
+		return addresses, nil
+	}
+
+	addressReleases.Add(uint64(len(addresses)))
+	am.updateMetrics()
+
+	err = am.save()
+	if err != nil {
+		return nil, err
+	}
+
+	return addresses, nil
+}
@@ -4,11 +4,16 @@
 package ipam
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/Azure/azure-container-networking/common"
+	"github.com/Azure/azure-container-networking/store"
 )
 
 var (
@@ -30,6 +35,10 @@ var (
 	addr31  = net.IPv4(10, 0, 3, 1)
 	addr32  = net.IPv4(10, 0, 3, 2)
 	addr33  = net.IPv4(10, 0, 3, 3)
+
+	subnet6 = net.IPNet{IP: net.ParseIP("fd00:0:1::"), Mask: net.CIDRMask(64, 128)}
+	addr61  = net.ParseIP("fd00:0:1::1")
+	addr62  = net.ParseIP("fd00:0:1::2")
 )
 
 // createAddressManager creates an address manager with a simple test configuration.
@@ -371,3 +380,421 @@ func TestAddressRequestsFromTheSamePool(t *testing.T) {
 		t.Errorf("ReleasePool failed, err:%v", err)
 	}
 }
+
+// Tests IPv6 pools serve addresses of their family and their state is restored correctly.
+func TestIPv6AddressPool(t *testing.T) {
+	file, err := ioutil.TempFile("", "ipam")
+	if err != nil {
+		t.Fatalf("Failed to create store file, err:%v", err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+	defer os.Remove(file.Name())
+
+	kvs, err := store.NewJsonFileStore(file.Name())
+	if err != nil {
+		t.Fatalf("NewJsonFileStore failed, err:%v", err)
+	}
+
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+
+	amImpl := am.(*addressManager)
+	amImpl.store = kvs
+
+	// Add a dual-stack local address space.
+	localAs, _ := amImpl.newAddressSpace(LocalDefaultAddressSpaceId, LocalScope)
+	ap, _ := localAs.newAddressPool(anyInterface, anyPriority, &subnet1)
+	ap.newAddressRecord(&addr11)
+	ap, _ = localAs.newAddressPool(anyInterface, anyPriority, &subnet6)
+	ap.newAddressRecord(&addr61)
+	ap.newAddressRecord(&addr62)
+	amImpl.setAddressSpace(localAs)
+
+	// Request an IPv6 pool.
+	poolId, subnet, err := am.RequestPool(LocalDefaultAddressSpaceId, "", "", nil, true)
+	if err != nil || subnet != subnet6.String() {
+		t.Fatalf("RequestPool returned subnet %v, err:%v", subnet, err)
+	}
+
+	// Requests for another family are rejected.
+	options := map[string]string{OptAddressFamily: OptAddressFamilyIPv4}
+	_, err = am.RequestAddress(LocalDefaultAddressSpaceId, poolId, "", options)
+	if !errors.Is(err, errAddressFamilyMismatch) {
+		t.Errorf("Expected address family mismatch, err:%v", err)
+	}
+
+	// Addresses are found in any IPv6 notation.
+	options[OptAddressFamily] = OptAddressFamilyIPv6
+	address, err := am.RequestAddress(LocalDefaultAddressSpaceId, poolId, "fd00:0:1:0:0:0:0:2", options)
+	if err != nil || address != "fd00:0:1::2/64" {
+		t.Fatalf("RequestAddress returned %v, err:%v", address, err)
+	}
+
+	info, err := am.GetPoolInfo(LocalDefaultAddressSpaceId, poolId)
+	if err != nil || !info.IsIPv6 || info.Capacity != 2 || info.Available != 1 {
+		t.Errorf("Unexpected pool info %+v, err:%v", info, err)
+	}
+
+	if !info.Gateway.Equal(net.ParseIP("fd00:0:1::1")) {
+		t.Errorf("Unexpected gateway %v", info.Gateway)
+	}
+
+	// Restore the state in a new address manager.
+	restored := &addressManager{AddrSpaces: make(map[string]*addressSpace), store: kvs}
+	if err := restored.restore(); err != nil {
+		t.Fatalf("restore failed, err:%v", err)
+	}
+
+	info, err = restored.GetPoolInfo(LocalDefaultAddressSpaceId, poolId)
+	if err != nil || !info.IsIPv6 || info.Subnet.String() != subnet6.String() || info.Available != 1 {
+		t.Errorf("Unexpected restored pool info %+v, err:%v", info, err)
+	}
+
+	_, err = restored.RequestAddress(LocalDefaultAddressSpaceId, poolId, "fd00:0:1::2", nil)
+	if !errors.Is(err, errAddressInUse) {
+		t.Errorf("Expected restored address to be in use, err:%v", err)
+	}
+
+	err = restored.ReleaseAddress(LocalDefaultAddressSpaceId, poolId, address, nil)
+	if err != nil {
+		t.Errorf("ReleaseAddress failed, err:%v", err)
+	}
+
+	address, err = restored.RequestAddress(LocalDefaultAddressSpaceId, poolId, "fd00:0:1::2", nil)
+	if err != nil || address != "fd00:0:1::2/64" {
+		t.Errorf("RequestAddress returned %v after release, err:%v", address, err)
+	}
+}
+
+// Tests static address requests are validated against the pool and record the requestor ID.
+func TestStaticAddressRequests(t *testing.T) {
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+
+	poolId := subnet1.String()
+	tests := []struct {
+		address string
+		id      string
+		err     error
+	}{
+		{"10.0.2.1", "", errAddressOutOfRange},
+		{"10.0.1.3", "", errAddressNotFound},
+		{"10.0.1.1", "id1", nil},
+		{"10.0.1.1", "id1", nil},
+		{"10.0.1.1", "id2", errAddressInUse},
+		{"10.0.1.1", "", errAddressInUse},
+		{"10.0.1.2", "id1", errAddressIDInUse},
+		{"10.0.1.2", "", nil},
+	}
+
+	for _, test := range tests {
+		options := map[string]string{OptStaticAddress: test.address, OptAddressID: test.id}
+		_, err := am.RequestAddress(LocalDefaultAddressSpaceId, poolId, "", options)
+		if !errors.Is(err, test.err) {
+			t.Errorf("Static request for %v with id %q returned err:%v, expected %v", test.address, test.id, err, test.err)
+		}
+	}
+
+	// Addresses are released by address whether or not they were requested with an ID.
+	for _, address := range []string{"10.0.1.1/24", "10.0.1.2"} {
+		if err := am.ReleaseAddress(LocalDefaultAddressSpaceId, poolId, address, nil); err != nil {
+			t.Errorf("ReleaseAddress failed, err:%v", err)
+		}
+	}
+
+	info, _ := am.GetPoolInfo(LocalDefaultAddressSpaceId, poolId)
+	if info.Available != info.Capacity {
+		t.Errorf("Expected all addresses to be released, got %+v", info)
+	}
+
+	// The released ID can hold another address.
+	options := map[string]string{OptStaticAddress: "10.0.1.2", OptAddressID: "id1"}
+	if _, err := am.RequestAddress(LocalDefaultAddressSpaceId, poolId, "", options); err != nil {
+		t.Errorf("RequestAddress failed after release, err:%v", err)
+	}
+}
+
+// Tests only one of the callers requesting the same static address concurrently gets it.
+func TestConcurrentStaticAddressRequests(t *testing.T) {
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+
+	const callers = 20
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func(id string) {
+			options := map[string]string{OptAddressID: id}
+			_, err := am.RequestAddress(LocalDefaultAddressSpaceId, subnet1.String(), addr11.String(), options)
+			errs <- err
+		}(fmt.Sprintf("id%v", i))
+	}
+
+	succeeded := 0
+	for i := 0; i < callers; i++ {
+		err := <-errs
+		if err == nil {
+			succeeded++
+		} else if !errors.Is(err, errAddressInUse) {
+			t.Errorf("Unexpected error %v", err)
+		}
+	}
+
+	if succeeded != 1 {
+		t.Errorf("Expected a single caller to get the address, got %v", succeeded)
+	}
+}
+
+// Tests reservations hold addresses until they are committed or expire, across restarts.
+func TestAddressReservations(t *testing.T) {
+	file, err := ioutil.TempFile("", "ipam")
+	if err != nil {
+		t.Fatalf("Failed to create store file, err:%v", err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+	defer os.Remove(file.Name())
+
+	kvs, err := store.NewJsonFileStore(file.Name())
+	if err != nil {
+		t.Fatalf("NewJsonFileStore failed, err:%v", err)
+	}
+
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+	defer am.Uninitialize()
+
+	amImpl := am.(*addressManager)
+	amImpl.store = kvs
+	poolId := subnet1.String()
+
+	token1, address1, err := am.ReserveAddress(LocalDefaultAddressSpaceId, poolId, "pod1", time.Minute)
+	if err != nil {
+		t.Fatalf("ReserveAddress failed, err:%v", err)
+	}
+
+	// Reserving again for the same requestor returns the same reservation.
+	token, address, err := am.ReserveAddress(LocalDefaultAddressSpaceId, poolId, "pod1", time.Minute)
+	if err != nil || token != token1 || address != address1 {
+		t.Errorf("Unexpected reservation %v %v, err:%v", token, address, err)
+	}
+
+	token2, address2, err := am.ReserveAddress(LocalDefaultAddressSpaceId, poolId, "pod2", time.Minute)
+	if err != nil || address2 == address1 {
+		t.Fatalf("Unexpected reservation %v, err:%v", address2, err)
+	}
+
+	// Reserved addresses are not available.
+	info, _ := am.GetPoolInfo(LocalDefaultAddressSpaceId, poolId)
+	if info.Available != 0 {
+		t.Errorf("Expected reserved addresses to be unavailable, got %+v", info)
+	}
+
+	_, err = am.RequestAddress(LocalDefaultAddressSpaceId, poolId, "", nil)
+	if !errors.Is(err, errNoAvailableAddresses) {
+		t.Errorf("Expected no available addresses, err:%v", err)
+	}
+
+	_, err = am.RequestAddress(LocalDefaultAddressSpaceId, poolId, address1, nil)
+	if !errors.Is(err, errAddressInUse) {
+		t.Errorf("Expected reserved address to be in use, err:%v", err)
+	}
+
+	// Reservations are restored after a restart, except those that expired.
+	amImpl.Lock()
+	_, ar := amImpl.findReservation(token2)
+	ar.Reservation.Expiry = time.Now()
+	amImpl.save()
+	amImpl.Unlock()
+
+	restored := &addressManager{AddrSpaces: make(map[string]*addressSpace), store: kvs}
+	if err := restored.restore(); err != nil {
+		t.Fatalf("restore failed, err:%v", err)
+	}
+
+	if _, err := restored.CommitReservation(token2); !errors.Is(err, errReservationNotFound) {
+		t.Errorf("Expected expired reservation to be deleted, err:%v", err)
+	}
+
+	addr, err := restored.CommitReservation(token1)
+	if err != nil || addr != address1+"/24" {
+		t.Fatalf("CommitReservation returned %v, err:%v", addr, err)
+	}
+
+	if _, err := restored.CommitReservation(token1); !errors.Is(err, errReservationNotFound) {
+		t.Errorf("Expected committed reservation to be deleted, err:%v", err)
+	}
+
+	// Committed addresses are held by the requestor ID.
+	addr, err = restored.RequestAddress(LocalDefaultAddressSpaceId, poolId, "", map[string]string{OptAddressID: "pod1"})
+	if err != nil || addr != address1+"/24" {
+		t.Errorf("RequestAddress by ID returned %v, err:%v", addr, err)
+	}
+
+	info, _ = restored.GetPoolInfo(LocalDefaultAddressSpaceId, poolId)
+	if info.Available != 1 {
+		t.Errorf("Expected the expired reservation to be available, got %+v", info)
+	}
+}
+
+// Tests the sweeper deletes expired reservations.
+func TestReservationSweeper(t *testing.T) {
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+	defer am.Uninitialize()
+
+	amImpl := am.(*addressManager)
+	amImpl.stopSweeper()
+	amImpl.startSweeper(time.Millisecond)
+
+	token, _, err := am.ReserveAddress(LocalDefaultAddressSpaceId, subnet1.String(), "pod1", time.Millisecond)
+	if err != nil {
+		t.Fatalf("ReserveAddress failed, err:%v", err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		amImpl.Lock()
+		_, ar := amImpl.findReservation(token)
+		amImpl.Unlock()
+
+		if ar == nil {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Errorf("Reservation was not swept")
+}
+
+// Tests pool usage counts allocated, reserved and unhealthy addresses.
+func TestGetPoolUsage(t *testing.T) {
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+	defer am.Uninitialize()
+
+	poolId := subnet1.String()
+
+	_, err = am.RequestAddress(LocalDefaultAddressSpaceId, poolId, addr12.String(), map[string]string{OptAddressID: "pod2"})
+	if err != nil {
+		t.Fatalf("RequestAddress failed, err:%v", err)
+	}
+
+	_, _, err = am.ReserveAddress(LocalDefaultAddressSpaceId, poolId, "pod1", time.Minute)
+	if err != nil {
+		t.Fatalf("ReserveAddress failed, err:%v", err)
+	}
+
+	usage, err := am.GetPoolUsage(LocalDefaultAddressSpaceId, poolId)
+	if err != nil || usage.Total != 2 || usage.Allocated != 1 || usage.Reserved != 1 || usage.Unhealthy != 0 {
+		t.Fatalf("Unexpected pool usage %+v, err:%v", usage, err)
+	}
+
+	if len(usage.Addresses) != 1 || !usage.Addresses[0].Address.Equal(addr12) || usage.Addresses[0].OwnerID != "pod2" {
+		t.Errorf("Unexpected allocated addresses %+v", usage.Addresses)
+	}
+
+	if _, err := am.GetPoolUsage(LocalDefaultAddressSpaceId, "10.9.9.0/24"); !errors.Is(err, errInvalidPoolId) {
+		t.Errorf("Expected unknown pool to fail, err:%v", err)
+	}
+}
+
+// Tests that the addresses held by an owner are released together and only once.
+func TestReleaseAddressesByOwner(t *testing.T) {
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+	defer am.Uninitialize()
+
+	poolId := subnet1.String()
+
+	for _, address := range []string{addr11.String(), addr12.String()} {
+		_, err = am.RequestAddress(LocalDefaultAddressSpaceId, poolId, address, map[string]string{OptAddressOwner: "container1"})
+		if err != nil {
+			t.Fatalf("RequestAddress failed, err:%v", err)
+		}
+	}
+
+	if _, err := am.ReleaseAddressesByOwner(LocalDefaultAddressSpaceId, poolId, ""); !errors.Is(err, errInvalidAddressOwner) {
+		t.Errorf("Expected an empty owner to fail, err:%v", err)
+	}
+
+	addresses, err := am.ReleaseAddressesByOwner(LocalDefaultAddressSpaceId, poolId, "container1")
+	if err != nil || len(addresses) != 2 || addresses[0] != addr11.String() || addresses[1] != addr12.String() {
+		t.Fatalf("Unexpected released addresses %v, err:%v", addresses, err)
+	}
+
+	info, _ := am.GetPoolInfo(LocalDefaultAddressSpaceId, poolId)
+	if info.Available != info.Capacity {
+		t.Errorf("Expected all addresses to be released, got %+v", info)
+	}
+
+	addresses, err = am.ReleaseAddressesByOwner(LocalDefaultAddressSpaceId, poolId, "container1")
+	if err != nil || len(addresses) != 0 {
+		t.Errorf("Expected releasing again to be a no-op, got %v, err:%v", addresses, err)
+	}
+}
+
+// Tests that reconciliation frees stale allocations outside the grace period.
+func TestReconcileAddresses(t *testing.T) {
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+	defer am.Uninitialize()
+
+	poolId := subnet1.String()
+
+	for _, address := range []string{addr11.String(), addr12.String()} {
+		_, err = am.RequestAddress(LocalDefaultAddressSpaceId, poolId, address, nil)
+		if err != nil {
+			t.Fatalf("RequestAddress failed, err:%v", err)
+		}
+	}
+
+	inUse := []string{"10.0.1.1/24"}
+	options := ReconcileOptions{GracePeriod: time.Hour}
+
+	// Recent allocations are skipped.
+	summary, err := am.ReconcileAddresses(LocalDefaultAddressSpaceId, inUse, options)
+	if err != nil || summary.Skipped != 1 || summary.Freed != 0 || len(summary.Stale) != 0 {
+		t.Fatalf("Unexpected summary %+v, err:%v", summary, err)
+	}
+
+	ap, _ := am.(*addressManager).AddrSpaces[LocalDefaultAddressSpaceId].getAddressPool(poolId)
+	ap.Addresses[addr12.String()].AllocatedAt = time.Now().Add(-2 * time.Hour)
+
+	// Dry runs only report stale allocations.
+	options.DryRun = true
+	summary, err = am.ReconcileAddresses(LocalDefaultAddressSpaceId, inUse, options)
+	if err != nil || summary.Freed != 0 || len(summary.Stale) != 1 || summary.Stale[0] != addr12.String() {
+		t.Fatalf("Unexpected dry-run summary %+v, err:%v", summary, err)
+	}
+
+	options.DryRun = false
+	summary, err = am.ReconcileAddresses(LocalDefaultAddressSpaceId, inUse, options)
+	if err != nil || summary.Freed != 1 || summary.Skipped != 0 {
+		t.Fatalf("Unexpected summary %+v, err:%v", summary, err)
+	}
+
+	usage, _ := am.GetPoolUsage(LocalDefaultAddressSpaceId, poolId)
+	if usage.Allocated != 1 || !usage.Addresses[0].Address.Equal(addr11) {
+		t.Errorf("Expected only the address in use to remain allocated, got %+v", usage)
+	}
+
+	if _, err := am.ReconcileAddresses(LocalDefaultAddressSpaceId, []string{"10.0.1"}, options); !errors.Is(err, errInvalidAddress) {
+		t.Errorf("Expected an invalid address to fail, err:%v", err)
+	}
+}
@@ -4,9 +4,9 @@
 package ipam
 
 import (
+	"context"
 	"encoding/json"
 	"net"
-	"net/http"
 	"time"
 
 	"github.com/Azure/azure-container-networking/common"
@@ -28,6 +28,7 @@ type masSource struct {
 	queryUrl      string
 	queryInterval time.Duration
 	lastRefresh   time.Time
+	client        *common.HostClient
 }
 
 // MAS host agent JSON object format.
@@ -59,6 +60,7 @@ func newMasSource(options map[string]interface{}) (*masSource, error) {
 		name:          "MAS",
 		queryUrl:      queryUrl,
 		queryInterval: queryInterval,
+		client:        common.NewHostClient(common.HostClientConfig{Name: "MAS IPAM query"}),
 	}, nil
 }
 
@@ -90,17 +92,14 @@ func (s *masSource) refresh() error {
 	}
 
 	// Fetch configuration.
-	resp, err := http.Get(s.queryUrl)
+	data, err := s.client.Get(context.Background(), s.queryUrl)
 	if err != nil {
 		return err
 	}
 
-	defer resp.Body.Close()
-
 	// Decode JSON object.
 	var obj jsonObject
-	decoder := json.NewDecoder(resp.Body)
-	err = decoder.Decode(&obj)
+	err = json.Unmarshal(data, &obj)
 	if err != nil {
 		return err
 	}
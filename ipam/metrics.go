@@ -0,0 +1,56 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ipam
+
+import (
+	"github.com/Azure/azure-container-networking/common"
+)
+
+var (
+	// Metrics of the address manager.
+	addressRequests = common.NewCounter(
+		"ipam_address_requests_total", "Number of address requests.")
+	addressRequestFailures = common.NewCounter(
+		"ipam_address_request_failures_total", "Number of address requests that failed.")
+	addressReleases = common.NewCounter(
+		"ipam_address_releases_total", "Number of address releases.")
+	staleAddressesFreed = common.NewCounter(
+		"ipam_stale_addresses_freed_total", "Number of stale allocations freed by reconciliation.")
+	staleAddressesSkipped = common.NewCounter(
+		"ipam_stale_addresses_skipped_total", "Number of allocations skipped by reconciliation for being within the grace period.")
+	addressCapacity = common.NewGauge(
+		"ipam_addresses", "Number of addresses in all address pools.")
+	addressesInUse = common.NewGauge(
+		"ipam_addresses_in_use", "Number of addresses in use in all address pools.")
+	addressesReserved = common.NewGauge(
+		"ipam_addresses_reserved", "Number of reserved addresses in all address pools.")
+	poolUtilization = common.NewGauge(
+		"ipam_pool_utilization", "Fraction of addresses in use or reserved in the most utilized address pool.")
+)
+
+// updateMetrics updates the address pool utilization metrics.
+func (am *addressManager) updateMetrics() {
+	var capacity, inUse, reserved int
+	var utilization float64
+
+	for _, as := range am.AddrSpaces {
+		for _, ap := range as.Pools {
+			usage := ap.getUsage()
+			capacity += usage.Total
+			inUse += usage.Allocated
+			reserved += usage.Reserved
+
+			if usage.Total > 0 {
+				if u := float64(usage.Allocated+usage.Reserved) / float64(usage.Total); u > utilization {
+					utilization = u
+				}
+			}
+		}
+	}
+
+	addressCapacity.Set(float64(capacity))
+	addressesInUse.Set(float64(inUse))
+	addressesReserved.Set(float64(reserved))
+	poolUtilization.Set(utilization)
+}
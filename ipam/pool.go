@@ -4,9 +4,12 @@
 package ipam
 
 import (
+	"bytes"
 	"fmt"
 	"net"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/Azure/azure-container-networking/log"
 	"github.com/Azure/azure-container-networking/platform"
@@ -75,13 +78,31 @@ type AddressPoolInfo struct {
 	Capacity       int
 }
 
+// AddressPoolUsage contains the utilization of an address pool.
+type AddressPoolUsage struct {
+	Total     int
+	Allocated int
+	Reserved  int
+	Unhealthy int
+	Addresses []AllocatedAddress
+}
+
+// AllocatedAddress is an address allocated from a pool along with the ID of its owner, if any.
+type AllocatedAddress struct {
+	Address net.IP
+	OwnerID string
+}
+
 // Represents an IP address in a pool.
 type addressRecord struct {
-	ID        string
-	Addr      net.IP
-	InUse     bool
-	unhealthy bool
-	epoch     int
+	ID          string
+	Owner       string `json:",omitempty"`
+	Addr        net.IP
+	InUse       bool
+	AllocatedAt time.Time
+	Reservation *addressReservation `json:",omitempty"`
+	unhealthy   bool
+	epoch       int
 }
 
 //
@@ -224,8 +245,8 @@ func (as *addressSpace) merge(newas *addressSpace) {
 				if av.epoch == as.epoch {
 					// Pool has at least one valid or in-use address.
 					pv.epoch = as.epoch
-				} else if av.InUse {
-					// Address is no longer valid, but still in use.
+				} else if av.InUse || av.Reservation != nil {
+					// Address is no longer valid, but still in use or reserved.
 					pv.epoch = as.epoch
 					av.unhealthy = true
 				} else {
@@ -397,7 +418,7 @@ func (ap *addressPool) getInfo() *AddressPoolInfo {
 	var unhealthyAddrs []net.IP
 
 	for _, ar := range ap.Addresses {
-		if !ar.InUse {
+		if !ar.InUse && ar.Reservation == nil {
 			available++
 		}
 		if ar.unhealthy {
@@ -418,11 +439,60 @@ func (ap *addressPool) getInfo() *AddressPoolInfo {
 	return info
 }
 
+// Returns address pool utilization, with the allocated addresses in order.
+func (ap *addressPool) getUsage() *AddressPoolUsage {
+	usage := &AddressPoolUsage{
+		Total: len(ap.Addresses),
+	}
+
+	for _, ar := range ap.Addresses {
+		if ar.InUse {
+			usage.Allocated++
+			usage.Addresses = append(usage.Addresses, AllocatedAddress{Address: ar.Addr, OwnerID: ar.Owner})
+		} else if ar.Reservation != nil {
+			usage.Reserved++
+		}
+		if ar.unhealthy {
+			usage.Unhealthy++
+		}
+	}
+
+	sort.Slice(usage.Addresses, func(i, j int) bool {
+		return bytes.Compare(usage.Addresses[i].Address.To16(), usage.Addresses[j].Address.To16()) < 0
+	})
+
+	return usage
+}
+
 // Returns if an address pool is currently in use.
 func (ap *addressPool) isInUse() bool {
 	return ap.RefCount > 0
 }
 
+// Returns if an address pool serves addresses of the given family. An empty family matches any pool.
+func (ap *addressPool) matchesFamily(family string) bool {
+	switch family {
+	case "", OptAddressFamilyBoth:
+		return true
+	case OptAddressFamilyIPv4:
+		return !ap.IsIPv6
+	case OptAddressFamilyIPv6:
+		return ap.IsIPv6
+	default:
+		return false
+	}
+}
+
+// Returns the canonical form of an address in regular or CIDR notation, so that the notations
+// of an IPv6 address refer to the same address record.
+func canonicalAddress(address string) string {
+	if ip := platform.ConvertStringToIPAddress(address); ip != nil {
+		return ip.String()
+	}
+
+	return address
+}
+
 // Creates a new addressRecord object.
 func (ap *addressPool) newAddressRecord(addr *net.IP) (*addressRecord, error) {
 	id := addr.String()
@@ -453,23 +523,24 @@ func (ap *addressPool) requestAddress(address string, options map[string]string)
 	var err error
 	id := options[OptAddressID]
 
+	if address == "" {
+		address = options[OptStaticAddress]
+	}
+
 	log.Printf("[ipam] Requesting address with address:%v options:%+v.", address, options)
 	defer func() { log.Printf("[ipam] Address request completed with address:%v err:%v.", addr, err) }()
 
+	if !ap.matchesFamily(options[OptAddressFamily]) {
+		err = errAddressFamilyMismatch
+		return "", err
+	}
+
 	if address != "" {
 		// Return the specific address requested.
-		ar = ap.Addresses[address]
-		if ar == nil {
-			err = errAddressNotFound
+		ar, err = ap.getStaticAddress(address, id)
+		if err != nil {
 			return "", err
 		}
-		if ar.InUse {
-			// Return the same address if IDs match.
-			if id == "" || id != ar.ID {
-				err = errAddressInUse
-				return "", err
-			}
-		}
 	} else if options[OptAddressType] == OptAddressTypeGateway {
 		// Return the pre-assigned gateway address.
 		ar = &addressRecord{
@@ -484,7 +555,7 @@ func (ap *addressPool) requestAddress(address string, options map[string]string)
 	// If no address was found, return any available address.
 	if ar == nil {
 		for _, ar = range ap.Addresses {
-			if !ar.InUse && ar.ID == "" {
+			if !ar.InUse && ar.ID == "" && ar.Reservation == nil {
 				break
 			}
 			ar = nil
@@ -495,11 +566,18 @@ func (ap *addressPool) requestAddress(address string, options map[string]string)
 		}
 	}
 
+	// Record the ID of the requestor against the address.
 	if id != "" {
 		ap.addrsByID[id] = ar
 		ar.ID = id
-	} else {
-		ar.InUse = true
+	}
+	ar.InUse = true
+	ar.AllocatedAt = time.Now()
+
+	// Record the owner of the address, which defaults to the ID of the requestor.
+	ar.Owner = options[OptAddressOwner]
+	if ar.Owner == "" {
+		ar.Owner = id
 	}
 
 	// Return address in CIDR notation.
@@ -511,6 +589,36 @@ func (ap *addressPool) requestAddress(address string, options map[string]string)
 	return addr.String(), nil
 }
 
+// Returns the record of a specific address requested by the caller with the given ID. The address
+// must be in the pool, and either be free or already held by the same ID.
+func (ap *addressPool) getStaticAddress(address string, id string) (*addressRecord, error) {
+	ip := platform.ConvertStringToIPAddress(address)
+	if ip == nil {
+		return nil, errInvalidAddress
+	}
+
+	if !ap.Subnet.Contains(ip) {
+		return nil, errAddressOutOfRange
+	}
+
+	ar := ap.Addresses[ip.String()]
+	if ar == nil {
+		return nil, errAddressNotFound
+	}
+
+	// Addresses held by an ID are returned only to the same ID.
+	if (ar.InUse || ar.ID != "") && (id == "" || id != ar.ID) || ar.Reservation != nil {
+		return nil, errAddressInUse
+	}
+
+	// An ID holds a single address.
+	if other := ap.addrsByID[id]; id != "" && other != nil && other != ar {
+		return nil, errAddressIDInUse
+	}
+
+	return ar, nil
+}
+
 // Releases a previously requested address back to its address pool.
 func (ap *addressPool) releaseAddress(address string, options map[string]string) error {
 	var ar *addressRecord
@@ -526,6 +634,7 @@ func (ap *addressPool) releaseAddress(address string, options map[string]string)
 
 	if address != "" {
 		// Release the specific address.
+		address = canonicalAddress(address)
 		ar = ap.Addresses[address]
 
 		// Release the pre-assigned gateway address.
@@ -546,14 +655,17 @@ func (ap *addressPool) releaseAddress(address string, options map[string]string)
 		return nil
 	}
 
-	if !ar.InUse {
+	if !ar.InUse && ar.ID == "" {
 		log.Printf("Address not in use. Not Returning error")
 		return nil
 	}
 
 	ar.InUse = false
+	ar.Owner = ""
+	ar.AllocatedAt = time.Time{}
 
-	if id != "" && ar.ID == id {
+	// Release the ID of the requestor, whether or not the address was released by ID.
+	if ar.ID != "" {
 		delete(ap.addrsByID, ar.ID)
 		ar.ID = ""
 	}
@@ -566,3 +678,22 @@ func (ap *addressPool) releaseAddress(address string, options map[string]string)
 
 	return nil
 }
+
+// Releases all addresses of the address pool held by the given owner, and returns them in order.
+func (ap *addressPool) releaseAddressesByOwner(owner string) []string {
+	var addresses []string
+
+	for _, ar := range ap.Addresses {
+		if ar.InUse && ar.Owner == owner {
+			addresses = append(addresses, ar.Addr.String())
+		}
+	}
+
+	sort.Strings(addresses)
+
+	for _, address := range addresses {
+		ap.releaseAddress(address, nil)
+	}
+
+	return addresses
+}
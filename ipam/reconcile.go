@@ -0,0 +1,108 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ipam
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Azure/azure-container-networking/log"
+	"github.com/Azure/azure-container-networking/platform"
+)
+
+// ReconcileOptions configures the reconciliation of allocations with the addresses in use.
+type ReconcileOptions struct {
+	// Reports stale allocations without freeing them.
+	DryRun bool
+
+	// Allocations younger than the grace period are skipped, since they may belong to an endpoint
+	// that is still being created.
+	GracePeriod time.Duration
+}
+
+// ReconcileSummary is the result of reconciling allocations with the addresses in use.
+type ReconcileSummary struct {
+	// Allocated addresses not in use, which are freed unless reconciling in dry-run mode.
+	Stale []string
+
+	// Number of stale allocations freed, and number of allocations not in use skipped for being
+	// within the grace period.
+	Freed   int
+	Skipped int
+}
+
+// ReconcileAddresses frees the allocations of the address space whose addresses are not in the given
+// set of addresses in use, such as allocations leaked by endpoints deleted while the plugin was down.
+func (am *addressManager) ReconcileAddresses(asId string, inUse []string, options ReconcileOptions) (*ReconcileSummary, error) {
+	am.Lock()
+	defer am.Unlock()
+
+	as, err := am.getAddressSpace(asId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Index the addresses in use by their canonical form.
+	inUseSet := make(map[string]bool, len(inUse))
+	for _, address := range inUse {
+		ip := platform.ConvertStringToIPAddress(address)
+		if ip == nil {
+			return nil, errInvalidAddress
+		}
+		inUseSet[ip.String()] = true
+	}
+
+	summary := &ReconcileSummary{}
+	now := time.Now()
+
+	for _, ap := range as.Pools {
+		var stale []string
+
+		for address, ar := range ap.Addresses {
+			if !ar.InUse || inUseSet[address] {
+				continue
+			}
+
+			if now.Sub(ar.AllocatedAt) < options.GracePeriod {
+				summary.Skipped++
+				continue
+			}
+
+			stale = append(stale, address)
+		}
+
+		sort.Strings(stale)
+		summary.Stale = append(summary.Stale, stale...)
+
+		if options.DryRun {
+			continue
+		}
+
+		for _, address := range stale {
+			log.Printf("[ipam] Freeing stale allocation of address %v.", address)
+			ap.releaseAddress(address, nil)
+			summary.Freed++
+		}
+	}
+
+	log.Printf("[ipam] Reconciled address space %v with dryRun:%v, stale:%v freed:%v skipped:%v.",
+		asId, options.DryRun, summary.Stale, summary.Freed, summary.Skipped)
+
+	staleAddressesSkipped.Add(uint64(summary.Skipped))
+
+	if summary.Freed == 0 {
+		return summary, nil
+	}
+
+	staleAddressesFreed.Add(uint64(summary.Freed))
+	addressReleases.Add(uint64(summary.Freed))
+	am.updateMetrics()
+
+	err = am.save()
+	if err != nil {
+		return nil, err
+	}
+
+	return summary, nil
+}
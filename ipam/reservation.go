@@ -0,0 +1,237 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ipam
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"time"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+const (
+	// Interval between sweeps of expired address reservations.
+	reservationSweepInterval = 10 * time.Second
+)
+
+// Represents a reservation of an address for a requestor, which expires unless it is committed.
+type addressReservation struct {
+	Token       string
+	RequestorID string
+	Expiry      time.Time
+}
+
+// Returns whether the reservation has expired at the given time.
+func (r *addressReservation) isExpired(now time.Time) bool {
+	return !now.Before(r.Expiry)
+}
+
+// Returns a random reservation token.
+func newReservationToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Reserves an available address of the pool for the requestor until the TTL elapses. Reserving
+// again for the same requestor extends the existing reservation.
+func (ap *addressPool) reserveAddress(requestorID string, ttl time.Duration) (*addressRecord, error) {
+	if requestorID == "" || ttl <= 0 {
+		return nil, errInvalidReservation
+	}
+
+	if ap.addrsByID[requestorID] != nil {
+		return nil, errAddressIDInUse
+	}
+
+	var ar *addressRecord
+	for _, record := range ap.Addresses {
+		if record.Reservation != nil && record.Reservation.RequestorID == requestorID {
+			ar = record
+			break
+		}
+
+		if ar == nil && !record.InUse && record.ID == "" && record.Reservation == nil {
+			ar = record
+		}
+	}
+
+	if ar == nil {
+		return nil, errNoAvailableAddresses
+	}
+
+	if ar.Reservation == nil {
+		ar.Reservation = &addressReservation{
+			Token:       newReservationToken(),
+			RequestorID: requestorID,
+		}
+	}
+	ar.Reservation.Expiry = time.Now().Add(ttl)
+
+	return ar, nil
+}
+
+// Converts the reservation of an address to an allocation held by the requestor ID.
+func (ap *addressPool) commitReservation(ar *addressRecord) (string, error) {
+	id := ar.Reservation.RequestorID
+	if other := ap.addrsByID[id]; other != nil && other != ar {
+		return "", errAddressIDInUse
+	}
+
+	ar.Reservation = nil
+	ar.InUse = true
+	ar.AllocatedAt = time.Now()
+	ar.ID = id
+	ar.Owner = id
+	ap.addrsByID[id] = ar
+
+	addr := &net.IPNet{
+		IP:   ar.Addr,
+		Mask: ap.Subnet.Mask,
+	}
+
+	return addr.String(), nil
+}
+
+// Returns the pool and the record of the address reserved with the given token.
+func (am *addressManager) findReservation(token string) (*addressPool, *addressRecord) {
+	for _, as := range am.AddrSpaces {
+		for _, ap := range as.Pools {
+			for _, ar := range ap.Addresses {
+				if ar.Reservation != nil && ar.Reservation.Token == token {
+					return ap, ar
+				}
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// Deletes the reservations that expired at the given time and returns whether any was deleted.
+func (am *addressManager) expireReservations(now time.Time) bool {
+	expired := false
+
+	for _, as := range am.AddrSpaces {
+		for _, ap := range as.Pools {
+			for _, ar := range ap.Addresses {
+				if ar.Reservation != nil && ar.Reservation.isExpired(now) {
+					log.Printf("[ipam] Reservation of address %v for %v expired.", ar.Addr, ar.Reservation.RequestorID)
+					ar.Reservation = nil
+					expired = true
+				}
+			}
+		}
+	}
+
+	return expired
+}
+
+// Starts sweeping expired reservations periodically until stopSweeper is called.
+func (am *addressManager) startSweeper(interval time.Duration) {
+	am.sweepStop = make(chan struct{})
+	am.sweepDone = make(chan struct{})
+	go am.sweep(interval, am.sweepStop, am.sweepDone)
+}
+
+// Stops sweeping expired reservations.
+func (am *addressManager) stopSweeper() {
+	if am.sweepStop != nil {
+		close(am.sweepStop)
+		<-am.sweepDone
+		am.sweepStop = nil
+	}
+}
+
+// Sweeps expired reservations periodically.
+func (am *addressManager) sweep(interval time.Duration, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		am.Lock()
+		if am.expireReservations(time.Now()) {
+			am.updateMetrics()
+			am.save()
+		}
+		am.Unlock()
+	}
+}
+
+// ReserveAddress reserves an address of the pool for the requestor until the TTL elapses, and
+// returns the reservation token along with the address. The reservation is either converted to an
+// allocation by CommitReservation, or expires.
+func (am *addressManager) ReserveAddress(asId, poolId, requestorId string, ttl time.Duration) (string, string, error) {
+	am.Lock()
+	defer am.Unlock()
+
+	am.refreshSource()
+
+	as, err := am.getAddressSpace(asId)
+	if err != nil {
+		return "", "", err
+	}
+
+	ap, err := as.getAddressPool(poolId)
+	if err != nil {
+		return "", "", err
+	}
+
+	am.expireReservations(time.Now())
+
+	ar, err := ap.reserveAddress(requestorId, ttl)
+	if err != nil {
+		log.Printf("[ipam] Failed to reserve address for %v, err:%v.", requestorId, err)
+		return "", "", err
+	}
+
+	log.Printf("[ipam] Reserved address %v for %v until %v.", ar.Addr, requestorId, ar.Reservation.Expiry)
+
+	am.updateMetrics()
+
+	err = am.save()
+	if err != nil {
+		return "", "", err
+	}
+
+	return ar.Reservation.Token, ar.Addr.String(), nil
+}
+
+// CommitReservation converts an active reservation to an allocation held by the requestor ID of
+// the reservation, and returns the address in CIDR notation.
+func (am *addressManager) CommitReservation(token string) (string, error) {
+	am.Lock()
+	defer am.Unlock()
+
+	ap, ar := am.findReservation(token)
+	if ar == nil || ar.Reservation.isExpired(time.Now()) {
+		return "", errReservationNotFound
+	}
+
+	addr, err := ap.commitReservation(ar)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("[ipam] Committed reservation of address %v for %v.", addr, ar.ID)
+
+	am.updateMetrics()
+
+	err = am.save()
+	if err != nil {
+		return "", err
+	}
+
+	return addr, nil
+}
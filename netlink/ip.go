@@ -248,6 +248,12 @@ func setIpRoute(route *Route, add bool) error {
 
 	req.addPayload(msg)
 
+	// Table IDs that do not fit in the message header are passed as an attribute.
+	if route.Table > 0xFF {
+		msg.Table = unix.RT_TABLE_UNSPEC
+		req.addPayload(newAttributeUint32(unix.RTA_TABLE, uint32(route.Table)))
+	}
+
 	if route.Dst != nil {
 		prefixLength, _ := route.Dst.Mask.Size()
 		msg.Dst_len = uint8(prefixLength)
@@ -286,3 +292,74 @@ func AddIpRoute(route *Route) error {
 func DeleteIpRoute(route *Route) error {
 	return setIpRoute(route, false)
 }
+
+// Rule represents a netlink routing policy rule that looks up a route table.
+type Rule struct {
+	Family   int
+	Src      *net.IPNet
+	Table    int
+	Priority int
+
+	// SuppressDefaultRoute ignores the routes with a prefix length of zero in the table,
+	// such as default routes, so that the lookup continues with the next rule.
+	SuppressDefaultRoute bool
+}
+
+// setIpRule sends an IP rule set request.
+func setIpRule(rule *Rule, add bool) error {
+	var msgType, flags int
+
+	s, err := getSocket()
+	if err != nil {
+		return err
+	}
+
+	if add {
+		msgType = unix.RTM_NEWRULE
+		flags = unix.NLM_F_CREATE | unix.NLM_F_EXCL | unix.NLM_F_ACK
+	} else {
+		msgType = unix.RTM_DELRULE
+		flags = unix.NLM_F_ACK
+	}
+
+	req := newRequest(msgType, flags)
+
+	// Rule messages have the layout of route messages, with the action in place of the type.
+	msg := newRtMsg(rule.Family)
+	msg.Protocol = 0
+	msg.Scope = 0
+	msg.Type = FR_ACT_TO_TBL
+	if rule.Table <= 0xFF {
+		msg.Table = uint8(rule.Table)
+	}
+
+	req.addPayload(msg)
+
+	if rule.Src != nil {
+		prefixLength, _ := rule.Src.Mask.Size()
+		msg.Src_len = uint8(prefixLength)
+		req.addPayload(newAttributeIpAddress(FRA_SRC, rule.Src.IP))
+	}
+
+	req.addPayload(newAttributeUint32(FRA_TABLE, uint32(rule.Table)))
+
+	if rule.Priority != 0 {
+		req.addPayload(newAttributeUint32(FRA_PRIORITY, uint32(rule.Priority)))
+	}
+
+	if rule.SuppressDefaultRoute {
+		req.addPayload(newAttributeUint32(FRA_SUPPRESS_PREFIXLEN, 0))
+	}
+
+	return s.sendAndWaitForAck(req)
+}
+
+// AddIpRule adds an IP rule to the routing policy database.
+func AddIpRule(rule *Rule) error {
+	return setIpRule(rule, true)
+}
+
+// DeleteIpRule deletes an IP rule from the routing policy database.
+func DeleteIpRule(rule *Rule) error {
+	return setIpRule(rule, false)
+}
@@ -15,10 +15,13 @@ import (
 
 // Link types.
 const (
-	LINK_TYPE_BRIDGE = "bridge"
-	LINK_TYPE_VETH   = "veth"
-	LINK_TYPE_IPVLAN = "ipvlan"
-	LINK_TYPE_DUMMY  = "dummy"
+	LINK_TYPE_BRIDGE  = "bridge"
+	LINK_TYPE_VETH    = "veth"
+	LINK_TYPE_IPVLAN  = "ipvlan"
+	LINK_TYPE_MACVLAN = "macvlan"
+	LINK_TYPE_DUMMY   = "dummy"
+	LINK_TYPE_VXLAN   = "vxlan"
+	LINK_TYPE_VLAN    = "vlan"
 )
 
 // IPVLAN link attributes.
@@ -31,6 +34,16 @@ const (
 	IPVLAN_MODE_MAX
 )
 
+// MACVLAN link attributes.
+type MacVlanMode uint32
+
+const (
+	MACVLAN_MODE_PRIVATE  MacVlanMode = 1
+	MACVLAN_MODE_VEPA     MacVlanMode = 2
+	MACVLAN_MODE_BRIDGE   MacVlanMode = 4
+	MACVLAN_MODE_PASSTHRU MacVlanMode = 8
+)
+
 // Link represents a network interface.
 type Link interface {
 	Info() *LinkInfo
@@ -67,11 +80,31 @@ type IPVlanLink struct {
 	Mode IPVlanMode
 }
 
+// MacVlanLink represents a MacVlan network interface.
+type MacVlanLink struct {
+	LinkInfo
+	Mode MacVlanMode
+}
+
 // DummyLink represents a dummy network interface.
 type DummyLink struct {
 	LinkInfo
 }
 
+// VxlanLink represents a VXLAN tunnel endpoint over the parent interface.
+type VxlanLink struct {
+	LinkInfo
+	VxlanId  uint32
+	Port     uint16
+	Learning bool
+}
+
+// VlanLink represents an 802.1Q VLAN sub-interface of the parent interface.
+type VlanLink struct {
+	LinkInfo
+	VlanId uint16
+}
+
 // AddLink adds a new network interface of a specified type.
 func AddLink(link Link) error {
 	var info *LinkInfo
@@ -138,6 +171,34 @@ func AddLink(link Link) error {
 		attrData := newAttribute(IFLA_INFO_DATA, nil)
 		attrData.addNested(newAttributeUint16(IFLA_IPVLAN_MODE, uint16(ipvlan.Mode)))
 
+		attrLinkInfo.addNested(attrData)
+
+	} else if macvlan, ok := link.(*MacVlanLink); ok {
+		// Set MacVlan attributes.
+		attrData := newAttribute(IFLA_INFO_DATA, nil)
+		attrData.addNested(newAttributeUint32(IFLA_MACVLAN_MODE, uint32(macvlan.Mode)))
+
+		attrLinkInfo.addNested(attrData)
+
+	} else if vxlan, ok := link.(*VxlanLink); ok {
+		// Set VXLAN attributes.
+		attrData := newAttribute(IFLA_INFO_DATA, nil)
+		attrData.addNested(newAttributeUint32(IFLA_VXLAN_ID, vxlan.VxlanId))
+		if info.ParentIndex != 0 {
+			attrData.addNested(newAttributeUint32(IFLA_VXLAN_LINK, uint32(info.ParentIndex)))
+		}
+		if vxlan.Port != 0 {
+			attrData.addNested(newAttributeUint16BigEndian(IFLA_VXLAN_PORT, vxlan.Port))
+		}
+		attrData.addNested(newAttributeBool(IFLA_VXLAN_LEARNING, vxlan.Learning))
+
+		attrLinkInfo.addNested(attrData)
+
+	} else if vlan, ok := link.(*VlanLink); ok {
+		// Set VLAN attributes.
+		attrData := newAttribute(IFLA_INFO_DATA, nil)
+		attrData.addNested(newAttributeUint16(IFLA_VLAN_ID, vlan.VlanId))
+
 		attrLinkInfo.addNested(attrData)
 	}
 
@@ -320,6 +381,32 @@ func SetLinkAddress(ifName string, hwAddress net.HardwareAddr) error {
 	return s.sendAndWaitForAck(req)
 }
 
+// SetLinkMTU sets the MTU of a network interface.
+func SetLinkMTU(ifName string, mtu int) error {
+	s, err := getSocket()
+	if err != nil {
+		return err
+	}
+
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return err
+	}
+
+	req := newRequest(unix.RTM_SETLINK, unix.NLM_F_ACK)
+
+	ifInfo := newIfInfoMsg()
+	ifInfo.Type = unix.RTM_SETLINK
+	ifInfo.Index = int32(iface.Index)
+	ifInfo.Flags = unix.NLM_F_REQUEST
+	ifInfo.Change = DEFAULT_CHANGE
+	req.addPayload(ifInfo)
+
+	req.addPayload(newAttributeUint32(unix.IFLA_MTU, uint32(mtu)))
+
+	return s.sendAndWaitForAck(req)
+}
+
 // SetLinkPromisc sets the promiscuous mode of a network interface.
 func SetLinkPromisc(ifName string, on bool) error {
 	s, err := getSocket()
@@ -134,6 +134,80 @@ func TestAddDeleteIPVlan(t *testing.T) {
 	}
 }
 
+// TestAddDeleteMacVlan tests adding and deleting a MACVLAN interface.
+func TestAddDeleteMacVlan(t *testing.T) {
+	dummy, err := addDummyInterface(dummyName)
+	if err != nil {
+		t.Errorf("addDummyInterface failed: %v", err)
+	}
+
+	link := MacVlanLink{
+		LinkInfo: LinkInfo{
+			Type:        LINK_TYPE_MACVLAN,
+			Name:        ifName,
+			ParentIndex: dummy.Index,
+		},
+		Mode: MACVLAN_MODE_BRIDGE,
+	}
+
+	err = AddLink(&link)
+	if err != nil {
+		t.Errorf("AddLink failed: %+v", err)
+	}
+
+	err = DeleteLink(ifName)
+	if err != nil {
+		t.Errorf("DeleteLink failed: %+v", err)
+	}
+
+	_, err = net.InterfaceByName(ifName)
+	if err == nil {
+		t.Errorf("Interface not deleted")
+	}
+
+	err = DeleteLink(dummyName)
+	if err != nil {
+		t.Errorf("DeleteLink failed: %v", err)
+	}
+}
+
+// TestAddDeleteVlan tests adding and deleting a VLAN interface.
+func TestAddDeleteVlan(t *testing.T) {
+	dummy, err := addDummyInterface(dummyName)
+	if err != nil {
+		t.Errorf("addDummyInterface failed: %v", err)
+	}
+
+	link := VlanLink{
+		LinkInfo: LinkInfo{
+			Type:        LINK_TYPE_VLAN,
+			Name:        ifName,
+			ParentIndex: dummy.Index,
+		},
+		VlanId: 100,
+	}
+
+	err = AddLink(&link)
+	if err != nil {
+		t.Errorf("AddLink failed: %+v", err)
+	}
+
+	err = DeleteLink(ifName)
+	if err != nil {
+		t.Errorf("DeleteLink failed: %+v", err)
+	}
+
+	_, err = net.InterfaceByName(ifName)
+	if err == nil {
+		t.Errorf("Interface not deleted")
+	}
+
+	err = DeleteLink(dummyName)
+	if err != nil {
+		t.Errorf("DeleteLink failed: %v", err)
+	}
+}
+
 // TestSetLinkState tests setting the operational state of a network interface.
 func TestSetLinkState(t *testing.T) {
 	_, err := addDummyInterface(ifName)
@@ -234,3 +308,27 @@ func TestSetLinkHairpin(t *testing.T) {
 		t.Errorf("DeleteLink failed: %+v", err)
 	}
 }
+
+// TestSetLinkRateLimit tests adding, replacing and deleting a rate limit on a network interface.
+func TestSetLinkRateLimit(t *testing.T) {
+	_, err := addDummyInterface(ifName)
+	if err != nil {
+		t.Fatalf("addDummyInterface failed: %+v", err)
+	}
+	defer DeleteLink(ifName)
+
+	err = SetLinkRateLimit(ifName, 10*1000*1000)
+	if err != nil {
+		t.Errorf("SetLinkRateLimit failed: %+v", err)
+	}
+
+	err = SetLinkRateLimit(ifName, 100*1000*1000*1000)
+	if err != nil {
+		t.Errorf("SetLinkRateLimit replace failed: %+v", err)
+	}
+
+	err = DeleteLinkRateLimit(ifName)
+	if err != nil {
+		t.Errorf("DeleteLinkRateLimit failed: %+v", err)
+	}
+}
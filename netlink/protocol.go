@@ -15,13 +15,27 @@ import (
 
 // Netlink protocol constants that are not already defined in unix package.
 const (
-	IFLA_INFO_KIND   = 1
-	IFLA_INFO_DATA   = 2
-	IFLA_NET_NS_FD   = 28
-	IFLA_IPVLAN_MODE = 1
-	IFLA_BRPORT_MODE = 4
-	VETH_INFO_PEER   = 1
-	DEFAULT_CHANGE   = 0xFFFFFFFF
+	IFLA_INFO_KIND    = 1
+	IFLA_INFO_DATA    = 2
+	IFLA_NET_NS_FD    = 28
+	IFLA_IPVLAN_MODE  = 1
+	IFLA_MACVLAN_MODE = 1
+	IFLA_BRPORT_MODE  = 4
+	VETH_INFO_PEER    = 1
+	DEFAULT_CHANGE    = 0xFFFFFFFF
+
+	IFLA_VXLAN_ID       = 1
+	IFLA_VXLAN_LINK     = 3
+	IFLA_VXLAN_LEARNING = 7
+	IFLA_VXLAN_PORT     = 15
+
+	IFLA_VLAN_ID = 1
+
+	FRA_SRC                = 2
+	FRA_PRIORITY           = 6
+	FRA_SUPPRESS_PREFIXLEN = 14
+	FRA_TABLE              = 15
+	FR_ACT_TO_TBL          = 1
 )
 
 // Serializable types are used to construct netlink messages.
@@ -170,6 +184,21 @@ func newAttributeUint16(attrType int, value uint16) *attribute {
 	return newAttribute(attrType, buf)
 }
 
+// Creates a new attribute with a uint16 value in network byte order.
+func newAttributeUint16BigEndian(attrType int, value uint16) *attribute {
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, value)
+	return newAttribute(attrType, buf)
+}
+
+// Creates a new attribute with a boolean value.
+func newAttributeBool(attrType int, value bool) *attribute {
+	if value {
+		return newAttribute(attrType, []byte{1})
+	}
+	return newAttribute(attrType, []byte{0})
+}
+
 // Creates a new attribute with a net.IP value.
 func newAttributeIpAddress(attrType int, value net.IP) *attribute {
 	addr := value.To4()
@@ -0,0 +1,153 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+// +build linux
+
+package netlink
+
+import (
+	"math"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// Traffic control constants that are not already defined in unix package.
+const (
+	TCA_KIND       = 1
+	TCA_OPTIONS    = 2
+	TCA_TBF_PARMS  = 1
+	TCA_TBF_RATE64 = 4
+	TCA_TBF_BURST  = 6
+
+	TC_H_ROOT             = 0xFFFFFFFF
+	TC_LINKLAYER_ETHERNET = 1
+
+	QDISC_TYPE_TBF = "tbf"
+
+	// Handle of the root qdisc installed by this package, 1:0.
+	rootQdiscHandle = 0x10000
+
+	// Size of the tc_ratespec and tc_tbf_qopt structures.
+	sizeofTcRateSpec = 12
+	sizeofTbfQopt    = 2*sizeofTcRateSpec + 12
+
+	// Time worth of traffic allowed in a burst and queued, in milliseconds.
+	tbfBurstMs   = 10
+	tbfLatencyMs = 25
+
+	// Minimum burst size in bytes, large enough for a few full-size frames.
+	tbfMinBurst = 3 * 1500
+)
+
+// Traffic control message
+type tcMsg struct {
+	Family  uint8
+	Ifindex int32
+	Handle  uint32
+	Parent  uint32
+	Info    uint32
+}
+
+// Serializes a traffic control message.
+func (tc *tcMsg) serialize() []byte {
+	b := make([]byte, tc.length())
+	b[0] = tc.Family
+	encoder.PutUint32(b[4:8], uint32(tc.Ifindex))
+	encoder.PutUint32(b[8:12], tc.Handle)
+	encoder.PutUint32(b[12:16], tc.Parent)
+	encoder.PutUint32(b[16:20], tc.Info)
+	return b
+}
+
+// Returns the length of a traffic control message.
+func (tc *tcMsg) length() int {
+	return 20
+}
+
+// SetLinkRateLimit replaces the root qdisc of a network interface with a token bucket filter
+// that limits its egress traffic to the given rate in bits per second.
+func SetLinkRateLimit(ifName string, rate uint64) error {
+	s, err := getSocket()
+	if err != nil {
+		return err
+	}
+
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return err
+	}
+
+	req := newRequest(unix.RTM_NEWQDISC, unix.NLM_F_CREATE|unix.NLM_F_REPLACE|unix.NLM_F_ACK)
+
+	tc := &tcMsg{
+		Family:  unix.AF_UNSPEC,
+		Ifindex: int32(iface.Index),
+		Handle:  rootQdiscHandle,
+		Parent:  TC_H_ROOT,
+	}
+	req.addPayload(tc)
+	req.addPayload(newAttributeStringZ(TCA_KIND, QDISC_TYPE_TBF))
+
+	// Size the bucket and the queue by the time worth of traffic at the configured rate.
+	byteRate := rate / 8
+	burst := byteRate * tbfBurstMs / 1000
+	if burst < tbfMinBurst {
+		burst = tbfMinBurst
+	}
+	if burst > math.MaxUint32/2 {
+		burst = math.MaxUint32 / 2
+	}
+
+	limit := burst + byteRate*tbfLatencyMs/1000
+	if limit > math.MaxUint32 {
+		limit = math.MaxUint32
+	}
+
+	// Serialize tc_tbf_qopt. Rates that do not fit in 32 bits are passed separately.
+	qopt := make([]byte, sizeofTbfQopt)
+	qopt[1] = TC_LINKLAYER_ETHERNET
+	if byteRate < math.MaxUint32 {
+		encoder.PutUint32(qopt[8:12], uint32(byteRate))
+	} else {
+		encoder.PutUint32(qopt[8:12], math.MaxUint32)
+	}
+	encoder.PutUint32(qopt[2*sizeofTcRateSpec:], uint32(limit))
+
+	options := newAttribute(TCA_OPTIONS, nil)
+	options.addNested(newAttribute(TCA_TBF_PARMS, qopt))
+	options.addNested(newAttributeUint32(TCA_TBF_BURST, uint32(burst)))
+	if byteRate >= math.MaxUint32 {
+		rate64 := make([]byte, 8)
+		encoder.PutUint64(rate64, byteRate)
+		options.addNested(newAttribute(TCA_TBF_RATE64, rate64))
+	}
+	req.addPayload(options)
+
+	return s.sendAndWaitForAck(req)
+}
+
+// DeleteLinkRateLimit deletes the root qdisc of a network interface, restoring the default qdisc.
+func DeleteLinkRateLimit(ifName string) error {
+	s, err := getSocket()
+	if err != nil {
+		return err
+	}
+
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return err
+	}
+
+	req := newRequest(unix.RTM_DELQDISC, unix.NLM_F_ACK)
+
+	tc := &tcMsg{
+		Family:  unix.AF_UNSPEC,
+		Ifindex: int32(iface.Index),
+		Handle:  rootQdiscHandle,
+		Parent:  TC_H_ROOT,
+	}
+	req.addPayload(tc)
+
+	return s.sendAndWaitForAck(req)
+}
@@ -4,19 +4,117 @@
 package network
 
 import (
+	"errors"
 	"fmt"
+	"time"
+
+	"github.com/Azure/azure-container-networking/common"
 )
 
 var (
 	// Error responses returned by NetworkManager.
-	errSubnetNotFound         = fmt.Errorf("Subnet not found")
-	errNetworkModeInvalid     = fmt.Errorf("Network mode is invalid")
-	errNetworkExists          = fmt.Errorf("Network already exists")
-	errNetworkNotFound        = fmt.Errorf("Network not found")
-	errEndpointExists         = fmt.Errorf("Endpoint already exists")
-	errEndpointNotFound       = fmt.Errorf("Endpoint not found")
-	errNamespaceNotFound      = fmt.Errorf("Namespace not found")
-	errMultipleEndpointsFound = fmt.Errorf("Multiple endpoints found")
-	errEndpointInUse          = fmt.Errorf("Endpoint is already joined to a sandbox")
-	errEndpointNotInUse       = fmt.Errorf("Endpoint is not joined to a sandbox")
+	errSubnetNotFound         = common.NewError(common.ErrCodeInvalidArgument, "Subnet not found")
+	errNetworkModeInvalid     = common.NewError(common.ErrCodeInvalidConfig, "Network mode is invalid")
+	errNamespaceNotFound      = common.NewError(common.ErrCodeInvalidArgument, "Namespace not found")
+	errMultipleEndpointsFound = common.NewError(common.ErrCodeInvalidArgument, "Multiple endpoints found")
+	errEndpointInUse          = common.NewError(common.ErrCodeInvalidArgument, "Endpoint is already joined to a sandbox")
+	errEndpointNotInUse       = common.NewError(common.ErrCodeInvalidArgument, "Endpoint is not joined to a sandbox")
+
+	errMultipleIPAddressesOfSameFamily = common.NewError(common.ErrCodeInvalidArgument, "Endpoint has multiple IP addresses of the same family")
+	errMacAddressMismatch              = common.NewError(common.ErrCodeInvalidArgument, "Endpoint MAC address does not match the requested MAC address")
+	errQosPolicyNotSupported           = common.NewError(common.ErrCodeNotSupported, "QoS policy is not supported by HNS on this Windows build")
+	errHcnDNSUpdateNotSupported        = common.NewError(common.ErrCodeNotSupported, "DNS settings of endpoints created with HCN cannot be updated")
+	errEndpointNameCollision           = common.NewError(common.ErrCodeEndpointExists, "Endpoint name is already in use by another container")
+	errEndpointStatsNotSupported       = common.NewError(common.ErrCodeNotSupported, "Endpoint statistics are not supported on this platform")
+	errLoopbackDSRNotSupported         = common.NewError(common.ErrCodeNotSupported, "Loopback DSR is unsupported on this OS build")
+	errInvalidVlanID                   = common.NewError(common.ErrCodeInvalidConfig, "VLAN ID is out of range")
+	errVlanInUse                       = common.NewError(common.ErrCodeInvalidConfig, "VLAN is already used by another network on the master interface")
+	errNetworkVlanNotSupported         = common.NewError(common.ErrCodeNotSupported, "Network VLAN is not supported in this network mode")
+	errNetworkPolicyNotSupported       = common.NewError(common.ErrCodeNotSupported, "Network policies are not supported in this network mode")
+	errHostDeviceNotFound              = common.NewError(common.ErrCodeInvalidConfig, "Host device not found")
+	errIpvlanModeInvalid               = common.NewError(common.ErrCodeInvalidConfig, "Ipvlan mode is invalid")
+	errConflictingRoutes               = common.NewError(common.ErrCodeInvalidConfig, "Routes to the same destination have different gateways")
+	errSysctlNotAllowed                = common.NewError(common.ErrCodeInvalidConfig, "Sysctl is not allowed")
+	errSysctlRequiresNetNs             = common.NewError(common.ErrCodeInvalidConfig, "Sysctls require a container network namespace")
+	errNetworkPruned                   = common.NewError(common.ErrCodeNetworkNotFound, "Network no longer exists on the host and is pending cleanup")
+	errSubnetGatewayMissing            = common.NewError(common.ErrCodeInvalidConfig, "Subnet has no gateway")
+	errSubnetsOverlap                  = common.NewError(common.ErrCodeInvalidConfig, "Subnets overlap")
+	errOverlayNotSupported             = common.NewError(common.ErrCodeNotSupported, "Overlay networks are unsupported on this OS build")
+	errNetworkUpdateNotSupported       = common.NewError(common.ErrCodeNotSupported, "Adding subnets to networks is unsupported on this OS build")
+	errVxlanIdInvalid                  = common.NewError(common.ErrCodeInvalidConfig, "VXLAN ID is out of range")
+	errVxlanPortInvalid                = common.NewError(common.ErrCodeInvalidConfig, "VXLAN port is out of range")
+	errRemoteEndpointNotSupported      = common.NewError(common.ErrCodeNotSupported, "Remote endpoints are not supported by this network")
+	errRemoteEndpointInvalid           = common.NewError(common.ErrCodeInvalidArgument, "Remote endpoint has no MAC address or node IP address")
+	errRemoteEndpointNotFound          = common.NewError(common.ErrCodeEndpointNotFound, "Remote endpoint not found")
+	errPortOutOfRange                  = common.NewError(common.ErrCodeInvalidConfig, "Port mapping port is out of range")
+	errPortMappingProtocolInvalid      = common.NewError(common.ErrCodeInvalidConfig, "Port mapping protocol must be tcp or udp")
+	errPortMappingHostIPNotSupported   = common.NewError(common.ErrCodeNotSupported, "Port mappings to a specific host IP are not supported")
+)
+
+var (
+	// Errors returned by NetworkManager that callers can test for with errors.Is.
+	ErrNetworkNotFound  = common.NewError(common.ErrCodeNetworkNotFound, "Network not found")
+	ErrNetworkExists    = common.NewError(common.ErrCodeNetworkExists, "Network already exists")
+	ErrEndpointNotFound = common.NewError(common.ErrCodeEndpointNotFound, "Endpoint not found")
+	ErrEndpointExists   = common.NewError(common.ErrCodeEndpointExists, "Endpoint already exists")
+	ErrHNSFailure       = common.NewError(common.ErrCodeHNSFailure, "HNS request failed")
+	ErrSubnetInUse      = common.NewError(common.ErrCodeSubnetInUse, "Subnet is in use")
 )
+
+var (
+	// Endpoint address validation errors that callers can test for.
+	ErrNoIPAddress        = common.NewError(common.ErrCodeInvalidArgument, "Endpoint has no IP address")
+	ErrTooManyIPAddresses = common.NewError(common.ErrCodeInvalidArgument, "Endpoint has more IP addresses than supported")
+)
+
+// HNSTimeoutError is returned when an HNS request does not complete within its deadline.
+// The request may still complete in the background, so callers should fail the operation
+// as retryable instead of retrying it immediately.
+type HNSTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *HNSTimeoutError) Error() string {
+	return fmt.Sprintf("HNS request timed out after %v", e.Timeout)
+}
+
+// Is makes timed out requests match ErrHNSFailure.
+func (e *HNSTimeoutError) Is(target error) bool {
+	return target == ErrHNSFailure
+}
+
+// ErrorCode returns common.ErrCodeHNSTimeout.
+func (e *HNSTimeoutError) ErrorCode() common.ErrorCode {
+	return common.ErrCodeHNSTimeout
+}
+
+// IsHNSTimeoutError returns true if the error is or wraps an HNS request timeout.
+func IsHNSTimeoutError(err error) bool {
+	var timeoutErr *HNSTimeoutError
+	return errors.As(err, &timeoutErr)
+}
+
+// HNSError is returned when an HNS request fails. It keeps the text of the HNS error it wraps,
+// and matches ErrHNSFailure.
+type HNSError struct {
+	Err error
+}
+
+func (e *HNSError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the HNS error.
+func (e *HNSError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes failed requests match ErrHNSFailure.
+func (e *HNSError) Is(target error) bool {
+	return target == ErrHNSFailure
+}
+
+// ErrorCode returns common.ErrCodeHNSFailure.
+func (e *HNSError) ErrorCode() common.ErrorCode {
+	return common.ErrCodeHNSFailure
+}
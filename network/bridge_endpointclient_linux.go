@@ -1,7 +1,10 @@
 package network
 
 import (
+	"fmt"
+	"io/ioutil"
 	"net"
+	"strings"
 
 	"github.com/Azure/azure-container-networking/ebtables"
 	"github.com/Azure/azure-container-networking/log"
@@ -9,6 +12,20 @@ import (
 	"github.com/Azure/azure-container-networking/network/epcommon"
 )
 
+const (
+	// Paths of the host veth interface settings.
+	proxyArpPathFormat    = "/proc/sys/net/ipv4/conf/%s/proxy_arp"
+	forwardingPathFormat  = "/proc/sys/net/ipv4/conf/%s/forwarding"
+	hairpinModePathFormat = "/sys/class/net/%s/brport/hairpin_mode"
+	operStatePathFormat   = "/sys/class/net/%s/operstate"
+)
+
+// Sysfs accessors, replaceable for testing.
+var (
+	readSysfsFile  = ioutil.ReadFile
+	writeSysfsFile = ioutil.WriteFile
+)
+
 type LinuxBridgeEndpointClient struct {
 	bridgeName        string
 	hostPrimaryIfName string
@@ -17,6 +34,14 @@ type LinuxBridgeEndpointClient struct {
 	hostPrimaryMac    net.HardwareAddr
 	containerMac      net.HardwareAddr
 	mode              string
+	subnets           []string
+
+	// Whether the bridge is not connected to the external interface, as in overlay and VLAN networks.
+	standaloneBridge bool
+
+	// Host veth settings, driven by the network mode.
+	EnableProxyArp bool
+	EnableHairpin  bool
 }
 
 func NewLinuxBridgeEndpointClient(
@@ -33,11 +58,26 @@ func NewLinuxBridgeEndpointClient(
 		containerVethName: containerVethName,
 		hostPrimaryMac:    extIf.MacAddress,
 		mode:              mode,
+		subnets:           extIf.Subnets,
 	}
 
+	client.EnableProxyArp, client.EnableHairpin = getHostVethSettings(mode)
+
 	return client
 }
 
+// getHostVethSettings returns whether proxy ARP and hairpin mode are enabled on host veth
+// interfaces in the given network mode. Bridged modes rely on the bridge for neighbor
+// resolution and only need hairpinning so that containers can reach themselves via services.
+func getHostVethSettings(mode string) (enableProxyArp bool, enableHairpin bool) {
+	switch mode {
+	case opModeBridge, opModeTunnel, opModeOverlay:
+		return false, true
+	default:
+		return false, false
+	}
+}
+
 func (client *LinuxBridgeEndpointClient) AddEndpoints(epInfo *EndpointInfo) error {
 	if err := epcommon.CreateEndpoint(client.hostVethName, client.containerVethName); err != nil {
 		return err
@@ -60,11 +100,25 @@ func (client *LinuxBridgeEndpointClient) AddEndpointRules(epInfo *EndpointInfo)
 		return err
 	}
 
+	// Bridges that are not connected to the external interface learn container MAC addresses
+	// like any other bridge, so they need no address resolution or MAC translation rules.
+	if client.standaloneBridge {
+		return client.configureHostVeth()
+	}
+
 	for _, ipAddr := range epInfo.IPAddresses {
-		// Add ARP reply rule.
-		log.Printf("[net] Adding ARP reply rule for IP address %v", ipAddr.String())
-		if err = ebtables.SetArpReply(ipAddr.IP, client.getArpReplyAddress(client.containerMac), ebtables.Append); err != nil {
-			return err
+		if ipAddr.IP.To4() != nil {
+			// Add ARP reply rule.
+			log.Printf("[net] Adding ARP reply rule for IP address %v", ipAddr.String())
+			if err = ebtables.SetArpReply(ipAddr.IP, client.getArpReplyAddress(client.containerMac), ebtables.Append); err != nil {
+				return err
+			}
+		} else {
+			// IPv6 neighbor discovery is not covered by ARP reply rules, add a static neighbor entry instead.
+			log.Printf("[net] Adding neighbor entry for IP address %v on %v.", ipAddr.String(), client.bridgeName)
+			if err = epcommon.AddStaticNeighbor(client.bridgeName, ipAddr.IP, client.containerMac); err != nil {
+				return err
+			}
 		}
 
 		// Add MAC address translation rule.
@@ -74,23 +128,77 @@ func (client *LinuxBridgeEndpointClient) AddEndpointRules(epInfo *EndpointInfo)
 		}
 	}
 
-	log.Printf("[net] Setting hairpin for hostveth %v", client.hostVethName)
-	if err := netlink.SetLinkHairpin(client.hostVethName, true); err != nil {
-		log.Printf("Setting up hairpin failed for interface %v error %v", client.hostVethName, err)
-		return err
+	// Addresses outside the subnets of the bridge, such as service VIPs, are routed to the bridge.
+	for _, ipAddr := range client.getOffSubnetAddresses(epInfo.IPAddresses) {
+		log.Printf("[net] Adding host route for IP address %v via %v.", ipAddr.IP.String(), client.bridgeName)
+		if err := setHostRoute(client.bridgeName, ipAddr.IP, true); err != nil {
+			return err
+		}
+	}
+
+	return client.configureHostVeth()
+}
+
+// configureHostVeth applies the proxy ARP, forwarding and hairpin settings to the host veth interface
+// and verifies that the kernel accepted them.
+func (client *LinuxBridgeEndpointClient) configureHostVeth() error {
+	settings := []struct {
+		path string
+		on   bool
+	}{
+		{fmt.Sprintf(proxyArpPathFormat, client.hostVethName), client.EnableProxyArp},
+		{fmt.Sprintf(forwardingPathFormat, client.hostVethName), client.EnableProxyArp},
+		{fmt.Sprintf(hairpinModePathFormat, client.hostVethName), client.EnableHairpin},
+	}
+
+	for _, setting := range settings {
+		value := "0"
+		if setting.on {
+			value = "1"
+		}
+
+		log.Printf("[net] Setting %v to %v.", setting.path, value)
+		if err := writeSysfsFile(setting.path, []byte(value), 0644); err != nil {
+			log.Printf("[net] Failed to set %v: %v.", setting.path, err)
+			return err
+		}
+
+		actual, err := readSysfsFile(setting.path)
+		if err != nil {
+			return err
+		}
+
+		if strings.TrimSpace(string(actual)) != value {
+			return fmt.Errorf("Failed to set %v to %v, kernel reports %v", setting.path, value, strings.TrimSpace(string(actual)))
+		}
 	}
 
 	return nil
 }
 
 func (client *LinuxBridgeEndpointClient) DeleteEndpointRules(ep *endpoint) {
+	if client.standaloneBridge {
+		return
+	}
+
 	// Delete rules for IP addresses on the container interface.
 	for _, ipAddr := range ep.IPAddresses {
-		// Delete ARP reply rule.
-		log.Printf("[net] Deleting ARP reply rule for IP address %v on %v.", ipAddr.String(), ep.Id)
-		err := ebtables.SetArpReply(ipAddr.IP, client.getArpReplyAddress(ep.MacAddress), ebtables.Delete)
-		if err != nil {
-			log.Printf("[net] Failed to delete ARP reply rule for IP address %v: %v.", ipAddr.String(), err)
+		var err error
+
+		if ipAddr.IP.To4() != nil {
+			// Delete ARP reply rule.
+			log.Printf("[net] Deleting ARP reply rule for IP address %v on %v.", ipAddr.String(), ep.Id)
+			err = ebtables.SetArpReply(ipAddr.IP, client.getArpReplyAddress(ep.MacAddress), ebtables.Delete)
+			if err != nil {
+				log.Printf("[net] Failed to delete ARP reply rule for IP address %v: %v.", ipAddr.String(), err)
+			}
+		} else {
+			// Delete neighbor entry.
+			log.Printf("[net] Deleting neighbor entry for IP address %v on %v.", ipAddr.String(), ep.Id)
+			err = epcommon.DeleteStaticNeighbor(client.bridgeName, ipAddr.IP)
+			if err != nil {
+				log.Printf("[net] Failed to delete neighbor entry for IP address %v: %v.", ipAddr.String(), err)
+			}
 		}
 
 		// Delete MAC address translation rule.
@@ -100,6 +208,45 @@ func (client *LinuxBridgeEndpointClient) DeleteEndpointRules(ep *endpoint) {
 			log.Printf("[net] Failed to delete MAC DNAT rule for IP address %v: %v.", ipAddr.String(), err)
 		}
 	}
+
+	for _, ipAddr := range client.getOffSubnetAddresses(ep.IPAddresses) {
+		log.Printf("[net] Deleting host route for IP address %v via %v.", ipAddr.IP.String(), client.bridgeName)
+		if err := setHostRoute(client.bridgeName, ipAddr.IP, false); err != nil {
+			log.Printf("[net] Failed to delete host route for IP address %v: %v.", ipAddr.IP.String(), err)
+		}
+	}
+}
+
+// getOffSubnetAddresses returns the addresses that are not in any subnet of the bridge.
+// If the subnets of the bridge are unknown, no address is considered off-subnet.
+func (client *LinuxBridgeEndpointClient) getOffSubnetAddresses(ipAddresses []net.IPNet) []net.IPNet {
+	var subnets []*net.IPNet
+	for _, subnet := range client.subnets {
+		if _, ipNet, err := net.ParseCIDR(subnet); err == nil {
+			subnets = append(subnets, ipNet)
+		}
+	}
+
+	if len(subnets) == 0 {
+		return nil
+	}
+
+	var offSubnet []net.IPNet
+	for _, ipAddr := range ipAddresses {
+		inSubnet := false
+		for _, subnet := range subnets {
+			if subnet.Contains(ipAddr.IP) {
+				inSubnet = true
+				break
+			}
+		}
+
+		if !inSubnet {
+			offSubnet = append(offSubnet, ipAddr)
+		}
+	}
+
+	return offSubnet
 }
 
 // getArpReplyAddress returns the MAC address to use in ARP replies.
@@ -119,7 +266,7 @@ func (client *LinuxBridgeEndpointClient) getArpReplyAddress(epMacAddress net.Har
 
 func (client *LinuxBridgeEndpointClient) MoveEndpointsToContainerNS(epInfo *EndpointInfo, nsID uintptr) error {
 	// Move the container interface to container's network namespace.
-	log.Printf("[net] Setting link %v netns %v.", client.containerVethName, epInfo.NetNsPath)
+	log.Printf("[net] Setting link %v netns %v.", client.containerVethName, epInfo.NetNs)
 	if err := netlink.SetLinkNetNs(client.containerVethName, nsID); err != nil {
 		return err
 	}
@@ -138,6 +285,12 @@ func (client *LinuxBridgeEndpointClient) SetupContainerInterfaces(epInfo *Endpoi
 }
 
 func (client *LinuxBridgeEndpointClient) ConfigureContainerInterfacesAndRoutes(epInfo *EndpointInfo) error {
+	if epcommon.HasIPv6Address(epInfo.IPAddresses) {
+		if err := epcommon.ConfigureIPv6Interface(client.containerVethName, acceptIPv6RouterAdvertisements(epInfo.Secondary, epInfo.Routes)); err != nil {
+			return err
+		}
+	}
+
 	if err := epcommon.AssignIPToInterface(client.containerVethName, epInfo.IPAddresses); err != nil {
 		return err
 	}
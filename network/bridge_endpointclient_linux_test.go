@@ -0,0 +1,108 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+// fakeSysfs records sysfs writes and returns them on reads.
+type fakeSysfs struct {
+	files  map[string]string
+	reject map[string]bool
+}
+
+func newFakeSysfs() *fakeSysfs {
+	fs := &fakeSysfs{files: make(map[string]string), reject: make(map[string]bool)}
+
+	writeSysfsFile = func(path string, data []byte, perm os.FileMode) error {
+		if !fs.reject[path] {
+			fs.files[path] = string(data)
+		}
+		return nil
+	}
+
+	readSysfsFile = func(path string) ([]byte, error) {
+		value, ok := fs.files[path]
+		if !ok {
+			return nil, fmt.Errorf("%v not found", path)
+		}
+		return []byte(value + "\n"), nil
+	}
+
+	return fs
+}
+
+// TestConfigureHostVethByMode tests the host veth settings written for each network mode.
+func TestConfigureHostVethByMode(t *testing.T) {
+	tests := []struct {
+		mode       string
+		proxyArp   string
+		forwarding string
+		hairpin    string
+	}{
+		{opModeBridge, "0", "0", "1"},
+		{opModeTunnel, "0", "0", "1"},
+	}
+
+	defer func() { readSysfsFile, writeSysfsFile = ioutil.ReadFile, ioutil.WriteFile }()
+
+	for _, tt := range tests {
+		fs := newFakeSysfs()
+		client := NewLinuxBridgeEndpointClient(&externalInterface{Name: "eth0"}, "azvtest", "azvtest-2", tt.mode)
+
+		if err := client.configureHostVeth(); err != nil {
+			t.Fatalf("configureHostVeth failed for mode %v: %v", tt.mode, err)
+		}
+
+		expected := map[string]string{
+			"/proc/sys/net/ipv4/conf/azvtest/proxy_arp":  tt.proxyArp,
+			"/proc/sys/net/ipv4/conf/azvtest/forwarding": tt.forwarding,
+			"/sys/class/net/azvtest/brport/hairpin_mode": tt.hairpin,
+		}
+
+		for path, value := range expected {
+			if fs.files[path] != value {
+				t.Errorf("Mode %v: expected %v to be %v, got %q", tt.mode, path, value, fs.files[path])
+			}
+		}
+	}
+}
+
+// TestConfigureHostVethRejected tests that settings rejected by the kernel fail the endpoint creation.
+func TestConfigureHostVethRejected(t *testing.T) {
+	fs := newFakeSysfs()
+	defer func() { readSysfsFile, writeSysfsFile = ioutil.ReadFile, ioutil.WriteFile }()
+
+	fs.files["/sys/class/net/azvtest/brport/hairpin_mode"] = "0"
+	fs.reject["/sys/class/net/azvtest/brport/hairpin_mode"] = true
+
+	client := NewLinuxBridgeEndpointClient(&externalInterface{Name: "eth0"}, "azvtest", "azvtest-2", opModeBridge)
+
+	if err := client.configureHostVeth(); err == nil {
+		t.Errorf("configureHostVeth succeeded although the kernel rejected hairpin mode")
+	}
+}
+
+// TestGetOffSubnetAddresses tests that only addresses outside the bridge subnets get host routes.
+func TestGetOffSubnetAddresses(t *testing.T) {
+	primary := net.IPNet{IP: net.ParseIP("10.0.0.4"), Mask: net.CIDRMask(16, 32)}
+	secondary := net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(16, 32)}
+	vip := net.IPNet{IP: net.ParseIP("192.168.10.1"), Mask: net.CIDRMask(32, 32)}
+
+	client := &LinuxBridgeEndpointClient{subnets: []string{"10.0.0.0/16"}}
+	offSubnet := client.getOffSubnetAddresses([]net.IPNet{primary, secondary, vip})
+	if len(offSubnet) != 1 || !offSubnet[0].IP.Equal(vip.IP) {
+		t.Errorf("Expected only %v to be off-subnet, got %v", vip.IP, offSubnet)
+	}
+
+	client = &LinuxBridgeEndpointClient{}
+	if offSubnet := client.getOffSubnetAddresses([]net.IPNet{primary, vip}); len(offSubnet) != 0 {
+		t.Errorf("Expected no off-subnet addresses without known subnets, got %v", offSubnet)
+	}
+}
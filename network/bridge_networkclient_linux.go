@@ -68,7 +68,7 @@ func (client *LinuxBridgeClient) AddL2Rules(extIf *externalInterface) error {
 	// Add ARP reply rule for host primary IP address.
 	// ARP requests for all IP addresses are forwarded to the SDN fabric, but fabric
 	// doesn't respond to ARP requests from the VM for its own primary IP address.
-	primary := extIf.IPAddresses[0].IP
+	primary := extIf.getPrimaryIPAddress()
 	log.Printf("[net] Adding ARP reply rule for primary IP address %v.", primary)
 	if err := ebtables.SetArpReply(primary, hostIf.HardwareAddr, ebtables.Append); err != nil {
 		return err
@@ -94,7 +94,7 @@ func (client *LinuxBridgeClient) AddL2Rules(extIf *externalInterface) error {
 func (client *LinuxBridgeClient) DeleteL2Rules(extIf *externalInterface) {
 	ebtables.SetVepaMode(client.bridgeName, commonInterfacePrefix, virtualMacAddress, ebtables.Delete)
 	ebtables.SetDnatForArpReplies(extIf.Name, ebtables.Delete)
-	ebtables.SetArpReply(extIf.IPAddresses[0].IP, extIf.MacAddress, ebtables.Delete)
+	ebtables.SetArpReply(extIf.getPrimaryIPAddress(), extIf.MacAddress, ebtables.Delete)
 	ebtables.SetSnatForInterface(extIf.Name, extIf.MacAddress, ebtables.Delete)
 }
 
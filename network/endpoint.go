@@ -4,14 +4,23 @@
 package network
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
 	"net"
+	"strings"
+	"time"
 
+	"github.com/Azure/azure-container-networking/common"
 	"github.com/Azure/azure-container-networking/log"
 	"github.com/Azure/azure-container-networking/network/policy"
 )
 
 const (
 	InfraVnet = 0
+
+	// Number of hex characters of the container ID hash in hashed endpoint IDs.
+	endpointIDHashLength = 8
 )
 
 // Endpoint represents a container network interface.
@@ -26,6 +35,7 @@ type endpoint struct {
 	IPAddresses           []net.IPNet
 	Gateways              []net.IP
 	DNS                   DNSInfo
+	SearchDomains         []string `json:",omitempty"`
 	Routes                []RouteInfo
 	VlanID                int
 	EnableSnatOnHost      bool
@@ -33,42 +43,125 @@ type endpoint struct {
 	EnableMultitenancy    bool
 	NetworkNameSpace      string `json:",omitempty"`
 	ContainerID           string
-	PODName               string `json:",omitempty"`
-	PODNameSpace          string `json:",omitempty"`
-	InfraVnetAddressSpace string `json:",omitempty"`
+	Attached              bool          `json:",omitempty"`
+	PortMappings          []PortMapping `json:",omitempty"`
+	InfraEndpointId       string        `json:",omitempty"`
+	RefCount              int           `json:",omitempty"`
+	HNSTimeout            time.Duration `json:",omitempty"`
+	NetworkCompartmentID  uint16        `json:",omitempty"`
+	MTU                   int           `json:",omitempty"`
+	HostDeviceName        string        `json:",omitempty"`
+	HostDeviceNetNsPath   string        `json:",omitempty"`
+	IngressRate           uint64        `json:",omitempty"`
+	EgressRate            uint64        `json:",omitempty"`
+	Broken                bool          `json:",omitempty"`
+	Stale                 bool          `json:",omitempty"`
+	PODName               string        `json:",omitempty"`
+	PODNameSpace          string        `json:",omitempty"`
+	InfraVnetAddressSpace string        `json:",omitempty"`
+	HNSAPIVersion         int           `json:",omitempty"`
+	Secondary             bool          `json:",omitempty"`
+	CreatedTime           time.Time
 }
 
 // EndpointInfo contains read-only information about an endpoint.
+//
+// A container attached to multiple networks has a primary endpoint, its first one, which programs the
+// default routes and DNS settings of the container. CreateEndpoint sets Secondary on the endpoints that
+// it creates for containers that already have a primary endpoint. It can also be set to request one.
+//
+// DNS holds the settings of the endpoint itself, while SearchDomains is set by the network manager to
+// the search domains programmed in the container, those of the network followed by those in DNS.
 type EndpointInfo struct {
-	Id                    string
-	ContainerID           string
-	NetNsPath             string
-	IfName                string
-	SandboxKey            string
-	IfIndex               int
-	MacAddress            net.HardwareAddr
-	DNS                   DNSInfo
-	IPAddresses           []net.IPNet
-	InfraVnetIP           net.IPNet
-	Routes                []RouteInfo
-	Policies              []policy.Policy
-	Gateways              []net.IP
-	EnableSnatOnHost      bool
-	EnableInfraVnet       bool
-	EnableMultiTenancy    bool
-	PODName               string
-	PODNameSpace          string
-	Data                  map[string]interface{}
-	InfraVnetAddressSpace string
+	Id                        string
+	NetworkId                 string
+	ContainerID               string
+	NetNs                     *common.Namespace
+	IfName                    string
+	SandboxKey                string
+	IfIndex                   int
+	MacAddress                net.HardwareAddr
+	DNS                       DNSInfo
+	SearchDomains             []string
+	IPAddresses               []net.IPNet
+	InfraVnetIP               net.IPNet
+	Routes                    []RouteInfo
+	Policies                  []policy.Policy
+	ACLPolicies               []policy.ACLPolicy
+	Gateways                  []net.IP
+	EnableSnatOnHost          bool
+	OutBoundNatExceptionList  []string
+	PortMappings              []PortMapping
+	EnableInfraVnet           bool
+	EnableMultiTenancy        bool
+	PODName                   string
+	PODNameSpace              string
+	Data                      map[string]interface{}
+	InfraVnetAddressSpace     string
+	RetryPolicy               *RetryPolicy
+	HashedEndpointID          bool
+	HNSTimeout                time.Duration
+	EnableLoopbackDSR         bool
+	NetworkCompartmentID      uint16
+	AllowHNSAssignedIPAddress bool
+	MTU                       int
+	HostDeviceName            string
+	DisableTxChecksumOffload  bool
+	IngressRate               uint64
+	EgressRate                uint64
+	Sysctls                   map[string]string
+	Secondary                 bool
+}
+
+// EndpointFilter selects the endpoints returned by GetEndpointInfos. Empty fields match any endpoint.
+type EndpointFilter struct {
+	ContainerID string
+	IfName      string
+}
+
+// RetryPolicy controls how transient platform failures are retried during endpoint operations.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// PortMapping contains information about a container port published on the host.
+type PortMapping struct {
+	Protocol      string
+	HostPort      int
+	ContainerPort int
+	HostIP        net.IP `json:",omitempty"`
+}
+
+// EndpointStats contains the traffic counters of an endpoint.
+type EndpointStats struct {
+	BytesReceived          uint64
+	BytesSent              uint64
+	PacketsReceived        uint64
+	PacketsSent            uint64
+	DroppedPacketsIncoming uint64
+	DroppedPacketsOutgoing uint64
 }
 
 // RouteInfo contains information about an IP route.
+// A route without a gateway is a device-only (on-link) route.
 type RouteInfo struct {
 	Dst     net.IPNet
 	Gw      net.IP
+	Src     net.IP `json:",omitempty"`
 	DevName string
+	Metric  int `json:",omitempty"`
+	Scope   int `json:",omitempty"`
 }
 
+// Route scopes, matching the values used by the Linux kernel.
+const (
+	RouteScopeUniverse = 0
+	RouteScopeLink     = 253
+	RouteScopeHost     = 254
+)
+
 // NewEndpoint creates a new endpoint in the network.
 func (nw *network) newEndpoint(epInfo *EndpointInfo) (*endpoint, error) {
 	var ep *endpoint
@@ -81,12 +174,39 @@ func (nw *network) newEndpoint(epInfo *EndpointInfo) (*endpoint, error) {
 		}
 	}()
 
+	// Only the primary endpoint of a container programs its default routes and DNS settings.
+	// Other endpoints inherit the DNS settings of the network that they do not override.
+	if epInfo.Secondary {
+		epInfo.Routes = removeDefaultRoutes(epInfo.Routes)
+		epInfo.DNS = DNSInfo{}
+		epInfo.SearchDomains = nil
+	} else {
+		epInfo.DNS = epInfo.DNS.inherit(nw.DNS)
+		epInfo.SearchDomains = nw.getSearchDomains(epInfo.DNS)
+	}
+
+	if epInfo.RetryPolicy == nil {
+		epInfo.RetryPolicy = nw.RetryPolicy
+	}
+
+	// Endpoints may lower the MTU of the network, but not raise it.
+	if nw.MTU > 0 && epInfo.MTU > nw.MTU {
+		err = fmt.Errorf("Endpoint MTU %v exceeds network MTU %v", epInfo.MTU, nw.MTU)
+		return nil, err
+	}
+
 	// Call the platform implementation.
 	ep, err = nw.newEndpointImpl(epInfo)
 	if err != nil {
 		return nil, err
 	}
 
+	if ep.CreatedTime.IsZero() {
+		ep.CreatedTime = time.Now()
+	}
+
+	ep.Secondary = ep.Secondary || epInfo.Secondary
+
 	nw.Endpoints[epInfo.Id] = ep
 	log.Printf("[net] Created endpoint %+v.", ep)
 
@@ -107,18 +227,23 @@ func (nw *network) deleteEndpoint(endpointId string) error {
 	// Look up the endpoint.
 	ep, err := nw.getEndpoint(endpointId)
 	if err != nil {
-		log.Printf("[net] Endpoint %v not found. Not Returning error", endpointId)
-		return nil
+		return err
 	}
 
 	// Call the platform implementation.
 	err = nw.deleteEndpointImpl(ep)
 	if err != nil {
-		return err
+		// Platform resources of stale endpoints were deleted along with their network.
+		if !ep.Stale {
+			return err
+		}
+
+		log.Printf("[net] Ignoring failure to delete stale endpoint %v, err:%v.", ep.Id, err)
+		err = nil
 	}
 
 	// Remove the endpoint object.
-	delete(nw.Endpoints, endpointId)
+	delete(nw.Endpoints, ep.Id)
 
 	log.Printf("[net] Deleted endpoint %+v.", ep)
 
@@ -131,8 +256,16 @@ func (nw *network) getEndpoint(endpointId string) (*endpoint, error) {
 
 	ep := nw.Endpoints[endpointId]
 
+	// Endpoints created before hashed endpoint IDs were enabled are stored under their legacy ID.
 	if ep == nil {
-		return nil, errEndpointNotFound
+		if legacyId := getLegacyEndpointID(endpointId); legacyId != "" {
+			log.Printf("Trying to retrieve endpoint with legacy id %v", legacyId)
+			ep = nw.Endpoints[legacyId]
+		}
+	}
+
+	if ep == nil {
+		return nil, ErrEndpointNotFound
 	}
 
 	return ep, nil
@@ -155,7 +288,7 @@ func (nw *network) getEndpointByPOD(podName string, podNameSpace string) (*endpo
 	}
 
 	if ep == nil {
-		return nil, errEndpointNotFound
+		return nil, ErrEndpointNotFound
 	}
 
 	return ep, nil
@@ -176,14 +309,20 @@ func (ep *endpoint) getInfo() *EndpointInfo {
 		SandboxKey:         ep.SandboxKey,
 		IfIndex:            0, // Azure CNI supports only one interface
 		DNS:                ep.DNS,
+		SearchDomains:      ep.SearchDomains,
 		EnableSnatOnHost:   ep.EnableSnatOnHost,
 		EnableInfraVnet:    ep.EnableInfraVnet,
 		EnableMultiTenancy: ep.EnableMultitenancy,
 		IfName:             ep.IfName,
 		ContainerID:        ep.ContainerID,
-		NetNsPath:          ep.NetworkNameSpace,
 		PODName:            ep.PODName,
 		PODNameSpace:       ep.PODNameSpace,
+		Secondary:          ep.Secondary,
+	}
+
+	// The namespace was validated when the endpoint was created.
+	if ep.NetworkNameSpace != "" {
+		info.NetNs, _ = common.NamespaceFromPath(ep.NetworkNameSpace)
 	}
 
 	for _, route := range ep.Routes {
@@ -200,6 +339,51 @@ func (ep *endpoint) getInfo() *EndpointInfo {
 	return info
 }
 
+// removeDefaultRoutes returns the routes other than the default routes of both address families.
+func removeDefaultRoutes(routes []RouteInfo) []RouteInfo {
+	var remaining []RouteInfo
+	for _, route := range routes {
+		if ones, _ := route.Dst.Mask.Size(); ones == 0 && route.Dst.IP.IsUnspecified() {
+			log.Printf("[net] Skipping default route %+v of secondary endpoint.", route)
+			continue
+		}
+
+		remaining = append(remaining, route)
+	}
+
+	return remaining
+}
+
+// hasPrimaryEndpoint returns true if the network has a primary endpoint of the given container
+// other than the given endpoint.
+func (nw *network) hasPrimaryEndpoint(containerID string, endpointId string) bool {
+	for _, ep := range nw.Endpoints {
+		if ep.ContainerID == containerID && ep.Id != endpointId && !ep.Secondary {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateRoutes checks that no two routes send the same destination to different gateways,
+// which the platform would otherwise reject depending on the order of the routes.
+func validateRoutes(routes []RouteInfo) error {
+	gateways := make(map[string]net.IP)
+
+	for _, route := range routes {
+		key := route.Dst.String()
+		if gw, ok := gateways[key]; ok && !gw.Equal(route.Gw) {
+			log.Printf("[net] Route to %v via %v conflicts with route via %v.", route.Dst.String(), route.Gw, gw)
+			return errConflictingRoutes
+		}
+
+		gateways[key] = route.Gw
+	}
+
+	return nil
+}
+
 // Attach attaches an endpoint to a sandbox.
 func (ep *endpoint) attach(sandboxKey string) error {
 	if ep.SandboxKey != "" {
@@ -226,6 +410,11 @@ func (ep *endpoint) detach() error {
 	return nil
 }
 
+// GetStats returns the traffic counters of the endpoint.
+func (ep *endpoint) GetStats() (*EndpointStats, error) {
+	return ep.getStatsImpl()
+}
+
 // updateEndpoint updates an existing endpoint in the network.
 func (nw *network) updateEndpoint(exsitingEpInfo *EndpointInfo, targetEpInfo *EndpointInfo) (*endpoint, error) {
 	var err error
@@ -241,11 +430,14 @@ func (nw *network) updateEndpoint(exsitingEpInfo *EndpointInfo, targetEpInfo *En
 
 	ep := nw.Endpoints[exsitingEpInfo.Id]
 	if ep == nil {
-		return nil, errEndpointNotFound
+		return nil, ErrEndpointNotFound
 	}
 
 	log.Printf("[net] Retrieved endpoint to update %+v.", ep)
 
+	targetEpInfo.DNS = targetEpInfo.DNS.inherit(nw.DNS)
+	targetEpInfo.SearchDomains = nw.getSearchDomains(targetEpInfo.DNS)
+
 	// Call the platform implementation.
 	ep, err = nw.updateEndpointImpl(exsitingEpInfo, targetEpInfo)
 	if err != nil {
@@ -257,3 +449,140 @@ func (nw *network) updateEndpoint(exsitingEpInfo *EndpointInfo, targetEpInfo *En
 
 	return ep, nil
 }
+
+// hashContainerID returns the short hash of a container ID used in hashed endpoint IDs.
+func hashContainerID(containerID string) string {
+	h := sha1.New()
+	h.Write([]byte(containerID))
+	return hex.EncodeToString(h.Sum(nil))[:endpointIDHashLength]
+}
+
+// getLegacyEndpointID returns the endpoint ID that ConstructEndpointID generates for an endpoint ID
+// generated by ConstructHashedEndpointID, or an empty string if the endpoint ID is not hashed.
+func getLegacyEndpointID(endpointId string) string {
+	splits := strings.SplitN(endpointId, "-", 3)
+	if len(splits) != 3 || len(splits[1]) != endpointIDHashLength {
+		return ""
+	}
+
+	if _, err := hex.DecodeString(splits[1]); err != nil {
+		return ""
+	}
+
+	return splits[0] + "-" + splits[2]
+}
+
+// matches returns true if the endpoint matches the filter. A nil filter matches all endpoints.
+func (filter *EndpointFilter) matches(ep *endpoint) bool {
+	if filter == nil {
+		return true
+	}
+
+	if filter.ContainerID != "" && filter.ContainerID != ep.ContainerID {
+		return false
+	}
+
+	if filter.IfName != "" && filter.IfName != ep.IfName {
+		return false
+	}
+
+	return true
+}
+
+// GetSearchDomains returns the DNS search domains programmed in the container, falling back to the
+// suffixes of the endpoint for information that does not have them.
+func (epInfo *EndpointInfo) GetSearchDomains() []string {
+	if len(epInfo.SearchDomains) > 0 {
+		return epInfo.SearchDomains
+	}
+
+	return epInfo.DNS.GetSuffixes()
+}
+
+// copy returns a deep copy of the endpoint information.
+func (epInfo *EndpointInfo) copy() *EndpointInfo {
+	info := *epInfo
+
+	info.MacAddress = nil
+	if epInfo.MacAddress != nil {
+		info.MacAddress = append(net.HardwareAddr{}, epInfo.MacAddress...)
+	}
+
+	info.DNS.Suffixes = copyStrings(epInfo.DNS.Suffixes)
+	info.DNS.Servers = copyStrings(epInfo.DNS.Servers)
+	info.SearchDomains = copyStrings(epInfo.SearchDomains)
+	info.InfraVnetIP = copyIPNet(epInfo.InfraVnetIP)
+	info.OutBoundNatExceptionList = copyStrings(epInfo.OutBoundNatExceptionList)
+
+	info.IPAddresses = nil
+	for _, ipAddr := range epInfo.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, copyIPNet(ipAddr))
+	}
+
+	info.Routes = nil
+	for _, route := range epInfo.Routes {
+		route.Dst = copyIPNet(route.Dst)
+		route.Gw = copyIP(route.Gw)
+		route.Src = copyIP(route.Src)
+		info.Routes = append(info.Routes, route)
+	}
+
+	info.Gateways = nil
+	for _, gw := range epInfo.Gateways {
+		info.Gateways = append(info.Gateways, copyIP(gw))
+	}
+
+	info.Policies = nil
+	for _, p := range epInfo.Policies {
+		if p.Data != nil {
+			p.Data = append([]byte{}, p.Data...)
+		}
+		info.Policies = append(info.Policies, p)
+	}
+
+	info.ACLPolicies = append([]policy.ACLPolicy(nil), epInfo.ACLPolicies...)
+
+	info.PortMappings = nil
+	for _, portMapping := range epInfo.PortMappings {
+		portMapping.HostIP = copyIP(portMapping.HostIP)
+		info.PortMappings = append(info.PortMappings, portMapping)
+	}
+
+	if epInfo.RetryPolicy != nil {
+		retryPolicy := *epInfo.RetryPolicy
+		info.RetryPolicy = &retryPolicy
+	}
+
+	if epInfo.Data != nil {
+		info.Data = make(map[string]interface{})
+		for key, value := range epInfo.Data {
+			info.Data[key] = value
+		}
+	}
+
+	if epInfo.Sysctls != nil {
+		info.Sysctls = make(map[string]string)
+		for key, value := range epInfo.Sysctls {
+			info.Sysctls[key] = value
+		}
+	}
+
+	return &info
+}
+
+// validateAddresses returns an error if the persisted addresses of the endpoint are unusable.
+func (ep *endpoint) validateAddresses() error {
+	for _, ipAddr := range ep.IPAddresses {
+		if _, bits := ipAddr.Mask.Size(); ipAddr.IP == nil || bits == 0 {
+			return fmt.Errorf("Invalid IP address %v", ipAddr.String())
+		}
+	}
+
+	for _, gw := range ep.Gateways {
+		if gw == nil {
+			return fmt.Errorf("Invalid gateway")
+		}
+	}
+
+	return nil
+}
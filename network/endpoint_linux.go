@@ -8,10 +8,17 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net"
+	"sort"
 	"strings"
 
+	"github.com/Azure/azure-container-networking/common"
+	"github.com/Azure/azure-container-networking/ethtool"
 	"github.com/Azure/azure-container-networking/log"
 	"github.com/Azure/azure-container-networking/netlink"
+	"github.com/Azure/azure-container-networking/network/epcommon"
+	"github.com/Azure/azure-container-networking/platform"
+
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -23,15 +30,79 @@ const (
 
 	// Prefix for container network interface names.
 	containerInterfacePrefix = "eth"
+
+	// Name of the primary container network interface.
+	primaryContainerIfName = containerInterfacePrefix + "0"
+
+	// Suffix of the temporary container veth name, appended to the host veth name.
+	containerVethNameSuffix = "2"
+
+	// Maximum length of a network interface name, IFNAMSIZ less the terminating NUL.
+	maxInterfaceNameLength = 15
+
+	// Destination of the IPv6 default route.
+	ipv6DefaultRoute = "::/0"
 )
 
-func generateVethName(key string) string {
+// Sysctls that can be set in the container network namespace. A "*" component matches any interface name.
+var allowedSysctls = []string{
+	"net.ipv4.ip_forward",
+	"net.ipv4.conf.*.rp_filter",
+	"net.ipv4.conf.*.arp_notify",
+}
+
+func generateVethName(key string, length int) string {
 	h := sha1.New()
 	h.Write([]byte(key))
-	return hex.EncodeToString(h.Sum(nil))[:11]
+	return hex.EncodeToString(h.Sum(nil))[:length]
+}
+
+// getVethNames returns the host and temporary container interface names of the veth pair of an endpoint.
+// Names are a hash of the endpoint key and container interface name, shortened to fit in IFNAMSIZ, so that
+// every interface of a container gets its own deterministic name. The primary interface of endpoints with
+// OptVethName keeps the name derived from the key alone. Endpoints without it were named after the first
+// characters of their ID before, so existing endpoints may have other names. Only new endpoints are named
+// here, existing endpoints are deleted and reconciled by the HostIfName recorded when they were created.
+func getVethNames(epInfo *EndpointInfo) (string, string) {
+	key := epInfo.Id
+	if vethName, ok := epInfo.Data[OptVethName]; ok {
+		log.Printf("Generate veth name based on the key provided")
+		key = vethName.(string)
+	} else {
+		log.Printf("Generate veth name based on endpoint id")
+	}
+
+	if epInfo.IfName != "" && epInfo.IfName != primaryContainerIfName {
+		key = fmt.Sprintf("%s-%s", key, epInfo.IfName)
+	}
+
+	hashLength := maxInterfaceNameLength - len(hostVEthInterfacePrefix) - len(containerVethNameSuffix)
+	hostIfName := fmt.Sprintf("%s%s", hostVEthInterfacePrefix, generateVethName(key, hashLength))
+	contIfName := fmt.Sprintf("%s%s", hostIfName, containerVethNameSuffix)
+
+	return hostIfName, contIfName
+}
+
+// validateInterfaceNames checks that the interface names of a new endpoint are usable and not yet taken.
+func validateInterfaceNames(containerIfName string, newIfNames ...string) error {
+	if len(containerIfName) > maxInterfaceNameLength {
+		return fmt.Errorf("Interface name %v is longer than %v characters", containerIfName, maxInterfaceNameLength)
+	}
+
+	for _, ifName := range newIfNames {
+		if ifName == "" {
+			continue
+		}
+
+		if _, err := net.InterfaceByName(ifName); err == nil {
+			return fmt.Errorf("Interface %v already exists on the host, it may belong to another endpoint", ifName)
+		}
+	}
+
+	return nil
 }
 
-func ConstructEndpointID(containerID string, netNsPath string, ifName string) (string, string) {
+func ConstructEndpointID(containerID string, netNs *common.Namespace, ifName string) (string, string) {
 	if len(containerID) > 8 {
 		containerID = containerID[:8]
 	} else {
@@ -44,6 +115,54 @@ func ConstructEndpointID(containerID string, netNsPath string, ifName string) (s
 	return infraEpName, ""
 }
 
+// ConstructHashedEndpointID constructs endpoint name with a short hash of the full container ID
+// appended to the truncated container ID.
+func ConstructHashedEndpointID(containerID string, netNs *common.Namespace, ifName string) (string, string) {
+	if len(containerID) <= 8 {
+		log.Printf("Container ID is not greater than 8 ID: %v", containerID)
+		return "", ""
+	}
+
+	infraEpName := containerID[:8] + "-" + hashContainerID(containerID) + "-" + ifName
+
+	return infraEpName, ""
+}
+
+// newEndpointClient returns the endpoint client that creates the interfaces of a new endpoint.
+// It is a variable so that tests can inject failures.
+var newEndpointClient = defaultNewEndpointClient
+
+func defaultNewEndpointClient(nw *network, epInfo *EndpointInfo, hostIfName string, contIfName string, vlanid int) EndpointClient {
+	if epInfo.HostDeviceName != "" {
+		return NewHostDeviceEndpointClient(epInfo.HostDeviceName)
+	} else if nw.Mode == opModeIpvlan {
+		return NewIpvlanEndpointClient(nw.ParentIfName, contIfName, nw.IpvlanMode)
+	} else if nw.Mode == opModeMacvlan {
+		return NewMacvlanEndpointClient(nw.ParentIfName, contIfName)
+	} else if nw.Mode == opModeOverlay {
+		// Overlay networks have a bridge of their own.
+		client := NewLinuxBridgeEndpointClient(nw.extIf, hostIfName, contIfName, nw.Mode)
+		client.bridgeName = nw.BridgeName
+		client.standaloneBridge = true
+		return client
+	} else if nw.VlanIfName != "" {
+		// VLAN networks have a bridge for each VLAN of their endpoints.
+		client := NewLinuxBridgeEndpointClient(nw.extIf, hostIfName, contIfName, nw.Mode)
+		client.bridgeName, _ = nw.getVlanBridgeName(vlanid)
+		client.standaloneBridge = true
+		return client
+	} else if vlanid != 0 {
+		return NewOVSEndpointClient(
+			nw.extIf,
+			epInfo,
+			hostIfName,
+			contIfName,
+			vlanid)
+	}
+
+	return NewLinuxBridgeEndpointClient(nw.extIf, hostIfName, contIfName, nw.Mode)
+}
+
 // newEndpointImpl creates a new endpoint in the network.
 func (nw *network) newEndpointImpl(epInfo *EndpointInfo) (*endpoint, error) {
 	var containerIf *net.Interface
@@ -57,62 +176,124 @@ func (nw *network) newEndpointImpl(epInfo *EndpointInfo) (*endpoint, error) {
 
 	if nw.Endpoints[epInfo.Id] != nil {
 		log.Printf("[net] Endpoint alreday exists.")
-		err = errEndpointExists
+		err = ErrEndpointExists
 		return nil, err
 	}
 
+	if nw.Mode == opModeNone {
+		return nw.newNoneEndpoint(epInfo)
+	}
+
 	if epInfo.Data != nil {
 		if _, ok := epInfo.Data[VlanIDKey]; ok {
 			vlanid = epInfo.Data[VlanIDKey].(int)
 		}
 	}
 
-	if _, ok := epInfo.Data[OptVethName]; ok {
-		log.Printf("Generate veth name based on the key provided")
-		key := epInfo.Data[OptVethName].(string)
-		vethname := generateVethName(key)
-		hostIfName = fmt.Sprintf("%s%s", hostVEthInterfacePrefix, vethname)
-		contIfName = fmt.Sprintf("%s%s2", hostVEthInterfacePrefix, vethname)
+	if epInfo.HostDeviceName != "" {
+		// Move the host device into the container instead of creating a veth pair.
+		log.Printf("[net] Using host device %v for endpoint %v.", epInfo.HostDeviceName, epInfo.Id)
+		contIfName = epInfo.HostDeviceName
 	} else {
 		// Create a veth pair.
-		log.Printf("Generate veth name based on endpoint id")
-		hostIfName = fmt.Sprintf("%s%s", hostVEthInterfacePrefix, epInfo.Id[:7])
-		contIfName = fmt.Sprintf("%s%s-2", hostVEthInterfacePrefix, epInfo.Id[:7])
+		hostIfName, contIfName = getVethNames(epInfo)
+
+		if nw.Mode == opModeIpvlan || nw.Mode == opModeMacvlan {
+			// Ipvlan and macvlan sub-interfaces have no host-side peer.
+			hostIfName = ""
+		}
 	}
 
-	if vlanid != 0 {
-		epClient = NewOVSEndpointClient(
-			nw.extIf,
-			epInfo,
-			hostIfName,
-			contIfName,
-			vlanid)
-	} else {
-		epClient = NewLinuxBridgeEndpointClient(nw.extIf, hostIfName, contIfName, nw.Mode)
+	// Use the prefix length and gateway of the network subnet each address was allocated from.
+	epInfo.IPAddresses = nw.getSubnetAddresses(epInfo.IPAddresses)
+
+	ipv4Gateway := nw.getSubnetGateway(epInfo.IPAddresses, platform.AfINET)
+	if ipv4Gateway == nil {
+		ipv4Gateway = nw.extIf.IPv4Gateway
 	}
 
-	// Cleanup on failure.
-	defer func() {
-		if err != nil {
-			log.Printf("CNI error. Delete Endpoint %v and rules that are created.", contIfName)
-			endpt := &endpoint{
-				Id:                 epInfo.Id,
-				IfName:             contIfName,
-				HostIfName:         hostIfName,
-				IPAddresses:        epInfo.IPAddresses,
-				Gateways:           []net.IP{nw.extIf.IPv4Gateway},
-				DNS:                epInfo.DNS,
-				VlanID:             vlanid,
-				EnableSnatOnHost:   epInfo.EnableSnatOnHost,
-				EnableMultitenancy: epInfo.EnableMultiTenancy,
+	// Add a default IPv6 route via the network's IPv6 gateway.
+	gateways := []net.IP{ipv4Gateway}
+	if epcommon.HasIPv6Address(epInfo.IPAddresses) {
+		if ipv6Gateway := nw.getIPv6Gateway(epInfo.IPAddresses); ipv6Gateway != nil {
+			gateways = append(gateways, ipv6Gateway)
+
+			if !epInfo.Secondary && !hasIPv6DefaultRoute(epInfo.Routes) {
+				_, defaultDst, _ := net.ParseCIDR(ipv6DefaultRoute)
+				epInfo.Routes = append(epInfo.Routes, RouteInfo{Dst: *defaultDst, Gw: ipv6Gateway})
 			}
+		}
+	}
+
+	if err = validateRoutes(epInfo.Routes); err != nil {
+		return nil, err
+	}
+
+	// Sysctls are only ever applied in the container network namespace, never on the host.
+	if len(epInfo.Sysctls) > 0 && epInfo.NetNs == nil {
+		return nil, errSysctlRequiresNetNs
+	}
+
+	if err = validateSysctls(epInfo.Sysctls); err != nil {
+		return nil, err
+	}
+
+	// Host devices already exist, only the names of new interfaces must be free.
+	if epInfo.HostDeviceName != "" {
+		err = validateInterfaceNames(epInfo.IfName)
+	} else {
+		err = validateInterfaceNames(epInfo.IfName, hostIfName, contIfName)
+	}
+
+	if err != nil {
+		log.Printf("[net] Invalid interface names for endpoint %v: %v.", epInfo.Id, err)
+		return nil, err
+	}
+
+	// Endpoints of VLAN networks whose VLAN overrides the VLAN of the network get a bridge of their own.
+	if nw.VlanIfName != "" && epInfo.HostDeviceName == "" {
+		if vlanid == 0 {
+			vlanid = nw.VlanId
+		}
+
+		if err = nw.addEndpointVlan(vlanid); err != nil {
+			return nil, err
+		}
 
-			if containerIf != nil {
-				endpt.MacAddress = containerIf.HardwareAddr
-				epClient.DeleteEndpointRules(endpt)
+		defer func() {
+			if err != nil {
+				nw.deleteEndpointVlan(vlanid, epInfo.Id)
 			}
+		}()
+	}
+
+	epClient = newEndpointClient(nw, epInfo, hostIfName, contIfName, vlanid)
+
+	// Endpoint resources are created in stages. Each stage registers the rollback of the resources it
+	// creates, so that a failure in any later stage, for example because the container netns vanished,
+	// does not leak host interfaces and rules. The record of created resources tracks the container
+	// interface as it is moved and renamed, so that the rollback finds it.
+	created := &endpoint{
+		Id:                 epInfo.Id,
+		IfName:             contIfName,
+		HostIfName:         hostIfName,
+		IPAddresses:        epInfo.IPAddresses,
+		Gateways:           gateways,
+		DNS:                epInfo.DNS,
+		SearchDomains:      epInfo.SearchDomains,
+		VlanID:             vlanid,
+		EnableSnatOnHost:   epInfo.EnableSnatOnHost,
+		EnableMultitenancy: epInfo.EnableMultiTenancy,
+		HostDeviceName:     epInfo.HostDeviceName,
+	}
 
-			epClient.DeleteEndpoints(endpt)
+	// Stage 1: Create the interfaces.
+	defer func() {
+		if err != nil {
+			log.Printf("[net] Rolling back interfaces of endpoint %v.", epInfo.Id)
+			if err := epClient.DeleteEndpoints(created); err != nil {
+				log.Printf("[net] Failed to delete interfaces of endpoint %v, err:%v.", epInfo.Id, err)
+			}
 		}
 	}()
 
@@ -120,39 +301,77 @@ func (nw *network) newEndpointImpl(epInfo *EndpointInfo) (*endpoint, error) {
 		return nil, err
 	}
 
+	// Set the MTU on both ends of the veth pair. Host devices keep their own MTU unless one is requested.
+	mtu := epInfo.MTU
+	if epInfo.HostDeviceName == "" {
+		mtu = nw.getEndpointMTU(epInfo)
+	}
+
+	if mtu > 0 {
+		for _, ifName := range []string{hostIfName, contIfName} {
+			if ifName == "" {
+				continue
+			}
+
+			log.Printf("[net] Setting MTU of link %v to %v.", ifName, mtu)
+			if err = netlink.SetLinkMTU(ifName, mtu); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	containerIf, err = net.InterfaceByName(contIfName)
 	if err != nil {
 		return nil, err
 	}
 
-	// Setup rules for IP addresses on the container interface.
+	created.MacAddress = containerIf.HardwareAddr
+
+	// Shape traffic towards the container on the host-side veth.
+	if epInfo.IngressRate > 0 && hostIfName != "" {
+		if err = setRateLimit(hostIfName, epInfo.IngressRate); err != nil {
+			return nil, err
+		}
+	}
+
+	// Stage 2: Setup rules for IP addresses on the container interface.
+	defer func() {
+		if err != nil {
+			log.Printf("[net] Rolling back rules of endpoint %v.", epInfo.Id)
+			epClient.DeleteEndpointRules(created)
+		}
+	}()
+
 	if err = epClient.AddEndpointRules(epInfo); err != nil {
 		return nil, err
 	}
 
-	// If a network namespace for the container interface is specified...
-	if epInfo.NetNsPath != "" {
+	// Stage 3: Move the container interface to the container network namespace, if one is specified.
+	// Addresses and routes in the container netns are removed along with the interface.
+	if epInfo.NetNs != nil {
 		// Open the network namespace.
-		log.Printf("[net] Opening netns %v.", epInfo.NetNsPath)
-		ns, err = OpenNamespace(epInfo.NetNsPath)
+		log.Printf("[net] Opening netns %v.", epInfo.NetNs)
+		ns, err = OpenNamespace(epInfo.NetNs.Path())
 		if err != nil {
 			return nil, err
 		}
 		defer ns.Close()
 
-		if err := epClient.MoveEndpointsToContainerNS(epInfo, ns.GetFd()); err != nil {
+		if err = epClient.MoveEndpointsToContainerNS(epInfo, ns.GetFd()); err != nil {
 			return nil, err
 		}
 
+		created.NetworkNameSpace = epInfo.NetNs.Path()
+
 		// Enter the container network namespace.
-		log.Printf("[net] Entering netns %v.", epInfo.NetNsPath)
+		log.Printf("[net] Entering netns %v.", epInfo.NetNs)
 		if err = ns.Enter(); err != nil {
 			return nil, err
 		}
 
-		// Return to host network namespace.
+		// Return to host network namespace, before any rollback runs.
 		defer func() {
-			log.Printf("[net] Exiting netns %v.", epInfo.NetNsPath)
+			log.Printf("[net] Exiting netns %v.", epInfo.NetNs)
 			if err := ns.Exit(); err != nil {
 				log.Printf("[net] Failed to exit netns, err:%v.", err)
 			}
@@ -164,30 +383,74 @@ func (nw *network) newEndpointImpl(epInfo *EndpointInfo) (*endpoint, error) {
 		if err = epClient.SetupContainerInterfaces(epInfo); err != nil {
 			return nil, err
 		}
+
+		created.IfName = epInfo.IfName
+	}
+
+	// Stage 4: Configure the container interface.
+	if err = setSysctls(epInfo.Sysctls); err != nil {
+		return nil, err
 	}
 
 	if err = epClient.ConfigureContainerInterfacesAndRoutes(epInfo); err != nil {
 		return nil, err
 	}
 
+	// The container interface keeps its temporary name unless a name is specified.
+	containerIfName := contIfName
+	if epInfo.IfName != "" {
+		containerIfName = epInfo.IfName
+	}
+
+	// Traffic can only be shaped on egress, so traffic from the container is shaped on the container interface.
+	if epInfo.EgressRate > 0 {
+		if err = setRateLimit(containerIfName, epInfo.EgressRate); err != nil {
+			return nil, err
+		}
+	}
+
+	if epInfo.DisableTxChecksumOffload {
+		log.Printf("[net] Disabling TX checksum offload on %v.", containerIfName)
+		if err = ethtool.SetTxChecksumOffload(containerIfName, false); err != nil {
+			if err != ethtool.ErrNotSupported {
+				return nil, err
+			}
+
+			log.Printf("[net] TX checksum offload is not supported on %v, skipping.", containerIfName)
+			err = nil
+		}
+	}
+
 	// Create the endpoint object.
 	ep = &endpoint{
 		Id:                 epInfo.Id,
-		IfName:             epInfo.IfName,
+		IfName:             containerIfName,
 		HostIfName:         hostIfName,
 		MacAddress:         containerIf.HardwareAddr,
 		InfraVnetIP:        epInfo.InfraVnetIP,
 		IPAddresses:        epInfo.IPAddresses,
-		Gateways:           []net.IP{nw.extIf.IPv4Gateway},
+		Gateways:           gateways,
 		DNS:                epInfo.DNS,
+		SearchDomains:      epInfo.SearchDomains,
 		VlanID:             vlanid,
 		EnableSnatOnHost:   epInfo.EnableSnatOnHost,
 		EnableInfraVnet:    epInfo.EnableInfraVnet,
 		EnableMultitenancy: epInfo.EnableMultiTenancy,
-		NetworkNameSpace:   epInfo.NetNsPath,
+		NetworkNameSpace:   epInfo.NetNs.Path(),
 		ContainerID:        epInfo.ContainerID,
 		PODName:            epInfo.PODName,
 		PODNameSpace:       epInfo.PODNameSpace,
+		MTU:                mtu,
+		EgressRate:         epInfo.EgressRate,
+	}
+
+	if hostIfName != "" {
+		ep.IngressRate = epInfo.IngressRate
+	}
+
+	if epInfo.HostDeviceName != "" {
+		ep.HostDeviceName = epInfo.HostDeviceName
+		ep.HostDeviceNetNsPath = hostNetNsPath
 	}
 
 	for _, route := range epInfo.Routes {
@@ -201,47 +464,203 @@ func (nw *network) newEndpointImpl(epInfo *EndpointInfo) (*endpoint, error) {
 func (nw *network) deleteEndpointImpl(ep *endpoint) error {
 	var epClient EndpointClient
 
+	if nw.Mode == opModeNone {
+		return nil
+	}
+
 	// Delete the veth pair by deleting one of the peer interfaces.
 	// Deleting the host interface is more convenient since it does not require
 	// entering the container netns and hence works both for CNI and CNM.
-	if ep.VlanID != 0 {
+	if ep.HostDeviceName != "" {
+		epClient = NewHostDeviceEndpointClient(ep.HostDeviceName)
+	} else if nw.Mode == opModeIpvlan {
+		epClient = NewIpvlanEndpointClient(nw.ParentIfName, ep.IfName, nw.IpvlanMode)
+	} else if nw.Mode == opModeMacvlan {
+		epClient = NewMacvlanEndpointClient(nw.ParentIfName, ep.IfName)
+	} else if nw.Mode == opModeOverlay {
+		client := NewLinuxBridgeEndpointClient(nw.extIf, ep.HostIfName, "", nw.Mode)
+		client.bridgeName = nw.BridgeName
+		client.standaloneBridge = true
+		epClient = client
+	} else if nw.VlanIfName != "" {
+		client := NewLinuxBridgeEndpointClient(nw.extIf, ep.HostIfName, "", nw.Mode)
+		client.bridgeName, _ = nw.getVlanBridgeName(ep.VlanID)
+		client.standaloneBridge = true
+		epClient = client
+	} else if ep.VlanID != 0 {
 		epInfo := ep.getInfo()
 		epClient = NewOVSEndpointClient(nw.extIf, epInfo, ep.HostIfName, "", ep.VlanID)
 	} else {
 		epClient = NewLinuxBridgeEndpointClient(nw.extIf, ep.HostIfName, "", nw.Mode)
 	}
 
+	// Remove the rate limit on the host-side veth. The one on the container interface goes with it.
+	if ep.IngressRate > 0 {
+		log.Printf("[net] Deleting rate limit on %v.", ep.HostIfName)
+		if err := netlink.DeleteLinkRateLimit(ep.HostIfName); err != nil {
+			log.Printf("[net] Failed to delete rate limit on %v: %v.", ep.HostIfName, err)
+		}
+	}
+
 	epClient.DeleteEndpointRules(ep)
 	epClient.DeleteEndpoints(ep)
 
+	if nw.VlanIfName != "" && ep.HostDeviceName == "" {
+		nw.deleteEndpointVlan(ep.VlanID, ep.Id)
+	}
+
 	return nil
 }
 
 // getInfoImpl returns information about the endpoint.
 func (ep *endpoint) getInfoImpl(epInfo *EndpointInfo) {
+	epInfo.MTU = ep.MTU
+	epInfo.HostDeviceName = ep.HostDeviceName
+	epInfo.IngressRate = ep.IngressRate
+	epInfo.EgressRate = ep.EgressRate
 }
 
-func addRoutes(interfaceName string, routes []RouteInfo) error {
-	ifIndex := 0
-	interfaceIf, _ := net.InterfaceByName(interfaceName)
+// setRateLimit sets the rate limit on an interface, or removes it if the rate is zero.
+func setRateLimit(ifName string, rate uint64) error {
+	if rate == 0 {
+		log.Printf("[net] Deleting rate limit on %v.", ifName)
+		err := netlink.DeleteLinkRateLimit(ifName)
+		if err == unix.ENOENT || err == unix.EINVAL {
+			// There was no rate limit to delete.
+			err = nil
+		}
+		return err
+	}
+
+	log.Printf("[net] Setting rate limit on %v to %v bps.", ifName, rate)
+	return netlink.SetLinkRateLimit(ifName, rate)
+}
+
+// getIPv6Gateway returns the IPv6 gateway for the given addresses, preferring the gateway of the
+// subnet the IPv6 address was allocated from.
+func (nw *network) getIPv6Gateway(ipAddresses []net.IPNet) net.IP {
+	if gateway := nw.getSubnetGateway(ipAddresses, platform.AfINET6); gateway != nil {
+		return gateway
+	}
+
+	if nw.extIf.IPv6Gateway != nil && !nw.extIf.IPv6Gateway.IsUnspecified() {
+		return nw.extIf.IPv6Gateway
+	}
+
+	for _, subnet := range nw.Subnets {
+		if subnet.Family == platform.AfINET6 && subnet.Gateway != nil {
+			return subnet.Gateway
+		}
+	}
+
+	return nil
+}
 
+// hasIPv6DefaultRoute returns true if the routes contain an IPv6 default route.
+func hasIPv6DefaultRoute(routes []RouteInfo) bool {
 	for _, route := range routes {
-		log.Printf("[net] Adding IP route %+v to link %v.", route, interfaceName)
+		ones, _ := route.Dst.Mask.Size()
+		if route.Dst.IP.To4() == nil && route.Dst.IP.IsUnspecified() && ones == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acceptIPv6RouterAdvertisements returns whether a container interface learns its IPv6 default route
+// from router advertisements, which only primary endpoints without an IPv6 default route do.
+func acceptIPv6RouterAdvertisements(secondary bool, routes []RouteInfo) bool {
+	return !secondary && !hasIPv6DefaultRoute(routes)
+}
+
+// getEndpointMTU returns the MTU for a new endpoint. The endpoint MTU takes precedence
+// over the network MTU, which in turn takes precedence over the external interface MTU.
+func (nw *network) getEndpointMTU(epInfo *EndpointInfo) int {
+	if epInfo.MTU > 0 {
+		return epInfo.MTU
+	}
+
+	if nw.MTU > 0 {
+		return nw.MTU
+	}
+
+	extIf, err := net.InterfaceByName(nw.extIf.Name)
+	if err != nil {
+		log.Printf("[net] Failed to query MTU of external interface %v, err:%v.", nw.extIf.Name, err)
+		return 0
+	}
+
+	return extIf.MTU
+}
+
+// deleteContainerLink deletes the container interface of an endpoint that has no host-side peer,
+// entering the container network namespace if the interface was moved there.
+func deleteContainerLink(ep *endpoint) error {
+	if ep.NetworkNameSpace == "" {
+		log.Printf("[net] Deleting container interface %v.", ep.IfName)
+		return netlink.DeleteLink(ep.IfName)
+	}
+
+	ns, err := OpenNamespace(ep.NetworkNameSpace)
+	if err != nil {
+		log.Printf("[net] Container netns %v is already gone, err:%v.", ep.NetworkNameSpace, err)
+		return nil
+	}
+	defer ns.Close()
+
+	log.Printf("[net] Entering netns %v.", ep.NetworkNameSpace)
+	if err = ns.Enter(); err != nil {
+		return err
+	}
 
-		if route.DevName != "" {
-			devIf, _ := net.InterfaceByName(route.DevName)
-			ifIndex = devIf.Index
-		} else {
-			ifIndex = interfaceIf.Index
+	defer func() {
+		log.Printf("[net] Exiting netns %v.", ep.NetworkNameSpace)
+		if err := ns.Exit(); err != nil {
+			log.Printf("[net] Failed to exit netns, err:%v.", err)
 		}
+	}()
+
+	log.Printf("[net] Deleting container interface %v.", ep.IfName)
+	return netlink.DeleteLink(ep.IfName)
+}
+
+// setHostRoute adds or deletes a host route for a container IP address via the given host interface.
+func setHostRoute(hostIfName string, ip net.IP, add bool) error {
+	hostIf, err := net.InterfaceByName(hostIfName)
+	if err != nil {
+		return err
+	}
+
+	dst := &net.IPNet{IP: ip, Mask: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len)}
+	if ip.To4() != nil {
+		dst = &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(8*net.IPv4len, 8*net.IPv4len)}
+	}
+
+	nlRoute := &netlink.Route{
+		Family:    netlink.GetIpAddressFamily(ip),
+		Dst:       dst,
+		LinkIndex: hostIf.Index,
+	}
+
+	if add {
+		return netlink.AddIpRoute(nlRoute)
+	}
+
+	return netlink.DeleteIpRoute(nlRoute)
+}
+
+func addRoutes(interfaceName string, routes []RouteInfo) error {
+	for _, route := range routes {
+		log.Printf("[net] Adding IP route %+v to link %v.", route, interfaceName)
 
-		nlRoute := &netlink.Route{
-			Family:    netlink.GetIpAddressFamily(route.Gw),
-			Dst:       &route.Dst,
-			Gw:        route.Gw,
-			LinkIndex: ifIndex,
+		ifIndex, err := getRouteLinkIndex(interfaceName, route)
+		if err != nil {
+			return err
 		}
 
+		nlRoute := newNetlinkRoute(route, ifIndex)
+
 		if err := netlink.AddIpRoute(nlRoute); err != nil {
 			if !strings.Contains(strings.ToLower(err.Error()), "file exists") {
 				return err
@@ -255,25 +674,15 @@ func addRoutes(interfaceName string, routes []RouteInfo) error {
 }
 
 func deleteRoutes(interfaceName string, routes []RouteInfo) error {
-	ifIndex := 0
-	interfaceIf, _ := net.InterfaceByName(interfaceName)
-
 	for _, route := range routes {
 		log.Printf("[ovs] Deleting IP route %+v from link %v.", route, interfaceName)
 
-		if route.DevName != "" {
-			devIf, _ := net.InterfaceByName(route.DevName)
-			ifIndex = devIf.Index
-		} else {
-			ifIndex = interfaceIf.Index
+		ifIndex, err := getRouteLinkIndex(interfaceName, route)
+		if err != nil {
+			return err
 		}
 
-		nlRoute := &netlink.Route{
-			Family:    netlink.GetIpAddressFamily(route.Gw),
-			Dst:       &route.Dst,
-			Gw:        route.Gw,
-			LinkIndex: ifIndex,
-		}
+		nlRoute := newNetlinkRoute(route, ifIndex)
 
 		if err := netlink.DeleteIpRoute(nlRoute); err != nil {
 			return err
@@ -283,6 +692,42 @@ func deleteRoutes(interfaceName string, routes []RouteInfo) error {
 	return nil
 }
 
+// getRouteLinkIndex returns the index of the interface named by the route, or of the given
+// interface if the route does not name one.
+func getRouteLinkIndex(interfaceName string, route RouteInfo) (int, error) {
+	if route.DevName != "" {
+		interfaceName = route.DevName
+	}
+
+	iface, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		return 0, fmt.Errorf("route %v: interface %q not found: %v", route.Dst.String(), interfaceName, err)
+	}
+
+	return iface.Index, nil
+}
+
+// newNetlinkRoute converts a route to its netlink representation on the given interface.
+func newNetlinkRoute(route RouteInfo, ifIndex int) *netlink.Route {
+	dst := route.Dst
+
+	// Device-only routes have no gateway to derive the address family from.
+	family := netlink.GetIpAddressFamily(route.Gw)
+	if route.Gw == nil {
+		family = netlink.GetIpAddressFamily(dst.IP)
+	}
+
+	return &netlink.Route{
+		Family:    family,
+		Dst:       &dst,
+		Src:       route.Src,
+		Gw:        route.Gw,
+		Scope:     route.Scope,
+		Priority:  route.Metric,
+		LinkIndex: ifIndex,
+	}
+}
+
 // updateEndpointImpl updates an existing endpoint in the network.
 func (nw *network) updateEndpointImpl(existingEpInfo *EndpointInfo, targetEpInfo *EndpointInfo) (*endpoint, error) {
 	var ns *Namespace
@@ -293,10 +738,34 @@ func (nw *network) updateEndpointImpl(existingEpInfo *EndpointInfo, targetEpInfo
 	log.Printf("[updateEndpointImpl] Going to retrieve endpoint with Id %+v to update.", existingEpInfo.Id)
 	if existingEpFromRepository == nil {
 		log.Printf("[updateEndpointImpl] Endpoint cannot be updated as it does not exist.")
-		err = errEndpointNotFound
+		err = ErrEndpointNotFound
 		return nil, err
 	}
 
+	if nw.Mode == opModeNone {
+		return nw.updateNoneEndpoint(existingEpInfo, targetEpInfo)
+	}
+
+	// Replace the rate limit on the host-side veth before entering the container namespace.
+	if existingEpFromRepository.HostIfName != "" && targetEpInfo.IngressRate != existingEpFromRepository.IngressRate {
+		if err = setRateLimit(existingEpFromRepository.HostIfName, targetEpInfo.IngressRate); err != nil {
+			return nil, err
+		}
+		existingEpFromRepository.IngressRate = targetEpInfo.IngressRate
+	}
+
+	// Re-home the endpoint if its sandbox was recreated in a new network namespace.
+	if targetEpInfo.NetNs != nil && existingEpFromRepository.NetworkNameSpace != "" &&
+		targetEpInfo.NetNs.Path() != existingEpFromRepository.NetworkNameSpace {
+		log.Printf("[updateEndpointImpl] Moving endpoint %v from netns %v to %v.",
+			existingEpInfo.Id, existingEpFromRepository.NetworkNameSpace, targetEpInfo.NetNs)
+		if err = moveEndpointToNamespace(existingEpFromRepository, targetEpInfo.NetNs); err != nil {
+			return nil, err
+		}
+
+		existingEpFromRepository.NetworkNameSpace = targetEpInfo.NetNs.Path()
+	}
+
 	netns := existingEpFromRepository.NetworkNameSpace
 	// Network namespace for the container interface has to be specified
 	if netns != "" {
@@ -332,6 +801,13 @@ func (nw *network) updateEndpointImpl(existingEpInfo *EndpointInfo, targetEpInfo
 		return nil, err
 	}
 
+	if targetEpInfo.EgressRate != existingEpFromRepository.EgressRate {
+		if err = setRateLimit(existingEpFromRepository.IfName, targetEpInfo.EgressRate); err != nil {
+			return nil, err
+		}
+		existingEpFromRepository.EgressRate = targetEpInfo.EgressRate
+	}
+
 	// Create the endpoint object.
 	ep = &endpoint{
 		Id: existingEpInfo.Id,
@@ -345,6 +821,156 @@ func (nw *network) updateEndpointImpl(existingEpInfo *EndpointInfo, targetEpInfo
 	return ep, nil
 }
 
+// moveEndpointToNamespace moves the container interface of an endpoint from its current network namespace
+// to the given one and re-applies its addresses and routes. On failure the interface is moved back, and if
+// that fails as well the endpoint is marked broken so that a subsequent delete cleans it up.
+func moveEndpointToNamespace(ep *endpoint, netNs *common.Namespace) error {
+	newNs, err := OpenNamespace(netNs.Path())
+	if err != nil {
+		return err
+	}
+	defer newNs.Close()
+
+	oldNs, err := OpenNamespace(ep.NetworkNameSpace)
+	if err != nil {
+		return err
+	}
+	defer oldNs.Close()
+
+	if err = moveContainerInterface(ep, oldNs, newNs); err != nil {
+		return err
+	}
+
+	if err = configureContainerInterface(ep, newNs); err == nil {
+		return nil
+	}
+
+	log.Printf("[net] Failed to configure endpoint %v in netns %v, rolling back: %v.", ep.Id, netNs, err)
+	rollbackErr := moveContainerInterface(ep, newNs, oldNs)
+	if rollbackErr == nil {
+		rollbackErr = configureContainerInterface(ep, oldNs)
+	}
+
+	if rollbackErr != nil {
+		log.Printf("[net] Failed to roll back endpoint %v, marking it broken: %v.", ep.Id, rollbackErr)
+		ep.Broken = true
+	}
+
+	return err
+}
+
+// moveContainerInterface moves the container interface of an endpoint between network namespaces.
+func moveContainerInterface(ep *endpoint, from *Namespace, to *Namespace) error {
+	if err := from.Enter(); err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := from.Exit(); err != nil {
+			log.Printf("[net] Failed to exit netns, err:%v.", err)
+		}
+	}()
+
+	log.Printf("[net] Setting link %v state down.", ep.IfName)
+	if err := netlink.SetLinkState(ep.IfName, false); err != nil {
+		return err
+	}
+
+	log.Printf("[net] Setting link %v netns %v.", ep.IfName, to.file.Name())
+	return netlink.SetLinkNetNs(ep.IfName, to.GetFd())
+}
+
+// configureContainerInterface applies the addresses and routes of an endpoint to its container interface
+// in the given network namespace.
+func configureContainerInterface(ep *endpoint, ns *Namespace) error {
+	if err := ns.Enter(); err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := ns.Exit(); err != nil {
+			log.Printf("[net] Failed to exit netns, err:%v.", err)
+		}
+	}()
+
+	log.Printf("[net] Setting link %v state up.", ep.IfName)
+	if err := netlink.SetLinkState(ep.IfName, true); err != nil {
+		return err
+	}
+
+	if epcommon.HasIPv6Address(ep.IPAddresses) {
+		if err := epcommon.ConfigureIPv6Interface(ep.IfName, acceptIPv6RouterAdvertisements(ep.Secondary, ep.Routes)); err != nil {
+			return err
+		}
+	}
+
+	if err := epcommon.AssignIPToInterface(ep.IfName, ep.IPAddresses); err != nil {
+		return err
+	}
+
+	return addRoutes(ep.IfName, ep.Routes)
+}
+
+// validateSysctls checks that all sysctls of an endpoint are in the list of allowed sysctls.
+func validateSysctls(sysctls map[string]string) error {
+	for key := range sysctls {
+		if !isSysctlAllowed(key) {
+			log.Printf("[net] Sysctl %v is not allowed.", key)
+			return errSysctlNotAllowed
+		}
+	}
+
+	return nil
+}
+
+// isSysctlAllowed returns whether a sysctl key matches one of the allowed sysctls.
+func isSysctlAllowed(key string) bool {
+	if strings.Contains(key, "/") {
+		return false
+	}
+
+	components := strings.Split(key, ".")
+
+	for _, allowed := range allowedSysctls {
+		allowedComponents := strings.Split(allowed, ".")
+		if len(allowedComponents) != len(components) {
+			continue
+		}
+
+		match := true
+		for i, component := range components {
+			if component == "" || (allowedComponents[i] != "*" && allowedComponents[i] != component) {
+				match = false
+				break
+			}
+		}
+
+		if match {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setSysctls sets the sysctls of an endpoint in the current network namespace, in key order.
+func setSysctls(sysctls map[string]string) error {
+	keys := make([]string, 0, len(sysctls))
+	for key := range sysctls {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := epcommon.SetSysctl(key, sysctls[key]); err != nil {
+			log.Printf("[net] Failed to set sysctl %v, err:%v.", key, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
 func updateRoutes(existingEp *EndpointInfo, targetEp *EndpointInfo) error {
 	log.Printf("Updating routes for the endpoint %+v.", existingEp)
 	log.Printf("Target endpoint is %+v", targetEp)
@@ -416,3 +1042,9 @@ func updateRoutes(existingEp *EndpointInfo, targetEp *EndpointInfo) error {
 
 	return nil
 }
+
+// getStatsImpl returns the traffic counters of the endpoint.
+// getStatsImpl is not yet supported on Linux platform.
+func (ep *endpoint) getStatsImpl() (*EndpointStats, error) {
+	return nil, errEndpointStatsNotSupported
+}
@@ -0,0 +1,457 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-container-networking/common"
+	"github.com/Azure/azure-container-networking/netlink"
+	"github.com/Azure/azure-container-networking/network/epcommon"
+	"golang.org/x/sys/unix"
+)
+
+var errInjected = fmt.Errorf("Injected failure")
+
+// fakeEndpointClient creates a real veth pair, records the endpoint rules it adds,
+// and fails at the given stage after creating the resources of that stage.
+type fakeEndpointClient struct {
+	hostIfName string
+	contIfName string
+	failStage  string
+	rules      map[string]bool
+}
+
+func (client *fakeEndpointClient) fail(stage string) error {
+	if client.failStage == stage {
+		return errInjected
+	}
+
+	return nil
+}
+
+func (client *fakeEndpointClient) AddEndpoints(epInfo *EndpointInfo) error {
+	if err := epcommon.CreateEndpoint(client.hostIfName, client.contIfName); err != nil {
+		return err
+	}
+
+	return client.fail("AddEndpoints")
+}
+
+func (client *fakeEndpointClient) AddEndpointRules(epInfo *EndpointInfo) error {
+	for _, ipAddr := range epInfo.IPAddresses {
+		client.rules[ipAddr.IP.String()] = true
+	}
+
+	return client.fail("AddEndpointRules")
+}
+
+func (client *fakeEndpointClient) DeleteEndpointRules(ep *endpoint) {
+	for _, ipAddr := range ep.IPAddresses {
+		delete(client.rules, ipAddr.IP.String())
+	}
+}
+
+func (client *fakeEndpointClient) MoveEndpointsToContainerNS(epInfo *EndpointInfo, nsID uintptr) error {
+	if err := netlink.SetLinkNetNs(client.contIfName, nsID); err != nil {
+		return err
+	}
+
+	return client.fail("MoveEndpointsToContainerNS")
+}
+
+func (client *fakeEndpointClient) SetupContainerInterfaces(epInfo *EndpointInfo) error {
+	if err := epcommon.SetupContainerInterface(client.contIfName, epInfo.IfName); err != nil {
+		return err
+	}
+
+	client.contIfName = epInfo.IfName
+
+	return client.fail("SetupContainerInterfaces")
+}
+
+func (client *fakeEndpointClient) ConfigureContainerInterfacesAndRoutes(epInfo *EndpointInfo) error {
+	if err := epcommon.AssignIPToInterface(client.contIfName, epInfo.IPAddresses); err != nil {
+		return err
+	}
+
+	return client.fail("ConfigureContainerInterfacesAndRoutes")
+}
+
+func (client *fakeEndpointClient) DeleteEndpoints(ep *endpoint) error {
+	return netlink.DeleteLink(ep.HostIfName)
+}
+
+// testNamespace returns the network namespace with the given path.
+func testNamespace(t *testing.T, nsPath string) *common.Namespace {
+	ns, err := common.NamespaceFromPath(nsPath)
+	if err != nil {
+		t.Fatalf("Invalid netns %v: %v", nsPath, err)
+	}
+
+	return ns
+}
+
+// withTestNamespace runs a test function inside a new, empty network namespace
+// and returns the calling thread to its original namespace afterwards.
+func withTestNamespace(t *testing.T, test func(nsPath string)) {
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origNs, err := GetCurrentThreadNamespace()
+	if err != nil {
+		t.Fatalf("Failed to open current netns: %v", err)
+	}
+	defer origNs.Close()
+
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("Failed to create test netns: %v", err)
+	}
+	netlink.ResetSocket()
+
+	defer func() {
+		if err := origNs.set(); err != nil {
+			t.Fatalf("Failed to restore netns: %v", err)
+		}
+		netlink.ResetSocket()
+	}()
+
+	test(fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), unix.Gettid()))
+}
+
+// TestValidateRoutes tests that conflicting routes are rejected.
+func TestValidateRoutes(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("10.1.0.0/16")
+	gw1 := net.ParseIP("10.0.0.1")
+	gw2 := net.ParseIP("10.0.0.2")
+
+	tests := []struct {
+		name   string
+		routes []RouteInfo
+		err    error
+	}{
+		{"no routes", nil, nil},
+		{"duplicate route", []RouteInfo{{Dst: *dst, Gw: gw1}, {Dst: *dst, Gw: gw1}}, nil},
+		{"same gateway at different metrics", []RouteInfo{{Dst: *dst, Gw: gw1}, {Dst: *dst, Gw: gw1, Metric: 100}}, nil},
+		{"different gateways at different metrics", []RouteInfo{{Dst: *dst, Gw: gw1}, {Dst: *dst, Gw: gw2, Metric: 100}}, errConflictingRoutes},
+		{"different gateways", []RouteInfo{{Dst: *dst, Gw: gw1}, {Dst: *dst, Gw: gw2}}, errConflictingRoutes},
+		{"gateway and device-only", []RouteInfo{{Dst: *dst, Gw: gw1}, {Dst: *dst, DevName: "eth1"}}, errConflictingRoutes},
+	}
+
+	for _, tt := range tests {
+		if err := validateRoutes(tt.routes); err != tt.err {
+			t.Errorf("%v: expected %v, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+// TestRoutesWithUnknownDevice tests that routes through a missing device fail before any netlink request.
+func TestRoutesWithUnknownDevice(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("10.1.0.0/16")
+	routes := []RouteInfo{{Dst: *dst, DevName: "nosuchdev0"}}
+
+	for name, program := range map[string]func(string, []RouteInfo) error{"add": addRoutes, "delete": deleteRoutes} {
+		err := program("lo", routes)
+		if err == nil || !strings.Contains(err.Error(), `interface "nosuchdev0" not found`) {
+			t.Errorf("%v: expected an unknown interface error, got %v", name, err)
+		}
+	}
+}
+
+// TestGetVethNames tests that veth names are unique per container interface and fit in IFNAMSIZ.
+func TestGetVethNames(t *testing.T) {
+	primary := &EndpointInfo{Id: "1234abcd-eth0", IfName: "eth0", Data: map[string]interface{}{OptVethName: "azure-pod1"}}
+	secondary := &EndpointInfo{Id: "1234abcd-net1", IfName: "net1", Data: map[string]interface{}{OptVethName: "azure-pod1"}}
+
+	hostIfName, contIfName := getVethNames(primary)
+	if hostIfName != hostVEthInterfacePrefix+generateVethName("azure-pod1", 11) {
+		t.Errorf("Primary interface veth name changed: %v", hostIfName)
+	}
+
+	secondaryHostIfName, secondaryContIfName := getVethNames(secondary)
+	if secondaryHostIfName == hostIfName || secondaryContIfName == contIfName {
+		t.Errorf("Secondary interface shares veth names %v %v with primary interface", secondaryHostIfName, secondaryContIfName)
+	}
+
+	again, _ := getVethNames(secondary)
+	if again != secondaryHostIfName {
+		t.Errorf("Veth names are not deterministic: %v %v", again, secondaryHostIfName)
+	}
+
+	for _, ifName := range []string{hostIfName, contIfName, secondaryHostIfName, secondaryContIfName} {
+		if len(ifName) > maxInterfaceNameLength {
+			t.Errorf("Interface name %v is longer than %v characters", ifName, maxInterfaceNameLength)
+		}
+	}
+}
+
+// TestValidateInterfaceNames tests that names that are too long or already in use are rejected.
+func TestValidateInterfaceNames(t *testing.T) {
+	if err := validateInterfaceNames("eth0", "azvunused0000", ""); err != nil {
+		t.Errorf("Unexpected error for free names: %v", err)
+	}
+
+	if err := validateInterfaceNames("averyverylongifname"); err == nil {
+		t.Errorf("Expected error for interface name longer than IFNAMSIZ")
+	}
+
+	if err := validateInterfaceNames("eth0", "lo"); err == nil {
+		t.Errorf("Expected error for interface name that is already in use")
+	}
+}
+
+// TestIsSysctlAllowed tests that only allowed sysctls can be set on endpoints.
+func TestIsSysctlAllowed(t *testing.T) {
+	tests := []struct {
+		key     string
+		allowed bool
+	}{
+		{"net.ipv4.ip_forward", true},
+		{"net.ipv4.conf.eth0.rp_filter", true},
+		{"net.ipv4.conf.all.arp_notify", true},
+		{"net.ipv4.conf.eth0.forwarding", false},
+		{"net.ipv4.conf..rp_filter", false},
+		{"net.ipv4.conf.a/../../x.rp_filter", false},
+		{"kernel.shmmax", false},
+	}
+
+	for _, tt := range tests {
+		if allowed := isSysctlAllowed(tt.key); allowed != tt.allowed {
+			t.Errorf("%v: expected %v, got %v", tt.key, tt.allowed, allowed)
+		}
+	}
+}
+
+// TestNewEndpointRollback tests that a failure at any stage of endpoint creation
+// removes the interfaces and rules created by earlier stages.
+func TestNewEndpointRollback(t *testing.T) {
+	defer func() { newEndpointClient = defaultNewEndpointClient }()
+
+	stages := []string{
+		"AddEndpoints",
+		"AddEndpointRules",
+		"OpenNamespace",
+		"MoveEndpointsToContainerNS",
+		"SetupContainerInterfaces",
+		"ConfigureContainerInterfacesAndRoutes",
+	}
+
+	for _, stage := range stages {
+		withTestNamespace(t, func(nsPath string) {
+			var client *fakeEndpointClient
+			newEndpointClient = func(nw *network, epInfo *EndpointInfo, hostIfName string, contIfName string, vlanid int) EndpointClient {
+				client = &fakeEndpointClient{
+					hostIfName: hostIfName,
+					contIfName: contIfName,
+					failStage:  stage,
+					rules:      make(map[string]bool),
+				}
+				return client
+			}
+
+			// A vanished container netns fails opening the namespace.
+			if stage == "OpenNamespace" {
+				nsPath = "/proc/0/ns/net"
+			}
+
+			nw := &network{
+				Id:        "test",
+				Endpoints: make(map[string]*endpoint),
+				extIf:     &externalInterface{Name: "lo"},
+				Mode:      opModeBridge,
+				MTU:       1500,
+			}
+
+			epInfo := &EndpointInfo{
+				Id:          "12345678-eth0",
+				IfName:      "eth0",
+				NetNs:       testNamespace(t, nsPath),
+				IPAddresses: []net.IPNet{{IP: net.ParseIP("10.0.0.4"), Mask: net.CIDRMask(24, 32)}},
+			}
+
+			if _, err := nw.newEndpointImpl(epInfo); err == nil {
+				t.Errorf("%v: expected endpoint creation to fail", stage)
+				return
+			}
+
+			if len(client.rules) != 0 {
+				t.Errorf("%v: endpoint rules were not rolled back: %v", stage, client.rules)
+			}
+
+			interfaces, err := net.Interfaces()
+			if err != nil {
+				t.Fatalf("%v: failed to list interfaces: %v", stage, err)
+			}
+
+			for _, iface := range interfaces {
+				if iface.Name != "lo" {
+					t.Errorf("%v: interface %v was not rolled back", stage, iface.Name)
+				}
+			}
+		})
+	}
+}
+
+// TestNewEndpointMTUExceedsNetwork tests that an endpoint cannot raise the MTU of its network.
+func TestNewEndpointMTUExceedsNetwork(t *testing.T) {
+	defer func() { newEndpointClient = defaultNewEndpointClient }()
+	newEndpointClient = func(nw *network, epInfo *EndpointInfo, hostIfName string, contIfName string, vlanid int) EndpointClient {
+		t.Errorf("Unexpected endpoint client for endpoint %v", epInfo.Id)
+		return &fakeEndpointClient{rules: make(map[string]bool)}
+	}
+
+	nw := &network{
+		Id:        "test",
+		Endpoints: make(map[string]*endpoint),
+		extIf:     &externalInterface{Name: "lo"},
+		Mode:      opModeBridge,
+		MTU:       1400,
+	}
+
+	epInfo := &EndpointInfo{Id: "12345678-eth0", IfName: "eth0", MTU: 1500}
+	if _, err := nw.newEndpoint(epInfo); err == nil {
+		t.Errorf("Expected endpoint MTU above the network MTU to be rejected")
+	}
+
+	if len(nw.Endpoints) != 0 {
+		t.Errorf("Unexpected endpoints %v", nw.Endpoints)
+	}
+}
+
+// TestNewEndpointMultipleAddresses tests that all addresses of an endpoint are assigned to its
+// single container interface and persisted.
+func TestNewEndpointMultipleAddresses(t *testing.T) {
+	defer func() { newEndpointClient = defaultNewEndpointClient }()
+
+	withTestNamespace(t, func(nsPath string) {
+		newEndpointClient = func(nw *network, epInfo *EndpointInfo, hostIfName string, contIfName string, vlanid int) EndpointClient {
+			return &fakeEndpointClient{hostIfName: hostIfName, contIfName: contIfName, rules: make(map[string]bool)}
+		}
+
+		nw := &network{
+			Id:        "test",
+			Endpoints: make(map[string]*endpoint),
+			extIf:     &externalInterface{Name: "lo"},
+			Mode:      opModeBridge,
+			MTU:       1500,
+		}
+
+		epInfo := &EndpointInfo{
+			Id:     "12345678-eth0",
+			IfName: "eth0",
+			NetNs:  testNamespace(t, nsPath),
+			IPAddresses: []net.IPNet{
+				{IP: net.ParseIP("10.0.0.4").To4(), Mask: net.CIDRMask(24, 32)},
+				{IP: net.ParseIP("10.0.0.5").To4(), Mask: net.CIDRMask(24, 32)},
+				{IP: net.ParseIP("192.168.10.1").To4(), Mask: net.CIDRMask(32, 32)},
+			},
+		}
+
+		ep, err := nw.newEndpointImpl(epInfo)
+		if err != nil {
+			t.Fatalf("Failed to create endpoint: %v", err)
+		}
+
+		if len(ep.IPAddresses) != len(epInfo.IPAddresses) {
+			t.Errorf("Expected %v persisted addresses, got %v", len(epInfo.IPAddresses), ep.IPAddresses)
+		}
+
+		containerIf, err := net.InterfaceByName("eth0")
+		if err != nil {
+			t.Fatalf("Failed to find container interface: %v", err)
+		}
+
+		addrs, err := containerIf.Addrs()
+		if err != nil {
+			t.Fatalf("Failed to list addresses: %v", err)
+		}
+
+		for _, ipAddr := range epInfo.IPAddresses {
+			found := false
+			for _, addr := range addrs {
+				if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ipAddr.IP) {
+					found = true
+				}
+			}
+
+			if !found {
+				t.Errorf("Address %v is not assigned to the container interface", ipAddr.IP)
+			}
+		}
+	})
+}
+
+// TestMacvlanEndpoint tests creating and deleting a macvlan endpoint with a requested MAC address.
+func TestMacvlanEndpoint(t *testing.T) {
+	withTestNamespace(t, func(nsPath string) {
+		parent := netlink.VEthLink{
+			LinkInfo: netlink.LinkInfo{
+				Type: netlink.LINK_TYPE_VETH,
+				Name: "parent0",
+			},
+			PeerName: "parent1",
+		}
+
+		if err := netlink.AddLink(&parent); err != nil {
+			t.Fatalf("Failed to create parent interface: %v", err)
+		}
+
+		nw := &network{
+			Id:           "test",
+			Endpoints:    make(map[string]*endpoint),
+			extIf:        &externalInterface{Name: "parent0"},
+			Mode:         opModeMacvlan,
+			ParentIfName: "parent0",
+		}
+
+		macAddress, _ := net.ParseMAC("02:00:00:00:00:42")
+		epInfo := &EndpointInfo{
+			Id:          "12345678-eth0",
+			IfName:      "eth0",
+			NetNs:       testNamespace(t, nsPath),
+			MacAddress:  macAddress,
+			IPAddresses: []net.IPNet{{IP: net.ParseIP("10.0.0.4").To4(), Mask: net.CIDRMask(24, 32)}},
+		}
+
+		ep, err := nw.newEndpointImpl(epInfo)
+		if err != nil {
+			t.Fatalf("Failed to create endpoint: %v", err)
+		}
+
+		if ep.HostIfName != "" {
+			t.Errorf("Macvlan endpoint has host interface %v", ep.HostIfName)
+		}
+
+		containerIf, err := net.InterfaceByName("eth0")
+		if err != nil {
+			t.Fatalf("Failed to find container interface: %v", err)
+		}
+
+		if containerIf.HardwareAddr.String() != macAddress.String() {
+			t.Errorf("Expected MAC address %v, got %v", macAddress, containerIf.HardwareAddr)
+		}
+
+		interfaces, _ := net.Interfaces()
+		if len(interfaces) != 4 {
+			t.Errorf("Expected only lo, the parent veth pair and eth0, got %v", interfaces)
+		}
+
+		if err := nw.deleteEndpointImpl(ep); err != nil {
+			t.Fatalf("Failed to delete endpoint: %v", err)
+		}
+
+		if _, err := net.InterfaceByName("eth0"); err == nil {
+			t.Errorf("Container interface was not deleted")
+		}
+	})
+}
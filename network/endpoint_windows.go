@@ -4,35 +4,88 @@
 package network
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/Azure/azure-container-networking/common"
+	"github.com/Azure/azure-container-networking/common/retry"
 	"github.com/Azure/azure-container-networking/log"
 	"github.com/Azure/azure-container-networking/network/policy"
+	"github.com/Azure/azure-container-networking/platform"
 	"github.com/Microsoft/hcsshim"
+	"github.com/Microsoft/hcsshim/hcn"
 )
 
+const (
+	// Default retry policy for transient HNS failures.
+	defaultHNSRetryAttempts       = 5
+	defaultHNSRetryInitialBackoff = 500 * time.Millisecond
+	defaultHNSRetryMaxBackoff     = 8 * time.Second
+	hnsRetryJitter                = 0.2
+
+	// Delay before retrying an endpoint delete that failed after a failed detach.
+	endpointDeleteRetryDelay = 2 * time.Second
+
+	// Default time to wait for an HNS request to complete.
+	defaultHNSTimeout = 30 * time.Second
+
+	// Range of the ports of port mappings.
+	minPort = 1
+	maxPort = 65535
+)
+
+// Oldest HNS version supporting loopback DSR.
+var loopbackDSRMinHNSVersion = hcsshim.HNSVersion{Major: 9, Minor: 2}
+
+// Network modes whose traffic is not translated by outbound NAT on the host. L2tunnel networks
+// forward all container traffic to the physical host, which applies its own NAT, and transparent
+// networks attach containers directly to the physical network.
+var noOutboundNatModes = map[string]bool{
+	opModeTunnel:      true,
+	opModeTransparent: true,
+}
+
+// Error messages of transient HNS failures that are worth retrying.
+var transientHNSErrors = []string{
+	"rpc server is unavailable",
+	"rpc server is too busy",
+	"timeout",
+	"timed out",
+}
+
+// dualStackHNSEndpoint extends the vendored HNS endpoint schema with the IPv6 fields
+// understood by dual-stack capable HNS versions.
+type dualStackHNSEndpoint struct {
+	hcsshim.HNSEndpoint
+	IPv6Address      net.IP `json:",omitempty"`
+	IPv6PrefixLength uint8  `json:",omitempty"`
+}
+
 // HotAttachEndpoint is a wrapper of hcsshim's HotAttachEndpoint.
 func (endpoint *EndpointInfo) HotAttachEndpoint(containerID string) error {
 	return hcsshim.HotAttachEndpoint(containerID, endpoint.Id)
 }
 
-// ConstructEndpointID constructs endpoint name from netNsPath.
-func ConstructEndpointID(containerID string, netNsPath string, ifName string) (string, string) {
+// ConstructEndpointID constructs endpoint name from the network namespace.
+func ConstructEndpointID(containerID string, netNs *common.Namespace, ifName string) (string, string) {
 	if len(containerID) > 8 {
 		containerID = containerID[:8]
 	}
 
 	infraEpName, workloadEpName := "", ""
 
-	splits := strings.Split(netNsPath, ":")
-	if len(splits) == 2 {
+	if infraContainerID := netNs.ContainerID(); infraContainerID != "" {
 		// For workload containers, we extract its linking infrastructure container ID.
-		if len(splits[1]) > 8 {
-			splits[1] = splits[1][:8]
+		if len(infraContainerID) > 8 {
+			infraContainerID = infraContainerID[:8]
 		}
-		infraEpName = splits[1] + "-" + ifName
+		infraEpName = infraContainerID + "-" + ifName
 		workloadEpName = containerID + "-" + ifName
 	} else {
 		// For infrastructure containers, we use its container ID directly.
@@ -42,33 +95,184 @@ func ConstructEndpointID(containerID string, netNsPath string, ifName string) (s
 	return infraEpName, workloadEpName
 }
 
+// ConstructHashedEndpointID constructs endpoint name from the network namespace, appending a short hash of
+// the full container ID to the truncated container ID so that containers sharing an ID prefix get distinct names.
+func ConstructHashedEndpointID(containerID string, netNs *common.Namespace, ifName string) (string, string) {
+	infraEpName, workloadEpName := "", ""
+
+	if infraContainerID := netNs.ContainerID(); infraContainerID != "" {
+		// For workload containers, we extract its linking infrastructure container ID.
+		infraEpName = getHashedEndpointName(infraContainerID, ifName)
+		workloadEpName = getHashedEndpointName(containerID, ifName)
+	} else {
+		// For infrastructure containers, we use its container ID directly.
+		infraEpName = getHashedEndpointName(containerID, ifName)
+	}
+
+	return infraEpName, workloadEpName
+}
+
+// getHashedEndpointName returns the hashed endpoint name of a container interface.
+func getHashedEndpointName(containerID string, ifName string) string {
+	prefix := containerID
+	if len(prefix) > 8 {
+		prefix = prefix[:8]
+	}
+
+	return prefix + "-" + hashContainerID(containerID) + "-" + ifName
+}
+
+// getInfraContainerID returns the ID of the infrastructure container owning the endpoint.
+func getInfraContainerID(containerID string, netNs *common.Namespace) string {
+	if infraContainerID := netNs.ContainerID(); infraContainerID != "" {
+		return infraContainerID
+	}
+
+	return containerID
+}
+
 // newEndpointImpl creates a new endpoint in the network.
 func (nw *network) newEndpointImpl(epInfo *EndpointInfo) (*endpoint, error) {
 	var vlanid int
 
+	if nw.Mode == opModeNone {
+		return nw.newNoneEndpoint(epInfo)
+	}
+
 	if epInfo.Data != nil {
 		if _, ok := epInfo.Data[VlanIDKey]; ok {
 			vlanid = epInfo.Data[VlanIDKey].(int)
 		}
 	}
 
+	if vlanid != 0 && (vlanid < minVlanID || vlanid > maxVlanID) {
+		log.Printf("[net] Invalid VLAN ID %v, must be between %v and %v.", vlanid, minVlanID, maxVlanID)
+		return nil, errInvalidVlanID
+	}
+
 	// Get Infrastructure containerID. Handle ADD calls for workload container.
 	var err error
-	infraEpName, _ := ConstructEndpointID(epInfo.ContainerID, epInfo.NetNsPath, epInfo.IfName)
+	var infraEpName, workloadEpName string
+	if epInfo.HashedEndpointID {
+		infraEpName, workloadEpName = ConstructHashedEndpointID(epInfo.ContainerID, epInfo.NetNs, epInfo.IfName)
+	} else {
+		infraEpName, workloadEpName = ConstructEndpointID(epInfo.ContainerID, epInfo.NetNs, epInfo.IfName)
+	}
+
+	// Truncated container IDs can collide, fail instead of taking over another container's endpoint.
+	infraContainerID := getInfraContainerID(epInfo.ContainerID, epInfo.NetNs)
+	for _, ep := range nw.Endpoints {
+		if ep.Id == infraEpName && ep.ContainerID != "" && ep.ContainerID != infraContainerID {
+			log.Printf("[net] Endpoint name %v is already used by container %v.", infraEpName, ep.ContainerID)
+			return nil, errEndpointNameCollision
+		}
+	}
+
+	// Workload containers share the endpoint of their infrastructure container.
+	if workloadEpName != "" {
+		return nw.newWorkloadEndpointImpl(epInfo, infraEpName, workloadEpName)
+	}
+
+	if err = validateIPAddresses(epInfo); err != nil {
+		return nil, err
+	}
+
+	// Exclude the requested destinations from SNAT on host.
+	policies := nw.getEndpointPolicies(epInfo.Policies)
+	if epInfo.EnableSnatOnHost && len(epInfo.OutBoundNatExceptionList) > 0 && !noOutboundNatModes[nw.Mode] {
+		policies, err = policy.AddOutBoundNatExceptions(policies, epInfo.OutBoundNatExceptionList)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Publish container ports on the host.
+	if err = validatePortMappings(epInfo.PortMappings); err != nil {
+		return nil, err
+	}
+
+	for _, mapping := range epInfo.PortMappings {
+		policies = append(policies, policy.GetNatPolicy(mapping.Protocol, uint16(mapping.HostPort), uint16(mapping.ContainerPort)))
+	}
+
+	// Only fail on older builds when loopback DSR is explicitly requested.
+	if epInfo.EnableLoopbackDSR {
+		if err = checkLoopbackDSRSupported(epInfo.HNSTimeout); err != nil {
+			return nil, err
+		}
+	}
+
+	// Validate the ACLs before making any HNS call.
+	aclPolicies, err := policy.SerializeACLPolicies(epInfo.ACLPolicies)
+	if err != nil {
+		log.Printf("[net] Invalid ACL policies %+v: %v.", epInfo.ACLPolicies, err)
+		return nil, err
+	}
+
+	hnsEndpoint := &dualStackHNSEndpoint{
+		HNSEndpoint: hcsshim.HNSEndpoint{
+			Name:           infraEpName,
+			VirtualNetwork: nw.HnsId,
+			DNSSuffix:      strings.Join(epInfo.GetSearchDomains(), ","),
+			DNSServerList:  strings.Join(epInfo.DNS.Servers, ","),
+			Policies:       policy.SerializePolicies(policy.EndpointPolicy, policies, epInfo.Data),
+		},
+	}
+
+	// Tag the endpoint traffic with the VLAN ID.
+	if vlanid != 0 {
+		vlanPolicy := hcsshim.VlanPolicy{
+			Type: hcsshim.VLAN,
+			VLAN: uint(vlanid),
+		}
+		serializedVlanPolicy, _ := json.Marshal(vlanPolicy)
+		hnsEndpoint.Policies = append(hnsEndpoint.Policies, serializedVlanPolicy)
+	}
 
-	hnsEndpoint := &hcsshim.HNSEndpoint{
-		Name:           infraEpName,
-		VirtualNetwork: nw.HnsId,
-		DNSSuffix:      epInfo.DNS.Suffix,
-		DNSServerList:  strings.Join(epInfo.DNS.Servers, ","),
-		Policies:       policy.SerializePolicies(policy.EndpointPolicy, epInfo.Policies, epInfo.Data),
+	// Program the endpoint routes in the container.
+	hnsEndpoint.Policies = append(hnsEndpoint.Policies, getRoutePolicies(epInfo.Routes)...)
+	hnsEndpoint.Policies = append(hnsEndpoint.Policies, aclPolicies...)
+
+	// Request a specific MAC address if one is set.
+	if epInfo.MacAddress != nil {
+		hnsEndpoint.MacAddress = formatHNSMacAddress(epInfo.MacAddress)
 	}
 
-	// HNS currently supports only one IP address per endpoint.
-	if epInfo.IPAddresses != nil {
-		hnsEndpoint.IPAddress = epInfo.IPAddresses[0].IP
-		pl, _ := epInfo.IPAddresses[0].Mask.Size()
+	// HNS supports at most one IPv4 and one IPv6 address per endpoint. Use the prefix length
+	// of the network subnet each address was allocated from.
+	ipv4Address, ipv6Address, err := getDualStackAddresses(nw.getSubnetAddresses(epInfo.IPAddresses))
+	if err != nil {
+		return nil, err
+	}
+
+	var ipAddresses []net.IPNet
+	if ipv4Address != nil {
+		hnsEndpoint.IPAddress = ipv4Address.IP
+		pl, _ := ipv4Address.Mask.Size()
 		hnsEndpoint.PrefixLength = uint8(pl)
+		ipAddresses = append(ipAddresses, *ipv4Address)
+
+		// Networks with multiple subnets need the gateway of the subnet the address belongs to.
+		// HNS programs a default route through the gateway, which only primary endpoints get.
+		if gateway := nw.getSubnetGateway(ipAddresses, platform.AfINET); gateway != nil && !epInfo.Secondary {
+			hnsEndpoint.GatewayAddress = gateway.String()
+		}
+	}
+
+	if ipv6Address != nil {
+		hnsEndpoint.IPv6Address = ipv6Address.IP
+		pl, _ := ipv6Address.Mask.Size()
+		hnsEndpoint.IPv6PrefixLength = uint8(pl)
+		ipAddresses = append(ipAddresses, *ipv6Address)
+	}
+
+	// Let host processes reach the endpoint addresses through loopback DSR.
+	if epInfo.EnableLoopbackDSR {
+		var destinations []string
+		for _, ipAddress := range ipAddresses {
+			destinations = append(destinations, ipAddress.IP.String())
+		}
+		hnsEndpoint.Policies = append(hnsEndpoint.Policies, policy.SerializeLoopbackDSRPolicy(destinations))
 	}
 
 	// Marshal the request.
@@ -78,68 +282,1011 @@ func (nw *network) newEndpointImpl(epInfo *EndpointInfo) (*endpoint, error) {
 	}
 	hnsRequest := string(buffer)
 
-	// Create the HNS endpoint.
-	log.Printf("[net] HNSEndpointRequest POST request:%+v", hnsRequest)
-	hnsResponse, err := hcsshim.HNSEndpointRequest("POST", "", hnsRequest)
-	log.Printf("[net] HNSEndpointRequest POST response:%+v err:%v.", hnsResponse, err)
+	// Requests that cannot be expressed in the HCN schema are made with HNS V1.
+	apiVersion := nw.getHNSAPIVersion(epInfo.HNSTimeout)
+	var hcnRequest *hcn.HostComputeEndpoint
+	if apiVersion == hnsAPIVersionV2 {
+		// Like with HNS V1, only primary endpoints get a default route.
+		var gateways []net.IP
+		if !epInfo.Secondary {
+			gateways = nw.getHcnGateways(ipAddresses)
+		}
+
+		var hcnErr error
+		if hcnRequest, hcnErr = newHcnEndpoint(hnsEndpoint, gateways); hcnErr != nil {
+			log.Printf("[net] Creating endpoint %v with HNS V1, its request cannot be translated to HCN: %v.", infraEpName, hcnErr)
+			apiVersion = hnsAPIVersionV1
+		}
+	}
+
+	qosRequested := policy.HasHNSPolicy(hnsEndpoint.Policies, hcsshim.QOS)
+
+	// Delete the endpoint if it cannot be set up. Endpoints created by requests that time out
+	// are deleted when the requests complete.
+	var hnsResponse *hcsshim.HNSEndpoint
+	defer func() {
+		if err != nil && hnsResponse != nil {
+			deleteHNSEndpointWithTimeout(epInfo.HNSTimeout, apiVersion, hnsResponse.Id)
+		}
+	}()
+
+	// Reuse the endpoint left behind by a previous attempt to create this endpoint, if any.
+	hnsResponse, err = nw.getReusableHNSEndpoint(epInfo.HNSTimeout, infraEpName, ipv4Address)
 	if err != nil {
 		return nil, err
 	}
 
-	defer func() {
+	if hnsResponse == nil {
+		// Create the HNS endpoint.
+		err = retryHNSCall(epInfo.RetryPolicy, func() error {
+			var err error
+			hnsResponse, err = createHNSEndpointWithTimeout(epInfo.HNSTimeout, apiVersion, hnsRequest, hcnRequest)
+			return err
+		})
 		if err != nil {
-			log.Printf("[net] HNSEndpointRequest DELETE id:%v", hnsResponse.Id)
-			hnsResponse, err := hcsshim.HNSEndpointRequest("DELETE", hnsResponse.Id, "")
-			log.Printf("[net] HNSEndpointRequest DELETE response:%+v err:%v.", hnsResponse, err)
+			if qosRequested {
+				err = fmt.Errorf("Failed to create endpoint with QoS policy, HNS on this Windows build may not support it: %v", err)
+			}
+			return nil, err
 		}
-	}()
+	}
 
-	// Attach the endpoint.
-	log.Printf("[net] Attaching endpoint %v to container %v.", hnsResponse.Id, epInfo.ContainerID)
-	err = hcsshim.HotAttachEndpoint(epInfo.ContainerID, hnsResponse.Id)
+	// Older HNS versions silently ignore QoS policies, do not leave the endpoint unshaped.
+	// HCN fails requests with policies it does not support instead.
+	if qosRequested && apiVersion == hnsAPIVersionV1 && !policy.HasHNSPolicy(hnsResponse.Policies, hcsshim.QOS) {
+		log.Printf("[net] HNS did not apply the QoS policy to endpoint %v.", hnsResponse.Id)
+		err = errQosPolicyNotSupported
+		return nil, err
+	}
+
+	// Make sure HNS programmed the requested MAC address.
+	macAddress, err := net.ParseMAC(hnsResponse.MacAddress)
+	if err != nil {
+		log.Printf("[net] Failed to parse MAC address %v of endpoint %v: %v.", hnsResponse.MacAddress, hnsResponse.Id, err)
+		return nil, err
+	}
+
+	if epInfo.MacAddress != nil && !bytes.Equal(macAddress, epInfo.MacAddress) {
+		log.Printf("[net] Endpoint %v has MAC address %v, requested %v.", hnsResponse.Id, macAddress, epInfo.MacAddress)
+		err = errMacAddressMismatch
+		return nil, err
+	}
+
+	// Attach the endpoint. The deferred cleanup above only runs once all attempts have failed.
+	err = retryHNSCall(epInfo.RetryPolicy, func() error {
+		var err error
+		if epInfo.NetworkCompartmentID != 0 {
+			// Process-isolated workloads have no container, attach the endpoint to their compartment instead.
+			log.Printf("[net] Attaching endpoint %v to compartment %v.", hnsResponse.Id, epInfo.NetworkCompartmentID)
+			err = hostAttachEndpointWithTimeout(epInfo.HNSTimeout, hnsResponse.Id, epInfo.NetworkCompartmentID)
+		} else {
+			log.Printf("[net] Attaching endpoint %v to container %v.", hnsResponse.Id, epInfo.ContainerID)
+			err = hotAttachEndpointWithTimeout(epInfo.HNSTimeout, epInfo.ContainerID, hnsResponse.Id)
+		}
+
+		if err != nil && isAlreadyAttachedError(err) {
+			log.Printf("[net] Endpoint %v is already attached.", hnsResponse.Id)
+			return nil
+		}
+		return err
+	})
 	if err != nil {
 		log.Printf("[net] Failed to attach endpoint: %v.", err)
 		return nil, err
 	}
 
+	// Record the address HNS assigned from the pool.
+	if len(ipAddresses) == 0 && hnsResponse.IPAddress != nil {
+		ipAddresses = append(ipAddresses, net.IPNet{
+			IP:   hnsResponse.IPAddress,
+			Mask: net.CIDRMask(int(hnsResponse.PrefixLength), 32),
+		})
+	}
+
+	gateways := nw.getEndpointGateways(hnsResponse, ipv6Address)
+
 	// Create the endpoint object.
 	ep := &endpoint{
-		Id:               infraEpName,
-		HnsId:            hnsResponse.Id,
-		SandboxKey:       epInfo.ContainerID,
-		IfName:           epInfo.IfName,
-		IPAddresses:      epInfo.IPAddresses,
-		Gateways:         []net.IP{net.ParseIP(hnsResponse.GatewayAddress)},
-		DNS:              epInfo.DNS,
-		VlanID:           vlanid,
-		EnableSnatOnHost: epInfo.EnableSnatOnHost,
+		Id:                   infraEpName,
+		HnsId:                hnsResponse.Id,
+		SandboxKey:           epInfo.ContainerID,
+		IfName:               epInfo.IfName,
+		IPAddresses:          ipAddresses,
+		Gateways:             gateways,
+		DNS:                  epInfo.DNS,
+		SearchDomains:        epInfo.SearchDomains,
+		VlanID:               vlanid,
+		EnableSnatOnHost:     epInfo.EnableSnatOnHost,
+		MacAddress:           macAddress,
+		HNSAPIVersion:        apiVersion,
+		ContainerID:          epInfo.ContainerID,
+		Attached:             true,
+		PortMappings:         epInfo.PortMappings,
+		HNSTimeout:           epInfo.HNSTimeout,
+		NetworkCompartmentID: epInfo.NetworkCompartmentID,
 	}
 
 	for _, route := range epInfo.Routes {
 		ep.Routes = append(ep.Routes, route)
 	}
 
-	ep.MacAddress, _ = net.ParseMAC(hnsResponse.MacAddress)
+	return ep, nil
+}
+
+// newWorkloadEndpointImpl attaches the endpoint of an infrastructure container to a workload container.
+func (nw *network) newWorkloadEndpointImpl(epInfo *EndpointInfo, infraEpName string, workloadEpName string) (*endpoint, error) {
+	infraEp, err := nw.getEndpoint(infraEpName)
+	if err != nil {
+		log.Printf("[net] Endpoint %v of the infrastructure container of %v not found.", infraEpName, epInfo.ContainerID)
+		return nil, err
+	}
+
+	// Containers sharing the network compartment of the infrastructure container report the endpoint as attached.
+	err = retryHNSCall(epInfo.RetryPolicy, func() error {
+		log.Printf("[net] Attaching endpoint %v to container %v.", infraEp.HnsId, epInfo.ContainerID)
+		err := hotAttachEndpointWithTimeout(epInfo.HNSTimeout, epInfo.ContainerID, infraEp.HnsId)
+		if err != nil && isAlreadyAttachedError(err) {
+			log.Printf("[net] Endpoint %v is already attached to container %v.", infraEp.HnsId, epInfo.ContainerID)
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		log.Printf("[net] Failed to attach endpoint: %v.", err)
+		return nil, err
+	}
+
+	// Count each workload container once, even if its ADD is retried.
+	if existingEp := nw.Endpoints[epInfo.Id]; existingEp == nil || existingEp.InfraEndpointId != infraEp.Id {
+		infraEp.RefCount++
+	}
+
+	ep := &endpoint{
+		Id:               workloadEpName,
+		HnsId:            infraEp.HnsId,
+		SandboxKey:       epInfo.ContainerID,
+		IfName:           epInfo.IfName,
+		IPAddresses:      infraEp.IPAddresses,
+		Gateways:         infraEp.Gateways,
+		DNS:              infraEp.DNS,
+		SearchDomains:    infraEp.SearchDomains,
+		Routes:           infraEp.Routes,
+		VlanID:           infraEp.VlanID,
+		EnableSnatOnHost: infraEp.EnableSnatOnHost,
+		MacAddress:       infraEp.MacAddress,
+		ContainerID:      epInfo.ContainerID,
+		Attached:         true,
+		InfraEndpointId:  infraEp.Id,
+		HNSTimeout:       epInfo.HNSTimeout,
+		Secondary:        infraEp.Secondary,
+	}
 
 	return ep, nil
 }
 
+// getEndpointPolicies returns the endpoint policies that apply to the type of the network.
+func (nw *network) getEndpointPolicies(policies []policy.Policy) []policy.Policy {
+	if !noOutboundNatModes[nw.Mode] {
+		return policies
+	}
+
+	var filtered []policy.Policy
+	for _, p := range policies {
+		if policy.IsPolicyTypeOutBoundNAT(p) {
+			log.Printf("[net] Skipping OutBoundNAT policy in %v network %v.", nw.Mode, nw.Id)
+			continue
+		}
+
+		filtered = append(filtered, p)
+	}
+
+	return filtered
+}
+
+// checkLoopbackDSRSupported returns an error if the HNS version does not support loopback DSR.
+func checkLoopbackDSRSupported(timeout time.Duration) error {
+	globals, err := getHNSGlobalsWithTimeout(timeout)
+	if err != nil {
+		log.Printf("[net] Failed to query HNS version: %v.", err)
+		return err
+	}
+
+	if !isHNSVersionAtLeast(globals.Version, loopbackDSRMinHNSVersion) {
+		log.Printf("[net] HNS version %+v does not support loopback DSR.", globals.Version)
+		return errLoopbackDSRNotSupported
+	}
+
+	return nil
+}
+
+// getEndpointGateways returns the IPv4 and IPv6 gateways of an HNS endpoint.
+// Gateways that cannot be parsed are logged and left out.
+func (nw *network) getEndpointGateways(hnsEndpoint *hcsshim.HNSEndpoint, ipv6Address *net.IPNet) []net.IP {
+	var gateways []net.IP
+
+	if hnsEndpoint.GatewayAddress != "" {
+		if gateway := net.ParseIP(hnsEndpoint.GatewayAddress); gateway != nil {
+			gateways = append(gateways, gateway)
+		} else {
+			log.Printf("[net] Failed to parse gateway %v of endpoint %v.", hnsEndpoint.GatewayAddress, hnsEndpoint.Id)
+		}
+	}
+
+	// The vendored HNS schema does not return the IPv6 gateway, so take it from the subnet the
+	// IPv6 address belongs to, or else from the network's first IPv6 subnet.
+	if ipv6Address != nil {
+		gateway := nw.getSubnetGateway([]net.IPNet{*ipv6Address}, platform.AfINET6)
+		if gateway == nil {
+			for _, subnet := range nw.Subnets {
+				if subnet.Family == platform.AfINET6 && subnet.Gateway != nil {
+					gateway = subnet.Gateway
+					break
+				}
+			}
+		}
+
+		if gateway != nil && gateway.To4() == nil {
+			gateways = append(gateways, gateway)
+		} else {
+			log.Printf("[net] No IPv6 gateway found for endpoint %v.", hnsEndpoint.Id)
+		}
+	}
+
+	return gateways
+}
+
+// formatHNSMacAddress formats a MAC address in the dash separated notation used by HNS.
+func formatHNSMacAddress(macAddress net.HardwareAddr) string {
+	return strings.ToUpper(strings.Replace(macAddress.String(), ":", "-", -1))
+}
+
+// validateIPAddresses checks that the endpoint addresses can be programmed in HNS.
+func validateIPAddresses(epInfo *EndpointInfo) error {
+	if len(epInfo.IPAddresses) == 0 {
+		if epInfo.AllowHNSAssignedIPAddress {
+			log.Printf("[net] Endpoint %v has no IP address, HNS will assign one from the pool.", epInfo.Id)
+			return nil
+		}
+
+		return ErrNoIPAddress
+	}
+
+	// HNS supports at most one IPv4 and one IPv6 address per endpoint.
+	if len(epInfo.IPAddresses) > 2 {
+		log.Printf("[net] Endpoint %v has too many IP addresses %v.", epInfo.Id, epInfo.IPAddresses)
+		return ErrTooManyIPAddresses
+	}
+
+	_, _, err := getDualStackAddresses(epInfo.IPAddresses)
+	return err
+}
+
+// validatePortMappings checks that the port mappings can be published as HNS NAT policies. NAT policies
+// apply to all host addresses, so mappings to a specific host IP are rejected.
+func validatePortMappings(portMappings []PortMapping) error {
+	for _, mapping := range portMappings {
+		if mapping.HostPort < minPort || mapping.HostPort > maxPort ||
+			mapping.ContainerPort < minPort || mapping.ContainerPort > maxPort {
+			log.Printf("[net] Invalid port mapping %+v, ports must be between %v and %v.", mapping, minPort, maxPort)
+			return errPortOutOfRange
+		}
+
+		if protocol := strings.ToLower(mapping.Protocol); protocol != "tcp" && protocol != "udp" {
+			log.Printf("[net] Invalid port mapping %+v, protocol must be tcp or udp.", mapping)
+			return errPortMappingProtocolInvalid
+		}
+
+		if mapping.HostIP != nil && !mapping.HostIP.IsUnspecified() {
+			log.Printf("[net] Invalid port mapping %+v, HNS cannot publish ports on a specific host IP.", mapping)
+			return errPortMappingHostIPNotSupported
+		}
+	}
+
+	return nil
+}
+
+// getDualStackAddresses splits the endpoint addresses into at most one IPv4 and one IPv6 address.
+func getDualStackAddresses(ipAddresses []net.IPNet) (*net.IPNet, *net.IPNet, error) {
+	var ipv4Address, ipv6Address *net.IPNet
+
+	for i := range ipAddresses {
+		ipAddr := &ipAddresses[i]
+		if ipAddr.IP.To4() != nil {
+			if ipv4Address != nil {
+				log.Printf("[net] Endpoint has multiple IPv4 addresses %v and %v.", ipv4Address, ipAddr)
+				return nil, nil, errMultipleIPAddressesOfSameFamily
+			}
+			ipv4Address = ipAddr
+		} else {
+			if ipv6Address != nil {
+				log.Printf("[net] Endpoint has multiple IPv6 addresses %v and %v.", ipv6Address, ipAddr)
+				return nil, nil, errMultipleIPAddressesOfSameFamily
+			}
+			ipv6Address = ipAddr
+		}
+	}
+
+	return ipv4Address, ipv6Address, nil
+}
+
+// getReusableHNSEndpoint returns the HNS endpoint with the given name if it belongs to this network
+// and has the requested IPv4 address. Such an endpoint is left behind when the runtime retries an
+// ADD that timed out, since endpoint names are derived from the container ID. An endpoint of this
+// network with the name and another address belongs to another container whose truncated ID
+// collides with this one, and fails with errEndpointNameCollision.
+func (nw *network) getReusableHNSEndpoint(timeout time.Duration, name string, ipv4Address *net.IPNet) (*hcsshim.HNSEndpoint, error) {
+	var hnsEndpoint *hcsshim.HNSEndpoint
+	err := callHNSWithTimeout(timeout, func() error {
+		var err error
+		hnsEndpoint, err = hns.GetEndpointByName(name)
+		return err
+	})
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil, nil
+		}
+		log.Printf("[net] Failed to query HNS endpoint %v: %v.", name, err)
+		return nil, err
+	}
+
+	if hnsEndpoint == nil || !strings.EqualFold(hnsEndpoint.VirtualNetwork, nw.HnsId) {
+		return nil, nil
+	}
+
+	// Endpoints without a requested address cannot be told apart, create a new one.
+	if ipv4Address == nil {
+		log.Printf("[net] Found HNS endpoint %v with name %v that cannot be reused.", hnsEndpoint.Id, name)
+		return nil, nil
+	}
+
+	if !hnsEndpoint.IPAddress.Equal(ipv4Address.IP) {
+		log.Printf("[net] Endpoint name %v is already used by HNS endpoint %v with address %v.",
+			name, hnsEndpoint.Id, hnsEndpoint.IPAddress)
+		return nil, errEndpointNameCollision
+	}
+
+	log.Printf("[net] Reusing existing HNS endpoint %+v.", hnsEndpoint)
+
+	return hnsEndpoint, nil
+}
+
+// isAlreadyAttachedError returns true if the attach failed because the endpoint is already attached.
+func isAlreadyAttachedError(err error) bool {
+	return unwrapHNSError(err) == hcsshim.ErrVmcomputeOperationInvalidState ||
+		strings.Contains(strings.ToLower(err.Error()), "already attached")
+}
+
+// isNotFoundError returns true if the HNS error indicates that the object does not exist.
+func isNotFoundError(err error) bool {
+	message := strings.ToLower(err.Error())
+	return hcsshim.IsNotExist(unwrapHNSError(err)) || hcn.IsNotFoundError(unwrapHNSError(err)) ||
+		strings.Contains(message, "element not found") ||
+		strings.Contains(message, "0x490")
+}
+
+// retryHNSCall invokes an HNS operation until it succeeds, fails with a permanent error
+// or exhausts the retry policy. A nil policy selects the default policy, and zero backoffs
+// select the default backoffs.
+func retryHNSCall(retryPolicy *RetryPolicy, operation func() error) error {
+	if retryPolicy == nil {
+		retryPolicy = &RetryPolicy{
+			MaxAttempts:    defaultHNSRetryAttempts,
+			InitialBackoff: defaultHNSRetryInitialBackoff,
+			MaxBackoff:     defaultHNSRetryMaxBackoff,
+		}
+	}
+
+	// A policy without attempts makes a single attempt.
+	maxAttempts := retryPolicy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	initialBackoff := retryPolicy.InitialBackoff
+	if initialBackoff <= 0 {
+		initialBackoff = defaultHNSRetryInitialBackoff
+	}
+
+	maxBackoff := retryPolicy.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultHNSRetryMaxBackoff
+	}
+
+	attempts := 0
+	err := retry.Do(context.Background(), retry.Policy{
+		Name:           "HNS operation",
+		MaxAttempts:    maxAttempts,
+		InitialBackoff: initialBackoff,
+		MaxBackoff:     maxBackoff,
+		Jitter:         hnsRetryJitter,
+		IsRetryable:    isRetryableHNSError,
+	}, func() error {
+		attempts++
+		return operation()
+	})
+
+	if attempts > 1 {
+		hnsRetries.Add(uint64(attempts - 1))
+	}
+
+	return err
+}
+
+// getHNSGlobalsWithTimeout queries the HNS global settings and stops waiting once the timeout expires.
+func getHNSGlobalsWithTimeout(timeout time.Duration) (*hcsshim.HNSGlobals, error) {
+	var globals *hcsshim.HNSGlobals
+	err := callHNSWithTimeout(timeout, func() error {
+		var err error
+		globals, err = hns.GetGlobals()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return globals, nil
+}
+
+// endpointRequestWithTimeout makes an HNS endpoint request and stops waiting for it once the timeout expires.
+func endpointRequestWithTimeout(timeout time.Duration, method, path, request string) (*hcsshim.HNSEndpoint, error) {
+	var hnsEndpoint *hcsshim.HNSEndpoint
+	err := callHNSWithTimeout(timeout, func() error {
+		var err error
+		hnsEndpoint, err = hns.EndpointRequest(method, path, request)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hnsEndpoint, nil
+}
+
+// createHNSEndpointWithTimeout creates an endpoint with the given HNS API and stops waiting for it once the
+// timeout expires. HCN endpoints are returned in their HNS V1 representation. An endpoint created after
+// the timeout expired is deleted, since the caller already gave up on it.
+func createHNSEndpointWithTimeout(timeout time.Duration, apiVersion int, hnsRequest string, hcnRequest *hcn.HostComputeEndpoint) (*hcsshim.HNSEndpoint, error) {
+	var hnsEndpoint *hcsshim.HNSEndpoint
+	err := callHNSWithTimeoutOrUndo(timeout, func() error {
+		var err error
+		if apiVersion == hnsAPIVersionV2 {
+			var endpoint *hcn.HostComputeEndpoint
+			log.Printf("[net] HcnCreateEndpoint request:%+v", hcnRequest)
+			endpoint, err = hns.CreateHcnEndpoint(hcnRequest)
+			if err == nil {
+				hnsEndpoint = toHNSEndpoint(endpoint)
+			}
+			log.Printf("[net] HcnCreateEndpoint response:%+v err:%v.", hnsEndpoint, err)
+			return err
+		}
+
+		log.Printf("[net] HNSEndpointRequest POST request:%+v", hnsRequest)
+		hnsEndpoint, err = hns.EndpointRequest("POST", "", hnsRequest)
+		log.Printf("[net] HNSEndpointRequest POST response:%+v err:%v.", hnsEndpoint, err)
+		return err
+	}, func() {
+		log.Printf("[net] Deleting endpoint %v created after the request timed out.", hnsEndpoint.Id)
+		deleteHNSEndpointWithTimeout(timeout, apiVersion, hnsEndpoint.Id)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hnsEndpoint, nil
+}
+
+// hotAttachEndpointWithTimeout attaches an endpoint to a container and stops waiting once the timeout expires.
+// An endpoint attached after the timeout expired is detached, since the caller already gave up on it.
+func hotAttachEndpointWithTimeout(timeout time.Duration, containerID string, endpointID string) error {
+	return callHNSWithTimeoutOrUndo(timeout, func() error {
+		return hns.HotAttachEndpoint(containerID, endpointID)
+	}, func() {
+		log.Printf("[net] Detaching endpoint %v attached to container %v after the request timed out.", endpointID, containerID)
+		hotDetachEndpointWithTimeout(timeout, containerID, endpointID)
+	})
+}
+
+// hotDetachEndpointWithTimeout detaches an endpoint from a container and stops waiting once the timeout expires.
+func hotDetachEndpointWithTimeout(timeout time.Duration, containerID string, endpointID string) error {
+	return callHNSWithTimeout(timeout, func() error {
+		return hns.HotDetachEndpoint(containerID, endpointID)
+	})
+}
+
+// hostAttachEndpointWithTimeout attaches an endpoint to a network compartment and stops waiting once the
+// timeout expires. An endpoint attached after the timeout expired is detached.
+func hostAttachEndpointWithTimeout(timeout time.Duration, endpointID string, compartmentID uint16) error {
+	return callHNSWithTimeoutOrUndo(timeout, func() error {
+		return hns.HostAttachEndpoint(endpointID, compartmentID)
+	}, func() {
+		log.Printf("[net] Detaching endpoint %v attached to compartment %v after the request timed out.", endpointID, compartmentID)
+		hostDetachEndpointWithTimeout(timeout, endpointID)
+	})
+}
+
+// hostDetachEndpointWithTimeout detaches an endpoint from its network compartment and stops waiting once
+// the timeout expires.
+func hostDetachEndpointWithTimeout(timeout time.Duration, endpointID string) error {
+	return callHNSWithTimeout(timeout, func() error {
+		return hns.HostDetachEndpoint(endpointID)
+	})
+}
+
+// callHNSWithTimeout runs an HNS operation under a context with the given deadline. HNS calls cannot be
+// cancelled, so an operation that times out keeps running in the background and its result is discarded.
+// Callers must only use the results set by the operation if it returns without error.
+// A zero timeout selects the default timeout.
+func callHNSWithTimeout(timeout time.Duration, operation func() error) error {
+	return callHNSWithTimeoutOrUndo(timeout, operation, nil)
+}
+
+// callHNSWithTimeoutOrUndo is like callHNSWithTimeout for operations that create HNS objects. If the
+// operation succeeds after the timeout expired, undo runs in the background to delete what it created.
+func callHNSWithTimeoutOrUndo(timeout time.Duration, operation func() error, undo func()) error {
+	if timeout <= 0 {
+		timeout = defaultHNSTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var lock sync.Mutex
+	timedOut := false
+
+	errChan := make(chan error, 1)
+	go func() {
+		err := operation()
+
+		lock.Lock()
+		abandoned := timedOut
+		errChan <- err
+		lock.Unlock()
+
+		if abandoned && err == nil && undo != nil {
+			undo()
+		}
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+	}
+
+	// The operation may have completed while the timeout expired.
+	lock.Lock()
+	defer lock.Unlock()
+
+	select {
+	case err := <-errChan:
+		return err
+	default:
+	}
+
+	timedOut = true
+	log.Printf("[net] HNS request did not complete within %v.", timeout)
+	return &HNSTimeoutError{Timeout: timeout}
+}
+
+// isRetryableHNSError returns true if the HNS error is transient, such as an unavailable
+// or busy RPC server or a timeout. Errors caused by invalid requests are permanent.
+func isRetryableHNSError(err error) bool {
+	// The timed out request may still be running, retrying would pile up more requests on a wedged HNS.
+	if IsHNSTimeoutError(err) {
+		return false
+	}
+
+	if hcsErr := unwrapHNSError(err); hcsshim.IsTimeout(hcsErr) || hcsshim.IsPending(hcsErr) {
+		return true
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, transientError := range transientHNSErrors {
+		if strings.Contains(message, transientError) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getHcnEndpointWithTimeout queries an endpoint with the HCN API and stops waiting once the timeout expires.
+func getHcnEndpointWithTimeout(timeout time.Duration, endpointID string) (*hcn.HostComputeEndpoint, error) {
+	var endpoint *hcn.HostComputeEndpoint
+	err := callHNSWithTimeout(timeout, func() error {
+		var err error
+		endpoint, err = hns.GetHcnEndpointByID(endpointID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return endpoint, nil
+}
+
+// applyHcnEndpointPolicyWithTimeout replaces the policies of an HCN endpoint and stops waiting once the
+// timeout expires.
+func applyHcnEndpointPolicyWithTimeout(timeout time.Duration, endpoint *hcn.HostComputeEndpoint, request hcn.PolicyEndpointRequest) error {
+	return callHNSWithTimeout(timeout, func() error {
+		return hns.ApplyHcnEndpointPolicy(endpoint, request)
+	})
+}
+
+// deleteHNSEndpointWithTimeout deletes an endpoint with the HNS API that created it and stops waiting
+// once the timeout expires.
+func deleteHNSEndpointWithTimeout(timeout time.Duration, apiVersion int, endpointID string) error {
+	if apiVersion == hnsAPIVersionV2 {
+		log.Printf("[net] HcnDeleteEndpoint id:%v", endpointID)
+		err := callHNSWithTimeout(timeout, func() error {
+			return hns.DeleteHcnEndpoint(endpointID)
+		})
+		log.Printf("[net] HcnDeleteEndpoint err:%v.", err)
+		return err
+	}
+
+	log.Printf("[net] HNSEndpointRequest DELETE id:%v", endpointID)
+	hnsResponse, err := endpointRequestWithTimeout(timeout, "DELETE", endpointID, "")
+	log.Printf("[net] HNSEndpointRequest DELETE response:%+v err:%v.", hnsResponse, err)
+	return err
+}
+
 // deleteEndpointImpl deletes an existing endpoint from the network.
 func (nw *network) deleteEndpointImpl(ep *endpoint) error {
-	// Delete the HNS endpoint.
-	log.Printf("[net] HNSEndpointRequest DELETE id:%v", ep.HnsId)
-	hnsResponse, err := hcsshim.HNSEndpointRequest("DELETE", ep.HnsId, "")
-	log.Printf("[net] HNSEndpointRequest DELETE response:%+v err:%v.", hnsResponse, err)
+	var detachErr error
+
+	if nw.Mode == opModeNone {
+		return nil
+	}
+
+	// Workload endpoints share the HNS endpoint of their infrastructure container, only detach them.
+	if ep.InfraEndpointId != "" {
+		return nw.deleteWorkloadEndpointImpl(ep)
+	}
+
+	if ep.RefCount > 0 {
+		log.Printf("[net] Deleting endpoint %v still shared with %v workload containers.", ep.Id, ep.RefCount)
+	}
+
+	// Detach the endpoint from its container or compartment first so that the vNIC is not left dangling.
+	if ep.Attached {
+		detachErr = retryHNSCall(nil, func() error {
+			if ep.NetworkCompartmentID != 0 {
+				log.Printf("[net] Detaching endpoint %v from compartment %v.", ep.HnsId, ep.NetworkCompartmentID)
+				return hostDetachEndpointWithTimeout(ep.HNSTimeout, ep.HnsId)
+			}
+
+			log.Printf("[net] Detaching endpoint %v from container %v.", ep.HnsId, ep.ContainerID)
+			return hotDetachEndpointWithTimeout(ep.HNSTimeout, ep.ContainerID, ep.HnsId)
+		})
+
+		if detachErr != nil && isNotFoundError(detachErr) {
+			log.Printf("[net] Endpoint %v is not attached: %v.", ep.HnsId, detachErr)
+			detachErr = nil
+		}
+
+		if detachErr != nil {
+			log.Printf("[net] Failed to detach endpoint %v: %v.", ep.HnsId, detachErr)
+		} else {
+			ep.Attached = false
+		}
+	}
+
+	// Delete the HNS endpoint with the API that created it.
+	log.Printf("[net] Deleting HNS endpoint %v addresses:%v port mappings:%+v", ep.HnsId, ep.IPAddresses, ep.PortMappings)
+	err := deleteHNSEndpointWithTimeout(ep.HNSTimeout, ep.HNSAPIVersion, ep.HnsId)
+
+	// A failed detach can briefly keep the endpoint busy, give HNS a moment and retry once.
+	if err != nil && detachErr != nil && !isNotFoundError(err) {
+		time.Sleep(endpointDeleteRetryDelay)
+
+		err = deleteHNSEndpointWithTimeout(ep.HNSTimeout, ep.HNSAPIVersion, ep.HnsId)
+		if err != nil && !isNotFoundError(err) {
+			return fmt.Errorf("Failed to delete endpoint %v, detach err:%v delete err:%v", ep.HnsId, detachErr, err)
+		}
+	}
+
+	// The endpoint is already gone, so the caller can forget about it.
+	if err != nil && isNotFoundError(err) {
+		log.Printf("[net] HNS endpoint %v is already deleted: %v.", ep.HnsId, err)
+		return nil
+	}
 
 	return err
 }
 
+// deleteWorkloadEndpointImpl detaches the shared endpoint of an infrastructure container from a workload container.
+func (nw *network) deleteWorkloadEndpointImpl(ep *endpoint) error {
+	err := retryHNSCall(nil, func() error {
+		log.Printf("[net] Detaching endpoint %v from container %v.", ep.HnsId, ep.ContainerID)
+		return hotDetachEndpointWithTimeout(ep.HNSTimeout, ep.ContainerID, ep.HnsId)
+	})
+	if err != nil && !isNotFoundError(err) {
+		log.Printf("[net] Failed to detach endpoint %v: %v.", ep.HnsId, err)
+		return err
+	}
+
+	if infraEp := nw.Endpoints[ep.InfraEndpointId]; infraEp != nil && infraEp.RefCount > 0 {
+		infraEp.RefCount--
+	}
+
+	return nil
+}
+
+// getStatsImpl returns the traffic counters of the endpoint.
+func (ep *endpoint) getStatsImpl() (*EndpointStats, error) {
+	// Endpoints of networks in none mode have no HNS endpoint to count traffic of.
+	if ep.HnsId == "" {
+		return nil, errEndpointStatsNotSupported
+	}
+
+	// Report stale endpoints as missing instead of as endpoints without traffic.
+	var err error
+	if ep.HNSAPIVersion == hnsAPIVersionV2 {
+		_, err = getHcnEndpointWithTimeout(ep.HNSTimeout, ep.HnsId)
+	} else {
+		_, err = endpointRequestWithTimeout(ep.HNSTimeout, "GET", ep.HnsId, "")
+	}
+	if err != nil {
+		if isNotFoundError(err) {
+			log.Printf("[net] HNS endpoint %v of endpoint %v not found.", ep.HnsId, ep.Id)
+			return nil, ErrEndpointNotFound
+		}
+		return nil, err
+	}
+
+	var networkStats []hcsshim.NetworkStats
+	err = callHNSWithTimeout(ep.HNSTimeout, func() error {
+		var err error
+		networkStats, err = hns.GetContainerNetworkStats(ep.ContainerID)
+		return err
+	})
+	if err != nil {
+		log.Printf("[net] Failed to query network statistics of container %v: %v.", ep.ContainerID, err)
+		return nil, err
+	}
+
+	stats := &EndpointStats{}
+	for _, networkStat := range networkStats {
+		if strings.EqualFold(networkStat.EndpointId, ep.HnsId) {
+			stats.BytesReceived = networkStat.BytesReceived
+			stats.BytesSent = networkStat.BytesSent
+			stats.PacketsReceived = networkStat.PacketsReceived
+			stats.PacketsSent = networkStat.PacketsSent
+			stats.DroppedPacketsIncoming = networkStat.DroppedPacketsIncoming
+			stats.DroppedPacketsOutgoing = networkStat.DroppedPacketsOutgoing
+			break
+		}
+	}
+
+	return stats, nil
+}
+
 // getInfoImpl returns information about the endpoint.
 func (ep *endpoint) getInfoImpl(epInfo *EndpointInfo) {
+	if epInfo.Data == nil {
+		epInfo.Data = make(map[string]interface{})
+	}
+
+	epInfo.IPAddresses = ep.IPAddresses
+	epInfo.MacAddress = ep.MacAddress
+	epInfo.Gateways = ep.Gateways
+	epInfo.DNS = ep.DNS
+	epInfo.SearchDomains = ep.SearchDomains
+	epInfo.PortMappings = ep.PortMappings
+
+	// Operational data reported to CNM and CNS.
+	var ipAddresses, gateways []string
+	for _, ipAddr := range ep.IPAddresses {
+		ipAddresses = append(ipAddresses, ipAddr.String())
+	}
+
+	for _, gw := range ep.Gateways {
+		gateways = append(gateways, gw.String())
+	}
+
 	epInfo.Data["hnsid"] = ep.HnsId
+	epInfo.Data["ipAddresses"] = ipAddresses
+	epInfo.Data["macAddress"] = ep.MacAddress.String()
+	epInfo.Data["gateways"] = gateways
+	epInfo.Data["dnsSuffix"] = ep.DNS.Suffix
+	epInfo.Data["dnsSuffixes"] = epInfo.GetSearchDomains()
+	epInfo.Data["dnsServers"] = ep.DNS.Servers
+	epInfo.Data[VlanIDKey] = ep.VlanID
+	epInfo.Data["attached"] = ep.Attached
 }
 
-// updateEndpointImpl in windows does nothing for now
+// updateEndpointImpl updates the DNS settings and routes of an existing HNS endpoint.
 func (nw *network) updateEndpointImpl(existingEpInfo *EndpointInfo, targetEpInfo *EndpointInfo) (*endpoint, error) {
-	return nil, nil
+	ep := nw.Endpoints[existingEpInfo.Id]
+	if ep == nil {
+		return nil, ErrEndpointNotFound
+	}
+
+	if nw.Mode == opModeNone {
+		return nw.updateNoneEndpoint(existingEpInfo, targetEpInfo)
+	}
+
+	// Update the endpoint with the HNS API that created it.
+	var err error
+	if ep.HNSAPIVersion == hnsAPIVersionV2 {
+		err = updateHcnEndpoint(ep, existingEpInfo, targetEpInfo)
+	} else {
+		err = updateHNSEndpoint(ep, existingEpInfo, targetEpInfo)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Update existing endpoint state with the new settings to persist.
+	ep.DNS = targetEpInfo.DNS
+	ep.SearchDomains = targetEpInfo.SearchDomains
+	ep.Routes = nil
+	for _, route := range targetEpInfo.Routes {
+		ep.Routes = append(ep.Routes, route)
+	}
+
+	return ep, nil
+}
+
+// updateHNSEndpoint updates the DNS settings and routes of an endpoint created with HNS V1.
+func updateHNSEndpoint(ep *endpoint, existingEpInfo *EndpointInfo, targetEpInfo *EndpointInfo) error {
+	// Query the current HNS endpoint state.
+	log.Printf("[net] HNSEndpointRequest GET id:%v", ep.HnsId)
+	hnsEndpoint, err := endpointRequestWithTimeout(ep.HNSTimeout, "GET", ep.HnsId, "")
+	log.Printf("[net] HNSEndpointRequest GET response:%+v err:%v.", hnsEndpoint, err)
+	if err != nil {
+		return err
+	}
+
+	if !applyEndpointUpdate(hnsEndpoint, existingEpInfo, targetEpInfo) {
+		log.Printf("[net] Endpoint %v is already up to date.", ep.Id)
+		return nil
+	}
+
+	// Marshal the request.
+	buffer, err := json.Marshal(hnsEndpoint)
+	if err != nil {
+		return err
+	}
+	hnsRequest := string(buffer)
+
+	// Update the HNS endpoint. HNS either applies the whole request or leaves the endpoint unchanged.
+	log.Printf("[net] HNSEndpointRequest POST id:%v request:%+v", ep.HnsId, hnsRequest)
+	hnsResponse, err := endpointRequestWithTimeout(ep.HNSTimeout, "POST", ep.HnsId, hnsRequest)
+	log.Printf("[net] HNSEndpointRequest POST response:%+v err:%v.", hnsResponse, err)
+
+	return err
+}
+
+// updateHcnEndpoint updates the routes of an endpoint created with HCN. HCN cannot change the DNS
+// settings of an existing endpoint.
+func updateHcnEndpoint(ep *endpoint, existingEpInfo *EndpointInfo, targetEpInfo *EndpointInfo) error {
+	if !dnsEqual(existingEpInfo, targetEpInfo) {
+		log.Printf("[net] Cannot update DNS of HCN endpoint %v from %+v to %+v.", ep.HnsId, existingEpInfo.DNS, targetEpInfo.DNS)
+		return errHcnDNSUpdateNotSupported
+	}
+
+	if routesEqual(existingEpInfo.Routes, targetEpInfo.Routes) {
+		log.Printf("[net] Endpoint %v is already up to date.", ep.Id)
+		return nil
+	}
+
+	// Query the current HCN endpoint policies.
+	log.Printf("[net] HcnGetEndpoint id:%v", ep.HnsId)
+	hcnEndpoint, err := getHcnEndpointWithTimeout(ep.HNSTimeout, ep.HnsId)
+	if err != nil {
+		log.Printf("[net] HcnGetEndpoint err:%v.", err)
+		return err
+	}
+
+	var routePolicies []json.RawMessage
+	for _, route := range targetEpInfo.Routes {
+		routePolicies = append(routePolicies, policy.SerializeRoutePolicy(route.Dst.String(), route.Gw.String(), false))
+	}
+
+	hcnRoutePolicies, err := policy.GetHcnEndpointPolicies(routePolicies)
+	if err != nil {
+		return err
+	}
+
+	// Replace the existing route policies and keep every other policy as is.
+	log.Printf("[net] Updating routes from %+v to %+v.", existingEpInfo.Routes, targetEpInfo.Routes)
+	var policies []hcn.EndpointPolicy
+	for _, hcnPolicy := range hcnEndpoint.Policies {
+		if !isHcnRoutePolicy(hcnPolicy) {
+			policies = append(policies, hcnPolicy)
+		}
+	}
+
+	request := hcn.PolicyEndpointRequest{Policies: append(policies, hcnRoutePolicies...)}
+	log.Printf("[net] HcnApplyEndpointPolicy id:%v request:%+v", ep.HnsId, request)
+	err = applyHcnEndpointPolicyWithTimeout(ep.HNSTimeout, hcnEndpoint, request)
+	log.Printf("[net] HcnApplyEndpointPolicy err:%v.", err)
+
+	return err
+}
+
+// dnsEqual returns true if both endpoints have the same DNS settings.
+func dnsEqual(epInfo *EndpointInfo, otherEpInfo *EndpointInfo) bool {
+	return strings.Join(epInfo.GetSearchDomains(), ",") == strings.Join(otherEpInfo.GetSearchDomains(), ",") &&
+		strings.Join(epInfo.DNS.Servers, ",") == strings.Join(otherEpInfo.DNS.Servers, ",")
+}
+
+// applyEndpointUpdate applies the DNS and route differences between the existing and
+// target endpoint to the HNS endpoint. It returns false if there is nothing to update.
+func applyEndpointUpdate(hnsEndpoint *hcsshim.HNSEndpoint, existingEpInfo *EndpointInfo, targetEpInfo *EndpointInfo) bool {
+	updated := false
+
+	if !dnsEqual(existingEpInfo, targetEpInfo) {
+		log.Printf("[net] Updating DNS from %+v to %+v.", existingEpInfo.DNS, targetEpInfo.DNS)
+		hnsEndpoint.DNSSuffix = strings.Join(targetEpInfo.GetSearchDomains(), ",")
+		hnsEndpoint.DNSServerList = strings.Join(targetEpInfo.DNS.Servers, ",")
+		updated = true
+	}
+
+	if !routesEqual(existingEpInfo.Routes, targetEpInfo.Routes) {
+		log.Printf("[net] Updating routes from %+v to %+v.", existingEpInfo.Routes, targetEpInfo.Routes)
+
+		// Replace the existing route policies and keep every other policy as is.
+		var policies []json.RawMessage
+		for _, hnsPolicy := range hnsEndpoint.Policies {
+			if policy.GetHNSPolicyType(hnsPolicy) != hcsshim.Route {
+				policies = append(policies, hnsPolicy)
+			}
+		}
+
+		hnsEndpoint.Policies = append(policies, getRoutePolicies(targetEpInfo.Routes)...)
+		updated = true
+	}
+
+	return updated
+}
+
+// getRoutePolicies returns the HNS route policies for the endpoint routes.
+// A route without a gateway is on-link, and a route without a destination is a default route.
+func getRoutePolicies(routes []RouteInfo) []json.RawMessage {
+	var policies []json.RawMessage
+
+	for _, route := range routes {
+		// Routes without a destination are default routes of the address family of their gateway.
+		destinationPrefix := route.Dst.String()
+		if route.Dst.IP == nil {
+			destinationPrefix = "0.0.0.0/0"
+			if route.Gw != nil && route.Gw.To4() == nil {
+				destinationPrefix = "::/0"
+			}
+		}
+
+		nextHop := ""
+		if route.Gw != nil && !route.Gw.IsUnspecified() {
+			nextHop = route.Gw.String()
+		}
+
+		policies = append(policies, policy.SerializeRoutePolicy(destinationPrefix, nextHop, false))
+	}
+
+	return policies
+}
+
+// routesEqual returns true if both lists contain the same set of routes.
+func routesEqual(routes []RouteInfo, otherRoutes []RouteInfo) bool {
+	if len(routes) != len(otherRoutes) {
+		return false
+	}
+
+	keys := make(map[string]int)
+	for _, route := range routes {
+		keys[route.Dst.String()+"|"+route.Gw.String()]++
+	}
+
+	for _, route := range otherRoutes {
+		key := route.Dst.String() + "|" + route.Gw.String()
+		if keys[key] == 0 {
+			return false
+		}
+		keys[key]--
+	}
+
+	return true
 }
@@ -0,0 +1,1346 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-container-networking/common"
+	"github.com/Azure/azure-container-networking/network/policy"
+	"github.com/Azure/azure-container-networking/platform"
+	"github.com/Microsoft/hcsshim"
+	"github.com/Microsoft/hcsshim/hcn"
+)
+
+var (
+	// Routes used by tests.
+	route1 = RouteInfo{
+		Dst: net.IPNet{IP: net.IPv4(10, 0, 1, 0), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Gw:  net.IPv4(10, 0, 0, 1),
+	}
+	route2 = RouteInfo{
+		Dst: net.IPNet{IP: net.IPv4(10, 0, 2, 0), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Gw:  net.IPv4(10, 0, 0, 1),
+	}
+)
+
+// fakeHnsClient is an in-memory HNS used by tests.
+type fakeHnsClient struct {
+	networks     map[string]*hcsshim.HNSNetwork
+	networkErr   error
+	endpoints    map[string]*hcsshim.HNSEndpoint
+	hcnEndpoints map[string]*hcn.HostComputeEndpoint
+	attached     map[string]string
+	lastID       int
+	version      hcsshim.HNSVersion
+	deleteErr    error
+	hostAttached map[string]uint16
+	// lastNetworkRequest is the body of the last network create or update request.
+	lastNetworkRequest string
+	// Network create requests wait for networkBlock, if set, and signal networkCreated when done.
+	networkBlock   chan struct{}
+	networkCreated chan struct{}
+	// Endpoint create requests wait for endpointBlock, if set, and delete requests signal endpointDeleted.
+	endpointBlock   chan struct{}
+	endpointDeleted chan struct{}
+	// Attach and detach requests wait for attachBlock and detachBlock, if set, and detach requests
+	// signal endpointDetached.
+	attachBlock      chan struct{}
+	detachBlock      chan struct{}
+	endpointDetached chan struct{}
+	// Endpoint create and attach requests fail with the next error of createErrs and attachErrs, if any.
+	createErrs     []error
+	attachErrs     []error
+	createAttempts int
+	attachAttempts int
+}
+
+// newFakeHnsClient installs a fake HNS client and returns it. Like hcsshimClient, it wraps the
+// errors it returns with wrapHNSError.
+func newFakeHnsClient() *fakeHnsClient {
+	fake := &fakeHnsClient{
+		networks:     map[string]*hcsshim.HNSNetwork{"hnsnw-1": {Id: "hnsnw-1", Name: "azure"}},
+		endpoints:    make(map[string]*hcsshim.HNSEndpoint),
+		hcnEndpoints: make(map[string]*hcn.HostComputeEndpoint),
+		attached:     make(map[string]string),
+		hostAttached: make(map[string]uint16),
+		version:      hcsshim.HNSVersion{Major: 9, Minor: 2},
+	}
+	hns = fake
+	return fake
+}
+
+func (fake *fakeHnsClient) NetworkRequest(method, path, request string) (*hcsshim.HNSNetwork, error) {
+	switch {
+	case method == "POST" && path == "":
+		if fake.networkErr != nil {
+			return nil, wrapHNSError(fake.networkErr)
+		}
+		if fake.networkBlock != nil {
+			<-fake.networkBlock
+			defer func() { fake.networkCreated <- struct{}{} }()
+		}
+		fake.lastNetworkRequest = request
+		var hnsNetwork hcsshim.HNSNetwork
+		if err := json.Unmarshal([]byte(request), &hnsNetwork); err != nil {
+			return nil, wrapHNSError(err)
+		}
+		fake.lastID++
+		hnsNetwork.Id = fmt.Sprintf("hnsnw-%v", fake.lastID)
+		fake.networks[hnsNetwork.Id] = &hnsNetwork
+		response := hnsNetwork
+		return &response, nil
+
+	case method == "POST":
+		hnsNetwork := fake.networks[path]
+		if hnsNetwork == nil {
+			return nil, wrapHNSError(fmt.Errorf("HNS failed with error : Element not found. "))
+		}
+		fake.lastNetworkRequest = request
+		var update hcsshim.HNSNetwork
+		if err := json.Unmarshal([]byte(request), &update); err != nil {
+			return nil, wrapHNSError(err)
+		}
+		hnsNetwork.Subnets = update.Subnets
+		response := *hnsNetwork
+		return &response, nil
+
+	case method == "GET" || method == "DELETE":
+		hnsNetwork := fake.networks[path]
+		if hnsNetwork == nil {
+			return nil, wrapHNSError(fmt.Errorf("HNS failed with error : Element not found. "))
+		}
+		if method == "DELETE" {
+			delete(fake.networks, path)
+		}
+		response := *hnsNetwork
+		return &response, nil
+	}
+
+	return nil, wrapHNSError(fmt.Errorf("Unexpected HNS request %v %v", method, path))
+}
+
+func (fake *fakeHnsClient) EndpointRequest(method, path, request string) (*hcsshim.HNSEndpoint, error) {
+	switch {
+	case method == "POST" && path == "":
+		if fake.endpointBlock != nil {
+			<-fake.endpointBlock
+		}
+		fake.createAttempts++
+		if len(fake.createErrs) > 0 {
+			err := fake.createErrs[0]
+			fake.createErrs = fake.createErrs[1:]
+			return nil, wrapHNSError(err)
+		}
+		var hnsEndpoint hcsshim.HNSEndpoint
+		if err := json.Unmarshal([]byte(request), &hnsEndpoint); err != nil {
+			return nil, wrapHNSError(err)
+		}
+		fake.lastID++
+		hnsEndpoint.Id = fmt.Sprintf("hnsep-%v", fake.lastID)
+		if hnsEndpoint.MacAddress == "" {
+			hnsEndpoint.MacAddress = fmt.Sprintf("00-15-5D-00-00-%02X", fake.lastID)
+		}
+		hnsEndpoint.GatewayAddress = "10.0.0.1"
+		fake.endpoints[hnsEndpoint.Id] = &hnsEndpoint
+		response := hnsEndpoint
+		return &response, nil
+
+	case method == "POST" || method == "GET":
+		hnsEndpoint := fake.endpoints[path]
+		if hnsEndpoint == nil {
+			return nil, wrapHNSError(fmt.Errorf("HNS failed with error : Element not found. "))
+		}
+		if method == "POST" {
+			if err := json.Unmarshal([]byte(request), hnsEndpoint); err != nil {
+				return nil, wrapHNSError(err)
+			}
+		}
+		response := *hnsEndpoint
+		return &response, nil
+
+	case method == "DELETE":
+		if fake.deleteErr != nil {
+			return nil, wrapHNSError(fake.deleteErr)
+		}
+		if fake.endpoints[path] == nil {
+			return nil, wrapHNSError(fmt.Errorf("HNS failed with error : Element not found. "))
+		}
+		delete(fake.endpoints, path)
+		if fake.endpointDeleted != nil {
+			fake.endpointDeleted <- struct{}{}
+		}
+		return &hcsshim.HNSEndpoint{Id: path}, nil
+	}
+
+	return nil, wrapHNSError(fmt.Errorf("Unexpected HNS request %v %v", method, path))
+}
+
+func (fake *fakeHnsClient) ListNetworkRequest() ([]hcsshim.HNSNetwork, error) {
+	var hnsNetworks []hcsshim.HNSNetwork
+	for _, hnsNetwork := range fake.networks {
+		hnsNetworks = append(hnsNetworks, *hnsNetwork)
+	}
+	return hnsNetworks, nil
+}
+
+func (fake *fakeHnsClient) GetNetworkByName(networkName string) (*hcsshim.HNSNetwork, error) {
+	for _, hnsNetwork := range fake.networks {
+		if hnsNetwork.Name == networkName {
+			response := *hnsNetwork
+			return &response, nil
+		}
+	}
+	return nil, wrapHNSError(hcsshim.NetworkNotFoundError{NetworkName: networkName})
+}
+
+func (fake *fakeHnsClient) ListEndpointRequest() ([]hcsshim.HNSEndpoint, error) {
+	var hnsEndpoints []hcsshim.HNSEndpoint
+	for _, hnsEndpoint := range fake.endpoints {
+		hnsEndpoints = append(hnsEndpoints, *hnsEndpoint)
+	}
+	return hnsEndpoints, nil
+}
+
+func (fake *fakeHnsClient) GetEndpointByName(endpointName string) (*hcsshim.HNSEndpoint, error) {
+	for _, hnsEndpoint := range fake.endpoints {
+		if hnsEndpoint.Name == endpointName {
+			response := *hnsEndpoint
+			return &response, nil
+		}
+	}
+	return nil, wrapHNSError(hcsshim.EndpointNotFoundError{EndpointName: endpointName})
+}
+
+func (fake *fakeHnsClient) HotAttachEndpoint(containerID string, endpointID string) error {
+	if fake.endpoints[endpointID] == nil {
+		return wrapHNSError(hcsshim.ErrElementNotFound)
+	}
+	if fake.attachBlock != nil {
+		<-fake.attachBlock
+	}
+	fake.attachAttempts++
+	if len(fake.attachErrs) > 0 {
+		err := fake.attachErrs[0]
+		fake.attachErrs = fake.attachErrs[1:]
+		return wrapHNSError(err)
+	}
+	fake.attached[endpointID] = containerID
+	return nil
+}
+
+func (fake *fakeHnsClient) HotDetachEndpoint(containerID string, endpointID string) error {
+	if fake.detachBlock != nil {
+		<-fake.detachBlock
+	}
+	if fake.attached[endpointID] != containerID {
+		return wrapHNSError(hcsshim.ErrElementNotFound)
+	}
+	delete(fake.attached, endpointID)
+	if fake.endpointDetached != nil {
+		fake.endpointDetached <- struct{}{}
+	}
+	return nil
+}
+
+func (fake *fakeHnsClient) CreateHcnEndpoint(endpoint *hcn.HostComputeEndpoint) (*hcn.HostComputeEndpoint, error) {
+	fake.lastID++
+	hcnEndpoint := *endpoint
+	hcnEndpoint.Id = fmt.Sprintf("hcnep-%v", fake.lastID)
+	fake.hcnEndpoints[hcnEndpoint.Id] = &hcnEndpoint
+	response := hcnEndpoint
+	return &response, nil
+}
+
+func (fake *fakeHnsClient) GetHcnEndpointByID(endpointID string) (*hcn.HostComputeEndpoint, error) {
+	hcnEndpoint := fake.hcnEndpoints[endpointID]
+	if hcnEndpoint == nil {
+		return nil, hcn.EndpointNotFoundError{EndpointID: endpointID}
+	}
+	response := *hcnEndpoint
+	return &response, nil
+}
+
+func (fake *fakeHnsClient) ApplyHcnEndpointPolicy(endpoint *hcn.HostComputeEndpoint, request hcn.PolicyEndpointRequest) error {
+	hcnEndpoint := fake.hcnEndpoints[endpoint.Id]
+	if hcnEndpoint == nil {
+		return hcn.EndpointNotFoundError{EndpointID: endpoint.Id}
+	}
+	hcnEndpoint.Policies = request.Policies
+	return nil
+}
+
+func (fake *fakeHnsClient) DeleteHcnEndpoint(endpointID string) error {
+	if fake.hcnEndpoints[endpointID] == nil {
+		return hcn.EndpointNotFoundError{EndpointID: endpointID}
+	}
+	delete(fake.hcnEndpoints, endpointID)
+	return nil
+}
+
+func (fake *fakeHnsClient) GetContainerNetworkStats(containerID string) ([]hcsshim.NetworkStats, error) {
+	var stats []hcsshim.NetworkStats
+	for endpointID, attachedContainerID := range fake.attached {
+		if attachedContainerID == containerID {
+			stats = append(stats, hcsshim.NetworkStats{EndpointId: endpointID, BytesReceived: 1024, PacketsReceived: 8})
+		}
+	}
+	return stats, nil
+}
+
+func (fake *fakeHnsClient) GetGlobals() (*hcsshim.HNSGlobals, error) {
+	return &hcsshim.HNSGlobals{Version: fake.version}, nil
+}
+
+func (fake *fakeHnsClient) HostAttachEndpoint(endpointID string, compartmentID uint16) error {
+	if fake.endpoints[endpointID] == nil {
+		return wrapHNSError(hcsshim.ErrElementNotFound)
+	}
+	fake.hostAttached[endpointID] = compartmentID
+	return nil
+}
+
+func (fake *fakeHnsClient) HostDetachEndpoint(endpointID string) error {
+	if _, ok := fake.hostAttached[endpointID]; !ok {
+		return wrapHNSError(hcsshim.ErrElementNotFound)
+	}
+	delete(fake.hostAttached, endpointID)
+	return nil
+}
+
+// createTestNetwork creates a network object backed by the fake HNS.
+func createTestNetwork() *network {
+	return &network{
+		Id:        "azure",
+		HnsId:     "hnsnw-1",
+		Endpoints: make(map[string]*endpoint),
+	}
+}
+
+// Tests that a DNS-only change updates the DNS settings and leaves the policies untouched.
+func TestApplyEndpointUpdateDNSOnly(t *testing.T) {
+	existing := &EndpointInfo{
+		DNS:    DNSInfo{Suffix: "default.svc.cluster.local", Servers: []string{"10.0.0.10"}},
+		Routes: []RouteInfo{route1},
+	}
+	target := &EndpointInfo{
+		DNS:    DNSInfo{Suffix: "kube-system.svc.cluster.local", Servers: []string{"10.0.0.10", "10.0.0.11"}},
+		Routes: []RouteInfo{route1},
+	}
+
+	routePolicy := policy.SerializeRoutePolicy(route1.Dst.String(), route1.Gw.String(), false)
+	hnsEndpoint := &hcsshim.HNSEndpoint{Policies: []json.RawMessage{routePolicy}}
+
+	if !applyEndpointUpdate(hnsEndpoint, existing, target) {
+		t.Fatalf("Expected DNS change to be detected")
+	}
+
+	if hnsEndpoint.DNSSuffix != target.DNS.Suffix {
+		t.Errorf("Unexpected DNS suffix %v", hnsEndpoint.DNSSuffix)
+	}
+
+	if hnsEndpoint.DNSServerList != "10.0.0.10,10.0.0.11" {
+		t.Errorf("Unexpected DNS server list %v", hnsEndpoint.DNSServerList)
+	}
+
+	if len(hnsEndpoint.Policies) != 1 || string(hnsEndpoint.Policies[0]) != string(routePolicy) {
+		t.Errorf("Unexpected policies %s", hnsEndpoint.Policies)
+	}
+}
+
+// Tests that a DNS search list change updates the HNS suffix list.
+func TestApplyEndpointUpdateDNSSuffixes(t *testing.T) {
+	existing := &EndpointInfo{
+		DNS: DNSInfo{Suffix: "default.svc.cluster.local", Servers: []string{"10.0.0.10"}},
+	}
+	target := &EndpointInfo{
+		DNS: DNSInfo{
+			Suffix:   "default.svc.cluster.local",
+			Suffixes: []string{"default.svc.cluster.local", "svc.cluster.local", "cluster.local"},
+			Servers:  []string{"10.0.0.10"},
+		},
+	}
+
+	hnsEndpoint := &hcsshim.HNSEndpoint{}
+
+	if !applyEndpointUpdate(hnsEndpoint, existing, target) {
+		t.Fatalf("Expected DNS search list change to be detected")
+	}
+
+	if hnsEndpoint.DNSSuffix != "default.svc.cluster.local,svc.cluster.local,cluster.local" {
+		t.Errorf("Unexpected DNS suffix %v", hnsEndpoint.DNSSuffix)
+	}
+}
+
+// Tests that a route-only change replaces the route policies and keeps other policies.
+func TestApplyEndpointUpdateRoutesOnly(t *testing.T) {
+	dns := DNSInfo{Suffix: "default.svc.cluster.local", Servers: []string{"10.0.0.10"}}
+	existing := &EndpointInfo{DNS: dns, Routes: []RouteInfo{route1}}
+	target := &EndpointInfo{DNS: dns, Routes: []RouteInfo{route2}}
+
+	natPolicy := json.RawMessage(`{"Type":"NAT","Protocol":"TCP","InternalPort":80,"ExternalPort":8080}`)
+	hnsEndpoint := &hcsshim.HNSEndpoint{
+		DNSSuffix:     dns.Suffix,
+		DNSServerList: "10.0.0.10",
+		Policies: []json.RawMessage{
+			natPolicy,
+			policy.SerializeRoutePolicy(route1.Dst.String(), route1.Gw.String(), false),
+		},
+	}
+
+	if !applyEndpointUpdate(hnsEndpoint, existing, target) {
+		t.Fatalf("Expected route change to be detected")
+	}
+
+	if hnsEndpoint.DNSSuffix != dns.Suffix || hnsEndpoint.DNSServerList != "10.0.0.10" {
+		t.Errorf("Unexpected DNS settings %v %v", hnsEndpoint.DNSSuffix, hnsEndpoint.DNSServerList)
+	}
+
+	expected := policy.SerializeRoutePolicy(route2.Dst.String(), route2.Gw.String(), false)
+	if len(hnsEndpoint.Policies) != 2 ||
+		string(hnsEndpoint.Policies[0]) != string(natPolicy) ||
+		string(hnsEndpoint.Policies[1]) != string(expected) {
+		t.Errorf("Unexpected policies %s", hnsEndpoint.Policies)
+	}
+}
+
+// Tests that identical endpoints do not result in an update.
+func TestApplyEndpointUpdateNoChange(t *testing.T) {
+	existing := &EndpointInfo{
+		DNS:    DNSInfo{Suffix: "default.svc.cluster.local", Servers: []string{"10.0.0.10"}},
+		Routes: []RouteInfo{route1, route2},
+	}
+	target := &EndpointInfo{
+		DNS:    DNSInfo{Suffix: "default.svc.cluster.local", Servers: []string{"10.0.0.10"}},
+		Routes: []RouteInfo{route2, route1},
+	}
+
+	hnsEndpoint := &hcsshim.HNSEndpoint{}
+
+	if applyEndpointUpdate(hnsEndpoint, existing, target) {
+		t.Errorf("Expected no change to be detected")
+	}
+
+	if hnsEndpoint.DNSSuffix != "" || hnsEndpoint.Policies != nil {
+		t.Errorf("HNS endpoint was modified %+v", hnsEndpoint)
+	}
+}
+
+// Tests that host, on-link and default routes are serialized into HNS route policies.
+func TestGetRoutePolicies(t *testing.T) {
+	routes := []RouteInfo{
+		route1,
+		{
+			Dst: net.IPNet{IP: net.IPv4(10, 0, 3, 4), Mask: net.IPv4Mask(255, 255, 255, 255)},
+		},
+		{
+			Dst: net.IPNet{IP: net.IPv4zero, Mask: net.IPv4Mask(0, 0, 0, 0)},
+			Gw:  net.IPv4(10, 0, 0, 254),
+		},
+		{
+			Gw: net.IPv4(10, 0, 0, 253),
+		},
+		{
+			Gw: net.ParseIP("fd00::1"),
+		},
+	}
+
+	expected := []string{
+		`{"Type":"ROUTE","DestinationPrefix":"10.0.1.0/24","NextHop":"10.0.0.1"}`,
+		`{"Type":"ROUTE","DestinationPrefix":"10.0.3.4/32"}`,
+		`{"Type":"ROUTE","DestinationPrefix":"0.0.0.0/0","NextHop":"10.0.0.254"}`,
+		`{"Type":"ROUTE","DestinationPrefix":"0.0.0.0/0","NextHop":"10.0.0.253"}`,
+		`{"Type":"ROUTE","DestinationPrefix":"::/0","NextHop":"fd00::1"}`,
+	}
+
+	policies := getRoutePolicies(routes)
+	if len(policies) != len(expected) {
+		t.Fatalf("Unexpected number of policies %v", len(policies))
+	}
+
+	for i, p := range policies {
+		if string(p) != expected[i] {
+			t.Errorf("Unexpected policy %s, expected %s", p, expected[i])
+		}
+	}
+}
+
+// Tests that getInfoImpl reports every field of an endpoint created by newEndpointImpl.
+func TestGetInfoImplRoundTrip(t *testing.T) {
+	fake := newFakeHnsClient()
+	defer func() { hns = hcsshimClient{} }()
+
+	nw := createTestNetwork()
+	epInfo := &EndpointInfo{
+		ContainerID:   "0123456789abcdef",
+		IfName:        "eth0",
+		IPAddresses:   []net.IPNet{{IP: net.IPv4(10, 0, 0, 4), Mask: net.IPv4Mask(255, 255, 255, 0)}},
+		DNS:           DNSInfo{Suffix: "default.svc.cluster.local", Servers: []string{"10.0.0.10"}},
+		SearchDomains: []string{"vnet.internal", "default.svc.cluster.local"},
+		Data:          map[string]interface{}{VlanIDKey: 100},
+	}
+
+	ep, err := nw.newEndpointImpl(epInfo)
+	if err != nil {
+		t.Fatalf("newEndpointImpl failed %v", err)
+	}
+
+	// getInfoImpl must not assume an initialized Data map.
+	info := &EndpointInfo{}
+	ep.getInfoImpl(info)
+
+	if len(info.IPAddresses) != 1 || info.IPAddresses[0].String() != "10.0.0.4/24" {
+		t.Errorf("Unexpected IP addresses %v", info.IPAddresses)
+	}
+
+	if info.MacAddress.String() != "00:15:5d:00:00:01" {
+		t.Errorf("Unexpected MAC address %v", info.MacAddress)
+	}
+
+	if len(info.Gateways) != 1 || !info.Gateways[0].Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("Unexpected gateways %v", info.Gateways)
+	}
+
+	if info.DNS.Suffix != epInfo.DNS.Suffix || len(info.DNS.Servers) != 1 || info.DNS.Servers[0] != "10.0.0.10" {
+		t.Errorf("Unexpected DNS %+v", info.DNS)
+	}
+
+	if len(info.SearchDomains) != 2 || info.SearchDomains[0] != "vnet.internal" {
+		t.Errorf("Unexpected search domains %v", info.SearchDomains)
+	}
+
+	if suffixes, _ := info.Data["dnsSuffixes"].([]string); len(suffixes) != 2 || suffixes[1] != "default.svc.cluster.local" {
+		t.Errorf("Unexpected DNS suffixes data %v", info.Data["dnsSuffixes"])
+	}
+
+	if info.Data["hnsid"] != ep.HnsId || fake.endpoints[ep.HnsId] == nil {
+		t.Errorf("Unexpected HNS ID %v", info.Data["hnsid"])
+	}
+
+	if info.Data[VlanIDKey] != 100 {
+		t.Errorf("Unexpected VLAN ID %v", info.Data[VlanIDKey])
+	}
+
+	if info.Data["attached"] != true || fake.attached[ep.HnsId] != epInfo.ContainerID {
+		t.Errorf("Unexpected attach state %v", info.Data["attached"])
+	}
+
+	if info.Data["macAddress"] != "00:15:5d:00:00:01" {
+		t.Errorf("Unexpected MAC address data %v", info.Data["macAddress"])
+	}
+}
+
+// Tests that a retried ADD reuses the HNS endpoint created by the first attempt.
+func TestNewEndpointImplReusesExistingEndpoint(t *testing.T) {
+	fake := newFakeHnsClient()
+	defer func() { hns = hcsshimClient{} }()
+
+	nw := createTestNetwork()
+	nw.HnsId = "HNSNW-1"
+	epInfo := &EndpointInfo{
+		ContainerID: "0123456789abcdef",
+		IfName:      "eth0",
+		IPAddresses: []net.IPNet{{IP: net.IPv4(10, 0, 0, 4), Mask: net.IPv4Mask(255, 255, 255, 0)}},
+	}
+
+	ep1, err := nw.newEndpointImpl(epInfo)
+	if err != nil {
+		t.Fatalf("newEndpointImpl failed %v", err)
+	}
+
+	fake.endpoints[ep1.HnsId].VirtualNetwork = "hnsnw-1"
+
+	ep2, err := nw.newEndpointImpl(epInfo)
+	if err != nil {
+		t.Fatalf("newEndpointImpl retry failed %v", err)
+	}
+
+	if ep1.HnsId != ep2.HnsId || len(fake.endpoints) != 1 {
+		t.Errorf("Expected endpoint %v to be reused, got %v with %v HNS endpoints", ep1.HnsId, ep2.HnsId, len(fake.endpoints))
+	}
+}
+
+func TestNewEndpointImplDetectsNameCollision(t *testing.T) {
+	newFakeHnsClient()
+	defer func() { hns = hcsshimClient{} }()
+
+	nw := createTestNetwork()
+	nw.Endpoints["01234567-eth0"] = &endpoint{Id: "01234567-eth0", ContainerID: "0123456789abcdef"}
+
+	epInfo := &EndpointInfo{
+		ContainerID: "01234567fedcba98",
+		IfName:      "eth0",
+		IPAddresses: []net.IPNet{{IP: net.IPv4(10, 0, 0, 5), Mask: net.IPv4Mask(255, 255, 255, 0)}},
+	}
+
+	if _, err := nw.newEndpointImpl(epInfo); err != errEndpointNameCollision {
+		t.Fatalf("Expected name collision error, got %v", err)
+	}
+
+	epInfo.HashedEndpointID = true
+	if _, err := nw.newEndpointImpl(epInfo); err != nil {
+		t.Fatalf("newEndpointImpl with hashed endpoint ID failed %v", err)
+	}
+}
+
+// Tests that an HNS endpoint of another container with the same name is neither reused nor deleted.
+func TestNewEndpointImplDetectsHNSNameCollision(t *testing.T) {
+	fake := newFakeHnsClient()
+	defer func() { hns = hcsshimClient{} }()
+
+	fake.endpoints["hnsep-1"] = &hcsshim.HNSEndpoint{
+		Id:             "hnsep-1",
+		Name:           "01234567-eth0",
+		VirtualNetwork: "hnsnw-1",
+		IPAddress:      net.IPv4(10, 0, 0, 4),
+	}
+
+	nw := createTestNetwork()
+	epInfo := &EndpointInfo{
+		ContainerID: "01234567fedcba98",
+		IfName:      "eth0",
+		IPAddresses: []net.IPNet{{IP: net.IPv4(10, 0, 0, 5), Mask: net.IPv4Mask(255, 255, 255, 0)}},
+	}
+
+	if _, err := nw.newEndpointImpl(epInfo); err != errEndpointNameCollision {
+		t.Fatalf("Expected name collision error, got %v", err)
+	}
+
+	if len(fake.endpoints) != 1 || fake.endpoints["hnsep-1"] == nil {
+		t.Errorf("Expected the HNS endpoint of the other container to be left alone, got %+v", fake.endpoints)
+	}
+}
+
+func TestGetEndpointByLegacyID(t *testing.T) {
+	fake := newFakeHnsClient()
+	defer func() { hns = hcsshimClient{} }()
+
+	hnsEndpoint, _ := fake.EndpointRequest("POST", "", `{"Name":"01234567-eth0"}`)
+
+	nw := createTestNetwork()
+	nw.Endpoints["01234567-eth0"] = &endpoint{Id: "01234567-eth0", HnsId: hnsEndpoint.Id, ContainerID: "0123456789abcdef"}
+
+	hashedId, _ := ConstructHashedEndpointID("0123456789abcdef", nil, "eth0")
+	ep, err := nw.getEndpoint(hashedId)
+	if err != nil || ep.Id != "01234567-eth0" {
+		t.Fatalf("Failed to retrieve endpoint %v by legacy ID, err:%v", hashedId, err)
+	}
+
+	if err := nw.deleteEndpoint(hashedId); err != nil || len(nw.Endpoints) != 0 || len(fake.endpoints) != 0 {
+		t.Errorf("Failed to delete endpoint %v by legacy ID, err:%v", hashedId, err)
+	}
+}
+
+func TestWorkloadEndpointSharesInfraEndpoint(t *testing.T) {
+	fake := newFakeHnsClient()
+	defer func() { hns = hcsshimClient{} }()
+
+	nw := createTestNetwork()
+	infraEpInfo := &EndpointInfo{
+		Id:          "01234567-eth0",
+		ContainerID: "0123456789abcdef",
+		IfName:      "eth0",
+		IPAddresses: []net.IPNet{{IP: net.IPv4(10, 0, 0, 6), Mask: net.IPv4Mask(255, 255, 255, 0)}},
+	}
+
+	infraEp, err := nw.newEndpoint(infraEpInfo)
+	if err != nil {
+		t.Fatalf("newEndpoint for infra container failed %v", err)
+	}
+
+	infraNs, err := common.NamespaceFromContainerID("0123456789abcdef")
+	if err != nil {
+		t.Fatalf("NamespaceFromContainerID failed %v", err)
+	}
+
+	workloadEpInfo := &EndpointInfo{
+		Id:          "fedcba98-eth0",
+		ContainerID: "fedcba9876543210",
+		NetNs:       infraNs,
+		IfName:      "eth0",
+	}
+
+	workloadEp, err := nw.newEndpoint(workloadEpInfo)
+	if err != nil {
+		t.Fatalf("newEndpoint for workload container failed %v", err)
+	}
+
+	if workloadEp.HnsId != infraEp.HnsId || len(fake.endpoints) != 1 || infraEp.RefCount != 1 {
+		t.Fatalf("Expected workload to share endpoint %v, got %v with %v HNS endpoints and ref count %v",
+			infraEp.HnsId, workloadEp.HnsId, len(fake.endpoints), infraEp.RefCount)
+	}
+
+	if err := nw.deleteEndpoint(workloadEpInfo.Id); err != nil {
+		t.Fatalf("deleteEndpoint for workload container failed %v", err)
+	}
+
+	if len(fake.endpoints) != 1 || infraEp.RefCount != 0 || nw.Endpoints[infraEpInfo.Id] == nil {
+		t.Errorf("Expected shared endpoint %v to be kept with ref count 0, got %v HNS endpoints and ref count %v",
+			infraEp.HnsId, len(fake.endpoints), infraEp.RefCount)
+	}
+}
+
+func TestGetStats(t *testing.T) {
+	fake := newFakeHnsClient()
+	defer func() { hns = hcsshimClient{} }()
+
+	nw := createTestNetwork()
+	epInfo := &EndpointInfo{
+		Id:          "01234567-eth0",
+		ContainerID: "0123456789abcdef",
+		IfName:      "eth0",
+		IPAddresses: []net.IPNet{{IP: net.IPv4(10, 0, 0, 7), Mask: net.IPv4Mask(255, 255, 255, 0)}},
+	}
+
+	ep, err := nw.newEndpoint(epInfo)
+	if err != nil {
+		t.Fatalf("newEndpoint failed %v", err)
+	}
+
+	stats, err := ep.GetStats()
+	if err != nil {
+		t.Fatalf("GetStats failed %v", err)
+	}
+
+	if stats.BytesReceived != 1024 || stats.PacketsReceived != 8 || stats.BytesSent != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	delete(fake.endpoints, ep.HnsId)
+
+	if _, err := ep.GetStats(); err != ErrEndpointNotFound {
+		t.Errorf("Expected not found error for stale endpoint, got %v", err)
+	}
+}
+
+// Tests that the gateways of both address families are returned and unparsable gateways are left out.
+func TestGetEndpointGateways(t *testing.T) {
+	nw := createTestNetwork()
+	nw.Subnets = []SubnetInfo{
+		{Family: platform.AfINET, Gateway: net.ParseIP("10.0.0.1")},
+		{Family: platform.AfINET6, Gateway: net.ParseIP("fd00::1")},
+	}
+
+	_, ipv6Address, _ := net.ParseCIDR("fd00::4/64")
+	gateways := nw.getEndpointGateways(&hcsshim.HNSEndpoint{GatewayAddress: "10.0.0.1"}, ipv6Address)
+	if len(gateways) != 2 || !gateways[0].Equal(net.ParseIP("10.0.0.1")) || !gateways[1].Equal(net.ParseIP("fd00::1")) {
+		t.Errorf("Unexpected gateways %v", gateways)
+	}
+
+	// The gateway of the subnet the address belongs to is preferred.
+	_, secondary, _ := net.ParseCIDR("fd01::/64")
+	nw.Subnets = append(nw.Subnets, SubnetInfo{Family: platform.AfINET6, Prefix: *secondary, Gateway: net.ParseIP("fd01::1")})
+	ipv6Address = &net.IPNet{IP: net.ParseIP("fd01::4"), Mask: secondary.Mask}
+	gateways = nw.getEndpointGateways(&hcsshim.HNSEndpoint{GatewayAddress: "10.0.0.1"}, ipv6Address)
+	if len(gateways) != 2 || !gateways[1].Equal(net.ParseIP("fd01::1")) {
+		t.Errorf("Expected secondary subnet gateway, got %v", gateways)
+	}
+
+	gateways = nw.getEndpointGateways(&hcsshim.HNSEndpoint{GatewayAddress: "invalid"}, nil)
+	if len(gateways) != 0 {
+		t.Errorf("Expected unparsable gateway to be left out, got %v", gateways)
+	}
+}
+
+// Tests that wrapped HNS errors are still classified by the hcsshim error they wrap.
+func TestWrapHNSError(t *testing.T) {
+	if wrapHNSError(nil) != nil {
+		t.Errorf("Expected no error to stay nil")
+	}
+
+	err := wrapHNSError(hcsshim.ErrVmcomputeOperationInvalidState)
+	if !errors.Is(err, ErrHNSFailure) || !isAlreadyAttachedError(err) {
+		t.Errorf("Expected wrapped error to match ErrHNSFailure and be classified, got %v", err)
+	}
+
+	if err.Error() != hcsshim.ErrVmcomputeOperationInvalidState.Error() {
+		t.Errorf("Expected HNS error text to be kept, got %v", err)
+	}
+
+	if !isNotFoundError(wrapHNSError(fmt.Errorf("Element not found."))) {
+		t.Errorf("Expected wrapped not found error to be classified")
+	}
+}
+
+// Tests that an HNS request that does not complete in time fails with a timeout error.
+func TestCallHNSWithTimeout(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	err := callHNSWithTimeout(10*time.Millisecond, func() error {
+		<-done
+		return nil
+	})
+	if !IsHNSTimeoutError(err) {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+
+	if isRetryableHNSError(err) {
+		t.Errorf("Expected timeout error not to be retried")
+	}
+
+	var hnsEndpoint *hcsshim.HNSEndpoint
+	err = callHNSWithTimeout(time.Second, func() error {
+		hnsEndpoint = &hcsshim.HNSEndpoint{Id: "hnsep-1"}
+		return nil
+	})
+	if err != nil || hnsEndpoint.Id != "hnsep-1" {
+		t.Errorf("Unexpected result %+v err:%v", hnsEndpoint, err)
+	}
+
+	// Operations that succeed after the timeout expired are undone.
+	undone := make(chan struct{})
+	block := make(chan struct{})
+	err = callHNSWithTimeoutOrUndo(10*time.Millisecond, func() error {
+		<-block
+		return nil
+	}, func() { close(undone) })
+	if !IsHNSTimeoutError(err) {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+
+	close(block)
+	select {
+	case <-undone:
+	case <-time.After(time.Second):
+		t.Errorf("Expected operation completed after the timeout to be undone")
+	}
+
+	err = callHNSWithTimeoutOrUndo(time.Second, func() error { return nil }, func() {
+		t.Errorf("Expected operation completed in time not to be undone")
+	})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+// Tests that an endpoint created after its create request timed out is deleted.
+func TestNewEndpointImplDeletesTimedOutEndpoint(t *testing.T) {
+	fake := newFakeHnsClient()
+	defer func() { hns = hcsshimClient{} }()
+	fake.endpointBlock = make(chan struct{})
+	fake.endpointDeleted = make(chan struct{})
+
+	nw := createTestNetwork()
+	epInfo := &EndpointInfo{
+		ContainerID: "0123456789abcdef",
+		IfName:      "eth0",
+		IPAddresses: []net.IPNet{{IP: net.IPv4(10, 0, 0, 4), Mask: net.IPv4Mask(255, 255, 255, 0)}},
+		HNSTimeout:  10 * time.Millisecond,
+	}
+
+	if _, err := nw.newEndpointImpl(epInfo); !IsHNSTimeoutError(err) {
+		t.Fatalf("Expected timeout error, got %v", err)
+	}
+
+	// Let the timed out request complete in the background.
+	close(fake.endpointBlock)
+	select {
+	case <-fake.endpointDeleted:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the endpoint created by the timed out request to be deleted")
+	}
+
+	if len(fake.endpoints) != 0 {
+		t.Errorf("Unexpected HNS endpoints %+v", fake.endpoints)
+	}
+}
+
+// Tests that an attach that times out fails the ADD, and that the endpoint is detached if the attach
+// completes later.
+func TestNewEndpointImplDetachesTimedOutAttach(t *testing.T) {
+	fake := newFakeHnsClient()
+	defer func() { hns = hcsshimClient{} }()
+	fake.attachBlock = make(chan struct{})
+	fake.endpointDetached = make(chan struct{})
+
+	nw := createTestNetwork()
+	epInfo := &EndpointInfo{
+		ContainerID: "0123456789abcdef",
+		IfName:      "eth0",
+		IPAddresses: []net.IPNet{{IP: net.IPv4(10, 0, 0, 4), Mask: net.IPv4Mask(255, 255, 255, 0)}},
+		HNSTimeout:  100 * time.Millisecond,
+	}
+
+	if _, err := nw.newEndpointImpl(epInfo); !IsHNSTimeoutError(err) {
+		t.Fatalf("Expected timeout error, got %v", err)
+	}
+
+	if len(fake.endpoints) != 0 {
+		t.Errorf("Expected the endpoint to be deleted, got %+v", fake.endpoints)
+	}
+
+	// Let the timed out attach complete in the background.
+	close(fake.attachBlock)
+	select {
+	case <-fake.endpointDetached:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the endpoint attached by the timed out request to be detached")
+	}
+
+	if len(fake.attached) != 0 {
+		t.Errorf("Unexpected attached endpoints %+v", fake.attached)
+	}
+}
+
+// Tests that a detach that times out does not block the delete of the endpoint.
+func TestDeleteEndpointImplDetachTimeout(t *testing.T) {
+	fake := newFakeHnsClient()
+	defer func() { hns = hcsshimClient{} }()
+
+	nw := createTestNetwork()
+	epInfo := &EndpointInfo{
+		ContainerID: "0123456789abcdef",
+		IfName:      "eth0",
+		IPAddresses: []net.IPNet{{IP: net.IPv4(10, 0, 0, 4), Mask: net.IPv4Mask(255, 255, 255, 0)}},
+	}
+
+	ep, err := nw.newEndpointImpl(epInfo)
+	if err != nil {
+		t.Fatalf("newEndpointImpl failed %v", err)
+	}
+
+	fake.detachBlock = make(chan struct{})
+	defer close(fake.detachBlock)
+	ep.HNSTimeout = 100 * time.Millisecond
+
+	if err := nw.deleteEndpointImpl(ep); err != nil {
+		t.Fatalf("deleteEndpointImpl failed %v", err)
+	}
+
+	if !ep.Attached || len(fake.endpoints) != 0 {
+		t.Errorf("Expected the endpoint to be deleted without being detached, got %+v", fake.endpoints)
+	}
+}
+
+// Tests that the endpoint is deleted when the endpoint cannot be set up after its creation.
+func TestNewEndpointImplRollback(t *testing.T) {
+	fake := newFakeHnsClient()
+	defer func() { hns = hcsshimClient{} }()
+
+	nw := createTestNetwork()
+	epInfo := &EndpointInfo{
+		ContainerID: "0123456789abcdef",
+		IfName:      "eth0",
+		IPAddresses: []net.IPNet{{IP: net.IPv4(10, 0, 0, 4), Mask: net.IPv4Mask(255, 255, 255, 0)}},
+		MacAddress:  net.HardwareAddr{0x00, 0x15, 0x5d, 0x00, 0x00, 0x99},
+	}
+
+	// The fake programs the requested MAC address, make it report another one.
+	hns = &macOverridingHnsClient{fakeHnsClient: fake}
+
+	if _, err := nw.newEndpointImpl(epInfo); err != errMacAddressMismatch {
+		t.Fatalf("Expected MAC address mismatch, got %v", err)
+	}
+
+	if len(fake.endpoints) != 0 {
+		t.Errorf("Expected the endpoint to be deleted, got %+v", fake.endpoints)
+	}
+}
+
+// macOverridingHnsClient is a fake HNS that does not program the requested MAC address.
+type macOverridingHnsClient struct {
+	*fakeHnsClient
+}
+
+func (fake *macOverridingHnsClient) EndpointRequest(method, path, request string) (*hcsshim.HNSEndpoint, error) {
+	hnsEndpoint, err := fake.fakeHnsClient.EndpointRequest(method, path, request)
+	if err == nil && method == "POST" && path == "" {
+		hnsEndpoint.MacAddress = "00-15-5D-00-00-01"
+	}
+	return hnsEndpoint, err
+}
+
+// testRetryPolicy retries HNS operations without slowing down tests.
+var testRetryPolicy = &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+// Tests that endpoint creation is retried on transient HNS errors.
+func TestNewEndpointImplRetriesTransientError(t *testing.T) {
+	fake := newFakeHnsClient()
+	defer func() { hns = hcsshimClient{} }()
+
+	fake.createErrs = []error{errors.New("The RPC server is unavailable.")}
+
+	nw := createTestNetwork()
+	epInfo := &EndpointInfo{
+		ContainerID: "0123456789abcdef",
+		IfName:      "eth0",
+		IPAddresses: []net.IPNet{{IP: net.IPv4(10, 0, 0, 4), Mask: net.IPv4Mask(255, 255, 255, 0)}},
+		RetryPolicy: testRetryPolicy,
+	}
+
+	ep, err := nw.newEndpointImpl(epInfo)
+	if err != nil {
+		t.Fatalf("newEndpointImpl failed %v", err)
+	}
+
+	if fake.createAttempts != 2 || fake.endpoints[ep.HnsId] == nil {
+		t.Errorf("Expected endpoint to be created on the second attempt, got %v attempts", fake.createAttempts)
+	}
+}
+
+// Tests that endpoint creation is not retried on permanent HNS errors.
+func TestNewEndpointImplPermanentError(t *testing.T) {
+	fake := newFakeHnsClient()
+	defer func() { hns = hcsshimClient{} }()
+
+	fake.createErrs = []error{errors.New("The parameter is incorrect.")}
+
+	nw := createTestNetwork()
+	epInfo := &EndpointInfo{
+		ContainerID: "0123456789abcdef",
+		IfName:      "eth0",
+		IPAddresses: []net.IPNet{{IP: net.IPv4(10, 0, 0, 4), Mask: net.IPv4Mask(255, 255, 255, 0)}},
+		RetryPolicy: testRetryPolicy,
+	}
+
+	if _, err := nw.newEndpointImpl(epInfo); err == nil {
+		t.Fatalf("Expected newEndpointImpl to fail")
+	}
+
+	if fake.createAttempts != 1 || len(fake.endpoints) != 0 {
+		t.Errorf("Expected a single attempt, got %v attempts and endpoints %+v", fake.createAttempts, fake.endpoints)
+	}
+}
+
+// Tests that the endpoint is deleted only after all attempts to attach it have failed.
+func TestNewEndpointImplDeletesAfterRetries(t *testing.T) {
+	fake := newFakeHnsClient()
+	defer func() { hns = hcsshimClient{} }()
+
+	transientErr := errors.New("The RPC server is too busy to complete this operation.")
+	fake.attachErrs = []error{transientErr, transientErr, transientErr}
+
+	nw := createTestNetwork()
+	epInfo := &EndpointInfo{
+		ContainerID: "0123456789abcdef",
+		IfName:      "eth0",
+		IPAddresses: []net.IPNet{{IP: net.IPv4(10, 0, 0, 4), Mask: net.IPv4Mask(255, 255, 255, 0)}},
+		RetryPolicy: testRetryPolicy,
+	}
+
+	if _, err := nw.newEndpointImpl(epInfo); err == nil {
+		t.Fatalf("Expected newEndpointImpl to fail")
+	}
+
+	// The fake fails attaches of deleted endpoints before counting them.
+	if fake.attachAttempts != testRetryPolicy.MaxAttempts {
+		t.Errorf("Expected %v attach attempts, got %v", testRetryPolicy.MaxAttempts, fake.attachAttempts)
+	}
+
+	if len(fake.endpoints) != 0 {
+		t.Errorf("Expected the endpoint to be deleted, got %+v", fake.endpoints)
+	}
+}
+
+// Tests that loopback DSR adds a policy for the endpoint address and fails on older HNS versions only when requested.
+func TestNewEndpointImplLoopbackDSR(t *testing.T) {
+	fake := newFakeHnsClient()
+	defer func() { hns = hcsshimClient{} }()
+
+	nw := createTestNetwork()
+	epInfo := &EndpointInfo{
+		ContainerID:       "0123456789abcdef",
+		IfName:            "eth0",
+		IPAddresses:       []net.IPNet{{IP: net.IPv4(10, 0, 0, 8), Mask: net.IPv4Mask(255, 255, 255, 0)}},
+		EnableLoopbackDSR: true,
+	}
+
+	ep, err := nw.newEndpointImpl(epInfo)
+	if err != nil {
+		t.Fatalf("newEndpointImpl with loopback DSR failed %v", err)
+	}
+
+	expected := `{"Type":"OutBoundNAT","Destinations":["10.0.0.8"]}`
+	found := false
+	for _, hnsPolicy := range fake.endpoints[ep.HnsId].Policies {
+		if string(hnsPolicy) == expected {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Errorf("Loopback DSR policy %s not found in %s", expected, fake.endpoints[ep.HnsId].Policies)
+	}
+
+	fake.version = hcsshim.HNSVersion{Major: 8, Minor: 0}
+	epInfo.ContainerID = "1123456789abcdef"
+	if _, err := nw.newEndpointImpl(epInfo); err != errLoopbackDSRNotSupported {
+		t.Errorf("Expected loopback DSR to be unsupported, got %v", err)
+	}
+
+	epInfo.EnableLoopbackDSR = false
+	if _, err := nw.newEndpointImpl(epInfo); err != nil {
+		t.Errorf("newEndpointImpl without loopback DSR failed %v", err)
+	}
+}
+
+// Tests that deleting an endpoint already removed from HNS succeeds and removes it from the network.
+func TestDeleteEndpointAlreadyDeleted(t *testing.T) {
+	newFakeHnsClient()
+	defer func() { hns = hcsshimClient{} }()
+
+	nw := createTestNetwork()
+	nw.Endpoints["01234567-eth0"] = &endpoint{Id: "01234567-eth0", HnsId: "hnsep-gone", ContainerID: "0123456789abcdef"}
+
+	if err := nw.deleteEndpoint("01234567-eth0"); err != nil {
+		t.Fatalf("Expected delete of missing HNS endpoint to succeed, got %v", err)
+	}
+
+	if len(nw.Endpoints) != 0 {
+		t.Errorf("Expected endpoint to be removed from the network")
+	}
+}
+
+// Tests that endpoints that are no longer attached to their container are still deleted.
+func TestDeleteEndpointNotAttached(t *testing.T) {
+	fake := newFakeHnsClient()
+	defer func() { hns = hcsshimClient{} }()
+
+	hnsEndpoint, _ := fake.EndpointRequest("POST", "", `{"Name":"01234567-eth0"}`)
+
+	nw := createTestNetwork()
+	nw.Endpoints["01234567-eth0"] = &endpoint{
+		Id:          "01234567-eth0",
+		HnsId:       hnsEndpoint.Id,
+		ContainerID: "0123456789abcdef",
+		Attached:    true,
+	}
+	nw.Endpoints["fedcba98-eth0"] = &endpoint{
+		Id:              "fedcba98-eth0",
+		HnsId:           hnsEndpoint.Id,
+		ContainerID:     "fedcba9876543210",
+		InfraEndpointId: "01234567-eth0",
+	}
+
+	if err := nw.deleteEndpoint("fedcba98-eth0"); err != nil {
+		t.Fatalf("Expected delete of detached workload endpoint to succeed, got %v", err)
+	}
+
+	if err := nw.deleteEndpoint("01234567-eth0"); err != nil {
+		t.Fatalf("Expected delete of detached endpoint to succeed, got %v", err)
+	}
+
+	if len(nw.Endpoints) != 0 || len(fake.endpoints) != 0 {
+		t.Errorf("Expected endpoints to be deleted, got %v endpoints and %v HNS endpoints",
+			len(nw.Endpoints), len(fake.endpoints))
+	}
+}
+
+// Tests that genuine HNS delete failures are returned and the endpoint is kept.
+func TestDeleteEndpointFailure(t *testing.T) {
+	fake := newFakeHnsClient()
+	defer func() { hns = hcsshimClient{} }()
+
+	hnsEndpoint, _ := fake.EndpointRequest("POST", "", `{"Name":"01234567-eth0"}`)
+	fake.deleteErr = fmt.Errorf("HNS failed with error : Access is denied. ")
+
+	nw := createTestNetwork()
+	nw.Endpoints["01234567-eth0"] = &endpoint{Id: "01234567-eth0", HnsId: hnsEndpoint.Id, ContainerID: "0123456789abcdef"}
+
+	if err := nw.deleteEndpoint("01234567-eth0"); !errors.Is(err, fake.deleteErr) {
+		t.Fatalf("Expected delete failure %v, got %v", fake.deleteErr, err)
+	}
+
+	if nw.Endpoints["01234567-eth0"] == nil {
+		t.Errorf("Expected endpoint to be kept after a failed delete")
+	}
+}
+
+// Tests that endpoints of process-isolated workloads are attached to and detached from their compartment.
+func TestEndpointNetworkCompartment(t *testing.T) {
+	fake := newFakeHnsClient()
+	defer func() { hns = hcsshimClient{} }()
+
+	nw := createTestNetwork()
+	epInfo := &EndpointInfo{
+		Id:                   "compartment-eth0",
+		IfName:               "eth0",
+		IPAddresses:          []net.IPNet{{IP: net.IPv4(10, 0, 0, 9), Mask: net.IPv4Mask(255, 255, 255, 0)}},
+		NetworkCompartmentID: 3,
+	}
+
+	ep, err := nw.newEndpoint(epInfo)
+	if err != nil {
+		t.Fatalf("newEndpoint in compartment failed %v", err)
+	}
+
+	if fake.hostAttached[ep.HnsId] != 3 || len(fake.attached) != 0 {
+		t.Fatalf("Expected endpoint %v to be attached to compartment 3 only", ep.HnsId)
+	}
+
+	if err := nw.deleteEndpoint(epInfo.Id); err != nil {
+		t.Fatalf("deleteEndpoint in compartment failed %v", err)
+	}
+
+	if len(fake.hostAttached) != 0 || len(fake.endpoints) != 0 {
+		t.Errorf("Expected endpoint %v to be detached and deleted", ep.HnsId)
+	}
+}
+
+// Tests that port mappings are published as NAT policies and invalid mappings are rejected before any HNS call.
+func TestNewEndpointImplPortMappings(t *testing.T) {
+	defer func() { hns = hcsshimClient{} }()
+
+	tests := []struct {
+		name    string
+		mapping PortMapping
+		err     error
+	}{
+		{"valid", PortMapping{Protocol: "tcp", HostPort: 8080, ContainerPort: 80}, nil},
+		{"any host IP", PortMapping{Protocol: "UDP", HostPort: 53, ContainerPort: 53, HostIP: net.IPv4zero}, nil},
+		{"host port too large", PortMapping{Protocol: "tcp", HostPort: 65536, ContainerPort: 80}, errPortOutOfRange},
+		{"host port zero", PortMapping{Protocol: "tcp", HostPort: 0, ContainerPort: 80}, errPortOutOfRange},
+		{"negative container port", PortMapping{Protocol: "tcp", HostPort: 8080, ContainerPort: -1}, errPortOutOfRange},
+		{"invalid protocol", PortMapping{Protocol: "sctp", HostPort: 8080, ContainerPort: 80}, errPortMappingProtocolInvalid},
+		{"host IP", PortMapping{Protocol: "tcp", HostPort: 8080, ContainerPort: 80, HostIP: net.IPv4(10, 0, 0, 5)}, errPortMappingHostIPNotSupported},
+	}
+
+	for _, test := range tests {
+		fake := newFakeHnsClient()
+
+		nw := createTestNetwork()
+		epInfo := &EndpointInfo{
+			ContainerID:  "0123456789abcdef",
+			IfName:       "eth0",
+			IPAddresses:  []net.IPNet{{IP: net.IPv4(10, 0, 0, 4), Mask: net.IPv4Mask(255, 255, 255, 0)}},
+			PortMappings: []PortMapping{test.mapping},
+		}
+
+		ep, err := nw.newEndpointImpl(epInfo)
+		if err != test.err {
+			t.Errorf("%v: Expected error %v, got %v", test.name, test.err, err)
+			continue
+		}
+
+		if test.err != nil {
+			if len(fake.endpoints) != 0 {
+				t.Errorf("%v: Expected no HNS endpoint, got %+v", test.name, fake.endpoints)
+			}
+			continue
+		}
+
+		if !policy.HasHNSPolicy(fake.endpoints[ep.HnsId].Policies, hcsshim.Nat) {
+			t.Errorf("%v: Expected NAT policy, got %s", test.name, fake.endpoints[ep.HnsId].Policies)
+		}
+	}
+}
+
+// Tests that the VLAN ID is applied as an HNS VLAN policy and out of range IDs are rejected before any HNS call.
+func TestNewEndpointImplVlanPolicy(t *testing.T) {
+	fake := newFakeHnsClient()
+	defer func() { hns = hcsshimClient{} }()
+
+	nw := createTestNetwork()
+	epInfo := &EndpointInfo{
+		ContainerID: "0123456789abcdef",
+		IfName:      "eth0",
+		IPAddresses: []net.IPNet{{IP: net.IPv4(10, 0, 0, 10), Mask: net.IPv4Mask(255, 255, 255, 0)}},
+		Data:        map[string]interface{}{VlanIDKey: 100},
+	}
+
+	ep, err := nw.newEndpointImpl(epInfo)
+	if err != nil {
+		t.Fatalf("newEndpointImpl with VLAN failed %v", err)
+	}
+
+	expected := `{"Type":"VLAN","VLAN":100}`
+	found := false
+	for _, hnsPolicy := range fake.endpoints[ep.HnsId].Policies {
+		if string(hnsPolicy) == expected {
+			found = true
+		}
+	}
+
+	if !found || ep.VlanID != 100 {
+		t.Errorf("VLAN policy %s not found in %s", expected, fake.endpoints[ep.HnsId].Policies)
+	}
+
+	for _, vlanid := range []int{-1, 4095} {
+		epInfo.Data[VlanIDKey] = vlanid
+		if _, err := nw.newEndpointImpl(epInfo); err != errInvalidVlanID {
+			t.Errorf("Expected VLAN ID %v to be rejected, got %v", vlanid, err)
+		}
+	}
+
+	if len(fake.endpoints) != 1 {
+		t.Errorf("Expected no HNS endpoint to be created for invalid VLAN IDs")
+	}
+}
+
+// Tests that the HNS endpoint gets the search domains of its network followed by its own.
+func TestNewEndpointSearchDomains(t *testing.T) {
+	fake := newFakeHnsClient()
+	defer func() { hns = hcsshimClient{} }()
+
+	nw := createTestNetwork()
+	nw.SearchDomains = []string{"vnet.internal"}
+	epInfo := &EndpointInfo{
+		Id:          "ep1",
+		ContainerID: "0123456789abcdef",
+		IfName:      "eth0",
+		IPAddresses: []net.IPNet{{IP: net.IPv4(10, 0, 0, 10), Mask: net.IPv4Mask(255, 255, 255, 0)}},
+		DNS:         DNSInfo{Suffix: "default.svc.cluster.local", Servers: []string{"10.0.0.10"}},
+	}
+
+	ep, err := nw.newEndpoint(epInfo)
+	if err != nil {
+		t.Fatalf("newEndpoint failed %v", err)
+	}
+
+	if suffix := fake.endpoints[ep.HnsId].DNSSuffix; suffix != "vnet.internal,default.svc.cluster.local" {
+		t.Errorf("Unexpected DNS suffix %v", suffix)
+	}
+
+	if ep.DNS.Suffix != "default.svc.cluster.local" || len(ep.SearchDomains) != 2 {
+		t.Errorf("Unexpected endpoint DNS settings %+v %v", ep.DNS, ep.SearchDomains)
+	}
+}
+
+// Tests that endpoint addresses are validated before any HNS call.
+func TestNewEndpointImplValidatesIPAddresses(t *testing.T) {
+	ipv4Address := net.IPNet{IP: net.IPv4(10, 0, 0, 11), Mask: net.IPv4Mask(255, 255, 255, 0)}
+	ipv6Address := net.IPNet{IP: net.ParseIP("fd00::11"), Mask: net.CIDRMask(64, 128)}
+
+	tests := []struct {
+		ipAddresses []net.IPNet
+		allowHNS    bool
+		expectedErr error
+	}{
+		{nil, false, ErrNoIPAddress},
+		{[]net.IPNet{}, false, ErrNoIPAddress},
+		{nil, true, nil},
+		{[]net.IPNet{ipv4Address}, false, nil},
+		{[]net.IPNet{ipv4Address, ipv6Address}, false, nil},
+		{[]net.IPNet{ipv4Address, ipv4Address}, false, errMultipleIPAddressesOfSameFamily},
+		{[]net.IPNet{ipv4Address, ipv6Address, ipv4Address}, false, ErrTooManyIPAddresses},
+	}
+
+	defer func() { hns = hcsshimClient{} }()
+
+	for i, test := range tests {
+		fake := newFakeHnsClient()
+		nw := createTestNetwork()
+		epInfo := &EndpointInfo{
+			ContainerID:               "0123456789abcdef",
+			IfName:                    "eth0",
+			IPAddresses:               test.ipAddresses,
+			AllowHNSAssignedIPAddress: test.allowHNS,
+		}
+
+		_, err := nw.newEndpointImpl(epInfo)
+		if err != test.expectedErr {
+			t.Errorf("Test %v: expected error %v, got %v", i, test.expectedErr, err)
+		}
+
+		if test.expectedErr != nil && len(fake.endpoints) != 0 {
+			t.Errorf("Test %v: expected no HNS endpoint to be created", i)
+		}
+	}
+}
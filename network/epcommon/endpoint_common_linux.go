@@ -2,7 +2,9 @@ package epcommon
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"strings"
 
 	"github.com/Azure/azure-container-networking/log"
 	"github.com/Azure/azure-container-networking/netlink"
@@ -96,6 +98,67 @@ func AssignIPToInterface(interfaceName string, ipAddresses []net.IPNet) error {
 	return nil
 }
 
+// HasIPv6Address returns true if any of the given addresses is an IPv6 address.
+func HasIPv6Address(ipAddresses []net.IPNet) bool {
+	for _, ipAddr := range ipAddresses {
+		if ipAddr.IP.To4() == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ConfigureIPv6Interface enables IPv6 on an interface and disables duplicate address detection,
+// so that statically assigned addresses are usable immediately. Router advertisements are accepted
+// only when requested, since statically configured interfaces get their default route explicitly.
+func ConfigureIPv6Interface(interfaceName string, acceptRA bool) error {
+	acceptRAValue := "0"
+	if acceptRA {
+		acceptRAValue = "1"
+	}
+
+	settings := []struct {
+		name  string
+		value string
+	}{
+		{"disable_ipv6", "0"},
+		{"accept_dad", "0"},
+		{"accept_ra", acceptRAValue},
+	}
+
+	for _, setting := range settings {
+		path := fmt.Sprintf("/proc/sys/net/ipv6/conf/%v/%v", interfaceName, setting.name)
+		log.Printf("[net] Setting %v to %v.", path, setting.value)
+		if err := ioutil.WriteFile(path, []byte(setting.value), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetSysctl sets a kernel parameter, such as net.ipv4.ip_forward, for the current network namespace.
+func SetSysctl(key string, value string) error {
+	path := "/proc/sys/" + strings.Replace(key, ".", "/", -1)
+	log.Printf("[net] Setting %v to %v.", path, value)
+	return ioutil.WriteFile(path, []byte(value), 0644)
+}
+
+// AddStaticNeighbor adds a permanent IPv6 neighbor entry for an IP address on an interface.
+func AddStaticNeighbor(interfaceName string, ipAddress net.IP, macAddress net.HardwareAddr) error {
+	cmd := fmt.Sprintf("ip -6 neigh replace %v lladdr %v dev %v nud permanent", ipAddress.String(), macAddress.String(), interfaceName)
+	_, err := platform.ExecuteCommand(cmd)
+	return err
+}
+
+// DeleteStaticNeighbor deletes the IPv6 neighbor entry for an IP address on an interface.
+func DeleteStaticNeighbor(interfaceName string, ipAddress net.IP) error {
+	cmd := fmt.Sprintf("ip -6 neigh del %v dev %v", ipAddress.String(), interfaceName)
+	_, err := platform.ExecuteCommand(cmd)
+	return err
+}
+
 func addOrDeleteFilterRule(bridgeName string, action string, ipAddress string, chainName string, target string) error {
 	var cmd string
 	option := "i"
@@ -0,0 +1,112 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+// EventType is the type of a network or endpoint lifecycle event.
+type EventType string
+
+const (
+	// Lifecycle event types.
+	EventNetworkCreated   EventType = "NetworkCreated"
+	EventNetworkUpdated   EventType = "NetworkUpdated"
+	EventNetworkDeleted   EventType = "NetworkDeleted"
+	EventEndpointCreated  EventType = "EndpointCreated"
+	EventEndpointDeleted  EventType = "EndpointDeleted"
+	EventEndpointUpdated  EventType = "EndpointUpdated"
+	EventEndpointAttached EventType = "EndpointAttached"
+	EventEndpointDetached EventType = "EndpointDetached"
+
+	// Maximum number of events waiting to be delivered to listeners.
+	eventQueueSize = 64
+)
+
+// Event describes a change to a network or endpoint, published after the change is persisted.
+type Event struct {
+	Type       EventType
+	NetworkId  string
+	EndpointId string `json:",omitempty"`
+	Time       time.Time
+}
+
+// eventDispatcher delivers events to listeners in order on a single worker goroutine.
+// Events are dropped when the queue is full, so that a slow or stuck listener never
+// blocks network operations.
+type eventDispatcher struct {
+	listeners []func(Event)
+	queue     chan Event
+	dropped   uint64
+	sync.Mutex
+}
+
+// register adds a listener and starts the worker on first use.
+func (dispatcher *eventDispatcher) register(listener func(Event)) {
+	dispatcher.Lock()
+	defer dispatcher.Unlock()
+
+	if dispatcher.queue == nil {
+		dispatcher.queue = make(chan Event, eventQueueSize)
+		go dispatcher.run()
+	}
+
+	dispatcher.listeners = append(dispatcher.listeners, listener)
+}
+
+// publish queues an event for delivery. It never blocks.
+func (dispatcher *eventDispatcher) publish(eventType EventType, networkId string, endpointId string) {
+	dispatcher.Lock()
+	defer dispatcher.Unlock()
+
+	if dispatcher.queue == nil {
+		return
+	}
+
+	event := Event{Type: eventType, NetworkId: networkId, EndpointId: endpointId, Time: time.Now()}
+
+	select {
+	case dispatcher.queue <- event:
+	default:
+		dispatcher.dropped++
+		log.Printf("[net] Dropped %v event for network %v endpoint %v, %v events dropped so far.",
+			eventType, networkId, endpointId, dispatcher.dropped)
+	}
+}
+
+// droppedEvents returns the number of events dropped because the queue was full.
+func (dispatcher *eventDispatcher) droppedEvents() uint64 {
+	dispatcher.Lock()
+	defer dispatcher.Unlock()
+
+	return dispatcher.dropped
+}
+
+// run delivers queued events to the listeners.
+func (dispatcher *eventDispatcher) run() {
+	for event := range dispatcher.queue {
+		dispatcher.Lock()
+		listeners := dispatcher.listeners
+		dispatcher.Unlock()
+
+		for _, listener := range listeners {
+			deliverEvent(listener, event)
+		}
+	}
+}
+
+// deliverEvent calls a listener, recovering from panics so that other listeners keep receiving events.
+func deliverEvent(listener func(Event), event Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[net] Event listener panicked on %v event: %v.", event.Type, r)
+		}
+	}()
+
+	listener(event)
+}
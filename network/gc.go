@@ -0,0 +1,172 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+const (
+	// Default minimum age of the endpoints deleted by garbage collection.
+	DefaultEndpointGCGracePeriod = 5 * time.Minute
+)
+
+// ContainerLivenessFunc returns whether the container that owns an endpoint still exists.
+type ContainerLivenessFunc func(epInfo *EndpointInfo) (bool, error)
+
+// gcCandidate is an endpoint old enough to be garbage collected.
+type gcCandidate struct {
+	networkId   string
+	epInfo      *EndpointInfo
+	createdTime time.Time
+}
+
+// CollectEndpoints deletes the endpoints whose containers no longer exist and that are older than the
+// grace period, and returns their IDs. A zero grace period selects the default grace period. Endpoints
+// whose liveness cannot be determined are kept. Liveness is checked without holding the manager lock,
+// so that slow checks do not block other operations.
+func (nm *networkManager) CollectEndpoints(isAlive ContainerLivenessFunc, gracePeriod time.Duration) ([]string, error) {
+	if gracePeriod <= 0 {
+		gracePeriod = DefaultEndpointGCGracePeriod
+	}
+
+	var deleted []string
+	var failures []string
+	for _, candidate := range nm.getGCCandidates(gracePeriod) {
+		alive, err := isAlive(candidate.epInfo)
+		if err != nil {
+			log.Printf("[net] Failed to check container %v of endpoint %v, err:%v.", candidate.epInfo.ContainerID, candidate.epInfo.Id, err)
+			continue
+		}
+
+		if alive {
+			continue
+		}
+
+		collected, err := nm.collectEndpoint(candidate)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%v: %v", candidate.epInfo.Id, err))
+			continue
+		}
+
+		if collected {
+			deleted = append(deleted, candidate.epInfo.Id)
+		}
+	}
+
+	if len(failures) > 0 {
+		return deleted, fmt.Errorf("Failed to delete %v endpoints: %v", len(failures), strings.Join(failures, "; "))
+	}
+
+	return deleted, nil
+}
+
+// StartEndpointGC runs CollectEndpoints at the given interval until the network manager is uninitialized.
+// Starting it again replaces the previous schedule.
+func (nm *networkManager) StartEndpointGC(isAlive ContainerLivenessFunc, gracePeriod time.Duration, interval time.Duration) {
+	nm.Lock()
+	defer nm.Unlock()
+
+	nm.stopEndpointGC()
+
+	stop := make(chan struct{})
+	nm.gcStop = stop
+
+	log.Printf("[net] Collecting endpoints of dead containers every %v.", interval)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				deleted, err := nm.CollectEndpoints(isAlive, gracePeriod)
+				if err != nil || len(deleted) > 0 {
+					log.Printf("[net] Collected endpoints %v, err:%v.", deleted, err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopEndpointGC stops the periodic garbage collection, if running.
+func (nm *networkManager) stopEndpointGC() {
+	if nm.gcStop != nil {
+		close(nm.gcStop)
+		nm.gcStop = nil
+	}
+}
+
+// getGCCandidates returns copies of the endpoints older than the grace period, sorted by ID.
+// Endpoints without a container ID or sandbox key have no owner to check.
+func (nm *networkManager) getGCCandidates(gracePeriod time.Duration) []*gcCandidate {
+	nm.RLock()
+	defer nm.RUnlock()
+
+	var candidates []*gcCandidate
+	now := time.Now()
+	for _, extIf := range nm.ExternalInterfaces {
+		for _, nw := range extIf.Networks {
+			nw.lock.Lock()
+			for _, ep := range nw.Endpoints {
+				if ep.ContainerID == "" && ep.SandboxKey == "" {
+					continue
+				}
+
+				if ep.CreatedTime.IsZero() || now.Sub(ep.CreatedTime) < gracePeriod {
+					continue
+				}
+
+				candidates = append(candidates, &gcCandidate{
+					networkId:   nw.Id,
+					epInfo:      ep.getInfo().copy(),
+					createdTime: ep.CreatedTime,
+				})
+			}
+			nw.lock.Unlock()
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].epInfo.Id < candidates[j].epInfo.Id })
+
+	return candidates
+}
+
+// collectEndpoint deletes a candidate endpoint, unless it was deleted or recreated since it was checked.
+func (nm *networkManager) collectEndpoint(candidate *gcCandidate) (bool, error) {
+	nw, unlock, err := nm.lockNetwork(candidate.networkId)
+	if err != nil {
+		return false, nil
+	}
+
+	ep := nw.Endpoints[candidate.epInfo.Id]
+	if ep == nil || !ep.CreatedTime.Equal(candidate.createdTime) {
+		unlock()
+		return false, nil
+	}
+
+	log.Printf("[net] Deleting endpoint %v of dead container %v.", ep.Id, ep.ContainerID)
+
+	prune, err := nm.deleteEndpoint(nw, ep.Id)
+	unlock()
+	if err != nil {
+		return false, err
+	}
+
+	if prune {
+		if err := nm.pruneNetwork(candidate.networkId); err != nil {
+			log.Printf("[net] Failed to prune network %v, err:%v.", candidate.networkId, err)
+		}
+	}
+
+	return true, nil
+}
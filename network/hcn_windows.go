@@ -0,0 +1,143 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-container-networking/log"
+	"github.com/Azure/azure-container-networking/network/policy"
+	"github.com/Microsoft/hcsshim"
+	"github.com/Microsoft/hcsshim/hcn"
+)
+
+const (
+	// HNS APIs that endpoints are created with. Endpoints that do not record their API use HNS V1.
+	hnsAPIVersionV1 = 1
+	hnsAPIVersionV2 = 2
+)
+
+// getHNSAPIVersion returns the HNS API to create the endpoints of the network with. Networks that
+// enable HNS V2 use HNS V1 on HNS versions without HCN support, or if HNS does not report its version
+// before the timeout expires.
+func (nw *network) getHNSAPIVersion(timeout time.Duration) int {
+	if !nw.EnableHNSV2 {
+		return hnsAPIVersionV1
+	}
+
+	if err := callHNSWithTimeout(timeout, hcn.V2ApiSupported); err != nil {
+		log.Printf("[net] HNS does not support HCN, using HNS V1: %v.", err)
+		return hnsAPIVersionV1
+	}
+
+	return hnsAPIVersionV2
+}
+
+// getHcnGateways returns the gateways of the network subnets the addresses belong to. Unlike HNS V1,
+// HCN does not pick the gateways of endpoints from their network.
+func (nw *network) getHcnGateways(ipAddresses []net.IPNet) []net.IP {
+	var gateways []net.IP
+	for _, ipAddress := range ipAddresses {
+		for _, subnet := range nw.Subnets {
+			if subnet.Gateway != nil && subnet.Prefix.Contains(ipAddress.IP) {
+				gateways = append(gateways, subnet.Gateway)
+				break
+			}
+		}
+	}
+
+	return gateways
+}
+
+// newHcnEndpoint translates an HNS V1 endpoint request to the HCN schema, with a default route
+// through each of the gateways.
+func newHcnEndpoint(hnsEndpoint *dualStackHNSEndpoint, gateways []net.IP) (*hcn.HostComputeEndpoint, error) {
+	policies, err := policy.GetHcnEndpointPolicies(hnsEndpoint.Policies)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := &hcn.HostComputeEndpoint{
+		Name:               hnsEndpoint.Name,
+		HostComputeNetwork: hnsEndpoint.VirtualNetwork,
+		Policies:           policies,
+		MacAddress:         hnsEndpoint.MacAddress,
+		Dns: hcn.Dns{
+			Search:     splitHNSList(hnsEndpoint.DNSSuffix),
+			ServerList: splitHNSList(hnsEndpoint.DNSServerList),
+		},
+		SchemaVersion: hcn.V2SchemaVersion(),
+	}
+
+	if hnsEndpoint.IPAddress != nil {
+		endpoint.IpConfigurations = append(endpoint.IpConfigurations, hcn.IpConfig{
+			IpAddress:    hnsEndpoint.IPAddress.String(),
+			PrefixLength: hnsEndpoint.PrefixLength,
+		})
+	}
+
+	if hnsEndpoint.IPv6Address != nil {
+		endpoint.IpConfigurations = append(endpoint.IpConfigurations, hcn.IpConfig{
+			IpAddress:    hnsEndpoint.IPv6Address.String(),
+			PrefixLength: hnsEndpoint.IPv6PrefixLength,
+		})
+	}
+
+	for _, gateway := range gateways {
+		destination := "0.0.0.0/0"
+		if gateway.To4() == nil {
+			destination = "::/0"
+		}
+
+		endpoint.Routes = append(endpoint.Routes, hcn.Route{
+			NextHop:           gateway.String(),
+			DestinationPrefix: destination,
+		})
+	}
+
+	return endpoint, nil
+}
+
+// toHNSEndpoint returns the HNS V1 representation of an HCN endpoint.
+func toHNSEndpoint(endpoint *hcn.HostComputeEndpoint) *hcsshim.HNSEndpoint {
+	hnsEndpoint := &hcsshim.HNSEndpoint{
+		Id:             endpoint.Id,
+		Name:           endpoint.Name,
+		VirtualNetwork: endpoint.HostComputeNetwork,
+		MacAddress:     endpoint.MacAddress,
+		DNSSuffix:      strings.Join(endpoint.Dns.Search, ","),
+		DNSServerList:  strings.Join(endpoint.Dns.ServerList, ","),
+	}
+
+	for _, ipConfig := range endpoint.IpConfigurations {
+		if ip := net.ParseIP(ipConfig.IpAddress); ip != nil && ip.To4() != nil && hnsEndpoint.IPAddress == nil {
+			hnsEndpoint.IPAddress = ip
+			hnsEndpoint.PrefixLength = ipConfig.PrefixLength
+		}
+	}
+
+	for _, route := range endpoint.Routes {
+		if route.DestinationPrefix == "0.0.0.0/0" {
+			hnsEndpoint.GatewayAddress = route.NextHop
+		}
+	}
+
+	return hnsEndpoint
+}
+
+// splitHNSList splits a comma separated HNS V1 list.
+func splitHNSList(list string) []string {
+	if list == "" {
+		return nil
+	}
+
+	return strings.Split(list, ",")
+}
+
+// isHcnRoutePolicy returns true if the HCN endpoint policy is a route policy.
+func isHcnRoutePolicy(hcnPolicy hcn.EndpointPolicy) bool {
+	return hcnPolicy.Type == hcn.SDNRoute
+}
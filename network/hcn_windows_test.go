@@ -0,0 +1,112 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/Azure/azure-container-networking/network/policy"
+	"github.com/Microsoft/hcsshim"
+	"github.com/Microsoft/hcsshim/hcn"
+)
+
+// Tests that an HNS V1 endpoint request is translated to the HCN schema.
+func TestNewHcnEndpoint(t *testing.T) {
+	hnsEndpoint := &dualStackHNSEndpoint{
+		HNSEndpoint: hcsshim.HNSEndpoint{
+			Name:           "ep1",
+			VirtualNetwork: "nw1",
+			MacAddress:     "00-15-5D-01-02-03",
+			DNSSuffix:      "default.svc.cluster.local",
+			DNSServerList:  "10.0.0.10,10.0.0.11",
+			IPAddress:      net.ParseIP("10.0.0.4"),
+			PrefixLength:   24,
+			Policies:       []json.RawMessage{policy.SerializeRoutePolicy("10.1.0.0/16", "10.0.0.1", false)},
+		},
+		IPv6Address:      net.ParseIP("fd00::4"),
+		IPv6PrefixLength: 64,
+	}
+
+	endpoint, err := newHcnEndpoint(hnsEndpoint, []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")})
+	if err != nil {
+		t.Fatalf("newHcnEndpoint failed: %v", err)
+	}
+
+	if endpoint.Name != "ep1" || endpoint.HostComputeNetwork != "nw1" || endpoint.MacAddress != "00-15-5D-01-02-03" {
+		t.Errorf("Unexpected endpoint %+v", endpoint)
+	}
+
+	if len(endpoint.Dns.Search) != 1 || len(endpoint.Dns.ServerList) != 2 || endpoint.Dns.ServerList[1] != "10.0.0.11" {
+		t.Errorf("Unexpected DNS settings %+v", endpoint.Dns)
+	}
+
+	expectedIPConfigs := []hcn.IpConfig{{IpAddress: "10.0.0.4", PrefixLength: 24}, {IpAddress: "fd00::4", PrefixLength: 64}}
+	if len(endpoint.IpConfigurations) != len(expectedIPConfigs) {
+		t.Fatalf("Unexpected IP configurations %+v", endpoint.IpConfigurations)
+	}
+	for i, ipConfig := range expectedIPConfigs {
+		if endpoint.IpConfigurations[i] != ipConfig {
+			t.Errorf("Unexpected IP configuration %+v, expected %+v", endpoint.IpConfigurations[i], ipConfig)
+		}
+	}
+
+	expectedRoutes := []hcn.Route{{NextHop: "10.0.0.1", DestinationPrefix: "0.0.0.0/0"}, {NextHop: "fd00::1", DestinationPrefix: "::/0"}}
+	if len(endpoint.Routes) != len(expectedRoutes) {
+		t.Fatalf("Unexpected routes %+v", endpoint.Routes)
+	}
+	for i, route := range expectedRoutes {
+		if endpoint.Routes[i] != route {
+			t.Errorf("Unexpected route %+v, expected %+v", endpoint.Routes[i], route)
+		}
+	}
+
+	if len(endpoint.Policies) != 1 || !isHcnRoutePolicy(endpoint.Policies[0]) {
+		t.Errorf("Unexpected policies %+v", endpoint.Policies)
+	}
+}
+
+// Tests that an HCN endpoint is returned in its HNS V1 representation.
+func TestToHNSEndpoint(t *testing.T) {
+	endpoint := &hcn.HostComputeEndpoint{
+		Id:                 "id1",
+		Name:               "ep1",
+		HostComputeNetwork: "nw1",
+		MacAddress:         "00-15-5D-01-02-03",
+		Dns:                hcn.Dns{Search: []string{"default.svc.cluster.local"}, ServerList: []string{"10.0.0.10", "10.0.0.11"}},
+		IpConfigurations:   []hcn.IpConfig{{IpAddress: "fd00::4", PrefixLength: 64}, {IpAddress: "10.0.0.4", PrefixLength: 24}},
+		Routes:             []hcn.Route{{NextHop: "fd00::1", DestinationPrefix: "::/0"}, {NextHop: "10.0.0.1", DestinationPrefix: "0.0.0.0/0"}},
+	}
+
+	hnsEndpoint := toHNSEndpoint(endpoint)
+
+	if hnsEndpoint.Id != "id1" || hnsEndpoint.Name != "ep1" || hnsEndpoint.VirtualNetwork != "nw1" ||
+		hnsEndpoint.MacAddress != "00-15-5D-01-02-03" {
+		t.Errorf("Unexpected endpoint %+v", hnsEndpoint)
+	}
+
+	if hnsEndpoint.DNSSuffix != "default.svc.cluster.local" || hnsEndpoint.DNSServerList != "10.0.0.10,10.0.0.11" {
+		t.Errorf("Unexpected DNS settings %v %v", hnsEndpoint.DNSSuffix, hnsEndpoint.DNSServerList)
+	}
+
+	if !hnsEndpoint.IPAddress.Equal(net.ParseIP("10.0.0.4")) || hnsEndpoint.PrefixLength != 24 {
+		t.Errorf("Unexpected IP address %v/%v", hnsEndpoint.IPAddress, hnsEndpoint.PrefixLength)
+	}
+
+	if hnsEndpoint.GatewayAddress != "10.0.0.1" {
+		t.Errorf("Unexpected gateway %v", hnsEndpoint.GatewayAddress)
+	}
+}
+
+// Tests that DNS changes of HCN endpoints are rejected.
+func TestUpdateHcnEndpointRejectsDNSChange(t *testing.T) {
+	ep := &endpoint{Id: "ep1", HnsId: "id1", HNSAPIVersion: hnsAPIVersionV2}
+	existing := &EndpointInfo{DNS: DNSInfo{Suffix: "default.svc.cluster.local", Servers: []string{"10.0.0.10"}}}
+	target := &EndpointInfo{DNS: DNSInfo{Suffix: "default.svc.cluster.local", Servers: []string{"10.0.0.11"}}}
+
+	if err := updateHcnEndpoint(ep, existing, target); err != errHcnDNSUpdateNotSupported {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
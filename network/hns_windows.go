@@ -0,0 +1,158 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"errors"
+
+	"github.com/Microsoft/hcsshim"
+	"github.com/Microsoft/hcsshim/hcn"
+)
+
+// hnsClient is the subset of the HNS API used by the Windows network implementation.
+type hnsClient interface {
+	NetworkRequest(method, path, request string) (*hcsshim.HNSNetwork, error)
+	ListNetworkRequest() ([]hcsshim.HNSNetwork, error)
+	GetNetworkByName(networkName string) (*hcsshim.HNSNetwork, error)
+	EndpointRequest(method, path, request string) (*hcsshim.HNSEndpoint, error)
+	ListEndpointRequest() ([]hcsshim.HNSEndpoint, error)
+	GetEndpointByName(endpointName string) (*hcsshim.HNSEndpoint, error)
+	HotAttachEndpoint(containerID string, endpointID string) error
+	HotDetachEndpoint(containerID string, endpointID string) error
+	CreateHcnEndpoint(endpoint *hcn.HostComputeEndpoint) (*hcn.HostComputeEndpoint, error)
+	GetHcnEndpointByID(endpointID string) (*hcn.HostComputeEndpoint, error)
+	ApplyHcnEndpointPolicy(endpoint *hcn.HostComputeEndpoint, request hcn.PolicyEndpointRequest) error
+	DeleteHcnEndpoint(endpointID string) error
+	GetContainerNetworkStats(containerID string) ([]hcsshim.NetworkStats, error)
+	GetGlobals() (*hcsshim.HNSGlobals, error)
+	HostAttachEndpoint(endpointID string, compartmentID uint16) error
+	HostDetachEndpoint(endpointID string) error
+}
+
+// hcsshimClient implements hnsClient with hcsshim.
+type hcsshimClient struct{}
+
+// hns is the HNS client used by the network package. Tests replace it with a fake.
+var hns hnsClient = hcsshimClient{}
+
+// NetworkRequest makes an HNS call to modify or query a network.
+func (hcsshimClient) NetworkRequest(method, path, request string) (*hcsshim.HNSNetwork, error) {
+	hnsNetwork, err := hcsshim.HNSNetworkRequest(method, path, request)
+	return hnsNetwork, wrapHNSError(err)
+}
+
+// ListNetworkRequest makes an HNS call to query the list of networks.
+func (hcsshimClient) ListNetworkRequest() ([]hcsshim.HNSNetwork, error) {
+	hnsNetworks, err := hcsshim.HNSListNetworkRequest("GET", "", "")
+	return hnsNetworks, wrapHNSError(err)
+}
+
+// GetNetworkByName queries the network with the given name.
+func (hcsshimClient) GetNetworkByName(networkName string) (*hcsshim.HNSNetwork, error) {
+	hnsNetwork, err := hcsshim.GetHNSNetworkByName(networkName)
+	return hnsNetwork, wrapHNSError(err)
+}
+
+// EndpointRequest makes an HNS call to modify or query a network endpoint.
+func (hcsshimClient) EndpointRequest(method, path, request string) (*hcsshim.HNSEndpoint, error) {
+	hnsEndpoint, err := hcsshim.HNSEndpointRequest(method, path, request)
+	return hnsEndpoint, wrapHNSError(err)
+}
+
+// ListEndpointRequest makes an HNS call to query the list of endpoints.
+func (hcsshimClient) ListEndpointRequest() ([]hcsshim.HNSEndpoint, error) {
+	hnsEndpoints, err := hcsshim.HNSListEndpointRequest()
+	return hnsEndpoints, wrapHNSError(err)
+}
+
+// GetEndpointByName queries the endpoint with the given name.
+func (hcsshimClient) GetEndpointByName(endpointName string) (*hcsshim.HNSEndpoint, error) {
+	hnsEndpoint, err := hcsshim.GetHNSEndpointByName(endpointName)
+	return hnsEndpoint, wrapHNSError(err)
+}
+
+// HotAttachEndpoint attaches an endpoint to a container.
+func (hcsshimClient) HotAttachEndpoint(containerID string, endpointID string) error {
+	return wrapHNSError(hcsshim.HotAttachEndpoint(containerID, endpointID))
+}
+
+// HotDetachEndpoint detaches an endpoint from a container.
+func (hcsshimClient) HotDetachEndpoint(containerID string, endpointID string) error {
+	return wrapHNSError(hcsshim.HotDetachEndpoint(containerID, endpointID))
+}
+
+// CreateHcnEndpoint makes an HCN call to create an endpoint.
+func (hcsshimClient) CreateHcnEndpoint(endpoint *hcn.HostComputeEndpoint) (*hcn.HostComputeEndpoint, error) {
+	hcnEndpoint, err := endpoint.Create()
+	return hcnEndpoint, wrapHNSError(err)
+}
+
+// GetHcnEndpointByID makes an HCN call to query an endpoint.
+func (hcsshimClient) GetHcnEndpointByID(endpointID string) (*hcn.HostComputeEndpoint, error) {
+	hcnEndpoint, err := hcn.GetEndpointByID(endpointID)
+	return hcnEndpoint, wrapHNSError(err)
+}
+
+// ApplyHcnEndpointPolicy makes an HCN call to replace the policies of an endpoint.
+func (hcsshimClient) ApplyHcnEndpointPolicy(endpoint *hcn.HostComputeEndpoint, request hcn.PolicyEndpointRequest) error {
+	return wrapHNSError(endpoint.ApplyPolicy(request))
+}
+
+// DeleteHcnEndpoint makes an HCN call to delete an endpoint.
+func (hcsshimClient) DeleteHcnEndpoint(endpointID string) error {
+	return wrapHNSError((&hcn.HostComputeEndpoint{Id: endpointID}).Delete())
+}
+
+// GetContainerNetworkStats queries the network statistics of the endpoints attached to a container.
+func (hcsshimClient) GetContainerNetworkStats(containerID string) ([]hcsshim.NetworkStats, error) {
+	container, err := hcsshim.OpenContainer(containerID)
+	if err != nil {
+		return nil, wrapHNSError(err)
+	}
+	defer container.Close()
+
+	stats, err := container.Statistics()
+	if err != nil {
+		return nil, wrapHNSError(err)
+	}
+
+	return stats.Network, nil
+}
+
+// GetGlobals queries the HNS global settings, including its version.
+func (hcsshimClient) GetGlobals() (*hcsshim.HNSGlobals, error) {
+	globals, err := hcsshim.GetHNSGlobals()
+	return globals, wrapHNSError(err)
+}
+
+// HostAttachEndpoint attaches an endpoint to a network compartment on the host.
+func (hcsshimClient) HostAttachEndpoint(endpointID string, compartmentID uint16) error {
+	endpoint := &hcsshim.HNSEndpoint{Id: endpointID}
+	return wrapHNSError(endpoint.HostAttach(compartmentID))
+}
+
+// HostDetachEndpoint detaches an endpoint from its network compartment on the host.
+func (hcsshimClient) HostDetachEndpoint(endpointID string) error {
+	endpoint := &hcsshim.HNSEndpoint{Id: endpointID}
+	return wrapHNSError(endpoint.HostDetach())
+}
+
+// wrapHNSError wraps an error returned by hcsshim in an HNSError.
+func wrapHNSError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &HNSError{Err: err}
+}
+
+// unwrapHNSError returns the hcsshim error wrapped by an HNSError, so that it can be inspected by hcsshim.
+func unwrapHNSError(err error) error {
+	var hnsErr *HNSError
+	if errors.As(err, &hnsErr) {
+		return hnsErr.Err
+	}
+
+	return err
+}
@@ -0,0 +1,191 @@
+package network
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/Azure/azure-container-networking/log"
+	"github.com/Azure/azure-container-networking/netlink"
+	"github.com/Azure/azure-container-networking/network/epcommon"
+)
+
+const (
+	// Network namespace to which host devices are returned when their endpoint is deleted.
+	hostNetNsPath = "/proc/1/ns/net"
+)
+
+// HostDeviceEndpointClient moves an existing host interface, such as an SR-IOV VF,
+// into the container network namespace instead of creating a veth pair.
+type HostDeviceEndpointClient struct {
+	hostDeviceName    string
+	containerVethName string
+	containerMac      net.HardwareAddr
+}
+
+func NewHostDeviceEndpointClient(hostDeviceName string) *HostDeviceEndpointClient {
+	client := &HostDeviceEndpointClient{
+		hostDeviceName:    hostDeviceName,
+		containerVethName: hostDeviceName,
+	}
+
+	return client
+}
+
+func (client *HostDeviceEndpointClient) AddEndpoints(epInfo *EndpointInfo) error {
+	hostDevice, err := net.InterfaceByName(client.hostDeviceName)
+	if err != nil {
+		log.Printf("[net] Failed to find host device %v: %v.", client.hostDeviceName, err)
+		return err
+	}
+
+	client.containerMac = hostDevice.HardwareAddr
+	return nil
+}
+
+func (client *HostDeviceEndpointClient) AddEndpointRules(epInfo *EndpointInfo) error {
+	return nil
+}
+
+func (client *HostDeviceEndpointClient) DeleteEndpointRules(ep *endpoint) {
+}
+
+func (client *HostDeviceEndpointClient) MoveEndpointsToContainerNS(epInfo *EndpointInfo, nsID uintptr) error {
+	log.Printf("[net] Setting link %v state down.", client.hostDeviceName)
+	if err := netlink.SetLinkState(client.hostDeviceName, false); err != nil {
+		return err
+	}
+
+	// Move the host device to container's network namespace.
+	log.Printf("[net] Setting link %v netns %v.", client.hostDeviceName, epInfo.NetNs)
+	if err := netlink.SetLinkNetNs(client.hostDeviceName, nsID); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (client *HostDeviceEndpointClient) SetupContainerInterfaces(epInfo *EndpointInfo) error {
+	if err := epcommon.SetupContainerInterface(client.containerVethName, epInfo.IfName); err != nil {
+		return err
+	}
+
+	client.containerVethName = epInfo.IfName
+
+	return nil
+}
+
+func (client *HostDeviceEndpointClient) ConfigureContainerInterfacesAndRoutes(epInfo *EndpointInfo) error {
+	if epcommon.HasIPv6Address(epInfo.IPAddresses) {
+		if err := epcommon.ConfigureIPv6Interface(client.containerVethName, acceptIPv6RouterAdvertisements(epInfo.Secondary, epInfo.Routes)); err != nil {
+			return err
+		}
+	}
+
+	if err := epcommon.AssignIPToInterface(client.containerVethName, epInfo.IPAddresses); err != nil {
+		return err
+	}
+
+	return addRoutes(client.containerVethName, epInfo.Routes)
+}
+
+// DeleteEndpoints moves the host device back to the host network namespace and restores its
+// original name. The device is looked up by its MAC address, so that devices whose move was
+// interrupted or which the kernel returned to the host after the container netns was destroyed
+// are restored as well.
+func (client *HostDeviceEndpointClient) DeleteEndpoints(ep *endpoint) error {
+	if ep.MacAddress == nil {
+		return nil
+	}
+
+	hostNsPath := ep.HostDeviceNetNsPath
+	if hostNsPath == "" {
+		hostNsPath = hostNetNsPath
+	}
+
+	hostNs, err := OpenNamespace(hostNsPath)
+	if err != nil {
+		log.Printf("[net] Failed to open host netns %v: %v.", hostNsPath, err)
+		return err
+	}
+	defer hostNs.Close()
+
+	if ep.NetworkNameSpace != "" {
+		if err := moveHostDeviceFromNamespace(ep, hostNs); err != nil {
+			log.Printf("[net] Failed to move host device %v out of netns %v: %v.", ep.HostDeviceName, ep.NetworkNameSpace, err)
+		}
+	}
+
+	// Restore the original name in the host namespace.
+	hostDevice, err := getInterfaceByMacAddress(ep.MacAddress)
+	if err != nil {
+		log.Printf("[net] Failed to find host device %v: %v.", ep.HostDeviceName, err)
+		return err
+	}
+
+	if hostDevice.Name != ep.HostDeviceName {
+		log.Printf("[net] Setting link %v state down.", hostDevice.Name)
+		if err := netlink.SetLinkState(hostDevice.Name, false); err != nil {
+			return err
+		}
+
+		log.Printf("[net] Setting link %v name %v.", hostDevice.Name, ep.HostDeviceName)
+		if err := netlink.SetLinkName(hostDevice.Name, ep.HostDeviceName); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("[net] Setting link %v state up.", ep.HostDeviceName)
+	return netlink.SetLinkState(ep.HostDeviceName, true)
+}
+
+// moveHostDeviceFromNamespace moves the host device of an endpoint from the container network namespace
+// to the given host namespace.
+func moveHostDeviceFromNamespace(ep *endpoint, hostNs *Namespace) error {
+	log.Printf("[net] Opening netns %v.", ep.NetworkNameSpace)
+	ns, err := OpenNamespace(ep.NetworkNameSpace)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	log.Printf("[net] Entering netns %v.", ep.NetworkNameSpace)
+	if err = ns.Enter(); err != nil {
+		return err
+	}
+
+	defer func() {
+		log.Printf("[net] Exiting netns %v.", ep.NetworkNameSpace)
+		if err := ns.Exit(); err != nil {
+			log.Printf("[net] Failed to exit netns, err:%v.", err)
+		}
+	}()
+
+	containerIf, err := getInterfaceByMacAddress(ep.MacAddress)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[net] Setting link %v state down.", containerIf.Name)
+	if err = netlink.SetLinkState(containerIf.Name, false); err != nil {
+		return err
+	}
+
+	log.Printf("[net] Setting link %v netns to host netns.", containerIf.Name)
+	return netlink.SetLinkNetNs(containerIf.Name, hostNs.GetFd())
+}
+
+// getInterfaceByMacAddress returns the interface with the given MAC address in the current namespace.
+func getInterfaceByMacAddress(macAddress net.HardwareAddr) (*net.Interface, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, iface := range interfaces {
+		if bytes.Equal(iface.HardwareAddr, macAddress) {
+			return &iface, nil
+		}
+	}
+
+	return nil, errHostDeviceNotFound
+}
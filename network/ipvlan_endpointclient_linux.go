@@ -0,0 +1,151 @@
+package network
+
+import (
+	"net"
+
+	"github.com/Azure/azure-container-networking/log"
+	"github.com/Azure/azure-container-networking/netlink"
+	"github.com/Azure/azure-container-networking/network/epcommon"
+)
+
+// IpvlanEndpointClient creates ipvlan sub-interfaces of the external interface for containers,
+// for hosts whose NIC cannot carry the additional MAC addresses required by bridging.
+type IpvlanEndpointClient struct {
+	parentIfName      string
+	hostIpvlanIfName  string
+	containerVethName string
+	mode              string
+}
+
+func NewIpvlanEndpointClient(parentIfName string, containerVethName string, mode string) *IpvlanEndpointClient {
+	client := &IpvlanEndpointClient{
+		parentIfName:      parentIfName,
+		containerVethName: containerVethName,
+		mode:              mode,
+	}
+
+	if parentIf, err := net.InterfaceByName(parentIfName); err == nil {
+		client.hostIpvlanIfName = getHostIpvlanInterfaceName(parentIf.Index)
+	}
+
+	return client
+}
+
+func (client *IpvlanEndpointClient) AddEndpoints(epInfo *EndpointInfo) error {
+	parentIf, err := net.InterfaceByName(client.parentIfName)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[net] Creating ipvlan %v interface %v on %v.", client.mode, client.containerVethName, client.parentIfName)
+
+	link := netlink.IPVlanLink{
+		LinkInfo: netlink.LinkInfo{
+			Type:        netlink.LINK_TYPE_IPVLAN,
+			Name:        client.containerVethName,
+			ParentIndex: parentIf.Index,
+		},
+		Mode: getNetlinkIpvlanMode(client.mode),
+	}
+
+	if err := netlink.AddLink(&link); err != nil {
+		log.Printf("[net] Failed to create ipvlan interface, err:%v.", err)
+		return err
+	}
+
+	return nil
+}
+
+func (client *IpvlanEndpointClient) AddEndpointRules(epInfo *EndpointInfo) error {
+	if client.mode != ipvlanModeL3 {
+		return nil
+	}
+
+	// In L3 mode the host cannot reach containers through the parent interface,
+	// so route container addresses through the host-side ipvlan interface.
+	for _, ipAddr := range epInfo.IPAddresses {
+		log.Printf("[net] Adding host route for IP address %v via %v.", ipAddr.IP.String(), client.hostIpvlanIfName)
+		if err := setHostRoute(client.hostIpvlanIfName, ipAddr.IP, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (client *IpvlanEndpointClient) DeleteEndpointRules(ep *endpoint) {
+	if client.mode != ipvlanModeL3 {
+		return
+	}
+
+	for _, ipAddr := range ep.IPAddresses {
+		log.Printf("[net] Deleting host route for IP address %v via %v.", ipAddr.IP.String(), client.hostIpvlanIfName)
+		if err := setHostRoute(client.hostIpvlanIfName, ipAddr.IP, false); err != nil {
+			log.Printf("[net] Failed to delete host route for IP address %v: %v.", ipAddr.IP.String(), err)
+		}
+	}
+}
+
+func (client *IpvlanEndpointClient) MoveEndpointsToContainerNS(epInfo *EndpointInfo, nsID uintptr) error {
+	// Move the ipvlan interface to container's network namespace.
+	log.Printf("[net] Setting link %v netns %v.", client.containerVethName, epInfo.NetNs)
+	if err := netlink.SetLinkNetNs(client.containerVethName, nsID); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (client *IpvlanEndpointClient) SetupContainerInterfaces(epInfo *EndpointInfo) error {
+	if err := epcommon.SetupContainerInterface(client.containerVethName, epInfo.IfName); err != nil {
+		return err
+	}
+
+	client.containerVethName = epInfo.IfName
+
+	return nil
+}
+
+func (client *IpvlanEndpointClient) ConfigureContainerInterfacesAndRoutes(epInfo *EndpointInfo) error {
+	if epcommon.HasIPv6Address(epInfo.IPAddresses) {
+		if err := epcommon.ConfigureIPv6Interface(client.containerVethName, acceptIPv6RouterAdvertisements(epInfo.Secondary, epInfo.Routes)); err != nil {
+			return err
+		}
+	}
+
+	if err := epcommon.AssignIPToInterface(client.containerVethName, epInfo.IPAddresses); err != nil {
+		return err
+	}
+
+	if client.mode != ipvlanModeL3 {
+		return addRoutes(client.containerVethName, epInfo.Routes)
+	}
+
+	// L3 mode interfaces do not resolve neighbors, so routes are programmed as device routes.
+	containerIf, err := net.InterfaceByName(client.containerVethName)
+	if err != nil {
+		return err
+	}
+
+	for _, route := range epInfo.Routes {
+		log.Printf("[net] Adding IP route %+v to link %v.", route, client.containerVethName)
+
+		dst := route.Dst
+		nlRoute := &netlink.Route{
+			Family:    netlink.GetIpAddressFamily(dst.IP),
+			Dst:       &dst,
+			LinkIndex: containerIf.Index,
+		}
+
+		if err := netlink.AddIpRoute(nlRoute); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (client *IpvlanEndpointClient) DeleteEndpoints(ep *endpoint) error {
+	// The ipvlan interface lives in the container namespace and is removed along with it.
+	return deleteContainerLink(ep)
+}
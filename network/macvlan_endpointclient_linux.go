@@ -0,0 +1,105 @@
+package network
+
+import (
+	"net"
+
+	"github.com/Azure/azure-container-networking/log"
+	"github.com/Azure/azure-container-networking/netlink"
+	"github.com/Azure/azure-container-networking/network/epcommon"
+)
+
+// MacvlanEndpointClient creates bridge mode macvlan sub-interfaces of the external interface for containers
+// on flat L2 networks, avoiding the software bridge and veth pair on the host.
+type MacvlanEndpointClient struct {
+	parentIfName      string
+	containerVethName string
+}
+
+func NewMacvlanEndpointClient(parentIfName string, containerVethName string) *MacvlanEndpointClient {
+	client := &MacvlanEndpointClient{
+		parentIfName:      parentIfName,
+		containerVethName: containerVethName,
+	}
+
+	return client
+}
+
+func (client *MacvlanEndpointClient) AddEndpoints(epInfo *EndpointInfo) error {
+	parentIf, err := net.InterfaceByName(client.parentIfName)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[net] Creating macvlan interface %v on %v.", client.containerVethName, client.parentIfName)
+
+	link := netlink.MacVlanLink{
+		LinkInfo: netlink.LinkInfo{
+			Type:        netlink.LINK_TYPE_MACVLAN,
+			Name:        client.containerVethName,
+			ParentIndex: parentIf.Index,
+		},
+		Mode: netlink.MACVLAN_MODE_BRIDGE,
+	}
+
+	if err := netlink.AddLink(&link); err != nil {
+		log.Printf("[net] Failed to create macvlan interface, err:%v.", err)
+		return err
+	}
+
+	// The kernel generates a random MAC address unless one is requested.
+	if epInfo.MacAddress != nil {
+		log.Printf("[net] Setting link %v address %v.", client.containerVethName, epInfo.MacAddress)
+		if err := netlink.SetLinkAddress(client.containerVethName, epInfo.MacAddress); err != nil {
+			netlink.DeleteLink(client.containerVethName)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (client *MacvlanEndpointClient) AddEndpointRules(epInfo *EndpointInfo) error {
+	return nil
+}
+
+func (client *MacvlanEndpointClient) DeleteEndpointRules(ep *endpoint) {
+}
+
+func (client *MacvlanEndpointClient) MoveEndpointsToContainerNS(epInfo *EndpointInfo, nsID uintptr) error {
+	// Move the macvlan interface to container's network namespace.
+	log.Printf("[net] Setting link %v netns %v.", client.containerVethName, epInfo.NetNs)
+	if err := netlink.SetLinkNetNs(client.containerVethName, nsID); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (client *MacvlanEndpointClient) SetupContainerInterfaces(epInfo *EndpointInfo) error {
+	if err := epcommon.SetupContainerInterface(client.containerVethName, epInfo.IfName); err != nil {
+		return err
+	}
+
+	client.containerVethName = epInfo.IfName
+
+	return nil
+}
+
+func (client *MacvlanEndpointClient) ConfigureContainerInterfacesAndRoutes(epInfo *EndpointInfo) error {
+	if epcommon.HasIPv6Address(epInfo.IPAddresses) {
+		if err := epcommon.ConfigureIPv6Interface(client.containerVethName, acceptIPv6RouterAdvertisements(epInfo.Secondary, epInfo.Routes)); err != nil {
+			return err
+		}
+	}
+
+	if err := epcommon.AssignIPToInterface(client.containerVethName, epInfo.IPAddresses); err != nil {
+		return err
+	}
+
+	return addRoutes(client.containerVethName, epInfo.Routes)
+}
+
+func (client *MacvlanEndpointClient) DeleteEndpoints(ep *endpoint) error {
+	// The macvlan interface lives in the container namespace and is removed along with it.
+	return deleteContainerLink(ep)
+}
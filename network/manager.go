@@ -4,6 +4,12 @@
 package network
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,9 +21,15 @@ import (
 
 const (
 	// Network store key.
-	storeKey    = "Network"
-	VlanIDKey   = "VlanID"
-	genericData = "com.docker.network.generic"
+	storeKey      = "Network"
+	VlanIDKey     = "VlanID"
+	IpvlanModeKey = "ipvlanMode"
+	VxlanIdKey    = "vxlanId"
+	VxlanPortKey  = "vxlanPort"
+	genericData   = "com.docker.network.generic"
+
+	// Maximum number of orphaned networks and endpoints kept in the state.
+	maxOrphans = 100
 )
 
 type NetworkClient interface {
@@ -40,12 +52,33 @@ type EndpointClient interface {
 }
 
 // NetworkManager manages the set of container networking resources.
+//
+// Operations that add or remove external interfaces and networks hold the manager lock exclusively.
+// Endpoint operations hold it shared along with the lock of their network, so that slow endpoint
+// operations on one network do not delay the others. Lock order is manager, ports, containers, network, save.
 type networkManager struct {
 	Version            string
 	TimeStamp          time.Time
 	ExternalInterfaces map[string]*externalInterface
+	Orphans            []*OrphanInfo `json:",omitempty"`
 	store              store.KeyValueStore
-	sync.Mutex
+	interfaces         *common.InterfaceInventory
+	events             eventDispatcher
+	gcStop             chan struct{}
+	portLock           sync.Mutex
+	containerLock      sync.Mutex
+	pendingPrimaries   map[string]bool
+	saveLock           sync.Mutex
+	sync.RWMutex
+}
+
+// OrphanInfo describes a network or endpoint dropped from the persisted state because it was invalid.
+type OrphanInfo struct {
+	NetworkId  string
+	EndpointId string `json:",omitempty"`
+	Reason     string
+	Time       time.Time
+	Data       json.RawMessage `json:",omitempty"`
 }
 
 // NetworkManager API.
@@ -56,16 +89,30 @@ type NetworkManager interface {
 	AddExternalInterface(ifName string, subnet string) error
 
 	CreateNetwork(nwInfo *NetworkInfo) error
+	UpdateNetwork(nwInfo *NetworkInfo) error
 	DeleteNetwork(networkId string) error
+	ForceDeleteNetwork(networkId string) error
 	GetNetworkInfo(networkId string) (*NetworkInfo, error)
+	GetNetworkInfos() ([]*NetworkInfo, error)
 
 	CreateEndpoint(networkId string, epInfo *EndpointInfo) error
 	DeleteEndpoint(networkId string, endpointId string) error
 	GetEndpointInfo(networkId string, endpointId string) (*EndpointInfo, error)
+	GetEndpointInfos(networkId string, filter *EndpointFilter) ([]*EndpointInfo, error)
+	GetContainerEndpointInfos(containerID string) ([]*EndpointInfo, error)
 	GetEndpointInfoBasedOnPODDetails(networkId string, podName string, podNameSpace string) (*EndpointInfo, error)
 	AttachEndpoint(networkId string, endpointId string, sandboxKey string) (*endpoint, error)
 	DetachEndpoint(networkId string, endpointId string) error
 	UpdateEndpoint(networkId string, existingEpInfo *EndpointInfo, targetEpInfo *EndpointInfo) error
+	AddRemoteEndpoint(networkId string, remoteEpInfo *RemoteEndpointInfo) error
+	DeleteRemoteEndpoint(networkId string, macAddress net.HardwareAddr) error
+	ReconcileEndpoints(dryRun bool) error
+	GetEndpointStats(networkId string) (map[string]*EndpointStats, error)
+	GetOrphanInfos() ([]*OrphanInfo, error)
+	Snapshot() (*Snapshot, error)
+	RegisterListener(listener func(Event))
+	CollectEndpoints(isAlive ContainerLivenessFunc, gracePeriod time.Duration) ([]string, error)
+	StartEndpointGC(isAlive ContainerLivenessFunc, gracePeriod time.Duration, interval time.Duration)
 }
 
 // Creates a new network manager.
@@ -81,6 +128,7 @@ func NewNetworkManager() (NetworkManager, error) {
 func (nm *networkManager) Initialize(config *common.PluginConfig) error {
 	nm.Version = config.Version
 	nm.store = config.Store
+	nm.interfaces = config.Interfaces
 
 	// Restore persisted state.
 	err := nm.restore()
@@ -89,6 +137,10 @@ func (nm *networkManager) Initialize(config *common.PluginConfig) error {
 
 // Uninitialize cleans up network manager.
 func (nm *networkManager) Uninitialize() {
+	nm.Lock()
+	defer nm.Unlock()
+
+	nm.stopEndpointGC()
 }
 
 // Restore reads network manager state from persistent store.
@@ -125,10 +177,28 @@ func (nm *networkManager) restore() error {
 		}
 	}
 
-	// Populate pointers.
-	for _, extIf := range nm.ExternalInterfaces {
+	// Set aside the networks and endpoints that could not be decoded and populate pointers.
+	changed := false
+	for ifName, extIf := range nm.ExternalInterfaces {
+		if extIf == nil {
+			delete(nm.ExternalInterfaces, ifName)
+			continue
+		}
+
+		changed = nm.addOrphans(extIf.undecodable) || changed
+		extIf.undecodable = nil
+
 		for _, nw := range extIf.Networks {
+			changed = nm.addOrphans(nw.undecodable) || changed
+			nw.undecodable = nil
 			nw.extIf = extIf
+
+			// Endpoints persisted without a creation time are at least as old as the state.
+			for _, ep := range nw.Endpoints {
+				if ep.CreatedTime.IsZero() {
+					ep.CreatedTime = nm.TimeStamp
+				}
+			}
 		}
 	}
 
@@ -150,10 +220,21 @@ func (nm *networkManager) restore() error {
 					log.Printf("[net] Restoring network failed for nwInfo %v extif %v. This should not happen %v", nwInfo, extIf, err)
 					return err
 				}
+
+				nw.restoreRemoteEndpoints()
 			}
 		}
 	}
 
+	// Make sure the persisted networks and endpoints still exist on the host.
+	changed = nm.reconcileNetworks() || changed
+	changed = nm.validateEndpoints() || changed
+	if changed {
+		nm.save()
+	} else {
+		nm.encodeNetworks()
+	}
+
 	log.Printf("[net] Restored state, %+v\n", nm)
 	for _, extIf := range nm.ExternalInterfaces {
 		log.Printf("External Interface %+v", extIf)
@@ -168,13 +249,209 @@ func (nm *networkManager) restore() error {
 	return nil
 }
 
+// reconcileNetworks verifies that each persisted network still exists on the host, recreates missing
+// networks from their persisted configuration and prunes the ones that cannot be recreated. Endpoints
+// of missing networks lost their platform resources along with the network and are marked stale, so
+// that deleting them succeeds. Pruned networks are removed once their last endpoint is deleted.
+// Returns whether the state changed.
+func (nm *networkManager) reconcileNetworks() bool {
+	var total, missing, recreated, pruned int
+
+	for _, extIf := range nm.ExternalInterfaces {
+		for _, nw := range extIf.Networks {
+			total++
+
+			exists, err := nm.networkExistsImpl(nw)
+			if err != nil {
+				// Do not prune networks because of transient errors.
+				log.Printf("[net] Failed to verify network %v, err:%v.", nw.Id, err)
+				continue
+			}
+
+			if exists {
+				continue
+			}
+
+			missing++
+			log.Printf("[net] Network %v no longer exists on the host.", nw.Id)
+
+			for _, ep := range nw.Endpoints {
+				ep.Stale = true
+			}
+
+			if nm.recreateNetwork(nw) {
+				recreated++
+				continue
+			}
+
+			pruned++
+			if len(nw.Endpoints) == 0 {
+				log.Printf("[net] Pruning network %v.", nw.Id)
+				delete(extIf.Networks, nw.Id)
+			} else {
+				log.Printf("[net] Pruning network %v after its %v endpoints are deleted.", nw.Id, len(nw.Endpoints))
+				nw.Pruned = true
+			}
+		}
+	}
+
+	log.Printf("[net] Reconciled %v networks: %v missing, %v recreated, %v pruned.", total, missing, recreated, pruned)
+
+	return missing > 0
+}
+
+// validateEndpoints drops the endpoints whose addresses are unusable or whose platform resources no
+// longer exist from the state, and records them as orphans. Endpoints of missing networks are left
+// to reconcileNetworks. Returns whether the state changed.
+func (nm *networkManager) validateEndpoints() bool {
+	resources, err := listEndpointResourcesImpl()
+	if err != nil {
+		// Do not drop endpoints because of transient errors.
+		log.Printf("[net] Failed to list endpoint resources, err:%v.", err)
+	}
+
+	var orphans []*OrphanInfo
+	for _, extIf := range nm.ExternalInterfaces {
+		for _, nw := range extIf.Networks {
+			for endpointId, ep := range nw.Endpoints {
+				if ep.Stale {
+					continue
+				}
+
+				err := ep.validateAddresses()
+				if err == nil && resources != nil {
+					err = ep.checkResourcesImpl(resources)
+				}
+
+				if err == nil {
+					continue
+				}
+
+				log.Printf("[net] Dropping invalid endpoint %v of network %v: %v.", endpointId, nw.Id, err)
+				data, _ := json.Marshal(ep)
+				orphans = append(orphans, &OrphanInfo{NetworkId: nw.Id, EndpointId: endpointId, Reason: err.Error(), Data: data})
+				delete(nw.Endpoints, endpointId)
+			}
+		}
+	}
+
+	return nm.addOrphans(orphans)
+}
+
+// addOrphans records orphaned networks and endpoints, keeping only the most recent ones.
+// Returns whether any were added.
+func (nm *networkManager) addOrphans(orphans []*OrphanInfo) bool {
+	for _, orphan := range orphans {
+		log.Printf("[net] Orphaned network %v endpoint %v: %v.", orphan.NetworkId, orphan.EndpointId, orphan.Reason)
+		if orphan.Time.IsZero() {
+			orphan.Time = time.Now()
+		}
+
+		nm.Orphans = append(nm.Orphans, orphan)
+	}
+
+	if len(nm.Orphans) > maxOrphans {
+		nm.Orphans = nm.Orphans[len(nm.Orphans)-maxOrphans:]
+	}
+
+	return len(orphans) > 0
+}
+
+// recreateNetwork recreates a missing network from its persisted configuration.
+// Returns whether the network exists afterwards.
+func (nm *networkManager) recreateNetwork(nw *network) bool {
+	nwInfo, err := nm.GetNetworkInfo(nw.Id)
+	if err != nil {
+		log.Printf("[net] Failed to fetch network info for network %v, err:%v.", nw.Id, err)
+		return false
+	}
+
+	// Settings that are not reported in network info.
+	nwInfo.EnableSnatOnHost = nw.EnableSnatOnHost
+	nwInfo.MTU = nw.MTU
+	nwInfo.HNSTimeout = nw.HNSTimeout
+	nwInfo.EnableHNSV2 = nw.EnableHNSV2
+	nwInfo.RetryPolicy = nw.RetryPolicy
+
+	log.Printf("[net] Recreating network %v.", nw.Id)
+	nw.extIf.BridgeName = ""
+
+	newNw, err := nm.newNetworkImpl(nwInfo, nw.extIf)
+	if err != nil {
+		log.Printf("[net] Failed to recreate network %v, err:%v.", nw.Id, err)
+		return false
+	}
+
+	nw.HnsId = newNw.HnsId
+
+	exists, err := nm.networkExistsImpl(nw)
+	if err != nil || !exists {
+		log.Printf("[net] Recreated network %v is still missing, err:%v.", nw.Id, err)
+		return false
+	}
+
+	nw.Pruned = false
+	nw.restoreRemoteEndpoints()
+
+	return true
+}
+
 // Save writes network manager state to persistent store.
+// The caller holds the manager lock exclusively.
 func (nm *networkManager) save() error {
 	// Skip if a store is not provided.
 	if nm.store == nil {
 		return nil
 	}
 
+	nm.saveLock.Lock()
+	defer nm.saveLock.Unlock()
+
+	nm.encodeNetworks()
+
+	return nm.write()
+}
+
+// saveNetwork writes network manager state to persistent store after a change to a single network.
+// Only the given network is encoded again, the others are written as they were last saved.
+// The caller holds the manager lock shared and the lock of the network.
+func (nm *networkManager) saveNetwork(nw *network) error {
+	// Skip if a store is not provided.
+	if nm.store == nil {
+		return nil
+	}
+
+	encoded, err := nw.encode()
+	if err != nil {
+		log.Printf("[net] Failed to encode network %v, err:%v\n", nw.Id, err)
+		return err
+	}
+
+	nm.saveLock.Lock()
+	defer nm.saveLock.Unlock()
+
+	nw.encoded = encoded
+
+	return nm.write()
+}
+
+// encodeNetworks caches the current encoding of all networks.
+func (nm *networkManager) encodeNetworks() {
+	for _, extIf := range nm.ExternalInterfaces {
+		for _, nw := range extIf.Networks {
+			encoded, err := nw.encode()
+			if err != nil {
+				log.Printf("[net] Failed to encode network %v, err:%v\n", nw.Id, err)
+				continue
+			}
+
+			nw.encoded = encoded
+		}
+	}
+}
+
+// write writes the state to the store. The caller holds the save lock.
+func (nm *networkManager) write() error {
 	// Update time stamp.
 	nm.TimeStamp = time.Now()
 
@@ -187,6 +464,27 @@ func (nm *networkManager) save() error {
 	return err
 }
 
+// lockNetwork looks up a network for an endpoint operation and locks it. The manager lock is held
+// shared until the returned function unlocks both, so that the network is not deleted meanwhile.
+func (nm *networkManager) lockNetwork(networkId string) (*network, func(), error) {
+	nm.RLock()
+
+	nw, err := nm.getNetwork(networkId)
+	if err != nil {
+		nm.RUnlock()
+		return nil, nil, err
+	}
+
+	nw.lock.Lock()
+
+	unlock := func() {
+		nw.lock.Unlock()
+		nm.RUnlock()
+	}
+
+	return nw, unlock, nil
+}
+
 //
 // NetworkManager API
 //
@@ -226,6 +524,34 @@ func (nm *networkManager) CreateNetwork(nwInfo *NetworkInfo) error {
 		return err
 	}
 
+	nm.events.publish(EventNetworkCreated, nwInfo.Id, "")
+
+	return nil
+}
+
+// UpdateNetwork adds subnets to an existing container network. The given information lists all subnets
+// of the network, so subnets that the network already has are left as they are. Other fields left empty
+// are not changed, and changes to the mode or the master interface are rejected.
+func (nm *networkManager) UpdateNetwork(nwInfo *NetworkInfo) error {
+	nm.Lock()
+	defer nm.Unlock()
+
+	added, err := nm.updateNetwork(nwInfo)
+	if err != nil {
+		return err
+	}
+
+	if len(added) == 0 {
+		return nil
+	}
+
+	err = nm.save()
+	if err != nil {
+		return err
+	}
+
+	nm.events.publish(EventNetworkUpdated, nwInfo.Id, "")
+
 	return nil
 }
 
@@ -244,45 +570,133 @@ func (nm *networkManager) DeleteNetwork(networkId string) error {
 		return err
 	}
 
+	nm.events.publish(EventNetworkDeleted, networkId, "")
+
 	return nil
 }
 
-// GetNetworkInfo returns information about the given network.
-func (nm *networkManager) GetNetworkInfo(networkId string) (*NetworkInfo, error) {
+// ForceDeleteNetwork deletes an existing container network along with all of its endpoints.
+// The state is saved after each deleted endpoint, so that endpoints deleted before a crash stay deleted.
+// Endpoints that fail to delete do not stop the deletion of the others. Their errors are returned
+// together and the network is kept, so that the call can be retried.
+func (nm *networkManager) ForceDeleteNetwork(networkId string) error {
 	nm.Lock()
 	defer nm.Unlock()
 
 	nw, err := nm.getNetwork(networkId)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	nwInfo := &NetworkInfo{
-		Id:      networkId,
-		Subnets: nw.Subnets,
-		Mode:    nw.Mode,
-		Options: make(map[string]interface{}),
+	var endpointIds []string
+	for endpointId := range nw.Endpoints {
+		endpointIds = append(endpointIds, endpointId)
 	}
+	sort.Strings(endpointIds)
+
+	var failures []string
+	for _, endpointId := range endpointIds {
+		err = nw.deleteEndpoint(endpointId)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%v: %v", endpointId, err))
+			continue
+		}
 
-	getNetworkInfoImpl(nwInfo, nw)
+		err = nm.save()
+		if err != nil {
+			return err
+		}
 
-	if nw.extIf != nil {
-		nwInfo.BridgeName = nw.extIf.BridgeName
+		nm.events.publish(EventEndpointDeleted, networkId, endpointId)
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("Failed to delete %v endpoints of network %v: %v", len(failures), networkId, strings.Join(failures, "; "))
+	}
+
+	err = nm.deleteNetwork(networkId)
+	if err != nil {
+		return err
+	}
+
+	err = nm.save()
+	if err != nil {
+		return err
+	}
+
+	nm.events.publish(EventNetworkDeleted, networkId, "")
+
+	return nil
+}
+
+// GetNetworkInfo returns information about the given network.
+func (nm *networkManager) GetNetworkInfo(networkId string) (*NetworkInfo, error) {
+	nm.RLock()
+	defer nm.RUnlock()
+
+	nw, err := nm.getNetwork(networkId)
+	if err != nil {
+		return nil, err
 	}
 
-	return nwInfo, nil
+	return nw.getInfo(), nil
+}
+
+// GetNetworkInfos returns information about all networks, sorted by ID.
+// The returned information is a copy that callers are free to modify.
+func (nm *networkManager) GetNetworkInfos() ([]*NetworkInfo, error) {
+	nm.RLock()
+	defer nm.RUnlock()
+
+	var nwInfos []*NetworkInfo
+	for _, extIf := range nm.ExternalInterfaces {
+		for _, nw := range extIf.Networks {
+			nwInfos = append(nwInfos, nw.getInfo())
+		}
+	}
+
+	sort.Slice(nwInfos, func(i, j int) bool { return nwInfos[i].Id < nwInfos[j].Id })
+
+	return nwInfos, nil
 }
 
 // CreateEndpoint creates a new container endpoint.
 func (nm *networkManager) CreateEndpoint(networkId string, epInfo *EndpointInfo) error {
-	nm.Lock()
-	defer nm.Unlock()
+	nm.RLock()
+	defer nm.RUnlock()
 
 	nw, err := nm.getNetwork(networkId)
 	if err != nil {
 		return err
 	}
 
+	// Host ports are shared by all networks, so endpoints that publish ports are created one at a time.
+	if len(epInfo.PortMappings) > 0 {
+		nm.portLock.Lock()
+		defer nm.portLock.Unlock()
+
+		err = nm.checkPortMappings(epInfo)
+		if err != nil {
+			return err
+		}
+	}
+
+	if epInfo.ContainerID != "" && !epInfo.Secondary {
+		if nm.claimPrimaryEndpoint(epInfo.ContainerID, epInfo.Id) {
+			defer nm.releasePrimaryEndpoint(epInfo.ContainerID)
+		} else {
+			log.Printf("[net] Container %v has a primary endpoint, creating secondary endpoint %v.", epInfo.ContainerID, epInfo.Id)
+			epInfo.Secondary = true
+		}
+	}
+
+	nw.lock.Lock()
+	defer nw.lock.Unlock()
+
+	if nw.Pruned {
+		return errNetworkPruned
+	}
+
 	if nw.VlanId != 0 {
 		if epInfo.Data[VlanIDKey] == nil {
 			log.Printf("overriding endpoint vlanid with network vlanid")
@@ -290,51 +704,136 @@ func (nm *networkManager) CreateEndpoint(networkId string, epInfo *EndpointInfo)
 		}
 	}
 
+	start := time.Now()
 	_, err = nw.newEndpoint(epInfo)
+	endpointCreateDuration.ObserveDuration(start)
 	if err != nil {
+		endpointCreateFailures.Inc()
 		return err
 	}
 
-	err = nm.save()
+	err = nm.saveNetwork(nw)
 	if err != nil {
 		return err
 	}
 
+	nm.events.publish(EventEndpointCreated, networkId, epInfo.Id)
+
 	return nil
 }
 
+// claimPrimaryEndpoint returns whether a new endpoint of the given container becomes its primary endpoint,
+// which is the case unless the container has another primary endpoint. The claim is pending until it is
+// released, so that concurrent creates of endpoints of the same container do not both become primary.
+// The caller holds the manager lock shared and no network lock.
+func (nm *networkManager) claimPrimaryEndpoint(containerID string, endpointId string) bool {
+	nm.containerLock.Lock()
+	defer nm.containerLock.Unlock()
+
+	if nm.pendingPrimaries[containerID] {
+		return false
+	}
+
+	for _, extIf := range nm.ExternalInterfaces {
+		for _, nw := range extIf.Networks {
+			nw.lock.Lock()
+			found := nw.hasPrimaryEndpoint(containerID, endpointId)
+			nw.lock.Unlock()
+
+			if found {
+				return false
+			}
+		}
+	}
+
+	if nm.pendingPrimaries == nil {
+		nm.pendingPrimaries = make(map[string]bool)
+	}
+	nm.pendingPrimaries[containerID] = true
+
+	return true
+}
+
+// releasePrimaryEndpoint releases the pending claim of a container to its primary endpoint, once the
+// endpoint was created or failed to be created.
+func (nm *networkManager) releasePrimaryEndpoint(containerID string) {
+	nm.containerLock.Lock()
+	defer nm.containerLock.Unlock()
+
+	delete(nm.pendingPrimaries, containerID)
+}
+
 // DeleteEndpoint deletes an existing container endpoint.
 func (nm *networkManager) DeleteEndpoint(networkId string, endpointId string) error {
-	nm.Lock()
-	defer nm.Unlock()
-
-	nw, err := nm.getNetwork(networkId)
+	nw, unlock, err := nm.lockNetwork(networkId)
 	if err != nil {
 		return err
 	}
 
-	err = nw.deleteEndpoint(endpointId)
+	prune, err := nm.deleteEndpoint(nw, endpointId)
+	unlock()
 	if err != nil {
 		return err
 	}
 
+	if prune {
+		return nm.pruneNetwork(networkId)
+	}
+
+	return nil
+}
+
+// deleteEndpoint deletes an endpoint and persists the state. Returns whether the network is pruned
+// and this was its last endpoint. The caller holds the manager lock shared and the lock of the network.
+func (nm *networkManager) deleteEndpoint(nw *network, endpointId string) (bool, error) {
+	_, existed := nw.Endpoints[endpointId]
+	err := nw.deleteEndpoint(endpointId)
+	if err != nil {
+		return false, err
+	}
+
+	err = nm.saveNetwork(nw)
+	if err != nil {
+		return false, err
+	}
+
+	if existed {
+		nm.events.publish(EventEndpointDeleted, nw.Id, endpointId)
+	}
+
+	return nw.Pruned && len(nw.Endpoints) == 0, nil
+}
+
+// pruneNetwork removes a pruned network along with its last endpoint, unless an endpoint was added since.
+func (nm *networkManager) pruneNetwork(networkId string) error {
+	nm.Lock()
+	defer nm.Unlock()
+
+	nw, err := nm.getNetwork(networkId)
+	if err != nil || !nw.Pruned || len(nw.Endpoints) != 0 {
+		return nil
+	}
+
+	log.Printf("[net] Pruning network %v.", nw.Id)
+	delete(nw.extIf.Networks, nw.Id)
+
 	err = nm.save()
 	if err != nil {
 		return err
 	}
 
+	nm.events.publish(EventNetworkDeleted, nw.Id, "")
+
 	return nil
 }
 
 // GetEndpointInfo returns information about the given endpoint.
 func (nm *networkManager) GetEndpointInfo(networkId string, endpointId string) (*EndpointInfo, error) {
-	nm.Lock()
-	defer nm.Unlock()
-
-	nw, err := nm.getNetwork(networkId)
+	nw, unlock, err := nm.lockNetwork(networkId)
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
 	ep, err := nw.getEndpoint(endpointId)
 	if err != nil {
@@ -344,16 +843,91 @@ func (nm *networkManager) GetEndpointInfo(networkId string, endpointId string) (
 	return ep.getInfo(), nil
 }
 
+// GetEndpointInfos returns information about the endpoints of the given network that match the filter,
+// sorted by ID. A nil filter matches all endpoints. The returned information is a copy that callers
+// are free to modify.
+func (nm *networkManager) GetEndpointInfos(networkId string, filter *EndpointFilter) ([]*EndpointInfo, error) {
+	nw, unlock, err := nm.lockNetwork(networkId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var epInfos []*EndpointInfo
+	for _, ep := range nw.Endpoints {
+		if filter.matches(ep) {
+			epInfos = append(epInfos, ep.getInfo().copy())
+		}
+	}
+
+	sort.Slice(epInfos, func(i, j int) bool { return epInfos[i].Id < epInfos[j].Id })
+
+	return epInfos, nil
+}
+
+// GetContainerEndpointInfos returns information about the endpoints of the given container in all networks,
+// with the NetworkId of each set. The primary endpoint comes first, followed by the secondary endpoints
+// sorted by network and endpoint ID. The returned information is a copy that callers are free to modify.
+func (nm *networkManager) GetContainerEndpointInfos(containerID string) ([]*EndpointInfo, error) {
+	nm.RLock()
+	defer nm.RUnlock()
+
+	filter := &EndpointFilter{ContainerID: containerID}
+
+	var epInfos []*EndpointInfo
+	for _, extIf := range nm.ExternalInterfaces {
+		for _, nw := range extIf.Networks {
+			nw.lock.Lock()
+			for _, ep := range nw.Endpoints {
+				if filter.matches(ep) {
+					epInfo := ep.getInfo().copy()
+					epInfo.NetworkId = nw.Id
+					epInfos = append(epInfos, epInfo)
+				}
+			}
+			nw.lock.Unlock()
+		}
+	}
+
+	sort.Slice(epInfos, func(i, j int) bool {
+		if epInfos[i].Secondary != epInfos[j].Secondary {
+			return !epInfos[i].Secondary
+		}
+
+		if epInfos[i].NetworkId != epInfos[j].NetworkId {
+			return epInfos[i].NetworkId < epInfos[j].NetworkId
+		}
+
+		return epInfos[i].Id < epInfos[j].Id
+	})
+
+	return epInfos, nil
+}
+
+// GetOrphanInfos returns the networks and endpoints dropped from the persisted state because they were
+// invalid, oldest first. The returned information is a copy that callers are free to modify.
+func (nm *networkManager) GetOrphanInfos() ([]*OrphanInfo, error) {
+	nm.RLock()
+	defer nm.RUnlock()
+
+	var orphans []*OrphanInfo
+	for _, orphan := range nm.Orphans {
+		orphanCopy := *orphan
+		orphanCopy.Data = append(json.RawMessage(nil), orphan.Data...)
+		orphans = append(orphans, &orphanCopy)
+	}
+
+	return orphans, nil
+}
+
 // GetEndpointInfoBasedOnPODDetails returns information about the given endpoint.
 // It returns an error if a single pod has multiple endpoints.
 func (nm *networkManager) GetEndpointInfoBasedOnPODDetails(networkID string, podName string, podNameSpace string) (*EndpointInfo, error) {
-	nm.Lock()
-	defer nm.Unlock()
-
-	nw, err := nm.getNetwork(networkID)
+	nw, unlock, err := nm.lockNetwork(networkID)
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
 	ep, err := nw.getEndpointByPOD(podName, podNameSpace)
 	if err != nil {
@@ -365,13 +939,11 @@ func (nm *networkManager) GetEndpointInfoBasedOnPODDetails(networkID string, pod
 
 // AttachEndpoint attaches an endpoint to a sandbox.
 func (nm *networkManager) AttachEndpoint(networkId string, endpointId string, sandboxKey string) (*endpoint, error) {
-	nm.Lock()
-	defer nm.Unlock()
-
-	nw, err := nm.getNetwork(networkId)
+	nw, unlock, err := nm.lockNetwork(networkId)
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
 	ep, err := nw.getEndpoint(endpointId)
 	if err != nil {
@@ -383,23 +955,23 @@ func (nm *networkManager) AttachEndpoint(networkId string, endpointId string, sa
 		return nil, err
 	}
 
-	err = nm.save()
+	err = nm.saveNetwork(nw)
 	if err != nil {
 		return nil, err
 	}
 
+	nm.events.publish(EventEndpointAttached, networkId, endpointId)
+
 	return ep, nil
 }
 
 // DetachEndpoint detaches an endpoint from its sandbox.
 func (nm *networkManager) DetachEndpoint(networkId string, endpointId string) error {
-	nm.Lock()
-	defer nm.Unlock()
-
-	nw, err := nm.getNetwork(networkId)
+	nw, unlock, err := nm.lockNetwork(networkId)
 	if err != nil {
 		return err
 	}
+	defer unlock()
 
 	ep, err := nw.getEndpoint(endpointId)
 	if err != nil {
@@ -411,33 +983,115 @@ func (nm *networkManager) DetachEndpoint(networkId string, endpointId string) er
 		return err
 	}
 
-	err = nm.save()
+	err = nm.saveNetwork(nw)
 	if err != nil {
 		return err
 	}
 
+	nm.events.publish(EventEndpointDetached, networkId, endpointId)
+
 	return nil
 }
 
 // UpdateEndpoint updates an existing container endpoint.
 func (nm *networkManager) UpdateEndpoint(networkID string, existingEpInfo *EndpointInfo, targetEpInfo *EndpointInfo) error {
-	nm.Lock()
-	defer nm.Unlock()
-
-	nw, err := nm.getNetwork(networkID)
+	nw, unlock, err := nm.lockNetwork(networkID)
 	if err != nil {
 		return err
 	}
+	defer unlock()
 
 	_, err = nw.updateEndpoint(existingEpInfo, targetEpInfo)
 	if err != nil {
+		// Persist endpoints marked broken by a failed update, so that they can be cleaned up later.
+		if ep := nw.Endpoints[existingEpInfo.Id]; ep != nil && ep.Broken {
+			nm.saveNetwork(nw)
+		}
 		return err
 	}
 
-	err = nm.save()
+	err = nm.saveNetwork(nw)
 	if err != nil {
 		return err
 	}
 
+	nm.events.publish(EventEndpointUpdated, networkID, existingEpInfo.Id)
+
 	return nil
 }
+
+// AddRemoteEndpoint adds an endpoint on another node to an overlay network, so that traffic to its MAC
+// address is tunneled to the node. Adding a remote endpoint again updates its node.
+func (nm *networkManager) AddRemoteEndpoint(networkId string, remoteEpInfo *RemoteEndpointInfo) error {
+	nw, unlock, err := nm.lockNetwork(networkId)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	changed, err := nw.addRemoteEndpoint(remoteEpInfo)
+	if err != nil || !changed {
+		return err
+	}
+
+	return nm.saveNetwork(nw)
+}
+
+// DeleteRemoteEndpoint deletes an endpoint on another node from an overlay network.
+func (nm *networkManager) DeleteRemoteEndpoint(networkId string, macAddress net.HardwareAddr) error {
+	nw, unlock, err := nm.lockNetwork(networkId)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = nw.deleteRemoteEndpoint(macAddress)
+	if err != nil {
+		return err
+	}
+
+	return nm.saveNetwork(nw)
+}
+
+// RegisterListener registers a function that is called with the network and endpoint lifecycle events
+// after they are persisted. Listeners are called in order on a separate goroutine. Events are dropped
+// if listeners fall behind, so that they cannot block network operations.
+func (nm *networkManager) RegisterListener(listener func(Event)) {
+	nm.events.register(listener)
+}
+
+// ReconcileEndpoints removes platform endpoints that are no longer tracked in the persisted state.
+// In dry run mode, orphaned endpoints are only logged.
+func (nm *networkManager) ReconcileEndpoints(dryRun bool) error {
+	nm.Lock()
+	defer nm.Unlock()
+
+	return nm.reconcileEndpointsImpl(dryRun)
+}
+
+// GetEndpointStats returns the traffic counters of the endpoints in the given network.
+// Endpoints that no longer exist on the platform are left out.
+func (nm *networkManager) GetEndpointStats(networkId string) (map[string]*EndpointStats, error) {
+	nw, unlock, err := nm.lockNetwork(networkId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	stats := make(map[string]*EndpointStats)
+	for id, ep := range nw.Endpoints {
+		epStats, err := ep.GetStats()
+		if errors.Is(err, ErrEndpointNotFound) {
+			log.Printf("[net] Skipping stale endpoint %v.", id)
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		stats[id] = epStats
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,18 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"github.com/Azure/azure-container-networking/common"
+)
+
+var (
+	// Metrics of the network manager.
+	endpointCreateDuration = common.NewHistogram(
+		"network_endpoint_create_duration_seconds", "Duration of endpoint creations.", common.DefaultDurationBuckets)
+	endpointCreateFailures = common.NewCounter(
+		"network_endpoint_create_failures_total", "Number of endpoint creations that failed.")
+	hnsRetries = common.NewCounter(
+		"network_hns_retries_total", "Number of HNS operations retried after a transient error.")
+)
@@ -4,9 +4,17 @@
 package network
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"net"
+	"path"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/Azure/azure-container-networking/common"
 	"github.com/Azure/azure-container-networking/log"
 	"github.com/Azure/azure-container-networking/network/policy"
 	"github.com/Azure/azure-container-networking/platform"
@@ -14,22 +22,38 @@ import (
 
 const (
 	// Operational modes.
-	opModeBridge  = "bridge"
-	opModeTunnel  = "tunnel"
-	opModeDefault = opModeTunnel
+	opModeBridge      = "bridge"
+	opModeTunnel      = "tunnel"
+	opModeTransparent = "transparent"
+	opModeOverlay     = "overlay"
+	opModeIpvlan      = "ipvlan"
+	opModeMacvlan     = "macvlan"
+	opModeNone        = "none"
+	opModeDefault     = opModeTunnel
+
+	// Range of valid VLAN IDs.
+	minVlanID = 1
+	maxVlanID = 4094
+
+	// Maximum number of DNS search domains of an endpoint, the limit of resolv.conf on Linux.
+	// Windows endpoints are capped alike so that containers resolve names the same on both.
+	maxDNSSearchDomains = 6
 )
 
 // ExternalInterface is a host network interface that bridges containers to external networks.
+// SubnetIPs holds the address of the interface selected for each of its subnets.
 type externalInterface struct {
 	Name        string
 	Networks    map[string]*network
 	Subnets     []string
+	SubnetIPs   map[string]*net.IPNet `json:",omitempty"`
 	BridgeName  string
 	MacAddress  net.HardwareAddr
 	IPAddresses []*net.IPNet
 	Routes      []*route
 	IPv4Gateway net.IP
 	IPv6Gateway net.IP
+	undecodable []*OrphanInfo
 }
 
 // A container network is a set of endpoints allowed to communicate with each other.
@@ -43,19 +67,52 @@ type network struct {
 	extIf            *externalInterface
 	DNS              DNSInfo
 	EnableSnatOnHost bool
+	EnableHNSV2      bool                           `json:",omitempty"`
+	SearchDomains    []string                       `json:",omitempty"`
+	MTU              int                            `json:",omitempty"`
+	ParentIfName     string                         `json:",omitempty"`
+	IpvlanMode       string                         `json:",omitempty"`
+	Pruned           bool                           `json:",omitempty"`
+	MasterIfName     string                         `json:",omitempty"`
+	HNSTimeout       time.Duration                  `json:",omitempty"`
+	RetryPolicy      *RetryPolicy                   `json:",omitempty"`
+	BridgeName       string                         `json:",omitempty"`
+	VlanIfName       string                         `json:",omitempty"`
+	VxlanId          int                            `json:",omitempty"`
+	VxlanPort        int                            `json:",omitempty"`
+	RemoteEndpoints  map[string]*RemoteEndpointInfo `json:",omitempty"`
+	NetworkPolicies  []policy.NetworkScopedPolicy   `json:",omitempty"`
+	undecodable      []*OrphanInfo
+	encoded          json.RawMessage
+	lock             sync.Mutex
 }
 
 // NetworkInfo contains read-only information about a container network.
+// SearchDomains are the DNS search domains of the network, such as the suffix of its VNET.
+// They precede the search domains of each endpoint.
 type NetworkInfo struct {
-	MasterIfName     string
-	Id               string
-	Mode             string
-	Subnets          []SubnetInfo
-	DNS              DNSInfo
-	Policies         []policy.Policy
-	BridgeName       string
-	EnableSnatOnHost bool
-	Options          map[string]interface{}
+	MasterIfName        string
+	MasterIfMacAddress  net.HardwareAddr
+	MasterIfNamePattern string
+	Id                  string
+	Mode                string
+	Subnets             []SubnetInfo
+	DNS                 DNSInfo
+	SearchDomains       []string
+	Policies            []policy.Policy
+	NetworkPolicies     []policy.NetworkScopedPolicy
+	BridgeName          string
+	EnableSnatOnHost    bool
+	MTU                 int
+	HNSTimeout          time.Duration
+	VlanID              int
+	Options             map[string]interface{}
+	// EnableHNSV2 creates the endpoints of the network with the HCN (HNS V2) API on Windows, if HNS supports it.
+	EnableHNSV2 bool
+	// RetryPolicy is the retry policy of the endpoints of the network that do not set their own.
+	RetryPolicy *RetryPolicy
+	// AllowOverlappingSubnets skips the check that the subnets do not overlap those of other networks.
+	AllowOverlappingSubnets bool
 }
 
 // SubnetInfo contains subnet information for a container network.
@@ -67,36 +124,205 @@ type SubnetInfo struct {
 
 // DNSInfo contains DNS information for a container network or endpoint.
 type DNSInfo struct {
-	Suffix  string
-	Servers []string
+	Suffix   string
+	Suffixes []string `json:",omitempty"`
+	Servers  []string
 }
 
-// NewExternalInterface adds a host interface to the list of available external interfaces.
-func (nm *networkManager) newExternalInterface(ifName string, subnet string) error {
-	// Check whether the external interface is already configured.
-	if nm.ExternalInterfaces[ifName] != nil {
-		return nil
+// inherit returns the DNS settings with the fields that are not set taken from the given defaults.
+// The suffix and the list of suffixes are inherited together, so that a single suffix set on an
+// endpoint is not shadowed by the search list of its network.
+func (dns DNSInfo) inherit(defaults DNSInfo) DNSInfo {
+	if dns.Suffix == "" && len(dns.Suffixes) == 0 {
+		dns.Suffix = defaults.Suffix
+		dns.Suffixes = copyStrings(defaults.Suffixes)
+	}
+
+	if len(dns.Servers) == 0 {
+		dns.Servers = copyStrings(defaults.Servers)
 	}
 
-	// Find the host interface.
-	hostIf, err := net.InterfaceByName(ifName)
+	return dns
+}
+
+// GetSuffixes returns the DNS search suffixes, falling back to the single suffix for callers that only set it.
+func (dns *DNSInfo) GetSuffixes() []string {
+	if len(dns.Suffixes) > 0 {
+		return dns.Suffixes
+	}
+
+	if dns.Suffix != "" {
+		return []string{dns.Suffix}
+	}
+
+	return nil
+}
+
+// getSearchDomains returns the DNS search domains of an endpoint with the given DNS settings,
+// those of the network followed by those of the endpoint.
+func (nw *network) getSearchDomains(dns DNSInfo) []string {
+	return mergeSearchDomains(nw.SearchDomains, dns.GetSuffixes())
+}
+
+// mergeSearchDomains concatenates lists of DNS search domains in order. Domains are compared case
+// insensitively and, once listed, are not repeated. The result is capped at maxDNSSearchDomains.
+func mergeSearchDomains(lists ...[]string) []string {
+	var domains []string
+	seen := make(map[string]bool)
+
+	for _, list := range lists {
+		for _, domain := range list {
+			key := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+			if key == "" || seen[key] {
+				continue
+			}
+
+			if len(domains) == maxDNSSearchDomains {
+				log.Printf("[net] Dropping DNS search domain %v beyond the limit of %v.", domain, maxDNSSearchDomains)
+				continue
+			}
+
+			seen[key] = true
+			domains = append(domains, strings.TrimSpace(domain))
+		}
+	}
+
+	return domains
+}
+
+// NewExternalInterface adds a host interface to the list of available external interfaces.
+// The address of the interface in the given subnet is selected and persisted with the subnet.
+func (nm *networkManager) newExternalInterface(ifName string, subnet string) error {
+	_, prefix, err := net.ParseCIDR(subnet)
 	if err != nil {
 		return err
 	}
 
-	extIf := externalInterface{
-		Name:        ifName,
-		Networks:    make(map[string]*network),
-		MacAddress:  hostIf.HardwareAddr,
-		IPv4Gateway: net.IPv4zero,
-		IPv6Gateway: net.IPv6unspecified,
+	// Check whether the external interface is already configured for the subnet.
+	extIf := nm.ExternalInterfaces[ifName]
+	if extIf != nil {
+		for _, s := range extIf.Subnets {
+			if s == subnet {
+				return nil
+			}
+		}
+	}
+
+	// Find the host interface in the inventory, refreshing it if the address is missing since
+	// addresses can change after the inventory was refreshed.
+	var hostIf *common.InterfaceInfo
+	var candidates []*net.IPNet
+	var address *net.IPNet
+	for refreshed := false; ; refreshed = true {
+		hostIf, err = nm.getInterfaces().InterfaceByName(ifName)
+		if err != nil {
+			return err
+		}
+
+		candidates = append([]*net.IPNet{}, hostIf.Addresses...)
+
+		// The addresses of an interface connected to a bridge were moved to the bridge.
+		if extIf != nil {
+			candidates = append(candidates, extIf.IPAddresses...)
+		}
+
+		address = selectSubnetAddress(candidates, prefix)
+		if address != nil || refreshed {
+			break
+		}
+
+		if err = nm.getInterfaces().Refresh(); err != nil {
+			return err
+		}
+	}
+
+	if address == nil {
+		return fmt.Errorf("No address of interface %v is in subnet %v, candidates are [%v]", ifName, subnet, ipNetsToString(candidates))
+	}
+
+	if extIf == nil {
+		extIf = &externalInterface{
+			Name:        ifName,
+			Networks:    make(map[string]*network),
+			MacAddress:  hostIf.HardwareAddr,
+			IPv4Gateway: net.IPv4zero,
+			IPv6Gateway: net.IPv6unspecified,
+		}
+
+		nm.ExternalInterfaces[ifName] = extIf
+	}
+
+	if extIf.SubnetIPs == nil {
+		extIf.SubnetIPs = make(map[string]*net.IPNet)
 	}
 
 	extIf.Subnets = append(extIf.Subnets, subnet)
+	extIf.SubnetIPs[subnet] = address
+
+	log.Printf("[net] Added ExternalInterface %v for subnet %v with address %v.", ifName, subnet, address)
+
+	return nil
+}
+
+// getInterfaces returns the inventory of the host interfaces, creating one if the manager was not
+// given one. The caller holds the manager lock exclusively.
+func (nm *networkManager) getInterfaces() *common.InterfaceInventory {
+	if nm.interfaces == nil {
+		nm.interfaces = common.NewInterfaceInventory()
+	}
+
+	return nm.interfaces
+}
 
-	nm.ExternalInterfaces[ifName] = &extIf
+// selectSubnetAddress returns the address whose prefix equals the given subnet or, failing that, the
+// address with the longest prefix that contains the subnet. Ties go to the first address. Returns nil
+// if no address is in the subnet.
+func selectSubnetAddress(candidates []*net.IPNet, subnet *net.IPNet) *net.IPNet {
+	subnetOnes, subnetBits := subnet.Mask.Size()
+
+	var selected *net.IPNet
+	selectedOnes := -1
+	for _, candidate := range candidates {
+		ones, bits := candidate.Mask.Size()
+		if bits != subnetBits || ones > subnetOnes || !candidate.Contains(subnet.IP) {
+			continue
+		}
 
-	log.Printf("[net] Added ExternalInterface %v for subnet %v.", ifName, subnet)
+		if ones > selectedOnes {
+			selected = candidate
+			selectedOnes = ones
+		}
+	}
+
+	if selected == nil {
+		return nil
+	}
+
+	return &net.IPNet{IP: copyIP(selected.IP), Mask: append(net.IPMask(nil), selected.Mask...)}
+}
+
+// ipNetsToString returns a comma separated list of the given addresses.
+func ipNetsToString(ipNets []*net.IPNet) string {
+	var values []string
+	for _, ipNet := range ipNets {
+		values = append(values, ipNet.String())
+	}
+
+	return strings.Join(values, ", ")
+}
+
+// getPrimaryIPAddress returns the address selected for the first subnet of the external interface,
+// or the first address of the interface if none was selected.
+func (extIf *externalInterface) getPrimaryIPAddress() net.IP {
+	if len(extIf.Subnets) > 0 {
+		if address := extIf.SubnetIPs[extIf.Subnets[0]]; address != nil {
+			return address.IP
+		}
+	}
+
+	if len(extIf.IPAddresses) > 0 {
+		return extIf.IPAddresses[0].IP
+	}
 
 	return nil
 }
@@ -123,14 +349,77 @@ func (nm *networkManager) findExternalInterfaceBySubnet(subnet string) *external
 	return nil
 }
 
-// FindExternalInterfaceByName finds an external interface by name.
-func (nm *networkManager) findExternalInterfaceByName(ifName string) *externalInterface {
-	extIf, exists := nm.ExternalInterfaces[ifName]
-	if exists && extIf != nil {
-		return extIf
+// selectExternalInterface returns the external interface selected by the master interface name,
+// MAC address and name pattern of a network. All selectors that are set must match the same interface.
+// Without selectors, the interface connected to one of the network subnets is selected.
+func (nm *networkManager) selectExternalInterface(nwInfo *NetworkInfo) (*externalInterface, error) {
+	ifName := strings.TrimSpace(nwInfo.MasterIfName)
+	if ifName == "" && nwInfo.MasterIfMacAddress == nil && nwInfo.MasterIfNamePattern == "" {
+		for _, subnet := range nwInfo.Subnets {
+			if extIf := nm.findExternalInterfaceBySubnet(subnet.Prefix.String()); extIf != nil {
+				return extIf, nil
+			}
+		}
+
+		return nil, errSubnetNotFound
 	}
 
-	return nil
+	var selectors []string
+	if ifName != "" {
+		selectors = append(selectors, "name "+ifName)
+	}
+	if nwInfo.MasterIfMacAddress != nil {
+		selectors = append(selectors, "MAC address "+nwInfo.MasterIfMacAddress.String())
+	}
+	if nwInfo.MasterIfNamePattern != "" {
+		if _, err := path.Match(nwInfo.MasterIfNamePattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid external interface name pattern %v: %v", nwInfo.MasterIfNamePattern, err)
+		}
+		selectors = append(selectors, "name pattern "+nwInfo.MasterIfNamePattern)
+	}
+
+	var ifNames []string
+	for name, extIf := range nm.ExternalInterfaces {
+		if extIf != nil {
+			ifNames = append(ifNames, name)
+		}
+	}
+	sort.Strings(ifNames)
+
+	var selected *externalInterface
+	var candidates, matches []string
+	for _, name := range ifNames {
+		extIf := nm.ExternalInterfaces[name]
+		candidates = append(candidates, fmt.Sprintf("%v (%v)", extIf.Name, extIf.MacAddress))
+
+		if ifName != "" && extIf.Name != ifName {
+			continue
+		}
+
+		if nwInfo.MasterIfMacAddress != nil && !bytes.Equal(extIf.MacAddress, nwInfo.MasterIfMacAddress) {
+			continue
+		}
+
+		if nwInfo.MasterIfNamePattern != "" {
+			if matched, _ := path.Match(nwInfo.MasterIfNamePattern, extIf.Name); !matched {
+				continue
+			}
+		}
+
+		selected = extIf
+		matches = append(matches, extIf.Name)
+	}
+
+	selector := strings.Join(selectors, " and ")
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("No external interface matches %v, candidates are [%v]", selector, strings.Join(candidates, ", "))
+	case 1:
+		log.Printf("[net] Selected external interface %v by %v.", selected.Name, selector)
+		return selected, nil
+	default:
+		return nil, fmt.Errorf("Multiple external interfaces %v match %v, candidates are [%v]", matches, selector, strings.Join(candidates, ", "))
+	}
 }
 
 // NewNetwork creates a new container network.
@@ -150,39 +439,177 @@ func (nm *networkManager) newNetwork(nwInfo *NetworkInfo) (*network, error) {
 		nwInfo.Mode = opModeDefault
 	}
 
-	// If the master interface name is provided, find the external interface by name
-	// else use subnet to to find the interface
-	var extIf *externalInterface
-	if len(strings.TrimSpace(nwInfo.MasterIfName)) > 0 {
-		extIf = nm.findExternalInterfaceByName(nwInfo.MasterIfName)
-	} else {
-		extIf = nm.findExternalInterfaceBySubnet(nwInfo.Subnets[0].Prefix.String())
+	err = validateSubnets(nwInfo.Subnets)
+	if err != nil {
+		return nil, err
 	}
-	if extIf == nil {
-		err = errSubnetNotFound
+
+	err = validateNetworkPolicies(nwInfo.NetworkPolicies)
+	if err != nil {
+		return nil, err
+	}
+
+	// Networks in none mode do not program the dataplane, so there is nowhere to apply these.
+	if nwInfo.Mode == opModeNone {
+		if nwInfo.VlanID != 0 {
+			err = errNetworkVlanNotSupported
+			return nil, err
+		}
+
+		if len(nwInfo.NetworkPolicies) > 0 {
+			err = errNetworkPolicyNotSupported
+			return nil, err
+		}
+	}
+
+	if nwInfo.VlanID != 0 && (nwInfo.VlanID < minVlanID || nwInfo.VlanID > maxVlanID) {
+		log.Printf("[net] Invalid VLAN ID %v, must be between %v and %v.", nwInfo.VlanID, minVlanID, maxVlanID)
+		err = errInvalidVlanID
+		return nil, err
+	}
+
+	extIf, err := nm.selectExternalInterface(nwInfo)
+	if err != nil {
 		return nil, err
 	}
 
 	// Make sure this network does not already exist.
 	if extIf.Networks[nwInfo.Id] != nil {
-		err = errNetworkExists
+		err = ErrNetworkExists
 		return nil, err
 	}
 
+	// Traffic of networks sharing a VLAN on the same interface cannot be told apart.
+	if nwInfo.VlanID != 0 {
+		for _, existing := range extIf.Networks {
+			if existing.VlanId == nwInfo.VlanID {
+				log.Printf("[net] VLAN %v is already used by network %v on interface %v.", nwInfo.VlanID, existing.Id, extIf.Name)
+				err = errVlanInUse
+				return nil, err
+			}
+		}
+	}
+
+	// Overlapping subnets make traffic to the other network ambiguous, unless the caller intends it.
+	if !nwInfo.AllowOverlappingSubnets {
+		err = nm.checkSubnetsInUse(nwInfo.Id, nwInfo.Mode, extIf, nwInfo.Subnets)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Call the OS-specific implementation.
 	nw, err = nm.newNetworkImpl(nwInfo, extIf)
 	if err != nil {
 		return nil, err
 	}
 
-	// Add the network object.
+	// Add the network object. The selected interface is recorded so that the network
+	// keeps using it regardless of its selectors.
 	nw.Subnets = nwInfo.Subnets
+	nw.NetworkPolicies = nwInfo.NetworkPolicies
+	nw.SearchDomains = copyStrings(nwInfo.SearchDomains)
+	nw.MasterIfName = extIf.Name
 	extIf.Networks[nwInfo.Id] = nw
 
 	log.Printf("[net] Created network %v on interface %v.", nwInfo.Id, extIf.Name)
 	return nw, nil
 }
 
+// UpdateNetwork adds the subnets of the given network information that the network does not have yet
+// and returns them. Subnets cannot be removed and the mode and master interface cannot be changed.
+func (nm *networkManager) updateNetwork(nwInfo *NetworkInfo) ([]SubnetInfo, error) {
+	var err error
+
+	log.Printf("[net] Updating network %+v.", nwInfo)
+	defer func() {
+		if err != nil {
+			log.Printf("[net] Failed to update network %v, err:%v.", nwInfo.Id, err)
+		}
+	}()
+
+	nw, err := nm.getNetwork(nwInfo.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if nw.Pruned {
+		err = errNetworkPruned
+		return nil, err
+	}
+
+	if nwInfo.Mode != "" && nwInfo.Mode != nw.Mode {
+		err = fmt.Errorf("Mode of network %v cannot be changed from %v to %v", nw.Id, nw.Mode, nwInfo.Mode)
+		return nil, err
+	}
+
+	masterIfName := nw.MasterIfName
+	if masterIfName == "" {
+		masterIfName = nw.extIf.Name
+	}
+
+	if nwInfo.MasterIfName != "" && nwInfo.MasterIfName != masterIfName {
+		err = fmt.Errorf("Master interface of network %v cannot be changed from %v to %v", nw.Id, masterIfName, nwInfo.MasterIfName)
+		return nil, err
+	}
+
+	requested := make(map[string]SubnetInfo)
+	for _, subnet := range nwInfo.Subnets {
+		requested[subnet.Prefix.String()] = subnet
+	}
+
+	for _, subnet := range nw.Subnets {
+		prefix := subnet.Prefix.String()
+		update, ok := requested[prefix]
+		if !ok {
+			err = fmt.Errorf("Subnet %v cannot be removed from network %v", prefix, nw.Id)
+			return nil, err
+		}
+
+		if !update.Gateway.Equal(subnet.Gateway) {
+			err = fmt.Errorf("Gateway of subnet %v of network %v cannot be changed from %v to %v", prefix, nw.Id, subnet.Gateway, update.Gateway)
+			return nil, err
+		}
+
+		delete(requested, prefix)
+	}
+
+	var added []SubnetInfo
+	for _, subnet := range nwInfo.Subnets {
+		if _, ok := requested[subnet.Prefix.String()]; ok {
+			added = append(added, subnet)
+			delete(requested, subnet.Prefix.String())
+		}
+	}
+
+	if len(added) == 0 {
+		return nil, nil
+	}
+
+	err = validateSubnets(append(append([]SubnetInfo(nil), nw.Subnets...), added...))
+	if err != nil {
+		return nil, err
+	}
+
+	if !nwInfo.AllowOverlappingSubnets {
+		err = nm.checkSubnetsInUse(nw.Id, nw.Mode, nw.extIf, added)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Call the OS-specific implementation.
+	err = nm.updateNetworkImpl(nw, added)
+	if err != nil {
+		return nil, err
+	}
+
+	nw.Subnets = append(nw.Subnets, added...)
+
+	log.Printf("[net] Added %v subnets to network %v.", len(added), nw.Id)
+	return added, nil
+}
+
 // DeleteNetwork deletes an existing container network.
 func (nm *networkManager) deleteNetwork(networkId string) error {
 	var err error
@@ -222,5 +649,314 @@ func (nm *networkManager) getNetwork(networkId string) (*network, error) {
 		}
 	}
 
-	return nil, errNetworkNotFound
+	return nil, ErrNetworkNotFound
+}
+
+// checkPortMappings makes sure that the host ports requested by the endpoint are not already
+// published by another endpoint on this host. NAT policies apply to all host addresses,
+// so host ports are compared regardless of the host IP. The caller holds the port lock and no network
+// lock, since each network is locked in turn while its endpoints are checked.
+func (nm *networkManager) checkPortMappings(epInfo *EndpointInfo) error {
+	type hostPort struct {
+		protocol string
+		port     int
+	}
+
+	owners := make(map[hostPort]string)
+	for _, extIf := range nm.ExternalInterfaces {
+		for _, nw := range extIf.Networks {
+			nw.lock.Lock()
+			for _, ep := range nw.Endpoints {
+				for _, mapping := range ep.PortMappings {
+					owners[hostPort{strings.ToLower(mapping.Protocol), mapping.HostPort}] = ep.Id
+				}
+			}
+			nw.lock.Unlock()
+		}
+	}
+
+	for _, mapping := range epInfo.PortMappings {
+		key := hostPort{strings.ToLower(mapping.Protocol), mapping.HostPort}
+		if owner, ok := owners[key]; ok {
+			return fmt.Errorf("Host port %v/%v requested by endpoint %v is already published by endpoint %v",
+				mapping.HostPort, mapping.Protocol, epInfo.Id, owner)
+		}
+		owners[key] = epInfo.Id
+	}
+
+	return nil
+}
+
+// getInfo returns information about the network. The returned information shares no memory with the network.
+func (nw *network) getInfo() *NetworkInfo {
+	nwInfo := &NetworkInfo{
+		Id:           nw.Id,
+		Mode:         nw.Mode,
+		MasterIfName: nw.MasterIfName,
+		DNS: DNSInfo{
+			Suffix:   nw.DNS.Suffix,
+			Suffixes: copyStrings(nw.DNS.Suffixes),
+			Servers:  copyStrings(nw.DNS.Servers),
+		},
+		SearchDomains: copyStrings(nw.SearchDomains),
+		Options:       make(map[string]interface{}),
+	}
+
+	for _, subnet := range nw.Subnets {
+		nwInfo.Subnets = append(nwInfo.Subnets, SubnetInfo{
+			Family:  subnet.Family,
+			Prefix:  copyIPNet(subnet.Prefix),
+			Gateway: copyIP(subnet.Gateway),
+		})
+	}
+
+	for _, networkPolicy := range nw.NetworkPolicies {
+		nwInfo.NetworkPolicies = append(nwInfo.NetworkPolicies, policy.NetworkScopedPolicy{
+			Type:     networkPolicy.Type,
+			Settings: append(json.RawMessage(nil), networkPolicy.Settings...),
+		})
+	}
+
+	getNetworkInfoImpl(nwInfo, nw)
+
+	// Overlay and VLAN networks have a bridge of their own.
+	if nw.BridgeName != "" {
+		nwInfo.BridgeName = nw.BridgeName
+	} else if nw.extIf != nil {
+		nwInfo.BridgeName = nw.extIf.BridgeName
+	}
+
+	return nwInfo
+}
+
+// copyIP returns a copy of an IP address.
+func copyIP(ip net.IP) net.IP {
+	if ip == nil {
+		return nil
+	}
+
+	return append(net.IP{}, ip...)
+}
+
+// copyIPNet returns a copy of an IP network.
+func copyIPNet(ipNet net.IPNet) net.IPNet {
+	ipNet.IP = copyIP(ipNet.IP)
+	if ipNet.Mask != nil {
+		ipNet.Mask = append(net.IPMask{}, ipNet.Mask...)
+	}
+
+	return ipNet
+}
+
+// copyStrings returns a copy of a string slice.
+func copyStrings(values []string) []string {
+	if values == nil {
+		return nil
+	}
+
+	return append([]string{}, values...)
+}
+
+// validateNetworkPolicies checks that the network policies are valid and supported on this platform.
+func validateNetworkPolicies(policies []policy.NetworkScopedPolicy) error {
+	for _, networkPolicy := range policies {
+		if err := networkPolicy.Validate(); err != nil {
+			return err
+		}
+
+		if !isNetworkPolicySupported(&networkPolicy) {
+			return fmt.Errorf("%v network policy is not supported on this platform", networkPolicy.Type)
+		}
+	}
+
+	return nil
+}
+
+// prefixesOverlap returns whether two prefixes have addresses in common, which is the case when one
+// contains the other.
+func prefixesOverlap(a net.IPNet, b net.IPNet) bool {
+	return a.Contains(b.IP.Mask(b.Mask)) || b.Contains(a.IP.Mask(a.Mask))
+}
+
+// checkSubnetsInUse returns an error naming the conflicting network if one of the given subnets of a
+// network overlaps a subnet of another network on the node. The subnets of overlay networks are routed
+// by the host, so they must not overlap the prefixes of the external interface either.
+func (nm *networkManager) checkSubnetsInUse(networkId string, mode string, extIf *externalInterface, subnets []SubnetInfo) error {
+	for _, subnet := range subnets {
+		for _, otherIf := range nm.ExternalInterfaces {
+			for _, other := range otherIf.Networks {
+				if other.Id == networkId {
+					continue
+				}
+
+				for _, otherSubnet := range other.Subnets {
+					if prefixesOverlap(subnet.Prefix, otherSubnet.Prefix) {
+						log.Printf("[net] Subnet %v overlaps subnet %v of network %v.", subnet.Prefix.String(), otherSubnet.Prefix.String(), other.Id)
+						return fmt.Errorf("Subnet %v overlaps subnet %v of network %v: %w", subnet.Prefix.String(), otherSubnet.Prefix.String(), other.Id, ErrSubnetInUse)
+					}
+				}
+			}
+		}
+
+		if mode != opModeOverlay {
+			continue
+		}
+
+		var hostPrefixes []*net.IPNet
+		for _, address := range extIf.SubnetIPs {
+			hostPrefixes = append(hostPrefixes, address)
+		}
+		hostPrefixes = append(hostPrefixes, extIf.IPAddresses...)
+
+		for _, hostPrefix := range hostPrefixes {
+			if prefixesOverlap(subnet.Prefix, *hostPrefix) {
+				log.Printf("[net] Subnet %v overlaps prefix %v of interface %v.", subnet.Prefix.String(), hostPrefix, extIf.Name)
+				return fmt.Errorf("Subnet %v overlaps prefix %v of interface %v: %w", subnet.Prefix.String(), hostPrefix, extIf.Name, ErrSubnetInUse)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateSubnets checks that every subnet of a network has a gateway and that no two subnets overlap.
+func validateSubnets(subnets []SubnetInfo) error {
+	for i, subnet := range subnets {
+		if subnet.Gateway == nil || subnet.Gateway.IsUnspecified() {
+			log.Printf("[net] Subnet %v has no gateway.", subnet.Prefix.String())
+			return errSubnetGatewayMissing
+		}
+
+		for _, other := range subnets[:i] {
+			if prefixesOverlap(subnet.Prefix, other.Prefix) {
+				log.Printf("[net] Subnet %v overlaps subnet %v.", subnet.Prefix.String(), other.Prefix.String())
+				return errSubnetsOverlap
+			}
+		}
+	}
+
+	return nil
+}
+
+// getSubnetForAddress returns the network subnet containing the given IP address, or nil if there is none.
+func (nw *network) getSubnetForAddress(ip net.IP) *SubnetInfo {
+	for i := range nw.Subnets {
+		if nw.Subnets[i].Prefix.Contains(ip) {
+			return &nw.Subnets[i]
+		}
+	}
+
+	return nil
+}
+
+// getSubnetAddresses returns the given addresses with the prefix length of the network subnet
+// each was allocated from. Addresses outside the network subnets are returned unchanged.
+func (nw *network) getSubnetAddresses(ipAddresses []net.IPNet) []net.IPNet {
+	var addresses []net.IPNet
+
+	for _, ipAddr := range ipAddresses {
+		if subnet := nw.getSubnetForAddress(ipAddr.IP); subnet != nil {
+			ipAddr.Mask = subnet.Prefix.Mask
+		}
+
+		addresses = append(addresses, ipAddr)
+	}
+
+	return addresses
+}
+
+// getSubnetGateway returns the gateway of the network subnet containing the first of the given
+// addresses of the given family, or nil if there is none.
+func (nw *network) getSubnetGateway(ipAddresses []net.IPNet, family platform.AddressFamily) net.IP {
+	for _, ipAddr := range ipAddresses {
+		if (ipAddr.IP.To4() != nil) != (family == platform.AfINET) {
+			continue
+		}
+
+		if subnet := nw.getSubnetForAddress(ipAddr.IP); subnet != nil {
+			return subnet.Gateway
+		}
+	}
+
+	return nil
+}
+
+// UnmarshalJSON decodes a persisted external interface. Networks that cannot be decoded, for example
+// because they were persisted by an incompatible version, are set aside instead of failing the restore.
+func (extIf *externalInterface) UnmarshalJSON(data []byte) error {
+	type persistedInterface externalInterface
+	aux := struct {
+		*persistedInterface
+		Networks map[string]json.RawMessage
+	}{persistedInterface: (*persistedInterface)(extIf)}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	extIf.Networks = make(map[string]*network)
+	for networkId, raw := range aux.Networks {
+		nw := &network{}
+		err := json.Unmarshal(raw, nw)
+		if err == nil && nw.Id == "" {
+			err = fmt.Errorf("Network has no ID")
+		}
+
+		if err != nil {
+			extIf.undecodable = append(extIf.undecodable, &OrphanInfo{NetworkId: networkId, Reason: err.Error(), Data: raw})
+			continue
+		}
+
+		extIf.Networks[networkId] = nw
+	}
+
+	return nil
+}
+
+// MarshalJSON returns the encoding of the network cached by its last save, so that saving one network
+// does not encode the others while their endpoints are being changed.
+func (nw *network) MarshalJSON() ([]byte, error) {
+	if nw.encoded != nil {
+		return nw.encoded, nil
+	}
+
+	return nw.encode()
+}
+
+// encode returns the current encoding of the network.
+func (nw *network) encode() ([]byte, error) {
+	type persistedNetwork network
+	return json.Marshal((*persistedNetwork)(nw))
+}
+
+// UnmarshalJSON decodes a persisted network. Endpoints that cannot be decoded are set aside
+// instead of failing the restore.
+func (nw *network) UnmarshalJSON(data []byte) error {
+	type persistedNetwork network
+	aux := struct {
+		*persistedNetwork
+		Endpoints map[string]json.RawMessage
+	}{persistedNetwork: (*persistedNetwork)(nw)}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	nw.Endpoints = make(map[string]*endpoint)
+	for endpointId, raw := range aux.Endpoints {
+		ep := &endpoint{}
+		err := json.Unmarshal(raw, ep)
+		if err == nil && ep.Id == "" {
+			err = fmt.Errorf("Endpoint has no ID")
+		}
+
+		if err != nil {
+			nw.undecodable = append(nw.undecodable, &OrphanInfo{NetworkId: nw.Id, EndpointId: endpointId, Reason: err.Error(), Data: raw})
+			continue
+		}
+
+		nw.Endpoints[endpointId] = ep
+	}
+
+	return nil
 }
@@ -28,6 +28,19 @@ const (
 	InfraVnetIPKey = "infraVnetIP"
 
 	OptVethName = "vethname"
+
+	// Supported ipvlan modes.
+	ipvlanModeL2 = "l2"
+	ipvlanModeL3 = "l3"
+
+	// Prefix for host-side ipvlan interface names used by L3 mode networks.
+	hostIpvlanInterfacePrefix = "azipvl"
+
+	// Route tables for source-based routing are numbered from this base plus the bridge index.
+	sourceRoutingTableBase = 1000
+
+	// Priority of the source-based routing rules, ahead of the main table rule.
+	sourceRoutingRulePriority = 3000
 )
 
 // Linux implementation of route.
@@ -37,22 +50,111 @@ type route netlink.Route
 func (nm *networkManager) newNetworkImpl(nwInfo *NetworkInfo, extIf *externalInterface) (*network, error) {
 	// Connect the external interface.
 	var vlanid int
+	var ipvlanMode string
+	var bridgeName, vlanIfName string
+	var vxlanId, vxlanPort int
 	opt, _ := nwInfo.Options[genericData].(map[string]interface{})
 	log.Printf("opt %+v options %+v", opt, nwInfo.Options)
 
+	if nwInfo.Mode == opModeNone {
+		return newNoneNetwork(nwInfo, extIf), nil
+	}
+
+	if nwInfo.VlanID != 0 && nwInfo.Mode != opModeBridge {
+		return nil, errNetworkVlanNotSupported
+	}
+
+	// Install the network policy rules, and delete them if the network cannot be created.
+	if err := addNetworkPolicyRules(nwInfo.NetworkPolicies); err != nil {
+		return nil, err
+	}
+
+	created := false
+	defer func() {
+		if !created {
+			deleteNetworkPolicyRules(nwInfo.NetworkPolicies)
+		}
+	}()
+
 	switch nwInfo.Mode {
 	case opModeTunnel:
 		fallthrough
 	case opModeBridge:
+		if nwInfo.VlanID != 0 {
+			log.Printf("create vlan bridge")
+			vlanid = nwInfo.VlanID
+
+			var err error
+			if vlanIfName, bridgeName, err = getVlanInterfaceNames(extIf.Name, vlanid); err != nil {
+				return nil, err
+			}
+
+			if nwInfo.BridgeName != "" {
+				bridgeName = nwInfo.BridgeName
+			}
+
+			if err = createVlanBridge(extIf.Name, vlanIfName, bridgeName, vlanid, nwInfo.MTU); err != nil {
+				return nil, err
+			}
+
+			break
+		}
+
 		log.Printf("create bridge")
 		if err := nm.connectExternalInterface(extIf, nwInfo); err != nil {
 			return nil, err
 		}
 
+		if err := setBridgeSubnetGateways(extIf, getSecondarySubnets(extIf, nwInfo.Subnets), true); err != nil {
+			setBridgeSubnetGateways(extIf, getSecondarySubnets(extIf, nwInfo.Subnets), false)
+			return nil, err
+		}
+
+		if err := setSourceRouting(extIf, nwInfo.Subnets, nwInfo.Subnets, true); err != nil {
+			setSourceRouting(extIf, nwInfo.Subnets, nwInfo.Subnets, false)
+			setBridgeSubnetGateways(extIf, getSecondarySubnets(extIf, nwInfo.Subnets), false)
+			return nil, err
+		}
+
 		if opt != nil && opt[VlanIDKey] != nil {
 			vlanid, _ = strconv.Atoi(opt[VlanIDKey].(string))
 		}
 
+	case opModeIpvlan:
+		log.Printf("create ipvlan")
+		if opt != nil && opt[IpvlanModeKey] != nil {
+			ipvlanMode, _ = opt[IpvlanModeKey].(string)
+		}
+
+		if ipvlanMode == "" {
+			ipvlanMode = ipvlanModeL2
+		}
+
+		if ipvlanMode != ipvlanModeL2 && ipvlanMode != ipvlanModeL3 {
+			return nil, errIpvlanModeInvalid
+		}
+
+		if ipvlanMode == ipvlanModeL3 {
+			if err := createHostIpvlanInterface(extIf.Name); err != nil {
+				return nil, err
+			}
+		}
+
+	case opModeMacvlan:
+		// Macvlan sub-interfaces attach directly to the external interface, no bridge is needed.
+		log.Printf("create macvlan")
+
+	case opModeOverlay:
+		log.Printf("create overlay")
+		var err error
+		if vxlanId, vxlanPort, err = getVxlanOptions(opt); err != nil {
+			return nil, err
+		}
+
+		if bridgeName, err = createOverlay(extIf, nwInfo, vxlanId, vxlanPort); err != nil {
+			return nil, err
+		}
+
 	default:
 		return nil, errNetworkModeInvalid
 	}
@@ -66,21 +168,98 @@ func (nm *networkManager) newNetworkImpl(nwInfo *NetworkInfo, extIf *externalInt
 		VlanId:           vlanid,
 		DNS:              nwInfo.DNS,
 		EnableSnatOnHost: nwInfo.EnableSnatOnHost,
+		MTU:              nwInfo.MTU,
+		IpvlanMode:       ipvlanMode,
+		BridgeName:       bridgeName,
+		VlanIfName:       vlanIfName,
+		VxlanId:          vxlanId,
+		VxlanPort:        vxlanPort,
 	}
 
+	if nwInfo.Mode == opModeIpvlan || nwInfo.Mode == opModeMacvlan {
+		nw.ParentIfName = extIf.Name
+	}
+
+	created = true
+
 	return nw, nil
 }
 
+// updateNetworkImpl adds subnets to an existing container network. Bridge networks serve the gateways
+// of the new subnets on the bridge and route their traffic like the subnets they were created with.
+func (nm *networkManager) updateNetworkImpl(nw *network, subnets []SubnetInfo) error {
+	if nw.Mode == opModeOverlay {
+		if err := setSubnetGateways(nw.BridgeName, subnets, true); err != nil {
+			setSubnetGateways(nw.BridgeName, subnets, false)
+			return err
+		}
+
+		return nil
+	}
+
+	// VLAN networks are routed by the network of the VLAN, not the host.
+	if (nw.Mode != opModeBridge && nw.Mode != opModeTunnel) || nw.VlanIfName != "" {
+		return nil
+	}
+
+	secondarySubnets := getSecondarySubnets(nw.extIf, subnets)
+	if err := setBridgeSubnetGateways(nw.extIf, secondarySubnets, true); err != nil {
+		setBridgeSubnetGateways(nw.extIf, secondarySubnets, false)
+		return err
+	}
+
+	allSubnets := append(append([]SubnetInfo(nil), nw.Subnets...), subnets...)
+	if err := setSourceRouting(nw.extIf, allSubnets, subnets, true); err != nil {
+		setSourceRouting(nw.extIf, allSubnets, subnets, false)
+		setBridgeSubnetGateways(nw.extIf, secondarySubnets, false)
+		return err
+	}
+
+	return nil
+}
+
 // DeleteNetworkImpl deletes an existing container network.
 func (nm *networkManager) deleteNetworkImpl(nw *network) error {
 	var networkClient NetworkClient
 
+	if nw.Mode == opModeNone {
+		return nil
+	}
+
+	deleteNetworkPolicyRules(nw.NetworkPolicies)
+
+	if nw.Mode == opModeIpvlan {
+		// Delete the host-side ipvlan interface if this was the last network using it.
+		if nw.IpvlanMode == ipvlanModeL3 && len(nw.extIf.Networks) == 1 {
+			deleteHostIpvlanInterface(nw.ParentIfName)
+		}
+
+		return nil
+	}
+
+	if nw.Mode == opModeMacvlan {
+		return nil
+	}
+
+	if nw.Mode == opModeOverlay {
+		deleteOverlayInterfaces(nw.BridgeName, getVxlanInterfaceName(nw.VxlanId))
+		return nil
+	}
+
+	if nw.VlanIfName != "" {
+		nw.deleteVlanBridges()
+		return nil
+	}
+
 	if nw.VlanId != 0 {
 		networkClient = NewOVSClient(nw.extIf.BridgeName, nw.extIf.Name, "", nw.DNS.Servers, nw.EnableSnatOnHost)
 	} else {
 		networkClient = NewLinuxBridgeClient(nw.extIf.BridgeName, nw.extIf.Name, nw.Mode)
 	}
 
+	setSourceRouting(nw.extIf, nw.Subnets, nw.Subnets, false)
+	setBridgeSubnetGateways(nw.extIf, getSecondarySubnets(nw.extIf, nw.Subnets), false)
+
 	// Disconnect the interface if this was the last network using it.
 	if len(nw.extIf.Networks) == 1 {
 		nm.disconnectExternalInterface(nw.extIf, networkClient)
@@ -167,6 +346,154 @@ func (nm *networkManager) applyIPConfig(extIf *externalInterface, targetIf *net.
 	return nil
 }
 
+// getSecondarySubnets returns the subnets in which the host has neither an address nor its default gateway.
+// These are routed to the host, so the bridge acts as their gateway.
+func getSecondarySubnets(extIf *externalInterface, subnets []SubnetInfo) []SubnetInfo {
+	var secondarySubnets []SubnetInfo
+
+	for _, subnet := range subnets {
+		isPrimary := subnet.Gateway.Equal(extIf.IPv4Gateway) || subnet.Gateway.Equal(extIf.IPv6Gateway)
+		for _, addr := range extIf.IPAddresses {
+			if subnet.Prefix.Contains(addr.IP) {
+				isPrimary = true
+			}
+		}
+
+		if !isPrimary {
+			secondarySubnets = append(secondarySubnets, subnet)
+		}
+	}
+
+	return secondarySubnets
+}
+
+// setBridgeSubnetGateways adds or deletes the gateway addresses of the given subnets on the bridge.
+func setBridgeSubnetGateways(extIf *externalInterface, subnets []SubnetInfo, add bool) error {
+	if extIf.BridgeName == "" {
+		return nil
+	}
+
+	return setSubnetGateways(extIf.BridgeName, subnets, add)
+}
+
+// setSubnetGateways adds or deletes the gateway addresses of the given subnets on an interface.
+func setSubnetGateways(ifName string, subnets []SubnetInfo, add bool) error {
+	for _, subnet := range subnets {
+		addr := &net.IPNet{IP: subnet.Gateway, Mask: subnet.Prefix.Mask}
+
+		if add {
+			log.Printf("[net] Adding IP address %v to interface %v.", addr, ifName)
+			err := netlink.AddIpAddress(ifName, addr.IP, addr)
+			if err != nil && !strings.Contains(strings.ToLower(err.Error()), "file exists") {
+				log.Printf("[net] Failed to add IP address %v: %v.", addr, err)
+				return err
+			}
+		} else {
+			log.Printf("[net] Deleting IP address %v from interface %v.", addr, ifName)
+			if err := netlink.DeleteIpAddress(ifName, addr.IP, addr); err != nil {
+				log.Printf("[net] Failed to delete IP address %v: %v.", addr, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// getInterfaceGateway returns the gateway of the first subnet of the given family that contains
+// an address of the external interface, or nil if there is none.
+func getInterfaceGateway(extIf *externalInterface, subnets []SubnetInfo, family int) net.IP {
+	for _, subnet := range subnets {
+		if subnet.Gateway == nil || netlink.GetIpAddressFamily(subnet.Gateway) != family {
+			continue
+		}
+
+		for _, addr := range extIf.IPAddresses {
+			if subnet.Prefix.Contains(addr.IP) {
+				return subnet.Gateway
+			}
+		}
+	}
+
+	return nil
+}
+
+// setSourceRouting adds or deletes source-based routing for the given routed subnets of a network on an
+// external interface without a default route, such as a secondary NIC. Traffic from these subnets that
+// the host routes, other than to destinations in the main table, then egresses the external interface
+// through its own gateway instead of following the default route of another interface. The gateway is
+// found among all subnets of the network.
+func setSourceRouting(extIf *externalInterface, subnets []SubnetInfo, routed []SubnetInfo, add bool) error {
+	if extIf.BridgeName == "" {
+		return nil
+	}
+
+	bridge, err := net.InterfaceByName(extIf.BridgeName)
+	if err != nil {
+		return err
+	}
+
+	table := sourceRoutingTableBase + bridge.Index
+
+	for _, family := range []int{unix.AF_INET, unix.AF_INET6} {
+		hostGateway := extIf.IPv4Gateway
+		if family == unix.AF_INET6 {
+			hostGateway = extIf.IPv6Gateway
+		}
+
+		// Interfaces with a default route are routed by the main table.
+		gateway := getInterfaceGateway(extIf, subnets, family)
+		if hostGateway != nil || gateway == nil {
+			continue
+		}
+
+		defaultRoute := &netlink.Route{Family: family, Gw: gateway, LinkIndex: bridge.Index, Table: table}
+		if add {
+			log.Printf("[net] Adding default route via %v to table %v.", gateway, table)
+			err := netlink.AddIpRoute(defaultRoute)
+			if err != nil && !strings.Contains(strings.ToLower(err.Error()), "file exists") {
+				return err
+			}
+		}
+
+		for _, subnet := range routed {
+			if netlink.GetIpAddressFamily(subnet.Prefix.IP) != family {
+				continue
+			}
+
+			prefix := subnet.Prefix
+			rules := []*netlink.Rule{
+				{Family: family, Src: &prefix, Table: unix.RT_TABLE_MAIN, Priority: sourceRoutingRulePriority, SuppressDefaultRoute: true},
+				{Family: family, Src: &prefix, Table: table, Priority: sourceRoutingRulePriority + 1},
+			}
+
+			for _, rule := range rules {
+				if add {
+					log.Printf("[net] Adding rule from %v to table %v.", rule.Src, rule.Table)
+					err := netlink.AddIpRule(rule)
+					if err != nil && !strings.Contains(strings.ToLower(err.Error()), "file exists") {
+						return err
+					}
+				} else {
+					log.Printf("[net] Deleting rule from %v to table %v.", rule.Src, rule.Table)
+					if err := netlink.DeleteIpRule(rule); err != nil {
+						log.Printf("[net] Failed to delete rule from %v: %v.", rule.Src, err)
+					}
+				}
+			}
+		}
+
+		// The default route is shared by all subnets of the networks on the interface.
+		if !add && len(routed) == len(subnets) && len(extIf.Networks) <= 1 {
+			log.Printf("[net] Deleting default route via %v from table %v.", gateway, table)
+			if err := netlink.DeleteIpRoute(defaultRoute); err != nil {
+				log.Printf("[net] Failed to delete default route from table %v: %v.", table, err)
+			}
+		}
+	}
+
+	return nil
+}
+
 // ConnectExternalInterface connects the given host interface to a bridge.
 func (nm *networkManager) connectExternalInterface(extIf *externalInterface, nwInfo *NetworkInfo) error {
 	var err error
@@ -249,6 +576,14 @@ func (nm *networkManager) connectExternalInterface(extIf *externalInterface, nwI
 		return err
 	}
 
+	// Set the network MTU on the bridge. Otherwise the bridge follows the MTU of its ports.
+	if nwInfo.MTU > 0 {
+		log.Printf("[net] Setting MTU of link %v to %v.", bridgeName, nwInfo.MTU)
+		if err = netlink.SetLinkMTU(bridgeName, nwInfo.MTU); err != nil {
+			return err
+		}
+	}
+
 	// External interface up.
 	log.Printf("[net] Setting link %v state up.", hostIf.Name)
 	err = netlink.SetLinkState(hostIf.Name, true)
@@ -317,12 +652,231 @@ func (nm *networkManager) disconnectExternalInterface(extIf *externalInterface,
 	log.Printf("[net] Disconnected interface %v.", extIf.Name)
 }
 
+// reconcileEndpointsImpl deletes host veth interfaces created by this plugin that are not
+// owned by any endpoint in the persisted state and whose peer is gone.
+func (nm *networkManager) reconcileEndpointsImpl(dryRun bool) error {
+	orphans, err := nm.findOrphanedResourcesImpl()
+	if err != nil {
+		log.Printf("[net] Failed to list interfaces, err:%v.", err)
+		return err
+	}
+
+	for ifName, reason := range orphans {
+		if dryRun {
+			log.Printf("[net] Found orphaned veth %v: %v.", ifName, reason)
+			continue
+		}
+
+		log.Printf("[net] Deleting orphaned veth %v: %v.", ifName, reason)
+		if err := netlink.DeleteLink(ifName); err != nil {
+			log.Printf("[net] Failed to delete orphaned veth %v: %v.", ifName, err)
+		}
+	}
+
+	return nil
+}
+
+// findOrphanedResourcesImpl returns the host veth interfaces created by this plugin that are not
+// owned by any endpoint in the persisted state and whose peer is gone, with the reason for each.
+// The caller holds the manager lock.
+func (nm *networkManager) findOrphanedResourcesImpl() (map[string]string, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	ownedInterfaces := make(map[string]bool)
+	for _, extIf := range nm.ExternalInterfaces {
+		for _, nw := range extIf.Networks {
+			nw.lock.Lock()
+			for _, ep := range nw.Endpoints {
+				ownedInterfaces[ep.HostIfName] = true
+			}
+			nw.lock.Unlock()
+		}
+	}
+
+	return findOrphanedVeths(interfaces, ownedInterfaces), nil
+}
+
+// listEndpointResourcesImpl returns the names of the host interfaces.
+func listEndpointResourcesImpl() (map[string]bool, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	resources := make(map[string]bool)
+	for _, iface := range interfaces {
+		resources[iface.Name] = true
+	}
+
+	return resources, nil
+}
+
+// checkResourcesImpl returns an error if the host interface of the endpoint no longer exists.
+// Endpoints without a host-side interface live entirely in the container namespace.
+func (ep *endpoint) checkResourcesImpl(resources map[string]bool) error {
+	if ep.HostIfName != "" && !resources[ep.HostIfName] {
+		return fmt.Errorf("Host interface %v no longer exists", ep.HostIfName)
+	}
+
+	return nil
+}
+
+// findOrphanedVeths returns the veth interfaces following this plugin's naming convention that have
+// no owner and whose peer is gone, together with the reason they are considered orphaned.
+// A veth only reports an "up" operational state while its peer exists and is up.
+func findOrphanedVeths(interfaces []net.Interface, ownedInterfaces map[string]bool) map[string]string {
+	orphans := make(map[string]string)
+
+	for _, iface := range interfaces {
+		if !strings.HasPrefix(iface.Name, hostVEthInterfacePrefix) || ownedInterfaces[iface.Name] {
+			continue
+		}
+
+		operState, err := readSysfsFile(fmt.Sprintf(operStatePathFormat, iface.Name))
+		if err != nil {
+			log.Printf("[net] Failed to read operational state of %v: %v.", iface.Name, err)
+			continue
+		}
+
+		if state := strings.TrimSpace(string(operState)); state != "up" {
+			orphans[iface.Name] = fmt.Sprintf("no endpoint owns it and its peer is gone (operstate %v)", state)
+		}
+	}
+
+	return orphans
+}
+
+// networkExistsImpl returns whether the host interfaces backing a network still exist.
+func (nm *networkManager) networkExistsImpl(nw *network) (bool, error) {
+	ifNames := []string{nw.extIf.Name}
+
+	switch nw.Mode {
+	case opModeNone:
+		return true, nil
+
+	case opModeIpvlan:
+		if nw.IpvlanMode == ipvlanModeL3 {
+			parentIf, err := net.InterfaceByName(nw.ParentIfName)
+			if err != nil {
+				log.Printf("[net] Parent interface %v of network %v is missing.", nw.ParentIfName, nw.Id)
+				return false, nil
+			}
+
+			ifNames = append(ifNames, getHostIpvlanInterfaceName(parentIf.Index))
+		}
+
+	case opModeMacvlan:
+
+	case opModeOverlay:
+		ifNames = append(ifNames, nw.BridgeName, getVxlanInterfaceName(nw.VxlanId))
+
+	default:
+		if nw.VlanIfName != "" {
+			ifNames = append(ifNames, nw.BridgeName, nw.VlanIfName)
+			break
+		}
+
+		if nw.extIf.BridgeName != "" {
+			ifNames = append(ifNames, nw.extIf.BridgeName)
+		}
+	}
+
+	for _, ifName := range ifNames {
+		if _, err := net.InterfaceByName(ifName); err != nil {
+			log.Printf("[net] Interface %v of network %v is missing.", ifName, nw.Id)
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
 func getNetworkInfoImpl(nwInfo *NetworkInfo, nw *network) {
-	if nw.VlanId != 0 {
+	if nw.VlanIfName != "" {
+		nwInfo.VlanID = nw.VlanId
+	} else if nw.VlanId != 0 {
 		vlanMap := make(map[string]interface{})
 		vlanMap[VlanIDKey] = strconv.Itoa(nw.VlanId)
 		nwInfo.Options[genericData] = vlanMap
 	}
+
+	if nw.IpvlanMode != "" {
+		ipvlanMap := make(map[string]interface{})
+		ipvlanMap[IpvlanModeKey] = nw.IpvlanMode
+		nwInfo.Options[genericData] = ipvlanMap
+	}
+
+	if nw.VxlanId != 0 {
+		vxlanMap := make(map[string]interface{})
+		vxlanMap[VxlanIdKey] = strconv.Itoa(nw.VxlanId)
+		vxlanMap[VxlanPortKey] = strconv.Itoa(nw.VxlanPort)
+		nwInfo.Options[genericData] = vxlanMap
+	}
+}
+
+// getHostIpvlanInterfaceName returns the name of the host-side ipvlan interface of a parent interface.
+func getHostIpvlanInterfaceName(parentIfIndex int) string {
+	return fmt.Sprintf("%s%d", hostIpvlanInterfacePrefix, parentIfIndex)
+}
+
+// getNetlinkIpvlanMode converts an ipvlan mode option to its netlink value.
+func getNetlinkIpvlanMode(mode string) netlink.IPVlanMode {
+	if mode == ipvlanModeL3 {
+		return netlink.IPVLAN_MODE_L3
+	}
+
+	return netlink.IPVLAN_MODE_L2
+}
+
+// createHostIpvlanInterface creates the host-side L3 ipvlan interface used to reach containers
+// on an ipvlan network, since ipvlan sub-interfaces cannot talk to their parent interface.
+func createHostIpvlanInterface(parentIfName string) error {
+	parentIf, err := net.InterfaceByName(parentIfName)
+	if err != nil {
+		return err
+	}
+
+	hostIfName := getHostIpvlanInterfaceName(parentIf.Index)
+	if _, err := net.InterfaceByName(hostIfName); err == nil {
+		log.Printf("[net] Found existing host ipvlan interface %v.", hostIfName)
+		return nil
+	}
+
+	log.Printf("[net] Creating host ipvlan interface %v on %v.", hostIfName, parentIfName)
+	link := netlink.IPVlanLink{
+		LinkInfo: netlink.LinkInfo{
+			Type:        netlink.LINK_TYPE_IPVLAN,
+			Name:        hostIfName,
+			ParentIndex: parentIf.Index,
+		},
+		Mode: netlink.IPVLAN_MODE_L3,
+	}
+
+	if err := netlink.AddLink(&link); err != nil {
+		log.Printf("[net] Failed to create host ipvlan interface, err:%v.", err)
+		return err
+	}
+
+	log.Printf("[net] Setting link %v state up.", hostIfName)
+	return netlink.SetLinkState(hostIfName, true)
+}
+
+// deleteHostIpvlanInterface deletes the host-side ipvlan interface of a parent interface.
+func deleteHostIpvlanInterface(parentIfName string) {
+	parentIf, err := net.InterfaceByName(parentIfName)
+	if err != nil {
+		log.Printf("[net] Failed to find interface %v: %v.", parentIfName, err)
+		return
+	}
+
+	hostIfName := getHostIpvlanInterfaceName(parentIf.Index)
+	log.Printf("[net] Deleting host ipvlan interface %v.", hostIfName)
+	if err := netlink.DeleteLink(hostIfName); err != nil {
+		log.Printf("[net] Failed to delete host ipvlan interface %v: %v.", hostIfName, err)
+	}
 }
 
 func AddStaticRoute(ip string, interfaceName string) error {
@@ -0,0 +1,1404 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-container-networking/common"
+	"github.com/Azure/azure-container-networking/network/policy"
+	"github.com/Azure/azure-container-networking/platform"
+	"github.com/Azure/azure-container-networking/store"
+	"golang.org/x/sys/unix"
+)
+
+// TestFindOrphanedVeths tests that only unowned veths with a gone peer are reported.
+func TestFindOrphanedVeths(t *testing.T) {
+	fs := newFakeSysfs()
+	defer func() { readSysfsFile, writeSysfsFile = ioutil.ReadFile, ioutil.WriteFile }()
+
+	fs.files["/sys/class/net/azvowned/operstate"] = "lowerlayerdown"
+	fs.files["/sys/class/net/azvalive/operstate"] = "up"
+	fs.files["/sys/class/net/azvstale/operstate"] = "lowerlayerdown"
+	fs.files["/sys/class/net/azvstale-2/operstate"] = "down"
+	fs.files["/sys/class/net/eth0/operstate"] = "down"
+
+	interfaces := []net.Interface{
+		{Name: "azvowned"},
+		{Name: "azvalive"},
+		{Name: "azvstale"},
+		{Name: "azvstale-2"},
+		{Name: "eth0"},
+	}
+
+	orphans := findOrphanedVeths(interfaces, map[string]bool{"azvowned": true})
+
+	if len(orphans) != 2 || orphans["azvstale"] == "" || orphans["azvstale-2"] == "" {
+		t.Errorf("Unexpected orphaned veths %+v", orphans)
+	}
+}
+
+// TestReconcileNetworks tests that networks whose host interfaces are missing are pruned
+// once their stale endpoints are deleted, and that existing networks are left untouched.
+func TestReconcileNetworks(t *testing.T) {
+	missing := &network{
+		Id:           "missing",
+		Mode:         opModeIpvlan,
+		IpvlanMode:   ipvlanModeL2,
+		ParentIfName: "azmissing0",
+		Endpoints:    map[string]*endpoint{"ep1": {Id: "ep1", IfName: "azmissing1"}},
+	}
+	missingIf := &externalInterface{Name: "azmissing0", Networks: map[string]*network{missing.Id: missing}}
+	missing.extIf = missingIf
+
+	existing := &network{
+		Id:           "existing",
+		Mode:         opModeIpvlan,
+		IpvlanMode:   ipvlanModeL2,
+		ParentIfName: "lo",
+		Endpoints:    map[string]*endpoint{"ep2": {Id: "ep2"}},
+	}
+	existingIf := &externalInterface{Name: "lo", Networks: map[string]*network{existing.Id: existing}}
+	existing.extIf = existingIf
+
+	nm := &networkManager{
+		ExternalInterfaces: map[string]*externalInterface{missingIf.Name: missingIf, existingIf.Name: existingIf},
+	}
+
+	if !nm.reconcileNetworks() {
+		t.Errorf("Expected the state to change")
+	}
+
+	if !missing.Pruned || !missing.Endpoints["ep1"].Stale {
+		t.Errorf("Expected pruned network with stale endpoint, got pruned:%v stale:%v", missing.Pruned, missing.Endpoints["ep1"].Stale)
+	}
+
+	if existing.Pruned || existing.Endpoints["ep2"].Stale {
+		t.Errorf("Existing network was modified")
+	}
+
+	if err := nm.DeleteEndpoint(missing.Id, "ep1"); err != nil {
+		t.Errorf("Failed to delete stale endpoint: %v", err)
+	}
+
+	if _, err := nm.getNetwork(missing.Id); err == nil {
+		t.Errorf("Expected pruned network to be removed with its last endpoint")
+	}
+}
+
+// Tests that networks and endpoints that cannot be decoded are set aside instead of failing the restore.
+func TestDecodeInvalidEntries(t *testing.T) {
+	state := `{
+		"ExternalInterfaces": {
+			"lo": {
+				"Name": "lo",
+				"Networks": {
+					"bad": {"Id": "bad", "Mode": 42},
+					"good": {
+						"Id": "good",
+						"Endpoints": {
+							"ep1": {"Id": "ep1", "IPAddresses": [{"IP": "10.0.0.4", "Mask": "////AA=="}]},
+							"ep2": {"Id": "ep2", "IPAddresses": [{"IP": "not-an-ip", "Mask": "////AA=="}]},
+							"ep3": {}
+						}
+					}
+				}
+			}
+		}
+	}`
+
+	nm := &networkManager{}
+	if err := json.Unmarshal([]byte(state), nm); err != nil {
+		t.Fatalf("Failed to decode state: %v", err)
+	}
+
+	extIf := nm.ExternalInterfaces["lo"]
+	if len(extIf.Networks) != 1 || len(extIf.undecodable) != 1 || extIf.undecodable[0].NetworkId != "bad" {
+		t.Fatalf("Expected network bad to be set aside, got networks:%v undecodable:%v", len(extIf.Networks), len(extIf.undecodable))
+	}
+
+	nw := extIf.Networks["good"]
+	if len(nw.Endpoints) != 1 || nw.Endpoints["ep1"] == nil || len(nw.undecodable) != 2 {
+		t.Fatalf("Expected endpoints ep2 and ep3 to be set aside, got endpoints:%v undecodable:%v", len(nw.Endpoints), len(nw.undecodable))
+	}
+
+	for _, orphan := range nw.undecodable {
+		if orphan.NetworkId != "good" || orphan.Reason == "" || len(orphan.Data) == 0 {
+			t.Errorf("Invalid orphan %+v", orphan)
+		}
+	}
+}
+
+// Tests that endpoints with invalid addresses or missing host interfaces are dropped and recorded as orphans.
+func TestValidateEndpoints(t *testing.T) {
+	_, ipNet, _ := net.ParseCIDR("10.0.0.4/24")
+	nw := &network{
+		Id: "nw",
+		Endpoints: map[string]*endpoint{
+			"valid":   {Id: "valid", HostIfName: "lo", IPAddresses: []net.IPNet{*ipNet}},
+			"missing": {Id: "missing", HostIfName: "azvmissing0"},
+			"badip":   {Id: "badip", IPAddresses: []net.IPNet{{IP: ipNet.IP}}},
+			"stale":   {Id: "stale", HostIfName: "azvmissing1", Stale: true},
+		},
+	}
+	extIf := &externalInterface{Name: "lo", Networks: map[string]*network{nw.Id: nw}}
+	nw.extIf = extIf
+
+	nm := &networkManager{ExternalInterfaces: map[string]*externalInterface{extIf.Name: extIf}}
+
+	if !nm.validateEndpoints() {
+		t.Errorf("Expected the state to change")
+	}
+
+	if len(nw.Endpoints) != 2 || nw.Endpoints["valid"] == nil || nw.Endpoints["stale"] == nil {
+		t.Errorf("Expected only valid and stale endpoints to be kept, got %v", nw.Endpoints)
+	}
+
+	orphans, _ := nm.GetOrphanInfos()
+	if len(orphans) != 2 {
+		t.Fatalf("Expected 2 orphans, got %v", len(orphans))
+	}
+
+	for _, orphan := range orphans {
+		if orphan.NetworkId != nw.Id || orphan.Time.IsZero() || len(orphan.Data) == 0 {
+			t.Errorf("Invalid orphan %+v", orphan)
+		}
+	}
+
+	if nm.validateEndpoints() {
+		t.Errorf("Expected no change on second validation")
+	}
+}
+
+// Tests that a snapshot captures the persisted state, the host interfaces and the differences between them.
+func TestSnapshot(t *testing.T) {
+	nw := &network{
+		Id:   "nw",
+		Mode: opModeMacvlan,
+		Endpoints: map[string]*endpoint{
+			"valid":   {Id: "valid", HostIfName: "lo"},
+			"missing": {Id: "missing", HostIfName: "azvmissing0"},
+		},
+	}
+	gone := &network{
+		Id:         "gone",
+		Mode:       opModeOverlay,
+		BridgeName: "azvxbrmissing",
+		VxlanId:    77,
+		Endpoints:  map[string]*endpoint{},
+	}
+	extIf := &externalInterface{Name: "lo", Networks: map[string]*network{nw.Id: nw, gone.Id: gone}}
+	nw.extIf = extIf
+	gone.extIf = extIf
+
+	nm := &networkManager{
+		ExternalInterfaces: map[string]*externalInterface{extIf.Name: extIf},
+		Orphans:            []*OrphanInfo{{NetworkId: "old", Reason: "invalid"}},
+	}
+
+	snapshot, err := nm.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	if len(snapshot.Networks) != 2 || snapshot.Networks[0].Id != "gone" || snapshot.Networks[1].Id != "nw" {
+		t.Fatalf("Unexpected networks %+v", snapshot.Networks)
+	}
+
+	if endpoints := snapshot.Networks[1].Endpoints; len(endpoints) != 2 || endpoints[0].Id != "missing" || endpoints[1].Id != "valid" {
+		t.Errorf("Unexpected endpoints %+v", endpoints)
+	}
+
+	if len(snapshot.Orphans) != 1 || snapshot.Orphans[0] == nm.Orphans[0] {
+		t.Errorf("Expected a copy of the orphans, got %+v", snapshot.Orphans)
+	}
+
+	var diffs []string
+	for _, diff := range snapshot.Diffs {
+		if diff.Resource == "" {
+			diffs = append(diffs, diff.NetworkId+"/"+diff.EndpointId)
+		}
+	}
+
+	if len(diffs) != 2 || diffs[0] != "gone/" || diffs[1] != "nw/missing" || len(snapshot.DiffErrors) != 0 {
+		t.Errorf("Unexpected diffs %v errors %v", diffs, snapshot.DiffErrors)
+	}
+
+	var lo *InterfaceSnapshot
+	for _, ifSnapshot := range snapshot.Host.Interfaces {
+		if ifSnapshot.Name == "lo" {
+			lo = ifSnapshot
+		}
+	}
+
+	if lo == nil || len(lo.Addresses) == 0 || snapshot.Host.InterfacesError != "" {
+		t.Errorf("Expected the loopback interface in the host snapshot, got %+v", snapshot.Host)
+	}
+
+	if _, err := json.Marshal(snapshot); err != nil {
+		t.Errorf("Failed to encode snapshot: %v", err)
+	}
+}
+
+// Tests that a network is deleted along with all of its endpoints.
+func TestForceDeleteNetwork(t *testing.T) {
+	nw := &network{
+		Id:           "nw",
+		Mode:         opModeIpvlan,
+		IpvlanMode:   ipvlanModeL2,
+		ParentIfName: "lo",
+		Endpoints: map[string]*endpoint{
+			"ep1": {Id: "ep1", IfName: "eth0", NetworkNameSpace: "/proc/0/ns/net"},
+			"ep2": {Id: "ep2", IfName: "eth0", NetworkNameSpace: "/proc/0/ns/net"},
+		},
+	}
+	extIf := &externalInterface{Name: "lo", Networks: map[string]*network{nw.Id: nw}}
+	nw.extIf = extIf
+
+	nm := &networkManager{ExternalInterfaces: map[string]*externalInterface{extIf.Name: extIf}}
+
+	if err := nm.ForceDeleteNetwork(nw.Id); err != nil {
+		t.Fatalf("Failed to force delete network: %v", err)
+	}
+
+	if len(nw.Endpoints) != 0 {
+		t.Errorf("Expected all endpoints to be deleted, got %v", len(nw.Endpoints))
+	}
+
+	if _, err := nm.getNetwork(nw.Id); err == nil {
+		t.Errorf("Expected network to be removed")
+	}
+
+	if err := nm.ForceDeleteNetwork(nw.Id); err != ErrNetworkNotFound {
+		t.Errorf("Expected %v, got %v", ErrNetworkNotFound, err)
+	}
+}
+
+// Tests that the network manager returns errors that callers can match for missing and existing objects.
+func TestNetworkManagerErrors(t *testing.T) {
+	nw := &network{Id: "nw", Mode: opModeMacvlan, ParentIfName: "lo", Endpoints: make(map[string]*endpoint)}
+	extIf := &externalInterface{Name: "lo", Networks: map[string]*network{nw.Id: nw}}
+	nw.extIf = extIf
+
+	nm := &networkManager{ExternalInterfaces: map[string]*externalInterface{extIf.Name: extIf}}
+
+	tests := []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{"CreateNetwork", nm.CreateNetwork(&NetworkInfo{Id: "nw", Mode: opModeMacvlan, MasterIfName: "lo"}), ErrNetworkExists},
+		{"DeleteNetwork", nm.DeleteNetwork("missing"), ErrNetworkNotFound},
+		{"CreateEndpoint", nm.CreateEndpoint("missing", &EndpointInfo{Id: "ep1"}), ErrNetworkNotFound},
+		{"DeleteEndpoint", nm.DeleteEndpoint("nw", "missing"), ErrEndpointNotFound},
+	}
+
+	for _, test := range tests {
+		if !errors.Is(test.err, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.name, test.expected, test.err)
+		}
+	}
+
+	// HNS errors keep their text and match ErrHNSFailure.
+	hnsErr := fmt.Errorf("Failed to delete endpoint: %w", &HNSError{Err: fmt.Errorf("Element not found.")})
+	if !errors.Is(hnsErr, ErrHNSFailure) || hnsErr.Error() != "Failed to delete endpoint: Element not found." {
+		t.Errorf("Unexpected HNS error %v", hnsErr)
+	}
+
+	if timeoutErr := error(&HNSTimeoutError{Timeout: time.Second}); !errors.Is(timeoutErr, ErrHNSFailure) || !IsHNSTimeoutError(fmt.Errorf("%w", timeoutErr)) {
+		t.Errorf("Expected HNS timeouts to match ErrHNSFailure")
+	}
+}
+
+// Tests that listeners receive the events of deleted endpoints and networks in order.
+func TestRegisterListener(t *testing.T) {
+	nw := &network{
+		Id:           "nw",
+		Mode:         opModeIpvlan,
+		IpvlanMode:   ipvlanModeL2,
+		ParentIfName: "lo",
+		Endpoints: map[string]*endpoint{
+			"ep1": {Id: "ep1", IfName: "eth0", NetworkNameSpace: "/proc/0/ns/net"},
+			"ep2": {Id: "ep2", IfName: "eth0", NetworkNameSpace: "/proc/0/ns/net"},
+		},
+	}
+	extIf := &externalInterface{Name: "lo", Networks: map[string]*network{nw.Id: nw}}
+	nw.extIf = extIf
+
+	nm := &networkManager{ExternalInterfaces: map[string]*externalInterface{extIf.Name: extIf}}
+
+	events := make(chan Event, eventQueueSize)
+	nm.RegisterListener(func(event Event) { events <- event })
+
+	if err := nm.ForceDeleteNetwork(nw.Id); err != nil {
+		t.Fatalf("Failed to force delete network: %v", err)
+	}
+
+	expected := []Event{
+		{Type: EventEndpointDeleted, NetworkId: "nw", EndpointId: "ep1"},
+		{Type: EventEndpointDeleted, NetworkId: "nw", EndpointId: "ep2"},
+		{Type: EventNetworkDeleted, NetworkId: "nw"},
+	}
+
+	for _, want := range expected {
+		select {
+		case event := <-events:
+			if event.Type != want.Type || event.NetworkId != want.NetworkId || event.EndpointId != want.EndpointId || event.Time.IsZero() {
+				t.Errorf("Expected %+v, got %+v", want, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %+v", want)
+		}
+	}
+}
+
+// Tests that events are dropped instead of blocking when a listener is stuck.
+func TestEventDispatcherDropsEvents(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	var dispatcher eventDispatcher
+	dispatcher.register(func(event Event) { <-block })
+
+	// One event is held by the stuck listener, the queue holds the rest.
+	for i := 0; i < eventQueueSize+3; i++ {
+		dispatcher.publish(EventEndpointCreated, "nw", "ep")
+	}
+
+	if dropped := dispatcher.droppedEvents(); dropped < 2 {
+		t.Errorf("Expected dropped events, got %v", dropped)
+	}
+}
+
+// Tests that only endpoints of dead containers older than the grace period are collected.
+func TestCollectEndpoints(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+	newEndpoint := func(id string, containerID string, createdTime time.Time) *endpoint {
+		return &endpoint{Id: id, IfName: "eth0", NetworkNameSpace: "/proc/0/ns/net", ContainerID: containerID, CreatedTime: createdTime}
+	}
+
+	nw := &network{
+		Id:           "nw",
+		Mode:         opModeIpvlan,
+		IpvlanMode:   ipvlanModeL2,
+		ParentIfName: "lo",
+		Endpoints: map[string]*endpoint{
+			"dead-old":   newEndpoint("dead-old", "dead", old),
+			"dead-young": newEndpoint("dead-young", "dead", time.Now()),
+			"alive-old":  newEndpoint("alive-old", "alive", old),
+			"error-old":  newEndpoint("error-old", "error", old),
+			"unowned":    newEndpoint("unowned", "", old),
+		},
+	}
+	extIf := &externalInterface{Name: "lo", Networks: map[string]*network{nw.Id: nw}}
+	nw.extIf = extIf
+
+	nm := &networkManager{ExternalInterfaces: map[string]*externalInterface{extIf.Name: extIf}}
+
+	isAlive := func(epInfo *EndpointInfo) (bool, error) {
+		switch epInfo.ContainerID {
+		case "dead":
+			return false, nil
+		case "error":
+			return false, fmt.Errorf("runtime unavailable")
+		}
+		return true, nil
+	}
+
+	deleted, err := nm.CollectEndpoints(isAlive, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to collect endpoints: %v", err)
+	}
+
+	if !reflect.DeepEqual(deleted, []string{"dead-old"}) {
+		t.Errorf("Expected dead-old to be collected, got %v", deleted)
+	}
+
+	if len(nw.Endpoints) != 4 || nw.Endpoints["dead-old"] != nil {
+		t.Errorf("Unexpected remaining endpoints %v", nw.Endpoints)
+	}
+}
+
+// blockingEndpointClient creates no interfaces. If it has a release channel, adding endpoints
+// signals started and blocks until the channel is closed.
+type blockingEndpointClient struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (client *blockingEndpointClient) AddEndpoints(epInfo *EndpointInfo) error {
+	if client.release != nil {
+		close(client.started)
+		<-client.release
+	}
+
+	return nil
+}
+
+func (client *blockingEndpointClient) AddEndpointRules(epInfo *EndpointInfo) error {
+	return nil
+}
+
+func (client *blockingEndpointClient) DeleteEndpointRules(ep *endpoint) {
+}
+
+func (client *blockingEndpointClient) MoveEndpointsToContainerNS(epInfo *EndpointInfo, nsID uintptr) error {
+	return nil
+}
+
+func (client *blockingEndpointClient) SetupContainerInterfaces(epInfo *EndpointInfo) error {
+	return nil
+}
+
+func (client *blockingEndpointClient) ConfigureContainerInterfacesAndRoutes(epInfo *EndpointInfo) error {
+	return nil
+}
+
+func (client *blockingEndpointClient) DeleteEndpoints(ep *endpoint) error {
+	return nil
+}
+
+// Tests that endpoints are added to and deleted from a network while an endpoint operation on another
+// network is in progress, and that saving one network keeps the persisted endpoints of the other.
+func TestPerNetworkLocking(t *testing.T) {
+	defer func() { newEndpointClient = defaultNewEndpointClient }()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	newEndpointClient = func(nw *network, epInfo *EndpointInfo, hostIfName string, contIfName string, vlanid int) EndpointClient {
+		if nw.Id == "slow" {
+			return &blockingEndpointClient{started: started, release: release}
+		}
+		return &blockingEndpointClient{}
+	}
+
+	dir, err := ioutil.TempDir("", "network")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	stateFile := path.Join(dir, "azure-vnet.json")
+	kvs, err := store.NewJsonFileStore(stateFile)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	extIf := &externalInterface{Name: "lo", Networks: make(map[string]*network)}
+	for _, id := range []string{"slow", "fast"} {
+		extIf.Networks[id] = &network{Id: id, Mode: opModeBridge, Endpoints: make(map[string]*endpoint), extIf: extIf}
+	}
+
+	nm := &networkManager{ExternalInterfaces: map[string]*externalInterface{extIf.Name: extIf}, store: kvs}
+
+	// Host devices are used as is, so "lo" stands in for the container interface.
+	newEndpointInfo := func(id string) *EndpointInfo {
+		return &EndpointInfo{Id: id, HostDeviceName: "lo"}
+	}
+
+	slowDone := make(chan error, 1)
+	go func() { slowDone <- nm.CreateEndpoint("slow", newEndpointInfo("slow-ep")) }()
+	<-started
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			id := fmt.Sprintf("fast-ep%v", i)
+			if err := nm.CreateEndpoint("fast", newEndpointInfo(id)); err != nil {
+				errs <- err
+				return
+			}
+
+			if i%2 == 0 {
+				if err := nm.DeleteEndpoint("fast", id); err != nil {
+					errs <- err
+				}
+			}
+		}(i)
+	}
+
+	fastDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(fastDone)
+	}()
+
+	select {
+	case <-fastDone:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Endpoint operations on network fast were blocked by network slow")
+	}
+
+	close(errs)
+	for err := range errs {
+		t.Errorf("Endpoint operation on network fast failed: %v", err)
+	}
+
+	select {
+	case err := <-slowDone:
+		t.Fatalf("Endpoint operation on network slow completed before it was released, err:%v", err)
+	default:
+	}
+
+	close(release)
+	if err := <-slowDone; err != nil {
+		t.Fatalf("Failed to create endpoint on network slow: %v", err)
+	}
+
+	restoredStore, err := store.NewJsonFileStore(stateFile)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+
+	restored := &networkManager{}
+	if err := restoredStore.Read(storeKey, restored); err != nil {
+		t.Fatalf("Failed to read state: %v", err)
+	}
+
+	networks := restored.ExternalInterfaces["lo"].Networks
+	if len(networks["slow"].Endpoints) != 1 || networks["slow"].Endpoints["slow-ep"] == nil {
+		t.Errorf("Unexpected persisted endpoints of network slow %v", networks["slow"].Endpoints)
+	}
+
+	if len(networks["fast"].Endpoints) != 5 {
+		t.Errorf("Unexpected persisted endpoints of network fast %v", networks["fast"].Endpoints)
+	}
+}
+
+// Tests that only the first endpoint of a container attached to multiple networks is its primary endpoint.
+func TestMultiHomedContainer(t *testing.T) {
+	defer func() { newEndpointClient = defaultNewEndpointClient }()
+
+	newEndpointClient = func(nw *network, epInfo *EndpointInfo, hostIfName string, contIfName string, vlanid int) EndpointClient {
+		return &blockingEndpointClient{}
+	}
+
+	extIf := &externalInterface{Name: "lo", Networks: make(map[string]*network)}
+	for _, id := range []string{"nw1", "nw2"} {
+		extIf.Networks[id] = &network{
+			Id:        id,
+			Mode:      opModeBridge,
+			Endpoints: make(map[string]*endpoint),
+			DNS:       DNSInfo{Suffix: id + ".local", Servers: []string{"10.0.0.10"}},
+			extIf:     extIf,
+		}
+	}
+
+	nm := &networkManager{ExternalInterfaces: map[string]*externalInterface{extIf.Name: extIf}}
+
+	_, defaultDst, _ := net.ParseCIDR("0.0.0.0/0")
+	_, subnetDst, _ := net.ParseCIDR("10.1.0.0/16")
+	newEndpointInfo := func(id string) *EndpointInfo {
+		return &EndpointInfo{
+			Id:             id,
+			ContainerID:    "container1",
+			HostDeviceName: "lo",
+			Routes: []RouteInfo{
+				{Dst: *defaultDst, Gw: net.ParseIP("10.1.0.1")},
+				{Dst: *subnetDst, Gw: net.ParseIP("10.1.0.1")},
+			},
+		}
+	}
+
+	if err := nm.CreateEndpoint("nw2", newEndpointInfo("ep2")); err != nil {
+		t.Fatalf("Failed to create endpoint ep2: %v", err)
+	}
+
+	secondary := newEndpointInfo("ep1")
+	if err := nm.CreateEndpoint("nw1", secondary); err != nil {
+		t.Fatalf("Failed to create endpoint ep1: %v", err)
+	}
+
+	if !secondary.Secondary {
+		t.Errorf("Endpoint ep1 was not created as a secondary endpoint")
+	}
+
+	ep1 := extIf.Networks["nw1"].Endpoints["ep1"]
+	if !ep1.Secondary || len(ep1.Routes) != 1 || !ep1.Routes[0].Dst.IP.Equal(subnetDst.IP) {
+		t.Errorf("Unexpected secondary endpoint %+v", ep1)
+	}
+
+	if ep1.DNS.Suffix != "" || len(ep1.DNS.Servers) != 0 {
+		t.Errorf("Secondary endpoint has DNS settings %+v", ep1.DNS)
+	}
+
+	ep2 := extIf.Networks["nw2"].Endpoints["ep2"]
+	if ep2.Secondary || len(ep2.Routes) != 2 || ep2.DNS.Suffix != "nw2.local" {
+		t.Errorf("Unexpected primary endpoint %+v", ep2)
+	}
+
+	epInfos, err := nm.GetContainerEndpointInfos("container1")
+	if err != nil {
+		t.Fatalf("Failed to get endpoints of container: %v", err)
+	}
+
+	if len(epInfos) != 2 ||
+		epInfos[0].Id != "ep2" || epInfos[0].NetworkId != "nw2" || epInfos[0].Secondary ||
+		epInfos[1].Id != "ep1" || epInfos[1].NetworkId != "nw1" || !epInfos[1].Secondary {
+		t.Errorf("Unexpected endpoints of container %+v", epInfos)
+	}
+
+	// Once the primary endpoint is deleted, the next endpoint of the container becomes primary.
+	if err := nm.DeleteEndpoint("nw2", "ep2"); err != nil {
+		t.Fatalf("Failed to delete endpoint ep2: %v", err)
+	}
+
+	primary := newEndpointInfo("ep3")
+	if err := nm.CreateEndpoint("nw2", primary); err != nil {
+		t.Fatalf("Failed to create endpoint ep3: %v", err)
+	}
+
+	if primary.Secondary {
+		t.Errorf("Endpoint ep3 was created as a secondary endpoint")
+	}
+}
+
+// Tests that subnets are added to a network and that changes to immutable fields are rejected.
+func TestUpdateNetwork(t *testing.T) {
+	nw := &network{
+		Id:           "nw",
+		Mode:         opModeIpvlan,
+		IpvlanMode:   ipvlanModeL2,
+		ParentIfName: "lo",
+		MasterIfName: "lo",
+		Subnets:      []SubnetInfo{parseSubnet("10.0.0.0/24", "10.0.0.1")},
+		Endpoints:    make(map[string]*endpoint),
+	}
+	extIf := &externalInterface{Name: "lo", Networks: map[string]*network{nw.Id: nw}}
+	nw.extIf = extIf
+
+	nm := &networkManager{ExternalInterfaces: map[string]*externalInterface{extIf.Name: extIf}}
+
+	tests := []struct {
+		name    string
+		nwInfo  *NetworkInfo
+		subnets int
+		valid   bool
+	}{
+		{"unchanged", &NetworkInfo{Id: "nw", Subnets: []SubnetInfo{parseSubnet("10.0.0.0/24", "10.0.0.1")}}, 1, true},
+		{"added", &NetworkInfo{Id: "nw", Mode: opModeIpvlan, MasterIfName: "lo", Subnets: []SubnetInfo{
+			parseSubnet("10.0.0.0/24", "10.0.0.1"),
+			parseSubnet("10.1.0.0/24", "10.1.0.1"),
+		}}, 2, true},
+		{"removed", &NetworkInfo{Id: "nw", Subnets: []SubnetInfo{parseSubnet("10.1.0.0/24", "10.1.0.1")}}, 2, false},
+		{"gateway", &NetworkInfo{Id: "nw", Subnets: []SubnetInfo{
+			parseSubnet("10.0.0.0/24", "10.0.0.254"),
+			parseSubnet("10.1.0.0/24", "10.1.0.1"),
+		}}, 2, false},
+		{"overlap", &NetworkInfo{Id: "nw", Subnets: []SubnetInfo{
+			parseSubnet("10.0.0.0/24", "10.0.0.1"),
+			parseSubnet("10.1.0.0/24", "10.1.0.1"),
+			parseSubnet("10.1.0.0/16", "10.1.0.1"),
+		}}, 2, false},
+		{"mode", &NetworkInfo{Id: "nw", Mode: opModeBridge}, 2, false},
+		{"master", &NetworkInfo{Id: "nw", MasterIfName: "eth1"}, 2, false},
+		{"missing", &NetworkInfo{Id: "missing"}, 2, false},
+	}
+
+	for _, tt := range tests {
+		err := nm.UpdateNetwork(tt.nwInfo)
+		if tt.valid && err != nil {
+			t.Errorf("%v: unexpected error %v", tt.name, err)
+		}
+
+		if !tt.valid && err == nil {
+			t.Errorf("%v: expected update to be rejected", tt.name)
+		}
+
+		if len(nw.Subnets) != tt.subnets {
+			t.Errorf("%v: expected %v subnets, got %v", tt.name, tt.subnets, nw.Subnets)
+		}
+	}
+}
+
+// Tests that overlay networks tunnel traffic to remote endpoints and persist them.
+func TestOverlayNetwork(t *testing.T) {
+	withTestNamespace(t, func(nsPath string) {
+		dir, err := ioutil.TempDir("", "network")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		stateFile := path.Join(dir, "azure-vnet.json")
+		kvs, err := store.NewJsonFileStore(stateFile)
+		if err != nil {
+			t.Fatalf("Failed to create store: %v", err)
+		}
+
+		extIf := &externalInterface{Name: "lo", Networks: make(map[string]*network)}
+		nm := &networkManager{ExternalInterfaces: map[string]*externalInterface{extIf.Name: extIf}, store: kvs}
+
+		nwInfo := &NetworkInfo{
+			Id:           "overlay",
+			Mode:         opModeOverlay,
+			MasterIfName: "lo",
+			Subnets:      []SubnetInfo{parseSubnet("10.240.0.0/16", "10.240.0.1")},
+			Options:      map[string]interface{}{genericData: map[string]interface{}{VxlanIdKey: "4096"}},
+		}
+
+		if err := nm.CreateNetwork(nwInfo); err != nil {
+			t.Fatalf("Failed to create overlay network: %v", err)
+		}
+
+		for _, ifName := range []string{"azvxbr4096", "azvx4096"} {
+			if _, err := net.InterfaceByName(ifName); err != nil {
+				t.Fatalf("Interface %v of overlay network is missing: %v", ifName, err)
+			}
+		}
+
+		mac, _ := net.ParseMAC("02:00:0a:f0:01:05")
+		remoteEp := &RemoteEndpointInfo{MacAddress: mac, NodeIP: net.ParseIP("192.168.0.2")}
+
+		// Adding a remote endpoint is idempotent.
+		for i := 0; i < 2; i++ {
+			if err := nm.AddRemoteEndpoint("overlay", remoteEp); err != nil {
+				t.Fatalf("Failed to add remote endpoint: %v", err)
+			}
+		}
+
+		fdb, _ := platform.ExecuteCommand("bridge fdb show dev azvx4096")
+		if strings.Count(fdb, "02:00:0a:f0:01:05 dst 192.168.0.2") != 1 || strings.Count(fdb, "00:00:00:00:00:00 dst 192.168.0.2") != 1 {
+			t.Errorf("Unexpected FDB entries %v", fdb)
+		}
+
+		// The endpoint moved to another node.
+		remoteEp.NodeIP = net.ParseIP("192.168.0.3")
+		if err := nm.AddRemoteEndpoint("overlay", remoteEp); err != nil {
+			t.Fatalf("Failed to update remote endpoint: %v", err)
+		}
+
+		fdb, _ = platform.ExecuteCommand("bridge fdb show dev azvx4096")
+		if strings.Contains(fdb, "192.168.0.2") || !strings.Contains(fdb, "02:00:0a:f0:01:05 dst 192.168.0.3") {
+			t.Errorf("Unexpected FDB entries after move %v", fdb)
+		}
+
+		restored := &networkManager{}
+		if err := kvs.Read(storeKey, restored); err != nil {
+			t.Fatalf("Failed to read state: %v", err)
+		}
+
+		persisted := restored.ExternalInterfaces["lo"].Networks["overlay"]
+		if persisted.VxlanId != 4096 || persisted.VxlanPort != defaultVxlanPort || len(persisted.RemoteEndpoints) != 1 ||
+			!persisted.RemoteEndpoints[mac.String()].NodeIP.Equal(remoteEp.NodeIP) {
+			t.Errorf("Unexpected persisted overlay network %+v", persisted)
+		}
+
+		if err := nm.DeleteRemoteEndpoint("overlay", mac); err != nil {
+			t.Fatalf("Failed to delete remote endpoint: %v", err)
+		}
+
+		if err := nm.DeleteRemoteEndpoint("overlay", mac); err != errRemoteEndpointNotFound {
+			t.Errorf("Expected errRemoteEndpointNotFound, got %v", err)
+		}
+
+		fdb, _ = platform.ExecuteCommand("bridge fdb show dev azvx4096")
+		if strings.Contains(fdb, "192.168.0.3") {
+			t.Errorf("Unexpected FDB entries after delete %v", fdb)
+		}
+
+		if err := nm.DeleteNetwork("overlay"); err != nil {
+			t.Fatalf("Failed to delete overlay network: %v", err)
+		}
+
+		if _, err := net.InterfaceByName("azvx4096"); err == nil {
+			t.Errorf("VXLAN interface of deleted overlay network still exists")
+		}
+	})
+}
+
+// Tests that networks in none mode record their endpoints and persist them without creating any
+// interface, which does not require privileges.
+func TestNoneNetwork(t *testing.T) {
+	dir, err := ioutil.TempDir("", "network")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	stateFile := path.Join(dir, "azure-vnet.json")
+	kvs, err := store.NewJsonFileStore(stateFile)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	extIf := &externalInterface{Name: "lo", Networks: make(map[string]*network)}
+	nm := &networkManager{ExternalInterfaces: map[string]*externalInterface{extIf.Name: extIf}, store: kvs}
+
+	nwInfo := &NetworkInfo{
+		Id:           "none",
+		Mode:         opModeNone,
+		MasterIfName: "lo",
+		Subnets:      []SubnetInfo{parseSubnet("10.240.0.0/16", "10.240.0.1")},
+		DNS:          DNSInfo{Servers: []string{"168.63.129.16"}},
+	}
+
+	if err := nm.CreateNetwork(nwInfo); err != nil {
+		t.Fatalf("Failed to create network: %v", err)
+	}
+
+	interfaces, _ := net.Interfaces()
+
+	_, ipAddress, _ := net.ParseCIDR("10.240.0.4/32")
+	ipAddress.IP = net.ParseIP("10.240.0.4")
+	epInfo := &EndpointInfo{Id: "ep1", ContainerID: "container1", IfName: "eth0", IPAddresses: []net.IPNet{*ipAddress}}
+	if err := nm.CreateEndpoint("none", epInfo); err != nil {
+		t.Fatalf("Failed to create endpoint: %v", err)
+	}
+
+	if after, _ := net.Interfaces(); len(after) != len(interfaces) {
+		t.Errorf("Expected no interfaces to be created, got %+v", after)
+	}
+
+	info, err := nm.GetEndpointInfo("none", "ep1")
+	if err != nil {
+		t.Fatalf("Failed to get endpoint info: %v", err)
+	}
+
+	if len(info.IPAddresses) != 1 || info.IPAddresses[0].String() != "10.240.0.4/16" ||
+		len(info.Gateways) != 1 || !info.Gateways[0].Equal(net.ParseIP("10.240.0.1")) ||
+		!reflect.DeepEqual(info.DNS.Servers, nwInfo.DNS.Servers) {
+		t.Errorf("Unexpected endpoint info %+v", info)
+	}
+
+	if err := nm.CreateEndpoint("none", epInfo); !errors.Is(err, ErrEndpointExists) {
+		t.Errorf("Expected ErrEndpointExists, got %v", err)
+	}
+
+	// The persisted network and endpoint survive a restore.
+	restored := &networkManager{ExternalInterfaces: make(map[string]*externalInterface)}
+	if err := restored.Initialize(&common.PluginConfig{Store: kvs}); err != nil {
+		t.Fatalf("Failed to restore state: %v", err)
+	}
+
+	if _, err := restored.GetEndpointInfo("none", "ep1"); err != nil {
+		t.Errorf("Endpoint was not restored: %v", err)
+	}
+
+	if err := nm.DeleteEndpoint("none", "ep1"); err != nil {
+		t.Fatalf("Failed to delete endpoint: %v", err)
+	}
+
+	if err := nm.DeleteNetwork("none"); err != nil {
+		t.Fatalf("Failed to delete network: %v", err)
+	}
+
+	// There is nowhere to program VLANs and network policies.
+	nwInfo.VlanID = 100
+	if err := nm.CreateNetwork(nwInfo); err != errNetworkVlanNotSupported {
+		t.Errorf("Expected %v, got %v", errNetworkVlanNotSupported, err)
+	}
+}
+
+// Tests that the VXLAN ID is required and that the VXLAN options are validated.
+func TestGetVxlanOptions(t *testing.T) {
+	tests := []struct {
+		opt   map[string]interface{}
+		id    int
+		port  int
+		valid bool
+	}{
+		{map[string]interface{}{VxlanIdKey: "1"}, 1, defaultVxlanPort, true},
+		{map[string]interface{}{VxlanIdKey: "16777215", VxlanPortKey: "8472"}, 16777215, 8472, true},
+		{nil, 0, 0, false},
+		{map[string]interface{}{VxlanIdKey: "0"}, 0, 0, false},
+		{map[string]interface{}{VxlanIdKey: "16777216"}, 0, 0, false},
+		{map[string]interface{}{VxlanIdKey: "1", VxlanPortKey: "65536"}, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		id, port, err := getVxlanOptions(tt.opt)
+		if tt.valid != (err == nil) || id != tt.id || port != tt.port {
+			t.Errorf("getVxlanOptions(%v) = %v, %v, %v", tt.opt, id, port, err)
+		}
+	}
+}
+
+// Tests that network policy rules are applied to their table and that HNS policies are rejected.
+func TestNetworkPolicyRules(t *testing.T) {
+	iptablesPolicy := policy.NetworkScopedPolicy{
+		Type:     policy.IPTablesPolicy,
+		Settings: json.RawMessage(`{"Chain":"FORWARD","Rule":"-i azure0 -j ACCEPT"}`),
+	}
+	ebtablesPolicy := policy.NetworkScopedPolicy{
+		Type:     policy.EBTablesPolicy,
+		Settings: json.RawMessage(`{"Table":"nat","Chain":"PREROUTING","Rule":"-p ARP -j ACCEPT"}`),
+	}
+
+	cmd, err := getNetworkPolicyCommand(&iptablesPolicy, "-A")
+	if err != nil || cmd != "iptables -t filter -A FORWARD -i azure0 -j ACCEPT" {
+		t.Errorf("Unexpected iptables command %q, err:%v", cmd, err)
+	}
+
+	cmd, err = getNetworkPolicyCommand(&ebtablesPolicy, "-D")
+	if err != nil || cmd != "ebtables -t nat -D PREROUTING -p ARP -j ACCEPT" {
+		t.Errorf("Unexpected ebtables command %q, err:%v", cmd, err)
+	}
+
+	if err := validateNetworkPolicies([]policy.NetworkScopedPolicy{iptablesPolicy, ebtablesPolicy}); err != nil {
+		t.Errorf("Unexpected error validating rules: %v", err)
+	}
+
+	vsidPolicy := policy.NetworkScopedPolicy{Type: policy.VsidPolicy, Settings: json.RawMessage(`{"VSID":4096}`)}
+	if err := validateNetworkPolicies([]policy.NetworkScopedPolicy{iptablesPolicy, vsidPolicy}); err == nil {
+		t.Errorf("Expected HNS network policy to be rejected on Linux")
+	}
+}
+
+// Tests that network VLANs are validated and not shared by networks on the same interface.
+func TestNetworkVlan(t *testing.T) {
+	extIf := &externalInterface{Name: "lo", Networks: make(map[string]*network)}
+	extIf.Networks["tenant1"] = &network{Id: "tenant1", Mode: opModeBridge, VlanId: 100, extIf: extIf}
+	nm := &networkManager{ExternalInterfaces: map[string]*externalInterface{extIf.Name: extIf}}
+
+	tests := []struct {
+		mode        string
+		vlanId      int
+		expectedErr error
+	}{
+		{opModeBridge, 100, errVlanInUse},
+		{opModeBridge, 4095, errInvalidVlanID},
+		{opModeTunnel, 200, errNetworkVlanNotSupported},
+		{opModeOverlay, 200, errNetworkVlanNotSupported},
+	}
+
+	for _, test := range tests {
+		nwInfo := &NetworkInfo{
+			Id:           "tenant2",
+			Mode:         test.mode,
+			MasterIfName: "lo",
+			Subnets:      []SubnetInfo{parseSubnet("10.240.0.0/16", "10.240.0.1")},
+			VlanID:       test.vlanId,
+		}
+
+		if _, err := nm.newNetwork(nwInfo); err != test.expectedErr {
+			t.Errorf("Mode %v VLAN %v: expected %v, got %v", test.mode, test.vlanId, test.expectedErr, err)
+		}
+	}
+
+	// Endpoints whose VLAN overrides the VLAN of the network are connected to a bridge of their own.
+	nw := &network{Id: "tenant3", Mode: opModeBridge, VlanId: 300, BridgeName: "azvlbr1.300", VlanIfName: "azvl1.300", extIf: extIf}
+	for vlanId, expected := range map[int]string{300: "azvlbr1.300", 301: "azvlbr1.301"} {
+		client, ok := defaultNewEndpointClient(nw, &EndpointInfo{}, "azv0", "azv0-c", vlanId).(*LinuxBridgeEndpointClient)
+		if !ok || client.bridgeName != expected || !client.standaloneBridge {
+			t.Errorf("VLAN %v: expected standalone bridge %v, got %+v", vlanId, expected, client)
+		}
+	}
+
+	nwInfo := nw.getInfo()
+	if nwInfo.VlanID != 300 || nwInfo.BridgeName != "azvlbr1.300" {
+		t.Errorf("Unexpected network info %+v", nwInfo)
+	}
+}
+
+// parseSubnet returns a subnet with the given prefix and gateway.
+func parseSubnet(prefix string, gateway string) SubnetInfo {
+	_, ipNet, _ := net.ParseCIDR(prefix)
+	return SubnetInfo{Prefix: *ipNet, Gateway: net.ParseIP(gateway)}
+}
+
+// Tests that subnets without gateways and overlapping subnets are rejected.
+func TestValidateSubnets(t *testing.T) {
+	tests := []struct {
+		subnets     []SubnetInfo
+		expectedErr error
+	}{
+		{[]SubnetInfo{parseSubnet("10.0.0.0/24", "10.0.0.1"), parseSubnet("10.1.0.0/24", "10.1.0.1")}, nil},
+		{[]SubnetInfo{parseSubnet("10.0.0.0/24", "10.0.0.1"), parseSubnet("fd00::/64", "fd00::1")}, nil},
+		{[]SubnetInfo{parseSubnet("10.0.0.0/24", "10.0.0.1"), parseSubnet("10.1.0.0/24", "")}, errSubnetGatewayMissing},
+		{[]SubnetInfo{parseSubnet("10.0.0.0/24", "0.0.0.0")}, errSubnetGatewayMissing},
+		{[]SubnetInfo{parseSubnet("10.0.0.0/16", "10.0.0.1"), parseSubnet("10.0.1.0/24", "10.0.1.1")}, errSubnetsOverlap},
+		{[]SubnetInfo{parseSubnet("10.0.1.0/24", "10.0.1.1"), parseSubnet("10.0.0.0/16", "10.0.0.1")}, errSubnetsOverlap},
+	}
+
+	for _, test := range tests {
+		if err := validateSubnets(test.subnets); err != test.expectedErr {
+			t.Errorf("Subnets %+v: expected %v, got %v", test.subnets, test.expectedErr, err)
+		}
+	}
+}
+
+// Tests that subnets overlapping those of other networks or, for overlay networks, the prefixes of the
+// external interface are rejected unless explicitly allowed. CIDR prefixes that overlap always contain
+// one another, so partial overlaps are covered by the prefixes containing the existing subnet.
+func TestCheckSubnetsInUse(t *testing.T) {
+	_, hostPrefix, _ := net.ParseCIDR("192.168.0.4/24")
+	extIf := &externalInterface{Name: "lo", Networks: make(map[string]*network), IPAddresses: []*net.IPNet{hostPrefix}}
+	extIf.Networks["tenant1"] = &network{
+		Id:      "tenant1",
+		Mode:    opModeBridge,
+		Subnets: []SubnetInfo{parseSubnet("10.240.0.0/16", "10.240.0.1"), parseSubnet("fd00:10::/64", "fd00:10::1")},
+		extIf:   extIf,
+	}
+	nm := &networkManager{ExternalInterfaces: map[string]*externalInterface{extIf.Name: extIf}}
+
+	tests := []struct {
+		mode       string
+		prefix     string
+		expectedNw string
+	}{
+		{opModeBridge, "10.240.0.0/16", "tenant1"},
+		{opModeBridge, "10.240.8.0/24", "tenant1"},
+		{opModeBridge, "10.0.0.0/8", "tenant1"},
+		{opModeBridge, "10.241.0.0/16", ""},
+		{opModeBridge, "fd00:10::/64", "tenant1"},
+		{opModeBridge, "fd00:10::/80", "tenant1"},
+		{opModeBridge, "fd00::/16", "tenant1"},
+		{opModeBridge, "fd00:11::/64", ""},
+		{opModeBridge, "192.168.0.0/16", ""},
+		{opModeOverlay, "192.168.0.0/16", "lo"},
+		{opModeOverlay, "192.168.0.128/25", "lo"},
+		{opModeOverlay, "192.169.0.0/16", ""},
+	}
+
+	for _, test := range tests {
+		_, ipNet, _ := net.ParseCIDR(test.prefix)
+		err := nm.checkSubnetsInUse("tenant2", test.mode, extIf, []SubnetInfo{{Prefix: *ipNet}})
+		if test.expectedNw == "" {
+			if err != nil {
+				t.Errorf("Mode %v subnet %v: unexpected error %v", test.mode, test.prefix, err)
+			}
+		} else if !errors.Is(err, ErrSubnetInUse) || !strings.Contains(err.Error(), test.expectedNw) {
+			t.Errorf("Mode %v subnet %v: expected conflict with %v, got %v", test.mode, test.prefix, test.expectedNw, err)
+		}
+	}
+
+	// The network itself is not a conflict when subnets are added to it.
+	if err := nm.checkSubnetsInUse("tenant1", opModeBridge, extIf, []SubnetInfo{parseSubnet("10.240.0.0/16", "10.240.0.1")}); err != nil {
+		t.Errorf("Unexpected conflict with the network itself: %v", err)
+	}
+
+	nwInfo := &NetworkInfo{
+		Id:           "tenant2",
+		Mode:         opModeTunnel,
+		MasterIfName: "lo",
+		Subnets:      []SubnetInfo{parseSubnet("10.240.0.0/16", "10.240.0.1")},
+		VlanID:       200,
+	}
+
+	if _, err := nm.newNetwork(nwInfo); !errors.Is(err, ErrSubnetInUse) {
+		t.Errorf("Expected ErrSubnetInUse, got %v", err)
+	}
+
+	// The override skips the check, so creation fails later on the unsupported VLAN instead.
+	nwInfo.AllowOverlappingSubnets = true
+	if _, err := nm.newNetwork(nwInfo); err != errNetworkVlanNotSupported {
+		t.Errorf("Expected %v with overlapping subnets allowed, got %v", errNetworkVlanNotSupported, err)
+	}
+}
+
+// Tests that endpoint addresses take the prefix length and gateway of the subnet they belong to.
+func TestGetSubnetAddresses(t *testing.T) {
+	nw := &network{
+		Subnets: []SubnetInfo{parseSubnet("10.0.0.0/24", "10.0.0.1"), parseSubnet("10.1.0.0/16", "10.1.0.1")},
+	}
+
+	ipAddresses := []net.IPNet{
+		{IP: net.ParseIP("10.1.2.3"), Mask: net.CIDRMask(32, 32)},
+		{IP: net.ParseIP("192.168.0.4"), Mask: net.CIDRMask(32, 32)},
+	}
+
+	addresses := nw.getSubnetAddresses(ipAddresses)
+	if ones, _ := addresses[0].Mask.Size(); ones != 16 {
+		t.Errorf("Expected prefix length of secondary subnet, got %v", addresses[0].String())
+	}
+
+	if ones, _ := addresses[1].Mask.Size(); ones != 32 {
+		t.Errorf("Expected address outside the subnets to be unchanged, got %v", addresses[1].String())
+	}
+
+	if ones, _ := ipAddresses[0].Mask.Size(); ones != 32 {
+		t.Errorf("Input addresses were modified")
+	}
+
+	if gateway := nw.getSubnetGateway(addresses, platform.AfINET); !gateway.Equal(net.ParseIP("10.1.0.1")) {
+		t.Errorf("Expected secondary subnet gateway, got %v", gateway)
+	}
+
+	if gateway := nw.getSubnetGateway(addresses, platform.AfINET6); gateway != nil {
+		t.Errorf("Expected no IPv6 gateway, got %v", gateway)
+	}
+}
+
+// Tests that only subnets without host addresses or the host gateway are served by the bridge.
+func TestGetSecondarySubnets(t *testing.T) {
+	_, hostAddr, _ := net.ParseCIDR("10.0.0.4/24")
+	extIf := &externalInterface{
+		IPAddresses: []*net.IPNet{{IP: net.ParseIP("10.0.0.4"), Mask: hostAddr.Mask}},
+		IPv4Gateway: net.ParseIP("10.0.0.1"),
+		IPv6Gateway: net.IPv6unspecified,
+	}
+
+	subnets := []SubnetInfo{
+		parseSubnet("10.0.0.0/24", "10.0.0.1"),
+		parseSubnet("10.1.0.0/24", "10.1.0.1"),
+		parseSubnet("10.2.0.0/24", "10.0.0.1"),
+	}
+
+	secondarySubnets := getSecondarySubnets(extIf, subnets)
+	if len(secondarySubnets) != 1 || secondarySubnets[0].Prefix.String() != "10.1.0.0/24" {
+		t.Errorf("Unexpected secondary subnets %+v", secondarySubnets)
+	}
+}
+
+// Tests that the gateway of the subnet containing an interface address is selected for source routing.
+func TestGetInterfaceGateway(t *testing.T) {
+	_, hostAddr, _ := net.ParseCIDR("10.1.0.4/24")
+	extIf := &externalInterface{
+		IPAddresses: []*net.IPNet{{IP: net.ParseIP("10.1.0.4"), Mask: hostAddr.Mask}},
+	}
+
+	subnets := []SubnetInfo{
+		parseSubnet("10.2.0.0/24", "10.2.0.1"),
+		parseSubnet("10.1.0.0/24", "10.1.0.1"),
+	}
+
+	gateway := getInterfaceGateway(extIf, subnets, unix.AF_INET)
+	if !gateway.Equal(net.ParseIP("10.1.0.1")) {
+		t.Errorf("Expected gateway 10.1.0.1, got %v", gateway)
+	}
+
+	if gateway := getInterfaceGateway(extIf, subnets, unix.AF_INET6); gateway != nil {
+		t.Errorf("Expected no IPv6 gateway, got %v", gateway)
+	}
+
+	if gateway := getInterfaceGateway(extIf, subnets[:1], unix.AF_INET); gateway != nil {
+		t.Errorf("Expected no gateway for subnets without interface addresses, got %v", gateway)
+	}
+}
+
+// Tests that network and endpoint queries are filtered, sorted and return deep copies.
+func TestGetEndpointInfos(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+	nw := &network{
+		Id:      "nw",
+		Mode:    opModeBridge,
+		Subnets: []SubnetInfo{{Prefix: *subnet, Gateway: net.ParseIP("10.0.0.1")}},
+		Endpoints: map[string]*endpoint{
+			"ep2": {Id: "ep2", ContainerID: "c1", IfName: "eth1"},
+			"ep1": {Id: "ep1", ContainerID: "c1", IfName: "eth0", IPAddresses: []net.IPNet{{IP: net.ParseIP("10.0.0.4"), Mask: subnet.Mask}}},
+			"ep3": {Id: "ep3", ContainerID: "c2", IfName: "eth0"},
+		},
+	}
+	extIf := &externalInterface{Name: "eth0", Networks: map[string]*network{nw.Id: nw}}
+	nw.extIf = extIf
+
+	nm := &networkManager{ExternalInterfaces: map[string]*externalInterface{extIf.Name: extIf}}
+
+	nwInfos, err := nm.GetNetworkInfos()
+	if err != nil || len(nwInfos) != 1 || nwInfos[0].Id != nw.Id {
+		t.Fatalf("Unexpected networks %+v, err:%v", nwInfos, err)
+	}
+
+	nwInfos[0].Subnets[0].Gateway[15] = 254
+	if !nw.Subnets[0].Gateway.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("Network info shares memory with the network")
+	}
+
+	tests := []struct {
+		filter      *EndpointFilter
+		endpointIds []string
+	}{
+		{nil, []string{"ep1", "ep2", "ep3"}},
+		{&EndpointFilter{ContainerID: "c1"}, []string{"ep1", "ep2"}},
+		{&EndpointFilter{IfName: "eth0"}, []string{"ep1", "ep3"}},
+		{&EndpointFilter{ContainerID: "c1", IfName: "eth0"}, []string{"ep1"}},
+		{&EndpointFilter{ContainerID: "c3"}, nil},
+	}
+
+	for _, test := range tests {
+		epInfos, err := nm.GetEndpointInfos(nw.Id, test.filter)
+		if err != nil {
+			t.Fatalf("Failed to get endpoints: %v", err)
+		}
+
+		var endpointIds []string
+		for _, epInfo := range epInfos {
+			endpointIds = append(endpointIds, epInfo.Id)
+		}
+
+		if !reflect.DeepEqual(endpointIds, test.endpointIds) {
+			t.Errorf("Filter %+v: expected %v, got %v", test.filter, test.endpointIds, endpointIds)
+		}
+	}
+
+	epInfos, _ := nm.GetEndpointInfos(nw.Id, &EndpointFilter{ContainerID: "c1", IfName: "eth0"})
+	epInfos[0].IPAddresses[0].IP[15] = 5
+	if !nw.Endpoints["ep1"].IPAddresses[0].IP.Equal(net.ParseIP("10.0.0.4")) {
+		t.Errorf("Endpoint info shares memory with the endpoint")
+	}
+
+	if _, err := nm.GetEndpointInfos("missing", nil); err != ErrNetworkNotFound {
+		t.Errorf("Expected %v, got %v", ErrNetworkNotFound, err)
+	}
+}
+
+// Tests that endpoints inherit the network DNS settings they do not set themselves.
+func TestDNSInfoInherit(t *testing.T) {
+	nwDNS := DNSInfo{Suffix: "nw.local", Suffixes: []string{"nw.local", "local"}, Servers: []string{"10.0.0.10"}}
+
+	tests := []struct {
+		epDNS    DNSInfo
+		expected DNSInfo
+	}{
+		{DNSInfo{}, nwDNS},
+		{DNSInfo{Servers: []string{"10.0.0.20"}}, DNSInfo{Suffix: "nw.local", Suffixes: []string{"nw.local", "local"}, Servers: []string{"10.0.0.20"}}},
+		{DNSInfo{Suffix: "ep.local"}, DNSInfo{Suffix: "ep.local", Servers: []string{"10.0.0.10"}}},
+		{DNSInfo{Suffixes: []string{"ep.local"}, Servers: []string{"10.0.0.20"}}, DNSInfo{Suffixes: []string{"ep.local"}, Servers: []string{"10.0.0.20"}}},
+	}
+
+	for _, test := range tests {
+		if dns := test.epDNS.inherit(nwDNS); !reflect.DeepEqual(dns, test.expected) {
+			t.Errorf("Endpoint DNS %+v: expected %+v, got %+v", test.epDNS, test.expected, dns)
+		}
+	}
+
+	// Without network DNS settings the endpoint settings are unchanged.
+	if dns := (DNSInfo{}).inherit(DNSInfo{}); !reflect.DeepEqual(dns, DNSInfo{}) {
+		t.Errorf("Expected empty DNS settings, got %+v", dns)
+	}
+}
+
+// Tests that the search domains of a network precede those of its endpoints, without duplicates.
+func TestGetSearchDomains(t *testing.T) {
+	nw := &network{SearchDomains: []string{"vnet.internal", "corp.local"}}
+
+	tests := []struct {
+		epDNS    DNSInfo
+		expected []string
+	}{
+		{DNSInfo{}, []string{"vnet.internal", "corp.local"}},
+		{DNSInfo{Suffix: "default.svc.cluster.local"}, []string{"vnet.internal", "corp.local", "default.svc.cluster.local"}},
+		{DNSInfo{Suffixes: []string{"svc.cluster.local", "Corp.Local.", "vnet.internal"}}, []string{"vnet.internal", "corp.local", "svc.cluster.local"}},
+		{DNSInfo{Suffixes: []string{"a.local", "b.local", "c.local", "d.local", "e.local"}}, []string{"vnet.internal", "corp.local", "a.local", "b.local", "c.local", "d.local"}},
+	}
+
+	for _, test := range tests {
+		if domains := nw.getSearchDomains(test.epDNS); !reflect.DeepEqual(domains, test.expected) {
+			t.Errorf("Endpoint DNS %+v: expected %v, got %v", test.epDNS, test.expected, domains)
+		}
+	}
+
+	// Endpoint information without search domains falls back to the endpoint suffixes.
+	epInfo := &EndpointInfo{DNS: DNSInfo{Suffix: "ep.local"}}
+	if domains := epInfo.GetSearchDomains(); !reflect.DeepEqual(domains, []string{"ep.local"}) {
+		t.Errorf("Expected endpoint suffix, got %v", domains)
+	}
+}
+
+// Tests that external interfaces are selected by name, MAC address and name pattern.
+func TestSelectExternalInterface(t *testing.T) {
+	mac0, _ := net.ParseMAC("00:0d:3a:00:00:00")
+	mac1, _ := net.ParseMAC("00:0d:3a:00:00:01")
+	nm := &networkManager{
+		ExternalInterfaces: map[string]*externalInterface{
+			"eth0": {Name: "eth0", MacAddress: mac0, Subnets: []string{"10.0.0.0/24"}},
+			"eth1": {Name: "eth1", MacAddress: mac1, Subnets: []string{"10.0.0.0/24"}},
+		},
+	}
+
+	tests := []struct {
+		nwInfo   NetworkInfo
+		expected string
+	}{
+		{NetworkInfo{MasterIfName: "eth1"}, "eth1"},
+		{NetworkInfo{MasterIfMacAddress: mac1}, "eth1"},
+		{NetworkInfo{MasterIfNamePattern: "eth*", MasterIfMacAddress: mac0}, "eth0"},
+		{NetworkInfo{MasterIfNamePattern: "*1"}, "eth1"},
+		{NetworkInfo{MasterIfName: "eth0", MasterIfMacAddress: mac1}, ""},
+		{NetworkInfo{MasterIfNamePattern: "eth*"}, ""},
+		{NetworkInfo{MasterIfNamePattern: "wlan*"}, ""},
+		{NetworkInfo{MasterIfNamePattern: "eth["}, ""},
+	}
+
+	for _, test := range tests {
+		extIf, err := nm.selectExternalInterface(&test.nwInfo)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("Selectors %+v: expected an error, got %v", test.nwInfo, extIf.Name)
+			}
+		} else if err != nil || extIf.Name != test.expected {
+			t.Errorf("Selectors %+v: expected %v, got %v err:%v", test.nwInfo, test.expected, extIf, err)
+		}
+	}
+
+	// Errors list the candidate interfaces.
+	_, err := nm.selectExternalInterface(&NetworkInfo{MasterIfName: "eth2"})
+	if err == nil || !strings.Contains(err.Error(), "eth0 (00:0d:3a:00:00:00), eth1 (00:0d:3a:00:00:01)") {
+		t.Errorf("Expected candidates in error, got %v", err)
+	}
+}
+
+// Tests that the address of an external interface in the requested subnet is selected and persisted.
+func TestNewExternalInterface(t *testing.T) {
+	nm := &networkManager{ExternalInterfaces: make(map[string]*externalInterface)}
+
+	if err := nm.newExternalInterface("lo", "127.0.0.0/16"); err != nil {
+		t.Fatalf("Failed to add external interface: %v", err)
+	}
+
+	extIf := nm.ExternalInterfaces["lo"]
+	if address := extIf.SubnetIPs["127.0.0.0/16"]; address == nil || address.String() != "127.0.0.1/8" {
+		t.Errorf("Unexpected address %v selected", address)
+	}
+
+	if ip := extIf.getPrimaryIPAddress(); !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Unexpected primary address %v", ip)
+	}
+
+	// Errors list the candidate addresses.
+	err := nm.newExternalInterface("lo", "10.0.0.0/24")
+	if err == nil || !strings.Contains(err.Error(), "127.0.0.1/8") {
+		t.Errorf("Expected candidates in error, got %v", err)
+	}
+
+	if len(extIf.Subnets) != 1 {
+		t.Errorf("Expected only the matching subnet to be added, got %v", extIf.Subnets)
+	}
+}
+
+// Tests that the address whose prefix equals or most closely contains the subnet is selected.
+func TestSelectSubnetAddress(t *testing.T) {
+	_, primary, _ := net.ParseCIDR("10.0.0.4/16")
+	_, secondary, _ := net.ParseCIDR("10.0.1.4/24")
+	_, other, _ := net.ParseCIDR("10.1.0.4/24")
+	_, ipv6, _ := net.ParseCIDR("fd00::4/64")
+	candidates := []*net.IPNet{primary, secondary, other, ipv6}
+
+	tests := []struct {
+		subnet   string
+		expected *net.IPNet
+	}{
+		{"10.0.1.0/24", secondary},
+		{"10.0.2.0/24", primary},
+		{"10.0.0.0/16", primary},
+		{"10.1.0.0/24", other},
+		{"10.1.0.0/16", nil},
+		{"fd00::/64", ipv6},
+		{"192.168.0.0/24", nil},
+	}
+
+	for _, test := range tests {
+		_, subnet, _ := net.ParseCIDR(test.subnet)
+		address := selectSubnetAddress(candidates, subnet)
+		if (address == nil) != (test.expected == nil) || (address != nil && address.String() != test.expected.String()) {
+			t.Errorf("Subnet %v: expected %v, got %v", test.subnet, test.expected, address)
+		}
+	}
+}
@@ -5,6 +5,9 @@ package network
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -18,15 +21,39 @@ const (
 	// HNS network types.
 	hnsL2bridge      = "l2bridge"
 	hnsL2tunnel      = "l2tunnel"
+	hnsTransparent   = "transparent"
+	hnsOverlay       = "overlay"
 	CnetAddressSpace = "cnetAddressSpace"
 )
 
+// HNS network types of the network modes.
+var hnsNetworkTypes = map[string]string{
+	opModeBridge:      hnsL2bridge,
+	opModeTunnel:      hnsL2tunnel,
+	opModeTransparent: hnsTransparent,
+	opModeOverlay:     hnsOverlay,
+}
+
+// Minimum HNS version that supports overlay networks, Windows Server version 1803.
+var overlayMinHNSVersion = hcsshim.HNSVersion1803
+
+// Minimum HNS version that can add subnets to an existing network.
+var updateNetworkMinHNSVersion = hcsshim.HNSVersion{Major: 9, Minor: 2}
+
+// Names of endpoints created by ConstructEndpointID, a truncated container ID followed by the interface name.
+var endpointNameRegex = regexp.MustCompile(`^[0-9a-fA-F]{1,8}-\S+$`)
+
 // Windows implementation of route.
 type route interface{}
 
 // NewNetworkImpl creates a new container network.
 func (nm *networkManager) newNetworkImpl(nwInfo *NetworkInfo, extIf *externalInterface) (*network, error) {
 	var vlanid int
+
+	if nwInfo.Mode == opModeNone {
+		return newNoneNetwork(nwInfo, extIf), nil
+	}
+
 	networkAdapterName := extIf.Name
 	// FixMe: Find a better way to check if a nic that is selected is not part of a vSwitch
 	if strings.HasPrefix(networkAdapterName, "vEthernet") {
@@ -40,30 +67,37 @@ func (nm *networkManager) newNetworkImpl(nwInfo *NetworkInfo, extIf *externalInt
 		Policies:           policy.SerializePolicies(policy.NetworkPolicy, nwInfo.Policies, nil),
 	}
 
-	// Set the VLAN and OutboundNAT policies
+	// Add the network scoped policies.
+	networkPolicies, err := policy.SerializeNetworkScopedPolicies(nwInfo.NetworkPolicies)
+	if err != nil {
+		return nil, err
+	}
+	hnsNetwork.Policies = append(hnsNetwork.Policies, networkPolicies...)
+
+	// Set the VLAN and OutboundNAT policies. The VLAN of the network takes precedence over the option.
+	vlanid = nwInfo.VlanID
 	opt, _ := nwInfo.Options[genericData].(map[string]interface{})
-	if opt != nil && opt[VlanIDKey] != nil {
+	if vlanid == 0 && opt != nil && opt[VlanIDKey] != nil {
+		vlanID, _ := strconv.ParseUint(opt[VlanIDKey].(string), 10, 32)
+		vlanid = int(vlanID)
+	}
+
+	if vlanid != 0 {
 		vlanPolicy := hcsshim.VlanPolicy{
 			Type: "VLAN",
+			VLAN: uint(vlanid),
 		}
-		vlanID, _ := strconv.ParseUint(opt[VlanIDKey].(string), 10, 32)
-		vlanPolicy.VLAN = uint(vlanID)
 
 		serializedVlanPolicy, _ := json.Marshal(vlanPolicy)
 		hnsNetwork.Policies = append(hnsNetwork.Policies, serializedVlanPolicy)
-
-		vlanid = (int)(vlanPolicy.VLAN)
 	}
 
-	// Set network mode.
-	switch nwInfo.Mode {
-	case opModeBridge:
-		hnsNetwork.Type = hnsL2bridge
-	case opModeTunnel:
-		hnsNetwork.Type = hnsL2tunnel
-	default:
-		return nil, errNetworkModeInvalid
+	// Set network type.
+	hnsNetworkType, err := getHNSNetworkType(nwInfo.Mode)
+	if err != nil {
+		return nil, err
 	}
+	hnsNetwork.Type = hnsNetworkType
 
 	// Populate subnets.
 	for _, subnet := range nwInfo.Subnets {
@@ -76,20 +110,29 @@ func (nm *networkManager) newNetworkImpl(nwInfo *NetworkInfo, extIf *externalInt
 	}
 
 	// Marshal the request.
-	buffer, err := json.Marshal(hnsNetwork)
+	buffer, err := json.Marshal(&hnsNetworkRequest{HNSNetwork: hnsNetwork, MTU: nwInfo.MTU})
 	if err != nil {
 		return nil, err
 	}
 	hnsRequest := string(buffer)
 
-	// Create the HNS network.
-	log.Printf("[net] HNSNetworkRequest POST request:%+v", hnsRequest)
-	hnsResponse, err := hcsshim.HNSNetworkRequest("POST", "", hnsRequest)
-	log.Printf("[net] HNSNetworkRequest POST response:%+v err:%v.", hnsResponse, err)
+	// Adopt the network left behind by a previous create request that timed out, if any.
+	hnsResponse, err := getReusableHNSNetwork(hnsNetwork, nwInfo.HNSTimeout)
 	if err != nil {
 		return nil, err
 	}
 
+	created := hnsResponse == nil
+	if created {
+		// Create the HNS network.
+		log.Printf("[net] HNSNetworkRequest POST request:%+v", hnsRequest)
+		hnsResponse, err = networkRequestWithTimeout(nwInfo.HNSTimeout, "POST", "", hnsRequest)
+		log.Printf("[net] HNSNetworkRequest POST response:%+v err:%v.", hnsResponse, err)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Create the network object.
 	nw := &network{
 		Id:               nwInfo.Id,
@@ -98,10 +141,19 @@ func (nm *networkManager) newNetworkImpl(nwInfo *NetworkInfo, extIf *externalInt
 		Endpoints:        make(map[string]*endpoint),
 		extIf:            extIf,
 		VlanId:           vlanid,
+		DNS:              nwInfo.DNS,
 		EnableSnatOnHost: nwInfo.EnableSnatOnHost,
+		EnableHNSV2:      nwInfo.EnableHNSV2,
+		MTU:              nwInfo.MTU,
+		HNSTimeout:       nwInfo.HNSTimeout,
+		RetryPolicy:      nwInfo.RetryPolicy,
 	}
 
-	globals, err := hcsshim.GetHNSGlobals()
+	if !created {
+		return nw, nil
+	}
+
+	globals, err := hns.GetGlobals()
 	if err != nil || globals.Version.Major <= hcsshim.HNSVersion1803.Major {
 		// err would be not nil for windows 1709 & below
 		// Sleep for 10 seconds as a workaround for windows 1803 & below
@@ -112,15 +164,312 @@ func (nm *networkManager) newNetworkImpl(nwInfo *NetworkInfo, extIf *externalInt
 	return nw, nil
 }
 
+// getReusableHNSNetwork returns the HNS network with the name of the requested network, which a previous
+// create request that timed out may have created. A network of another type or without all requested
+// subnets is a partial creation and is deleted so that it can be created again.
+func getReusableHNSNetwork(hnsNetwork *hcsshim.HNSNetwork, timeout time.Duration) (*hcsshim.HNSNetwork, error) {
+	var existing *hcsshim.HNSNetwork
+	err := callHNSWithTimeout(timeout, func() error {
+		var err error
+		existing, err = hns.GetNetworkByName(hnsNetwork.Name)
+		return err
+	})
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil, nil
+		}
+
+		if IsHNSTimeoutError(err) {
+			return nil, err
+		}
+
+		log.Printf("[net] Failed to query HNS network %v, err:%v.", hnsNetwork.Name, err)
+		return nil, nil
+	}
+
+	if strings.EqualFold(existing.Type, hnsNetwork.Type) && hasHNSSubnets(existing, hnsNetwork.Subnets) {
+		log.Printf("[net] Adopting existing HNS network %v %v.", existing.Name, existing.Id)
+		return existing, nil
+	}
+
+	log.Printf("[net] Deleting partially created HNS network %v %v.", existing.Name, existing.Id)
+	hnsResponse, err := networkRequestWithTimeout(timeout, "DELETE", existing.Id, "")
+	log.Printf("[net] HNSNetworkRequest DELETE response:%+v err:%v.", hnsResponse, err)
+	if err != nil && !isNotFoundError(err) {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// hasHNSSubnets returns true if the HNS network has all the given subnets.
+func hasHNSSubnets(hnsNetwork *hcsshim.HNSNetwork, subnets []hcsshim.Subnet) bool {
+	prefixes := make(map[string]bool)
+	for _, hnsSubnet := range hnsNetwork.Subnets {
+		if _, prefix, err := net.ParseCIDR(hnsSubnet.AddressPrefix); err == nil {
+			prefixes[prefix.String()] = true
+		}
+	}
+
+	for _, subnet := range subnets {
+		_, prefix, err := net.ParseCIDR(subnet.AddressPrefix)
+		if err != nil || !prefixes[prefix.String()] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// networkRequestWithTimeout makes an HNS network request and stops waiting for it once the timeout expires.
+func networkRequestWithTimeout(timeout time.Duration, method, path, request string) (*hcsshim.HNSNetwork, error) {
+	var hnsNetwork *hcsshim.HNSNetwork
+	err := callHNSWithTimeout(timeout, func() error {
+		var err error
+		hnsNetwork, err = hns.NetworkRequest(method, path, request)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hnsNetwork, nil
+}
+
+// hnsNetworkRequest is the body of an HNS network create request. It adds the fields
+// that hcsshim.HNSNetwork does not expose.
+type hnsNetworkRequest struct {
+	*hcsshim.HNSNetwork
+	MTU int `json:",omitempty"`
+}
+
+// getHNSNetworkType returns the HNS network type of a network mode, or an error if
+// the mode is not supported by HNS on this OS build.
+func getHNSNetworkType(mode string) (string, error) {
+	hnsNetworkType, ok := hnsNetworkTypes[mode]
+	if !ok {
+		return "", errNetworkModeInvalid
+	}
+
+	if mode == opModeOverlay {
+		globals, err := hns.GetGlobals()
+		if err != nil {
+			log.Printf("[net] Failed to query HNS version: %v.", err)
+			return "", errOverlayNotSupported
+		}
+
+		if !isHNSVersionAtLeast(globals.Version, overlayMinHNSVersion) {
+			log.Printf("[net] HNS version %+v does not support overlay networks.", globals.Version)
+			return "", errOverlayNotSupported
+		}
+	}
+
+	return hnsNetworkType, nil
+}
+
+// isHNSVersionAtLeast returns true if the HNS version is the same as or newer than the minimum version.
+func isHNSVersionAtLeast(version hcsshim.HNSVersion, minVersion hcsshim.HNSVersion) bool {
+	return version.Major > minVersion.Major ||
+		(version.Major == minVersion.Major && version.Minor >= minVersion.Minor)
+}
+
+// updateNetworkImpl adds subnets to the HNS network of an existing container network.
+func (nm *networkManager) updateNetworkImpl(nw *network, subnets []SubnetInfo) error {
+	if nw.Mode == opModeNone {
+		return nil
+	}
+
+	globals, err := hns.GetGlobals()
+	if err != nil {
+		log.Printf("[net] Failed to query HNS version: %v.", err)
+		return errNetworkUpdateNotSupported
+	}
+
+	if !isHNSVersionAtLeast(globals.Version, updateNetworkMinHNSVersion) {
+		log.Printf("[net] HNS version %+v does not support adding subnets to networks.", globals.Version)
+		return errNetworkUpdateNotSupported
+	}
+
+	// HNS replaces the subnets of the network with the requested ones.
+	hnsNetwork := &hcsshim.HNSNetwork{}
+	for _, subnet := range append(append([]SubnetInfo(nil), nw.Subnets...), subnets...) {
+		hnsNetwork.Subnets = append(hnsNetwork.Subnets, hcsshim.Subnet{
+			AddressPrefix:  subnet.Prefix.String(),
+			GatewayAddress: subnet.Gateway.String(),
+		})
+	}
+
+	buffer, err := json.Marshal(hnsNetwork)
+	if err != nil {
+		return err
+	}
+	hnsRequest := string(buffer)
+
+	log.Printf("[net] HNSNetworkRequest POST id:%v request:%+v", nw.HnsId, hnsRequest)
+	hnsResponse, err := networkRequestWithTimeout(nw.HNSTimeout, "POST", nw.HnsId, hnsRequest)
+	log.Printf("[net] HNSNetworkRequest POST response:%+v err:%v.", hnsResponse, err)
+	if err != nil {
+		return err
+	}
+
+	if !hasHNSSubnets(hnsResponse, hnsNetwork.Subnets) {
+		return fmt.Errorf("HNS network %v did not add the requested subnets", nw.HnsId)
+	}
+
+	return nil
+}
+
 // DeleteNetworkImpl deletes an existing container network.
 func (nm *networkManager) deleteNetworkImpl(nw *network) error {
+	if nw.Mode == opModeNone {
+		return nil
+	}
+
 	// Delete the HNS network.
 	log.Printf("[net] HNSNetworkRequest DELETE id:%v", nw.HnsId)
-	hnsResponse, err := hcsshim.HNSNetworkRequest("DELETE", nw.HnsId, "")
+	hnsResponse, err := networkRequestWithTimeout(nw.HNSTimeout, "DELETE", nw.HnsId, "")
 	log.Printf("[net] HNSNetworkRequest DELETE response:%+v err:%v.", hnsResponse, err)
 
 	return err
 }
 
+// networkExistsImpl returns whether the HNS network of a network still exists.
+func (nm *networkManager) networkExistsImpl(nw *network) (bool, error) {
+	if nw.Mode == opModeNone {
+		return true, nil
+	}
+
+	log.Printf("[net] HNSNetworkRequest GET id:%v", nw.HnsId)
+	hnsResponse, err := hns.NetworkRequest("GET", nw.HnsId, "")
+	log.Printf("[net] HNSNetworkRequest GET response:%+v err:%v.", hnsResponse, err)
+	if err != nil {
+		if isNotFoundError(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
 func getNetworkInfoImpl(nwInfo *NetworkInfo, nw *network) {
+	nwInfo.VlanID = nw.VlanId
+}
+
+// listEndpointResourcesImpl returns the lowercase IDs of the HNS endpoints.
+func listEndpointResourcesImpl() (map[string]bool, error) {
+	var hnsEndpoints []hcsshim.HNSEndpoint
+	err := callHNSWithTimeout(0, func() error {
+		var err error
+		hnsEndpoints, err = hns.ListEndpointRequest()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resources := make(map[string]bool)
+	for _, hnsEndpoint := range hnsEndpoints {
+		resources[strings.ToLower(hnsEndpoint.Id)] = true
+	}
+
+	return resources, nil
+}
+
+// checkResourcesImpl returns an error if the HNS endpoint of the endpoint no longer exists.
+func (ep *endpoint) checkResourcesImpl(resources map[string]bool) error {
+	if ep.HnsId != "" && !resources[strings.ToLower(ep.HnsId)] {
+		return fmt.Errorf("HNS endpoint %v no longer exists", ep.HnsId)
+	}
+
+	return nil
+}
+
+// reconcileEndpointsImpl deletes HNS endpoints that were created by this plugin in one of its
+// networks but are no longer tracked in the persisted state.
+func (nm *networkManager) reconcileEndpointsImpl(dryRun bool) error {
+	orphans, err := nm.findOrphanedResourcesImpl()
+	if err != nil {
+		log.Printf("[net] Failed to list HNS endpoints, err:%v.", err)
+		return err
+	}
+
+	var failures []string
+	for hnsId, reason := range orphans {
+		if dryRun {
+			log.Printf("[net] Found orphaned HNS endpoint %v: %v.", hnsId, reason)
+			continue
+		}
+
+		log.Printf("[net] Deleting orphaned HNS endpoint %v: %v.", hnsId, reason)
+		if err := deleteHNSEndpointWithTimeout(0, hnsAPIVersionV1, hnsId); err != nil && !isNotFoundError(err) {
+			failures = append(failures, fmt.Sprintf("%v: %v", hnsId, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("Failed to delete %v orphaned HNS endpoints: %v", len(failures), strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+// findOrphanedResourcesImpl returns the HNS endpoints that were created by this plugin in one of its
+// networks but are no longer tracked in the persisted state, with the reason for each.
+// The caller holds the manager lock.
+func (nm *networkManager) findOrphanedResourcesImpl() (map[string]string, error) {
+	var hnsEndpoints []hcsshim.HNSEndpoint
+	err := callHNSWithTimeout(0, func() error {
+		var err error
+		hnsEndpoints, err = hns.ListEndpointRequest()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := make(map[string]string)
+	for _, extIf := range nm.ExternalInterfaces {
+		for _, nw := range extIf.Networks {
+			knownEndpoints := make(map[string]bool)
+			nw.lock.Lock()
+			for _, ep := range nw.Endpoints {
+				knownEndpoints[strings.ToLower(ep.HnsId)] = true
+			}
+			nw.lock.Unlock()
+
+			for _, hnsEndpoint := range hnsEndpoints {
+				// Skip endpoints of other networks, tracked endpoints and endpoints created by other agents.
+				if !strings.EqualFold(hnsEndpoint.VirtualNetwork, nw.HnsId) ||
+					knownEndpoints[strings.ToLower(hnsEndpoint.Id)] ||
+					!endpointNameRegex.MatchString(hnsEndpoint.Name) {
+					continue
+				}
+
+				orphans[hnsEndpoint.Id] = fmt.Sprintf("no endpoint of network %v owns it (name %v)", nw.Id, hnsEndpoint.Name)
+			}
+		}
+	}
+
+	return orphans, nil
+}
+
+// addRemoteEndpointImpl is not supported, HNS overlay networks manage their remote endpoints themselves.
+func (nw *network) addRemoteEndpointImpl(remoteEp *RemoteEndpointInfo) error {
+	return errRemoteEndpointNotSupported
+}
+
+// deleteRemoteEndpointImpl does nothing, since remote endpoints are never added on Windows.
+func (nw *network) deleteRemoteEndpointImpl(remoteEp *RemoteEndpointInfo) {
+}
+
+// deleteRemoteNodeImpl does nothing, since remote endpoints are never added on Windows.
+func (nw *network) deleteRemoteNodeImpl(nodeIP net.IP) {
+}
+
+// isNetworkPolicySupported returns true if HNS applies the network policy, which is the case for all
+// policies but Linux rules.
+func isNetworkPolicySupported(networkPolicy *policy.NetworkScopedPolicy) bool {
+	return !networkPolicy.IsRule()
 }
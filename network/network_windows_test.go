@@ -0,0 +1,522 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-container-networking/network/policy"
+	"github.com/Microsoft/hcsshim"
+)
+
+// createTestNetworkManager creates a network manager with a single network on an external interface.
+func createTestNetworkManager(nw *network) *networkManager {
+	extIf := &externalInterface{
+		Name:     "Ethernet",
+		Networks: map[string]*network{nw.Id: nw},
+	}
+	nw.extIf = extIf
+	nw.Mode = opModeBridge
+
+	return &networkManager{ExternalInterfaces: map[string]*externalInterface{extIf.Name: extIf}}
+}
+
+// Tests that the network MTU is passed to HNS and kept in the network state.
+func TestNewNetworkMTU(t *testing.T) {
+	defer func() { hns = hcsshimClient{} }()
+	fake := newFakeHnsClient()
+
+	nwInfo := &NetworkInfo{Id: "mtu", Mode: opModeBridge, MTU: 1400}
+	nm := &networkManager{ExternalInterfaces: make(map[string]*externalInterface)}
+	nw, err := nm.newNetworkImpl(nwInfo, &externalInterface{Name: "Ethernet"})
+	if err != nil {
+		t.Fatalf("Failed to create network: %v", err)
+	}
+
+	var request map[string]interface{}
+	if err := json.Unmarshal([]byte(fake.lastNetworkRequest), &request); err != nil {
+		t.Fatalf("Failed to decode network request: %v", err)
+	}
+
+	if request["MTU"] != float64(1400) || nw.MTU != 1400 {
+		t.Errorf("Expected MTU 1400, got request:%v network:%v", request["MTU"], nw.MTU)
+	}
+
+	if request["Name"] != nwInfo.Id {
+		t.Errorf("Expected HNS network fields in request, got %v", fake.lastNetworkRequest)
+	}
+}
+
+// Tests that network scoped policies are added to the HNS network and that Linux rules are rejected.
+func TestNewNetworkPolicies(t *testing.T) {
+	defer func() { hns = hcsshimClient{} }()
+	fake := newFakeHnsClient()
+
+	nwInfo := createTestNetworkInfo("policies")
+	nwInfo.NetworkPolicies = []policy.NetworkScopedPolicy{
+		{Type: policy.VsidPolicy, Settings: json.RawMessage(`{"VSID":4096}`)},
+		{Type: policy.AutomaticDNSPolicy, Settings: json.RawMessage(`{"Enable":true}`)},
+	}
+
+	nm := &networkManager{ExternalInterfaces: make(map[string]*externalInterface)}
+	if _, err := nm.newNetworkImpl(nwInfo, &externalInterface{Name: "Ethernet"}); err != nil {
+		t.Fatalf("Failed to create network: %v", err)
+	}
+
+	var request hcsshim.HNSNetwork
+	if err := json.Unmarshal([]byte(fake.lastNetworkRequest), &request); err != nil {
+		t.Fatalf("Failed to decode network request: %v", err)
+	}
+
+	if !policy.HasHNSPolicy(request.Policies, "VSID") || !policy.HasHNSPolicy(request.Policies, "AutomaticDNS") {
+		t.Errorf("Expected network policies in request, got %v", fake.lastNetworkRequest)
+	}
+
+	var vsid hcsshim.VsidPolicy
+	for _, hnsPolicy := range request.Policies {
+		if policy.GetHNSPolicyType(hnsPolicy) == "VSID" {
+			json.Unmarshal(hnsPolicy, &vsid)
+		}
+	}
+
+	if vsid.VSID != 4096 {
+		t.Errorf("Expected VSID 4096, got %+v", vsid)
+	}
+
+	nwInfo = createTestNetworkInfo("rules")
+	nwInfo.NetworkPolicies = []policy.NetworkScopedPolicy{
+		{Type: policy.IPTablesPolicy, Settings: json.RawMessage(`{"Chain":"FORWARD","Rule":"-j ACCEPT"}`)},
+	}
+
+	fake.lastNetworkRequest = ""
+	if _, err := nm.newNetworkImpl(nwInfo, &externalInterface{Name: "Ethernet"}); err == nil || fake.lastNetworkRequest != "" {
+		t.Errorf("Expected Linux rule to be rejected before the HNS request, err:%v", err)
+	}
+}
+
+// Tests that the network VLAN is added to the HNS network in place of the VLAN option and that
+// networks on the same interface cannot share it.
+func TestNewNetworkVlan(t *testing.T) {
+	defer func() { hns = hcsshimClient{} }()
+	fake := newFakeHnsClient()
+
+	nwInfo := createTestNetworkInfo("vlan")
+	nwInfo.MasterIfName = "Ethernet"
+	nwInfo.VlanID = 200
+	nwInfo.Options = map[string]interface{}{genericData: map[string]interface{}{VlanIDKey: "100"}}
+
+	nm := &networkManager{ExternalInterfaces: map[string]*externalInterface{
+		"Ethernet": {Name: "Ethernet", Networks: make(map[string]*network)},
+	}}
+
+	nw, err := nm.newNetwork(nwInfo)
+	if err != nil {
+		t.Fatalf("Failed to create network: %v", err)
+	}
+
+	var request hcsshim.HNSNetwork
+	if err := json.Unmarshal([]byte(fake.lastNetworkRequest), &request); err != nil {
+		t.Fatalf("Failed to decode network request: %v", err)
+	}
+
+	var vlanPolicies []hcsshim.VlanPolicy
+	for _, hnsPolicy := range request.Policies {
+		if policy.GetHNSPolicyType(hnsPolicy) == "VLAN" {
+			var vlanPolicy hcsshim.VlanPolicy
+			json.Unmarshal(hnsPolicy, &vlanPolicy)
+			vlanPolicies = append(vlanPolicies, vlanPolicy)
+		}
+	}
+
+	if len(vlanPolicies) != 1 || vlanPolicies[0].VLAN != 200 {
+		t.Errorf("Expected a single VLAN 200 policy, got %+v", vlanPolicies)
+	}
+
+	if nw.VlanId != 200 || nw.getInfo().VlanID != 200 {
+		t.Errorf("Expected network VLAN 200, got %v", nw.VlanId)
+	}
+
+	nwInfo = createTestNetworkInfo("vlan2")
+	nwInfo.MasterIfName = "Ethernet"
+	nwInfo.VlanID = 200
+
+	fake.lastNetworkRequest = ""
+	if _, err := nm.newNetwork(nwInfo); err != errVlanInUse || fake.lastNetworkRequest != "" {
+		t.Errorf("Expected VLAN conflict to be rejected before the HNS request, err:%v", err)
+	}
+}
+
+// createTestNetworkInfo returns the info of a bridge network with a single subnet.
+func createTestNetworkInfo(id string) *NetworkInfo {
+	_, prefix, _ := net.ParseCIDR("10.0.0.0/24")
+	return &NetworkInfo{
+		Id:      id,
+		Mode:    opModeBridge,
+		Subnets: []SubnetInfo{{Prefix: *prefix, Gateway: net.ParseIP("10.0.0.1")}},
+	}
+}
+
+// Tests that subnets are added to the HNS network and that older HNS versions reject the update.
+func TestUpdateNetwork(t *testing.T) {
+	defer func() { hns = hcsshimClient{} }()
+	fake := newFakeHnsClient()
+
+	nm := &networkManager{ExternalInterfaces: make(map[string]*externalInterface)}
+	nm.ExternalInterfaces["Ethernet"] = &externalInterface{Name: "Ethernet", Networks: make(map[string]*network)}
+
+	nwInfo := createTestNetworkInfo("update")
+	nwInfo.MasterIfName = "Ethernet"
+	if err := nm.CreateNetwork(nwInfo); err != nil {
+		t.Fatalf("Failed to create network: %v", err)
+	}
+
+	_, added, _ := net.ParseCIDR("10.1.0.0/24")
+	nwInfo = createTestNetworkInfo("update")
+	nwInfo.Subnets = append(nwInfo.Subnets, SubnetInfo{Prefix: *added, Gateway: net.ParseIP("10.1.0.1")})
+
+	if err := nm.UpdateNetwork(nwInfo); err != nil {
+		t.Fatalf("Failed to update network: %v", err)
+	}
+
+	nw, _ := nm.getNetwork("update")
+	if len(nw.Subnets) != 2 || len(fake.networks[nw.HnsId].Subnets) != 2 {
+		t.Errorf("Expected 2 subnets, got network:%v HNS network:%v", nw.Subnets, fake.networks[nw.HnsId].Subnets)
+	}
+
+	_, unsupported, _ := net.ParseCIDR("10.2.0.0/24")
+	nwInfo.Subnets = append(nwInfo.Subnets, SubnetInfo{Prefix: *unsupported, Gateway: net.ParseIP("10.2.0.1")})
+	fake.version = hcsshim.HNSVersion{Major: 8, Minor: 0}
+
+	if err := nm.UpdateNetwork(nwInfo); err != errNetworkUpdateNotSupported {
+		t.Errorf("Expected errNetworkUpdateNotSupported, got %v", err)
+	}
+
+	if len(nw.Subnets) != 2 {
+		t.Errorf("Expected subnets to be unchanged, got %v", nw.Subnets)
+	}
+}
+
+// Tests that a network created by a create request that timed out is adopted by the next attempt.
+func TestNewNetworkAdoptsTimedOutNetwork(t *testing.T) {
+	defer func() { hns = hcsshimClient{} }()
+	fake := newFakeHnsClient()
+	fake.networkBlock = make(chan struct{})
+	fake.networkCreated = make(chan struct{})
+
+	nwInfo := createTestNetworkInfo("timeout")
+	nwInfo.HNSTimeout = 10 * time.Millisecond
+	nm := &networkManager{ExternalInterfaces: make(map[string]*externalInterface)}
+	extIf := &externalInterface{Name: "Ethernet"}
+
+	if _, err := nm.newNetworkImpl(nwInfo, extIf); !IsHNSTimeoutError(err) {
+		t.Fatalf("Expected timeout error, got %v", err)
+	}
+
+	// Let the timed out request complete in the background.
+	close(fake.networkBlock)
+	<-fake.networkCreated
+	fake.networkBlock = nil
+
+	hnsNetwork, err := fake.GetNetworkByName(nwInfo.Id)
+	if err != nil {
+		t.Fatalf("Timed out request did not create the network: %v", err)
+	}
+
+	fake.lastNetworkRequest = ""
+	nw, err := nm.newNetworkImpl(nwInfo, extIf)
+	if err != nil {
+		t.Fatalf("Failed to create network: %v", err)
+	}
+
+	if nw.HnsId != hnsNetwork.Id || fake.lastNetworkRequest != "" {
+		t.Errorf("Expected network %v to be adopted, got %v request:%v", hnsNetwork.Id, nw.HnsId, fake.lastNetworkRequest)
+	}
+}
+
+// Tests that a network without the requested subnets is deleted and created again.
+func TestNewNetworkDeletesPartialNetwork(t *testing.T) {
+	defer func() { hns = hcsshimClient{} }()
+	fake := newFakeHnsClient()
+	fake.networks["hnsnw-partial"] = &hcsshim.HNSNetwork{Id: "hnsnw-partial", Name: "partial", Type: hnsL2bridge}
+
+	nm := &networkManager{ExternalInterfaces: make(map[string]*externalInterface)}
+	nw, err := nm.newNetworkImpl(createTestNetworkInfo("partial"), &externalInterface{Name: "Ethernet"})
+	if err != nil {
+		t.Fatalf("Failed to create network: %v", err)
+	}
+
+	if fake.networks["hnsnw-partial"] != nil {
+		t.Errorf("Expected partial network to be deleted")
+	}
+
+	if nw.HnsId == "hnsnw-partial" || fake.networks[nw.HnsId] == nil {
+		t.Errorf("Expected a new HNS network, got %v", nw.HnsId)
+	}
+}
+
+// Tests that a network deleted from HNS is recreated and its endpoints are marked stale.
+func TestReconcileNetworksRecreatesMissingNetwork(t *testing.T) {
+	defer func() { hns = hcsshimClient{} }()
+	fake := newFakeHnsClient()
+
+	nw := createTestNetwork()
+	nw.HnsId = "hnsnw-deleted"
+	nw.Endpoints["ep1"] = &endpoint{Id: "ep1", HnsId: "hnsep-deleted"}
+	nm := createTestNetworkManager(nw)
+
+	if !nm.reconcileNetworks() {
+		t.Errorf("Expected the state to change")
+	}
+
+	if fake.networks[nw.HnsId] == nil {
+		t.Errorf("Network %v was not recreated in HNS", nw.HnsId)
+	}
+
+	if nw.Pruned || !nw.Endpoints["ep1"].Stale {
+		t.Errorf("Expected recreated network with stale endpoint, got pruned:%v stale:%v", nw.Pruned, nw.Endpoints["ep1"].Stale)
+	}
+}
+
+// Tests that a network that cannot be recreated is pruned once its stale endpoints are deleted.
+func TestReconcileNetworksPrunesNetwork(t *testing.T) {
+	defer func() { hns = hcsshimClient{} }()
+	fake := newFakeHnsClient()
+	fake.networkErr = fmt.Errorf("HNS failed with error : The network adapter was not found. ")
+
+	nw := createTestNetwork()
+	nw.HnsId = "hnsnw-deleted"
+	nw.Endpoints["ep1"] = &endpoint{Id: "ep1", HnsId: "hnsep-deleted"}
+	nm := createTestNetworkManager(nw)
+
+	nm.reconcileNetworks()
+
+	if !nw.Pruned {
+		t.Fatalf("Expected network to be pruned")
+	}
+
+	if err := nm.CreateEndpoint(nw.Id, &EndpointInfo{Id: "ep2"}); err != errNetworkPruned {
+		t.Errorf("Expected CreateEndpoint to fail with %v, got %v", errNetworkPruned, err)
+	}
+
+	if err := nm.DeleteEndpoint(nw.Id, "ep1"); err != nil {
+		t.Errorf("Failed to delete stale endpoint: %v", err)
+	}
+
+	if _, err := nm.getNetwork(nw.Id); err == nil {
+		t.Errorf("Expected pruned network to be removed with its last endpoint")
+	}
+}
+
+// Tests that existing networks are left untouched.
+func TestReconcileNetworksExistingNetwork(t *testing.T) {
+	defer func() { hns = hcsshimClient{} }()
+	newFakeHnsClient()
+
+	nw := createTestNetwork()
+	nw.Endpoints["ep1"] = &endpoint{Id: "ep1"}
+	nm := createTestNetworkManager(nw)
+
+	if nm.reconcileNetworks() {
+		t.Errorf("Expected the state to be unchanged")
+	}
+
+	if nw.HnsId != "hnsnw-1" || nw.Endpoints["ep1"].Stale {
+		t.Errorf("Existing network was modified")
+	}
+}
+
+// Tests that a snapshot captures the HNS state and the differences with the persisted state without modifying HNS.
+func TestSnapshot(t *testing.T) {
+	defer func() { hns = hcsshimClient{} }()
+	fake := newFakeHnsClient()
+	fake.endpoints["hnsep-1"] = &hcsshim.HNSEndpoint{Id: "hnsep-1", Name: "abcd1234-eth0", VirtualNetwork: "hnsnw-1"}
+	fake.endpoints["hnsep-2"] = &hcsshim.HNSEndpoint{Id: "hnsep-2", Name: "abcd5678-eth0", VirtualNetwork: "hnsnw-1"}
+
+	nw := createTestNetwork()
+	nw.Endpoints["ep1"] = &endpoint{Id: "ep1", HnsId: "hnsep-1"}
+	nw.Endpoints["ep2"] = &endpoint{Id: "ep2", HnsId: "hnsep-deleted"}
+	nm := createTestNetworkManager(nw)
+
+	snapshot, err := nm.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	if len(snapshot.Networks) != 1 || len(snapshot.Networks[0].Endpoints) != 2 {
+		t.Fatalf("Unexpected networks %+v", snapshot.Networks)
+	}
+
+	if len(snapshot.Host.Networks) != 1 || len(snapshot.Host.Endpoints) != 2 {
+		t.Errorf("Unexpected host snapshot %+v", snapshot.Host)
+	}
+
+	if len(snapshot.Diffs) != 2 || snapshot.Diffs[0].Resource != "hnsep-2" || snapshot.Diffs[1].EndpointId != "ep2" {
+		t.Errorf("Unexpected diffs %+v", snapshot.Diffs)
+	}
+
+	if len(fake.endpoints) != 2 {
+		t.Errorf("Snapshot modified HNS endpoints")
+	}
+}
+
+// Tests that orphaned HNS endpoints are deleted, and that failed deletions are returned.
+func TestReconcileEndpointsImpl(t *testing.T) {
+	defer func() { hns = hcsshimClient{} }()
+	fake := newFakeHnsClient()
+	fake.endpoints["hnsep-1"] = &hcsshim.HNSEndpoint{Id: "hnsep-1", Name: "abcd1234-eth0", VirtualNetwork: "hnsnw-1"}
+	fake.endpoints["hnsep-2"] = &hcsshim.HNSEndpoint{Id: "hnsep-2", Name: "abcd5678-eth0", VirtualNetwork: "hnsnw-1"}
+
+	nw := createTestNetwork()
+	nw.Endpoints["ep1"] = &endpoint{Id: "ep1", HnsId: "hnsep-1"}
+	nm := createTestNetworkManager(nw)
+
+	if err := nm.reconcileEndpointsImpl(true); err != nil || len(fake.endpoints) != 2 {
+		t.Fatalf("Expected a dry run to keep HNS endpoints, got err:%v endpoints:%+v", err, fake.endpoints)
+	}
+
+	fake.deleteErr = fmt.Errorf("HNS failed with error : Access is denied. ")
+	if err := nm.reconcileEndpointsImpl(false); err == nil || !strings.Contains(err.Error(), "hnsep-2") {
+		t.Fatalf("Expected the failed deletion of hnsep-2 to be returned, got %v", err)
+	}
+
+	fake.deleteErr = nil
+	if err := nm.reconcileEndpointsImpl(false); err != nil {
+		t.Fatalf("reconcileEndpointsImpl failed: %v", err)
+	}
+
+	if len(fake.endpoints) != 1 || fake.endpoints["hnsep-1"] == nil {
+		t.Errorf("Expected only the orphaned HNS endpoint to be deleted, got %+v", fake.endpoints)
+	}
+}
+
+// Tests that a failed endpoint deletion keeps the network, and that a retry deletes everything.
+func TestForceDeleteNetwork(t *testing.T) {
+	defer func() { hns = hcsshimClient{} }()
+	fake := newFakeHnsClient()
+
+	nw := createTestNetwork()
+	for _, id := range []string{"ep1", "ep2"} {
+		hnsEndpoint, _ := fake.EndpointRequest("POST", "", fmt.Sprintf(`{"Name":"%v"}`, id))
+		nw.Endpoints[id] = &endpoint{Id: id, HnsId: hnsEndpoint.Id}
+	}
+	nm := createTestNetworkManager(nw)
+
+	fake.deleteErr = fmt.Errorf("HNS failed with error : Access is denied. ")
+	if err := nm.ForceDeleteNetwork(nw.Id); err == nil {
+		t.Fatalf("Expected endpoint delete failures to be returned")
+	}
+
+	if _, err := nm.getNetwork(nw.Id); err != nil || len(nw.Endpoints) != 2 {
+		t.Fatalf("Expected network and endpoints to be kept, got err:%v endpoints:%v", err, len(nw.Endpoints))
+	}
+
+	fake.deleteErr = nil
+	if err := nm.ForceDeleteNetwork(nw.Id); err != nil {
+		t.Fatalf("Failed to force delete network: %v", err)
+	}
+
+	if len(fake.endpoints) != 0 || fake.networks[nw.HnsId] != nil {
+		t.Errorf("Expected HNS endpoints and network to be deleted")
+	}
+
+	if _, err := nm.getNetwork(nw.Id); err == nil {
+		t.Errorf("Expected network to be removed")
+	}
+}
+
+// Tests that network modes map to HNS network types and that overlay requires a recent HNS.
+func TestGetHNSNetworkType(t *testing.T) {
+	defer func() { hns = hcsshimClient{} }()
+	fake := newFakeHnsClient()
+
+	tests := []struct {
+		mode           string
+		hnsNetworkType string
+		expectedErr    error
+	}{
+		{opModeBridge, hnsL2bridge, nil},
+		{opModeTunnel, hnsL2tunnel, nil},
+		{opModeTransparent, hnsTransparent, nil},
+		{opModeOverlay, hnsOverlay, nil},
+		{opModeIpvlan, "", errNetworkModeInvalid},
+	}
+
+	for _, test := range tests {
+		hnsNetworkType, err := getHNSNetworkType(test.mode)
+		if hnsNetworkType != test.hnsNetworkType || err != test.expectedErr {
+			t.Errorf("Mode %v: expected %v %v, got %v %v", test.mode, test.hnsNetworkType, test.expectedErr, hnsNetworkType, err)
+		}
+	}
+
+	fake.version = hcsshim.HNSVersion{Major: 6, Minor: 2}
+	if _, err := getHNSNetworkType(opModeOverlay); err != errOverlayNotSupported {
+		t.Errorf("Expected %v on an older build, got %v", errOverlayNotSupported, err)
+	}
+
+	if _, err := getHNSNetworkType(opModeBridge); err != nil {
+		t.Errorf("Expected bridge networks on an older build, got %v", err)
+	}
+}
+
+// Tests that OutBoundNAT policies are only applied in network types that use outbound NAT.
+func TestGetEndpointPolicies(t *testing.T) {
+	policies := []policy.Policy{
+		{Type: policy.EndpointPolicy, Data: json.RawMessage(`{"Type":"OutBoundNAT","ExceptionList":["10.0.0.0/8"]}`)},
+		{Type: policy.EndpointPolicy, Data: json.RawMessage(`{"Type":"ROUTE","DestinationPrefix":"10.0.0.0/8"}`)},
+	}
+
+	nw := createTestNetwork()
+	for mode, expected := range map[string]int{opModeBridge: 2, opModeTunnel: 1, opModeTransparent: 1} {
+		nw.Mode = mode
+		if filtered := nw.getEndpointPolicies(policies); len(filtered) != expected {
+			t.Errorf("Mode %v: expected %v policies, got %+v", mode, expected, filtered)
+		}
+	}
+}
+
+// Tests that networks in none mode and their endpoints are recorded without any HNS request.
+func TestNoneNetwork(t *testing.T) {
+	defer func() { hns = hcsshimClient{} }()
+	fake := newFakeHnsClient()
+
+	nm := &networkManager{ExternalInterfaces: map[string]*externalInterface{
+		"Ethernet": {Name: "Ethernet", Networks: make(map[string]*network)},
+	}}
+
+	nwInfo := createTestNetworkInfo("none")
+	nwInfo.Mode = opModeNone
+	nwInfo.MasterIfName = "Ethernet"
+
+	nw, err := nm.newNetwork(nwInfo)
+	if err != nil {
+		t.Fatalf("Failed to create network: %v", err)
+	}
+
+	_, ipAddress, _ := net.ParseCIDR("10.0.0.4/32")
+	ep, err := nw.newEndpoint(&EndpointInfo{Id: "ep1", ContainerID: "container1", IPAddresses: []net.IPNet{*ipAddress}})
+	if err != nil {
+		t.Fatalf("Failed to create endpoint: %v", err)
+	}
+
+	if fake.lastNetworkRequest != "" || len(fake.networks) != 1 || len(fake.endpoints) != 0 {
+		t.Errorf("Unexpected HNS requests, networks %+v endpoints %+v", fake.networks, fake.endpoints)
+	}
+
+	if ep.HnsId != "" || ep.IPAddresses[0].String() != "10.0.0.4/24" || len(ep.Gateways) != 1 {
+		t.Errorf("Unexpected endpoint %+v", ep)
+	}
+
+	if err := nw.deleteEndpoint("ep1"); err != nil {
+		t.Errorf("Failed to delete endpoint: %v", err)
+	}
+
+	if err := nm.deleteNetwork("none"); err != nil {
+		t.Errorf("Failed to delete network: %v", err)
+	}
+}
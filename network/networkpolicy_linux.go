@@ -0,0 +1,106 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"fmt"
+
+	"github.com/Azure/azure-container-networking/log"
+	"github.com/Azure/azure-container-networking/network/policy"
+	"github.com/Azure/azure-container-networking/platform"
+)
+
+const (
+	// Table of network policy rules that do not specify one.
+	defaultNetworkPolicyTable = "filter"
+)
+
+// isNetworkPolicySupported returns true if the network policy is an IPTables or EBTables rule,
+// which are the network policies supported on Linux.
+func isNetworkPolicySupported(networkPolicy *policy.NetworkScopedPolicy) bool {
+	return networkPolicy.IsRule()
+}
+
+// getNetworkPolicyCommand returns the command that applies the given iptables or ebtables action,
+// such as -A or -D, to the rule of a network policy.
+func getNetworkPolicyCommand(networkPolicy *policy.NetworkScopedPolicy, action string) (string, error) {
+	rule, err := networkPolicy.GetRuleSettings()
+	if err != nil {
+		return "", err
+	}
+
+	tool := "iptables"
+	if networkPolicy.Type == policy.EBTablesPolicy {
+		tool = "ebtables"
+	}
+
+	table := rule.Table
+	if table == "" {
+		table = defaultNetworkPolicyTable
+	}
+
+	return fmt.Sprintf("%v -t %v %v %v %v", tool, table, action, rule.Chain, rule.Rule), nil
+}
+
+// addNetworkPolicyRules installs the rules of the network policies. Rules that are already installed
+// are not added again. On failure, the rules installed so far are deleted.
+func addNetworkPolicyRules(policies []policy.NetworkScopedPolicy) error {
+	for i := range policies {
+		if err := addNetworkPolicyRule(&policies[i]); err != nil {
+			deleteNetworkPolicyRules(policies[:i])
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addNetworkPolicyRule installs the rule of a network policy unless it is already installed.
+func addNetworkPolicyRule(networkPolicy *policy.NetworkScopedPolicy) error {
+	if networkPolicy.Type == policy.IPTablesPolicy {
+		cmd, err := getNetworkPolicyCommand(networkPolicy, "-C")
+		if err != nil {
+			return err
+		}
+
+		if _, err := platform.ExecuteCommand(cmd); err == nil {
+			log.Printf("[net] Network policy rule already exists.")
+			return nil
+		}
+	} else {
+		// Ebtables cannot check for a rule, so any existing copy is deleted first.
+		cmd, err := getNetworkPolicyCommand(networkPolicy, "-D")
+		if err != nil {
+			return err
+		}
+
+		platform.ExecuteCommand(cmd)
+	}
+
+	cmd, err := getNetworkPolicyCommand(networkPolicy, "-A")
+	if err != nil {
+		return err
+	}
+
+	if _, err := platform.ExecuteCommand(cmd); err != nil {
+		log.Printf("[net] Failed to add network policy rule, err:%v.", err)
+		return err
+	}
+
+	return nil
+}
+
+// deleteNetworkPolicyRules deletes the rules of the network policies.
+func deleteNetworkPolicyRules(policies []policy.NetworkScopedPolicy) {
+	for i := range policies {
+		cmd, err := getNetworkPolicyCommand(&policies[i], "-D")
+		if err != nil {
+			continue
+		}
+
+		if _, err := platform.ExecuteCommand(cmd); err != nil {
+			log.Printf("[net] Failed to delete network policy rule, err:%v.", err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"net"
+
+	"github.com/Azure/azure-container-networking/log"
+	"github.com/Azure/azure-container-networking/platform"
+)
+
+// Networks in none mode track their endpoints and the addresses allocated to them without
+// programming anything on the host. They serve containers that bring their own networking and
+// let IPAM and the persisted state be exercised without the privileges the dataplane requires.
+
+// newNoneNetwork returns a network in none mode. The external interface only records the network.
+func newNoneNetwork(nwInfo *NetworkInfo, extIf *externalInterface) *network {
+	log.Printf("[net] Network %v is in none mode, nothing is programmed on the host.", nwInfo.Id)
+
+	return &network{
+		Id:               nwInfo.Id,
+		Mode:             nwInfo.Mode,
+		Endpoints:        make(map[string]*endpoint),
+		extIf:            extIf,
+		DNS:              nwInfo.DNS,
+		EnableSnatOnHost: nwInfo.EnableSnatOnHost,
+		MTU:              nwInfo.MTU,
+		HNSTimeout:       nwInfo.HNSTimeout,
+	}
+}
+
+// newNoneEndpoint records an endpoint of a network in none mode with the settings a container
+// would have been configured with, without creating any interface.
+func (nw *network) newNoneEndpoint(epInfo *EndpointInfo) (*endpoint, error) {
+	if nw.Endpoints[epInfo.Id] != nil {
+		return nil, ErrEndpointExists
+	}
+
+	if err := validateRoutes(epInfo.Routes); err != nil {
+		return nil, err
+	}
+
+	// Use the prefix length and gateway of the network subnet each address was allocated from.
+	epInfo.IPAddresses = nw.getSubnetAddresses(epInfo.IPAddresses)
+
+	var gateways []net.IP
+	for _, family := range []platform.AddressFamily{platform.AfINET, platform.AfINET6} {
+		if gateway := nw.getSubnetGateway(epInfo.IPAddresses, family); gateway != nil {
+			gateways = append(gateways, gateway)
+		}
+	}
+
+	ep := &endpoint{
+		Id:               epInfo.Id,
+		IfName:           epInfo.IfName,
+		MacAddress:       epInfo.MacAddress,
+		IPAddresses:      epInfo.IPAddresses,
+		Gateways:         gateways,
+		DNS:              epInfo.DNS,
+		SearchDomains:    epInfo.SearchDomains,
+		NetworkNameSpace: epInfo.NetNs.Path(),
+		ContainerID:      epInfo.ContainerID,
+		PODName:          epInfo.PODName,
+		PODNameSpace:     epInfo.PODNameSpace,
+		MTU:              epInfo.MTU,
+	}
+
+	for _, route := range epInfo.Routes {
+		ep.Routes = append(ep.Routes, route)
+	}
+
+	log.Printf("[net] Recorded endpoint %v of network %v in none mode.", epInfo.Id, nw.Id)
+
+	return ep, nil
+}
+
+// updateNoneEndpoint records the updated DNS settings and routes of an endpoint of a network in none mode.
+func (nw *network) updateNoneEndpoint(existingEpInfo *EndpointInfo, targetEpInfo *EndpointInfo) (*endpoint, error) {
+	ep := nw.Endpoints[existingEpInfo.Id]
+	if ep == nil {
+		return nil, ErrEndpointNotFound
+	}
+
+	if err := validateRoutes(targetEpInfo.Routes); err != nil {
+		return nil, err
+	}
+
+	ep.DNS = targetEpInfo.DNS
+	ep.SearchDomains = targetEpInfo.SearchDomains
+	ep.Routes = nil
+	for _, route := range targetEpInfo.Routes {
+		ep.Routes = append(ep.Routes, route)
+	}
+
+	return ep, nil
+}
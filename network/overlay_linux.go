@@ -0,0 +1,193 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-container-networking/log"
+	"github.com/Azure/azure-container-networking/netlink"
+	"github.com/Azure/azure-container-networking/platform"
+)
+
+const (
+	// Prefixes for the names of the bridge and VXLAN interfaces of overlay networks, followed by the VXLAN ID.
+	overlayBridgePrefix  = "azvxbr"
+	vxlanInterfacePrefix = "azvx"
+
+	// IANA assigned VXLAN UDP port.
+	defaultVxlanPort = 4789
+
+	// VXLAN IDs are 24 bits long.
+	maxVxlanId = 1<<24 - 1
+
+	// MAC address of the FDB entries that flood broadcast and unknown traffic to remote nodes.
+	floodMacAddress = "00:00:00:00:00:00"
+)
+
+// getVxlanOptions returns the VXLAN ID and port of an overlay network from its options.
+func getVxlanOptions(opt map[string]interface{}) (int, int, error) {
+	var vxlanId int
+	vxlanPort := defaultVxlanPort
+
+	if opt != nil && opt[VxlanIdKey] != nil {
+		id, err := strconv.Atoi(fmt.Sprintf("%v", opt[VxlanIdKey]))
+		if err != nil {
+			return 0, 0, errVxlanIdInvalid
+		}
+		vxlanId = id
+	}
+
+	if vxlanId < 1 || vxlanId > maxVxlanId {
+		return 0, 0, errVxlanIdInvalid
+	}
+
+	if opt != nil && opt[VxlanPortKey] != nil {
+		port, err := strconv.Atoi(fmt.Sprintf("%v", opt[VxlanPortKey]))
+		if err != nil || port < 1 || port > 65535 {
+			return 0, 0, errVxlanPortInvalid
+		}
+		vxlanPort = port
+	}
+
+	return vxlanId, vxlanPort, nil
+}
+
+// getVxlanInterfaceName returns the name of the VXLAN interface of an overlay network.
+func getVxlanInterfaceName(vxlanId int) string {
+	return fmt.Sprintf("%s%d", vxlanInterfacePrefix, vxlanId)
+}
+
+// createOverlay creates the bridge of an overlay network and connects it to a VXLAN interface over
+// the external interface. Unlike bridge mode, the external interface is not connected to the bridge,
+// which serves the subnet gateways for its endpoints instead. Returns the name of the bridge.
+func createOverlay(extIf *externalInterface, nwInfo *NetworkInfo, vxlanId int, vxlanPort int) (string, error) {
+	hostIf, err := net.InterfaceByName(extIf.Name)
+	if err != nil {
+		return "", err
+	}
+
+	bridgeName := nwInfo.BridgeName
+	if bridgeName == "" {
+		bridgeName = fmt.Sprintf("%s%d", overlayBridgePrefix, vxlanId)
+	}
+
+	vxlanName := getVxlanInterfaceName(vxlanId)
+
+	// On failure, delete the interfaces.
+	defer func() {
+		if err != nil {
+			deleteOverlayInterfaces(bridgeName, vxlanName)
+		}
+	}()
+
+	if _, err = net.InterfaceByName(bridgeName); err != nil {
+		log.Printf("[net] Creating bridge %v.", bridgeName)
+		link := netlink.BridgeLink{
+			LinkInfo: netlink.LinkInfo{
+				Type: netlink.LINK_TYPE_BRIDGE,
+				Name: bridgeName,
+			},
+		}
+
+		if err = netlink.AddLink(&link); err != nil {
+			return "", err
+		}
+	} else {
+		log.Printf("[net] Found existing bridge %v.", bridgeName)
+	}
+
+	if _, err = net.InterfaceByName(vxlanName); err != nil {
+		// Remote endpoints are programmed explicitly, so the VXLAN interface does not learn them.
+		log.Printf("[net] Creating VXLAN interface %v with ID %v port %v on %v.", vxlanName, vxlanId, vxlanPort, extIf.Name)
+		link := netlink.VxlanLink{
+			LinkInfo: netlink.LinkInfo{
+				Type:        netlink.LINK_TYPE_VXLAN,
+				Name:        vxlanName,
+				ParentIndex: hostIf.Index,
+			},
+			VxlanId: uint32(vxlanId),
+			Port:    uint16(vxlanPort),
+		}
+
+		if err = netlink.AddLink(&link); err != nil {
+			return "", err
+		}
+	} else {
+		log.Printf("[net] Found existing VXLAN interface %v.", vxlanName)
+	}
+
+	log.Printf("[net] Setting link %v master %v.", vxlanName, bridgeName)
+	if err = netlink.SetLinkMaster(vxlanName, bridgeName); err != nil {
+		return "", err
+	}
+
+	if nwInfo.MTU > 0 {
+		log.Printf("[net] Setting MTU of link %v to %v.", bridgeName, nwInfo.MTU)
+		if err = netlink.SetLinkMTU(bridgeName, nwInfo.MTU); err != nil {
+			return "", err
+		}
+	}
+
+	for _, ifName := range []string{vxlanName, bridgeName} {
+		log.Printf("[net] Setting link %v state up.", ifName)
+		if err = netlink.SetLinkState(ifName, true); err != nil {
+			return "", err
+		}
+	}
+
+	if err = setSubnetGateways(bridgeName, nwInfo.Subnets, true); err != nil {
+		return "", err
+	}
+
+	return bridgeName, nil
+}
+
+// deleteOverlayInterfaces deletes the VXLAN interface and the bridge of an overlay network.
+// The addresses of the bridge and the FDB entries of the VXLAN interface go with them.
+func deleteOverlayInterfaces(bridgeName string, vxlanName string) {
+	for _, ifName := range []string{vxlanName, bridgeName} {
+		log.Printf("[net] Deleting link %v.", ifName)
+		if err := netlink.DeleteLink(ifName); err != nil {
+			log.Printf("[net] Failed to delete link %v, err:%v.", ifName, err)
+		}
+	}
+}
+
+// addRemoteEndpointImpl tunnels traffic to the MAC address of a remote endpoint to its node, and floods
+// broadcast and unknown traffic to the node so that address resolution reaches its endpoints.
+func (nw *network) addRemoteEndpointImpl(remoteEp *RemoteEndpointInfo) error {
+	vxlanName := getVxlanInterfaceName(nw.VxlanId)
+
+	cmd := fmt.Sprintf("bridge fdb replace %v dev %v dst %v self permanent", remoteEp.MacAddress, vxlanName, remoteEp.NodeIP)
+	if _, err := platform.ExecuteCommand(cmd); err != nil {
+		return err
+	}
+
+	cmd = fmt.Sprintf("bridge fdb append %v dev %v dst %v self permanent", floodMacAddress, vxlanName, remoteEp.NodeIP)
+	if _, err := platform.ExecuteCommand(cmd); err != nil && !strings.Contains(strings.ToLower(err.Error()), "file exists") {
+		return err
+	}
+
+	return nil
+}
+
+// deleteRemoteEndpointImpl deletes the FDB entry of a remote endpoint.
+func (nw *network) deleteRemoteEndpointImpl(remoteEp *RemoteEndpointInfo) {
+	cmd := fmt.Sprintf("bridge fdb del %v dev %v dst %v self", remoteEp.MacAddress, getVxlanInterfaceName(nw.VxlanId), remoteEp.NodeIP)
+	if _, err := platform.ExecuteCommand(cmd); err != nil {
+		log.Printf("[net] Failed to delete FDB entry of remote endpoint %v, err:%v.", remoteEp.MacAddress, err)
+	}
+}
+
+// deleteRemoteNodeImpl stops flooding traffic to a node without remote endpoints.
+func (nw *network) deleteRemoteNodeImpl(nodeIP net.IP) {
+	cmd := fmt.Sprintf("bridge fdb del %v dev %v dst %v self", floodMacAddress, getVxlanInterfaceName(nw.VxlanId), nodeIP)
+	if _, err := platform.ExecuteCommand(cmd); err != nil {
+		log.Printf("[net] Failed to delete flood FDB entry of node %v, err:%v.", nodeIP, err)
+	}
+}
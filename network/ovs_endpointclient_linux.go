@@ -143,13 +143,15 @@ func (client *OVSEndpointClient) DeleteEndpointRules(ep *endpoint) {
 	log.Printf("[ovs] Deleting IP SNAT for port %v", containerPort)
 	ovsctl.DeleteIPSnatRule(client.bridgeName, containerPort)
 
-	// Delete Arp Reply Rules for container
-	log.Printf("[ovs] Deleting ARP reply rule for ip %v vlanid %v for container port %v", ep.IPAddresses[0].IP.String(), ep.VlanID, containerPort)
-	ovsctl.DeleteArpReplyRule(client.bridgeName, containerPort, ep.IPAddresses[0].IP, ep.VlanID)
+	for _, ipAddr := range ep.IPAddresses {
+		// Delete Arp Reply Rules for container
+		log.Printf("[ovs] Deleting ARP reply rule for ip %v vlanid %v for container port %v", ipAddr.IP.String(), ep.VlanID, containerPort)
+		ovsctl.DeleteArpReplyRule(client.bridgeName, containerPort, ipAddr.IP, ep.VlanID)
 
-	// Delete MAC address translation rule.
-	log.Printf("[ovs] Deleting MAC DNAT rule for IP address %v and vlan %v.", ep.IPAddresses[0].IP.String(), ep.VlanID)
-	ovsctl.DeleteMacDnatRule(client.bridgeName, hostPort, ep.IPAddresses[0].IP, ep.VlanID)
+		// Delete MAC address translation rule.
+		log.Printf("[ovs] Deleting MAC DNAT rule for IP address %v and vlan %v.", ipAddr.IP.String(), ep.VlanID)
+		ovsctl.DeleteMacDnatRule(client.bridgeName, hostPort, ipAddr.IP, ep.VlanID)
+	}
 
 	// Delete port from ovs bridge
 	log.Printf("[ovs] Deleting interface %v from bridge %v", client.hostVethName, client.bridgeName)
@@ -160,16 +162,16 @@ func (client *OVSEndpointClient) DeleteEndpointRules(ep *endpoint) {
 
 func (client *OVSEndpointClient) MoveEndpointsToContainerNS(epInfo *EndpointInfo, nsID uintptr) error {
 	// Move the container interface to container's network namespace.
-	log.Printf("[ovs] Setting link %v netns %v.", client.containerVethName, epInfo.NetNsPath)
+	log.Printf("[ovs] Setting link %v netns %v.", client.containerVethName, epInfo.NetNs)
 	if err := netlink.SetLinkNetNs(client.containerVethName, nsID); err != nil {
 		return err
 	}
 
-	if err := MoveSnatEndpointToContainerNS(client, epInfo.NetNsPath, nsID); err != nil {
+	if err := MoveSnatEndpointToContainerNS(client, epInfo.NetNs.Path(), nsID); err != nil {
 		return err
 	}
 
-	return MoveInfraEndpointToContainerNS(client, epInfo.NetNsPath, nsID)
+	return MoveInfraEndpointToContainerNS(client, epInfo.NetNs.Path(), nsID)
 
 }
 
@@ -189,6 +191,12 @@ func (client *OVSEndpointClient) SetupContainerInterfaces(epInfo *EndpointInfo)
 }
 
 func (client *OVSEndpointClient) ConfigureContainerInterfacesAndRoutes(epInfo *EndpointInfo) error {
+	if epcommon.HasIPv6Address(epInfo.IPAddresses) {
+		if err := epcommon.ConfigureIPv6Interface(client.containerVethName, acceptIPv6RouterAdvertisements(epInfo.Secondary, epInfo.Routes)); err != nil {
+			return err
+		}
+	}
+
 	if err := epcommon.AssignIPToInterface(client.containerVethName, epInfo.IPAddresses); err != nil {
 		return err
 	}
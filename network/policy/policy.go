@@ -2,17 +2,269 @@ package policy
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
 )
 
 const (
 	NetworkPolicy     CNIPolicyType = "NetworkPolicy"
 	EndpointPolicy    CNIPolicyType = "EndpointPolicy"
 	OutBoundNatPolicy CNIPolicyType = "OutBoundNAT"
+	QosPolicy         CNIPolicyType = "QOS"
+	NatPolicy         CNIPolicyType = "NAT"
 )
 
+// Types of network scoped policies. IPTables and EBTables policies are Linux rules, the others are
+// passed to HNS on Windows.
+const (
+	AutomaticDNSPolicy CNIPolicyType = "AutomaticDNS"
+	VsidPolicy         CNIPolicyType = "VSID"
+	IPTablesPolicy     CNIPolicyType = "IPTables"
+	EBTablesPolicy     CNIPolicyType = "EBTables"
+
+	// VSIDs are 24 bits long.
+	MaxVsid = 1<<24 - 1
+)
+
+// ACL policy actions, directions and priority range.
+const (
+	ACLActionAllow = "Allow"
+	ACLActionBlock = "Block"
+
+	ACLDirectionIn  = "In"
+	ACLDirectionOut = "Out"
+
+	MinACLPriority = 100
+	MaxACLPriority = 65500
+)
+
+// Protocol numbers of the protocol names accepted in ACL policies.
+var aclProtocols = map[string]uint16{
+	"ANY":    256,
+	"ICMP":   1,
+	"TCP":    6,
+	"UDP":    17,
+	"ICMPV6": 58,
+}
+
 type CNIPolicyType string
 
 type Policy struct {
 	Type CNIPolicyType
 	Data json.RawMessage
 }
+
+// GetQosPolicy returns an endpoint policy that limits the egress bandwidth of the endpoint.
+func GetQosPolicy(maximumOutgoingBandwidthInBytes uint64) Policy {
+	type KVPair struct {
+		Type                            CNIPolicyType `json:"Type"`
+		MaximumOutgoingBandwidthInBytes uint64
+	}
+
+	data, _ := json.Marshal(KVPair{
+		Type:                            QosPolicy,
+		MaximumOutgoingBandwidthInBytes: maximumOutgoingBandwidthInBytes,
+	})
+
+	return Policy{
+		Type: EndpointPolicy,
+		Data: data,
+	}
+}
+
+// GetNatPolicy returns an endpoint policy that publishes a container port on the host.
+func GetNatPolicy(protocol string, externalPort uint16, internalPort uint16) Policy {
+	type KVPair struct {
+		Type         CNIPolicyType `json:"Type"`
+		Protocol     string
+		InternalPort uint16
+		ExternalPort uint16
+	}
+
+	data, _ := json.Marshal(KVPair{
+		Type:         NatPolicy,
+		Protocol:     protocol,
+		InternalPort: internalPort,
+		ExternalPort: externalPort,
+	})
+
+	return Policy{
+		Type: EndpointPolicy,
+		Data: data,
+	}
+}
+
+// ACLPolicy is an access control rule applied to an endpoint.
+type ACLPolicy struct {
+	Action      string
+	Direction   string
+	Protocol    string
+	LocalPorts  string
+	RemotePorts string
+	RemoteCIDR  string
+	Priority    uint16
+}
+
+// Validate returns an error if the ACL policy cannot be applied.
+func (acl *ACLPolicy) Validate() error {
+	if acl.Action != ACLActionAllow && acl.Action != ACLActionBlock {
+		return fmt.Errorf("Invalid ACL action %v", acl.Action)
+	}
+
+	if acl.Direction != ACLDirectionIn && acl.Direction != ACLDirectionOut {
+		return fmt.Errorf("Invalid ACL direction %v", acl.Direction)
+	}
+
+	protocol, ok := aclProtocols[strings.ToUpper(acl.Protocol)]
+	if !ok {
+		return fmt.Errorf("Invalid ACL protocol %v", acl.Protocol)
+	}
+
+	if acl.Priority < MinACLPriority || acl.Priority > MaxACLPriority {
+		return fmt.Errorf("Invalid ACL priority %v, must be between %v and %v", acl.Priority, MinACLPriority, MaxACLPriority)
+	}
+
+	// Ports only apply to TCP and UDP.
+	if acl.LocalPorts != "" || acl.RemotePorts != "" {
+		if protocol != aclProtocols["TCP"] && protocol != aclProtocols["UDP"] {
+			return fmt.Errorf("ACL ports are not supported for protocol %v", acl.Protocol)
+		}
+
+		if err := validatePortList(acl.LocalPorts); err != nil {
+			return err
+		}
+
+		if err := validatePortList(acl.RemotePorts); err != nil {
+			return err
+		}
+	}
+
+	if acl.RemoteCIDR != "" {
+		if _, _, err := net.ParseCIDR(acl.RemoteCIDR); err != nil {
+			return fmt.Errorf("Invalid ACL remote CIDR %v: %v", acl.RemoteCIDR, err)
+		}
+	}
+
+	return nil
+}
+
+// GetProtocolNumber returns the IANA protocol number of the ACL policy protocol.
+func (acl *ACLPolicy) GetProtocolNumber() uint16 {
+	return aclProtocols[strings.ToUpper(acl.Protocol)]
+}
+
+// validatePortList validates a comma separated list of ports and port ranges.
+func validatePortList(ports string) error {
+	if ports == "" {
+		return nil
+	}
+
+	for _, portRange := range strings.Split(ports, ",") {
+		bounds := strings.Split(portRange, "-")
+		if len(bounds) > 2 {
+			return fmt.Errorf("Invalid ACL port range %v", portRange)
+		}
+
+		var previous uint64
+		for _, bound := range bounds {
+			port, err := strconv.ParseUint(strings.TrimSpace(bound), 10, 16)
+			if err != nil || port == 0 || port < previous {
+				return fmt.Errorf("Invalid ACL port range %v", portRange)
+			}
+			previous = port
+		}
+	}
+
+	return nil
+}
+
+// NetworkScopedPolicy is a policy applied to a network as a whole rather than to its endpoints.
+// Its settings are a JSON object whose fields depend on the policy type. The name avoids the
+// NetworkPolicy policy type, which selects the network policies among the CNI policies.
+type NetworkScopedPolicy struct {
+	Type     CNIPolicyType
+	Settings json.RawMessage `json:",omitempty"`
+}
+
+// RuleSettings are the settings of IPTables and EBTables network policies. Rule holds the
+// match and target arguments of the rule, which is appended to the chain of the table.
+type RuleSettings struct {
+	Table string `json:",omitempty"`
+	Chain string
+	Rule  string
+}
+
+// IsRule returns true if the policy is an IPTables or EBTables rule.
+func (policy *NetworkScopedPolicy) IsRule() bool {
+	return policy.Type == IPTablesPolicy || policy.Type == EBTablesPolicy
+}
+
+// GetSettings returns the settings of the policy as a map of fields.
+func (policy *NetworkScopedPolicy) GetSettings() (map[string]interface{}, error) {
+	settings := make(map[string]interface{})
+	if len(policy.Settings) == 0 {
+		return settings, nil
+	}
+
+	if err := json.Unmarshal(policy.Settings, &settings); err != nil {
+		return nil, fmt.Errorf("Invalid settings of %v network policy: %v", policy.Type, err)
+	}
+
+	return settings, nil
+}
+
+// GetRuleSettings returns the settings of an IPTables or EBTables policy.
+func (policy *NetworkScopedPolicy) GetRuleSettings() (*RuleSettings, error) {
+	var settings RuleSettings
+	if err := json.Unmarshal(policy.Settings, &settings); err != nil {
+		return nil, fmt.Errorf("Invalid settings of %v network policy: %v", policy.Type, err)
+	}
+
+	return &settings, nil
+}
+
+// Validate returns an error if the network policy cannot be applied.
+func (policy *NetworkScopedPolicy) Validate() error {
+	if policy.Type == "" {
+		return fmt.Errorf("Network policy has no type")
+	}
+
+	settings, err := policy.GetSettings()
+	if err != nil {
+		return err
+	}
+
+	// The type of HNS policies is set from the policy type.
+	if _, ok := settings["Type"]; ok {
+		return fmt.Errorf("Settings of %v network policy must not have a type", policy.Type)
+	}
+
+	switch policy.Type {
+	case VsidPolicy:
+		vsid, ok := settings["VSID"].(float64)
+		if !ok || vsid < 1 || vsid > MaxVsid || vsid != float64(uint32(vsid)) {
+			return fmt.Errorf("Invalid VSID %v, must be between 1 and %v", settings["VSID"], MaxVsid)
+		}
+
+	case IPTablesPolicy, EBTablesPolicy:
+		rule, err := policy.GetRuleSettings()
+		if err != nil {
+			return err
+		}
+
+		if rule.Chain == "" || rule.Rule == "" {
+			return fmt.Errorf("%v network policy must have a chain and a rule", policy.Type)
+		}
+
+		// Rules are installed with shell commands.
+		for _, value := range []string{rule.Table, rule.Chain, rule.Rule} {
+			if strings.ContainsAny(value, ";&|`$<>()\\\n\"'") {
+				return fmt.Errorf("%v network policy has invalid characters in %q", policy.Type, value)
+			}
+		}
+	}
+
+	return nil
+}
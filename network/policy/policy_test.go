@@ -0,0 +1,41 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package policy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Tests that network scoped policies with invalid settings are rejected.
+func TestValidateNetworkScopedPolicy(t *testing.T) {
+	tests := []struct {
+		policy NetworkScopedPolicy
+		valid  bool
+	}{
+		{NetworkScopedPolicy{Type: AutomaticDNSPolicy, Settings: json.RawMessage(`{"Enable":true}`)}, true},
+		{NetworkScopedPolicy{Type: AutomaticDNSPolicy}, true},
+		{NetworkScopedPolicy{Type: VsidPolicy, Settings: json.RawMessage(`{"VSID":4096}`)}, true},
+		{NetworkScopedPolicy{Type: IPTablesPolicy, Settings: json.RawMessage(`{"Chain":"FORWARD","Rule":"-i azure0 -j ACCEPT"}`)}, true},
+		{NetworkScopedPolicy{Type: EBTablesPolicy, Settings: json.RawMessage(`{"Table":"nat","Chain":"PREROUTING","Rule":"-p ARP -j ACCEPT"}`)}, true},
+		{NetworkScopedPolicy{Settings: json.RawMessage(`{"Enable":true}`)}, false},
+		{NetworkScopedPolicy{Type: AutomaticDNSPolicy, Settings: json.RawMessage(`[true]`)}, false},
+		{NetworkScopedPolicy{Type: AutomaticDNSPolicy, Settings: json.RawMessage(`{"Type":"VLAN"}`)}, false},
+		{NetworkScopedPolicy{Type: VsidPolicy, Settings: json.RawMessage(`{"VSID":0}`)}, false},
+		{NetworkScopedPolicy{Type: VsidPolicy, Settings: json.RawMessage(`{"VSID":16777216}`)}, false},
+		{NetworkScopedPolicy{Type: IPTablesPolicy, Settings: json.RawMessage(`{"Chain":"FORWARD"}`)}, false},
+		{NetworkScopedPolicy{Type: IPTablesPolicy, Settings: json.RawMessage(`{"Chain":"FORWARD","Rule":"-j ACCEPT; reboot"}`)}, false},
+	}
+
+	for _, tt := range tests {
+		err := tt.policy.Validate()
+		if tt.valid && err != nil {
+			t.Errorf("%v policy %s: unexpected error %v", tt.policy.Type, tt.policy.Settings, err)
+		}
+
+		if !tt.valid && err == nil {
+			t.Errorf("%v policy %s: expected policy to be rejected", tt.policy.Type, tt.policy.Settings)
+		}
+	}
+}
@@ -4,10 +4,20 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
+	"strconv"
+	"strings"
 
 	"github.com/Microsoft/hcsshim"
+	"github.com/Microsoft/hcsshim/hcn"
 )
 
+// Protocol numbers of the protocols of HNS V1 NAT policies.
+var natProtocols = map[string]uint32{
+	"TCP": 6,
+	"UDP": 17,
+}
+
 // SerializePolicies serializes policies to json.
 func SerializePolicies(policyType CNIPolicyType, policies []Policy, epInfoData map[string]interface{}) []json.RawMessage {
 	var jsonPolicies []json.RawMessage
@@ -108,3 +118,293 @@ func SerializeOutBoundNATPolicy(policies []Policy, epInfoData map[string]interfa
 
 	return nil, fmt.Errorf("OutBoundNAT policy not set")
 }
+
+// AddOutBoundNatExceptions returns the policies with a single OutBoundNAT endpoint policy whose
+// exception list also contains the given CIDRs. Exceptions are validated and deduplicated.
+func AddOutBoundNatExceptions(policies []Policy, exceptions []string) ([]Policy, error) {
+	type KVPair struct {
+		Type          CNIPolicyType `json:"Type"`
+		ExceptionList []string      `json:"ExceptionList"`
+	}
+
+	existingList, err := GetOutBoundNatExceptionList(policies)
+	if err != nil {
+		return nil, err
+	}
+
+	data := KVPair{Type: OutBoundNatPolicy}
+	seen := make(map[string]bool)
+
+	for _, exception := range existingList {
+		if !seen[exception] {
+			seen[exception] = true
+			data.ExceptionList = append(data.ExceptionList, exception)
+		}
+	}
+
+	for _, exception := range exceptions {
+		_, ipNet, err := net.ParseCIDR(exception)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid OutBoundNAT exception %v: %v", exception, err)
+		}
+
+		if !seen[ipNet.String()] {
+			seen[ipNet.String()] = true
+			data.ExceptionList = append(data.ExceptionList, ipNet.String())
+		}
+	}
+
+	serializedData, _ := json.Marshal(data)
+
+	var result []Policy
+	for _, policy := range policies {
+		if !IsPolicyTypeOutBoundNAT(policy) {
+			result = append(result, policy)
+		}
+	}
+
+	result = append(result, Policy{Type: EndpointPolicy, Data: serializedData})
+
+	return result, nil
+}
+
+// RoutePolicy is the HNS endpoint policy describing a route inside the container.
+type RoutePolicy struct {
+	hcsshim.Policy
+	DestinationPrefix string `json:"DestinationPrefix,omitempty"`
+	NextHop           string `json:"NextHop,omitempty"`
+	EncapEnabled      bool   `json:"NeedEncap,omitempty"`
+}
+
+// SerializeRoutePolicy formulates a route policy and returns serialized json
+func SerializeRoutePolicy(destinationPrefix string, nextHop string, needEncap bool) json.RawMessage {
+	routePolicy := RoutePolicy{
+		DestinationPrefix: destinationPrefix,
+		NextHop:           nextHop,
+		EncapEnabled:      needEncap,
+	}
+	routePolicy.Type = hcsshim.Route
+
+	serializedRoutePolicy, _ := json.Marshal(routePolicy)
+	return serializedRoutePolicy
+}
+
+// GetHNSPolicyType returns the type of a serialized HNS policy.
+func GetHNSPolicyType(hnsPolicy json.RawMessage) hcsshim.PolicyType {
+	var data hcsshim.Policy
+	if err := json.Unmarshal(hnsPolicy, &data); err != nil {
+		return ""
+	}
+
+	return data.Type
+}
+
+// HasHNSPolicy returns true if the serialized HNS policies contain a policy of the given type.
+func HasHNSPolicy(hnsPolicies []json.RawMessage, policyType hcsshim.PolicyType) bool {
+	for _, hnsPolicy := range hnsPolicies {
+		if GetHNSPolicyType(hnsPolicy) == policyType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hcnOutboundNatPolicySetting adds the loopback DSR destinations, which the vendored HCN schema lacks,
+// to the HCN OutBoundNAT policy settings.
+type hcnOutboundNatPolicySetting struct {
+	hcn.OutboundNatPolicySetting
+	Destinations []string `json:",omitempty"`
+}
+
+// GetHcnEndpointPolicies translates serialized HNS V1 endpoint policies to the HCN schema. It returns
+// an error for policies that have no HCN equivalent, such as VLAN policies.
+func GetHcnEndpointPolicies(hnsPolicies []json.RawMessage) ([]hcn.EndpointPolicy, error) {
+	var hcnPolicies []hcn.EndpointPolicy
+	for _, hnsPolicy := range hnsPolicies {
+		hcnPolicy, err := getHcnEndpointPolicy(hnsPolicy)
+		if err != nil {
+			return nil, err
+		}
+
+		hcnPolicies = append(hcnPolicies, hcnPolicy)
+	}
+
+	return hcnPolicies, nil
+}
+
+// getHcnEndpointPolicy translates a serialized HNS V1 endpoint policy to the HCN schema.
+func getHcnEndpointPolicy(hnsPolicy json.RawMessage) (hcn.EndpointPolicy, error) {
+	var policyType hcn.EndpointPolicyType
+	var settings interface{}
+
+	switch hnsPolicyType := GetHNSPolicyType(hnsPolicy); hnsPolicyType {
+	case hcsshim.OutboundNat:
+		var data struct {
+			hcsshim.OutboundNatPolicy
+			Destinations []string
+		}
+		if err := json.Unmarshal(hnsPolicy, &data); err != nil {
+			return hcn.EndpointPolicy{}, err
+		}
+
+		policyType = hcn.OutBoundNAT
+		settings = hcnOutboundNatPolicySetting{
+			OutboundNatPolicySetting: hcn.OutboundNatPolicySetting{
+				VirtualIP:  data.VIP,
+				Exceptions: data.Exceptions,
+			},
+			Destinations: data.Destinations,
+		}
+
+	case hcsshim.Nat:
+		var data hcsshim.NatPolicy
+		if err := json.Unmarshal(hnsPolicy, &data); err != nil {
+			return hcn.EndpointPolicy{}, err
+		}
+
+		protocol, ok := natProtocols[strings.ToUpper(data.Protocol)]
+		if !ok {
+			return hcn.EndpointPolicy{}, fmt.Errorf("Invalid NAT protocol %v", data.Protocol)
+		}
+
+		policyType = hcn.PortMapping
+		settings = hcn.PortMappingPolicySetting{
+			Protocol:     protocol,
+			InternalPort: data.InternalPort,
+			ExternalPort: data.ExternalPort,
+		}
+
+	case hcsshim.ACL:
+		var data hcsshim.ACLPolicy
+		if err := json.Unmarshal(hnsPolicy, &data); err != nil {
+			return hcn.EndpointPolicy{}, err
+		}
+
+		// HCN takes a list of protocol numbers instead of a single one.
+		protocols := data.Protocols
+		if protocols == "" && data.Protocol != 0 {
+			protocols = strconv.Itoa(int(data.Protocol))
+		}
+
+		policyType = hcn.ACL
+		settings = hcn.AclPolicySetting{
+			Protocols:       protocols,
+			Action:          hcn.ActionType(data.Action),
+			Direction:       hcn.DirectionType(data.Direction),
+			LocalAddresses:  data.LocalAddresses,
+			RemoteAddresses: data.RemoteAddresses,
+			LocalPorts:      data.LocalPorts,
+			RemotePorts:     data.RemotePorts,
+			RuleType:        hcn.RuleType(data.RuleType),
+			Priority:        data.Priority,
+		}
+
+	case hcsshim.QOS:
+		var data hcsshim.QosPolicy
+		if err := json.Unmarshal(hnsPolicy, &data); err != nil {
+			return hcn.EndpointPolicy{}, err
+		}
+
+		policyType = hcn.QOS
+		settings = hcn.QosPolicySetting{
+			MaximumOutgoingBandwidthInBytes: data.MaximumOutgoingBandwidthInBytes,
+		}
+
+	case hcsshim.Route:
+		var data RoutePolicy
+		if err := json.Unmarshal(hnsPolicy, &data); err != nil {
+			return hcn.EndpointPolicy{}, err
+		}
+
+		policyType = hcn.SDNRoute
+		settings = hcn.SDNRoutePolicySetting{
+			DestinationPrefix: data.DestinationPrefix,
+			NextHop:           data.NextHop,
+			NeedEncap:         data.EncapEnabled,
+		}
+
+	default:
+		return hcn.EndpointPolicy{}, fmt.Errorf("%v endpoint policy is not supported by HCN", hnsPolicyType)
+	}
+
+	serializedSettings, err := json.Marshal(settings)
+	if err != nil {
+		return hcn.EndpointPolicy{}, err
+	}
+
+	return hcn.EndpointPolicy{Type: policyType, Settings: serializedSettings}, nil
+}
+
+// SerializeACLPolicies validates the ACL policies and returns them serialized as HNS ACL policies.
+func SerializeACLPolicies(acls []ACLPolicy) ([]json.RawMessage, error) {
+	var jsonPolicies []json.RawMessage
+	for _, acl := range acls {
+		if err := acl.Validate(); err != nil {
+			return nil, err
+		}
+
+		aclPolicy := hcsshim.ACLPolicy{
+			Type:            hcsshim.ACL,
+			Protocol:        acl.GetProtocolNumber(),
+			Action:          hcsshim.ActionType(acl.Action),
+			Direction:       hcsshim.DirectionType(acl.Direction),
+			LocalPorts:      acl.LocalPorts,
+			RemotePorts:     acl.RemotePorts,
+			RemoteAddresses: acl.RemoteCIDR,
+			RuleType:        hcsshim.Switch,
+			Priority:        acl.Priority,
+		}
+
+		serializedAclPolicy, _ := json.Marshal(aclPolicy)
+		jsonPolicies = append(jsonPolicies, serializedAclPolicy)
+	}
+
+	return jsonPolicies, nil
+}
+
+// LoopbackDSRPolicy is the HNS endpoint policy that lets host processes reach the endpoint through loopback DSR.
+type LoopbackDSRPolicy struct {
+	hcsshim.Policy
+	Destinations []string `json:"Destinations"`
+}
+
+// SerializeLoopbackDSRPolicy formulates a loopback DSR policy for the given addresses and returns serialized json
+func SerializeLoopbackDSRPolicy(destinations []string) json.RawMessage {
+	loopbackDSRPolicy := LoopbackDSRPolicy{Destinations: destinations}
+	loopbackDSRPolicy.Type = hcsshim.OutboundNat
+
+	serializedLoopbackDSRPolicy, _ := json.Marshal(loopbackDSRPolicy)
+	return serializedLoopbackDSRPolicy
+}
+
+// SerializeNetworkScopedPolicies validates network scoped policies and returns them as HNS network
+// policies, which have the fields of the policy settings along with the policy type.
+func SerializeNetworkScopedPolicies(policies []NetworkScopedPolicy) ([]json.RawMessage, error) {
+	var hnsPolicies []json.RawMessage
+	for _, policy := range policies {
+		if err := policy.Validate(); err != nil {
+			return nil, err
+		}
+
+		if policy.IsRule() {
+			return nil, fmt.Errorf("%v network policy is not supported on Windows", policy.Type)
+		}
+
+		settings, err := policy.GetSettings()
+		if err != nil {
+			return nil, err
+		}
+
+		settings["Type"] = policy.Type
+
+		hnsPolicy, err := json.Marshal(settings)
+		if err != nil {
+			return nil, err
+		}
+
+		hnsPolicies = append(hnsPolicies, hnsPolicy)
+	}
+
+	return hnsPolicies, nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package policy
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/hcn"
+)
+
+// Tests that OutBoundNAT exceptions are merged with the configured policy, validated and deduplicated.
+func TestAddOutBoundNatExceptions(t *testing.T) {
+	policies := []Policy{
+		{
+			Type: EndpointPolicy,
+			Data: json.RawMessage(`{"Type":"OutBoundNAT","ExceptionList":["10.240.0.0/16","10.0.0.0/8"]}`),
+		},
+		{
+			Type: EndpointPolicy,
+			Data: json.RawMessage(`{"Type":"ROUTE","DestinationPrefix":"10.0.0.0/8","NeedEncap":true}`),
+		},
+	}
+
+	policies, err := AddOutBoundNatExceptions(policies, []string{"10.0.0.0/8", "192.168.1.10/24", "192.168.1.0/24"})
+	if err != nil {
+		t.Fatalf("AddOutBoundNatExceptions failed %v", err)
+	}
+
+	serializedPolicies := SerializePolicies(EndpointPolicy, policies, nil)
+	if len(serializedPolicies) != 2 {
+		t.Fatalf("Unexpected number of policies %v", len(serializedPolicies))
+	}
+
+	expected := `{"Type":"OutBoundNAT","ExceptionList":["10.240.0.0/16","10.0.0.0/8","192.168.1.0/24"]}`
+	if string(serializedPolicies[1]) != expected {
+		t.Errorf("Unexpected OutBoundNAT policy %s, expected %s", serializedPolicies[1], expected)
+	}
+}
+
+// Tests that an OutBoundNAT policy is created when none is configured.
+func TestAddOutBoundNatExceptionsWithoutPolicy(t *testing.T) {
+	policies, err := AddOutBoundNatExceptions(nil, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("AddOutBoundNatExceptions failed %v", err)
+	}
+
+	serializedPolicies := SerializePolicies(EndpointPolicy, policies, nil)
+	expected := `{"Type":"OutBoundNAT","ExceptionList":["10.0.0.0/8"]}`
+	if len(serializedPolicies) != 1 || string(serializedPolicies[0]) != expected {
+		t.Errorf("Unexpected policies %s, expected %s", serializedPolicies, expected)
+	}
+}
+
+// Tests that invalid OutBoundNAT exceptions are rejected.
+func TestAddOutBoundNatExceptionsInvalidCIDR(t *testing.T) {
+	if _, err := AddOutBoundNatExceptions(nil, []string{"10.0.0.1"}); err == nil {
+		t.Errorf("Expected invalid CIDR to be rejected")
+	}
+}
+
+// Tests that HNS V1 endpoint policies are translated to the HCN schema.
+func TestGetHcnEndpointPolicies(t *testing.T) {
+	hnsPolicies := []json.RawMessage{
+		json.RawMessage(`{"Type":"OutBoundNAT","ExceptionList":["10.0.0.0/8"]}`),
+		json.RawMessage(`{"Type":"NAT","Protocol":"udp","InternalPort":53,"ExternalPort":5353}`),
+		json.RawMessage(`{"Type":"ACL","Protocol":6,"Action":"Block","Direction":"Out","RemotePorts":"443","RuleType":"Switch","Priority":300}`),
+		json.RawMessage(`{"Type":"QOS","MaximumOutgoingBandwidthInBytes":1000}`),
+		SerializeRoutePolicy("10.1.0.0/16", "10.0.0.1", true),
+	}
+
+	hcnPolicies, err := GetHcnEndpointPolicies(hnsPolicies)
+	if err != nil {
+		t.Fatalf("GetHcnEndpointPolicies failed %v", err)
+	}
+
+	expected := []hcn.EndpointPolicy{
+		{Type: hcn.OutBoundNAT, Settings: json.RawMessage(`{"Exceptions":["10.0.0.0/8"]}`)},
+		{Type: hcn.PortMapping, Settings: json.RawMessage(`{"Protocol":17,"InternalPort":53,"ExternalPort":5353}`)},
+		{Type: hcn.ACL, Settings: json.RawMessage(`{"Protocols":"6","Action":"Block","Direction":"Out","RemotePorts":"443","RuleType":"Switch","Priority":300}`)},
+		{Type: hcn.QOS, Settings: json.RawMessage(`{"MaximumOutgoingBandwidthInBytes":1000}`)},
+		{Type: hcn.SDNRoute, Settings: json.RawMessage(`{"DestinationPrefix":"10.1.0.0/16","NextHop":"10.0.0.1","NeedEncap":true}`)},
+	}
+
+	if len(hcnPolicies) != len(expected) {
+		t.Fatalf("Unexpected HCN policies %+v", hcnPolicies)
+	}
+
+	for i := range expected {
+		if hcnPolicies[i].Type != expected[i].Type || string(hcnPolicies[i].Settings) != string(expected[i].Settings) {
+			t.Errorf("Unexpected HCN policy %v %s, expected %v %s",
+				hcnPolicies[i].Type, hcnPolicies[i].Settings, expected[i].Type, expected[i].Settings)
+		}
+	}
+}
+
+// Tests that HNS V1 endpoint policies without an HCN equivalent are rejected.
+func TestGetHcnEndpointPoliciesUnsupported(t *testing.T) {
+	if _, err := GetHcnEndpointPolicies([]json.RawMessage{json.RawMessage(`{"Type":"VLAN","VLAN":100}`)}); err == nil {
+		t.Errorf("Expected VLAN policy to be rejected")
+	}
+}
+
+// Tests that ACL policies are serialized as HNS ACL policies.
+func TestSerializeACLPolicies(t *testing.T) {
+	acls := []ACLPolicy{
+		{
+			Action:     ACLActionAllow,
+			Direction:  ACLDirectionIn,
+			Protocol:   "tcp",
+			LocalPorts: "80,8080-8090",
+			RemoteCIDR: "10.0.0.0/8",
+			Priority:   200,
+		},
+	}
+
+	serializedPolicies, err := SerializeACLPolicies(acls)
+	if err != nil {
+		t.Fatalf("SerializeACLPolicies failed %v", err)
+	}
+
+	expected := `{"Type":"ACL","Protocol":6,"InternalPort":0,"Action":"Allow","Direction":"In","LocalAddresses":"",` +
+		`"RemoteAddresses":"10.0.0.0/8","LocalPorts":"80,8080-8090","LocalPort":0,"RemotePort":0,"RuleType":"Switch",` +
+		`"Priority":200,"ServiceName":""}`
+	if len(serializedPolicies) != 1 || string(serializedPolicies[0]) != expected {
+		t.Errorf("Unexpected ACL policies %s, expected %s", serializedPolicies, expected)
+	}
+}
+
+// Tests that invalid ACL policies are rejected.
+func TestSerializeACLPoliciesInvalid(t *testing.T) {
+	valid := ACLPolicy{Action: ACLActionBlock, Direction: ACLDirectionOut, Protocol: "UDP", Priority: 1000}
+
+	invalid := []ACLPolicy{valid, valid, valid, valid, valid, valid, valid}
+	invalid[0].Action = "Deny"
+	invalid[1].Direction = "Both"
+	invalid[2].Protocol = "SCTP"
+	invalid[3].Priority = 50
+	invalid[4].RemotePorts = "70000"
+	invalid[5].Protocol, invalid[5].LocalPorts = "ICMP", "80"
+	invalid[6].RemoteCIDR = "10.0.0.300/8"
+
+	for _, acl := range invalid {
+		if _, err := SerializeACLPolicies([]ACLPolicy{acl}); err == nil {
+			t.Errorf("Expected ACL policy %+v to be rejected", acl)
+		}
+	}
+}
+
+// Tests that the destinations of loopback DSR policies are kept in the HCN OutBoundNAT policy.
+func TestGetHcnEndpointPoliciesLoopbackDSR(t *testing.T) {
+	hcnPolicies, err := GetHcnEndpointPolicies([]json.RawMessage{SerializeLoopbackDSRPolicy([]string{"10.0.0.4"})})
+	if err != nil {
+		t.Fatalf("GetHcnEndpointPolicies failed %v", err)
+	}
+
+	expected := `{"Destinations":["10.0.0.4"]}`
+	if len(hcnPolicies) != 1 || hcnPolicies[0].Type != hcn.OutBoundNAT || string(hcnPolicies[0].Settings) != expected {
+		t.Errorf("Unexpected HCN policies %+v", hcnPolicies)
+	}
+}
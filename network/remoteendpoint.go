@@ -0,0 +1,97 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"net"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+// RemoteEndpointInfo describes an endpoint of an overlay network on another node.
+type RemoteEndpointInfo struct {
+	MacAddress net.HardwareAddr
+	NodeIP     net.IP
+}
+
+// addRemoteEndpoint programs a remote endpoint on the network. Remote endpoints are identified by their
+// MAC address, so adding one that moved to another node updates it. Returns whether the network changed.
+func (nw *network) addRemoteEndpoint(remoteEpInfo *RemoteEndpointInfo) (bool, error) {
+	if nw.Mode != opModeOverlay {
+		return false, errRemoteEndpointNotSupported
+	}
+
+	if len(remoteEpInfo.MacAddress) == 0 || remoteEpInfo.NodeIP == nil {
+		return false, errRemoteEndpointInvalid
+	}
+
+	remoteEp := &RemoteEndpointInfo{
+		MacAddress: append(net.HardwareAddr{}, remoteEpInfo.MacAddress...),
+		NodeIP:     copyIP(remoteEpInfo.NodeIP),
+	}
+
+	// Program the endpoint even if it is unchanged, in case the host lost its entries.
+	log.Printf("[net] Adding remote endpoint %v on node %v to network %v.", remoteEp.MacAddress, remoteEp.NodeIP, nw.Id)
+	if err := nw.addRemoteEndpointImpl(remoteEp); err != nil {
+		return false, err
+	}
+
+	key := remoteEp.MacAddress.String()
+	existing := nw.RemoteEndpoints[key]
+	if existing != nil && existing.NodeIP.Equal(remoteEp.NodeIP) {
+		return false, nil
+	}
+
+	if nw.RemoteEndpoints == nil {
+		nw.RemoteEndpoints = make(map[string]*RemoteEndpointInfo)
+	}
+
+	nw.RemoteEndpoints[key] = remoteEp
+
+	// The endpoint moved, stop flooding traffic to its previous node if nothing else is there.
+	if existing != nil && !nw.hasRemoteNode(existing.NodeIP) {
+		nw.deleteRemoteNodeImpl(existing.NodeIP)
+	}
+
+	return true, nil
+}
+
+// deleteRemoteEndpoint removes a remote endpoint from the network.
+func (nw *network) deleteRemoteEndpoint(macAddress net.HardwareAddr) error {
+	key := macAddress.String()
+	remoteEp := nw.RemoteEndpoints[key]
+	if remoteEp == nil {
+		return errRemoteEndpointNotFound
+	}
+
+	log.Printf("[net] Deleting remote endpoint %v on node %v from network %v.", remoteEp.MacAddress, remoteEp.NodeIP, nw.Id)
+	nw.deleteRemoteEndpointImpl(remoteEp)
+	delete(nw.RemoteEndpoints, key)
+
+	if !nw.hasRemoteNode(remoteEp.NodeIP) {
+		nw.deleteRemoteNodeImpl(remoteEp.NodeIP)
+	}
+
+	return nil
+}
+
+// hasRemoteNode returns whether the network has a remote endpoint on the given node.
+func (nw *network) hasRemoteNode(nodeIP net.IP) bool {
+	for _, remoteEp := range nw.RemoteEndpoints {
+		if remoteEp.NodeIP.Equal(nodeIP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// restoreRemoteEndpoints programs the persisted remote endpoints on a network that was recreated.
+func (nw *network) restoreRemoteEndpoints() {
+	for _, remoteEp := range nw.RemoteEndpoints {
+		if err := nw.addRemoteEndpointImpl(remoteEp); err != nil {
+			log.Printf("[net] Failed to restore remote endpoint %v of network %v, err:%v.", remoteEp.MacAddress, nw.Id, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+// Snapshot is a diagnostic export of the network manager. It captures the persisted networks and
+// endpoints, the live state of the host and the differences between them. Errors are embedded in
+// the section that failed, so that a single failed query does not lose the rest of the snapshot.
+type Snapshot struct {
+	Time       time.Time
+	Networks   []*NetworkSnapshot
+	Orphans    []*OrphanInfo `json:",omitempty"`
+	Host       *HostSnapshot
+	Diffs      []*SnapshotDiff `json:",omitempty"`
+	DiffErrors []string        `json:",omitempty"`
+}
+
+// NetworkSnapshot is the persisted state of a network and its endpoints.
+type NetworkSnapshot struct {
+	*NetworkInfo
+	Endpoints []*EndpointInfo
+}
+
+// SnapshotDiff describes a difference between the persisted state and the live state of the host,
+// either a persisted network or endpoint whose resources are missing, or a host resource created by
+// this plugin that no endpoint owns.
+type SnapshotDiff struct {
+	NetworkId  string `json:",omitempty"`
+	EndpointId string `json:",omitempty"`
+	Resource   string `json:",omitempty"`
+	Reason     string
+}
+
+// Snapshot returns a diagnostic snapshot of the network manager state. Gathering the live state of
+// the host does not modify it. The returned snapshot is a copy that callers are free to modify.
+func (nm *networkManager) Snapshot() (*Snapshot, error) {
+	nm.RLock()
+	defer nm.RUnlock()
+
+	snapshot := &Snapshot{
+		Time:     time.Now(),
+		Networks: []*NetworkSnapshot{},
+		Host:     getHostSnapshotImpl(),
+	}
+
+	for _, extIf := range nm.ExternalInterfaces {
+		for _, nw := range extIf.Networks {
+			nw.lock.Lock()
+			snapshot.Networks = append(snapshot.Networks, nw.getSnapshot())
+			nw.lock.Unlock()
+		}
+	}
+
+	sort.Slice(snapshot.Networks, func(i, j int) bool { return snapshot.Networks[i].Id < snapshot.Networks[j].Id })
+
+	for _, orphan := range nm.Orphans {
+		orphanCopy := *orphan
+		orphanCopy.Data = append([]byte(nil), orphan.Data...)
+		snapshot.Orphans = append(snapshot.Orphans, &orphanCopy)
+	}
+
+	nm.diffSnapshot(snapshot)
+
+	log.Printf("[net] Took snapshot of %v networks with %v differences.", len(snapshot.Networks), len(snapshot.Diffs))
+
+	return snapshot, nil
+}
+
+// getSnapshot returns the persisted state of the network and its endpoints, sorted by ID.
+// The caller holds the network lock.
+func (nw *network) getSnapshot() *NetworkSnapshot {
+	nwSnapshot := &NetworkSnapshot{NetworkInfo: nw.getInfo(), Endpoints: []*EndpointInfo{}}
+
+	for _, ep := range nw.Endpoints {
+		nwSnapshot.Endpoints = append(nwSnapshot.Endpoints, ep.getInfo().copy())
+	}
+
+	sort.Slice(nwSnapshot.Endpoints, func(i, j int) bool { return nwSnapshot.Endpoints[i].Id < nwSnapshot.Endpoints[j].Id })
+
+	return nwSnapshot
+}
+
+// diffSnapshot records the persisted networks and endpoints whose host resources are missing and the
+// host resources that no endpoint owns, using the same read-only checks as restore and reconciliation.
+// The caller holds the manager lock.
+func (nm *networkManager) diffSnapshot(snapshot *Snapshot) {
+	resources, err := listEndpointResourcesImpl()
+	if err != nil {
+		snapshot.DiffErrors = append(snapshot.DiffErrors, "Failed to list endpoint resources: "+err.Error())
+	}
+
+	for _, extIf := range nm.ExternalInterfaces {
+		for _, nw := range extIf.Networks {
+			nw.lock.Lock()
+
+			exists, err := nm.networkExistsImpl(nw)
+			if err != nil {
+				snapshot.DiffErrors = append(snapshot.DiffErrors, "Failed to verify network "+nw.Id+": "+err.Error())
+			} else if !exists {
+				snapshot.Diffs = append(snapshot.Diffs, &SnapshotDiff{NetworkId: nw.Id, Reason: "Network no longer exists on the host"})
+			}
+
+			if resources != nil {
+				for endpointId, ep := range nw.Endpoints {
+					if err := ep.checkResourcesImpl(resources); err != nil {
+						snapshot.Diffs = append(snapshot.Diffs, &SnapshotDiff{NetworkId: nw.Id, EndpointId: endpointId, Reason: err.Error()})
+					}
+				}
+			}
+
+			nw.lock.Unlock()
+		}
+	}
+
+	orphans, err := nm.findOrphanedResourcesImpl()
+	if err != nil {
+		snapshot.DiffErrors = append(snapshot.DiffErrors, "Failed to find orphaned resources: "+err.Error())
+	}
+
+	for resource, reason := range orphans {
+		snapshot.Diffs = append(snapshot.Diffs, &SnapshotDiff{Resource: resource, Reason: reason})
+	}
+
+	sort.SliceStable(snapshot.Diffs, func(i, j int) bool {
+		a, b := snapshot.Diffs[i], snapshot.Diffs[j]
+		if a.NetworkId != b.NetworkId {
+			return a.NetworkId < b.NetworkId
+		}
+		if a.EndpointId != b.EndpointId {
+			return a.EndpointId < b.EndpointId
+		}
+		return a.Resource < b.Resource
+	})
+}
@@ -0,0 +1,139 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/azure-container-networking/netlink"
+)
+
+const (
+	// Sysfs link to the bridge or bond an interface is enslaved to.
+	masterPathFormat = "/sys/class/net/%s/master"
+)
+
+// HostSnapshot is the live state of the interfaces and routes of the host.
+type HostSnapshot struct {
+	Interfaces      []*InterfaceSnapshot `json:",omitempty"`
+	InterfacesError string               `json:",omitempty"`
+	Routes          []*RouteSnapshot     `json:",omitempty"`
+	RoutesError     string               `json:",omitempty"`
+}
+
+// InterfaceSnapshot is the live state of a host interface. Master is the bridge the interface
+// is connected to, if any.
+type InterfaceSnapshot struct {
+	Name       string
+	Index      int
+	MTU        int
+	MacAddress string   `json:",omitempty"`
+	Flags      string   `json:",omitempty"`
+	OperState  string   `json:",omitempty"`
+	Master     string   `json:",omitempty"`
+	Addresses  []string `json:",omitempty"`
+	Error      string   `json:",omitempty"`
+}
+
+// RouteSnapshot is a route in the main routing table of the host.
+type RouteSnapshot struct {
+	Dst       string
+	Src       string `json:",omitempty"`
+	Gw        string `json:",omitempty"`
+	Interface string `json:",omitempty"`
+	Protocol  int
+	Scope     int
+	Priority  int `json:",omitempty"`
+}
+
+// getHostSnapshotImpl queries the interfaces and routes of the host. Netlink and sysfs are only
+// read, never written.
+func getHostSnapshotImpl() *HostSnapshot {
+	host := &HostSnapshot{}
+	ifNames := make(map[int]string)
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		host.InterfacesError = err.Error()
+	}
+
+	for i := range interfaces {
+		ifSnapshot := getInterfaceSnapshot(&interfaces[i])
+		host.Interfaces = append(host.Interfaces, ifSnapshot)
+		ifNames[ifSnapshot.Index] = ifSnapshot.Name
+	}
+
+	routes, err := netlink.GetIpRoute(&netlink.Route{})
+	if err != nil {
+		host.RoutesError = err.Error()
+	}
+
+	for _, route := range routes {
+		routeSnapshot := &RouteSnapshot{
+			Dst:       "default",
+			Interface: ifNames[route.LinkIndex],
+			Protocol:  route.Protocol,
+			Scope:     route.Scope,
+			Priority:  route.Priority,
+		}
+
+		if route.Dst != nil {
+			routeSnapshot.Dst = route.Dst.String()
+		}
+		if route.Src != nil {
+			routeSnapshot.Src = route.Src.String()
+		}
+		if route.Gw != nil {
+			routeSnapshot.Gw = route.Gw.String()
+		}
+
+		host.Routes = append(host.Routes, routeSnapshot)
+	}
+
+	return host
+}
+
+// getInterfaceSnapshot returns the live state of a host interface. Failures to read its addresses,
+// operational state or master are recorded in the snapshot.
+func getInterfaceSnapshot(iface *net.Interface) *InterfaceSnapshot {
+	ifSnapshot := &InterfaceSnapshot{
+		Name:       iface.Name,
+		Index:      iface.Index,
+		MTU:        iface.MTU,
+		MacAddress: iface.HardwareAddr.String(),
+		Flags:      iface.Flags.String(),
+	}
+
+	var errs []string
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	for _, addr := range addrs {
+		ifSnapshot.Addresses = append(ifSnapshot.Addresses, addr.String())
+	}
+
+	operState, err := readSysfsFile(fmt.Sprintf(operStatePathFormat, iface.Name))
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	ifSnapshot.OperState = strings.TrimSpace(string(operState))
+
+	master, err := os.Readlink(fmt.Sprintf(masterPathFormat, iface.Name))
+	if err == nil {
+		ifSnapshot.Master = filepath.Base(master)
+	} else if !os.IsNotExist(err) {
+		errs = append(errs, err.Error())
+	}
+
+	ifSnapshot.Error = strings.Join(errs, "; ")
+
+	return ifSnapshot
+}
@@ -0,0 +1,35 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"github.com/Microsoft/hcsshim"
+)
+
+// HostSnapshot is the live state of the HNS networks and endpoints on the host.
+type HostSnapshot struct {
+	Networks       []hcsshim.HNSNetwork  `json:",omitempty"`
+	NetworksError  string                `json:",omitempty"`
+	Endpoints      []hcsshim.HNSEndpoint `json:",omitempty"`
+	EndpointsError string                `json:",omitempty"`
+}
+
+// getHostSnapshotImpl queries the HNS networks and endpoints. HNS is only queried, never modified.
+func getHostSnapshotImpl() *HostSnapshot {
+	host := &HostSnapshot{}
+
+	hnsNetworks, err := hns.ListNetworkRequest()
+	if err != nil {
+		host.NetworksError = err.Error()
+	}
+	host.Networks = hnsNetworks
+
+	hnsEndpoints, err := hns.ListEndpointRequest()
+	if err != nil {
+		host.EndpointsError = err.Error()
+	}
+	host.Endpoints = hnsEndpoints
+
+	return host
+}
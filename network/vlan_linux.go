@@ -0,0 +1,192 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/Azure/azure-container-networking/log"
+	"github.com/Azure/azure-container-networking/netlink"
+)
+
+const (
+	// Prefixes for the names of the VLAN sub-interfaces and bridges of VLAN networks, followed by
+	// the index of the external interface and the VLAN ID.
+	vlanInterfacePrefix = "azvl"
+	vlanBridgePrefix    = "azvlbr"
+)
+
+// getVlanInterfaceNames returns the names of the VLAN sub-interface of an external interface and of
+// the bridge over it for the given VLAN.
+func getVlanInterfaceNames(extIfName string, vlanId int) (string, string, error) {
+	hostIf, err := net.InterfaceByName(extIfName)
+	if err != nil {
+		return "", "", err
+	}
+
+	vlanIfName := fmt.Sprintf("%s%d.%d", vlanInterfacePrefix, hostIf.Index, vlanId)
+	bridgeName := fmt.Sprintf("%s%d.%d", vlanBridgePrefix, hostIf.Index, vlanId)
+
+	return vlanIfName, bridgeName, nil
+}
+
+// getVlanBridgeName returns the bridge that connects the endpoints of a VLAN network tagged with the
+// given VLAN. Endpoints tagged with the VLAN of the network use the bridge of the network.
+func (nw *network) getVlanBridgeName(vlanId int) (string, error) {
+	if vlanId == nw.VlanId {
+		return nw.BridgeName, nil
+	}
+
+	_, bridgeName, err := getVlanInterfaceNames(nw.extIf.Name, vlanId)
+	return bridgeName, err
+}
+
+// createVlanBridge creates a VLAN sub-interface of the external interface and a bridge over it.
+// Unlike bridge mode, the external interface is not connected to the bridge, so the traffic of
+// its endpoints leaves the host tagged with the VLAN. Existing interfaces are reused.
+func createVlanBridge(extIfName string, vlanIfName string, bridgeName string, vlanId int, mtu int) error {
+	hostIf, err := net.InterfaceByName(extIfName)
+	if err != nil {
+		return err
+	}
+
+	var createdIfNames []string
+
+	// On failure, delete the interfaces created.
+	defer func() {
+		if err != nil {
+			deleteVlanBridge(createdIfNames...)
+		}
+	}()
+
+	if _, err = net.InterfaceByName(bridgeName); err != nil {
+		log.Printf("[net] Creating bridge %v.", bridgeName)
+		link := netlink.BridgeLink{
+			LinkInfo: netlink.LinkInfo{
+				Type: netlink.LINK_TYPE_BRIDGE,
+				Name: bridgeName,
+			},
+		}
+
+		if err = netlink.AddLink(&link); err != nil {
+			return err
+		}
+
+		createdIfNames = append(createdIfNames, bridgeName)
+	} else {
+		log.Printf("[net] Found existing bridge %v.", bridgeName)
+	}
+
+	if _, err = net.InterfaceByName(vlanIfName); err != nil {
+		log.Printf("[net] Creating VLAN interface %v with ID %v on %v.", vlanIfName, vlanId, extIfName)
+		link := netlink.VlanLink{
+			LinkInfo: netlink.LinkInfo{
+				Type:        netlink.LINK_TYPE_VLAN,
+				Name:        vlanIfName,
+				ParentIndex: hostIf.Index,
+			},
+			VlanId: uint16(vlanId),
+		}
+
+		if err = netlink.AddLink(&link); err != nil {
+			return err
+		}
+
+		createdIfNames = append(createdIfNames, vlanIfName)
+	} else {
+		log.Printf("[net] Found existing VLAN interface %v.", vlanIfName)
+	}
+
+	log.Printf("[net] Setting link %v master %v.", vlanIfName, bridgeName)
+	if err = netlink.SetLinkMaster(vlanIfName, bridgeName); err != nil {
+		return err
+	}
+
+	if mtu > 0 {
+		log.Printf("[net] Setting MTU of link %v to %v.", bridgeName, mtu)
+		if err = netlink.SetLinkMTU(bridgeName, mtu); err != nil {
+			return err
+		}
+	}
+
+	for _, ifName := range []string{vlanIfName, bridgeName} {
+		log.Printf("[net] Setting link %v state up.", ifName)
+		if err = netlink.SetLinkState(ifName, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteVlanBridge deletes the VLAN sub-interfaces and bridges with the given names.
+func deleteVlanBridge(ifNames ...string) {
+	for _, ifName := range ifNames {
+		log.Printf("[net] Deleting link %v.", ifName)
+		if err := netlink.DeleteLink(ifName); err != nil {
+			log.Printf("[net] Failed to delete link %v, err:%v.", ifName, err)
+		}
+	}
+}
+
+// addEndpointVlan creates the bridge for an endpoint whose VLAN overrides the VLAN of its network.
+func (nw *network) addEndpointVlan(vlanId int) error {
+	if vlanId == nw.VlanId {
+		return nil
+	}
+
+	if vlanId < minVlanID || vlanId > maxVlanID {
+		log.Printf("[net] Invalid VLAN ID %v, must be between %v and %v.", vlanId, minVlanID, maxVlanID)
+		return errInvalidVlanID
+	}
+
+	vlanIfName, bridgeName, err := getVlanInterfaceNames(nw.extIf.Name, vlanId)
+	if err != nil {
+		return err
+	}
+
+	return createVlanBridge(nw.extIf.Name, vlanIfName, bridgeName, vlanId, nw.MTU)
+}
+
+// deleteEndpointVlan deletes the bridge for an endpoint whose VLAN overrides the VLAN of its network,
+// unless another endpoint of the network is tagged with the same VLAN.
+func (nw *network) deleteEndpointVlan(vlanId int, epId string) {
+	if vlanId == nw.VlanId {
+		return
+	}
+
+	for _, ep := range nw.Endpoints {
+		if ep.Id != epId && ep.VlanID == vlanId {
+			return
+		}
+	}
+
+	vlanIfName, bridgeName, err := getVlanInterfaceNames(nw.extIf.Name, vlanId)
+	if err != nil {
+		log.Printf("[net] Failed to find interfaces of VLAN %v, err:%v.", vlanId, err)
+		return
+	}
+
+	deleteVlanBridge(vlanIfName, bridgeName)
+}
+
+// deleteVlanBridges deletes the bridges of a VLAN network, including those of its endpoints whose
+// VLAN overrides the VLAN of the network.
+func (nw *network) deleteVlanBridges() {
+	deleted := map[int]bool{nw.VlanId: true}
+
+	for _, ep := range nw.Endpoints {
+		if deleted[ep.VlanID] {
+			continue
+		}
+
+		deleted[ep.VlanID] = true
+		if vlanIfName, bridgeName, err := getVlanInterfaceNames(nw.extIf.Name, ep.VlanID); err == nil {
+			deleteVlanBridge(vlanIfName, bridgeName)
+		}
+	}
+
+	deleteVlanBridge(nw.VlanIfName, nw.BridgeName)
+}
@@ -6,8 +6,10 @@ package telemetry
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -32,6 +34,12 @@ const (
 	ContentType = "application/json"
 )
 
+var (
+	// Clients of the host endpoints receiving reports and serving interface details and metadata.
+	hostAgentClient = common.NewHostClient(common.HostClientConfig{Name: "Telemetry host query"})
+	metadataClient  = common.NewIMDSClient(common.HostClientConfig{Name: "Telemetry metadata query"})
+)
+
 // OS Details structure.
 type OSInfo struct {
 	OSType         string
@@ -117,7 +125,8 @@ type CNIReport struct {
 	SystemDetails       *SystemInfo
 	InterfaceDetails    *InterfaceInfo
 	BridgeDetails       *BridgeInfo
-	Metadata            Metadata `json:"compute"`
+	Metrics             map[string]float64 `json:",omitempty"`
+	Metadata            Metadata           `json:"compute"`
 }
 
 // ClusterState contains the current kubernetes cluster state.
@@ -139,7 +148,8 @@ type NPMReport struct {
 	EventMessage      string
 	UpTime            string
 	ClusterState      ClusterState
-	Metadata          Metadata `json:"compute"`
+	Metrics           map[string]float64 `json:",omitempty"`
+	Metadata          Metadata           `json:"compute"`
 }
 
 // ReportManager structure.
@@ -205,36 +215,33 @@ func (report *NPMReport) GetReport(clusterID, nodeName, npmVersion, kubernetesVe
 func (reportMgr *ReportManager) SendReport() error {
 	log.Printf("[Telemetry] Going to send Telemetry report to hostnetagent %v", reportMgr.HostNetAgentURL)
 
-	switch reportMgr.Report.(type) {
+	// Include the current metrics of the process in reports that have room for them.
+	switch report := reportMgr.Report.(type) {
 	case *CNIReport:
-		log.Printf("[Telemetry] %+v", reportMgr.Report.(*CNIReport))
+		report.Metrics = common.DefaultMetricsRegistry.Snapshot()
+		log.Printf("[Telemetry] %+v", report)
 	case *NPMReport:
-		log.Printf("[Telemetry] %+v", reportMgr.Report.(*NPMReport))
+		report.Metrics = common.DefaultMetricsRegistry.Snapshot()
+		log.Printf("[Telemetry] %+v", report)
 	default:
 		log.Printf("[Telemetry] %+v", reportMgr.Report)
 	}
 
-	httpc := &http.Client{}
 	var body bytes.Buffer
 	json.NewEncoder(&body).Encode(reportMgr.Report)
-	resp, err := httpc.Post(reportMgr.HostNetAgentURL, reportMgr.ContentType, &body)
+	_, err := hostAgentClient.Post(context.Background(), reportMgr.HostNetAgentURL, reportMgr.ContentType, body.Bytes())
 	if err != nil {
-		return fmt.Errorf("[Telemetry] HTTP Post returned error %v", err)
-	}
-
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		if resp.StatusCode == 400 {
+		var statusErr *common.HostStatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusBadRequest {
 			return fmt.Errorf(`"[Telemetry] HTTP Post returned statuscode %d. 
 				This error happens because telemetry service is not yet activated. 
-				The error can be ignored as it won't affect functionality"`, resp.StatusCode)
+				The error can be ignored as it won't affect functionality"`, statusErr.StatusCode)
 		}
 
-		return fmt.Errorf("[Telemetry] HTTP Post returned statuscode %d", resp.StatusCode)
+		return fmt.Errorf("[Telemetry] HTTP Post returned error %v", err)
 	}
 
-	log.Printf("[Telemetry] Telemetry sent with status code %d\n", resp.StatusCode)
+	log.Printf("[Telemetry] Telemetry sent")
 
 	return nil
 }
@@ -303,19 +310,16 @@ func (report *CNIReport) GetInterfaceDetails(queryUrl string) {
 		return
 	}
 
-	resp, err := http.Get(queryUrl)
+	data, err := hostAgentClient.Get(context.Background(), queryUrl)
 	if err != nil {
 		report.InterfaceDetails = &InterfaceInfo{}
 		report.InterfaceDetails.ErrorMessage = "Http get failed in getting interface details " + err.Error()
 		return
 	}
 
-	defer resp.Body.Close()
-
 	// Decode XML document.
 	var doc common.XmlDocument
-	decoder := xml.NewDecoder(resp.Body)
-	err = decoder.Decode(&doc)
+	err = xml.Unmarshal(data, &doc)
 	if err != nil {
 		report.InterfaceDetails = &InterfaceInfo{}
 		report.InterfaceDetails.ErrorMessage = "xml decode failed due to " + err.Error()
@@ -402,25 +406,18 @@ func (report *CNIReport) GetOrchestratorDetails() {
 
 // GetHostMetadata - retrieve metadata from host
 func (reportMgr *ReportManager) GetHostMetadata() error {
-	req, err := http.NewRequest("GET", metadataURL, nil)
-	if err != nil {
-		return err
-	}
-
-	req.Header.Set("Metadata", "True")
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	data, err := metadataClient.Get(context.Background(), metadataURL)
 	if err != nil {
+		var statusErr *common.HostStatusError
+		if errors.As(err, &statusErr) {
+			err = fmt.Errorf("[Telemetry] Request failed with HTTP error %d", statusErr.StatusCode)
+		}
 		return err
 	}
 
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("[Telemetry] Request failed with HTTP error %d", resp.StatusCode)
-	} else if resp.Body != nil {
+	if len(data) != 0 {
 		report := metadataWrapper{}
-		err = json.NewDecoder(resp.Body).Decode(&report)
+		err = json.Unmarshal(data, &report)
 		if err == nil {
 			// Find Metadata struct in report and try to set values
 			v := reflect.ValueOf(reportMgr.Report).Elem().FieldByName("Metadata")